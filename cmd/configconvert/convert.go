@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"go.universe.tf/metallb/internal/config"
+	"gopkg.in/yaml.v2"
+)
+
+// decodeAll returns the objects in the YAML stream bs, skipping
+// empty documents.
+func decodeAll(bs []byte) ([]object, error) {
+	var ret []object
+	dec := yaml.NewDecoder(bytes.NewReader(bs))
+	for {
+		var obj object
+		err := dec.Decode(&obj)
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if obj.Kind == "" {
+			continue
+		}
+		ret = append(ret, obj)
+	}
+}
+
+// encodeAll writes objs as a YAML stream.
+func encodeAll(objs []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, obj := range objs {
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		bs, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(bs)
+	}
+	return buf.Bytes(), nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	var ret []string
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func selectorsToFork(sels []labelSelector) []forkNodeSelector {
+	var ret []forkNodeSelector
+	for _, s := range sels {
+		ret = append(ret, forkNodeSelector(s))
+	}
+	return ret
+}
+
+func selectorsToUpstream(sels []forkNodeSelector) []labelSelector {
+	var ret []labelSelector
+	for _, s := range sels {
+		ret = append(ret, labelSelector(s))
+	}
+	return ret
+}
+
+// toFork converts upstream metallb.io resources to a ConfigMap in
+// namespace. The generated config is checked with the fork's parser.
+func toFork(bs []byte, namespace, name string) ([]byte, []string, error) {
+	objs, err := decodeAll(bs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding upstream resources: %s", err)
+	}
+
+	var (
+		warnings []string
+		cfg      forkConfig
+		pools    []string // in input order
+		specs    = map[string]ipAddressPoolSpec{}
+		l2       = map[string]bool{}
+		ads      = map[string][]forkBGPAdvertisement{}
+		l2Specs  []l2AdvertisementSpec
+		bgpSpecs []bgpAdvertisementSpec
+	)
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	for _, obj := range objs {
+		if !strings.HasPrefix(obj.APIVersion, "metallb.io/") {
+			warn("skipping %s %q, not a metallb.io resource", obj.Kind, obj.Metadata.Name)
+			continue
+		}
+		var err error
+		switch obj.Kind {
+		case "IPAddressPool":
+			var spec ipAddressPoolSpec
+			if err = remarshal(obj.Spec, &spec); err == nil {
+				pools = append(pools, obj.Metadata.Name)
+				specs[obj.Metadata.Name] = spec
+			}
+		case "BGPPeer":
+			var spec bgpPeerSpec
+			if err = remarshal(obj.Spec, &spec); err == nil {
+				if spec.SourceAddress != "" || spec.EBGPMultiHop || spec.BFDProfile != "" || spec.PasswordSecret != nil || spec.VRF != "" {
+					warn("BGPPeer %q: sourceAddress, ebgpMultiHop, bfdProfile, passwordSecret and vrf are not supported, dropped", obj.Metadata.Name)
+				}
+				cfg.Peers = append(cfg.Peers, forkPeer{
+					MyASN:         spec.MyASN,
+					ASN:           spec.ASN,
+					Addr:          spec.Address,
+					Port:          spec.Port,
+					HoldTime:      spec.HoldTime,
+					RouterID:      spec.RouterID,
+					NodeSelectors: selectorsToFork(spec.NodeSelectors),
+					Password:      spec.Password,
+				})
+			}
+		case "BGPAdvertisement":
+			var spec bgpAdvertisementSpec
+			if err = remarshal(obj.Spec, &spec); err == nil {
+				if len(spec.Peers) > 0 {
+					warn("BGPAdvertisement %q: peers is not supported, advertising to all peers", obj.Metadata.Name)
+				}
+				if len(spec.IPAddressPoolSelectors) > 0 {
+					warn("BGPAdvertisement %q: ipAddressPoolSelectors is not supported, skipped", obj.Metadata.Name)
+					continue
+				}
+				bgpSpecs = append(bgpSpecs, spec)
+			}
+		case "L2Advertisement":
+			var spec l2AdvertisementSpec
+			if err = remarshal(obj.Spec, &spec); err == nil {
+				if len(spec.NodeSelectors) > 0 || len(spec.Interfaces) > 0 {
+					warn("L2Advertisement %q: nodeSelectors and interfaces are not supported, announcing from all nodes and interfaces", obj.Metadata.Name)
+				}
+				if len(spec.IPAddressPoolSelectors) > 0 {
+					warn("L2Advertisement %q: ipAddressPoolSelectors is not supported, skipped", obj.Metadata.Name)
+					continue
+				}
+				l2Specs = append(l2Specs, spec)
+			}
+		case "Community":
+			var spec communitySpec
+			if err = remarshal(obj.Spec, &spec); err == nil {
+				for _, c := range spec.Communities {
+					if cfg.BGPCommunities == nil {
+						cfg.BGPCommunities = map[string]string{}
+					}
+					cfg.BGPCommunities[c.Name] = c.Value
+				}
+			}
+		default:
+			warn("skipping unsupported kind %s %q", obj.Kind, obj.Metadata.Name)
+		}
+		if err != nil {
+			return nil, warnings, fmt.Errorf("decoding %s %q: %s", obj.Kind, obj.Metadata.Name, err)
+		}
+	}
+
+	// Advertisements without pools apply to all pools.
+	for _, spec := range l2Specs {
+		names := spec.IPAddressPools
+		if len(names) == 0 {
+			names = pools
+		}
+		for _, n := range names {
+			l2[n] = true
+		}
+	}
+	for _, spec := range bgpSpecs {
+		names := spec.IPAddressPools
+		if len(names) == 0 {
+			names = pools
+		}
+		for _, n := range names {
+			ads[n] = append(ads[n], forkBGPAdvertisement{
+				AggregationLength: spec.AggregationLength,
+				LocalPref:         spec.LocalPref,
+				Communities:       spec.Communities,
+				NodeSelectors:     selectorsToFork(spec.NodeSelectors),
+			})
+		}
+	}
+
+	for _, n := range pools {
+		spec := specs[n]
+		p := forkPool{
+			Name:          n,
+			Addresses:     spec.Addresses,
+			AvoidBuggyIPs: spec.AvoidBuggyIPs,
+			AutoAssign:    spec.AutoAssign,
+		}
+		switch {
+		case ads[n] != nil && l2[n]:
+			p.Protocols = []string{string(config.BGP), config.Layer2}
+			p.BGPAdvertisements = ads[n]
+		case ads[n] != nil:
+			p.Protocol = string(config.BGP)
+			p.BGPAdvertisements = ads[n]
+		case l2[n]:
+			p.Protocol = config.Layer2
+		default:
+			warn("IPAddressPool %q is not used by any advertisement, skipped", n)
+			continue
+		}
+		cfg.Pools = append(cfg.Pools, p)
+	}
+
+	raw, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, warnings, err
+	}
+	if _, err := config.NewParser(nil).Parse(raw); err != nil {
+		return nil, warnings, fmt.Errorf("converted config is invalid: %s", err)
+	}
+
+	out, err := encodeAll([]interface{}{
+		object{
+			header: header{
+				APIVersion: "v1",
+				Kind:       "ConfigMap",
+				Metadata:   metadata{Name: name, Namespace: namespace},
+			},
+			Data: map[string]string{"config": string(raw)},
+		},
+	})
+	return out, warnings, err
+}
+
+// toUpstream converts a ConfigMap, or the bare contents of its
+// "config" key, to upstream metallb.io resources in namespace.
+func toUpstream(bs []byte, namespace string) ([]byte, []string, error) {
+	objs, err := decodeAll(bs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding ConfigMap: %s", err)
+	}
+	raw := bs
+	for _, obj := range objs {
+		if obj.Kind == "ConfigMap" {
+			raw = []byte(obj.Data["config"])
+			break
+		}
+	}
+	// Validate with the real parser first, so that we don't produce
+	// resources from a config the fork itself would reject.
+	if _, err := config.NewParser(nil).Parse(raw); err != nil {
+		return nil, nil, fmt.Errorf("invalid config: %s", err)
+	}
+	var cfg forkConfig
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("decoding config: %s", err)
+	}
+
+	var (
+		warnings []string
+		out      []interface{}
+	)
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	resource := func(apiVersion, kind, name string, spec interface{}) {
+		out = append(out, object{
+			header: header{
+				APIVersion: apiVersion,
+				Kind:       kind,
+				Metadata:   metadata{Name: name, Namespace: namespace},
+			},
+			Spec: spec,
+		})
+	}
+
+	if cfg.ServiceIPs != nil {
+		warn("service-ip-advertisement is not supported upstream, dropped")
+	}
+
+	for i, p := range cfg.Peers {
+		if p.CommunityFilter != nil || p.SourcePorts != "" || p.AnnouncePodCIDR {
+			warn("peer %s: community-filter, source-ports and announce-pod-cidr are not supported upstream, dropped", p.Addr)
+		}
+		resource("metallb.io/v1beta2", "BGPPeer", fmt.Sprintf("peer-%d", i+1), bgpPeerSpec{
+			MyASN:         p.MyASN,
+			ASN:           p.ASN,
+			Address:       p.Addr,
+			Port:          p.Port,
+			HoldTime:      p.HoldTime,
+			RouterID:      p.RouterID,
+			Password:      p.Password,
+			NodeSelectors: selectorsToUpstream(p.NodeSelectors),
+		})
+	}
+
+	if len(cfg.BGPCommunities) > 0 {
+		spec := communitySpec{}
+		for _, n := range sortedKeys(cfg.BGPCommunities) {
+			spec.Communities = append(spec.Communities, communityAlias{Name: n, Value: cfg.BGPCommunities[n]})
+		}
+		resource("metallb.io/v1beta1", "Community", "communities", spec)
+	}
+
+	for _, p := range cfg.Pools {
+		protos := p.Protocols
+		if len(protos) == 0 {
+			protos = []string{p.Protocol}
+		}
+		if p.Protocol == config.IPAM {
+			warn("pool %q: ipam pools are not supported upstream, skipped", p.Name)
+			continue
+		}
+		if p.MaxLeaseDuration != "" || p.FlapDamping != nil || p.RemovalPolicy != "" {
+			warn("pool %q: max-lease-duration, flap-damping and request-removal-policy are not supported upstream, dropped", p.Name)
+		}
+		avoidBuggyIPs := p.AvoidBuggyIPs
+		switch config.ReservedHostSuffixes(p.ReservedSuffixes) {
+		case config.ReserveEvery24:
+			avoidBuggyIPs = true
+		case config.ReservePoolCIDR:
+			warn("pool %q: reserved-host-suffixes %q is not supported upstream, all addresses will be handed out", p.Name, p.ReservedSuffixes)
+		}
+		resource("metallb.io/v1beta1", "IPAddressPool", p.Name, ipAddressPoolSpec{
+			Addresses:     p.Addresses,
+			AutoAssign:    p.AutoAssign,
+			AvoidBuggyIPs: avoidBuggyIPs,
+		})
+
+		for _, proto := range protos {
+			switch proto {
+			case config.Layer2:
+				resource("metallb.io/v1beta1", "L2Advertisement", p.Name, l2AdvertisementSpec{
+					IPAddressPools: []string{p.Name},
+				})
+			case string(config.BGP):
+				bgpAds := p.BGPAdvertisements
+				if len(bgpAds) == 0 {
+					bgpAds = []forkBGPAdvertisement{{}}
+				}
+				for i, ad := range bgpAds {
+					if len(ad.ExtendedCommunities) > 0 {
+						warn("pool %q: extended-communities are not supported upstream, dropped", p.Name)
+					}
+					name := p.Name
+					if len(bgpAds) > 1 {
+						name = fmt.Sprintf("%s-%d", p.Name, i+1)
+					}
+					resource("metallb.io/v1beta1", "BGPAdvertisement", name, bgpAdvertisementSpec{
+						AggregationLength: ad.AggregationLength,
+						LocalPref:         ad.LocalPref,
+						Communities:       ad.Communities,
+						IPAddressPools:    []string{p.Name},
+						NodeSelectors:     selectorsToUpstream(ad.NodeSelectors),
+					})
+				}
+			}
+		}
+	}
+
+	ret, err := encodeAll(out)
+	return ret, warnings, err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v2"
+)
+
+const upstreamResources = `
+apiVersion: metallb.io/v1beta1
+kind: IPAddressPool
+metadata:
+  name: public
+  namespace: metallb-system
+spec:
+  addresses:
+  - 10.20.0.0/24
+  autoAssign: false
+---
+apiVersion: metallb.io/v1beta1
+kind: IPAddressPool
+metadata:
+  name: office
+spec:
+  addresses:
+  - 192.168.10.0/24
+---
+apiVersion: metallb.io/v1beta1
+kind: IPAddressPool
+metadata:
+  name: unused
+spec:
+  addresses:
+  - 192.168.20.0/24
+---
+apiVersion: metallb.io/v1beta2
+kind: BGPPeer
+metadata:
+  name: tor
+spec:
+  myASN: 64512
+  peerASN: 64513
+  peerAddress: 10.0.0.1
+  holdTime: 90s
+  nodeSelectors:
+  - matchLabels:
+      rack: a
+  ebgpMultiHop: true
+---
+apiVersion: metallb.io/v1beta1
+kind: Community
+metadata:
+  name: aliases
+spec:
+  communities:
+  - name: no-export
+    value: 65535:65281
+---
+apiVersion: metallb.io/v1beta1
+kind: BGPAdvertisement
+metadata:
+  name: public
+spec:
+  ipAddressPools: [public]
+  aggregationLength: 24
+  communities: [no-export]
+  nodeSelectors:
+  - matchLabels:
+      role: border
+---
+apiVersion: metallb.io/v1beta1
+kind: BGPAdvertisement
+metadata:
+  name: office-bgp
+spec:
+  ipAddressPools: [office]
+---
+apiVersion: metallb.io/v1beta1
+kind: L2Advertisement
+metadata:
+  name: office-l2
+spec:
+  ipAddressPools: [office]
+`
+
+func decodeConfigMap(t *testing.T, bs []byte) forkConfig {
+	objs, err := decodeAll(bs)
+	if err != nil || len(objs) != 1 || objs[0].Kind != "ConfigMap" {
+		t.Fatalf("output is not a single ConfigMap: %v\n%s", err, bs)
+	}
+	var cfg forkConfig
+	if err := yaml.UnmarshalStrict([]byte(objs[0].Data["config"]), &cfg); err != nil {
+		t.Fatalf("decoding converted config: %s", err)
+	}
+	return cfg
+}
+
+func TestToFork(t *testing.T) {
+	out, warnings, err := toFork([]byte(upstreamResources), "metallb-system", "config")
+	if err != nil {
+		t.Fatalf("toFork failed: %s", err)
+	}
+
+	f := false
+	agg := 24
+	want := forkConfig{
+		Peers: []forkPeer{
+			{
+				MyASN:    64512,
+				ASN:      64513,
+				Addr:     "10.0.0.1",
+				HoldTime: "90s",
+				NodeSelectors: []forkNodeSelector{
+					{MatchLabels: map[string]string{"rack": "a"}},
+				},
+			},
+		},
+		BGPCommunities: map[string]string{"no-export": "65535:65281"},
+		Pools: []forkPool{
+			{
+				Name:       "public",
+				Protocol:   "bgp",
+				Addresses:  []string{"10.20.0.0/24"},
+				AutoAssign: &f,
+				BGPAdvertisements: []forkBGPAdvertisement{
+					{
+						AggregationLength: &agg,
+						Communities:       []string{"no-export"},
+						NodeSelectors: []forkNodeSelector{
+							{MatchLabels: map[string]string{"role": "border"}},
+						},
+					},
+				},
+			},
+			{
+				Name:              "office",
+				Protocols:         []string{"bgp", "layer2"},
+				Addresses:         []string{"192.168.10.0/24"},
+				BGPAdvertisements: []forkBGPAdvertisement{{}},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, decodeConfigMap(t, out)); diff != "" {
+		t.Errorf("unexpected config (-want +got)\n%s", diff)
+	}
+
+	wantWarnings := []string{
+		`BGPPeer "tor": sourceAddress, ebgpMultiHop, bfdProfile, passwordSecret and vrf are not supported, dropped`,
+		`IPAddressPool "unused" is not used by any advertisement, skipped`,
+	}
+	if diff := cmp.Diff(wantWarnings, warnings); diff != "" {
+		t.Errorf("unexpected warnings (-want +got)\n%s", diff)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	fork, _, err := toFork([]byte(upstreamResources), "metallb-system", "config")
+	if err != nil {
+		t.Fatalf("toFork failed: %s", err)
+	}
+	upstream, warnings, err := toUpstream(fork, "metallb-system")
+	if err != nil {
+		t.Fatalf("toUpstream failed: %s", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings converting back: %v", warnings)
+	}
+	again, _, err := toFork(upstream, "metallb-system", "config")
+	if err != nil {
+		t.Fatalf("toFork of converted resources failed: %s", err)
+	}
+	if diff := cmp.Diff(decodeConfigMap(t, fork), decodeConfigMap(t, again)); diff != "" {
+		t.Errorf("config changed in round trip (-first +second)\n%s", diff)
+	}
+}
+
+func TestToUpstreamWarnings(t *testing.T) {
+	raw := `
+peers:
+- my-asn: 64512
+  peer-asn: 64513
+  peer-address: 10.0.0.1
+  source-ports: 40000-40099
+address-pools:
+- name: leased
+  protocol: layer2
+  addresses:
+  - 10.20.0.0/24
+  max-lease-duration: 24h
+`
+	out, warnings, err := toUpstream([]byte(raw), "metallb-system")
+	if err != nil {
+		t.Fatalf("toUpstream failed: %s", err)
+	}
+	objs, err := decodeAll(out)
+	if err != nil {
+		t.Fatalf("decoding output: %s", err)
+	}
+	var kinds []string
+	for _, obj := range objs {
+		kinds = append(kinds, obj.Kind+"/"+obj.Metadata.Name)
+	}
+	if diff := cmp.Diff([]string{"BGPPeer/peer-1", "IPAddressPool/leased", "L2Advertisement/leased"}, kinds); diff != "" {
+		t.Errorf("unexpected resources (-want +got)\n%s", diff)
+	}
+	if len(warnings) != 2 {
+		t.Errorf("expected 2 warnings, got %v", warnings)
+	}
+
+	if _, _, err := toUpstream([]byte("address-pools: [{name: bad}]"), "metallb-system"); err == nil {
+		t.Error("invalid config converted without error")
+	}
+}
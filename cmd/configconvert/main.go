@@ -0,0 +1,60 @@
+// Command configconvert converts between the custom resources of
+// upstream MetalLB (IPAddressPool, BGPPeer, BGPAdvertisement,
+// L2Advertisement and Community in the metallb.io group) and this
+// fork's ConfigMap format, to ease migrations in either direction.
+//
+// Settings that have no equivalent in the target format are dropped
+// with a warning on stderr.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	var (
+		to        = flag.String("to", "fork", "output format: \"fork\" reads metallb.io resources and writes a ConfigMap, \"upstream\" reads a ConfigMap (or bare config) and writes metallb.io resources")
+		in        = flag.String("in", "-", "file to read, - for stdin")
+		namespace = flag.String("namespace", "metallb-system", "namespace of the generated objects")
+		configMap = flag.String("configmap", "config", "name of the generated ConfigMap, with --to=fork")
+	)
+	flag.Parse()
+
+	var (
+		bs  []byte
+		err error
+	)
+	if *in == "-" {
+		bs, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		bs, err = ioutil.ReadFile(*in)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configconvert: reading input: %s\n", err)
+		os.Exit(1)
+	}
+
+	var (
+		out      []byte
+		warnings []string
+	)
+	switch *to {
+	case "fork":
+		out, warnings, err = toFork(bs, *namespace, *configMap)
+	case "upstream":
+		out, warnings, err = toUpstream(bs, *namespace)
+	default:
+		err = fmt.Errorf("unknown output format %q, must be \"fork\" or \"upstream\"", *to)
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configconvert: %s\n", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(out)
+}
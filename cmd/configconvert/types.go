@@ -0,0 +1,149 @@
+package main
+
+import (
+	"gopkg.in/yaml.v2"
+)
+
+// The formats are mirrored here rather than imported, since the
+// fork's raw config types are internal to the config package and
+// upstream's types live in a different module. Only fields that are
+// converted, or warned about, are declared.
+
+type metadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+type header struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Kind       string   `yaml:"kind"`
+	Metadata   metadata `yaml:"metadata"`
+}
+
+// object is any Kubernetes object, with its spec left for a second
+// decoding pass once the kind is known.
+type object struct {
+	header `yaml:",inline"`
+	Spec   interface{}       `yaml:"spec,omitempty"`
+	Data   map[string]string `yaml:"data,omitempty"`
+}
+
+// remarshal decodes in, a generic YAML value, into out.
+func remarshal(in, out interface{}) error {
+	bs, err := yaml.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(bs, out)
+}
+
+// Upstream MetalLB, metallb.io group.
+
+type labelSelector struct {
+	MatchLabels      map[string]string     `yaml:"matchLabels,omitempty"`
+	MatchExpressions []selectorRequirement `yaml:"matchExpressions,omitempty"`
+}
+
+type selectorRequirement struct {
+	Key      string   `yaml:"key"`
+	Operator string   `yaml:"operator"`
+	Values   []string `yaml:"values,omitempty"`
+}
+
+type ipAddressPoolSpec struct {
+	Addresses     []string `yaml:"addresses"`
+	AutoAssign    *bool    `yaml:"autoAssign,omitempty"`
+	AvoidBuggyIPs bool     `yaml:"avoidBuggyIPs,omitempty"`
+}
+
+type bgpPeerSpec struct {
+	MyASN          uint32            `yaml:"myASN"`
+	ASN            uint32            `yaml:"peerASN"`
+	Address        string            `yaml:"peerAddress"`
+	Port           uint16            `yaml:"peerPort,omitempty"`
+	HoldTime       string            `yaml:"holdTime,omitempty"`
+	RouterID       string            `yaml:"routerID,omitempty"`
+	Password       string            `yaml:"password,omitempty"`
+	NodeSelectors  []labelSelector   `yaml:"nodeSelectors,omitempty"`
+	SourceAddress  string            `yaml:"sourceAddress,omitempty"`
+	EBGPMultiHop   bool              `yaml:"ebgpMultiHop,omitempty"`
+	BFDProfile     string            `yaml:"bfdProfile,omitempty"`
+	PasswordSecret map[string]string `yaml:"passwordSecret,omitempty"`
+	VRF            string            `yaml:"vrf,omitempty"`
+}
+
+type bgpAdvertisementSpec struct {
+	AggregationLength      *int            `yaml:"aggregationLength,omitempty"`
+	LocalPref              *uint32         `yaml:"localPref,omitempty"`
+	Communities            []string        `yaml:"communities,omitempty"`
+	IPAddressPools         []string        `yaml:"ipAddressPools,omitempty"`
+	IPAddressPoolSelectors []labelSelector `yaml:"ipAddressPoolSelectors,omitempty"`
+	NodeSelectors          []labelSelector `yaml:"nodeSelectors,omitempty"`
+	Peers                  []string        `yaml:"peers,omitempty"`
+}
+
+type l2AdvertisementSpec struct {
+	IPAddressPools         []string        `yaml:"ipAddressPools,omitempty"`
+	IPAddressPoolSelectors []labelSelector `yaml:"ipAddressPoolSelectors,omitempty"`
+	NodeSelectors          []labelSelector `yaml:"nodeSelectors,omitempty"`
+	Interfaces             []string        `yaml:"interfaces,omitempty"`
+}
+
+type communitySpec struct {
+	Communities []communityAlias `yaml:"communities"`
+}
+
+type communityAlias struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// This fork, the "config" key of the ConfigMap.
+
+type forkConfig struct {
+	Peers          []forkPeer        `yaml:"peers,omitempty"`
+	BGPCommunities map[string]string `yaml:"bgp-communities,omitempty"`
+	Pools          []forkPool        `yaml:"address-pools,omitempty"`
+	ServiceIPs     interface{}       `yaml:"service-ip-advertisement,omitempty"`
+}
+
+type forkPeer struct {
+	MyASN           uint32             `yaml:"my-asn"`
+	ASN             uint32             `yaml:"peer-asn"`
+	Addr            string             `yaml:"peer-address"`
+	Port            uint16             `yaml:"peer-port,omitempty"`
+	HoldTime        string             `yaml:"hold-time,omitempty"`
+	RouterID        string             `yaml:"router-id,omitempty"`
+	NodeSelectors   []forkNodeSelector `yaml:"node-selectors,omitempty"`
+	Password        string             `yaml:"password,omitempty"`
+	CommunityFilter interface{}        `yaml:"community-filter,omitempty"`
+	SourcePorts     string             `yaml:"source-ports,omitempty"`
+	AnnouncePodCIDR bool               `yaml:"announce-pod-cidr,omitempty"`
+}
+
+type forkNodeSelector struct {
+	MatchLabels      map[string]string     `yaml:"match-labels,omitempty"`
+	MatchExpressions []selectorRequirement `yaml:"match-expressions,omitempty"`
+}
+
+type forkPool struct {
+	Name              string                 `yaml:"name"`
+	Protocol          string                 `yaml:"protocol,omitempty"`
+	Protocols         []string               `yaml:"protocols,omitempty"`
+	Addresses         []string               `yaml:"addresses,omitempty"`
+	AvoidBuggyIPs     bool                   `yaml:"avoid-buggy-ips,omitempty"`
+	ReservedSuffixes  string                 `yaml:"reserved-host-suffixes,omitempty"`
+	AutoAssign        *bool                  `yaml:"auto-assign,omitempty"`
+	BGPAdvertisements []forkBGPAdvertisement `yaml:"bgp-advertisements,omitempty"`
+	MaxLeaseDuration  string                 `yaml:"max-lease-duration,omitempty"`
+	FlapDamping       interface{}            `yaml:"flap-damping,omitempty"`
+	RemovalPolicy     string                 `yaml:"request-removal-policy,omitempty"`
+}
+
+type forkBGPAdvertisement struct {
+	AggregationLength   *int               `yaml:"aggregation-length,omitempty"`
+	LocalPref           *uint32            `yaml:"localpref,omitempty"`
+	Communities         []string           `yaml:"communities,omitempty"`
+	ExtendedCommunities []string           `yaml:"extended-communities,omitempty"`
+	NodeSelectors       []forkNodeSelector `yaml:"node-selectors,omitempty"`
+}
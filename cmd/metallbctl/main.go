@@ -0,0 +1,140 @@
+// Command metallbctl talks to a running MetalLB controller.
+//
+// Usage:
+//
+//	metallbctl what-if [-controller URL] [-token-file file] [-f service.yaml]
+//
+// what-if sends a Service, in YAML or JSON, to the controller, and
+// prints which pool and IP it would get if it were created, and why.
+// Nothing is allocated. The token file holds the controller's
+// --what-if-token-file token. The controller's metrics port must be
+// reachable, e.g. with:
+//
+//	kubectl -n metallb-system port-forward deploy/controller 7472
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: metallbctl what-if [-controller URL] [-token-file file] [-f service.yaml]\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "what-if":
+		err = whatIf(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "metallbctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// whatIfResult mirrors the controller's answer.
+type whatIfResult struct {
+	Service    string   `json:"service"`
+	Pool       string   `json:"pool"`
+	IP         string   `json:"ip"`
+	SharedWith []string `json:"sharedWith"`
+	// Services of other namespaces on the IP, which are not named.
+	OtherNamespaces int    `json:"sharedWithOtherNamespaces"`
+	Reason          string `json:"reason"`
+	Error           string `json:"error"`
+}
+
+func whatIf(args []string) error {
+	fs := flag.NewFlagSet("what-if", flag.ExitOnError)
+	var (
+		controller = fs.String("controller", "http://localhost:7472", "URL of the controller's metrics port")
+		in         = fs.String("f", "-", "file holding the Service, - for stdin")
+		output     = fs.String("o", "text", "output format, \"text\" or \"json\"")
+		tokenFile  = fs.String("token-file", "", "file holding the bearer token of the controller's --what-if-token-file")
+	)
+	fs.Parse(args)
+
+	var (
+		bs  []byte
+		err error
+	)
+	if *in == "-" {
+		bs, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		bs, err = ioutil.ReadFile(*in)
+	}
+	if err != nil {
+		return fmt.Errorf("reading service: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*controller, "/")+"/what-if", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+	if *tokenFile != "" {
+		token, err := ioutil.ReadFile(*tokenFile)
+		if err != nil {
+			return fmt.Errorf("reading token: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading answer: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("controller answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if *output == "json" {
+		os.Stdout.Write(body)
+		return nil
+	}
+
+	var ret whatIfResult
+	if err := json.Unmarshal(body, &ret); err != nil {
+		return fmt.Errorf("decoding answer: %s", err)
+	}
+	fmt.Printf("Service: %s\n", ret.Service)
+	if ret.Error != "" {
+		fmt.Printf("Result:  no IP, %s\n", ret.Error)
+	} else {
+		ip := ret.IP
+		if ip == "" {
+			ip = "picked by the pool's IPAM"
+		}
+		fmt.Printf("Pool:    %s\n", ret.Pool)
+		fmt.Printf("IP:      %s\n", ip)
+		shared := ret.SharedWith
+		if ret.OtherNamespaces > 0 {
+			shared = append(shared, fmt.Sprintf("%d service(s) in other namespaces", ret.OtherNamespaces))
+		}
+		if len(shared) > 0 {
+			fmt.Printf("Shared:  %s\n", strings.Join(shared, ", "))
+		}
+	}
+	fmt.Printf("Why:     %s\n", ret.Reason)
+	return nil
+}
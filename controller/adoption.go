@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Allocating IPs while the IPs of existing services are still being
+// adopted races with the adoption: a new service can get an IP that
+// is in use, but not yet known to the allocator. So the controller
+// syncs in two phases. First, the k8s client processes every existing
+// service and calls MarkSynced. Then, the controller waits until the
+// status IP of every service it saw has been adopted into the
+// allocator and checked against the IPAM, or cleared, possibly after
+// retries. Only then it allocates new IPs.
+
+// MarkSynced is called once every existing object was processed.
+func (c *controller) MarkSynced(l log.Logger) {
+	c.listed = true
+	if !c.finishAdoption(l) {
+		l.Log("event", "adoptingIPs", "pending", len(c.unadopted), "msg", "waiting for the IPs of existing services to be adopted before allocating IPs")
+	}
+}
+
+// trackAdoption records whether the status IP of svc, the converged
+// copy of the service called name, is adopted.
+func (c *controller) trackAdoption(name string, svc *v1.Service) {
+	if c.synced {
+		return
+	}
+	var ip net.IP
+	if svc != nil && svc.Spec.Type == v1.ServiceTypeLoadBalancer && len(svc.Status.LoadBalancer.Ingress) == 1 {
+		ip = net.ParseIP(svc.Status.LoadBalancer.Ingress[0].IP)
+	}
+	if ip == nil || c.verified[name].Equal(ip) {
+		delete(c.unadopted, name)
+		return
+	}
+	if c.unadopted == nil {
+		c.unadopted = map[string]bool{}
+	}
+	c.unadopted[name] = true
+}
+
+// finishAdoption marks the controller synced once all existing
+// services were processed and their IPs adopted. It returns true if
+// it did.
+func (c *controller) finishAdoption(l log.Logger) bool {
+	if c.synced || !c.listed || len(c.unadopted) > 0 {
+		return false
+	}
+	c.synced = true
+	l.Log("event", "stateSynced", "msg", "controller synced, can allocate IPs now")
+	return true
+}
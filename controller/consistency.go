@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.universe.tf/metallb/internal/allocator"
+)
+
+var (
+	discrepancies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "controller",
+		Name:      "consistency_discrepancies",
+		Help:      "Discrepancies found by the last consistency check, by kind",
+	}, []string{
+		"kind",
+	})
+
+	repairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "controller",
+		Name:      "consistency_repairs_total",
+		Help:      "Discrepancies repaired by consistency checks, by kind",
+	}, []string{
+		"kind",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(discrepancies)
+	prometheus.MustRegister(repairs)
+}
+
+// Kinds of discrepancies between the distributed state of services.
+const (
+	// A service's status has an IP the allocator doesn't assign it.
+	statusNotAllocated = "statusNotAllocated"
+	// The allocator assigns a service an IP that isn't in its status.
+	allocationNotInStatus = "allocationNotInStatus"
+	// The allocator assigns an IP to a service that doesn't exist.
+	allocationWithoutService = "allocationWithoutService"
+	// An IPAM reservation of this cluster is held by no service.
+	orphanReservation = "orphanReservation"
+	// A service's IP isn't reserved in the IPAM of its pool.
+	missingReservation = "missingReservation"
+	// A speaker announces an IP that isn't assigned to the service.
+	staleAnnouncement = "staleAnnouncement"
+)
+
+var discrepancyKinds = []string{
+	statusNotAllocated,
+	allocationNotInStatus,
+	allocationWithoutService,
+	orphanReservation,
+	missingReservation,
+	staleAnnouncement,
+}
+
+// discrepancy is an inconsistency about object, a service or IPAM
+// reservation.
+type discrepancy struct {
+	kind   string
+	object string
+	detail string
+}
+
+// announcement is a service IP announced by a speaker.
+type announcement struct {
+	service string
+	node    string
+	ip      string
+}
+
+// consistencyClient is the subset of the k8s client that the
+// consistency checker needs.
+type consistencyClient interface {
+	ListServices() []*v1.Service
+	GetDaemonSet(name string) (*appsv1.DaemonSet, error)
+	ListPods(selector *metav1.LabelSelector) ([]v1.Pod, error)
+	ForceSync()
+}
+
+// consistencyChecker periodically cross-checks the status of services,
+// the allocator, the reservations in external IPAMs and the
+// announcements of speakers, and reports the discrepancies it finds.
+// If repair is set, it fixes those it can.
+type consistencyChecker struct {
+	c         *controller
+	client    consistencyClient
+	call      func(func()) error
+	daemonSet string
+	repair    bool
+	scrape    func(addr string) ([]announcement, error)
+
+	// Discrepancies found by the previous check. Events may still be
+	// in flight when a check runs, so a discrepancy is only acted on
+	// when found twice in a row.
+	last map[discrepancy]bool
+}
+
+func (k *consistencyChecker) run(l log.Logger, interval time.Duration) {
+	for range time.Tick(interval) {
+		// Standby replicas don't keep the allocator up to date.
+		if !k.c.leader.leading() {
+			continue
+		}
+		if err := k.check(l); err != nil {
+			l.Log("op", "consistencyCheck", "error", err, "msg", "consistency check failed")
+		}
+	}
+}
+
+func (k *consistencyChecker) check(l log.Logger) error {
+	svcs := k.client.ListServices()
+	anns := k.announcements(l)
+
+	var confirmed []discrepancy
+	needSync := false
+	err := k.call(func() {
+		found := k.c.findDiscrepancies(context.Background(), l, svcs, anns)
+		last := k.last
+		k.last = map[discrepancy]bool{}
+		for _, d := range found {
+			k.last[d] = true
+			if last[d] {
+				confirmed = append(confirmed, d)
+			}
+		}
+		if k.repair {
+			needSync = k.c.repairDiscrepancies(context.Background(), l, confirmed)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	byName := map[string]*v1.Service{}
+	for _, svc := range svcs {
+		byName[svc.Namespace+"/"+svc.Name] = svc
+	}
+	counts := map[string]int{}
+	for _, d := range confirmed {
+		counts[d.kind]++
+		l.Log("event", "inconsistency", "kind", d.kind, "object", d.object, "detail", d.detail, "repair", k.repair, "msg", "state is inconsistent")
+		if svc := byName[d.object]; svc != nil {
+			k.c.client.Errorf(svc, "Inconsistent", "Consistency check found %s (%s)", d.kind, d.detail)
+		}
+	}
+	for _, kind := range discrepancyKinds {
+		discrepancies.WithLabelValues(kind).Set(float64(counts[kind]))
+	}
+	if needSync {
+		k.client.ForceSync()
+	}
+	return nil
+}
+
+// findDiscrepancies returns the discrepancies between svcs, the
+// controller's state, the IPAMs and anns. It must be called between
+// two events.
+func (c *controller) findDiscrepancies(ctx context.Context, l log.Logger, svcs []*v1.Service, anns []announcement) []discrepancy {
+	if !c.synced {
+		return nil
+	}
+	var ret []discrepancy
+
+	byName := map[string]*v1.Service{}
+	for _, svc := range svcs {
+		name := svc.Namespace + "/" + svc.Name
+		byName[name] = svc
+		if svc.Spec.Type != v1.ServiceTypeLoadBalancer || svc.DeletionTimestamp != nil {
+			continue
+		}
+		ip := statusIP(svc)
+		if ip != nil && !ip.Equal(c.ips.IP(name)) {
+			ret = append(ret, discrepancy{statusNotAllocated, name, ip.String()})
+		}
+	}
+
+	for name, a := range c.ips.Assignments() {
+		if strings.HasPrefix(name, gatewayAllocKey("")) || strings.HasPrefix(name, ipClaimAllocKey("")) {
+			continue
+		}
+		svc := byName[name]
+		switch {
+		case svc == nil:
+			ret = append(ret, discrepancy{allocationWithoutService, name, a.IP.String()})
+		case !a.IP.Equal(statusIP(svc)):
+			ret = append(ret, discrepancy{allocationNotInStatus, name, a.IP.String()})
+		}
+	}
+
+	orphans, unreserved, err := c.ips.CheckIPAM(ctx)
+	if err != nil {
+		l.Log("op", "consistencyCheck", "error", err, "msg", "failed to check IPAM reservations")
+	}
+	for _, r := range orphans {
+		ret = append(ret, discrepancy{orphanReservation, r.Pool + "/" + r.ID, r.IP})
+	}
+	for _, name := range unreserved {
+		ret = append(ret, discrepancy{missingReservation, name, c.ips.IP(name).String()})
+	}
+
+	for _, a := range anns {
+		if !c.ips.IP(a.service).Equal(net.ParseIP(a.ip)) {
+			ret = append(ret, discrepancy{staleAnnouncement, a.service, a.node + " " + a.ip})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].kind != ret[j].kind {
+			return ret[i].kind < ret[j].kind
+		}
+		return ret[i].object < ret[j].object
+	})
+	return ret
+}
+
+// repairDiscrepancies fixes the discrepancies ds where it can, and
+// returns true if services must be reprocessed to finish the repair.
+// It must be called between two events.
+func (c *controller) repairDiscrepancies(ctx context.Context, l log.Logger, ds []discrepancy) bool {
+	needSync := false
+	for _, d := range ds {
+		switch d.kind {
+		case statusNotAllocated, allocationNotInStatus:
+			// Converging the service again fixes either side.
+			needSync = true
+		case allocationWithoutService:
+			c.deleteBalancer(ctx, l, d.object)
+		case orphanReservation:
+			i := strings.LastIndex(d.object, "/")
+			r := allocator.Reservation{Pool: d.object[:i], ID: d.object[i+1:], IP: d.detail}
+			if err := c.ips.ReleaseReservation(ctx, l, r); err != nil {
+				l.Log("op", "consistencyRepair", "error", err, "msg", "failed to release orphaned reservation")
+				continue
+			}
+		case missingReservation:
+			// The next convergence checks the reservation again, and
+			// applies the stale IP policy.
+			delete(c.verified, d.object)
+			needSync = true
+		default:
+			// Speakers fix their announcements on their own once
+			// they process the service again.
+			continue
+		}
+		repairs.WithLabelValues(d.kind).Inc()
+	}
+	return needSync
+}
+
+func statusIP(svc *v1.Service) net.IP {
+	if len(svc.Status.LoadBalancer.Ingress) != 1 {
+		return nil
+	}
+	return net.ParseIP(svc.Status.LoadBalancer.Ingress[0].IP)
+}
+
+// announcements returns what the ready speakers announce. Speakers
+// whose metrics can't be read are skipped.
+func (k *consistencyChecker) announcements(l log.Logger) []announcement {
+	ds, err := k.client.GetDaemonSet(k.daemonSet)
+	if err != nil {
+		l.Log("op", "consistencyCheck", "error", err, "msg", "failed to get speaker daemonset, not checking announcements")
+		return nil
+	}
+	pods, err := k.client.ListPods(ds.Spec.Selector)
+	if err != nil {
+		l.Log("op", "consistencyCheck", "error", err, "msg", "failed to list speakers, not checking announcements")
+		return nil
+	}
+
+	var ret []announcement
+	for i := range pods {
+		pod := &pods[i]
+		if !podReady(pod) || pod.Status.PodIP == "" {
+			continue
+		}
+		anns, err := k.scrape(metricsAddr(pod))
+		if err != nil {
+			l.Log("op", "consistencyCheck", "pod", pod.Name, "error", err, "msg", "failed to read speaker announcements")
+			continue
+		}
+		ret = append(ret, anns...)
+	}
+	return ret
+}
+
+// metricsAddr returns the address of pod's metrics port.
+func metricsAddr(pod *v1.Pod) string {
+	port := 7472
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Name == "monitoring" {
+				port = int(p.ContainerPort)
+			}
+		}
+	}
+	return net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port))
+}
+
+var scrapeClient = &http.Client{Timeout: 10 * time.Second}
+
+// scrapeAnnouncements reads the announcements of the speaker serving
+// metrics on addr.
+func scrapeAnnouncements(addr string) ([]announcement, error) {
+	resp, err := scrapeClient.Get("http://" + addr + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading metrics from %s: %s", addr, resp.Status)
+	}
+	return parseAnnouncements(resp.Body)
+}
+
+// parseAnnouncements parses the metallb_speaker_announced samples in
+// r, in the Prometheus text format.
+func parseAnnouncements(r io.Reader) ([]announcement, error) {
+	const prefix = "metallb_speaker_announced{"
+
+	var ret []announcement
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		end := strings.LastIndex(line, "}")
+		if end < 0 {
+			return nil, fmt.Errorf("malformed sample %q", line)
+		}
+		if v := strings.Fields(line[end+1:]); len(v) == 0 || v[0] == "0" {
+			continue
+		}
+		labels, err := parseLabels(line[len(prefix):end])
+		if err != nil {
+			return nil, fmt.Errorf("malformed sample %q: %s", line, err)
+		}
+		ret = append(ret, announcement{
+			service: labels["service"],
+			node:    labels["node"],
+			ip:      labels["ip"],
+		})
+	}
+	return ret, s.Err()
+}
+
+// parseLabels parses the comma-separated name="value" pairs of a
+// sample.
+func parseLabels(s string) (map[string]string, error) {
+	ret := map[string]string{}
+	for s != "" {
+		eq := strings.Index(s, "=\"")
+		if eq < 0 {
+			return nil, fmt.Errorf("no value in %q", s)
+		}
+		name := s[:eq]
+		s = s[eq+1:]
+
+		// Find the closing quote, skipping escaped characters.
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return nil, fmt.Errorf("unterminated value of %q", name)
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("bad value of %q: %s", name, err)
+		}
+		ret[name] = v
+		s = strings.TrimPrefix(s[end+1:], ",")
+	}
+	return ret, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.universe.tf/metallb/internal/allocator"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+func TestParseAnnouncements(t *testing.T) {
+	metrics := `# HELP metallb_speaker_announced Services being announced from this node.
+# TYPE metallb_speaker_announced gauge
+metallb_speaker_announced{ip="1.2.3.0",node="node1",protocol="layer2",service="default/a"} 1
+metallb_speaker_announced{ip="1.2.3.1",node="node1",protocol="bgp",service="default/b"} 0
+metallb_speaker_announced{ip="1.2.3.2",node="node\"1",protocol="bgp",service="default/c"} 1
+metallb_speaker_node_check_failed{check="foo"} 1
+`
+	got, err := parseAnnouncements(strings.NewReader(metrics))
+	if err != nil {
+		t.Fatalf("parseAnnouncements: %s", err)
+	}
+	want := []announcement{
+		{service: "default/a", node: "node1", ip: "1.2.3.0"},
+		{service: "default/c", node: "node\"1", ip: "1.2.3.2"},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(announcement{})); diff != "" {
+		t.Errorf("wrong announcements (-want +got)\n%s", diff)
+	}
+
+	if _, err := parseAnnouncements(strings.NewReader(`metallb_speaker_announced{ip="1.2.3.0} 1`)); err == nil {
+		t.Error("malformed sample parsed")
+	}
+}
+
+type testConsistencyClient struct {
+	svcs   []*v1.Service
+	synced bool
+}
+
+func (t *testConsistencyClient) ListServices() []*v1.Service { return t.svcs }
+func (t *testConsistencyClient) ForceSync()                  { t.synced = true }
+
+func (t *testConsistencyClient) GetDaemonSet(name string) (*appsv1.DaemonSet, error) {
+	return &appsv1.DaemonSet{}, nil
+}
+
+func (t *testConsistencyClient) ListPods(selector *metav1.LabelSelector) ([]v1.Pod, error) {
+	return []v1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "speaker"},
+			Status: v1.PodStatus{
+				PodIP:      "10.0.0.1",
+				Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+			},
+		},
+	}, nil
+}
+
+func TestConsistencyCheck(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/30")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := func(name, ip string) *v1.Service {
+		ret := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+		if ip != "" {
+			ret.Status = statusAssigned(ip)
+		}
+		return ret
+	}
+
+	// a is consistent. b's status wasn't written, c's deletion was
+	// missed, and d's status IP was never adopted.
+	for name, ip := range map[string]string{"a": "1.2.3.0", "b": "1.2.3.1", "c": "1.2.3.2"} {
+		if err := c.ips.Assign("default/"+name, net.ParseIP(ip), nil, "", "", ""); err != nil {
+			t.Fatalf("Assign %s: %s", name, err)
+		}
+	}
+	client := &testConsistencyClient{
+		svcs: []*v1.Service{svc("a", "1.2.3.0"), svc("b", ""), svc("d", "1.2.3.3")},
+	}
+	checker := &consistencyChecker{
+		c:      c,
+		client: client,
+		call:   func(f func()) error { f(); return nil },
+		repair: true,
+		scrape: func(addr string) ([]announcement, error) {
+			if addr != "10.0.0.1:7472" {
+				t.Errorf("scraped wrong address %q", addr)
+			}
+			return []announcement{
+				{service: "default/a", node: "node1", ip: "1.2.3.0"},
+				{service: "default/e", node: "node1", ip: "1.2.3.3"},
+			}, nil
+		},
+	}
+
+	want := []discrepancy{
+		{allocationNotInStatus, "default/b", "1.2.3.1"},
+		{allocationWithoutService, "default/c", "1.2.3.2"},
+		{staleAnnouncement, "default/e", "node1 1.2.3.3"},
+		{statusNotAllocated, "default/d", "1.2.3.3"},
+	}
+	got := c.findDiscrepancies(context.Background(), l, client.svcs, []announcement{
+		{service: "default/a", node: "node1", ip: "1.2.3.0"},
+		{service: "default/e", node: "node1", ip: "1.2.3.3"},
+	})
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(discrepancy{})); diff != "" {
+		t.Fatalf("wrong discrepancies (-want +got)\n%s", diff)
+	}
+
+	// The first check only notes the discrepancies, in case events
+	// are in flight.
+	if err := checker.check(l); err != nil {
+		t.Fatalf("check: %s", err)
+	}
+	if client.synced || c.ips.IP("default/c") == nil {
+		t.Fatal("first check repaired discrepancies")
+	}
+
+	// The second check confirms and repairs them.
+	if err := checker.check(l); err != nil {
+		t.Fatalf("check: %s", err)
+	}
+	if !client.synced {
+		t.Error("services not reprocessed to repair their status")
+	}
+	if c.ips.IP("default/c") != nil {
+		t.Error("IP of deleted service not released")
+	}
+	if !k.loggedWarning {
+		t.Error("no event for inconsistent services")
+	}
+}
@@ -1,19 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"go.universe.tf/metallb/internal/allocator"
 	"go.universe.tf/metallb/internal/config"
 	"go.universe.tf/metallb/internal/k8s"
+	"go.universe.tf/metallb/pkg/hooks"
 
+	"github.com/NetApp/nks-on-prem-ipam/pkg/ipam"
+	"github.com/NetApp/nks-on-prem-ipam/pkg/ipam/fake"
 	"github.com/go-kit/kit/log"
 	"github.com/google/go-cmp/cmp"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 func diffService(a, b *v1.Service) string {
@@ -61,7 +72,11 @@ func statusAssigned(ip string) v1.ServiceStatus {
 type testK8S struct {
 	updateService       *v1.Service
 	updateServiceStatus *v1.ServiceStatus
+	updateGateway       *unstructured.Unstructured
+	updateIPClaim       *unstructured.Unstructured
 	loggedWarning       bool
+	infoEvents          []string
+	requeued            map[string]time.Duration
 	t                   *testing.T
 }
 
@@ -75,8 +90,19 @@ func (s *testK8S) UpdateStatus(svc *v1.Service) error {
 	return nil
 }
 
-func (s *testK8S) Infof(_ *v1.Service, evtType string, msg string, args ...interface{}) {
+func (s *testK8S) UpdateGatewayStatus(gw *unstructured.Unstructured) error {
+	s.updateGateway = gw
+	return nil
+}
+
+func (s *testK8S) UpdateIPClaimStatus(claim *unstructured.Unstructured) error {
+	s.updateIPClaim = claim
+	return nil
+}
+
+func (s *testK8S) Infof(svc *v1.Service, evtType string, msg string, args ...interface{}) {
 	s.t.Logf("k8s Info event %q: %s", evtType, fmt.Sprintf(msg, args...))
+	s.infoEvents = append(s.infoEvents, svc.Name+":"+evtType)
 }
 
 func (s *testK8S) Errorf(_ *v1.Service, evtType string, msg string, args ...interface{}) {
@@ -84,10 +110,21 @@ func (s *testK8S) Errorf(_ *v1.Service, evtType string, msg string, args ...inte
 	s.loggedWarning = true
 }
 
+func (s *testK8S) RequeueAfter(name string, d time.Duration) {
+	if s.requeued == nil {
+		s.requeued = map[string]time.Duration{}
+	}
+	s.requeued[name] = d
+}
+
 func (s *testK8S) reset() {
 	s.updateService = nil
 	s.updateServiceStatus = nil
+	s.updateGateway = nil
+	s.updateIPClaim = nil
 	s.loggedWarning = false
+	s.infoEvents = nil
+	s.requeued = nil
 }
 
 func (s *testK8S) gotService(in *v1.Service) *v1.Service {
@@ -684,9 +721,14 @@ func TestDeleteRecyclesIP(t *testing.T) {
 	if c.SetBalancer(l, "test2", svc2, nil) == k8s.SyncStateError {
 		t.Fatal("SetBalancer svc2 failed")
 	}
-	if k.gotService(svc2) != nil {
-		t.Fatal("SetBalancer svc2 mutated svc2 even though it should not have allocated")
+	gotSvc = k.gotService(svc2)
+	if gotSvc == nil || len(gotSvc.Status.LoadBalancer.Ingress) != 0 {
+		t.Fatal("SetBalancer svc2 should only have marked svc2 as pending")
+	}
+	if got := gotSvc.Annotations[pendingReasonAnnotation]; got != pendingAllocationFailed {
+		t.Fatalf("svc2 pending for %q, want %q", got, pendingAllocationFailed)
 	}
+	svc2 = gotSvc
 	k.reset()
 
 	// Deleting the first LB should tell us to reprocess all services.
@@ -705,4 +747,1636 @@ func TestDeleteRecyclesIP(t *testing.T) {
 	if len(gotSvc.Status.LoadBalancer.Ingress) == 0 || gotSvc.Status.LoadBalancer.Ingress[0].IP != "1.2.3.0" {
 		t.Fatal("svc2 didn't get an IP")
 	}
+	if _, ok := gotSvc.Annotations[pendingReasonAnnotation]; ok {
+		t.Fatal("svc2 still marked as pending")
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	for _, release := range []bool{false, true} {
+		k := &testK8S{t: t}
+		c := &controller{
+			ips:    allocator.New(),
+			client: k,
+		}
+
+		l := log.NewNopLogger()
+		cfg := &config.Config{
+			Pools: map[string]*config.Pool{
+				"default": {
+					AutoAssign:           true,
+					CIDR:                 []*net.IPNet{ipnet("1.2.3.0/32")},
+					MaxLeaseDuration:     time.Hour,
+					ReleaseExpiredLeases: release,
+				},
+			},
+		}
+		if c.SetConfig(l, cfg) == k8s.SyncStateError {
+			t.Fatal("SetConfig failed")
+		}
+		c.MarkSynced(l)
+
+		svc := &v1.Service{
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+		if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+		svc = k.gotService(svc)
+		if svc == nil || len(svc.Status.LoadBalancer.Ingress) == 0 {
+			t.Fatal("service didn't get an IP")
+		}
+		if got, want := svc.Annotations[leaseStartAnnotation], "2020-01-01T00:00:00Z"; got != want {
+			t.Fatalf("got lease start %q, want %q", got, want)
+		}
+		k.reset()
+
+		// Within the lease, nothing changes.
+		now = now.Add(30 * time.Minute)
+		if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+		if k.gotService(svc) != nil {
+			t.Fatal("service mutated within its lease")
+		}
+
+		// Past the lease.
+		now = now.Add(time.Hour)
+		if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+		if !k.loggedWarning {
+			t.Error("no warning event for expired lease")
+		}
+		got := k.gotService(svc)
+		if got == nil {
+			t.Fatal("service not updated after lease expired")
+		}
+		if !release {
+			if got.Annotations[leaseExpiredAnnotation] != leaseNotified {
+				t.Errorf("expired lease not marked as notified, annotations %v", got.Annotations)
+			}
+			if len(got.Status.LoadBalancer.Ingress) == 0 {
+				t.Error("notify policy released the IP")
+			}
+			continue
+		}
+
+		if got.Annotations[leaseExpiredAnnotation] != leaseReleased {
+			t.Errorf("expired lease not marked as released, annotations %v", got.Annotations)
+		}
+		if len(got.Status.LoadBalancer.Ingress) != 0 {
+			t.Error("release policy didn't release the IP")
+		}
+
+		// A released service doesn't get a new IP.
+		k.reset()
+		if c.SetBalancer(l, "test", got, nil) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+		if again := k.gotService(got); again != nil {
+			t.Errorf("released service was reallocated: %v", again.Status)
+		}
+	}
+}
+
+func TestBGPOverrides(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol:         config.BGP,
+				AutoAssign:       true,
+				CIDR:             []*net.IPNet{ipnet("1.2.3.0/32")},
+				ServiceLocalPref: &config.Uint32Range{Min: 100, Max: 300},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	tests := []struct {
+		annotations map[string]string
+		wantWarning bool
+	}{
+		{nil, false},
+		{map[string]string{config.LocalPrefAnnotation: "200"}, false},
+		{map[string]string{config.LocalPrefAnnotation: "400"}, true},
+		{map[string]string{config.MEDAnnotation: "10"}, true},
+	}
+	for _, test := range tests {
+		k.reset()
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: test.annotations,
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+		if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+		if got := k.gotService(svc); got == nil || len(got.Status.LoadBalancer.Ingress) == 0 {
+			t.Errorf("%v: service didn't get an IP", test.annotations)
+		}
+		if k.loggedWarning != test.wantWarning {
+			t.Errorf("%v: got warning %v, want %v", test.annotations, k.loggedWarning, test.wantWarning)
+		}
+		c.SetBalancer(l, "test", nil, nil)
+	}
+}
+
+func TestBlackhole(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol:   config.BGP,
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{config.BlackholeAnnotation: "soon"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if !k.loggedWarning {
+		t.Error("no warning event for invalid blackhole duration")
+	}
+	svc = k.gotService(svc)
+	if svc == nil || len(svc.Status.LoadBalancer.Ingress) == 0 {
+		t.Fatal("service didn't get an IP")
+	}
+	k.reset()
+
+	// A duration is replaced with the end of the blackhole.
+	svc.Annotations[config.BlackholeAnnotation] = "30m"
+	if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	got := k.gotService(svc)
+	if got == nil {
+		t.Fatal("blackhole duration not replaced")
+	}
+	if got, want := got.Annotations[config.BlackholeAnnotation], "2020-01-01T00:30:00Z"; got != want {
+		t.Fatalf("got blackhole end %q, want %q", got, want)
+	}
+	svc = got
+	k.reset()
+
+	// Within the blackhole, nothing changes.
+	now = now.Add(20 * time.Minute)
+	if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if k.gotService(svc) != nil {
+		t.Fatal("service mutated during blackhole")
+	}
+
+	// Past its end, the annotation is removed.
+	now = now.Add(20 * time.Minute)
+	if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	got = k.gotService(svc)
+	if got == nil {
+		t.Fatal("service not updated after blackhole ended")
+	}
+	if v, ok := got.Annotations[config.BlackholeAnnotation]; ok {
+		t.Errorf("blackhole annotation %q not removed", v)
+	}
+}
+
+func TestRequestRemoval(t *testing.T) {
+	for _, reallocate := range []bool{false, true} {
+		k := &testK8S{t: t}
+		c := &controller{
+			ips:    allocator.New(),
+			client: k,
+		}
+
+		l := log.NewNopLogger()
+		cfg := &config.Config{
+			Pools: map[string]*config.Pool{
+				"requested": {
+					CIDR:                       []*net.IPNet{ipnet("1.2.3.0/32")},
+					ReallocateOnRequestRemoval: reallocate,
+				},
+				"default": {
+					AutoAssign: true,
+					CIDR:       []*net.IPNet{ipnet("1.2.4.0/32")},
+				},
+			},
+		}
+		if c.SetConfig(l, cfg) == k8s.SyncStateError {
+			t.Fatal("SetConfig failed")
+		}
+		c.MarkSynced(l)
+
+		svc := &v1.Service{
+			Spec: v1.ServiceSpec{
+				Type:           "LoadBalancer",
+				ClusterIP:      "1.2.3.4",
+				LoadBalancerIP: "1.2.3.0",
+			},
+		}
+		if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+		svc = k.gotService(svc)
+		if svc == nil || len(svc.Status.LoadBalancer.Ingress) == 0 || svc.Status.LoadBalancer.Ingress[0].IP != "1.2.3.0" {
+			t.Fatal("service didn't get the requested IP")
+		}
+		if got, want := svc.Annotations[requestedAnnotation] == requestedByIP, reallocate; got != want {
+			t.Errorf("reallocate=%v: request recorded %v, want %v", reallocate, got, want)
+		}
+		k.reset()
+
+		svc.Spec.LoadBalancerIP = ""
+		if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+		got := k.gotService(svc)
+		if !reallocate {
+			if got != nil {
+				t.Errorf("keep policy mutated service: %v", got.Status)
+			}
+			continue
+		}
+		if got == nil || len(got.Status.LoadBalancer.Ingress) == 0 || got.Status.LoadBalancer.Ingress[0].IP != "1.2.4.0" {
+			t.Fatalf("reallocate policy didn't allocate from the auto-assign pool: %v", got)
+		}
+		if _, ok := got.Annotations[requestedAnnotation]; ok {
+			t.Errorf("request annotation not cleared, annotations %v", got.Annotations)
+		}
+	}
+}
+
+func TestSharingGroupEvents(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := func(name string, port int32) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Annotations: map[string]string{
+					"metallb.universe.tf/allow-shared-ip": "share",
+				},
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+				Ports:     []v1.ServicePort{{Port: port}},
+			},
+		}
+	}
+
+	if c.SetBalancer(l, "a", svc("a", 80), nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer a failed")
+	}
+	if len(k.infoEvents) != 1 || k.infoEvents[0] != "a:IPAllocated" {
+		t.Errorf("unexpected events for first service: %v", k.infoEvents)
+	}
+	k.reset()
+
+	if c.SetBalancer(l, "b", svc("b", 443), nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer b failed")
+	}
+	want := []string{"b:IPAllocated", "a:SharingGroupChanged", "b:SharingGroupJoined"}
+	if diff := cmp.Diff(want, k.infoEvents); diff != "" {
+		t.Errorf("unexpected events when joining (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string][]string{"1.2.3.0": {"a", "b"}}, c.sharing.snapshot()); diff != "" {
+		t.Errorf("unexpected sharing groups (-want +got)\n%s", diff)
+	}
+	k.reset()
+
+	if c.SetBalancer(l, "b", nil, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer b delete failed")
+	}
+	if diff := cmp.Diff([]string{"a:SharingGroupChanged"}, k.infoEvents); diff != "" {
+		t.Errorf("unexpected events when leaving (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string][]string{}, c.sharing.snapshot()); diff != "" {
+		t.Errorf("unexpected sharing groups (-want +got)\n%s", diff)
+	}
+}
+
+func TestTypeTransitions(t *testing.T) {
+	types := map[string]v1.ServiceSpec{
+		"ClusterIP":             {Type: "ClusterIP", ClusterIP: "1.2.3.4"},
+		"headless":              {Type: "ClusterIP", ClusterIP: "None"},
+		"NodePort":              {Type: "NodePort", ClusterIP: "1.2.3.4"},
+		"ExternalName":          {Type: "ExternalName", ExternalName: "example.com"},
+		"LoadBalancer":          {Type: "LoadBalancer", ClusterIP: "1.2.3.4"},
+		"LoadBalancer-headless": {Type: "LoadBalancer", ClusterIP: "None"},
+		"LoadBalancer-pending":  {Type: "LoadBalancer"},
+	}
+	hasIP := func(spec v1.ServiceSpec) bool {
+		return spec.Type == "LoadBalancer" && spec.ClusterIP == "1.2.3.4"
+	}
+	count := func(events []string, typ string) int {
+		n := 0
+		for _, e := range events {
+			if e == "test:"+typ {
+				n++
+			}
+		}
+		return n
+	}
+
+	for fromName, from := range types {
+		for toName, to := range types {
+			desc := fmt.Sprintf("%s -> %s", fromName, toName)
+			k := &testK8S{t: t}
+			c := &controller{
+				ips:    allocator.New(),
+				client: k,
+			}
+			l := log.NewNopLogger()
+			cfg := &config.Config{
+				Pools: map[string]*config.Pool{
+					"default": {
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+					},
+				},
+			}
+			if c.SetConfig(l, cfg) == k8s.SyncStateError {
+				t.Fatalf("%s: SetConfig failed", desc)
+			}
+			c.MarkSynced(l)
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "test"},
+				Spec:       from,
+			}
+			converge := func() {
+				if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+					t.Fatalf("%s: SetBalancer failed", desc)
+				}
+				if got := k.gotService(svc); got != nil {
+					svc = got
+				}
+				k.updateService, k.updateServiceStatus = nil, nil
+			}
+
+			converge()
+			fromIP := c.ips.IP("test")
+			if (fromIP != nil) != hasIP(from) {
+				t.Errorf("%s: initial IP %v, want IP %v", desc, fromIP, hasIP(from))
+			}
+			k.reset()
+
+			svc = svc.DeepCopy()
+			svc.Spec = to
+			converge()
+			// Converging again must be a no-op.
+			converge()
+
+			toIP := c.ips.IP("test")
+			switch {
+			case hasIP(to) && toIP == nil:
+				t.Errorf("%s: no IP allocated", desc)
+			case !hasIP(to) && toIP != nil:
+				t.Errorf("%s: IP %q still held", desc, toIP)
+			case !hasIP(to) && len(svc.Status.LoadBalancer.Ingress) != 0:
+				t.Errorf("%s: status not cleared: %v", desc, svc.Status)
+			case hasIP(to) && (len(svc.Status.LoadBalancer.Ingress) != 1 || svc.Status.LoadBalancer.Ingress[0].IP != toIP.String()):
+				t.Errorf("%s: status %v does not match IP %q", desc, svc.Status, toIP)
+			}
+
+			wantAllocs, wantReleases := 0, 0
+			switch {
+			case hasIP(from) && !hasIP(to):
+				wantReleases = 1
+			case !hasIP(from) && hasIP(to):
+				wantAllocs = 1
+			case hasIP(from) && hasIP(to) && !fromIP.Equal(toIP):
+				t.Errorf("%s: IP changed from %q to %q", desc, fromIP, toIP)
+			}
+			if got := count(k.infoEvents, "IPAllocated"); got != wantAllocs {
+				t.Errorf("%s: got %d allocations, want %d", desc, got, wantAllocs)
+			}
+			if got := count(k.infoEvents, "IPReleased"); got != wantReleases {
+				t.Errorf("%s: got %d releases, want %d", desc, got, wantReleases)
+			}
+		}
+	}
+}
+
+func TestIPConflictResolution(t *testing.T) {
+	older := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			CreationTimestamp: metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+		Status: statusAssigned("1.2.3.0"),
+	}
+	newer := older.DeepCopy()
+	newer.CreationTimestamp = metav1.NewTime(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC))
+
+	// Whatever the processing order, the older service keeps the IP
+	// and the newer one is moved to another IP.
+	for _, olderFirst := range []bool{true, false} {
+		k := &testK8S{t: t}
+		c := &controller{
+			ips:    allocator.New(),
+			client: k,
+		}
+
+		l := log.NewNopLogger()
+		cfg := &config.Config{
+			Pools: map[string]*config.Pool{
+				"default": {
+					AutoAssign: true,
+					CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+				},
+			},
+		}
+		if c.SetConfig(l, cfg) == k8s.SyncStateError {
+			t.Fatal("SetConfig failed")
+		}
+		c.MarkSynced(l)
+
+		svcs := map[string]*v1.Service{
+			"older": older.DeepCopy(),
+			"newer": newer.DeepCopy(),
+		}
+		order := []string{"newer", "older"}
+		if olderFirst {
+			order = []string{"older", "newer"}
+		}
+
+		// Process the services until they converge, reprocessing
+		// all of them when asked to, like the k8s client would.
+		for i := 0; i < 5; i++ {
+			converged := true
+			for _, name := range order {
+				k.reset()
+				st := c.SetBalancer(l, name, svcs[name], nil)
+				if st == k8s.SyncStateError {
+					t.Fatalf("SetBalancer %q failed", name)
+				}
+				if got := k.gotService(svcs[name]); got != nil {
+					svcs[name] = got
+					converged = false
+				}
+				if st == k8s.SyncStateReprocessAll {
+					converged = false
+				}
+			}
+			if converged {
+				break
+			}
+		}
+
+		if got := svcs["older"].Status.LoadBalancer.Ingress; len(got) != 1 || got[0].IP != "1.2.3.0" {
+			t.Errorf("olderFirst=%v: older service lost its IP, got status %v", olderFirst, got)
+		}
+		if got := svcs["newer"].Status.LoadBalancer.Ingress; len(got) != 1 || got[0].IP != "1.2.3.1" {
+			t.Errorf("olderFirst=%v: newer service not moved to a new IP, got status %v", olderFirst, got)
+		}
+		if got := c.ips.IP("older"); !got.Equal(net.ParseIP("1.2.3.0")) {
+			t.Errorf("olderFirst=%v: allocator has older service on %q", olderFirst, got)
+		}
+		if got := c.ips.IP("newer"); !got.Equal(net.ParseIP("1.2.3.1")) {
+			t.Errorf("olderFirst=%v: allocator has newer service on %q", olderFirst, got)
+		}
+	}
+}
+
+func TestFencing(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	fenced := &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "incident",
+			Annotations: map[string]string{k8s.FencedAnnotation: "true"},
+		},
+	}
+	if c.SetNamespace(l, "incident", fenced) != k8s.SyncStateReprocessAll {
+		t.Fatal("fencing a namespace didn't ask for reprocessing")
+	}
+	if c.SetNamespace(l, "incident", fenced) != k8s.SyncStateSuccess {
+		t.Fatal("unchanged fencing asked for reprocessing")
+	}
+	c.MarkSynced(l)
+
+	svc := func(ns string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: ns,
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+	}
+
+	if c.SetBalancer(l, "other/test", svc("other"), nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := k.gotService(nil); got == nil || got.Annotations[k8s.NamespaceFencedAnnotation] != "" {
+		t.Errorf("service in unfenced namespace marked as fenced: %v", got)
+	}
+
+	k.reset()
+	if c.SetBalancer(l, "incident/test", svc("incident"), nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	got := k.gotService(nil)
+	if got == nil || got.Annotations[k8s.NamespaceFencedAnnotation] != "true" {
+		t.Fatalf("service in fenced namespace not marked as fenced: %v", got)
+	}
+	if len(got.Status.LoadBalancer.Ingress) == 0 {
+		t.Error("fenced service didn't keep its IP")
+	}
+	if !k.loggedWarning {
+		t.Error("no warning event for fenced service")
+	}
+
+	if c.SetNamespace(l, "incident", nil) != k8s.SyncStateReprocessAll {
+		t.Fatal("deleting a fenced namespace didn't ask for reprocessing")
+	}
+	k.reset()
+	if c.SetBalancer(l, "incident/test", got, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	got = k.gotService(got)
+	if got == nil || got.Annotations[k8s.NamespaceFencedAnnotation] != "" {
+		t.Errorf("service not unmarked after unfencing: %v", got)
+	}
+
+	// Services that are not balancers are only fenced when the
+	// speakers advertise their ClusterIP and ExternalIPs.
+	c.SetNamespace(l, "incident", fenced)
+	clusterIP := svc("incident")
+	clusterIP.Spec.Type = "ClusterIP"
+	k.reset()
+	if c.SetBalancer(l, "incident/cluster", clusterIP, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := k.gotService(nil); got != nil {
+		t.Errorf("service without announced IPs updated: %v", got)
+	}
+	cfg.ServiceIPs = &config.ServiceIPs{ClusterIPs: true}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	k.reset()
+	if c.SetBalancer(l, "incident/cluster", clusterIP, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := k.gotService(nil); got == nil || got.Annotations[k8s.NamespaceFencedAnnotation] != "true" {
+		t.Errorf("service with an advertised ClusterIP not marked as fenced: %v", got)
+	}
+}
+
+func TestNamespaceScope(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+		scope: namespaceScope{
+			names:    map[string]bool{"tenant-a": true, "tenant-b": true},
+			selector: labels.SelectorFromSet(labels.Set{"metallb": "enabled"}),
+		},
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	ns := func(name string, enabled bool) *v1.Namespace {
+		ret := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if enabled {
+			ret.Labels = map[string]string{"metallb": "enabled"}
+		}
+		return ret
+	}
+	if c.SetNamespace(l, "tenant-a", ns("tenant-a", true)) != k8s.SyncStateReprocessAll {
+		t.Fatal("selecting a namespace didn't ask for reprocessing")
+	}
+	// Not in --watch-namespaces, the selector doesn't matter.
+	c.SetNamespace(l, "other", ns("other", true))
+	c.SetNamespace(l, "tenant-b", ns("tenant-b", false))
+	c.MarkSynced(l)
+
+	svc := func(ns string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: ns,
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+	}
+
+	for _, name := range []string{"other", "tenant-b"} {
+		k.reset()
+		if c.SetBalancer(l, name+"/test", svc(name), nil) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+		if got := k.gotService(nil); got != nil {
+			t.Errorf("service in unmanaged namespace %q was updated: %v", name, got)
+		}
+		if ip := c.ips.IP(name + "/test"); ip != nil {
+			t.Errorf("service in unmanaged namespace %q got IP %s", name, ip)
+		}
+	}
+
+	k.reset()
+	if c.SetBalancer(l, "tenant-a/test", svc("tenant-a"), nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	got := k.gotService(nil)
+	if got == nil || len(got.Status.LoadBalancer.Ingress) == 0 {
+		t.Fatalf("service in managed namespace didn't get an IP: %v", got)
+	}
+
+	// The namespace leaves the scope, its service's IP is released.
+	if c.SetNamespace(l, "tenant-a", ns("tenant-a", false)) != k8s.SyncStateReprocessAll {
+		t.Fatal("unselecting a namespace didn't ask for reprocessing")
+	}
+	k.reset()
+	if c.SetBalancer(l, "tenant-a/test", got, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if ip := c.ips.IP("tenant-a/test"); ip != nil {
+		t.Errorf("service kept IP %s after its namespace left the scope", ip)
+	}
+	// Speakers aren't scoped, the status must go too.
+	released := k.gotService(got)
+	if released == nil || len(released.Status.LoadBalancer.Ingress) != 0 {
+		t.Errorf("service status not cleared after its namespace left the scope: %v", released)
+	}
+
+	// Once released, the service isn't written again.
+	k.reset()
+	if c.SetBalancer(l, "tenant-a/test", released, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if again := k.gotService(nil); again != nil {
+		t.Errorf("released service out of scope was updated: %v", again)
+	}
+}
+
+func TestAllocationHooks(t *testing.T) {
+	k := &testK8S{t: t}
+	var (
+		calls   []hooks.Allocation
+		hookErr error
+	)
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+		hooks: []allocationHook{
+			{"test", hooks.HookFunc(func(ctx context.Context, a hooks.Allocation) error {
+				calls = append(calls, a)
+				return hookErr
+			})},
+		},
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "test",
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+
+	// A failing hook keeps the IP out of the status.
+	hookErr = errors.New("scrubber not ready")
+	if c.SetBalancer(l, "default/test", svc, nil) != k8s.SyncStateError {
+		t.Fatal("SetBalancer succeeded with failing hook")
+	}
+	if k.updateServiceStatus != nil {
+		t.Fatalf("status updated despite failing hook: %v", k.updateServiceStatus)
+	}
+	if !k.loggedWarning {
+		t.Error("no warning event for failing hook")
+	}
+
+	hookErr = nil
+	k.reset()
+	calls = nil
+	if c.SetBalancer(l, "default/test", svc, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	got := k.gotService(svc)
+	if got == nil || len(got.Status.LoadBalancer.Ingress) != 1 {
+		t.Fatalf("status not updated after hook succeeded: %v", got)
+	}
+	ip := got.Status.LoadBalancer.Ingress[0].IP
+	if len(calls) != 1 || calls[0].Service != "default/test" || calls[0].IP.String() != ip || calls[0].Pool != "default" {
+		t.Errorf("hook got %+v, want one call for default/test on %s from default", calls, ip)
+	}
+
+	// The published IP doesn't go through the hooks again.
+	k.reset()
+	calls = nil
+	if c.SetBalancer(l, "default/test", got, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if len(calls) != 0 {
+		t.Errorf("hook called again for published IP: %+v", calls)
+	}
+}
+
+func TestWhatIf(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+			"manual": {
+				CIDR: []*net.IPNet{ipnet("1.2.4.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	existing := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "existing",
+			Annotations: map[string]string{
+				"metallb.universe.tf/allow-shared-ip": "share",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+			Ports:     []v1.ServicePort{{Port: 80, Protocol: "TCP"}},
+		},
+	}
+	if c.SetBalancer(l, "default/existing", existing, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+
+	tests := []struct {
+		desc string
+		svc  *v1.Service
+		want whatIfResult
+	}{
+		{
+			desc: "next free IP",
+			svc: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "new"},
+				Spec:       v1.ServiceSpec{Type: "LoadBalancer"},
+			},
+			want: whatIfResult{
+				Service: "default/new",
+				Pool:    "default",
+				IP:      "1.2.3.1",
+				Reason:  "first pool, by name, with auto-assign enabled and a free IP of the service's family",
+			},
+		},
+		{
+			desc: "requested pool",
+			svc: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "new",
+					Annotations: map[string]string{"metallb.universe.tf/address-pool": "manual"},
+				},
+				Spec: v1.ServiceSpec{Type: "LoadBalancer"},
+			},
+			want: whatIfResult{
+				Service: "default/new",
+				Pool:    "manual",
+				IP:      "1.2.4.0",
+				Reason:  `the metallb.universe.tf/address-pool annotation requests pool "manual"`,
+			},
+		},
+		{
+			desc: "shared IP",
+			svc: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "new",
+					Annotations: map[string]string{"metallb.universe.tf/allow-shared-ip": "share"},
+				},
+				Spec: v1.ServiceSpec{
+					Type:           "LoadBalancer",
+					LoadBalancerIP: "1.2.3.0",
+					Ports:          []v1.ServicePort{{Port: 443, Protocol: "TCP"}},
+				},
+			},
+			want: whatIfResult{
+				Service:    "default/new",
+				Pool:       "default",
+				IP:         "1.2.3.0",
+				SharedWith: []string{"default/existing"},
+				Reason:     "spec.loadBalancerIP requests 1.2.3.0",
+			},
+		},
+		{
+			desc: "IP in use",
+			svc: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "new"},
+				Spec: v1.ServiceSpec{
+					Type:           "LoadBalancer",
+					LoadBalancerIP: "1.2.3.0",
+				},
+			},
+			want: whatIfResult{
+				Service: "default/new",
+				Reason:  "spec.loadBalancerIP requests 1.2.3.0",
+				Error:   `can't change sharing key for "default/new", address also in use by default/existing`,
+			},
+		},
+		{
+			desc: "shared IP with another namespace",
+			svc: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "team-b",
+					Name:        "new",
+					Annotations: map[string]string{"metallb.universe.tf/allow-shared-ip": "share"},
+				},
+				Spec: v1.ServiceSpec{
+					Type:           "LoadBalancer",
+					LoadBalancerIP: "1.2.3.0",
+					Ports:          []v1.ServicePort{{Port: 443, Protocol: "TCP"}},
+				},
+			},
+			want: whatIfResult{
+				Service:         "team-b/new",
+				Pool:            "default",
+				IP:              "1.2.3.0",
+				OtherNamespaces: 1,
+				Reason:          "spec.loadBalancerIP requests 1.2.3.0",
+			},
+		},
+		{
+			desc: "IP in use in another namespace",
+			svc: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "new"},
+				Spec: v1.ServiceSpec{
+					Type:           "LoadBalancer",
+					LoadBalancerIP: "1.2.3.0",
+				},
+			},
+			want: whatIfResult{
+				Service: "team-b/new",
+				Reason:  "spec.loadBalancerIP requests 1.2.3.0",
+				Error:   `can't change sharing key for "team-b/new", address also in use by <service in another namespace>`,
+			},
+		},
+		{
+			desc: "not a load balancer",
+			svc: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "new"},
+				Spec:       v1.ServiceSpec{Type: "ClusterIP"},
+			},
+			want: whatIfResult{
+				Service: "default/new",
+				Reason:  "first pool, by name, with auto-assign enabled and a free IP of the service's family",
+				Error:   `service type is "ClusterIP", MetalLB only allocates IPs to LoadBalancer services`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := c.whatIf(test.svc)
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%s: wrong result (-want +got)\n%s", test.desc, diff)
+		}
+	}
+
+	// Simulations change nothing.
+	if ip := c.ips.IP("default/new"); ip != nil {
+		t.Errorf("simulated allocation leaked, default/new has %s", ip)
+	}
+	if got := c.ips.ServicesOnIP(net.ParseIP("1.2.3.0")); !cmp.Equal(got, []string{"default/existing"}) {
+		t.Errorf("simulation changed the services on 1.2.3.0 to %v", got)
+	}
+
+	// Only requests with the token are answered.
+	serve := c.serveWhatIf(func(f func()) error { f(); return nil }, "secret")
+	body := `{"apiVersion":"v1","kind":"Service","metadata":{"name":"new"},"spec":{"type":"LoadBalancer"}}`
+	for _, auth := range []string{"", "Bearer wrong", "Bearer secret"} {
+		req := httptest.NewRequest(http.MethodPost, "/what-if", strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		serve(w, req)
+		want := http.StatusUnauthorized
+		if auth == "Bearer secret" {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("authorization %q: got status %d, want %d", auth, w.Code, want)
+		}
+	}
+}
+
+func TestServiceFinalizer(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:               allocator.New(),
+		client:            k,
+		serviceFinalizers: true,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Finalizers: []string{"example.com/other"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	svc = k.gotService(svc)
+	if svc == nil || len(svc.Status.LoadBalancer.Ingress) == 0 {
+		t.Fatal("service didn't get an IP")
+	}
+	if diff := cmp.Diff([]string{"example.com/other", serviceFinalizer}, svc.Finalizers); diff != "" {
+		t.Fatalf("wrong finalizers (-want +got)\n%s", diff)
+	}
+	k.reset()
+
+	// Deleting the service releases its IP and removes only our
+	// finalizer.
+	now := metav1.Now()
+	svc.DeletionTimestamp = &now
+	if c.SetBalancer(l, "test", svc, nil) != k8s.SyncStateReprocessAll {
+		t.Fatal("SetBalancer on deleted service didn't tell us to reprocess all balancers")
+	}
+	if k.updateService == nil {
+		t.Fatal("finalizer wasn't removed")
+	}
+	if diff := cmp.Diff([]string{"example.com/other"}, k.updateService.Finalizers); diff != "" {
+		t.Fatalf("wrong finalizers (-want +got)\n%s", diff)
+	}
+	if ip := c.ips.IP("test"); ip != nil {
+		t.Fatalf("IP %s of deleted service wasn't released", ip)
+	}
+	k.reset()
+
+	// The final delete event is a no-op.
+	if c.SetBalancer(l, "test", nil, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer with nil LB failed")
+	}
+
+	// With finalizers disabled, existing finalizers are removed.
+	c.serviceFinalizers = false
+	svc2 := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Finalizers: []string{serviceFinalizer},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	if c.SetBalancer(l, "test2", svc2, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer svc2 failed")
+	}
+	svc2 = k.gotService(svc2)
+	if svc2 == nil || len(svc2.Status.LoadBalancer.Ingress) == 0 {
+		t.Fatal("svc2 didn't get an IP")
+	}
+	if len(svc2.Finalizers) != 0 {
+		t.Fatalf("finalizers not removed: %v", svc2.Finalizers)
+	}
+}
+
+// releaseAgent is an IPAM agent holding reservations res, that
+// records the IDs it releases.
+type releaseAgent struct {
+	ipam.Agent
+	res      []ipam.IPAddressReservation
+	released []string
+}
+
+func (a *releaseAgent) ListIPReservations(nt ipam.NetworkType, metaData map[string]string) ([]ipam.IPAddressReservation, error) {
+	return a.res, nil
+}
+
+func (a *releaseAgent) ReleaseIPs(nt ipam.NetworkType, ids []string) error {
+	a.released = append(a.released, ids...)
+	return nil
+}
+
+func TestServiceFinalizerRestart(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:               allocator.New(),
+		client:            k,
+		serviceFinalizers: true,
+	}
+	l := log.NewNopLogger()
+	agent := &releaseAgent{
+		Agent: fake.GetFakeIPAMAgent(),
+		res:   []ipam.IPAddressReservation{{ID: "the id", Address: "1.2.3.4"}},
+	}
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				Protocol:   config.IPAM,
+				IPAM:       agent,
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+
+	// The controller restarted while the service was being deleted,
+	// its IP is only known from the status.
+	now := metav1.Now()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Finalizers:        []string{serviceFinalizer},
+			DeletionTimestamp: &now,
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "10.0.0.1",
+		},
+		Status: statusAssigned("1.2.3.4"),
+	}
+
+	// Until synced, services sharing the IP may not be known, so the
+	// release waits.
+	if c.SetBalancer(l, "test", svc, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if k.updateService != nil || len(agent.released) != 0 {
+		t.Fatal("IP released before sync")
+	}
+
+	c.MarkSynced(l)
+	if c.SetBalancer(l, "test", svc, nil) != k8s.SyncStateReprocessAll {
+		t.Fatal("SetBalancer on deleted service didn't tell us to reprocess all balancers")
+	}
+	if diff := cmp.Diff([]string{"the id"}, agent.released); diff != "" {
+		t.Fatalf("wrong released reservations (-want +got)\n%s", diff)
+	}
+	if k.updateService == nil || len(k.updateService.Finalizers) != 0 {
+		t.Fatal("finalizer wasn't removed")
+	}
+}
+
+func TestAdoptionBarrier(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+	l := log.NewNopLogger()
+
+	old := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+		Status: statusAssigned("1.2.3.0"),
+	}
+	stale := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+		Status: statusAssigned("4.5.6.7"),
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+
+	// Existing services are seen before the config is loaded, so
+	// their IPs aren't adopted.
+	for name, s := range map[string]*v1.Service{"old": old, "stale": stale} {
+		if c.SetBalancer(l, name, s, nil) == k8s.SyncStateError {
+			t.Fatalf("SetBalancer %s failed", name)
+		}
+	}
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+	if c.synced {
+		t.Fatal("controller synced before the IPs of existing services were adopted")
+	}
+
+	// A new service must not get an IP yet, it could be old's.
+	if c.SetBalancer(l, "new", svc, nil) != k8s.SyncStateError {
+		t.Fatal("SetBalancer allocated before sync")
+	}
+	if k.gotService(svc) != nil {
+		t.Fatal("SetBalancer mutated service before sync")
+	}
+
+	// The stale IP isn't allowed by the config, and is cleared
+	// rather than adopted. That doesn't unblock the sync.
+	if c.SetBalancer(l, "stale", stale, nil) != k8s.SyncStateError {
+		t.Fatal("SetBalancer stale didn't wait for the sync to allocate")
+	}
+	if c.synced {
+		t.Fatal("controller synced before old's IP was adopted")
+	}
+	k.reset()
+
+	// Adopting old's IP completes the sync, and all services must be
+	// reprocessed to get IPs.
+	if c.SetBalancer(l, "old", old, nil) != k8s.SyncStateReprocessAll {
+		t.Fatal("adopting the last IP didn't tell us to reprocess all balancers")
+	}
+	if !c.synced {
+		t.Fatal("controller not synced after adopting all IPs")
+	}
+	if c.SetBalancer(l, "new", svc, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer new failed")
+	}
+	gotSvc := k.gotService(svc)
+	if gotSvc == nil || len(gotSvc.Status.LoadBalancer.Ingress) == 0 || gotSvc.Status.LoadBalancer.Ingress[0].IP != "1.2.3.1" {
+		t.Fatalf("new service didn't get the free IP: %v", gotSvc)
+	}
+}
+
+func TestNamespaceThrottle(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:      allocator.New(),
+		client:   k,
+		throttle: newNamespaceThrottle(1, 2),
+	}
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/29")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := func(ns, name string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+	}
+	allocate := func(s *v1.Service) bool {
+		k.reset()
+		if c.SetBalancer(l, s.Namespace+"/"+s.Name, s, nil) == k8s.SyncStateError {
+			t.Fatalf("SetBalancer %s/%s failed", s.Namespace, s.Name)
+		}
+		got := k.gotService(s)
+		return got != nil && len(got.Status.LoadBalancer.Ingress) == 1
+	}
+
+	// The burst goes through, the next allocation has to wait.
+	for _, name := range []string{"a1", "a2"} {
+		if !allocate(svc("a", name)) {
+			t.Fatalf("service %s not allocated within the burst", name)
+		}
+	}
+	a3 := svc("a", "a3")
+	if allocate(a3) {
+		t.Fatal("service a3 allocated beyond the burst")
+	}
+	if got := k.gotService(a3); got == nil || got.Annotations[pendingReasonAnnotation] != pendingThrottled {
+		t.Fatal("service a3 not marked as throttled")
+	}
+	// It is retried once the bucket has a token again.
+	if got := k.requeued["a/a3"]; got != time.Second {
+		t.Fatalf("service a3 requeued after %s, want 1s", got)
+	}
+
+	// Other namespaces are unaffected.
+	if !allocate(svc("b", "b1")) {
+		t.Fatal("service b1 throttled by namespace a")
+	}
+
+	// The bucket refills at the rate.
+	now = now.Add(time.Second)
+	if !allocate(a3) {
+		t.Fatal("service a3 still throttled after the bucket refilled")
+	}
+	a4 := svc("a", "a4")
+	if allocate(a4) {
+		t.Fatal("service a4 allocated beyond the rate")
+	}
+
+	// Failed allocations don't use up the namespace's rate.
+	now = now.Add(time.Second)
+	unavailable := svc("a", "unavailable")
+	unavailable.Spec.LoadBalancerIP = "10.0.0.1"
+	if allocate(unavailable) {
+		t.Fatal("service got an IP outside the pools")
+	}
+	if !allocate(a4) {
+		t.Fatal("failed allocation counted against the rate")
+	}
+}
+
+func TestWaitForEndpoints(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+		zones:  newEndpointZones(),
+	}
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"zone-a": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+				Topology:   &config.Topology{Key: config.DefaultTopologyKey, Zones: []string{"a"}},
+			},
+			"zone-b": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.4.0/32")},
+				Topology:   &config.Topology{Key: config.DefaultTopologyKey, Zones: []string{"b"}},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+	c.SetClusterNode(l, "node-b", &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-b",
+			Labels: map[string]string{config.DefaultTopologyKey: "b"},
+		},
+	})
+
+	svc := func(name string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(now),
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+	}
+	allocate := func(s *v1.Service, eps *v1.Endpoints) string {
+		k.reset()
+		if c.SetBalancer(l, s.Name, s, eps) == k8s.SyncStateError {
+			t.Fatalf("SetBalancer %s failed", s.Name)
+		}
+		got := k.gotService(s)
+		if got == nil || len(got.Status.LoadBalancer.Ingress) != 1 {
+			return ""
+		}
+		return got.Status.LoadBalancer.Ingress[0].IP
+	}
+
+	// A new service without ready endpoints waits for them.
+	near := svc("near")
+	if ip := allocate(near, nil); ip != "" {
+		t.Fatalf("service without endpoints allocated %s right away", ip)
+	}
+	if got := k.gotService(near); got == nil || got.Annotations[pendingReasonAnnotation] != pendingWaitingForEndpoints {
+		t.Fatal("service not marked as waiting for endpoints")
+	}
+	if got := k.requeued["near"]; got != endpointWait {
+		t.Fatalf("service requeued after %s, want %s", got, endpointWait)
+	}
+
+	// Once they are ready, it gets an IP from their zone.
+	node := "node-b"
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{Addresses: []v1.EndpointAddress{{IP: "10.0.0.1", NodeName: &node}}},
+		},
+	}
+	if ip := allocate(near, eps); ip != "1.2.4.0" {
+		t.Fatalf("service with endpoints in zone b got IP %q, want 1.2.4.0", ip)
+	}
+
+	// Services whose endpoints don't show up get an IP anyway.
+	late := svc("late")
+	now = now.Add(endpointWait)
+	if ip := allocate(late, nil); ip != "1.2.3.0" {
+		t.Fatalf("service without endpoints got IP %q after waiting, want 1.2.3.0", ip)
+	}
+}
+
+func TestPendingAnnotations(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+			"manual": {
+				CIDR: []*net.IPNet{ipnet("1.2.4.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := func(name string, created time.Time, annotations map[string]string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(created),
+				Annotations:       annotations,
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+	}
+	set := func(s *v1.Service) *v1.Service {
+		k.reset()
+		c.SetBalancer(l, s.Name, s, nil)
+		got := k.gotService(s)
+		if got == nil {
+			t.Fatalf("service %s not updated", s.Name)
+		}
+		return got
+	}
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The first service takes the only IP, the others wait for it in
+	// order of creation, whatever the order they're processed in.
+	set(svc("first", t0, nil))
+	third := set(svc("third", t0.Add(2*time.Second), nil))
+	second := set(svc("second", t0.Add(time.Second), nil))
+	third = set(third)
+
+	// Other pools have their own queue.
+	manualPool := map[string]string{"metallb.universe.tf/address-pool": "manual"}
+	set(svc("manual1", t0.Add(3*time.Second), manualPool))
+	manual2 := set(svc("manual2", t0.Add(4*time.Second), manualPool))
+
+	tests := []struct {
+		svc                    *v1.Service
+		reason, pool, position string
+	}{
+		{second, pendingAllocationFailed, "default", "1"},
+		{third, pendingAllocationFailed, "default", "2"},
+		{manual2, pendingAllocationFailed, "manual", "1"},
+	}
+	for _, test := range tests {
+		for a, want := range map[string]string{
+			pendingReasonAnnotation:   test.reason,
+			pendingPoolAnnotation:     test.pool,
+			pendingPositionAnnotation: test.position,
+		} {
+			if got := test.svc.Annotations[a]; got != want {
+				t.Errorf("service %s: got %s %q, want %q", test.svc.Name, a, got, want)
+			}
+		}
+	}
+
+	// Deleting the first service lets the second one through, and
+	// the third moves up.
+	c.SetBalancer(l, "first", nil, nil)
+	if got := set(second); len(got.Status.LoadBalancer.Ingress) != 1 || got.Annotations[pendingReasonAnnotation] != "" {
+		t.Fatalf("second service not allocated: %v", got)
+	}
+	if got := set(third).Annotations[pendingPositionAnnotation]; got != "1" {
+		t.Fatalf("third service at position %q, want 1", got)
+	}
+}
+
+func TestPoolSelector(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+			"gold": {
+				CIDR:   []*net.IPNet{ipnet("1.2.4.0/32")},
+				Labels: labels.Set{"tier": "gold"},
+			},
+			"silver": {
+				CIDR:   []*net.IPNet{ipnet("1.2.5.0/32")},
+				Labels: labels.Set{"tier": "silver"},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{poolSelectorAnnotation: "tier=gold"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	tests := []struct {
+		desc     string
+		selector string
+		want     string
+	}{
+		{"select gold", "tier=gold", "1.2.4.0"},
+		{"unchanged", "tier=gold", "1.2.4.0"},
+		{"still matching", "tier in (gold, silver)", "1.2.4.0"},
+		{"select silver", "tier=silver", "1.2.5.0"},
+		// Typos don't take IPs away.
+		{"invalid selector", "tier=(", "1.2.5.0"},
+	}
+	for _, test := range tests {
+		svc.Annotations[poolSelectorAnnotation] = test.selector
+		k.reset()
+		c.SetBalancer(l, "test", svc, nil)
+		if got := k.gotService(svc); got != nil {
+			svc = got
+		}
+		var ip string
+		if ingress := svc.Status.LoadBalancer.Ingress; len(ingress) == 1 {
+			ip = ingress[0].IP
+		}
+		if ip != test.want {
+			t.Errorf("%s: got IP %q, want %q", test.desc, ip, test.want)
+		}
+	}
 }
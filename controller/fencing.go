@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+)
+
+// SetNamespace tracks which namespaces are fenced, see
+// k8s.FencedAnnotation, and which are managed, see namespaceScope. ns
+// is nil if name was deleted.
+func (c *controller) SetNamespace(l log.Logger, name string, ns *v1.Namespace) k8s.SyncState {
+	scoped := c.scope.setNamespace(l, name, ns)
+	fenced := c.setFenced(l, name, ns)
+	if scoped || fenced {
+		return k8s.SyncStateReprocessAll
+	}
+	return k8s.SyncStateSuccess
+}
+
+// setFenced tracks whether the namespace name is fenced, and returns
+// whether that changed.
+func (c *controller) setFenced(l log.Logger, name string, ns *v1.Namespace) bool {
+	fenced := ns != nil && ns.Annotations[k8s.FencedAnnotation] == "true"
+	if fenced == c.fenced[name] {
+		return false
+	}
+
+	if fenced {
+		if c.fenced == nil {
+			c.fenced = map[string]bool{}
+		}
+		c.fenced[name] = true
+		l.Log("event", "namespaceFenced", "msg", "namespace fenced, withdrawing announcements of its services")
+	} else {
+		delete(c.fenced, name)
+		l.Log("event", "namespaceUnfenced", "msg", "namespace no longer fenced, resuming announcements of its services")
+	}
+	return true
+}
+
+// checkFence marks svc as fenced if its namespace is, so that the
+// speakers withdraw it, and unmarks it otherwise.
+func (c *controller) checkFence(l log.Logger, svc *v1.Service) {
+	// Namespaces are all processed before the controller is synced.
+	// Until then, a fenced namespace may not be known yet, and
+	// unfencing its services would leak traffic.
+	if !c.synced {
+		return
+	}
+
+	marked := svc.Annotations[k8s.NamespaceFencedAnnotation] == "true"
+	switch {
+	case c.fenced[svc.Namespace] && !marked:
+		if svc.Annotations == nil {
+			svc.Annotations = map[string]string{}
+		}
+		svc.Annotations[k8s.NamespaceFencedAnnotation] = "true"
+		l.Log("event", "serviceFenced", "msg", "namespace is fenced, withdrawing announcements")
+		c.client.Errorf(svc, "Fenced", "Namespace %q is fenced, announcements withdrawn", svc.Namespace)
+	case !c.fenced[svc.Namespace] && marked:
+		delete(svc.Annotations, k8s.NamespaceFencedAnnotation)
+		l.Log("event", "serviceUnfenced", "msg", "namespace no longer fenced, resuming announcements")
+		c.client.Infof(svc, "Unfenced", "Namespace %q is no longer fenced, announcements resumed", svc.Namespace)
+	}
+}
+
+// fenceApplies returns true if the speakers may announce IPs of svc:
+// its LoadBalancer IP, or its ClusterIP and ExternalIPs with the
+// service IP advertisement, or if svc is still marked as fenced.
+func (c *controller) fenceApplies(svc *v1.Service) bool {
+	return svc.Spec.Type == v1.ServiceTypeLoadBalancer || c.config.ServiceIPs != nil || svc.Annotations[k8s.NamespaceFencedAnnotation] != ""
+}
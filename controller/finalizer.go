@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"go.universe.tf/metallb/internal/allocator/k8salloc"
+	"go.universe.tf/metallb/internal/k8s"
+	"go.universe.tf/metallb/internal/tracing"
+)
+
+// serviceFinalizer blocks the deletion of services with an IP until
+// the IP is released, so that IPAM reservations aren't leaked when
+// the controller misses the deletion.
+const serviceFinalizer = "metallb.universe.tf/ip-release"
+
+func hasFinalizer(svc *v1.Service) bool {
+	for _, f := range svc.Finalizers {
+		if f == serviceFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// setFinalizer adds or removes serviceFinalizer on svc.
+func setFinalizer(svc *v1.Service, want bool) {
+	if hasFinalizer(svc) == want {
+		return
+	}
+	if want {
+		svc.Finalizers = append(svc.Finalizers, serviceFinalizer)
+		return
+	}
+	var fs []string
+	for _, f := range svc.Finalizers {
+		if f != serviceFinalizer {
+			fs = append(fs, f)
+		}
+	}
+	svc.Finalizers = fs
+}
+
+// releaseBalancer releases the IP of svcRo, which is being deleted,
+// and removes our finalizer so that the deletion can complete. The
+// finalizer stays as long as the IP can't be released, and the
+// release is retried.
+func (c *controller) releaseBalancer(ctx context.Context, l log.Logger, name string, svcRo *v1.Service) k8s.SyncState {
+	if c.ips.IP(name) == nil && len(svcRo.Status.LoadBalancer.Ingress) == 1 {
+		// The controller restarted since the service got its IP, so
+		// the allocator has to learn it again before releasing it.
+		if ip := net.ParseIP(svcRo.Status.LoadBalancer.Ingress[0].IP); ip != nil {
+			if err := c.ips.AssignCurrent(ctx, l, name, ip, svcRo.Annotations["metallb.universe.tf/address-pool"], k8salloc.Ports(svcRo), k8salloc.SharingKey(svcRo), k8salloc.BackendKey(svcRo), k8salloc.Protocol(svcRo)); err != nil {
+				l.Log("op", "releaseIP", "error", err, "ip", ip, "msg", "IP of deleted service not allowed by config, nothing to release")
+			}
+		}
+	}
+	if !c.synced && c.ips.IP(name) != nil {
+		// Services sharing the IP may not be known yet, and would
+		// lose its reservation. All services are processed again
+		// once synced.
+		l.Log("event", "releaseDeferred", "msg", "controller not synced yet, releasing IP of deleted service after sync")
+		return k8s.SyncStateSuccess
+	}
+	if err := c.ips.UnAllocate(ctx, l, name); err != nil {
+		l.Log("op", "releaseIP", "error", err, "msg", "failed to release IP of deleted service, retrying")
+		c.client.Errorf(svcRo, "IPReleaseFailed", "Failed to release IP, deletion is blocked until it is: %s", err)
+		return k8s.SyncStateError
+	}
+	c.forgetBalancer(l, name)
+
+	svc := svcRo.DeepCopy()
+	setFinalizer(svc, false)
+	_, span := tracing.Start(ctx, "k8s.UpdateService", "service", name)
+	_, err := c.client.Update(svc)
+	span.SetAttributes("conflict", strconv.FormatBool(apierrors.IsConflict(err)))
+	span.End(err)
+	if err != nil {
+		l.Log("op", "removeFinalizer", "error", err, "msg", "failed to remove finalizer")
+		return k8s.SyncStateError
+	}
+	l.Log("event", "finalizerRemoved", "msg", "IP released, service can be deleted")
+
+	// The released IP may be feasible for other services.
+	return k8s.SyncStateReprocessAll
+}
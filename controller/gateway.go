@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/allocator/k8salloc"
+	"go.universe.tf/metallb/internal/k8s"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// gatewayAllocKey returns the allocator key of the gateway name. The
+// prefix keeps gateways apart from services of the same name.
+func gatewayAllocKey(name string) string {
+	return "gateway:" + name
+}
+
+// gatewayRequest is the address a gateway requests from MetalLB.
+type gatewayRequest struct {
+	// The requested IP, or nil to get any IP.
+	ip net.IP
+	// The requested pool, or empty for any auto-assign pool.
+	pool string
+}
+
+// parseGatewayRequest returns the address gw requests in
+// spec.addresses, or nil if it doesn't request an IPAddress.
+func parseGatewayRequest(gw *unstructured.Unstructured) (*gatewayRequest, error) {
+	addrs, _, err := unstructured.NestedSlice(gw.Object, "spec", "addresses")
+	if err != nil {
+		return nil, fmt.Errorf("invalid spec.addresses: %s", err)
+	}
+	var ret *gatewayRequest
+	for _, a := range addrs {
+		addr, ok := a.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid spec.addresses entry")
+		}
+		// IPAddress is the default address type.
+		if typ, _ := addr["type"].(string); typ != "" && typ != "IPAddress" {
+			continue
+		}
+		if ret != nil {
+			return nil, errors.New("only one address of type IPAddress is supported")
+		}
+		ret = &gatewayRequest{
+			pool: gw.GetAnnotations()["metallb.universe.tf/address-pool"],
+		}
+		if v, _ := addr["value"].(string); v != "" {
+			ret.ip = net.ParseIP(v)
+			if ret.ip == nil {
+				return nil, fmt.Errorf("invalid IPAddress %q", v)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// gatewayStatusIP returns the IPAddress in gw's status, if any.
+func gatewayStatusIP(gw *unstructured.Unstructured) net.IP {
+	addrs, _, _ := unstructured.NestedSlice(gw.Object, "status", "addresses")
+	for _, a := range addrs {
+		addr, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if typ, _ := addr["type"].(string); typ != "" && typ != "IPAddress" {
+			continue
+		}
+		if v, _ := addr["value"].(string); v != "" {
+			return net.ParseIP(v)
+		}
+	}
+	return nil
+}
+
+// SetGateway allocates an IP for gateways of the classes MetalLB
+// handles that request one in spec.addresses, and publishes it in
+// their status. The gateway's data plane services then get the same
+// IP, see k8s.GatewayNameLabel. gw is nil if name was deleted.
+func (c *controller) SetGateway(l log.Logger, name string, gw *unstructured.Unstructured) k8s.SyncState {
+	if gw == nil {
+		return c.deleteGateway(l, name, "gatewayDeleted")
+	}
+	class, _, _ := unstructured.NestedString(gw.Object, "spec", "gatewayClassName")
+	if !c.gatewayClasses[class] {
+		return c.deleteGateway(l, name, "otherGatewayClass")
+	}
+	if c.config == nil {
+		l.Log("event", "noConfig", "msg", "not processing, still waiting for config")
+		return k8s.SyncStateSuccess
+	}
+
+	req, err := parseGatewayRequest(gw)
+	if err != nil {
+		l.Log("op", "setGateway", "error", err, "msg", "invalid gateway addresses")
+		return c.deleteGateway(l, name, "invalidAddresses")
+	}
+	if req == nil {
+		return c.deleteGateway(l, name, "noAddressRequested")
+	}
+
+	ctx := context.Background()
+	key := gatewayAllocKey(name)
+	sharingKey := k8salloc.GatewaySharingKey(name)
+
+	// Keep the IP already in the status if it still matches the
+	// request, so that the allocation survives restarts.
+	ip := gatewayStatusIP(gw)
+	if ip != nil && req.ip != nil && !req.ip.Equal(ip) {
+		l.Log("event", "clearAssignment", "reason", "differentIPRequested", "msg", "gateway requested a different IP than the one currently assigned")
+		ip = nil
+	}
+	if ip != nil {
+		if err := c.ips.Assign(key, ip, nil, sharingKey, "", ""); err != nil {
+			l.Log("event", "clearAssignment", "error", err, "msg", "current IP not allowed, clearing")
+			ip = nil
+		} else if req.pool != "" && c.ips.Pool(key) != req.pool {
+			l.Log("event", "clearAssignment", "reason", "differentPoolRequested", "msg", "gateway requested a different pool than the one currently assigned")
+			ip = nil
+		}
+	}
+
+	if ip == nil {
+		if err := c.ips.UnAllocate(ctx, l, key); err != nil {
+			l.Log("op", "releaseIP", "error", err, "msg", "failed to release gateway IP")
+		}
+		c.ips.Unassign(key)
+		if !c.synced {
+			l.Log("op", "allocateIP", "error", "controller not synced", "msg", "controller not synced yet, cannot allocate IP; will retry after sync")
+			return k8s.SyncStateError
+		}
+		switch {
+		case req.ip != nil:
+			err = c.ips.AssignRequested(ctx, l, key, req.ip, req.pool, nil, sharingKey, "", "")
+			ip = req.ip
+		case req.pool != "":
+			ip, err = c.ips.AllocateFromPool(ctx, l, key, false, req.pool, nil, sharingKey, "", "")
+		default:
+			ip, err = c.ips.Allocate(ctx, l, key, false, nil, sharingKey, "", "")
+		}
+		if err != nil {
+			// Like for services, wait for another change to make the
+			// allocation feasible.
+			l.Log("op", "allocateIP", "error", err, "msg", "IP allocation for gateway failed")
+			return c.deleteGateway(l, name, "allocationFailed")
+		}
+		l.Log("event", "ipAllocated", "ip", ip, "msg", "IP address assigned to gateway by controller")
+	}
+
+	st := k8s.SyncStateSuccess
+	if !c.gateways[name].Equal(ip) {
+		if c.gateways == nil {
+			c.gateways = map[string]net.IP{}
+		}
+		c.gateways[name] = ip
+		// The gateway's data plane services must move to the IP.
+		st = k8s.SyncStateReprocessAll
+	}
+
+	if !ip.Equal(gatewayStatusIP(gw)) {
+		gw = gw.DeepCopy()
+		addrs := []interface{}{
+			map[string]interface{}{
+				"type":  "IPAddress",
+				"value": ip.String(),
+			},
+		}
+		if err := unstructured.SetNestedSlice(gw.Object, addrs, "status", "addresses"); err != nil {
+			l.Log("bug", "true", "error", err, "msg", "failed to set gateway status")
+			return k8s.SyncStateError
+		}
+		if err := c.client.UpdateGatewayStatus(gw); err != nil {
+			l.Log("op", "updateGatewayStatus", "error", err, "msg", "failed to update gateway status")
+			return k8s.SyncStateError
+		}
+	}
+	return st
+}
+
+// deleteGateway releases the IP of the gateway name, if it has one.
+func (c *controller) deleteGateway(l log.Logger, name, reason string) k8s.SyncState {
+	key := gatewayAllocKey(name)
+	if c.ips.IP(key) == nil && c.gateways[name] == nil {
+		return k8s.SyncStateSuccess
+	}
+	if err := c.ips.UnAllocate(context.Background(), l, key); err != nil {
+		l.Log("op", "releaseIP", "error", err, "msg", "failed to release gateway IP")
+	}
+	c.ips.Unassign(key)
+	delete(c.gateways, name)
+	l.Log("event", "gatewayIPReleased", "reason", reason, "msg", "released gateway IP")
+	// Services stuck waiting for an IP may now get one, and the
+	// gateway's data plane services lose theirs.
+	return k8s.SyncStateReprocessAll
+}
+
+// gatewayIP returns the IP of the gateway whose data plane service
+// svc is, or nil if svc isn't one or the gateway has no IP.
+func (c *controller) gatewayIP(namespace string, labels map[string]string) net.IP {
+	gw := labels[k8s.GatewayNameLabel]
+	if gw == "" {
+		return nil
+	}
+	return c.gateways[namespace+"/"+gw]
+}
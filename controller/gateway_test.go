@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"go.universe.tf/metallb/internal/allocator"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func gateway(class string, addrs ...map[string]interface{}) *unstructured.Unstructured {
+	spec := map[string]interface{}{
+		"gatewayClassName": class,
+	}
+	if len(addrs) > 0 {
+		var as []interface{}
+		for _, a := range addrs {
+			as = append(as, a)
+		}
+		spec["addresses"] = as
+	}
+	gw := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "gateway.networking.k8s.io/v1",
+			"kind":       "Gateway",
+			"spec":       spec,
+		},
+	}
+	gw.SetNamespace("default")
+	gw.SetName("gw")
+	return gw
+}
+
+func TestParseGatewayRequest(t *testing.T) {
+	tests := []struct {
+		desc    string
+		gw      *unstructured.Unstructured
+		want    *gatewayRequest
+		wantErr bool
+	}{
+		{
+			desc: "no addresses",
+			gw:   gateway("metallb"),
+		},
+		{
+			desc: "hostname only",
+			gw:   gateway("metallb", map[string]interface{}{"type": "Hostname", "value": "gw.example.com"}),
+		},
+		{
+			desc: "any IP",
+			gw:   gateway("metallb", map[string]interface{}{"type": "IPAddress"}),
+			want: &gatewayRequest{},
+		},
+		{
+			desc: "default type",
+			gw:   gateway("metallb", map[string]interface{}{"value": "1.2.3.4"}),
+			want: &gatewayRequest{ip: net.ParseIP("1.2.3.4")},
+		},
+		{
+			desc:    "invalid IP",
+			gw:      gateway("metallb", map[string]interface{}{"type": "IPAddress", "value": "not-an-ip"}),
+			wantErr: true,
+		},
+		{
+			desc: "several IPs",
+			gw: gateway("metallb",
+				map[string]interface{}{"type": "IPAddress", "value": "1.2.3.4"},
+				map[string]interface{}{"type": "IPAddress", "value": "1.2.3.5"}),
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseGatewayRequest(test.gw)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.desc, err)
+			continue
+		}
+		if (got == nil) != (test.want == nil) || (got != nil && (!got.ip.Equal(test.want.ip) || got.pool != test.want.pool)) {
+			t.Errorf("%q: got request %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestGatewayAllocation(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:            allocator.New(),
+		client:         k,
+		gatewayClasses: map[string]bool{"metallb": true},
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	if c.SetGateway(l, "default/other", gateway("other", map[string]interface{}{"type": "IPAddress"})) != k8s.SyncStateSuccess {
+		t.Fatal("SetGateway failed for gateway of another class")
+	}
+	if k.updateGateway != nil || c.ips.IP(gatewayAllocKey("default/other")) != nil {
+		t.Fatal("gateway of another class got an IP")
+	}
+
+	gw := gateway("metallb", map[string]interface{}{"type": "IPAddress"})
+	if c.SetGateway(l, "default/gw", gw) != k8s.SyncStateReprocessAll {
+		t.Fatal("allocating a gateway IP didn't ask for reprocessing")
+	}
+	ip := c.ips.IP(gatewayAllocKey("default/gw"))
+	if ip == nil {
+		t.Fatal("gateway didn't get an IP")
+	}
+	if k.updateGateway == nil || !gatewayStatusIP(k.updateGateway).Equal(ip) {
+		t.Fatalf("gateway status not updated with %s: %v", ip, k.updateGateway)
+	}
+
+	// Once the status is written back, the gateway is stable.
+	gw = k.updateGateway
+	k.reset()
+	if c.SetGateway(l, "default/gw", gw) != k8s.SyncStateSuccess {
+		t.Fatal("SetGateway failed")
+	}
+	if k.updateGateway != nil {
+		t.Error("converged gateway status updated again")
+	}
+
+	// The gateway's data plane service shares its IP.
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Labels:    map[string]string{k8s.GatewayNameLabel: "gw"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "10.0.0.1",
+			Ports:     []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80}},
+		},
+	}
+	if c.SetBalancer(l, "default/envoy", svc, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	got := k.gotService(svc)
+	if got == nil || len(got.Status.LoadBalancer.Ingress) == 0 || got.Status.LoadBalancer.Ingress[0].IP != ip.String() {
+		t.Fatalf("data plane service didn't get the gateway IP %s: %v", ip, got)
+	}
+
+	// Another service can't take the gateway's IP.
+	k.reset()
+	other := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+		},
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "10.0.0.2",
+			LoadBalancerIP: ip.String(),
+		},
+	}
+	if c.SetBalancer(l, "default/other", other, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if !k.loggedWarning {
+		t.Error("service took the gateway's IP")
+	}
+
+	if c.SetGateway(l, "default/gw", nil) != k8s.SyncStateReprocessAll {
+		t.Fatal("deleting a gateway didn't ask for reprocessing")
+	}
+	if c.ips.IP(gatewayAllocKey("default/gw")) != nil {
+		t.Error("deleted gateway still holds its IP")
+	}
+}
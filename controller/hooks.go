@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.universe.tf/metallb/internal/tracing"
+	"go.universe.tf/metallb/pkg/hooks"
+	v1 "k8s.io/api/core/v1"
+)
+
+var hookCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "metallb",
+	Subsystem: "controller",
+	Name:      "allocation_hook_calls_total",
+	Help:      "Number of calls to allocation hooks, by hook and result",
+}, []string{
+	"hook",
+	"result",
+})
+
+func init() {
+	prometheus.MustRegister(hookCalls)
+}
+
+// allocationHook is a hook enabled on the command line.
+type allocationHook struct {
+	name string
+	hook hooks.Hook
+}
+
+// runHooks calls the allocation hooks for lbIP, unless svc's status
+// already has it. It returns false if a hook failed, in which case
+// the status must not be updated.
+func (c *controller) runHooks(ctx context.Context, l log.Logger, key string, svc *v1.Service, lbIP net.IP, pool string) bool {
+	if len(c.hooks) == 0 {
+		return true
+	}
+	if ingress := svc.Status.LoadBalancer.Ingress; len(ingress) == 1 && net.ParseIP(ingress[0].IP).Equal(lbIP) {
+		return true
+	}
+
+	a := hooks.Allocation{Service: key, IP: lbIP, Pool: pool}
+	for _, h := range c.hooks {
+		hctx, span := tracing.Start(ctx, "hook.Allocated", "hook", h.name, "ip", lbIP.String())
+		cancel := func() {}
+		if c.hookTimeout > 0 {
+			hctx, cancel = context.WithTimeout(hctx, c.hookTimeout)
+		}
+		start := time.Now()
+		err := h.hook.Allocated(hctx, a)
+		cancel()
+		span.End(err)
+		if err != nil {
+			hookCalls.WithLabelValues(h.name, "error").Inc()
+			l.Log("op", "allocationHook", "hook", h.name, "ip", lbIP, "error", err, "msg", "allocation hook failed, not publishing IP")
+			c.client.Errorf(svc, "AllocationHookFailed", "Allocation hook %q failed for IP %q: %s", h.name, lbIP, err)
+			return false
+		}
+		hookCalls.WithLabelValues(h.name, "success").Inc()
+		l.Log("event", "allocationHookDone", "hook", h.name, "ip", lbIP, "duration", time.Since(start), "msg", "allocation hook succeeded")
+	}
+	return true
+}
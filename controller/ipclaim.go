@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/k8s"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ipClaimAllocKey returns the allocator key of the IP claim name, so
+// that the claim shows up as the owner of its IP next to services.
+func ipClaimAllocKey(name string) string {
+	return "ipclaim:" + name
+}
+
+// ipClaimRequest is what an IPClaim asks for in its spec.
+type ipClaimRequest struct {
+	// The requested IP, or nil to get any IP.
+	ip net.IP
+	// The requested pool, or empty for any auto-assign pool.
+	pool string
+	// Whether an IPv6 address is requested.
+	isIPv6 bool
+}
+
+// parseIPClaimRequest returns the request in claim's spec.
+func parseIPClaimRequest(claim *unstructured.Unstructured) (*ipClaimRequest, error) {
+	ret := &ipClaimRequest{}
+	ret.pool, _, _ = unstructured.NestedString(claim.Object, "spec", "pool")
+	if v, _, _ := unstructured.NestedString(claim.Object, "spec", "address"); v != "" {
+		ret.ip = net.ParseIP(v)
+		if ret.ip == nil {
+			return nil, fmt.Errorf("invalid address %q", v)
+		}
+		ret.isIPv6 = ret.ip.To4() == nil
+	}
+	family, _, _ := unstructured.NestedString(claim.Object, "spec", "ipFamily")
+	switch family {
+	case "":
+	case "IPv4", "IPv6":
+		if ret.ip != nil && (family == "IPv6") != ret.isIPv6 {
+			return nil, fmt.Errorf("address %q is not in ipFamily %s", ret.ip, family)
+		}
+		ret.isIPv6 = family == "IPv6"
+	default:
+		return nil, fmt.Errorf("unknown ipFamily %q", family)
+	}
+	return ret, nil
+}
+
+// SetIPClaim reserves an address for the IPClaim name, independently
+// of any service, and publishes it in the claim's status. The address
+// is released when the claim is deleted, in which case claim is nil.
+// Claims meant to live as long as some other object, e.g. a VM, carry
+// an owner reference to it and are garbage collected with it.
+func (c *controller) SetIPClaim(l log.Logger, name string, claim *unstructured.Unstructured) k8s.SyncState {
+	if claim == nil {
+		return c.deleteIPClaim(l, name, "claimDeleted")
+	}
+	if c.config == nil {
+		l.Log("event", "noConfig", "msg", "not processing, still waiting for config")
+		return k8s.SyncStateSuccess
+	}
+
+	req, err := parseIPClaimRequest(claim)
+	if err != nil {
+		l.Log("op", "setIPClaim", "error", err, "msg", "invalid IP claim")
+		st := c.deleteIPClaim(l, name, "invalidClaim")
+		if err := c.updateIPClaimStatus(claim, nil, err.Error()); err != nil {
+			l.Log("op", "updateIPClaimStatus", "error", err, "msg", "failed to update IP claim status")
+			return k8s.SyncStateError
+		}
+		return st
+	}
+
+	ctx := context.Background()
+	key := ipClaimAllocKey(name)
+
+	// Keep the IP already in the status if it still matches the
+	// request, so that the reservation survives restarts.
+	var ip net.IP
+	if v, _, _ := unstructured.NestedString(claim.Object, "status", "address"); v != "" {
+		ip = net.ParseIP(v)
+	}
+	if ip != nil && req.ip != nil && !req.ip.Equal(ip) {
+		l.Log("event", "clearAssignment", "reason", "differentIPRequested", "msg", "claim requested a different IP than the one currently assigned")
+		ip = nil
+	}
+	if ip != nil && req.isIPv6 != (ip.To4() == nil) {
+		l.Log("event", "clearAssignment", "reason", "differentIPFamily", "msg", "claim requested a different IP family than the one currently assigned")
+		ip = nil
+	}
+	if ip != nil {
+		if err := c.ips.Assign(key, ip, nil, "", "", ""); err != nil {
+			l.Log("event", "clearAssignment", "error", err, "msg", "current IP not allowed, clearing")
+			ip = nil
+		} else if req.pool != "" && c.ips.Pool(key) != req.pool {
+			l.Log("event", "clearAssignment", "reason", "differentPoolRequested", "msg", "claim requested a different pool than the one currently assigned")
+			ip = nil
+		}
+	}
+
+	st := k8s.SyncStateSuccess
+	if ip == nil {
+		if c.ips.IP(key) != nil {
+			if err := c.ips.UnAllocate(ctx, l, key); err != nil {
+				l.Log("op", "releaseIP", "error", err, "msg", "failed to release claimed IP")
+			}
+			c.ips.Unassign(key)
+			st = k8s.SyncStateReprocessAll
+		}
+		if !c.synced {
+			l.Log("op", "allocateIP", "error", "controller not synced", "msg", "controller not synced yet, cannot allocate IP; will retry after sync")
+			return k8s.SyncStateError
+		}
+		switch {
+		case req.ip != nil:
+			err = c.ips.AssignRequested(ctx, l, key, req.ip, req.pool, nil, "", "", "")
+			ip = req.ip
+		case req.pool != "":
+			ip, err = c.ips.AllocateFromPool(ctx, l, key, req.isIPv6, req.pool, nil, "", "", "")
+		default:
+			ip, err = c.ips.Allocate(ctx, l, key, req.isIPv6, nil, "", "", "")
+		}
+		if err != nil {
+			// Like for services, wait for another change to make the
+			// allocation feasible.
+			l.Log("op", "allocateIP", "error", err, "msg", "IP allocation for claim failed")
+			if err := c.updateIPClaimStatus(claim, nil, err.Error()); err != nil {
+				l.Log("op", "updateIPClaimStatus", "error", err, "msg", "failed to update IP claim status")
+				return k8s.SyncStateError
+			}
+			return st
+		}
+		owners := []string{}
+		for _, ref := range claim.GetOwnerReferences() {
+			owners = append(owners, ref.Kind+"/"+ref.Name)
+		}
+		l.Log("event", "ipAllocated", "ip", ip, "owners", fmt.Sprint(owners), "msg", "IP address reserved for claim by controller")
+	}
+
+	if err := c.updateIPClaimStatus(claim, ip, ""); err != nil {
+		l.Log("op", "updateIPClaimStatus", "error", err, "msg", "failed to update IP claim status")
+		return k8s.SyncStateError
+	}
+	return st
+}
+
+// updateIPClaimStatus sets claim's status to ip, or to msg if it has
+// no IP, if that's a change.
+func (c *controller) updateIPClaimStatus(claim *unstructured.Unstructured, ip net.IP, msg string) error {
+	status := map[string]interface{}{}
+	if ip != nil {
+		status["address"] = ip.String()
+		status["pool"] = c.ips.Pool(ipClaimAllocKey(claim.GetName()))
+	}
+	if msg != "" {
+		status["message"] = msg
+	}
+	old, _, _ := unstructured.NestedMap(claim.Object, "status")
+	if fmt.Sprint(old) == fmt.Sprint(status) {
+		return nil
+	}
+	claim = claim.DeepCopy()
+	if err := unstructured.SetNestedMap(claim.Object, status, "status"); err != nil {
+		return err
+	}
+	return c.client.UpdateIPClaimStatus(claim)
+}
+
+// deleteIPClaim releases the IP of the claim name, if it has one.
+func (c *controller) deleteIPClaim(l log.Logger, name, reason string) k8s.SyncState {
+	key := ipClaimAllocKey(name)
+	if c.ips.IP(key) == nil {
+		return k8s.SyncStateSuccess
+	}
+	if err := c.ips.UnAllocate(context.Background(), l, key); err != nil {
+		l.Log("op", "releaseIP", "error", err, "msg", "failed to release claimed IP")
+	}
+	c.ips.Unassign(key)
+	l.Log("event", "claimIPReleased", "reason", reason, "msg", "released claimed IP")
+	// Services stuck waiting for an IP may now get one.
+	return k8s.SyncStateReprocessAll
+}
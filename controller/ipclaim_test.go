@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"go.universe.tf/metallb/internal/allocator"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func ipClaim(spec map[string]interface{}) *unstructured.Unstructured {
+	claim := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "metallb.universe.tf/v1alpha1",
+			"kind":       "IPClaim",
+			"spec":       spec,
+		},
+	}
+	claim.SetName("vm")
+	return claim
+}
+
+func TestParseIPClaimRequest(t *testing.T) {
+	tests := []struct {
+		desc    string
+		spec    map[string]interface{}
+		want    *ipClaimRequest
+		wantErr bool
+	}{
+		{
+			desc: "any IP",
+			spec: map[string]interface{}{},
+			want: &ipClaimRequest{},
+		},
+		{
+			desc: "pool and family",
+			spec: map[string]interface{}{"pool": "vms", "ipFamily": "IPv6"},
+			want: &ipClaimRequest{pool: "vms", isIPv6: true},
+		},
+		{
+			desc: "address",
+			spec: map[string]interface{}{"address": "1.2.3.4"},
+			want: &ipClaimRequest{ip: net.ParseIP("1.2.3.4")},
+		},
+		{
+			desc:    "invalid address",
+			spec:    map[string]interface{}{"address": "not-an-ip"},
+			wantErr: true,
+		},
+		{
+			desc:    "address in other family",
+			spec:    map[string]interface{}{"address": "1.2.3.4", "ipFamily": "IPv6"},
+			wantErr: true,
+		},
+		{
+			desc:    "unknown family",
+			spec:    map[string]interface{}{"ipFamily": "IPv5"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseIPClaimRequest(ipClaim(test.spec))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.desc, err)
+			continue
+		}
+		if !got.ip.Equal(test.want.ip) || got.pool != test.want.pool || got.isIPv6 != test.want.isIPv6 {
+			t.Errorf("%q: got request %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestIPClaimAllocation(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+
+	claim := ipClaim(map[string]interface{}{"pool": "default"})
+	if c.SetIPClaim(l, "vm", claim) != k8s.SyncStateError {
+		t.Fatal("IP claim allocated before sync")
+	}
+	c.MarkSynced(l)
+
+	if c.SetIPClaim(l, "vm", claim) == k8s.SyncStateError {
+		t.Fatal("SetIPClaim failed")
+	}
+	ip := c.ips.IP(ipClaimAllocKey("vm"))
+	if !ip.Equal(net.ParseIP("1.2.3.0")) {
+		t.Fatalf("claim got IP %s, want 1.2.3.0", ip)
+	}
+	if k.updateIPClaim == nil {
+		t.Fatal("claim status not updated")
+	}
+	got, _, _ := unstructured.NestedString(k.updateIPClaim.Object, "status", "address")
+	if got != ip.String() {
+		t.Fatalf("claim status has address %q, want %s", got, ip)
+	}
+
+	// Once the status is written back, the claim is stable.
+	claim = k.updateIPClaim
+	k.reset()
+	if c.SetIPClaim(l, "vm", claim) != k8s.SyncStateSuccess {
+		t.Fatal("SetIPClaim failed")
+	}
+	if k.updateIPClaim != nil {
+		t.Error("converged claim status updated again")
+	}
+
+	// A service can't get the claimed IP.
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "10.0.0.1",
+		},
+	}
+	if c.SetBalancer(l, "default/svc", svc, nil) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if !k.loggedWarning {
+		t.Error("service got the claimed IP")
+	}
+
+	// A second claim fails, and says why in its status.
+	k.reset()
+	other := ipClaim(map[string]interface{}{})
+	other.SetName("other")
+	if c.SetIPClaim(l, "other", other) == k8s.SyncStateError {
+		t.Fatal("SetIPClaim failed")
+	}
+	if msg, _, _ := unstructured.NestedString(k.updateIPClaim.Object, "status", "message"); msg == "" {
+		t.Error("failed claim has no status message")
+	}
+
+	if c.SetIPClaim(l, "vm", nil) != k8s.SyncStateReprocessAll {
+		t.Fatal("deleting a claim didn't ask for reprocessing")
+	}
+	if c.ips.IP(ipClaimAllocKey("vm")) != nil {
+		t.Error("deleted claim still holds its IP")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "metallb",
+	Subsystem: "controller",
+	Name:      "leader",
+	Help:      "1 if this controller replica is the leader, 0 if it is on standby",
+})
+
+func init() {
+	prometheus.MustRegister(isLeader)
+}
+
+// leaderState is the leader election state of this replica, as served
+// on the debug endpoint.
+type leaderState struct {
+	// Protects the fields below, which are read by the debug and
+	// metrics servers.
+	mu sync.Mutex
+	// Identity of this replica, and of the last observed leader.
+	identity string
+	leader   string
+	// When this replica became the leader, zero on standby.
+	since time.Time
+}
+
+// leaderStatus is a snapshot of leaderState.
+type leaderStatus struct {
+	Identity    string     `json:"identity"`
+	Leader      string     `json:"leader"`
+	IsLeader    bool       `json:"isLeader"`
+	LeaderSince *time.Time `json:"leaderSince,omitempty"`
+	// True on standby replicas, whose other debug variables
+	// (sharingGroups, poolUsage) are not kept up to date. Ask the
+	// leader instead.
+	Stale bool `json:"stale"`
+}
+
+// setLeader records that leader is the new leader.
+func (s *leaderState) setLeader(leader string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if leader == s.leader {
+		return
+	}
+	s.leader = leader
+	if leader == s.identity {
+		s.since = time.Now()
+		isLeader.Set(1)
+	} else {
+		s.since = time.Time{}
+		isLeader.Set(0)
+	}
+}
+
+// leading returns whether this replica is the leader.
+func (s *leaderState) leading() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.since.IsZero()
+}
+
+// leadingFor returns how long this replica has been the leader, in
+// seconds.
+func (s *leaderState) leadingFor() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.since.IsZero() {
+		return 0
+	}
+	return time.Since(s.since).Seconds()
+}
+
+func (s *leaderState) snapshot() interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := leaderStatus{
+		Identity: s.identity,
+		Leader:   s.leader,
+		IsLeader: !s.since.IsZero(),
+		Stale:    s.since.IsZero(),
+	}
+	if !s.since.IsZero() {
+		since := s.since
+		ret.LeaderSince = &since
+	}
+	return ret
+}
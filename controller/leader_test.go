@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLeaderState(t *testing.T) {
+	s := &leaderState{identity: "controller-a"}
+
+	st := s.snapshot().(leaderStatus)
+	if st.IsLeader || !st.Stale || st.LeaderSince != nil {
+		t.Fatalf("replica with no observed leader not on standby: %+v", st)
+	}
+
+	s.setLeader("controller-b")
+	st = s.snapshot().(leaderStatus)
+	if st.Leader != "controller-b" || st.IsLeader || !st.Stale {
+		t.Fatalf("wrong status with another leader: %+v", st)
+	}
+	if s.leading() || s.leadingFor() != 0 {
+		t.Fatal("standby replica reports leading")
+	}
+
+	s.setLeader("controller-a")
+	st = s.snapshot().(leaderStatus)
+	if st.Leader != "controller-a" || !st.IsLeader || st.Stale || st.LeaderSince == nil {
+		t.Fatalf("wrong status as leader: %+v", st)
+	}
+	since := *st.LeaderSince
+	if !s.leading() {
+		t.Fatal("leader doesn't report leading")
+	}
+
+	// Observing itself again doesn't reset the leadership time.
+	s.setLeader("controller-a")
+	if st = s.snapshot().(leaderStatus); !st.LeaderSince.Equal(since) {
+		t.Fatalf("leadership time reset, got %s, want %s", st.LeaderSince, since)
+	}
+}
@@ -15,27 +15,50 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"go.universe.tf/metallb/internal/allocator"
 	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/control"
+	"go.universe.tf/metallb/internal/debug"
 	"go.universe.tf/metallb/internal/k8s"
 	"go.universe.tf/metallb/internal/logging"
+	"go.universe.tf/metallb/internal/secrets"
+	"go.universe.tf/metallb/internal/tracing"
 	"go.universe.tf/metallb/internal/version"
+	"go.universe.tf/metallb/pkg/hooks"
 
 	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/credentials"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 // Service offers methods to mutate a Kubernetes service object.
 type service interface {
 	Update(svc *v1.Service) (*v1.Service, error)
 	UpdateStatus(svc *v1.Service) error
+	UpdateGatewayStatus(gw *unstructured.Unstructured) error
+	UpdateIPClaimStatus(claim *unstructured.Unstructured) error
 	Infof(svc *v1.Service, desc, msg string, args ...interface{})
 	Errorf(svc *v1.Service, desc, msg string, args ...interface{})
+	RequeueAfter(name string, d time.Duration)
 }
 
 type controller struct {
@@ -43,42 +66,172 @@ type controller struct {
 	synced bool
 	config *config.Config
 	ips    *allocator.Allocator
+
+	// If true, IPs that are not reserved in the external IPAM are
+	// reallocated rather than re-reserved.
+	reallocateStaleIPs bool
+	// service -> IP whose IPAM reservation has been checked since
+	// startup.
+	verified map[string]net.IP
+	// service -> creation time, to resolve IP conflicts between
+	// services.
+	created map[string]metav1.Time
+	// service -> balancer state the service was last converged to.
+	states map[string]balancerState
+	// Set when processing a service changed the state of other
+	// services, which must be reprocessed.
+	reprocessAll bool
+
+	// Non-zero if some pool has a max-lease-duration, so services
+	// must be periodically reprocessed to expire leases. Accessed
+	// atomically.
+	hasLeases int32
+
+	// Services on each shared IP.
+	sharing sharingGroups
+
+	// How often the usage of pools using an external IPAM is fetched,
+	// see watchIPAMUsage. Zero fetches it on config changes only.
+	ipamUsageInterval time.Duration
+	// Usage of every pool.
+	usage poolUsages
+
+	// Set once every existing service was processed. The controller
+	// is synced once their IPs are adopted as well.
+	listed bool
+	// Services whose status IP isn't adopted yet.
+	unadopted map[string]bool
+
+	// Leader election state, for metrics and the debug endpoint.
+	leader leaderState
+
+	// Namespaces whose services must not be announced.
+	fenced map[string]bool
+	// Namespaces whose services the controller manages.
+	scope namespaceScope
+
+	// Gateway classes whose gateways get IPs, and the IPs of those
+	// gateways by name.
+	gatewayClasses map[string]bool
+	gateways       map[string]net.IP
+
+	// Called with new IPs before they're written to the status of
+	// services, each call bounded by hookTimeout if not zero.
+	hooks       []allocationHook
+	hookTimeout time.Duration
+
+	// If true, services with an IP get a finalizer that blocks their
+	// deletion until the IP is released.
+	serviceFinalizers bool
+
+	// If non-nil, IPs are allocated from pools in the zones of the
+	// services' endpoints.
+	zones *endpointZones
+	// Limits the rate of IP allocations of each namespace, nil if
+	// unlimited.
+	throttle *namespaceThrottle
+	// Services waiting for an IP.
+	pending map[string]pendingService
 }
 
-func (c *controller) SetBalancer(l log.Logger, name string, svcRo *v1.Service, _ *v1.Endpoints) k8s.SyncState {
+func (c *controller) SetBalancer(l log.Logger, name string, svcRo *v1.Service, eps *v1.Endpoints) k8s.SyncState {
 	l.Log("event", "startUpdate", "msg", "start of service update")
 	defer l.Log("event", "endUpdate", "msg", "end of service update")
 
+	c.zones.setEndpoints(name, eps)
+
+	ctx, span := tracing.Start(context.Background(), "controller.reconcile", "service", name)
+	st := c.setBalancer(ctx, l, name, svcRo)
+	if c.finishAdoption(l) {
+		// Services waiting for the sync can get IPs now.
+		c.reprocessAll = true
+	}
+	c.updateSharing(l, name, svcRo)
+	if c.ipamUsageInterval > 0 {
+		c.recordPoolUsage()
+	}
+	if c.reprocessAll {
+		// Resolving an IP conflict took IPs away from other services,
+		// which must now converge to new IPs, or the controller just
+		// synced.
+		c.reprocessAll = false
+		if st == k8s.SyncStateSuccess {
+			st = k8s.SyncStateReprocessAll
+		}
+	}
+	span.SetAttributes("result", syncStateName(st))
+	span.End(nil)
+	return st
+}
+
+func (c *controller) setBalancer(ctx context.Context, l log.Logger, name string, svcRo *v1.Service) k8s.SyncState {
 	if svcRo == nil {
-		c.deleteBalancer(l, name)
+		c.deleteBalancer(ctx, l, name)
 		// There might be other LBs stuck waiting for an IP, so when
 		// we delete a balancer we should reprocess all of them to
 		// check for newly feasible balancers.
 		return k8s.SyncStateReprocessAll
 	}
 
+	if !c.scope.manages(svcRo.Namespace) {
+		// Until synced, the namespace's labels may not be known yet,
+		// and releasing the service's IP would be premature.
+		switch {
+		case !c.synced:
+			return k8s.SyncStateSuccess
+		case hasFinalizer(svcRo), c.ips.IP(name) != nil:
+			l.Log("event", "serviceOutOfScope", "msg", "service's namespace is not managed, releasing its IP")
+			return c.releaseOutOfScope(ctx, l, name, svcRo)
+		}
+		return k8s.SyncStateSuccess
+	}
+
 	if c.config == nil {
 		// Config hasn't been read, nothing we can do just yet.
 		l.Log("event", "noConfig", "msg", "not processing, still waiting for config")
+		c.trackAdoption(name, svcRo)
 		return k8s.SyncStateSuccess
 	}
 
+	if svcRo.DeletionTimestamp != nil {
+		if !hasFinalizer(svcRo) {
+			// The IP is released when the deletion completes.
+			return k8s.SyncStateSuccess
+		}
+		return c.releaseBalancer(ctx, l, name, svcRo)
+	}
+
 	// Making a copy unconditionally is a bit wasteful, since we don't
 	// always need to update the service. But, making an unconditional
 	// copy makes the code much easier to follow, and we have a GC for
 	// a reason.
 	svc := svcRo.DeepCopy()
-	if !c.convergeBalancer(l, name, svc) {
+	converged := c.convergeBalancer(ctx, l, name, svc)
+	if converged && c.fenceApplies(svc) {
+		c.checkFence(l, svc)
+	}
+	c.trackAdoption(name, svc)
+	if !converged {
+		c.writePending(l, svcRo, svc)
 		return k8s.SyncStateError
 	}
+	setFinalizer(svc, c.serviceFinalizers && c.ips.IP(name) != nil)
 	if reflect.DeepEqual(svcRo, svc) {
 		l.Log("event", "noChange", "msg", "service converged, no change")
 		return k8s.SyncStateSuccess
 	}
+	return c.writeService(ctx, l, name, svcRo, svc)
+}
 
+// writeService writes the changes of svc, a modified copy of svcRo,
+// back into the cluster.
+func (c *controller) writeService(ctx context.Context, l log.Logger, name string, svcRo, svc *v1.Service) k8s.SyncState {
 	var err error
-	if !(reflect.DeepEqual(svcRo.Annotations, svc.Annotations) && reflect.DeepEqual(svcRo.Spec, svc.Spec)) {
+	if !(reflect.DeepEqual(svcRo.Annotations, svc.Annotations) && reflect.DeepEqual(svcRo.Finalizers, svc.Finalizers) && reflect.DeepEqual(svcRo.Spec, svc.Spec)) {
+		_, span := tracing.Start(ctx, "k8s.UpdateService", "service", name)
 		svcRo, err = c.client.Update(svc)
+		span.SetAttributes("conflict", strconv.FormatBool(apierrors.IsConflict(err)))
+		span.End(err)
 		if err != nil {
 			l.Log("op", "updateService", "error", err, "msg", "failed to update service")
 			return k8s.SyncStateError
@@ -88,7 +241,11 @@ func (c *controller) SetBalancer(l log.Logger, name string, svcRo *v1.Service, _
 		var st v1.ServiceStatus
 		st, svc = svc.Status, svcRo.DeepCopy()
 		svc.Status = st
-		if err = c.client.UpdateStatus(svc); err != nil {
+		_, span := tracing.Start(ctx, "k8s.UpdateServiceStatus", "service", name)
+		err = c.client.UpdateStatus(svc)
+		span.SetAttributes("conflict", strconv.FormatBool(apierrors.IsConflict(err)))
+		span.End(err)
+		if err != nil {
 			l.Log("op", "updateServiceStatus", "error", err, "msg", "failed to update service status")
 			return k8s.SyncStateError
 		}
@@ -98,10 +255,20 @@ func (c *controller) SetBalancer(l log.Logger, name string, svcRo *v1.Service, _
 	return k8s.SyncStateSuccess
 }
 
-func (c *controller) deleteBalancer(l log.Logger, name string) {
-	if err := c.ips.UnAllocate(l, name); err != nil {
+func (c *controller) deleteBalancer(ctx context.Context, l log.Logger, name string) {
+	if err := c.ips.UnAllocate(ctx, l, name); err != nil {
 		l.Log("bug", "IPReleaseFailed", "error", err)
 	}
+	c.forgetBalancer(l, name)
+}
+
+// forgetBalancer drops all state of a service whose IP is released.
+func (c *controller) forgetBalancer(l log.Logger, name string) {
+	delete(c.verified, name)
+	delete(c.created, name)
+	delete(c.states, name)
+	delete(c.unadopted, name)
+	delete(c.pending, name)
 
 	if c.ips.Unassign(name) {
 		l.Log("event", "serviceDeleted", "msg", "service deleted")
@@ -121,13 +288,34 @@ func (c *controller) SetConfig(l log.Logger, cfg *config.Config) k8s.SyncState {
 		l.Log("op", "setConfig", "error", err, "msg", "applying new configuration failed")
 		return k8s.SyncStateError
 	}
+	c.ips.SetAutoAssignStrategy(cfg.AutoAssignStrategy)
 	c.config = cfg
+
+	var hasLeases int32
+	for _, p := range cfg.Pools {
+		if p.MaxLeaseDuration > 0 {
+			hasLeases = 1
+		}
+	}
+	atomic.StoreInt32(&c.hasLeases, hasLeases)
+	c.recordPoolUsage()
+
 	return k8s.SyncStateReprocessAll
 }
 
-func (c *controller) MarkSynced(l log.Logger) {
-	c.synced = true
-	l.Log("event", "stateSynced", "msg", "controller synced, can allocate IPs now")
+// syncStateName returns a human readable name for st, for use in
+// traces.
+func syncStateName(st k8s.SyncState) string {
+	switch st {
+	case k8s.SyncStateSuccess:
+		return "success"
+	case k8s.SyncStateError:
+		return "error"
+	case k8s.SyncStateReprocessAll:
+		return "reprocessAll"
+	default:
+		return "unknown"
+	}
 }
 
 func main() {
@@ -138,34 +326,317 @@ func main() {
 	}
 
 	var (
-		port   = flag.Int("port", 7472, "HTTP listening port for Prometheus metrics")
-		config = flag.String("config", "config", "Kubernetes ConfigMap containing MetalLB's configuration")
+		port         = flag.Int("port", 7472, "HTTP listening port for Prometheus metrics")
+		config       = flag.String("config", "config", "Kubernetes ConfigMap (or Secret, with --config-secret) containing MetalLB's configuration")
+		configSecret = flag.Bool("config-secret", false, "read the configuration from a Secret instead of a ConfigMap, for configurations with peer passwords or other sensitive data")
+		reloadToken  = flag.String("reload-token-file", "", "file holding a bearer token that authorizes POST /reload on the metrics port, to reload the configuration synchronously. The endpoint is disabled if empty, SIGHUP always reloads")
+		whatIfToken  = flag.String("what-if-token-file", "", "file holding a bearer token that authorizes POST /what-if on the metrics port, to preview allocations. The endpoint is disabled if empty")
+		debugAddr    = flag.String("debug-addr", "", "address to serve pprof and expvar debug endpoints on (e.g. 127.0.0.1:6060), disabled if empty")
+		speakerDS    = flag.String("speaker-daemonset", "speaker", "name of the speaker DaemonSet, for coordinated restarts")
+		restartGrace = flag.Duration("restart-grace-period", 30*time.Second, "how long to wait after a speaker withdraws its announcements before restarting it")
+		staleIPs     = flag.String("stale-ip-policy", "adopt", "what to do with service IPs that are not reserved in IPAM, e.g. after a restore from backup: \"adopt\" re-reserves them, \"reallocate\" assigns new IPs")
+		otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP collector endpoint to export allocation traces to (e.g. http://otel-collector:4318), tracing is disabled if empty")
+		ipamTimeout  = flag.Duration("ipam-timeout", 30*time.Second, "how long a single call to an external IPAM may take, 0 for no limit")
+		ipamCalls    = flag.Int("ipam-max-concurrent-calls", 4, "how many calls may be in flight to the IPAM of one pool, including timed out calls that haven't returned yet, 0 for no limit")
+		ipamBatch    = flag.Duration("ipam-batch-window", 2*time.Second, "how long a listing of IPAM reservations is reused across services, to batch lookups during bursts of service changes, 0 to always list")
+		ipamUsage    = flag.Duration("ipam-usage-interval", 5*time.Minute, "how often the capacity and usage of IPAM pools is fetched from the IPAM, 0 to only fetch it on config changes. Failed fetches are retried with a backoff")
+		gwClasses    = flag.String("gateway-classes", "", "comma-separated Gateway API GatewayClasses whose gateways get IPs from MetalLB pools. Requires the Gateway API CRDs, disabled if empty")
+		ipClaims     = flag.Bool("enable-ip-claims", false, "reserve IPs for IPClaim resources. Requires the IPClaim CRD")
+		hookNames    = flag.String("allocation-hooks", "", "comma-separated in-process allocation hooks to call, in order, with each IP assigned to a service before its status is updated")
+		webhookURL   = flag.String("allocation-webhook", "", "URL to POST each IP assigned to a service to before its status is updated, after the --allocation-hooks. The status is only updated once it answers with a 2xx status. Disabled if empty")
+		webhookToken = flag.String("allocation-webhook-token-file", "", "file holding a bearer token to send to --allocation-webhook")
+		hookTimeout  = flag.Duration("allocation-hook-timeout", 10*time.Second, "how long a single allocation hook call may take, 0 for no limit")
+		leaderElect  = flag.Bool("leader-elect", false, "run several controller replicas, of which one leader elected with a Lease in MetalLB's namespace processes events. The others are on standby, and only serve metrics and debug endpoints")
+		strictConfig = flag.Bool("strict-config", false, "reject configurations with warnings, like deprecated settings or suspicious values, instead of loading them")
+		vaultSocket  = flag.String("vault-agent-socket", "", "unix socket of a Vault agent, to read BGP passwords and IPAM credentials with source \"vault\" from Vault. Vault is disabled if empty")
+		secretReload = flag.Duration("secret-refresh-interval", 0, "how often to reload the configuration and the credentials it refers to, so that rotated credentials take effect, 0 to only reload when the configuration changes")
+		checkPeriod  = flag.Duration("consistency-check-interval", 0, "how often to cross-check the status of services, the allocator, IPAM reservations and speaker announcements, and report discrepancies. Disabled if 0")
+		checkRepair  = flag.Bool("consistency-repair", false, "repair the discrepancies found by consistency checks where possible, e.g. by releasing orphaned IPAM reservations")
+		statusQPS    = flag.Float64("status-qps", 20, "how many service status writes per second the controller may send to the apiserver, separately from its other requests. Pending writes of the same service are coalesced. 0 writes statuses synchronously with the other requests")
+		statusBurst  = flag.Int("status-burst", 50, "how many service status writes may exceed --status-qps in a burst")
+		fieldManager = flag.String("field-manager", "", "field manager to write the statuses of services, gateways and IP claims as, with server-side apply, so that only the status fields MetalLB manages are written, e.g. metallb-controller. Requires Kubernetes 1.16 or later, older apiservers get whole status updates. Whole statuses are updated if empty")
+		watchNS      = flag.String("watch-namespaces", "", "comma-separated namespaces whose services MetalLB manages, for clusters where another load balancer implementation handles the other namespaces. All namespaces if empty")
+		nsSelector   = flag.String("namespace-selector", "", "label selector of the namespaces whose services MetalLB manages, e.g. \"metallb=enabled\". Combined with --watch-namespaces, namespaces must match both. All namespaces if empty")
+		finalizers   = flag.Bool("service-finalizers", false, "add a finalizer to services with an IP, so that their deletion blocks until the IP is released from the allocator and the external IPAM. Disabling it removes the finalizers again")
+		zoneAware    = flag.Bool("zone-aware-allocation", false, "allocate IPs from the pools whose topology has the zones of a service's endpoints first, then from pools without a topology. New services wait up to 30s for ready endpoints. Watches endpoints and nodes")
+		nsRate       = flag.Float64("namespace-allocation-rate", 0, "how many IPs per second may be allocated to the services of a single namespace, so that one namespace creating many services can't starve the others. Services over the limit are retried once their namespace may allocate again. 0 for no limit")
+		nsBurst      = flag.Int("namespace-allocation-burst", 10, "how many IP allocations a namespace may make in a burst above --namespace-allocation-rate")
+		controlPort  = flag.Int("control-port", 0, "port to serve the gRPC control channel on, to which speakers run with --controller-address report that they are alive and what they announce. Disabled if 0")
+		controlToken = flag.String("control-token-file", "", "file holding a bearer token that speakers must send on the control channel. Speakers aren't authenticated if empty")
+		controlCert  = flag.String("control-tls-cert-file", "", "file holding the TLS certificate to serve the control channel with, so that speakers can send their bearer token safely. Requires --control-tls-key-file. The control channel is plaintext if empty")
+		controlKey   = flag.String("control-tls-key-file", "", "file holding the private key of --control-tls-cert-file")
+		reportAge    = flag.Duration("speaker-report-timeout", 30*time.Second, "how long after its last report on the control channel a speaker is considered dead")
 	)
 	flag.Parse()
 
 	logger.Log("version", version.Version(), "commit", version.CommitHash(), "branch", version.Branch(), "msg", "MetalLB controller starting "+version.String())
 
+	debug.DumpOnSignal(logger, os.TempDir())
+	if *debugAddr != "" {
+		debug.Serve(logger, *debugAddr)
+	}
+
+	if *otlpEndpoint != "" {
+		tracing.Init(logger, *otlpEndpoint, "metallb-controller")
+		logger.Log("op", "startup", "endpoint", *otlpEndpoint, "msg", "exporting traces to OTLP collector")
+	}
+
+	if *staleIPs != "adopt" && *staleIPs != "reallocate" {
+		logger.Log("op", "startup", "error", fmt.Sprintf("unknown stale IP policy %q", *staleIPs), "msg", "invalid --stale-ip-policy")
+		os.Exit(1)
+	}
+
 	c := &controller{
-		ips: allocator.New(),
+		ips:                allocator.New(),
+		reallocateStaleIPs: *staleIPs == "reallocate",
+		ipamUsageInterval:  *ipamUsage,
+		hookTimeout:        *hookTimeout,
+		serviceFinalizers:  *finalizers,
+		throttle:           newNamespaceThrottle(*nsRate, *nsBurst),
+	}
+	if *hookNames != "" {
+		for _, name := range strings.Split(*hookNames, ",") {
+			name = strings.TrimSpace(name)
+			h, err := hooks.Lookup(name)
+			if err != nil {
+				logger.Log("op", "startup", "error", err, "msg", "invalid --allocation-hooks")
+				os.Exit(1)
+			}
+			c.hooks = append(c.hooks, allocationHook{name, h})
+		}
+	}
+	if *webhookURL != "" {
+		w := &hooks.Webhook{URL: *webhookURL}
+		if *webhookToken != "" {
+			token, err := ioutil.ReadFile(*webhookToken)
+			if err != nil {
+				logger.Log("op", "startup", "error", err, "msg", "failed to read --allocation-webhook-token-file")
+				os.Exit(1)
+			}
+			w.Token = strings.TrimSpace(string(token))
+		}
+		c.hooks = append(c.hooks, allocationHook{"webhook", w})
+	}
+	var watchNamespaces []string
+	if *watchNS != "" {
+		c.scope.names = map[string]bool{}
+		for _, ns := range strings.Split(*watchNS, ",") {
+			ns = strings.TrimSpace(ns)
+			c.scope.names[ns] = true
+			watchNamespaces = append(watchNamespaces, ns)
+		}
+	}
+	if *nsSelector != "" {
+		sel, err := labels.Parse(*nsSelector)
+		if err != nil {
+			logger.Log("op", "startup", "error", err, "msg", "invalid --namespace-selector")
+			os.Exit(1)
+		}
+		c.scope.selector = sel
+	}
+	var setGateway func(log.Logger, string, *unstructured.Unstructured) k8s.SyncState
+	if *gwClasses != "" {
+		c.gatewayClasses = map[string]bool{}
+		for _, class := range strings.Split(*gwClasses, ",") {
+			c.gatewayClasses[strings.TrimSpace(class)] = true
+		}
+		setGateway = c.SetGateway
+	}
+	var setIPClaim func(log.Logger, string, *unstructured.Unstructured) k8s.SyncState
+	if *ipClaims {
+		setIPClaim = c.SetIPClaim
+	}
+	var setClusterNode func(log.Logger, string, *v1.Node) k8s.SyncState
+	if *zoneAware {
+		c.zones = newEndpointZones()
+		setClusterNode = c.SetClusterNode
+	}
+	c.ips.SetIPAMLimits(allocator.IPAMLimits{
+		Timeout:       *ipamTimeout,
+		MaxConcurrent: *ipamCalls,
+		BatchWindow:   *ipamBatch,
+	})
+	// Sharing groups and pool usage are served on the debug
+	// endpoint, under /debug/vars.
+	expvar.Publish("sharingGroups", expvar.Func(c.sharing.snapshot))
+	expvar.Publish("poolUsage", expvar.Func(c.usage.snapshot))
+	expvar.Publish("leaderElection", expvar.Func(c.leader.snapshot))
+
+	identity, err := os.Hostname()
+	if err != nil {
+		logger.Log("op", "startup", "error", err, "msg", "failed to get hostname")
+		os.Exit(1)
+	}
+	c.leader.identity = identity
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "controller",
+		Name:      "leader_duration_seconds",
+		Help:      "How long this controller replica has been the leader, 0 on standby",
+	}, c.leader.leadingFor))
+	var leaseName string
+	if *leaderElect {
+		leaseName = "metallb-controller"
+	} else {
+		c.leader.setLeader(identity)
+	}
+
+	secretProviders := map[string]secrets.Provider{}
+	if *vaultSocket != "" {
+		secretProviders[secrets.VaultSource] = secrets.Vault(*vaultSocket)
 	}
 
 	client, err := k8s.New(&k8s.Config{
-		ProcessName:   "metallb-controller",
-		ConfigMapName: *config,
-		MetricsPort:   *port,
-		Logger:        logger,
-
-		ServiceChanged: c.SetBalancer,
-		ConfigChanged:  c.SetConfig,
-		Synced:         c.MarkSynced,
+		ProcessName:     "metallb-controller",
+		ConfigMapName:   *config,
+		ConfigSecret:    *configSecret,
+		StrictConfig:    *strictConfig,
+		ReloadTokenFile: *reloadToken,
+		MetricsPort:     *port,
+		ReadEndpoints:   *zoneAware,
+		Logger:          logger,
+
+		ConfigWarningEvents: true,
+
+		SecretProviders:       secretProviders,
+		SecretRefreshInterval: *secretReload,
+
+		StatusQPS:    float32(*statusQPS),
+		StatusBurst:  *statusBurst,
+		FieldManager: *fieldManager,
+
+		ServiceNamespaces:  watchNamespaces,
+		ClusterNodeChanged: setClusterNode,
+
+		ServiceChanged:   c.SetBalancer,
+		ConfigChanged:    c.SetConfig,
+		NamespaceChanged: c.SetNamespace,
+		GatewayChanged:   setGateway,
+		IPClaimChanged:   setIPClaim,
+		Synced:           c.MarkSynced,
+
+		LeaseName:     leaseName,
+		Identity:      identity,
+		LeaderChanged: c.leader.setLeader,
 	})
 	if err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to create k8s client")
 		os.Exit(1)
 	}
 
+	// The kube-system namespace lives as long as the cluster, its UID
+	// identifies the cluster in shared IPAMs unless CLUSTER_ID is set.
+	derivedID, err := client.NamespaceUID("kube-system")
+	if err != nil {
+		logger.Log("op", "startup", "error", err, "msg", "failed to derive cluster ID from the kube-system namespace")
+	}
+	clusterID, err := allocator.InitClusterID(derivedID)
+	if err != nil {
+		logger.Log("op", "startup", "error", err, "msg", "invalid cluster ID")
+		os.Exit(1)
+	}
+	logger.Log("op", "startup", "clusterID", clusterID, "msg", "using cluster ID for IPAM reservations")
+
 	c.client = client
+	if *whatIfToken != "" {
+		token, err := ioutil.ReadFile(*whatIfToken)
+		if err != nil || strings.TrimSpace(string(token)) == "" {
+			logger.Log("op", "startup", "error", err, "msg", "failed to read --what-if-token-file, or it is empty")
+			os.Exit(1)
+		}
+		client.Handle("/what-if", c.serveWhatIf(client.Call, strings.TrimSpace(string(token))))
+	}
+
+	var reports speakerReports
+	if *controlPort > 0 {
+		server, err := serveControl(logger, *controlPort, *controlToken, *controlCert, *controlKey, *reportAge, c.leader.leading)
+		if err != nil {
+			logger.Log("op", "startup", "error", err, "msg", "failed to start the control channel")
+			os.Exit(1)
+		}
+		reports = server
+	}
+	go func() {
+		// Standby replicas must not restart speakers.
+		for !c.leader.leading() {
+			time.Sleep(time.Second)
+		}
+		r := newRestarter(client, *speakerDS, *restartGrace)
+		r.reports = reports
+		if reports == nil {
+			logger.Log("op", "startup", "msg", "no control channel, coordinated speaker restarts can't confirm that speakers withdrew their announcements, and only wait --restart-grace-period")
+		}
+		r.run(logger)
+	}()
+	if *checkPeriod > 0 {
+		checker := &consistencyChecker{
+			c:         c,
+			client:    client,
+			call:      client.Call,
+			daemonSet: *speakerDS,
+			repair:    *checkRepair,
+			scrape:    scrapeAnnouncements,
+		}
+		go checker.run(logger, *checkPeriod)
+	}
+	// Slow or failing IPAMs must not hold up service events.
+	go c.watchIPAMUsage(logger, client.Call)
+	go func() {
+		for range time.Tick(time.Minute) {
+			if atomic.LoadInt32(&c.hasLeases) != 0 {
+				client.ForceSync()
+			}
+		}
+	}()
+
 	if err := client.Run(); err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to run k8s client")
 	}
 }
+
+// serveControl serves the control channel on port, with TLS if
+// certFile is set, and publishes the speakers reporting on it on the
+// debug endpoint and as a metric.
+func serveControl(l log.Logger, port int, tokenFile, certFile, keyFile string, timeout time.Duration, leading func() bool) (*control.Server, error) {
+	var token string
+	if tokenFile != "" {
+		b, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading --control-token-file: %s", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	var creds credentials.TransportCredentials
+	switch {
+	case certFile != "" && keyFile != "":
+		var err error
+		if creds, err = credentials.NewServerTLSFromFile(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("loading --control-tls-cert-file and --control-tls-key-file: %s", err)
+		}
+	case certFile != "" || keyFile != "":
+		return nil, errors.New("--control-tls-cert-file and --control-tls-key-file must be set together")
+	case token != "":
+		l.Log("op", "startup", "msg", "control channel is plaintext, speakers only send their bearer token with --control-insecure. Set --control-tls-cert-file to serve it with TLS")
+	}
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	server := control.NewServer(token, creds, timeout, leading)
+	expvar.Publish("speakers", expvar.Func(func() interface{} { return server.Speakers() }))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "controller",
+		Name:      "speakers_alive",
+		Help:      "Number of speakers that reported on the control channel recently",
+	}, func() float64 { return float64(server.Alive()) }))
+
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			l.Log("op", "control", "error", err, "msg", "control channel stopped")
+		}
+	}()
+	l.Log("op", "startup", "port", port, "msg", "serving the control channel")
+	return server, nil
+}
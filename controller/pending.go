@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// Set on services waiting for an IP, to why they are waiting.
+	pendingReasonAnnotation = "metallb.universe.tf/pending-reason"
+	pendingThrottled        = "NamespaceThrottled"
+	pendingAllocationFailed = "AllocationFailed"
+	// Waiting for ready endpoints to pick a pool in their zone.
+	pendingWaitingForEndpoints = "WaitingForEndpoints"
+	// The pool a service waiting for an IP would get it from, if
+	// any.
+	pendingPoolAnnotation = "metallb.universe.tf/pending-pool"
+	// The position of a service among the services waiting for an
+	// IP from the same pool, oldest first, starting at 1.
+	pendingPositionAnnotation = "metallb.universe.tf/pending-position"
+)
+
+var pendingAnnotations = []string{pendingReasonAnnotation, pendingPoolAnnotation, pendingPositionAnnotation}
+
+// pendingService is a service waiting for an IP.
+type pendingService struct {
+	pool    string
+	created metav1.Time
+}
+
+// setPending records that svc is waiting for an IP because of
+// reason, and annotates it with the reason, the pool it would get an
+// IP from and its position among the services waiting for that pool.
+// Positions are refreshed when services are processed, so they are
+// only a hint of which services get IPs first once some free up.
+func (c *controller) setPending(key string, svc *v1.Service, reason string) {
+	pool := c.candidatePool(key, svc)
+	if c.pending == nil {
+		c.pending = map[string]pendingService{}
+	}
+	c.pending[key] = pendingService{pool, svc.CreationTimestamp}
+
+	position := 1
+	for other, p := range c.pending {
+		if other != key && p.pool == pool && olderService(other, p.created, key, svc.CreationTimestamp) {
+			position++
+		}
+	}
+
+	if svc.Annotations == nil {
+		svc.Annotations = map[string]string{}
+	}
+	svc.Annotations[pendingReasonAnnotation] = reason
+	svc.Annotations[pendingPositionAnnotation] = strconv.Itoa(position)
+	if pool != "" {
+		svc.Annotations[pendingPoolAnnotation] = pool
+	} else {
+		delete(svc.Annotations, pendingPoolAnnotation)
+	}
+}
+
+// clearPending records that svc is no longer waiting for an IP.
+func (c *controller) clearPending(key string, svc *v1.Service) {
+	delete(c.pending, key)
+	for _, a := range pendingAnnotations {
+		delete(svc.Annotations, a)
+	}
+}
+
+// candidatePool returns the pool that svc would get an IP from, or
+// "" if none would serve it.
+func (c *controller) candidatePool(key string, svc *v1.Service) string {
+	isIPv6 := net.ParseIP(svc.Spec.ClusterIP).To4() == nil
+	var sel labels.Selector
+	if s := svc.Annotations[poolSelectorAnnotation]; s != "" {
+		var err error
+		if sel, err = labels.Parse(s); err != nil {
+			return ""
+		}
+	}
+	return c.ips.CandidatePool(isIPv6, net.ParseIP(svc.Spec.LoadBalancerIP), svc.Annotations["metallb.universe.tf/address-pool"], sel, c.zones.nodeLabels(key))
+}
+
+// writePending updates the pending annotations of svcRo to those of
+// svc, for services that didn't converge and are retried later, whose
+// other changes must not be written yet.
+func (c *controller) writePending(l log.Logger, svcRo, svc *v1.Service) {
+	upd := svcRo.DeepCopy()
+	if upd.Annotations == nil {
+		upd.Annotations = map[string]string{}
+	}
+	for _, a := range pendingAnnotations {
+		if v, ok := svc.Annotations[a]; ok {
+			upd.Annotations[a] = v
+		} else {
+			delete(upd.Annotations, a)
+		}
+	}
+	if len(svcRo.Annotations) == 0 && len(upd.Annotations) == 0 || reflect.DeepEqual(svcRo.Annotations, upd.Annotations) {
+		return
+	}
+	if _, err := c.client.Update(upd); err != nil {
+		l.Log("op", "updateService", "error", err, "msg", "failed to update pending allocation annotations")
+	}
+}
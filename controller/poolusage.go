@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.universe.tf/metallb/internal/allocator"
+
+	"github.com/go-kit/kit/log"
+)
+
+// poolUsage is the usage of a pool, as served on the debug endpoint.
+type poolUsage struct {
+	Addresses      int64 `json:"addresses"`
+	AddressesInUse int64 `json:"addressesInUse"`
+	Services       int   `json:"services"`
+	SharingGroups  int   `json:"sharingGroups"`
+	// For pools using an external IPAM, the addresses reserved in the
+	// IPAM by this cluster or others.
+	IPAMReserved *int64 `json:"ipamReserved,omitempty"`
+}
+
+// poolUsages is the latest usage of every pool.
+type poolUsages struct {
+	// Protects pools, which is read by the debug server.
+	mu    sync.Mutex
+	pools map[string]poolUsage
+}
+
+func (u *poolUsages) snapshot() interface{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ret := make(map[string]poolUsage, len(u.pools))
+	for n, p := range u.pools {
+		ret[n] = p
+	}
+	return ret
+}
+
+// ipamUsageTick is how often the usage of pools using an external
+// IPAM is checked for a fetch.
+const ipamUsageTick = 10 * time.Second
+
+// watchIPAMUsage fetches the usage of pools using an external IPAM
+// that is older than c.ipamUsageInterval, or unknown since the last
+// config change. The IPAM is called from this goroutine, call runs
+// the rest on the sync goroutine.
+func (c *controller) watchIPAMUsage(l log.Logger, call func(func()) error) {
+	for range time.Tick(ipamUsageTick) {
+		c.fetchIPAMUsage(context.Background(), l, call)
+	}
+}
+
+// fetchIPAMUsage fetches the usage of the pools whose usage is due
+// and records it.
+func (c *controller) fetchIPAMUsage(ctx context.Context, l log.Logger, call func(func()) error) {
+	var fetches []*allocator.IPAMUsageFetch
+	if err := call(func() { fetches = c.ips.DueIPAMUsage(time.Now(), c.ipamUsageInterval) }); err != nil || len(fetches) == 0 {
+		// Standby replicas don't track usage.
+		return
+	}
+	results := make([]allocator.IPAMUsageResult, 0, len(fetches))
+	for _, f := range fetches {
+		results = append(results, f.Fetch(ctx))
+	}
+	call(func() {
+		c.ips.SetIPAMUsage(l, results)
+		c.recordPoolUsage()
+	})
+}
+
+// recordPoolUsage records the usage of all pools, with the latest
+// usage fetched from their IPAM for pools using an external IPAM.
+func (c *controller) recordPoolUsage() {
+	if c.config == nil {
+		return
+	}
+	pools := map[string]poolUsage{}
+	for n := range c.config.Pools {
+		addrs, inUse, svcs := c.ips.PoolUsage(n)
+		p := poolUsage{
+			Addresses:      addrs,
+			AddressesInUse: inUse,
+			Services:       svcs,
+			SharingGroups:  c.ips.SharingGroups(n),
+		}
+		if _, reserved, ok := c.ips.IPAMUsage(n); ok {
+			p.IPAMReserved = &reserved
+		}
+		pools[n] = p
+	}
+	c.usage.mu.Lock()
+	c.usage.pools = pools
+	c.usage.mu.Unlock()
+}
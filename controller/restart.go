@@ -0,0 +1,229 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go.universe.tf/metallb/internal/k8s"
+
+	"github.com/go-kit/kit/log"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// Setting this annotation on the speaker DaemonSet to a new value
+	// (e.g. a timestamp) triggers a coordinated restart of all
+	// speakers.
+	restartRequestedAnnotation = "metallb.universe.tf/restart-requested-at"
+	// Set by the controller to the value of
+	// restartRequestedAnnotation once all speakers have restarted.
+	restartCompletedAnnotation = "metallb.universe.tf/restart-completed-at"
+)
+
+// restartClient is the subset of the k8s client that the restarter
+// needs.
+type restartClient interface {
+	GetDaemonSet(name string) (*appsv1.DaemonSet, error)
+	UpdateDaemonSet(ds *appsv1.DaemonSet) error
+	ListPods(selector *metav1.LabelSelector) ([]v1.Pod, error)
+	DeletePod(name string) error
+	SetNodeAnnotation(node, key, value string) error
+	NodeErrorf(name, kind, msg string, args ...interface{})
+}
+
+// speakerReports is the subset of the control server that the
+// restarter needs, see control.Server.Drained.
+type speakerReports interface {
+	Drained(node string) (drained, alive bool)
+}
+
+// restarter restarts speaker pods one node at a time when requested
+// through an annotation on the speaker DaemonSet. Each speaker is
+// first asked to withdraw its announcements, and is only deleted once
+// peers have had gracePeriod to converge on the remaining speakers.
+// The next node is not touched until the replacement pod is ready.
+// With speaker reports, the grace period only starts once the speaker
+// reports that it withdrew everything. Without them, nothing confirms
+// that it did, and the restart is best-effort: the grace period is
+// all that routers get.
+type restarter struct {
+	client       restartClient
+	daemonSet    string
+	gracePeriod  time.Duration
+	readyTimeout time.Duration
+	pollInterval time.Duration
+	sleep        func(time.Duration)
+	// Reports of the speakers over the control channel, nil if
+	// speakers don't report.
+	reports speakerReports
+
+	// The restart request being processed, and the nodes whose
+	// speakers have already been restarted for it, so that a failed
+	// attempt can resume where it left off.
+	request string
+	done    map[string]bool
+}
+
+func newRestarter(client restartClient, daemonSet string, gracePeriod time.Duration) *restarter {
+	return &restarter{
+		client:       client,
+		daemonSet:    daemonSet,
+		gracePeriod:  gracePeriod,
+		readyTimeout: 5 * time.Minute,
+		pollInterval: 5 * time.Second,
+		sleep:        time.Sleep,
+	}
+}
+
+func (r *restarter) run(l log.Logger) {
+	for {
+		if err := r.sync(l); err != nil {
+			l.Log("op", "restartSpeakers", "error", err, "msg", "coordinated speaker restart failed, will retry")
+		}
+		r.sleep(r.pollInterval)
+	}
+}
+
+func (r *restarter) sync(l log.Logger) error {
+	ds, err := r.client.GetDaemonSet(r.daemonSet)
+	if err != nil {
+		return fmt.Errorf("getting daemonset %q: %s", r.daemonSet, err)
+	}
+	req := ds.Annotations[restartRequestedAnnotation]
+	if req == "" || req == ds.Annotations[restartCompletedAnnotation] {
+		return nil
+	}
+	if req != r.request {
+		l.Log("event", "restartStarted", "request", req, "msg", "starting coordinated restart of speakers")
+		r.request = req
+		r.done = map[string]bool{}
+	}
+
+	pods, err := r.client.ListPods(ds.Spec.Selector)
+	if err != nil {
+		return fmt.Errorf("listing speaker pods: %s", err)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Spec.NodeName < pods[j].Spec.NodeName })
+
+	for _, pod := range pods {
+		node := pod.Spec.NodeName
+		if node == "" || r.done[node] {
+			continue
+		}
+		if err := r.restartPod(log.With(l, "node", node, "pod", pod.Name), ds, pod); err != nil {
+			return err
+		}
+		r.done[node] = true
+	}
+
+	if ds.Annotations == nil {
+		ds.Annotations = map[string]string{}
+	}
+	ds.Annotations[restartCompletedAnnotation] = req
+	if err := r.client.UpdateDaemonSet(ds); err != nil {
+		return fmt.Errorf("marking restart complete: %s", err)
+	}
+	l.Log("event", "restartCompleted", "request", req, "msg", "coordinated restart of speakers complete")
+	return nil
+}
+
+func (r *restarter) restartPod(l log.Logger, ds *appsv1.DaemonSet, pod v1.Pod) error {
+	node := pod.Spec.NodeName
+
+	if err := r.client.SetNodeAnnotation(node, k8s.DrainAnnotation, pod.Name); err != nil {
+		return fmt.Errorf("draining node %q: %s", node, err)
+	}
+	l.Log("event", "speakerDraining", "gracePeriod", r.gracePeriod, "msg", "asked speaker to withdraw announcements, waiting for peers to converge")
+	if r.reports == nil || !r.waitDrained(l, node) {
+		l.Log("event", "speakerDrainUnconfirmed", "gracePeriod", r.gracePeriod, "msg", "can't confirm that the speaker withdrew its announcements, only waiting the grace period")
+		r.client.NodeErrorf(node, "SpeakerDrainUnconfirmed", "Restarting speaker %s after the %s grace period, without confirmation that it withdrew its announcements", pod.Name, r.gracePeriod)
+	}
+	r.sleep(r.gracePeriod)
+
+	if err := r.client.DeletePod(pod.Name); err != nil {
+		return fmt.Errorf("deleting pod %q: %s", pod.Name, err)
+	}
+	l.Log("event", "speakerRestarting", "msg", "deleted speaker pod, waiting for its replacement")
+
+	// Undrain the node even if the replacement doesn't come up, so
+	// that the new speaker can announce as soon as it's healthy.
+	readyErr := r.waitReady(ds, node, pod.UID)
+	if err := r.client.SetNodeAnnotation(node, k8s.DrainAnnotation, ""); err != nil {
+		return fmt.Errorf("undraining node %q: %s", node, err)
+	}
+	if readyErr != nil {
+		return readyErr
+	}
+	l.Log("event", "speakerRestarted", "msg", "replacement speaker is ready")
+	return nil
+}
+
+// waitDrained waits until the speaker on node reports that it
+// withdrew all its announcements, and returns true if it did.
+// Speakers that don't report, e.g. because they crashed, are deleted
+// without waiting, and speakers that don't drain within readyTimeout
+// are deleted anyway.
+func (r *restarter) waitDrained(l log.Logger, node string) bool {
+	for waited := time.Duration(0); waited < r.readyTimeout; waited += r.pollInterval {
+		drained, alive := r.reports.Drained(node)
+		switch {
+		case !alive:
+			l.Log("event", "speakerNotReporting", "msg", "speaker doesn't report to the controller, not waiting for it to drain")
+			return false
+		case drained:
+			l.Log("event", "speakerDrained", "msg", "speaker reports that it withdrew all announcements")
+			return true
+		}
+		r.sleep(r.pollInterval)
+	}
+	l.Log("event", "speakerNotDrained", "timeout", r.readyTimeout, "msg", "speaker still announces, restarting it anyway")
+	return false
+}
+
+// waitReady waits until a speaker pod other than old is running and
+// ready on node.
+func (r *restarter) waitReady(ds *appsv1.DaemonSet, node string, old types.UID) error {
+	for waited := time.Duration(0); waited < r.readyTimeout; waited += r.pollInterval {
+		pods, err := r.client.ListPods(ds.Spec.Selector)
+		if err != nil {
+			return fmt.Errorf("listing speaker pods: %s", err)
+		}
+		for _, pod := range pods {
+			if pod.Spec.NodeName == node && pod.UID != old && podReady(&pod) {
+				return nil
+			}
+		}
+		r.sleep(r.pollInterval)
+	}
+	return fmt.Errorf("replacement speaker on node %q not ready after %s", node, r.readyTimeout)
+}
+
+func podReady(pod *v1.Pod) bool {
+	if pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.universe.tf/metallb/internal/k8s"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeRestartClient simulates a DaemonSet that immediately replaces
+// deleted pods with ready ones, and records the order of operations.
+type fakeRestartClient struct {
+	ds      *appsv1.DaemonSet
+	pods    map[string]v1.Pod // node -> pod
+	drained map[string]bool
+	ops     []string
+	gen     int
+	// Nodes whose replacement pods never become ready.
+	neverReady map[string]bool
+}
+
+func newFakeRestartClient(annotations map[string]string, nodes ...string) *fakeRestartClient {
+	f := &fakeRestartClient{
+		ds: &appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "speaker",
+				Annotations: annotations,
+			},
+		},
+		pods:       map[string]v1.Pod{},
+		drained:    map[string]bool{},
+		neverReady: map[string]bool{},
+	}
+	for _, n := range nodes {
+		f.pods[n] = f.newPod(n, true)
+	}
+	return f
+}
+
+func (f *fakeRestartClient) newPod(node string, ready bool) v1.Pod {
+	f.gen++
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("speaker-%d", f.gen),
+			UID:  types.UID(fmt.Sprintf("uid-%d", f.gen)),
+		},
+		Spec: v1.PodSpec{NodeName: node},
+		Status: v1.PodStatus{
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}},
+		},
+	}
+}
+
+func (f *fakeRestartClient) GetDaemonSet(name string) (*appsv1.DaemonSet, error) {
+	return f.ds.DeepCopy(), nil
+}
+
+func (f *fakeRestartClient) UpdateDaemonSet(ds *appsv1.DaemonSet) error {
+	f.ds = ds.DeepCopy()
+	f.ops = append(f.ops, "complete")
+	return nil
+}
+
+func (f *fakeRestartClient) ListPods(*metav1.LabelSelector) ([]v1.Pod, error) {
+	var ret []v1.Pod
+	for _, p := range f.pods {
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+func (f *fakeRestartClient) DeletePod(name string) error {
+	for n, p := range f.pods {
+		if p.Name == name {
+			if !f.drained[n] {
+				return fmt.Errorf("deleted pod %q on undrained node %q", name, n)
+			}
+			f.pods[n] = f.newPod(n, !f.neverReady[n])
+			f.ops = append(f.ops, "restart "+n)
+			return nil
+		}
+	}
+	return fmt.Errorf("no pod %q", name)
+}
+
+func (f *fakeRestartClient) SetNodeAnnotation(node, key, value string) error {
+	if key != k8s.DrainAnnotation {
+		return fmt.Errorf("unexpected annotation %q", key)
+	}
+	f.drained[node] = value != ""
+	if value != "" {
+		f.ops = append(f.ops, "drain "+node)
+	} else {
+		f.ops = append(f.ops, "undrain "+node)
+	}
+	return nil
+}
+
+func (f *fakeRestartClient) NodeErrorf(name, kind, msg string, args ...interface{}) {
+	if kind == "SpeakerDrainUnconfirmed" {
+		f.ops = append(f.ops, "unconfirmed "+name)
+	}
+}
+
+func TestRestarter(t *testing.T) {
+	tests := []struct {
+		desc       string
+		ann        map[string]string
+		neverReady string
+		wantErr    bool
+		wantOps    []string
+	}{
+		{
+			desc:    "no restart requested",
+			ann:     nil,
+			wantOps: nil,
+		},
+		{
+			desc: "restart already done",
+			ann: map[string]string{
+				restartRequestedAnnotation: "1",
+				restartCompletedAnnotation: "1",
+			},
+			wantOps: nil,
+		},
+		{
+			desc: "restart requested",
+			ann: map[string]string{
+				restartRequestedAnnotation: "2",
+				restartCompletedAnnotation: "1",
+			},
+			// Without speaker reports, nothing confirms the drain.
+			wantOps: []string{
+				"drain a", "unconfirmed a", "restart a", "undrain a",
+				"drain b", "unconfirmed b", "restart b", "undrain b",
+				"drain c", "unconfirmed c", "restart c", "undrain c",
+				"complete",
+			},
+		},
+		{
+			desc: "replacement never ready stops the rollout",
+			ann: map[string]string{
+				restartRequestedAnnotation: "2",
+			},
+			neverReady: "b",
+			wantErr:    true,
+			wantOps: []string{
+				"drain a", "unconfirmed a", "restart a", "undrain a",
+				"drain b", "unconfirmed b", "restart b", "undrain b",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		f := newFakeRestartClient(test.ann, "c", "a", "b")
+		if test.neverReady != "" {
+			f.neverReady[test.neverReady] = true
+		}
+		r := newRestarter(f, "speaker", 30*time.Second)
+		r.sleep = func(time.Duration) {}
+
+		err := r.sync(log.NewNopLogger())
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %v", test.desc, err, test.wantErr)
+		}
+		if diff := cmp.Diff(test.wantOps, f.ops); diff != "" {
+			t.Errorf("%q: unexpected operations (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestRestarterResumes(t *testing.T) {
+	f := newFakeRestartClient(map[string]string{restartRequestedAnnotation: "1"}, "a", "b")
+	f.neverReady["b"] = true
+	r := newRestarter(f, "speaker", 30*time.Second)
+	r.sleep = func(time.Duration) {}
+
+	l := log.NewNopLogger()
+	if err := r.sync(l); err == nil {
+		t.Fatalf("first sync succeeded, but b never became ready")
+	}
+
+	// b recovers on its own, the retry should not restart a again.
+	f.neverReady["b"] = false
+	f.pods["b"] = f.newPod("b", true)
+	f.ops = nil
+	if err := r.sync(l); err != nil {
+		t.Fatalf("second sync failed: %s", err)
+	}
+	want := []string{"drain b", "unconfirmed b", "restart b", "undrain b", "complete"}
+	if diff := cmp.Diff(want, f.ops); diff != "" {
+		t.Errorf("unexpected operations (-want +got)\n%s", diff)
+	}
+	if got := f.ds.Annotations[restartCompletedAnnotation]; got != "1" {
+		t.Errorf("restart not marked complete, got %q", got)
+	}
+}
+
+// fakeReports simulates speakers that report being drained after a
+// few polls, or don't report at all.
+type fakeReports struct {
+	f     *fakeRestartClient
+	polls map[string]int
+	// Nodes whose speakers don't report.
+	silent map[string]bool
+}
+
+func (r *fakeReports) Drained(node string) (bool, bool) {
+	if r.silent[node] {
+		return false, false
+	}
+	r.polls[node]++
+	if r.polls[node] < 3 {
+		return false, true
+	}
+	r.f.ops = append(r.f.ops, "drained "+node)
+	return true, true
+}
+
+func TestRestarterWaitsForDrain(t *testing.T) {
+	f := newFakeRestartClient(map[string]string{restartRequestedAnnotation: "1"}, "a", "b")
+	r := newRestarter(f, "speaker", 30*time.Second)
+	var slept []time.Duration
+	r.sleep = func(d time.Duration) { slept = append(slept, d) }
+	r.reports = &fakeReports{f: f, polls: map[string]int{}, silent: map[string]bool{"b": true}}
+
+	if err := r.sync(log.NewNopLogger()); err != nil {
+		t.Fatalf("sync failed: %s", err)
+	}
+	wantOps := []string{
+		"drain a", "drained a", "restart a", "undrain a",
+		"drain b", "unconfirmed b", "restart b", "undrain b",
+		"complete",
+	}
+	if diff := cmp.Diff(wantOps, f.ops); diff != "" {
+		t.Errorf("unexpected operations (-want +got)\n%s", diff)
+	}
+	// Two polls until a drained, then the grace period of each node.
+	wantSleeps := []time.Duration{r.pollInterval, r.pollInterval, 30 * time.Second, 30 * time.Second}
+	if diff := cmp.Diff(wantSleeps, slept); diff != "" {
+		t.Errorf("unexpected sleeps (-want +got)\n%s", diff)
+	}
+}
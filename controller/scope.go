@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// namespaceScope limits the services the controller manages to some
+// namespaces, for clusters where another load balancer implementation
+// handles the others. The zero value manages every namespace.
+type namespaceScope struct {
+	// If non-nil, only these namespaces are managed.
+	names map[string]bool
+	// If non-nil, only namespaces with matching labels are managed.
+	selector labels.Selector
+	// Namespaces that match selector.
+	selected map[string]bool
+}
+
+// manages returns whether the services of namespace ns are managed.
+func (s *namespaceScope) manages(ns string) bool {
+	if s.names != nil && !s.names[ns] {
+		return false
+	}
+	if s.selector != nil && !s.selected[ns] {
+		return false
+	}
+	return true
+}
+
+// setNamespace tracks the labels of the namespace name, nil if it was
+// deleted, and returns whether that changed if it's managed.
+func (s *namespaceScope) setNamespace(l log.Logger, name string, ns *v1.Namespace) bool {
+	if s.selector == nil {
+		return false
+	}
+	selected := ns != nil && s.selector.Matches(labels.Set(ns.Labels))
+	if selected == s.selected[name] {
+		return false
+	}
+	if selected {
+		if s.selected == nil {
+			s.selected = map[string]bool{}
+		}
+		s.selected[name] = true
+		l.Log("event", "namespaceSelected", "msg", "namespace matches the namespace selector, managing its services")
+	} else {
+		delete(s.selected, name)
+		l.Log("event", "namespaceUnselected", "msg", "namespace no longer matches the namespace selector, releasing the IPs of its services")
+	}
+	return true
+}
+
+// releaseOutOfScope clears the status and our annotations of a service
+// whose namespace is no longer managed, then releases its IP. Speakers
+// announce every service with an IP in its status, they would keep
+// announcing the IP after it went to another service. The service is
+// written first, so that a failed write is retried while we still
+// hold the IP.
+func (c *controller) releaseOutOfScope(ctx context.Context, l log.Logger, name string, svcRo *v1.Service) k8s.SyncState {
+	svc := svcRo.DeepCopy()
+	if ip := c.ips.IP(name); ip == nil || statusHasIP(svc.Status.LoadBalancer, ip) {
+		// Otherwise it's not our IP, another implementation may
+		// manage the namespace now.
+		svc.Status.LoadBalancer = v1.LoadBalancerStatus{}
+	}
+	delete(svc.Annotations, leaseStartAnnotation)
+	delete(svc.Annotations, requestedAnnotation)
+	if svc.Annotations[leaseExpiredAnnotation] == leaseNotified {
+		delete(svc.Annotations, leaseExpiredAnnotation)
+	}
+	setFinalizer(svc, false)
+	if !reflect.DeepEqual(svcRo, svc) {
+		if st := c.writeService(ctx, l, name, svcRo, svc); st != k8s.SyncStateSuccess {
+			return st
+		}
+	}
+	c.deleteBalancer(ctx, l, name)
+	// The released IP may be feasible for other services.
+	return k8s.SyncStateReprocessAll
+}
+
+// statusHasIP returns true if ip is one of the ingress IPs of status.
+func statusHasIP(status v1.LoadBalancerStatus, ip net.IP) bool {
+	for _, ing := range status.Ingress {
+		if ip.Equal(net.ParseIP(ing.IP)) {
+			return true
+		}
+	}
+	return false
+}
@@ -15,36 +15,67 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
+	"go.universe.tf/metallb/internal/allocator"
 	"go.universe.tf/metallb/internal/allocator/k8salloc"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/tracing"
 )
 
-func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service) bool {
+const (
+	// Time at which the service's current IP was allocated, for pools
+	// with a max-lease-duration.
+	leaseStartAnnotation = "metallb.universe.tf/lease-start"
+	// Set when the service's lease has expired, to leaseNotified if
+	// the service was only warned, or to leaseReleased if its IP was
+	// released. Released services don't get a new IP until the user
+	// removes the annotation.
+	leaseExpiredAnnotation = "metallb.universe.tf/lease-expired"
+	leaseNotified          = "notified"
+	leaseReleased          = "released"
+	// Set on services in pools with request-removal-policy
+	// "reallocate", to requestedByIP or requestedByPool if the
+	// service's current IP was explicitly requested. Lets us notice
+	// when the user removes the request.
+	requestedAnnotation = "metallb.universe.tf/requested"
+	requestedByIP       = "loadBalancerIP"
+	requestedByPool     = "address-pool"
+	requestedBySelector = "address-pool-selector"
+	// Label selector of the pools a service wants an IP from, when
+	// it doesn't name one with the address-pool annotation.
+	poolSelectorAnnotation = "metallb.universe.tf/address-pool-selector"
+)
+
+// timeNow is overridden in tests.
+var timeNow = time.Now
+
+func (c *controller) convergeBalancer(ctx context.Context, l log.Logger, key string, svc *v1.Service) bool {
 	var lbIP net.IP
 
-	// Not a LoadBalancer, early exit. It might have been a balancer
-	// in the past, so we still need to clear LB state.
-	if svc.Spec.Type != "LoadBalancer" {
-		l.Log("event", "clearAssignment", "reason", "notLoadBalancer", "msg", "not a LoadBalancer")
-		c.clearServiceState(l, key, svc)
-		// Early return, we explicitly do *not* want to reallocate
-		// an IP.
-		return true
+	if c.created == nil {
+		c.created = map[string]metav1.Time{}
 	}
+	c.created[key] = svc.CreationTimestamp
 
-	// If the ClusterIP is malformed or not set we can't determine the
-	// ipFamily to use.
-	clusterIP := net.ParseIP(svc.Spec.ClusterIP)
-	if clusterIP == nil {
-		l.Log("event", "clearAssignment", "reason", "noClusterIP", "msg", "No ClusterIP")
-		c.clearServiceState(l, key, svc)
+	// Not a LoadBalancer, or one whose ClusterIP is malformed or not
+	// set so that we can't determine the ipFamily to use. It might
+	// have been a balancer in the past, so transition clears the LB
+	// state. Early return, we explicitly do *not* want to reallocate
+	// an IP.
+	if c.transition(ctx, l, key, svc) != stateBalancer {
 		return true
 	}
+	clusterIP := net.ParseIP(svc.Spec.ClusterIP)
 
 	// The assigned LB IP is the end state of convergence. If there's
 	// none or a malformed one, nuke all controlled state so that we
@@ -53,13 +84,13 @@ func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service)
 		lbIP = net.ParseIP(svc.Status.LoadBalancer.Ingress[0].IP)
 	}
 	if lbIP == nil {
-		c.clearServiceState(l, key, svc)
+		c.clearServiceState(ctx, l, key, svc)
 	}
 
 	// Clear the lbIP if it has a different ipFamily compared to the clusterIP.
 	// (this should not happen since the "ipFamily" of a service is immutable)
 	if (clusterIP.To4() == nil) != (lbIP.To4() == nil) {
-		c.clearServiceState(l, key, svc)
+		c.clearServiceState(ctx, l, key, svc)
 		lbIP = nil
 	}
 
@@ -67,23 +98,67 @@ func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service)
 	// makes sense. If so, clear it out and give the rest of the logic
 	// a chance to allocate again.
 	if lbIP != nil {
+		desiredPool := svc.Annotations["metallb.universe.tf/address-pool"]
+
 		// This assign is idempotent if the config is consistent,
 		// otherwise it'll fail and tell us why.
-		if err := c.ips.Assign(key, lbIP, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc)); err != nil {
-			l.Log("event", "clearAssignment", "reason", "notAllowedByConfig", "msg", "current IP not allowed by config, clearing")
-			c.clearServiceState(l, key, svc)
+		err := c.ips.AssignCurrent(ctx, l, key, lbIP, desiredPool, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc), k8salloc.Protocol(svc))
+		if err != nil && c.resolveConflict(l, key, svc, lbIP) {
+			err = c.ips.AssignCurrent(ctx, l, key, lbIP, desiredPool, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc), k8salloc.Protocol(svc))
+		}
+		if err != nil {
+			if owners := c.ips.ServicesOnIP(lbIP); len(owners) > 0 {
+				l.Log("event", "clearAssignment", "reason", "ipConflict", "owners", strings.Join(owners, ","), "error", err, "msg", "current IP is in use by an older service, clearing")
+				c.client.Errorf(svc, "IPConflict", "IP %q is also claimed by older service(s) %s, allocating a new IP", lbIP, strings.Join(owners, ", "))
+			} else {
+				l.Log("event", "clearAssignment", "reason", "notAllowedByConfig", "msg", "current IP not allowed by config, clearing")
+			}
+			c.clearServiceState(ctx, l, key, svc)
 			lbIP = nil
 		}
 
 		// The user might also have changed the pool annotation, and
 		// requested a different pool than the one that is currently
 		// allocated.
-		desiredPool := svc.Annotations["metallb.universe.tf/address-pool"]
 		if lbIP != nil && desiredPool != "" && c.ips.Pool(key) != desiredPool {
 			l.Log("event", "clearAssignment", "reason", "differentPoolRequested", "msg", "user requested a different pool than the one currently assigned")
-			c.clearServiceState(l, key, svc)
+			c.clearServiceState(ctx, l, key, svc)
+			lbIP = nil
+		}
+		if lbIP != nil && desiredPool == "" && !c.poolSelected(key, svc) {
+			l.Log("event", "clearAssignment", "reason", "differentPoolSelected", "msg", "user selected pools other than the one currently assigned")
+			c.clearServiceState(ctx, l, key, svc)
 			lbIP = nil
 		}
+
+		// The user might have removed the request that got the
+		// service its current IP.
+		if lbIP != nil && !c.checkRequestRemoval(ctx, l, key, svc) {
+			lbIP = nil
+		}
+
+		// The IP in the service's status may not be reserved in the
+		// external IPAM anymore, e.g. after a restore from backup.
+		// Check once per IP after startup.
+		if lbIP != nil && !c.verified[key].Equal(lbIP) {
+			reserved, err := c.ips.EnsureReservation(ctx, l, key, !c.reallocateStaleIPs)
+			if err != nil {
+				l.Log("op", "ensureReservation", "error", err, "msg", "failed to check IPAM reservation of current IP")
+				return false
+			}
+			if !reserved {
+				l.Log("event", "clearAssignment", "reason", "staleIP", "msg", "current IP is not reserved in IPAM, clearing")
+				c.client.Errorf(svc, "StaleIP", "IP %q is not reserved in IPAM, allocating a new one", lbIP)
+				// Don't go through clearServiceState, there is no
+				// reservation to release.
+				c.ips.Unassign(key)
+				svc.Status.LoadBalancer = v1.LoadBalancerStatus{}
+				delete(svc.Annotations, leaseStartAnnotation)
+				lbIP = nil
+			} else {
+				c.markVerified(key, lbIP)
+			}
+		}
 	}
 
 	// User set or changed the desired LB IP, nuke the
@@ -91,26 +166,60 @@ func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service)
 	// to meet the user's demands.
 	if svc.Spec.LoadBalancerIP != "" && svc.Spec.LoadBalancerIP != lbIP.String() {
 		l.Log("event", "clearAssignment", "reason", "differentIPRequested", "msg", "user requested a different IP than the one currently assigned")
-		c.clearServiceState(l, key, svc)
+		c.clearServiceState(ctx, l, key, svc)
+		lbIP = nil
+	}
+
+	// Same if the service's gateway moved to another IP.
+	if gwIP := c.gatewayIP(svc.Namespace, svc.Labels); lbIP != nil && gwIP != nil && !gwIP.Equal(lbIP) {
+		l.Log("event", "clearAssignment", "reason", "gatewayIPChanged", "msg", "service's gateway has a different IP than the one currently assigned")
+		c.clearServiceState(ctx, l, key, svc)
 		lbIP = nil
 	}
 
 	// If lbIP is still nil at this point, try to allocate.
 	if lbIP == nil {
+		if svc.Annotations[leaseExpiredAnnotation] == leaseReleased {
+			l.Log("event", "leaseExpired", "msg", "not allocating an IP, the service's previous lease expired")
+			return true
+		}
 		if !c.synced {
 			l.Log("op", "allocateIP", "error", "controller not synced", "msg", "controller not synced yet, cannot allocate IP; will retry after sync")
 			return false
 		}
-		ip, err := c.allocateIP(l, key, svc)
+		// Pools are only chosen by the zones of the endpoints, so
+		// give a new service's pods a moment to become ready.
+		if svc.Spec.LoadBalancerIP == "" && svc.Annotations["metallb.universe.tf/address-pool"] == "" && c.gatewayIP(svc.Namespace, svc.Labels) == nil {
+			if wait := c.waitForEndpoints(key, svc.CreationTimestamp.Time, timeNow()); wait > 0 {
+				l.Log("event", "waitingForEndpoints", "retryIn", wait, "msg", "no ready endpoints yet, waiting to allocate from a pool in their zone")
+				c.setPending(key, svc, pendingWaitingForEndpoints)
+				// Endpoints becoming ready reprocess the service
+				// right away.
+				c.client.RequeueAfter(key, wait)
+				return true
+			}
+		}
+		if ok, wait := c.throttle.allow(svc.Namespace, timeNow()); !ok {
+			l.Log("op", "allocateIP", "error", "namespace allocation rate exceeded", "namespace", svc.Namespace, "retryIn", wait, "msg", "too many IP allocations in namespace, will retry later")
+			c.setPending(key, svc, pendingThrottled)
+			// Retry once the namespace may allocate again, rather
+			// than with the growing backoff of failed syncs.
+			c.client.RequeueAfter(key, wait)
+			return true
+		}
+		ip, err := c.allocateIP(ctx, l, key, svc)
 		if err != nil {
 			l.Log("op", "allocateIP", "error", err, "msg", "IP allocation failed")
 			c.client.Errorf(svc, "AllocationFailed", "Failed to allocate IP for %q: %s", key, err)
+			c.setPending(key, svc, pendingAllocationFailed)
 			// The outer controller loop will retry converging this
 			// service when another service gets deleted, so there's
 			// nothing to do here but wait to get called again later.
 			return true
 		}
+		c.throttle.take(svc.Namespace, timeNow())
 		lbIP = ip
+		c.markVerified(key, lbIP)
 		l.Log("event", "ipAllocated", "ip", lbIP, "msg", "IP address assigned by controller")
 		c.client.Infof(svc, "IPAllocated", "Assigned IP %q", lbIP)
 	}
@@ -118,18 +227,43 @@ func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service)
 	if lbIP == nil {
 		l.Log("bug", "true", "msg", "internal error: failed to allocate an IP, but did not exit convergeService early!")
 		c.client.Errorf(svc, "InternalError", "didn't allocate an IP but also did not fail")
-		c.clearServiceState(l, key, svc)
+		c.clearServiceState(ctx, l, key, svc)
 		return true
 	}
 
+	c.clearPending(key, svc)
+
 	pool := c.ips.Pool(key)
 	if pool == "" || c.config.Pools[pool] == nil {
 		l.Log("bug", "true", "ip", lbIP, "msg", "internal error: allocated IP has no matching address pool")
 		c.client.Errorf(svc, "InternalError", "allocated an IP that has no pool")
-		c.clearServiceState(l, key, svc)
+		c.clearServiceState(ctx, l, key, svc)
 		return true
 	}
 
+	if !c.checkLease(ctx, l, key, svc, c.config.Pools[pool]) {
+		return true
+	}
+	recordRequest(svc, c.config.Pools[pool])
+
+	// The speakers announce with the pool's attributes when the
+	// overrides are invalid, tell the user why.
+	if _, err := c.config.Pools[pool].ServiceBGPOverrides(svc.Annotations); err != nil {
+		l.Log("op", "checkBGPOverrides", "error", err, "msg", "invalid BGP attribute overrides")
+		c.client.Errorf(svc, "InvalidBGPOverride", "Ignoring BGP attribute overrides: %s", err)
+	}
+	// Likewise with the pool's protocols for an invalid protocol
+	// selection.
+	if _, err := c.config.Pools[pool].ServiceProtocols(svc.Annotations); err != nil {
+		l.Log("op", "checkProtocol", "error", err, "msg", "invalid announcement protocol selection")
+		c.client.Errorf(svc, "InvalidProtocol", "Announcing with all the protocols of address pool %q: %s", pool, err)
+	}
+	c.checkBlackhole(l, svc)
+
+	if !c.runHooks(ctx, l, key, svc, lbIP, pool) {
+		return false
+	}
+
 	// At this point, we have an IP selected somehow, all that remains
 	// is to program the data plane.
 	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: lbIP.String()}}
@@ -138,23 +272,243 @@ func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service)
 
 // clearServiceState clears all fields that are actively managed by
 // this controller.
-func (c *controller) clearServiceState(l log.Logger, key string, svc *v1.Service) {
-	if err := c.ips.UnAllocate(l, key); err != nil {
+func (c *controller) clearServiceState(ctx context.Context, l log.Logger, key string, svc *v1.Service) {
+	if err := c.ips.UnAllocate(ctx, l, key); err != nil {
 		l.Log("bug", "IPReleaseFailed", "error", err)
 	}
 	c.ips.Unassign(key)
+	delete(c.verified, key)
 	svc.Status.LoadBalancer = v1.LoadBalancerStatus{}
+	delete(svc.Annotations, leaseStartAnnotation)
+	delete(svc.Annotations, requestedAnnotation)
+	if svc.Annotations[leaseExpiredAnnotation] == leaseNotified {
+		delete(svc.Annotations, leaseExpiredAnnotation)
+	}
 }
 
-func (c *controller) allocateIP(l log.Logger, key string, svc *v1.Service) (net.IP, error) {
+// checkRequestRemoval applies the request-removal-policy of the pool
+// of svc's current IP, if the user removed the loadBalancerIP,
+// address-pool or address-pool-selector request that the IP was
+// allocated for. It returns false if svc's IP was released.
+func (c *controller) checkRequestRemoval(ctx context.Context, l log.Logger, key string, svc *v1.Service) bool {
+	var removed bool
+	switch svc.Annotations[requestedAnnotation] {
+	case requestedByIP:
+		removed = svc.Spec.LoadBalancerIP == ""
+	case requestedByPool:
+		removed = svc.Annotations["metallb.universe.tf/address-pool"] == ""
+	case requestedBySelector:
+		removed = svc.Annotations[poolSelectorAnnotation] == ""
+	}
+	if !removed {
+		return true
+	}
+
+	delete(svc.Annotations, requestedAnnotation)
+	pool := c.config.Pools[c.ips.Pool(key)]
+	if pool == nil || !pool.ReallocateOnRequestRemoval {
+		l.Log("event", "requestRemoved", "msg", "user removed the IP request, keeping current IP")
+		return true
+	}
+
+	l.Log("event", "clearAssignment", "reason", "requestRemoved", "msg", "user removed the IP request, reallocating from auto-assign pools")
+	c.client.Infof(svc, "RequestRemoved", "IP request removed, reallocating from auto-assign pools per the pool's request-removal-policy")
+	c.clearServiceState(ctx, l, key, svc)
+	return false
+}
+
+// recordRequest marks svc with what requested its current IP, for
+// checkRequestRemoval. Only pools with request-removal-policy
+// "reallocate" need it.
+func recordRequest(svc *v1.Service, pool *config.Pool) {
+	if !pool.ReallocateOnRequestRemoval {
+		delete(svc.Annotations, requestedAnnotation)
+		return
+	}
+	var by string
+	switch {
+	case svc.Spec.LoadBalancerIP != "":
+		by = requestedByIP
+	case svc.Annotations["metallb.universe.tf/address-pool"] != "":
+		by = requestedByPool
+	case svc.Annotations[poolSelectorAnnotation] != "":
+		by = requestedBySelector
+	default:
+		return
+	}
+	if svc.Annotations == nil {
+		svc.Annotations = map[string]string{}
+	}
+	svc.Annotations[requestedAnnotation] = by
+}
+
+// resolveConflict handles svc claiming lbIP in its status while
+// other, incompatible services also claim it, which can happen after
+// a restore from backup. The oldest service keeps the IP. If that is
+// svc, resolveConflict takes the IP away from the other services,
+// schedules them for reprocessing so that they get new IPs, and
+// returns true.
+func (c *controller) resolveConflict(l log.Logger, key string, svc *v1.Service, lbIP net.IP) bool {
+	owners := c.ips.ServicesOnIP(lbIP)
+	if len(owners) == 0 {
+		return false
+	}
+	for _, owner := range owners {
+		if !olderService(key, svc.CreationTimestamp, owner, c.created[owner]) {
+			return false
+		}
+	}
+	for _, owner := range owners {
+		l.Log("event", "ipConflict", "ip", lbIP, "loser", owner, "msg", "IP claimed by a newer service, taking it back")
+		c.ips.Unassign(owner)
+		delete(c.verified, owner)
+	}
+	c.client.Infof(svc, "IPConflict", "IP %q was also claimed by newer service(s) %s, which will get new IPs", lbIP, strings.Join(owners, ", "))
+	c.reprocessAll = true
+	return true
+}
+
+// poolSelected returns false if svc selects pools with the
+// address-pool-selector annotation, and the pool of its current IP
+// isn't one of them. Invalid selectors select all pools, the
+// allocation reports them.
+func (c *controller) poolSelected(key string, svc *v1.Service) bool {
+	s := svc.Annotations[poolSelectorAnnotation]
+	if s == "" {
+		return true
+	}
+	sel, err := labels.Parse(s)
+	if err != nil {
+		return true
+	}
+	pool := c.config.Pools[c.ips.Pool(key)]
+	return pool == nil || sel.Matches(pool.Labels)
+}
+
+// olderService returns true if service a, created at ta, should win
+// an IP conflict against service b, created at tb. Ties are broken by
+// name, so that the outcome doesn't depend on processing order.
+func olderService(a string, ta metav1.Time, b string, tb metav1.Time) bool {
+	if !ta.Equal(&tb) {
+		return ta.Before(&tb)
+	}
+	return a < b
+}
+
+// markVerified records that ip is known to be correctly reserved
+// for the service key.
+func (c *controller) markVerified(key string, ip net.IP) {
+	if c.verified == nil {
+		c.verified = map[string]net.IP{}
+	}
+	c.verified[key] = ip
+}
+
+// checkLease enforces the max-lease-duration of pool on svc. It
+// returns false if svc's IP was released because its lease expired.
+func (c *controller) checkLease(ctx context.Context, l log.Logger, key string, svc *v1.Service, pool *config.Pool) bool {
+	if pool.MaxLeaseDuration == 0 {
+		return true
+	}
+
+	start, err := time.Parse(time.RFC3339, svc.Annotations[leaseStartAnnotation])
+	if err != nil {
+		// New allocation, or the pool just got a lease limit. Either
+		// way, the lease starts now.
+		if svc.Annotations == nil {
+			svc.Annotations = map[string]string{}
+		}
+		svc.Annotations[leaseStartAnnotation] = timeNow().UTC().Format(time.RFC3339)
+		return true
+	}
+
+	held := timeNow().Sub(start)
+	if held <= pool.MaxLeaseDuration {
+		return true
+	}
+
+	if !pool.ReleaseExpiredLeases {
+		if svc.Annotations[leaseExpiredAnnotation] != leaseNotified {
+			l.Log("event", "leaseExpired", "held", held, "maxLease", pool.MaxLeaseDuration, "msg", "service has held its IP past the pool's max-lease-duration")
+			c.client.Errorf(svc, "LeaseExpired", "Service has held its IP for %s, longer than the pool's max-lease-duration of %s", held.Round(time.Second), pool.MaxLeaseDuration)
+			svc.Annotations[leaseExpiredAnnotation] = leaseNotified
+		}
+		return true
+	}
+
+	l.Log("event", "clearAssignment", "reason", "leaseExpired", "held", held, "maxLease", pool.MaxLeaseDuration, "msg", "releasing IP held past the pool's max-lease-duration")
+	c.client.Errorf(svc, "LeaseExpired", "Released IP held for %s, longer than the pool's max-lease-duration of %s. Remove the %s annotation to get a new IP", held.Round(time.Second), pool.MaxLeaseDuration, leaseExpiredAnnotation)
+	c.clearServiceState(ctx, l, key, svc)
+	svc.Annotations[leaseExpiredAnnotation] = leaseReleased
+	return false
+}
+
+// checkBlackhole maintains the blackhole annotation of svc: it turns
+// a requested duration into the time at which blackholing ends, and
+// removes the annotation once that time has passed.
+func (c *controller) checkBlackhole(l log.Logger, svc *v1.Service) {
+	v, ok := svc.Annotations[config.BlackholeAnnotation]
+	if !ok {
+		return
+	}
+
+	until, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			l.Log("op", "checkBlackhole", "error", fmt.Sprintf("invalid value %q", v), "msg", "invalid blackhole request")
+			c.client.Errorf(svc, "InvalidBlackhole", "Invalid %s %q, must be a positive duration", config.BlackholeAnnotation, v)
+			return
+		}
+		until = timeNow().Add(d).UTC()
+		svc.Annotations[config.BlackholeAnnotation] = until.Format(time.RFC3339)
+		l.Log("event", "blackholeRequested", "until", until, "msg", "service IP will be advertised with the blackhole community")
+		c.client.Infof(svc, "BlackholeRequested", "Blackholing traffic to the service IP until %s", until.Format(time.RFC3339))
+		return
+	}
+
+	if timeNow().Before(until) {
+		return
+	}
+	delete(svc.Annotations, config.BlackholeAnnotation)
+	l.Log("event", "blackholeExpired", "msg", "blackhole expired, removing annotation")
+	c.client.Infof(svc, "BlackholeExpired", "Blackhole ended at %s", until.Format(time.RFC3339))
+}
+
+func (c *controller) allocateIP(ctx context.Context, l log.Logger, key string, svc *v1.Service) (net.IP, error) {
+	ctx, span := tracing.Start(ctx, "allocator.allocate", "service", key)
+	ip, err := c.doAllocateIP(ctx, l, c.ips, key, svc)
+	if ip != nil {
+		span.SetAttributes("ip", ip.String(), "pool", c.ips.Pool(key))
+	}
+	span.End(err)
+	return ip, err
+}
+
+// doAllocateIP allocates an IP to svc from ips, which is c.ips, or a
+// shadow of it to simulate the allocation.
+func (c *controller) doAllocateIP(ctx context.Context, l log.Logger, ips *allocator.Allocator, key string, svc *v1.Service) (net.IP, error) {
 	clusterIP := net.ParseIP(svc.Spec.ClusterIP)
 	if clusterIP == nil {
 		// (we should never get here because the caller ensured that Spec.ClusterIP != nil)
 		return nil, fmt.Errorf("invalid ClusterIP [%s], can't determine family", svc.Spec.ClusterIP)
 	}
+	// The vendored API predates spec.ipFamilies, so the family is
+	// always the ClusterIP's. Pools restrict which families they
+	// serve with ip-family.
 	isIPv6 := clusterIP.To4() == nil
 
-	// If the user asked for a specific IP, try that.
+	// Data plane services of a gateway share the gateway's IP.
+	if ip := c.gatewayIP(svc.Namespace, svc.Labels); ip != nil {
+		if err := ips.Assign(key, ip, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc), k8salloc.Protocol(svc)); err != nil {
+			return nil, err
+		}
+		return ip, nil
+	}
+
+	// If the user asked for a specific IP, try that. IPs from an
+	// external IPAM are reserved in the pool they asked for, if any.
+	desiredPool := svc.Annotations["metallb.universe.tf/address-pool"]
 	if svc.Spec.LoadBalancerIP != "" {
 		ip := net.ParseIP(svc.Spec.LoadBalancerIP)
 		if ip == nil {
@@ -163,22 +517,31 @@ func (c *controller) allocateIP(l log.Logger, key string, svc *v1.Service) (net.
 		if (ip.To4() == nil) != isIPv6 {
 			return nil, fmt.Errorf("requested spec.loadBalancerIP %q does not match the ipFamily of the service", svc.Spec.LoadBalancerIP)
 		}
-		if err := c.ips.Assign(key, ip, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc)); err != nil {
+		if err := ips.AssignRequested(ctx, l, key, ip, desiredPool, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc), k8salloc.Protocol(svc)); err != nil {
 			return nil, err
 		}
 		return ip, nil
 	}
 
 	// Otherwise, did the user ask for a specific pool?
-	desiredPool := svc.Annotations["metallb.universe.tf/address-pool"]
 	if desiredPool != "" {
-		ip, err := c.ips.AllocateFromPool(l, key, isIPv6, desiredPool, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc))
+		ip, err := ips.AllocateFromPool(ctx, l, key, isIPv6, desiredPool, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc), k8salloc.Protocol(svc))
 		if err != nil {
 			return nil, err
 		}
 		return ip, nil
 	}
 
-	// Okay, in that case just bruteforce across all pools.
-	return c.ips.Allocate(l, key, isIPv6, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc))
+	// Or pools with some labels?
+	if s := svc.Annotations[poolSelectorAnnotation]; s != "" {
+		sel, err := labels.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation %q: %s", poolSelectorAnnotation, s, err)
+		}
+		return ips.AllocateFromSelector(ctx, l, key, isIPv6, sel, c.zones.nodeLabels(key), k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc), k8salloc.Protocol(svc))
+	}
+
+	// Okay, in that case just bruteforce across all pools, trying
+	// pools in the zones of the endpoints first.
+	return ips.AllocateNear(ctx, l, key, isIPv6, c.zones.nodeLabels(key), k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc), k8salloc.Protocol(svc))
 }
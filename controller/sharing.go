@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// sharingGroups tracks which services share each IP, so that the
+// members of a group can be told when a service joins or leaves it.
+type sharingGroups struct {
+	// Protects members, which is also read by the debug server.
+	mu      sync.Mutex
+	members map[string][]string // IP -> sorted service names
+
+	ipOf map[string]string      // service name -> IP
+	svcs map[string]*v1.Service // service name -> latest object, for events
+}
+
+// snapshot returns the services on each IP that is shared by more
+// than one service.
+func (g *sharingGroups) snapshot() interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ret := map[string][]string{}
+	for ip, svcs := range g.members {
+		if len(svcs) > 1 {
+			ret[ip] = append([]string(nil), svcs...)
+		}
+	}
+	return ret
+}
+
+// updateSharing records the IP that name currently holds, and sends
+// events to the other services on its previous and new IP if name
+// left or joined them. svc is nil if name was deleted.
+func (c *controller) updateSharing(l log.Logger, name string, svc *v1.Service) {
+	g := &c.sharing
+	if g.ipOf == nil {
+		g.ipOf = map[string]string{}
+		g.svcs = map[string]*v1.Service{}
+	}
+
+	if svc != nil {
+		g.svcs[name] = svc
+	} else {
+		delete(g.svcs, name)
+	}
+
+	oldIP, newIP := g.ipOf[name], ""
+	if ip := c.ips.IP(name); ip != nil {
+		newIP = ip.String()
+	}
+	if oldIP == newIP {
+		return
+	}
+	if newIP == "" {
+		delete(g.ipOf, name)
+	} else {
+		g.ipOf[name] = newIP
+	}
+
+	g.mu.Lock()
+	if g.members == nil {
+		g.members = map[string][]string{}
+	}
+	var left, joined []string
+	if oldIP != "" {
+		for _, s := range g.members[oldIP] {
+			if s != name {
+				left = append(left, s)
+			}
+		}
+		if len(left) == 0 {
+			delete(g.members, oldIP)
+		} else {
+			g.members[oldIP] = left
+		}
+	}
+	if newIP != "" {
+		joined = g.members[newIP]
+		g.members[newIP] = append(append([]string(nil), joined...), name)
+		sort.Strings(g.members[newIP])
+	}
+	g.mu.Unlock()
+
+	// All services join a group on startup, that's not news.
+	if !c.synced {
+		return
+	}
+
+	if len(left) > 0 {
+		l.Log("event", "sharingGroupChanged", "ip", oldIP, "left", name, "members", strings.Join(left, ","), "msg", "service left shared IP")
+		for _, s := range left {
+			if other := g.svcs[s]; other != nil {
+				c.client.Infof(other, "SharingGroupChanged", "Service %q stopped sharing IP %q, now shared with %s", name, oldIP, strings.Join(left, ", "))
+			}
+		}
+	}
+	if len(joined) > 0 {
+		l.Log("event", "sharingGroupChanged", "ip", newIP, "joined", name, "members", strings.Join(joined, ","), "msg", "service joined shared IP")
+		for _, s := range joined {
+			if other := g.svcs[s]; other != nil {
+				c.client.Infof(other, "SharingGroupChanged", "Service %q started sharing IP %q, now shared with %s", name, newIP, strings.Join(g.members[newIP], ", "))
+			}
+		}
+		if svc != nil {
+			c.client.Infof(svc, "SharingGroupJoined", "Sharing IP %q with %s", newIP, strings.Join(joined, ", "))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.universe.tf/metallb/internal/ratelimit"
+)
+
+var throttledAllocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "metallb",
+	Subsystem: "controller",
+	Name:      "allocations_throttled_total",
+	Help:      "Number of IP allocations postponed because their namespace exceeded its allocation rate, by namespace",
+}, []string{
+	"namespace",
+})
+
+func init() {
+	prometheus.MustRegister(throttledAllocations)
+}
+
+// namespaceThrottle rate limits the IP allocations of each namespace,
+// so that a namespace creating services in a loop can't starve the
+// others. A nil namespaceThrottle allows everything.
+type namespaceThrottle struct {
+	keyed *ratelimit.Keyed
+}
+
+// newNamespaceThrottle returns a throttle that allows rate
+// allocations per second in each namespace, in bursts of up to burst
+// allocations. It returns nil if rate is zero.
+func newNamespaceThrottle(rate float64, burst int) *namespaceThrottle {
+	keyed := ratelimit.New(rate, burst)
+	if keyed == nil {
+		return nil
+	}
+	return &namespaceThrottle{keyed: keyed}
+}
+
+// allow returns true if a service in ns may be allocated an IP at
+// now, and otherwise how long until it may. The allocation is only
+// counted against the namespace's rate once taken.
+func (t *namespaceThrottle) allow(ns string, now time.Time) (bool, time.Duration) {
+	if t == nil {
+		return true, 0
+	}
+	if wait := t.keyed.Delay(ns, now); wait > 0 {
+		throttledAllocations.WithLabelValues(ns).Inc()
+		return false, wait
+	}
+	return true, 0
+}
+
+// take counts an allocation in ns at now against the namespace's
+// rate, so that failed allocations don't.
+func (t *namespaceThrottle) take(ns string, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.keyed.Allow(ns, now)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// endpointWait is how long after its creation a service waits for
+// ready endpoints before getting an IP, when zones matter for its
+// allocation. New services usually have no ready endpoints yet.
+const endpointWait = 30 * time.Second
+
+// endpointZones tracks on which nodes, and so zones, the endpoints of
+// services run, to allocate their IPs from pools in those zones, see
+// Allocator.AllocateNear. A nil endpointZones tracks nothing.
+type endpointZones struct {
+	// Labels of every node.
+	nodes map[string]labels.Set
+	// service -> nodes running its ready endpoints.
+	endpoints map[string][]string
+}
+
+func newEndpointZones() *endpointZones {
+	return &endpointZones{
+		nodes:     map[string]labels.Set{},
+		endpoints: map[string][]string{},
+	}
+}
+
+// setEndpoints tracks the nodes of the endpoints eps of the service
+// name, nil if it was deleted.
+func (z *endpointZones) setEndpoints(name string, eps *v1.Endpoints) {
+	if z == nil {
+		return
+	}
+	seen := map[string]bool{}
+	var nodes []string
+	if eps != nil {
+		for _, subset := range eps.Subsets {
+			for _, ep := range subset.Addresses {
+				if ep.NodeName == nil || seen[*ep.NodeName] {
+					continue
+				}
+				seen[*ep.NodeName] = true
+				nodes = append(nodes, *ep.NodeName)
+			}
+		}
+	}
+	if len(nodes) == 0 {
+		delete(z.endpoints, name)
+		return
+	}
+	z.endpoints[name] = nodes
+}
+
+// setNode tracks the labels of the node name, nil if it was deleted.
+func (z *endpointZones) setNode(name string, node *v1.Node) {
+	if node == nil {
+		delete(z.nodes, name)
+		return
+	}
+	z.nodes[name] = labels.Set(node.Labels)
+}
+
+// nodeLabels returns the labels of the nodes running the endpoints of
+// the service name.
+func (z *endpointZones) nodeLabels(name string) []labels.Set {
+	if z == nil {
+		return nil
+	}
+	var ret []labels.Set
+	for _, n := range z.endpoints[name] {
+		if l, ok := z.nodes[n]; ok {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+// waitForEndpoints returns how much longer the service key, created
+// at created, should wait for ready endpoints before getting an IP
+// from pools, zero if it shouldn't wait. Services only wait while
+// the zones of their endpoints are unknown and some pool has a
+// topology.
+func (c *controller) waitForEndpoints(key string, created, now time.Time) time.Duration {
+	if c.zones == nil || len(c.zones.endpoints[key]) > 0 {
+		return 0
+	}
+	zoned := false
+	for _, pool := range c.config.Pools {
+		if pool.Topology != nil {
+			zoned = true
+			break
+		}
+	}
+	if !zoned {
+		return 0
+	}
+	if wait := created.Add(endpointWait).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// SetClusterNode tracks the labels of any node. Allocated IPs don't
+// move when nodes change zones, so nothing is reprocessed.
+func (c *controller) SetClusterNode(l log.Logger, name string, node *v1.Node) k8s.SyncState {
+	c.zones.setNode(name, node)
+	return k8s.SyncStateSuccess
+}
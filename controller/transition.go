@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// balancerState is what the controller must hold for a service,
+// derived from the service's type. Type changes move a service
+// between states, and only leaving stateBalancer releases an IP.
+type balancerState int
+
+const (
+	// Not processed since startup.
+	stateUnknown balancerState = iota
+	// Not a LoadBalancer (ClusterIP, NodePort, ExternalName): no IP.
+	stateNotBalancer
+	// A LoadBalancer without a usable ClusterIP, e.g. halfway through
+	// a conversion from a headless service: no IP, since we can't
+	// tell which IP family to allocate from.
+	stateNoClusterIP
+	// A LoadBalancer: exactly one IP.
+	stateBalancer
+)
+
+func (s balancerState) String() string {
+	switch s {
+	case stateNotBalancer:
+		return "notLoadBalancer"
+	case stateNoClusterIP:
+		return "noClusterIP"
+	case stateBalancer:
+		return "loadBalancer"
+	default:
+		return "unknown"
+	}
+}
+
+// desiredState returns the state that svc's spec asks for.
+func desiredState(svc *v1.Service) balancerState {
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return stateNotBalancer
+	}
+	if net.ParseIP(svc.Spec.ClusterIP) == nil {
+		return stateNoClusterIP
+	}
+	return stateBalancer
+}
+
+// transition moves key to the state that svc asks for and returns
+// it. Moving to a state other than stateBalancer releases the
+// service's IP, if it has one, and clears any leftover balancer
+// state from the service object.
+func (c *controller) transition(ctx context.Context, l log.Logger, key string, svc *v1.Service) balancerState {
+	if c.states == nil {
+		c.states = map[string]balancerState{}
+	}
+	from, to := c.states[key], desiredState(svc)
+	c.states[key] = to
+	if from != stateUnknown && from != to {
+		l.Log("event", "typeTransition", "from", from, "to", to, "type", svc.Spec.Type, "msg", "service changed type")
+	}
+	if to == stateBalancer {
+		return to
+	}
+
+	if ip := c.ips.IP(key); ip != nil {
+		l.Log("event", "clearAssignment", "reason", to, "ip", ip, "msg", "service no longer needs an IP, releasing")
+		c.client.Infof(svc, "IPReleased", "Released IP %q, service is no longer a LoadBalancer with a ClusterIP", ip)
+	}
+	// Leftover status or annotations, e.g. from before a restart,
+	// are cleared even if no IP is assigned.
+	c.clearServiceState(ctx, l, key, svc)
+	c.clearPending(key, svc)
+	return to
+}
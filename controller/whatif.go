@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/allocator"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// whatIfResult is the answer to a what-if allocation request.
+type whatIfResult struct {
+	Service string `json:"service"`
+	Pool    string `json:"pool,omitempty"`
+	// Empty if the pool's IPAM would pick the IP.
+	IP string `json:"ip,omitempty"`
+	// Services of the same namespace that the IP would be shared
+	// with, and how many services of other namespaces, which are not
+	// named.
+	SharedWith      []string `json:"sharedWith,omitempty"`
+	OtherNamespaces int      `json:"sharedWithOtherNamespaces,omitempty"`
+	Reason          string   `json:"reason"`
+	// Why the service would get no IP.
+	Error string `json:"error,omitempty"`
+}
+
+// whatIf simulates the creation of svc, and returns which IP it would
+// get and why. The allocation runs against a shadow of the allocator,
+// so it doesn't change anything.
+func (c *controller) whatIf(svc *v1.Service) whatIfResult {
+	key := svc.Namespace + "/" + svc.Name
+	ret := whatIfResult{
+		Service: key,
+		Reason:  c.allocationReason(svc),
+	}
+	if c.config == nil {
+		ret.Error = "no configuration loaded"
+		return ret
+	}
+	if svc.Spec.Type != "LoadBalancer" {
+		ret.Error = fmt.Sprintf("service type is %q, MetalLB only allocates IPs to LoadBalancer services", svc.Spec.Type)
+		return ret
+	}
+
+	svc = svc.DeepCopy()
+	if svc.Spec.ClusterIP == "" {
+		// Only known once the service is created. Go with the
+		// family of the requested IP, if any.
+		svc.Spec.ClusterIP = "0.0.0.0"
+		if ip := net.ParseIP(svc.Spec.LoadBalancerIP); ip != nil && ip.To4() == nil {
+			svc.Spec.ClusterIP = "::"
+		}
+	}
+
+	ips := c.ips.Shadow()
+	// Simulate a creation, not an update of an existing service of
+	// the same name.
+	ips.Unassign(key)
+	ip, err := c.doAllocateIP(context.Background(), log.NewNopLogger(), ips, key, svc)
+	var sim *allocator.SimulatedIPAMError
+	switch {
+	case errors.As(err, &sim):
+		ret.Pool = sim.Pool
+		ret.Reason += ", the pool's IPAM picks the IP when the service is created"
+	case err != nil:
+		ret.Error = redactServices(err.Error(), svc.Namespace, ips)
+	default:
+		ret.Pool = ips.Pool(key)
+		ret.IP = ip.String()
+		for _, other := range ips.ServicesOnIP(ip) {
+			switch {
+			case other == key:
+			case strings.HasPrefix(other, svc.Namespace+"/"):
+				ret.SharedWith = append(ret.SharedWith, other)
+			default:
+				ret.OtherNamespaces++
+			}
+		}
+	}
+	return ret
+}
+
+// redactServices replaces the names of the services of ips outside
+// namespace ns in msg, so that what-if requests don't reveal other
+// namespaces' services.
+func redactServices(msg, ns string, ips *allocator.Allocator) string {
+	for other := range ips.Assignments() {
+		if !strings.HasPrefix(other, ns+"/") {
+			msg = strings.Replace(msg, other, "<service in another namespace>", -1)
+		}
+	}
+	return msg
+}
+
+// allocationReason explains how doAllocateIP picks the IP of svc.
+func (c *controller) allocationReason(svc *v1.Service) string {
+	switch {
+	case c.gatewayIP(svc.Namespace, svc.Labels) != nil:
+		return "data plane service of a gateway, gets the gateway's IP"
+	case svc.Spec.LoadBalancerIP != "":
+		return fmt.Sprintf("spec.loadBalancerIP requests %s", svc.Spec.LoadBalancerIP)
+	case svc.Annotations["metallb.universe.tf/address-pool"] != "":
+		return fmt.Sprintf("the metallb.universe.tf/address-pool annotation requests pool %q", svc.Annotations["metallb.universe.tf/address-pool"])
+	case svc.Annotations[poolSelectorAnnotation] != "":
+		return fmt.Sprintf("the %s annotation selects pools %q, first one by name with a free IP of the service's family", poolSelectorAnnotation, svc.Annotations[poolSelectorAnnotation])
+	default:
+		return "first pool, by name, with auto-assign enabled and a free IP of the service's family"
+	}
+}
+
+// serveWhatIf answers POSTs of a Service, in YAML or JSON, with the
+// whatIfResult of creating it, to requests bearing token. call runs
+// the simulation between two events, see k8s.Client.Call.
+func (c *controller) serveWhatIf(call func(func()) error, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		bs, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("reading request: %s", err), http.StatusBadRequest)
+			return
+		}
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(bs, nil, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("decoding service: %s", err), http.StatusBadRequest)
+			return
+		}
+		svc, ok := obj.(*v1.Service)
+		if !ok {
+			http.Error(w, fmt.Sprintf("got a %T, want a Service", obj), http.StatusBadRequest)
+			return
+		}
+		if svc.Namespace == "" {
+			svc.Namespace = "default"
+		}
+
+		var ret whatIfResult
+		if err := call(func() { ret = c.whatIf(svc) }); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ret)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	vk "go.universe.tf/virtuakube"
+)
+
+// The client VM captures all BGP traffic to a ring of captureFiles
+// files of captureFileMiB each, so that long soak runs keep the
+// recent history without filling the disk.
+const (
+	captureDir     = "/var/lib/bgp-capture"
+	captureFiles   = 20
+	captureFileMiB = 10
+)
+
+// captureFilter selects packets from the client's BGP capture.
+type captureFilter struct {
+	// Only packets captured within [Since, Until). Zero values leave
+	// that end open.
+	Since, Until time.Time
+	// Only packets to or from this address, if not empty.
+	Peer string
+	// Return pcapng rather than pcap.
+	PCAPNG bool
+}
+
+// configureCapture starts the rotating BGP capture on client.
+func configureCapture(client *vk.VM) error {
+	unit := fmt.Sprintf(captureUnit, captureDir, captureDir, captureFileMiB, captureFiles)
+	if err := client.WriteFile("/etc/systemd/system/bgp-capture.service", []byte(unit)); err != nil {
+		return err
+	}
+	return client.RunMultiple(
+		"systemctl daemon-reload",
+		"systemctl enable bgp-capture",
+		"systemctl restart bgp-capture",
+	)
+}
+
+// fetchCapture returns the packets of the client's BGP capture that
+// match f, merged across the ring's files in time order.
+func fetchCapture(client *vk.VM, f captureFilter) ([]byte, error) {
+	// Files of the ring are named bgp.pcap00, bgp.pcap01 and so on.
+	cmd := []string{fmt.Sprintf("mergecap -F pcap -w - %s/bgp.pcap*", captureDir)}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		editcap := "TZ=UTC editcap"
+		if !f.Since.IsZero() {
+			editcap += fmt.Sprintf(" -A '%s'", f.Since.UTC().Format("2006-01-02 15:04:05"))
+		}
+		if !f.Until.IsZero() {
+			editcap += fmt.Sprintf(" -B '%s'", f.Until.UTC().Format("2006-01-02 15:04:05"))
+		}
+		cmd = append(cmd, editcap+" - -")
+	}
+	if f.Peer != "" {
+		cmd = append(cmd, fmt.Sprintf("tcpdump -r - -w - host %s", f.Peer))
+	}
+	if f.PCAPNG {
+		cmd = append(cmd, "editcap -F pcapng - -")
+	}
+
+	// The VM runs the pipeline, and we fetch the result from a file,
+	// so that tool chatter on stderr doesn't end up in the capture.
+	out := captureDir + "/fetch.out"
+	if _, err := client.Run(fmt.Sprintf("sh -c '%s > %s'", strings.Replace(strings.Join(cmd, " | "), "'", `'"'"'`, -1), out)); err != nil {
+		return nil, fmt.Errorf("filtering capture: %v", err)
+	}
+	bs, err := client.Run("base64 -w0 " + out)
+	if err != nil {
+		return nil, fmt.Errorf("reading capture: %v", err)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(bs)))
+}
+
+// saveCapture writes the client's BGP capture since start to
+// $E2E_ARTIFACTS, if t failed and that variable is set.
+func saveCapture(t *testing.T, client *vk.VM, start time.Time) {
+	dir := os.Getenv("E2E_ARTIFACTS")
+	if dir == "" || !t.Failed() {
+		return
+	}
+	bs, err := fetchCapture(client, captureFilter{Since: start, PCAPNG: true})
+	if err != nil {
+		t.Logf("fetching BGP capture: %v", err)
+		return
+	}
+	name := filepath.Join(dir, strings.Replace(t.Name(), "/", "_", -1)+".pcapng")
+	if err := ioutil.WriteFile(name, bs, 0644); err != nil {
+		t.Logf("saving BGP capture: %v", err)
+		return
+	}
+	t.Logf("BGP capture saved to %s", name)
+}
+
+const captureUnit = `[Unit]
+Description=Rotating capture of BGP traffic
+After=network.target
+
+[Service]
+ExecStartPre=/bin/mkdir -p %s
+ExecStart=/usr/sbin/tcpdump -i any -n -U -w %s/bgp.pcap -C %d -W %d tcp port 179
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`
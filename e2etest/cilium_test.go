@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+const ciliumConfig = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  namespace: metallb-system
+  name: config
+data:
+  config: |
+    address-pools:
+    - name: default
+      protocol: layer2
+      addresses:
+      - %s-%s
+`
+
+const ciliumService = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: mirror-cilium
+spec:
+  ports:
+  - port: 80
+    targetPort: 8080
+  selector:
+    app: mirror
+  type: LoadBalancer
+  loadBalancerIP: %s
+  externalTrafficPolicy: %s
+`
+
+// TestCiliumKind checks MetalLB on a kind cluster where Cilium
+// replaces kube-proxy, as set up by `inv dev-env --cni=cilium`. It
+// only runs with E2E_KIND_KUBECONFIG set to the cluster's kubeconfig,
+// and needs kubectl, docker and curl on the host, which is on kind's
+// docker network.
+func TestCiliumKind(t *testing.T) {
+	kubeconfig := os.Getenv("E2E_KIND_KUBECONFIG")
+	if kubeconfig == "" {
+		t.Skip("E2E_KIND_KUBECONFIG not set")
+	}
+	kubectl := func(stdin string, args ...string) (string, error) {
+		cmd := exec.Command("kubectl", append([]string{"--kubeconfig", kubeconfig}, args...)...)
+		cmd.Stdin = strings.NewReader(stdin)
+		bs, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("kubectl %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(bs))
+		}
+		return strings.TrimSpace(string(bs)), nil
+	}
+
+	kpr, err := kubectl("", "-n", "kube-system", "get", "configmap", "cilium-config", "-o", "jsonpath={.data.kube-proxy-replacement}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kpr != "strict" && kpr != "true" {
+		t.Fatalf("Cilium's kube-proxy-replacement is %q, the cluster still needs kube-proxy", kpr)
+	}
+
+	first, last, err := kindPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubectl(fmt.Sprintf(ciliumConfig, first, last), "apply", "-f", "-"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []string{"Cluster", "Local"} {
+		t.Run(policy, func(t *testing.T) {
+			if _, err := kubectl(fmt.Sprintf(ciliumService, first, policy), "apply", "-f", "-"); err != nil {
+				t.Fatal(err)
+			}
+			defer kubectl("", "delete", "service", "mirror-cilium")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+			defer cancel()
+
+			t.Run("http", func(t *testing.T) {
+				waitFor(ctx, t, func() error {
+					bs, err := exec.Command("curl", "--silent", "--fail", "--max-time", "2", "http://"+first.String()).CombinedOutput()
+					if err != nil {
+						return fmt.Errorf("fetching http://%s: %v: %s", first, err, bytes.TrimSpace(bs))
+					}
+					return nil
+				})
+			})
+
+			// Cilium only handles the traffic of IPs local to the
+			// node, so the announcing node holds it on the dummy
+			// interface, and no other node does.
+			t.Run("dummy interface", func(t *testing.T) {
+				waitFor(ctx, t, func() error {
+					nodes, err := kubectl("", "get", "nodes", "-o", "jsonpath={.items[*].metadata.name}")
+					if err != nil {
+						return err
+					}
+					var holding []string
+					for _, node := range strings.Fields(nodes) {
+						// kind names node containers after the nodes.
+						bs, err := exec.Command("docker", "exec", node, "ip", "-o", "addr", "show", "dev", "metallb-host").CombinedOutput()
+						if err == nil && strings.Contains(string(bs), " "+first.String()+"/32 ") {
+							holding = append(holding, node)
+						}
+					}
+					if len(holding) != 1 {
+						return fmt.Errorf("%s is on the dummy interface of nodes %v, want exactly one", first, holding)
+					}
+					return nil
+				})
+			})
+		})
+	}
+}
+
+// kindPool returns the first and last IPs of a small range at the top
+// of the IPv4 subnet of kind's docker network, which docker doesn't
+// hand out to nodes.
+func kindPool() (net.IP, net.IP, error) {
+	bs, err := exec.Command("docker", "network", "inspect", "kind", "-f", "{{range .IPAM.Config}}{{.Subnet}} {{end}}").Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("inspecting kind's docker network: %v", err)
+	}
+	for _, s := range strings.Fields(string(bs)) {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil || n.IP.To4() == nil {
+			continue
+		}
+		// The broadcast address, minus 1 and 10.
+		last := make(net.IP, 4)
+		for i := range last {
+			last[i] = n.IP.To4()[i] | ^n.Mask[i]
+		}
+		first := make(net.IP, 4)
+		copy(first, last)
+		last[3]--
+		first[3] -= 10
+		return first, last, nil
+	}
+	return nil, nil, fmt.Errorf("kind's docker network has no IPv4 subnet in %q", strings.TrimSpace(string(bs)))
+}
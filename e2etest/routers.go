@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	vk "go.universe.tf/virtuakube"
+)
+
+// The client VM runs several BIRD instances, so that it models a
+// small leaf-spine topology on its own:
+//
+//   - tor, AS 64513 on net1: the cluster's eBGP peer, with a strict
+//     import policy. This is the distribution's bird service, and
+//     the only instance that programs the kernel.
+//   - rr, AS 64512 on net2: an iBGP route reflector with every
+//     cluster node as a client.
+//   - upstream, AS 64600 on 127.0.0.2: an eBGP upstream of tor,
+//     which exports everything it accepted to it.
+//
+// Each instance has its own config, listening address and control
+// socket, see birdc.
+var routers = []string{"tor", "rr", "upstream"}
+
+// birdc returns the birdc command line for router.
+func birdc(router string) string {
+	if router == "" || router == "tor" {
+		return "birdc"
+	}
+	return fmt.Sprintf("birdc -s /run/bird-%s/bird.ctl", router)
+}
+
+// routerOptions are knobs of tor's sessions with the nodes, to
+// exercise the speaker's session negotiation and error handling.
+type routerOptions struct {
+	// TCP MD5 password the nodes must use.
+	Password string `yaml:"password"`
+	// Hold time tor proposes, in seconds. BIRD's default is 240.
+	HoldTime int `yaml:"hold-time"`
+	// Whether tor advertises capabilities at all, and the route
+	// refresh and 4-byte ASN capabilities. All default to on.
+	Capabilities *bool `yaml:"capabilities"`
+	RouteRefresh *bool `yaml:"route-refresh"`
+	AS4          *bool `yaml:"as4"`
+}
+
+// birdOptions returns o as BIRD bgp protocol options.
+func (o *routerOptions) birdOptions() string {
+	if o == nil {
+		return ""
+	}
+	var ret bytes.Buffer
+	if o.Password != "" {
+		fmt.Fprintf(&ret, "\n  password %q;", o.Password)
+	}
+	if o.HoldTime != 0 {
+		fmt.Fprintf(&ret, "\n  hold time %d;", o.HoldTime)
+	}
+	for _, sw := range []struct {
+		opt string
+		on  *bool
+	}{
+		{"capabilities", o.Capabilities},
+		{"enable route refresh", o.RouteRefresh},
+		{"enable as4", o.AS4},
+	} {
+		if sw.on != nil {
+			fmt.Fprintf(&ret, "\n  %s %s;", sw.opt, onOff(*sw.on))
+		}
+	}
+	return ret.String()
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// routerPeers returns the names and VMs of the cluster's nodes, as
+// the routers' BGP protocols are named.
+func routerPeers(cluster *vk.Cluster) ([]string, []*vk.VM) {
+	vms := append([]*vk.VM{cluster.Controller()}, cluster.Nodes()...)
+	names := []string{"controller"}
+	for i := range cluster.Nodes() {
+		names = append(names, "node"+strconv.Itoa(i))
+	}
+	return names, vms
+}
+
+// torConfig returns tor's IPv4 configuration, with opts applied to
+// its sessions with the nodes.
+func torConfig(client *vk.VM, cluster *vk.Cluster, opts *routerOptions) []byte {
+	var ret bytes.Buffer
+	fmt.Fprintf(&ret, birdBaseCfg, client.IPv4("net1"))
+	fmt.Fprintf(&ret, birdTorCfg, client.IPv4("net1"))
+	names, vms := routerPeers(cluster)
+	for i, vm := range vms {
+		fmt.Fprintf(&ret, birdTorPeerCfg, names[i], vm.IPv4("net1"), opts.birdOptions())
+	}
+	return ret.Bytes()
+}
+
+// reconfigureTor applies opts to tor's sessions with the nodes. BIRD
+// restarts the sessions whose options changed.
+func reconfigureTor(client *vk.VM, cluster *vk.Cluster, opts *routerOptions) error {
+	if err := client.WriteFile("/etc/bird/bird.conf", torConfig(client, cluster, opts)); err != nil {
+		return err
+	}
+	bs, err := client.Run("birdc configure")
+	if err != nil {
+		return fmt.Errorf("reconfiguring tor: %v", err)
+	}
+	// birdc exits 0 even if the config is rejected.
+	if !strings.Contains(string(bs), "Reconfigur") {
+		return fmt.Errorf("reconfiguring tor: %s", strings.TrimSpace(string(bs)))
+	}
+	return nil
+}
+
+// configureRouters writes the configuration of all BIRD instances on
+// client, and (re)starts them.
+func configureRouters(client *vk.VM, cluster *vk.Cluster) error {
+	var tor6, rr, upstream bytes.Buffer
+	fmt.Fprintf(&tor6, birdBaseCfg, client.IPv4("net1"))
+	fmt.Fprintf(&rr, birdRRCfg, client.IPv4("net2"), client.IPv4("net2"))
+	fmt.Fprint(&upstream, birdUpstreamCfg)
+	names, vms := routerPeers(cluster)
+	for i, vm := range vms {
+		fmt.Fprintf(&tor6, birdPeerCfg, names[i], vm.IPv6("net1"))
+		fmt.Fprintf(&rr, birdRRPeerCfg, names[i], client.IPv4("net2"), vm.IPv4("net2"))
+	}
+
+	files := map[string][]byte{
+		"/etc/bird/bird.conf":          torConfig(client, cluster, nil),
+		"/etc/bird/bird6.conf":         tor6.Bytes(),
+		"/etc/bird/bird-rr.conf":       rr.Bytes(),
+		"/etc/bird/bird-upstream.conf": upstream.Bytes(),
+	}
+	for _, r := range []string{"rr", "upstream"} {
+		files["/etc/systemd/system/bird-"+r+".service"] = []byte(fmt.Sprintf(birdUnit, r, r, r, r))
+	}
+	for path, bs := range files {
+		if err := client.WriteFile(path, bs); err != nil {
+			return err
+		}
+	}
+
+	return client.RunMultiple(
+		"systemctl daemon-reload",
+		"systemctl enable bird bird6 bird-rr bird-upstream",
+		"systemctl restart bird bird6 bird-rr bird-upstream",
+	)
+}
+
+const (
+	birdTorCfg = `
+listen bgp address %s;
+
+# Only service IPs from the test range, as host routes or as
+# aggregates no shorter than /24.
+filter tor_import {
+  if net ~ [ 10.249.0.0/16{24,32} ] then accept;
+  reject;
+}
+
+protocol bgp upstream {
+  local 127.0.0.1 as 64513;
+  neighbor 127.0.0.2 as 64600;
+  multihop;
+  import none;
+  export all;
+}`
+
+	birdTorPeerCfg = `
+protocol bgp %s {
+  local as 64513;
+  neighbor %s as 64512;
+  passive;
+  import keep filtered;
+  import filter tor_import;
+  import limit 1000 action block;
+  export none;%s
+}`
+
+	birdRRCfg = `
+router id %s;
+listen bgp address %s;
+
+protocol device {
+  scan time 60;
+}`
+
+	birdRRPeerCfg = `
+protocol bgp %s {
+  local %s as 64512;
+  neighbor %s as 64512;
+  passive;
+  rr client;
+  import all;
+  export all;
+}`
+
+	birdUpstreamCfg = `
+router id 127.0.0.2;
+listen bgp address 127.0.0.2;
+
+protocol device {
+  scan time 60;
+}
+
+# Resolves next hops through tor's loopback address.
+protocol direct {
+  interface "lo";
+  import all;
+}
+
+protocol bgp tor {
+  local 127.0.0.2 as 64600;
+  neighbor 127.0.0.1 as 64513;
+  multihop;
+  passive;
+  import all;
+  export none;
+}`
+
+	birdUnit = `[Unit]
+Description=BIRD routing daemon, %s instance
+After=network.target
+
+[Service]
+RuntimeDirectory=bird-%s
+ExecStart=/bin/sh -c 'exec bird -f -c /etc/bird/bird-%s.conf -s /run/bird-%s/bird.ctl'
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`
+)
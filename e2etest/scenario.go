@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	vk "go.universe.tf/virtuakube"
+)
+
+// A scenario is a declarative test case: a MetalLB configuration,
+// some Kubernetes objects, and what the client VM should see once
+// they are applied. Scenarios live in scenarios/*.yaml, see
+// scenarios/README.md for the format.
+type scenario struct {
+	Name        string         `yaml:"name"`
+	Description string         `yaml:"description"`
+	Timeout     string         `yaml:"timeout"`
+	Tor         *routerOptions `yaml:"tor"`
+	Config      string         `yaml:"config"`
+	Manifests   string         `yaml:"manifests"`
+	Expect      []expectation  `yaml:"expect"`
+
+	timeout time.Duration
+}
+
+// An expectation is one check made from the client VM. Exactly one
+// of its checks must be set.
+type expectation struct {
+	// The client's BGP router has a route for this prefix, through
+	// NextHops different nodes, or at least one if NextHops is 0.
+	BGPRoute string `yaml:"bgp-route"`
+	NextHops int    `yaml:"next-hops"`
+	// The client's BGP router has no route for this prefix.
+	NoBGPRoute string `yaml:"no-bgp-route"`
+	// All sessions between the client's BGP router and the nodes
+	// are "up", or all are "down".
+	BGPSessions string `yaml:"bgp-sessions"`
+	// Which of the client's BGP routers to check, "tor" if empty.
+	Router string `yaml:"router"`
+	// The client resolves this IP to a MAC address with ARP.
+	ARP string `yaml:"arp"`
+	// The client gets an HTTP response from this URL.
+	HTTP string `yaml:"http"`
+}
+
+func (e expectation) String() string {
+	switch {
+	case e.BGPRoute != "" && e.Router != "":
+		return e.Router + " bgp-route " + e.BGPRoute
+	case e.BGPRoute != "":
+		return "bgp-route " + e.BGPRoute
+	case e.NoBGPRoute != "" && e.Router != "":
+		return e.Router + " no-bgp-route " + e.NoBGPRoute
+	case e.NoBGPRoute != "":
+		return "no-bgp-route " + e.NoBGPRoute
+	case e.BGPSessions != "" && e.Router != "":
+		return e.Router + " bgp-sessions " + e.BGPSessions
+	case e.BGPSessions != "":
+		return "bgp-sessions " + e.BGPSessions
+	case e.ARP != "":
+		return "arp " + e.ARP
+	default:
+		return "http " + e.HTTP
+	}
+}
+
+// scenarioEnv is what scenario templates can refer to.
+type scenarioEnv struct {
+	// The client's address on net1, where its tor router peers
+	// with the cluster.
+	ClientIP string
+	// The client's address on net2, where its rr router peers with
+	// the cluster.
+	RRIP   string
+	client net.IP
+}
+
+// Net1 returns the address with last octet n in the client's /24 on
+// net1, for layer2 pools.
+func (e scenarioEnv) Net1(n int) string {
+	ip := make(net.IP, 4)
+	copy(ip, e.client.To4())
+	ip[3] = byte(n)
+	return ip.String()
+}
+
+// loadScenarios reads and checks all scenarios in dir, sorted by
+// name.
+func loadScenarios(dir string) ([]*scenario, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	var ret []*scenario
+	names := map[string]string{}
+	for _, f := range files {
+		bs, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		s := &scenario{timeout: 2 * time.Minute}
+		if err := yaml.UnmarshalStrict(bs, s); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", f, err)
+		}
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if other := names[s.Name]; other != "" {
+			return nil, fmt.Errorf("%s: scenario %q is also defined in %s", f, s.Name, other)
+		}
+		names[s.Name] = f
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+func (s *scenario) validate() error {
+	if s.Name == "" || strings.ContainsAny(s.Name, " /") {
+		return fmt.Errorf("scenario name %q must be non-empty, without spaces or slashes", s.Name)
+	}
+	if s.Config == "" {
+		return fmt.Errorf("scenario %q has no config", s.Name)
+	}
+	if len(s.Expect) == 0 {
+		return fmt.Errorf("scenario %q expects nothing", s.Name)
+	}
+	if s.Timeout != "" {
+		d, err := time.ParseDuration(s.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %q: %v", s.Timeout, err)
+		}
+		s.timeout = d
+	}
+	for i, e := range s.Expect {
+		n := 0
+		for _, set := range []bool{e.BGPRoute != "", e.NoBGPRoute != "", e.BGPSessions != "", e.ARP != "", e.HTTP != ""} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("expectation #%d must set exactly one of bgp-route, no-bgp-route, bgp-sessions, arp and http", i+1)
+		}
+		if e.BGPSessions != "" && e.BGPSessions != "up" && e.BGPSessions != "down" {
+			return fmt.Errorf("expectation #%d has bgp-sessions %q, must be up or down", i+1, e.BGPSessions)
+		}
+		if e.NextHops != 0 && e.BGPRoute == "" {
+			return fmt.Errorf("expectation #%d sets next-hops without bgp-route", i+1)
+		}
+		if e.Router != "" {
+			if e.BGPRoute == "" && e.NoBGPRoute == "" && e.BGPSessions == "" {
+				return fmt.Errorf("expectation #%d sets router without bgp-route, no-bgp-route or bgp-sessions", i+1)
+			}
+			known := false
+			for _, r := range routers {
+				known = known || r == e.Router
+			}
+			if !known {
+				return fmt.Errorf("expectation #%d has unknown router %q, must be one of %s", i+1, e.Router, strings.Join(routers, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// render expands the templates in s for env.
+func (s *scenario) render(env scenarioEnv) (*scenario, error) {
+	expand := func(in string) (string, error) {
+		tmpl, err := template.New(s.Name).Option("missingkey=error").Parse(in)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, env); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+
+	ret := *s
+	ret.Expect = nil
+	var err error
+	if ret.Config, err = expand(s.Config); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	if ret.Manifests, err = expand(s.Manifests); err != nil {
+		return nil, fmt.Errorf("manifests: %v", err)
+	}
+	for i, e := range s.Expect {
+		for _, f := range []*string{&e.BGPRoute, &e.NoBGPRoute, &e.ARP, &e.HTTP} {
+			if *f, err = expand(*f); err != nil {
+				return nil, fmt.Errorf("expectation #%d: %v", i+1, err)
+			}
+		}
+		ret.Expect = append(ret.Expect, e)
+	}
+	return &ret, nil
+}
+
+// run applies s to the universe, and waits for all its expectations
+// to hold.
+func (s *scenario) run(t *testing.T, u *vk.Universe) {
+	cluster := u.Cluster("cluster")
+	client := u.VM("client")
+	defer saveCapture(t, client, time.Now())
+
+	clientIP := net.ParseIP(fmt.Sprint(client.IPv4("net1")))
+	env := scenarioEnv{
+		ClientIP: clientIP.String(),
+		RRIP:     fmt.Sprint(client.IPv4("net2")),
+		client:   clientIP,
+	}
+	r, err := s.render(env)
+	if err != nil {
+		t.Fatalf("rendering scenario: %v", err)
+	}
+
+	if r.Tor != nil {
+		if err := reconfigureTor(client, cluster, r.Tor); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := reconfigureTor(client, cluster, nil); err != nil {
+				t.Errorf("restoring tor: %v", err)
+			}
+		}()
+	}
+
+	cm := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]string{
+			"namespace": "metallb-system",
+			"name":      "config",
+		},
+		"data": map[string]string{
+			"config": r.Config,
+		},
+	}
+	bs, err := yaml.Marshal(cm)
+	if err != nil {
+		t.Fatalf("encoding config: %v", err)
+	}
+	if err := cluster.ApplyManifest(bs); err != nil {
+		t.Fatalf("applying MetalLB configuration: %v", err)
+	}
+	if strings.TrimSpace(r.Manifests) != "" {
+		if err := cluster.ApplyManifest([]byte(r.Manifests)); err != nil {
+			t.Fatalf("applying manifests: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	for _, e := range r.Expect {
+		e := e
+		t.Run(e.String(), func(t *testing.T) {
+			waitFor(ctx, t, func() error { return e.check(client) })
+		})
+	}
+}
+
+// check returns nil if e holds on the client VM.
+func (e expectation) check(client *vk.VM) error {
+	switch {
+	case e.BGPRoute != "":
+		hops, err := bgpNextHops(client, e.Router, e.BGPRoute)
+		if err != nil {
+			return err
+		}
+		if len(hops) == 0 {
+			return fmt.Errorf("no route for %s", e.BGPRoute)
+		}
+		if e.NextHops != 0 && len(hops) != e.NextHops {
+			return fmt.Errorf("route for %s has next hops %s, want %d", e.BGPRoute, strings.Join(hops, ", "), e.NextHops)
+		}
+		return nil
+
+	case e.NoBGPRoute != "":
+		hops, err := bgpNextHops(client, e.Router, e.NoBGPRoute)
+		if err != nil {
+			return err
+		}
+		if len(hops) != 0 {
+			return fmt.Errorf("unexpected route for %s, via %s", e.NoBGPRoute, strings.Join(hops, ", "))
+		}
+		return nil
+
+	case e.BGPSessions != "":
+		states, err := bgpSessionStates(client, e.Router)
+		if err != nil {
+			return err
+		}
+		var wrong []string
+		for name, state := range states {
+			if (state == "up") != (e.BGPSessions == "up") {
+				wrong = append(wrong, name+" "+state)
+			}
+		}
+		if len(wrong) > 0 {
+			sort.Strings(wrong)
+			return fmt.Errorf("sessions not %s: %s", e.BGPSessions, strings.Join(wrong, ", "))
+		}
+		return nil
+
+	case e.ARP != "":
+		// The ping only triggers resolution, it's fine if the IP
+		// doesn't answer ICMP.
+		client.Run(fmt.Sprintf("ping -c 1 -W 1 %s", e.ARP))
+		bs, err := client.Run(fmt.Sprintf("ip neigh show %s", e.ARP))
+		if err != nil {
+			return fmt.Errorf("running ip neigh: %v", err)
+		}
+		// Sample output:
+		//   192.168.1.240 dev ens4 lladdr 52:54:00:12:34:56 REACHABLE
+		fs := strings.Fields(string(bs))
+		for i, f := range fs {
+			if f == "lladdr" && i+1 < len(fs) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s not resolved: %q", e.ARP, strings.TrimSpace(string(bs)))
+
+	default:
+		if _, err := client.Run(fmt.Sprintf("curl --silent --fail --max-time 2 %s", e.HTTP)); err != nil {
+			return fmt.Errorf("fetching %s: %v", e.HTTP, err)
+		}
+		return nil
+	}
+}
+
+// bgpNextHops returns the next hops of router's BGP routes for
+// prefix.
+func bgpNextHops(client *vk.VM, router, prefix string) ([]string, error) {
+	bs, err := client.Run(fmt.Sprintf("%s show route %s", birdc(router), prefix))
+	if err != nil {
+		return nil, fmt.Errorf("running birdc: %v", err)
+	}
+
+	// Sample birdc output, one line per path:
+	//   BIRD 1.6.3 ready.
+	//   10.249.0.1/32      via 192.168.1.3 on ens4 [node0 17:53:32] * (100) [i]
+	//                      via 192.168.1.4 on ens4 [node1 17:53:32] (100) [i]
+	var ret []string
+	for _, line := range strings.Split(string(bs), "\n") {
+		fs := strings.Fields(line)
+		for i, f := range fs {
+			if f == "via" && i+1 < len(fs) {
+				ret = append(ret, fs[i+1])
+			}
+		}
+	}
+	return ret, nil
+}
+
+// bgpSessionStates returns the state of router's BGP sessions with
+// the nodes, by session name.
+func bgpSessionStates(client *vk.VM, router string) (map[string]string, error) {
+	bs, err := client.Run(birdc(router) + " show protocols")
+	if err != nil {
+		return nil, fmt.Errorf("running birdc: %v", err)
+	}
+
+	// Sample birdc output, sessions between routers are named after
+	// the other router:
+	//   BIRD 1.6.3 ready.
+	//   name     proto    table    state  since       info
+	//   device1  Device   master   up     17:53:32
+	//   upstream BGP      master   up     17:53:35    Established
+	//   node0    BGP      master   start  17:53:32    Passive
+	ret := map[string]string{}
+	for _, line := range strings.Split(string(bs), "\n") {
+		fs := strings.Fields(line)
+		if len(fs) < 4 || fs[1] != "BGP" {
+			continue
+		}
+		known := false
+		for _, r := range routers {
+			known = known || r == fs[0]
+		}
+		if !known {
+			ret[fs[0]] = fs[3]
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no BGP sessions with nodes in %q", strings.TrimSpace(string(bs)))
+	}
+	return ret, nil
+}
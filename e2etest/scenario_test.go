@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	vk "go.universe.tf/virtuakube"
+)
+
+// TestScenarios runs every scenario in scenarios/, each in a fresh
+// universe.
+func TestScenarios(t *testing.T) {
+	scenarios, err := loadScenarios("scenarios")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range scenarios {
+		s := s
+		t.Run(s.Name, func(t *testing.T) {
+			testAll(t, func(t *testing.T, u *vk.Universe) { s.run(t, u) })
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -39,6 +40,23 @@ func init() {
 	mkUniverseCmd.Flags().StringSliceVar(&mkUniverseSteps, "steps", []string{}, "steps to forcibly regenerate")
 }
 
+// e2eArch returns the architecture of the images under test, which
+// must match the architecture of the test VMs. It defaults to the
+// architecture of the test binary, and can be overridden with
+// E2E_ARCH.
+func e2eArch() string {
+	if arch := os.Getenv("E2E_ARCH"); arch != "" {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
+// e2eImage returns the e2e tag of image for the architecture under
+// test.
+func e2eImage(image string) string {
+	return image + ":e2e-" + e2eArch()
+}
+
 func testAll(t *testing.T, f func(t *testing.T, u *vk.Universe)) {
 	for _, base := range []string{"calico", "flannel", "weave"} {
 		t.Run(base, func(t *testing.T) {
@@ -59,9 +77,9 @@ func testAll(t *testing.T, f func(t *testing.T, u *vk.Universe)) {
 			c := u.Cluster("cluster")
 
 			err = c.PushImages(
-				"metallb/controller:e2e-amd64",
-				"metallb/speaker:e2e-amd64",
-				"metallb/e2etest-mirror-server:e2e-amd64",
+				e2eImage("metallb/controller"),
+				e2eImage("metallb/speaker"),
+				e2eImage("metallb/e2etest-mirror-server"),
 			)
 			if err != nil {
 				t.Fatal(err)
@@ -72,8 +90,8 @@ func testAll(t *testing.T, f func(t *testing.T, u *vk.Universe)) {
 				t.Fatalf("reading metallb manifest: %v", err)
 			}
 			manifest := string(bs)
-			manifest = strings.Replace(manifest, "metallb/speaker:master", "metallb/speaker:e2e-amd64", -1)
-			manifest = strings.Replace(manifest, "metallb/controller:master", "metallb/controller:e2e-amd64", -1)
+			manifest = strings.Replace(manifest, "metallb/speaker:master", e2eImage("metallb/speaker"), -1)
+			manifest = strings.Replace(manifest, "metallb/controller:master", e2eImage("metallb/controller"), -1)
 			manifest = strings.Replace(manifest, "PullPolicy: Always", "PullPolicy: IfNotPresent", -1)
 			if err := c.ApplyManifest([]byte(manifest)); err != nil {
 				t.Fatalf("applying metallb manifest: %v", err)
@@ -173,7 +191,7 @@ func mkImage(u *vk.Universe) error {
 			vk.CustomizePreloadK8sImages,
 			func(v *vk.VM) error {
 				return v.RunMultiple(
-					"apt-get install bird",
+					"DEBIAN_FRONTEND=noninteractive apt-get install bird tcpdump wireshark-common",
 					"systemctl disable bird",
 					"systemctl disable bird6",
 				)
@@ -230,35 +248,10 @@ func mkCluster(u *vk.Universe) error {
 		return fmt.Errorf("starting client VM: %v", err)
 	}
 
-	var bird4, bird6 bytes.Buffer
-	fmt.Fprintf(&bird4, birdBaseCfg, client.IPv4("net1"))
-	fmt.Fprintf(&bird6, birdBaseCfg, client.IPv4("net1"))
-
-	fmt.Fprintf(&bird4, birdPeerCfg, "controller", cluster.Controller().IPv4("net1"))
-	fmt.Fprintf(&bird6, birdPeerCfg, "controller", cluster.Controller().IPv6("net1"))
-
-	for i, vm := range cluster.Nodes() {
-		fmt.Fprintf(&bird4, birdPeerCfg, "node"+strconv.Itoa(i), vm.IPv4("net1"))
-		fmt.Fprintf(&bird6, birdPeerCfg, "node"+strconv.Itoa(i), vm.IPv6("net1"))
-	}
-
-	if err := client.WriteFile("/etc/bird/bird.conf", bird4.Bytes()); err != nil {
+	if err := configureRouters(client, cluster); err != nil {
 		return err
 	}
-	if err := client.WriteFile("/etc/bird/bird6.conf", bird6.Bytes()); err != nil {
-		return err
-	}
-	err = client.RunMultiple(
-		"systemctl enable bird",
-		"systemctl enable bird6",
-		"systemctl restart bird",
-		"systemctl restart bird6",
-	)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return configureCapture(client)
 }
 
 func mkClusterNet(addon string) func(*vk.Universe) error {
@@ -364,7 +357,7 @@ func buildUniverse() error {
 		"make", "push-images",
 		"REGISTRY=localhost:"+strconv.Itoa(cluster.Controller().ForwardedPort(30000)),
 		"TAG=e2e",
-		"ARCH=amd64",
+		"ARCH="+e2eArch(),
 		"BINARIES=e2etest-mirror-server",
 	)
 	if err := cmd.Run(); err != nil {
@@ -372,7 +365,7 @@ func buildUniverse() error {
 	}
 
 	cmd = exec.Command("kubectl", "apply", "-f", "-")
-	cmd.Stdin = bytes.NewBufferString(mirrorServerManifest)
+	cmd.Stdin = bytes.NewBufferString(strings.Replace(mirrorServerManifest, "e2e-ARCH", "e2e-"+e2eArch(), -1))
 	cmd.Env = []string{"KUBECONFIG=" + cluster.Kubeconfig()}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -460,7 +453,7 @@ spec:
     spec:
       containers:
       - name: mirror
-        image: 127.0.0.1:30000/e2etest-mirror-server:e2e-amd64
+        image: 127.0.0.1:30000/e2etest-mirror-server:e2e-ARCH
         env:
         - name: NODE_NAME
           valueFrom:
@@ -1,19 +1,23 @@
 package allocator // import "go.universe.tf/metallb/internal/allocator"
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"math"
 	"net"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"go.universe.tf/metallb/internal/config"
 
 	"github.com/NetApp/nks-on-prem-ipam/pkg/ipam"
 	"github.com/go-kit/kit/log"
 	"github.com/mikioh/ipaddr"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
@@ -32,9 +36,43 @@ type Allocator struct {
 	servicesOnIP    map[string]map[string]bool // ip.String() -> svc -> allocated?
 	poolIPsInUse    map[string]map[string]int  // poolName -> ip.String() -> number of users
 	poolServices    map[string]int             // poolName -> #services
+	sharingGroups   map[string]map[string]int  // poolName -> sharing key -> #services
+
+	ipamLimits IPAMLimits
+	ipam       map[string]*ipamClient // poolName -> client
+	ipamUsage  map[string]*ipamUsage  // poolName -> usage in the IPAM
+	// poolName -> last fetch of the usage since the pools were set
+	ipamFetches map[string]*ipamFetch
+
+	strategy config.AutoAssignStrategy
+
+	// Set on copies made by Shadow.
+	shadow bool
 }
 
-// Port represents one port in use by a service.
+// ipamUsage is the usage of a pool according to its external IPAM.
+type ipamUsage struct {
+	capacity int64
+	reserved int64
+}
+
+// ipamFetch is the last attempt to fetch the usage of a pool from its
+// external IPAM, and how many attempts in a row failed.
+type ipamFetch struct {
+	at       time.Time
+	failures int
+}
+
+// Backoff of failed fetches of IPAM usage, which doubles with every
+// failure in a row.
+const (
+	ipamUsageRetry    = 10 * time.Second
+	ipamUsageMaxRetry = 5 * time.Minute
+)
+
+// Port represents one port in use by a service. Proto is "TCP",
+// "UDP" or "SCTP", in any case. Ports of different protocols don't
+// conflict, even with the same number.
 type Port struct {
 	Proto string
 	Port  int
@@ -45,9 +83,30 @@ func (p Port) String() string {
 	return fmt.Sprintf("%s/%d", p.Proto, p.Port)
 }
 
+// canonicalPorts returns ports with their protocols in upper case,
+// and TCP for ports without one, as Kubernetes defaults them.
+func canonicalPorts(ports []Port) ([]Port, error) {
+	ret := make([]Port, len(ports))
+	for i, p := range ports {
+		switch proto := strings.ToUpper(p.Proto); proto {
+		case "":
+			p.Proto = "TCP"
+		case "TCP", "UDP", "SCTP":
+			p.Proto = proto
+		default:
+			return nil, fmt.Errorf("unsupported protocol %q of port %d", p.Proto, p.Port)
+		}
+		ret[i] = p
+	}
+	return ret, nil
+}
+
 type key struct {
 	sharing string
 	backend string
+	// The protocol the service selects with
+	// config.ProtocolAnnotation, empty for all of its pool's.
+	protocol string
 }
 
 type alloc struct {
@@ -68,7 +127,35 @@ func New() *Allocator {
 		servicesOnIP:    map[string]map[string]bool{},
 		poolIPsInUse:    map[string]map[string]int{},
 		poolServices:    map[string]int{},
+		sharingGroups:   map[string]map[string]int{},
+
+		ipam:      map[string]*ipamClient{},
+		ipamUsage: map[string]*ipamUsage{},
+
+		ipamFetches: map[string]*ipamFetch{},
+	}
+}
+
+// SetIPAMLimits sets the bounds on calls to external IPAMs.
+func (a *Allocator) SetIPAMLimits(limits IPAMLimits) {
+	a.ipamLimits = limits
+	a.ipam = map[string]*ipamClient{}
+}
+
+// SetAutoAssignStrategy sets how Allocate chooses among the pools
+// with auto-assign.
+func (a *Allocator) SetAutoAssignStrategy(s config.AutoAssignStrategy) {
+	a.strategy = s
+}
+
+// ipamClient returns the client for the IPAM of poolName.
+func (a *Allocator) ipamClient(poolName string) *ipamClient {
+	c := a.ipam[poolName]
+	if c == nil {
+		c = newIPAMClient(poolName, a.ipamLimits)
+		a.ipam[poolName] = c
 	}
+	return c
 }
 
 // SetPools updates the set of address pools that the allocator owns.
@@ -78,7 +165,7 @@ func (a *Allocator) SetPools(pools map[string]*config.Pool) error {
 	// only question we have to answer is: can we fit all allocated
 	// IPs into address pools under the new configuration?
 	for svc, alloc := range a.allocated {
-		if poolFor(pools, alloc.ip) == "" {
+		if poolOwning(pools, alloc) == "" {
 			return fmt.Errorf("new config not compatible with assigned IPs: service %q cannot own %q under new config", svc, alloc.ip)
 		}
 	}
@@ -88,14 +175,37 @@ func (a *Allocator) SetPools(pools map[string]*config.Pool) error {
 			stats.poolCapacity.DeleteLabelValues(n)
 			stats.poolActive.DeleteLabelValues(n)
 			stats.poolAllocated.DeleteLabelValues(n)
+			stats.ipamReservations.DeleteLabelValues(n)
+			stats.ipamReserved.DeleteLabelValues(n)
+			stats.sharingGroups.DeleteLabelValues(n)
+			stats.sharingGroupsCollected.DeleteLabelValues(n)
+			delete(a.ipamUsage, n)
 		}
 	}
 
 	a.pools = pools
+	// The pools' IPAMs may have changed, so fetch their usage again.
+	a.ipamFetches = map[string]*ipamFetch{}
+	for n, p := range pools {
+		if p.Protocol != config.IPAM {
+			delete(a.ipamUsage, n)
+		}
+		stats.poolCapacity.WithLabelValues(n).Set(float64(a.poolCapacity(n)))
+	}
+
+	// The pools' IPAM agents may have changed, so listings from the
+	// old ones can't be reused.
+	for n, c := range a.ipam {
+		if pools[n] == nil {
+			delete(a.ipam, n)
+		} else {
+			c.invalidate()
+		}
+	}
 
 	// Need to rearrange existing pool mappings and counts
 	for svc, alloc := range a.allocated {
-		pool := poolFor(a.pools, alloc.ip)
+		pool := poolOwning(a.pools, alloc)
 		if pool != alloc.pool {
 			a.Unassign(svc)
 			alloc.pool = pool
@@ -105,12 +215,27 @@ func (a *Allocator) SetPools(pools map[string]*config.Pool) error {
 		}
 	}
 
+	// The loop above moved every allocation out of the removed
+	// pools, drop what's left of their bookkeeping.
+	for n := range a.poolIPsInUse {
+		if a.pools[n] == nil {
+			delete(a.poolIPsInUse, n)
+			delete(a.poolServices, n)
+			delete(a.sharingGroups, n)
+		}
+	}
+
 	return nil
 }
 
 // assign unconditionally updates internal state to reflect svc's
 // allocation of alloc. Caller must ensure that this call is safe.
 func (a *Allocator) assign(svc string, alloc *alloc) {
+	// Join the sharing group before leaving the previous one, so that
+	// reassigning svc to its IP doesn't collect the group.
+	if alloc.sharing != "" {
+		a.joinSharingGroup(alloc.pool, alloc.sharing)
+	}
 	a.Unassign(svc)
 	a.allocated[svc] = alloc
 	a.sharingKeyForIP[alloc.ip.String()] = &alloc.key
@@ -130,27 +255,115 @@ func (a *Allocator) assign(svc string, alloc *alloc) {
 	a.poolIPsInUse[alloc.pool][alloc.ip.String()]++
 	a.poolServices[alloc.pool]++
 
+	if a.shadow {
+		return
+	}
 	stats.poolActive.WithLabelValues(alloc.pool).Set(float64(len(a.poolIPsInUse[alloc.pool])))
 	stats.poolActive.WithLabelValues(alloc.pool).Set(float64(a.poolServices[alloc.pool]))
+	a.updateReservationStats(alloc.pool)
+}
+
+// updateReservationStats updates the count of IPAM reservations held
+// in pool, one per assigned IP.
+func (a *Allocator) updateReservationStats(pool string) {
+	if p := a.pools[pool]; a.shadow || p == nil || p.IPAM == nil {
+		return
+	}
+	stats.ipamReservations.WithLabelValues(pool).Set(float64(len(a.poolIPsInUse[pool])))
 }
 
 // Assign assigns the requested ip to svc, if the assignment is
-// permissible by sharingKey and backendKey.
-func (a *Allocator) Assign(svc string, ip net.IP, ports []Port, sharingKey, backendKey string) error {
-	pool := poolFor(a.pools, ip)
-	if pool == "" {
+// permissible by sharingKey, backendKey and protocol, the protocol
+// svc selects to be announced with, empty for all of the pool's.
+// The IP stays in the pool it is already assigned from, else it is
+// attributed to the pool poolFor finds.
+func (a *Allocator) Assign(svc string, ip net.IP, ports []Port, sharingKey, backendKey, protocol string) error {
+	return a.assignIn(svc, ip, a.assignedPool(svc, ip), ports, sharingKey, backendKey, protocol)
+}
+
+// AssignCurrent is Assign for the IP svc already has, e.g. in its
+// status when the controller starts. An IP in no static pool is
+// attributed to poolName if it's an IPAM pool, else to the only IPAM
+// pool, else to the IPAM pool that holds a reservation of it.
+func (a *Allocator) AssignCurrent(ctx context.Context, l log.Logger, svc string, ip net.IP, poolName string, ports []Port, sharingKey, backendKey, protocol string) error {
+	pool := a.assignedPool(svc, ip)
+	if pool == "" && staticPoolFor(a.pools, ip) == "" {
+		if p := a.pools[poolName]; p != nil && p.Protocol == config.IPAM {
+			pool = poolName
+		} else {
+			var err error
+			if pool, err = a.reservingPool(ctx, ip); err != nil {
+				return err
+			}
+		}
+	}
+	return a.assignIn(svc, ip, pool, ports, sharingKey, backendKey, protocol)
+}
+
+// reservingPool returns the IPAM pool with a reservation of ip, ""
+// if there is none or several of them.
+func (a *Allocator) reservingPool(ctx context.Context, ip net.IP) (string, error) {
+	var ret string
+	for n, p := range a.pools {
+		if p.Protocol != config.IPAM || p.Reserved(ip) {
+			continue
+		}
+		reservations, err := a.ipamClient(n).list(ctx, p.IPAM, reservationScope(p), false)
+		if err != nil {
+			return "", fmt.Errorf("unable to list reservations of pool %q, %v", n, err)
+		}
+		for _, res := range reservations {
+			if res.Address != ip.String() {
+				continue
+			}
+			if ret != "" {
+				return "", nil
+			}
+			ret = n
+			break
+		}
+	}
+	return ret, nil
+}
+
+// assignedPool returns the pool that ip is assigned from, to svc or
+// to the services sharing it, else the pool poolFor finds.
+func (a *Allocator) assignedPool(svc string, ip net.IP) string {
+	if al := a.allocated[svc]; al != nil && al.ip.Equal(ip) {
+		return al.pool
+	}
+	for other := range a.servicesOnIP[ip.String()] {
+		if al := a.allocated[other]; al != nil {
+			return al.pool
+		}
+	}
+	return poolFor(a.pools, ip)
+}
+
+// assignIn is Assign, attributing ip to pool.
+func (a *Allocator) assignIn(svc string, ip net.IP, pool string, ports []Port, sharingKey, backendKey, protocol string) error {
+	ports, err := canonicalPorts(ports)
+	if err != nil {
+		return err
+	}
+	if pool == "" || a.pools[pool] == nil {
 		return fmt.Errorf("%q is not allowed in config", ip)
 	}
 	sk := &key{
-		sharing: sharingKey,
-		backend: backendKey,
+		sharing:  sharingKey,
+		backend:  backendKey,
+		protocol: protocol,
 	}
 
 	// Does the IP already have allocs? If so, needs to be the same
 	// sharing key, and have non-overlapping ports. If not, the
 	// proposed IP needs to be allowed by configuration.
 	if existingSK := a.sharingKeyForIP[ip.String()]; existingSK != nil {
-		if err := sharingOK(existingSK, sk); err != nil {
+		err := sharingOK(existingSK, sk)
+		if err == nil {
+			err = protocolOK(a.pools[pool], existingSK, sk)
+		}
+		if err != nil {
 			// Sharing key is incompatible. However, if the owner is
 			// the same service, and is the only user of the IP, we
 			// can just update its sharing key in place.
@@ -180,17 +393,98 @@ func (a *Allocator) Assign(svc string, ip net.IP, ports []Port, sharingKey, back
 	alloc := &alloc{
 		pool:  pool,
 		ip:    ip,
-		ports: make([]Port, len(ports)),
+		ports: ports,
 		key:   *sk,
 	}
-	for i, port := range ports {
-		port := port
-		alloc.ports[i] = port
-	}
 	a.assign(svc, alloc)
 	return nil
 }
 
+// AssignRequested assigns the ip that svc requested to it. An ip in
+// none of the static pools is reserved in the external IPAM of
+// poolName, or of the only pool using one if poolName is empty, and
+// is only assigned if the IPAM confirms it. IPs already assigned to
+// other services share their reservation.
+func (a *Allocator) AssignRequested(ctx context.Context, l log.Logger, svc string, ip net.IP, poolName string, ports []Port, sharingKey, backendKey, protocol string) error {
+	if (a.allocated[svc] != nil && a.allocated[svc].ip.Equal(ip)) || a.servicesOnIP[ip.String()] != nil {
+		return a.Assign(svc, ip, ports, sharingKey, backendKey, protocol)
+	}
+	poolName, err := a.requestedPool(ip, poolName)
+	if err != nil {
+		return err
+	}
+	pool := a.pools[poolName]
+	if pool == nil || pool.Protocol != config.IPAM {
+		return a.Assign(svc, ip, ports, sharingKey, backendKey, protocol)
+	}
+	if ip.To4() == nil {
+		return fmt.Errorf("pool %q does not serve the service's ipFamily", poolName)
+	}
+	if a.shadow {
+		return &SimulatedIPAMError{Pool: poolName}
+	}
+	// Fail with the reason before reserving anything.
+	if _, err := canonicalPorts(ports); err != nil {
+		return err
+	}
+	metaData := reservationMetaData()
+	if pool.SharedIPAM && metaData[ipam.ClusterIDKey] == "" {
+		return fmt.Errorf("pool %q is shared with other clusters, but there is no cluster ID, set %s", poolName, clusterIDEnvVariable)
+	}
+
+	c := a.ipamClient(poolName)
+	reservationName := generateReservationName(svc)
+	resID, err := c.reserveAddress(ctx, l, pool.IPAM, reservationName, ip.String(), metaData)
+	if err != nil {
+		return fmt.Errorf("unable to reserve requested IP %s from pool %q, %w", ip, poolName, err)
+	}
+	l.Log("event", "ipReserved", "ip", ip, "id", reservationName, "networkType", ipam.NetworkType(poolName), "msg", "requested IP address reserved")
+
+	if err := a.assignIn(svc, ip, poolName, ports, sharingKey, backendKey, protocol); err != nil {
+		if relErr := c.release(ctx, pool.IPAM, []string{resID}); relErr != nil {
+			l.Log("op", "assignIP", "error", relErr, "id", resID, "msg", "failed to release unusable reservation")
+		}
+		return err
+	}
+	return nil
+}
+
+// requestedPool returns the name of the pool that a requested ip
+// comes from: the static pool containing it, else the IPAM pool
+// poolName, or the only IPAM pool. It returns "" if ip is in no pool.
+func (a *Allocator) requestedPool(ip net.IP, poolName string) (string, error) {
+	if poolName != "" {
+		pool := a.pools[poolName]
+		if pool == nil {
+			return "", fmt.Errorf("unknown pool %q", poolName)
+		}
+		if pool.Protocol == config.IPAM {
+			return poolName, nil
+		}
+	}
+	var ipamPools []string
+	for n, p := range a.pools {
+		if p.Protocol == config.IPAM {
+			ipamPools = append(ipamPools, n)
+			continue
+		}
+		for _, cidr := range p.CIDR {
+			if cidr.Contains(ip) {
+				return n, nil
+			}
+		}
+	}
+	switch len(ipamPools) {
+	case 0:
+		return "", nil
+	case 1:
+		return ipamPools[0], nil
+	default:
+		sort.Strings(ipamPools)
+		return "", fmt.Errorf("%q is in no static pool, and could be reserved from any of the IPAM pools %s, choose one with the address-pool annotation", ip, strings.Join(ipamPools, ", "))
+	}
+}
+
 // Unassign frees the IP associated with service, if any.
 func (a *Allocator) Unassign(svc string) bool {
 	if a.allocated[svc] == nil {
@@ -206,7 +500,10 @@ func (a *Allocator) Unassign(svc string) bool {
 		delete(a.portsInUse[al.ip.String()], port)
 	}
 	delete(a.servicesOnIP[al.ip.String()], svc)
-	if len(a.portsInUse[al.ip.String()]) == 0 {
+	// Holders without ports, like gateways, still constrain sharing
+	// of the IP, so it is only released with its last holder.
+	if len(a.servicesOnIP[al.ip.String()]) == 0 {
+		delete(a.servicesOnIP, al.ip.String())
 		delete(a.portsInUse, al.ip.String())
 		delete(a.sharingKeyForIP, al.ip.String())
 	}
@@ -217,9 +514,47 @@ func (a *Allocator) Unassign(svc string) bool {
 		delete(a.poolIPsInUse[al.pool], al.ip.String())
 	}
 	a.poolServices[al.pool]--
+	if al.sharing != "" {
+		a.leaveSharingGroup(al.pool, al.sharing)
+	}
+	a.updateReservationStats(al.pool)
 	return true
 }
 
+// joinSharingGroup counts a new member of the group of services
+// sharing IPs of pool with key.
+func (a *Allocator) joinSharingGroup(pool, key string) {
+	if a.sharingGroups[pool] == nil {
+		a.sharingGroups[pool] = map[string]int{}
+	}
+	a.sharingGroups[pool][key]++
+	a.updateSharingStats(pool)
+}
+
+// leaveSharingGroup removes a member from the group of services
+// sharing IPs of pool with key. Groups are deleted with their last
+// member, so that the keys of deleted services don't accumulate.
+func (a *Allocator) leaveSharingGroup(pool, key string) {
+	a.sharingGroups[pool][key]--
+	if a.sharingGroups[pool][key] == 0 {
+		delete(a.sharingGroups[pool], key)
+		if len(a.sharingGroups[pool]) == 0 {
+			delete(a.sharingGroups, pool)
+		}
+		if !a.shadow && a.pools[pool] != nil {
+			stats.sharingGroupsCollected.WithLabelValues(pool).Inc()
+		}
+	}
+	a.updateSharingStats(pool)
+}
+
+func (a *Allocator) updateSharingStats(pool string) {
+	if a.shadow || a.pools[pool] == nil {
+		return
+	}
+	stats.sharingGroups.WithLabelValues(pool).Set(float64(len(a.sharingGroups[pool])))
+}
+
 func cidrIsIPv6(cidr *net.IPNet) bool {
 	return cidr.IP.To4() == nil
 }
@@ -228,14 +563,14 @@ func ipIsIPv6(ip net.IP) bool {
 }
 
 // AllocateFromPool assigns an available IP from pool to service.
-func (a *Allocator) AllocateFromPool(l log.Logger, svc string, isIPv6 bool, poolName string, ports []Port, sharingKey, backendKey string) (net.IP, error) {
+func (a *Allocator) AllocateFromPool(ctx context.Context, l log.Logger, svc string, isIPv6 bool, poolName string, ports []Port, sharingKey, backendKey, protocol string) (net.IP, error) {
 	if alloc := a.allocated[svc]; alloc != nil {
 		// Handle the case where the svc has already been assigned an IP but from the wrong family.
 		// This "should-not-happen" since the "ipFamily" is an immutable field in services.
 		if isIPv6 != ipIsIPv6(alloc.ip) {
 			return nil, fmt.Errorf("IP for wrong family assigned %s", alloc.ip.String())
 		}
-		if err := a.Assign(svc, alloc.ip, ports, sharingKey, backendKey); err != nil {
+		if err := a.Assign(svc, alloc.ip, ports, sharingKey, backendKey, protocol); err != nil {
 			return nil, err
 		}
 		return alloc.ip, nil
@@ -245,13 +580,21 @@ func (a *Allocator) AllocateFromPool(l log.Logger, svc string, isIPv6 bool, pool
 	if pool == nil {
 		return nil, fmt.Errorf("unknown pool %q", poolName)
 	}
+	// Fail with the reason, rather than for lack of IPs below.
+	if _, err := canonicalPorts(ports); err != nil {
+		return nil, err
+	}
+	if !pool.ServesFamily(isIPv6) || (pool.Protocol == config.IPAM && isIPv6) {
+		// IPAM reservations are always IPv4.
+		return nil, fmt.Errorf("pool %q does not serve the service's ipFamily", poolName)
+	}
 
 	var ip net.IP
 	var err error
 	if pool.Protocol == config.IPAM {
-		ip, err = a.allocateFromDynamicPool(l, pool, isIPv6, svc, ports, sharingKey, backendKey, poolName)
+		ip, err = a.allocateFromDynamicPool(ctx, l, pool, isIPv6, svc, ports, sharingKey, backendKey, protocol, poolName)
 	} else {
-		ip, err = a.allocateFromStaticPool(pool, isIPv6, svc, ports, sharingKey, backendKey)
+		ip, err = a.allocateFromStaticPool(pool, poolName, isIPv6, svc, ports, sharingKey, backendKey, protocol)
 	}
 
 	if err != nil {
@@ -261,31 +604,84 @@ func (a *Allocator) AllocateFromPool(l log.Logger, svc string, isIPv6 bool, pool
 	return ip, nil
 }
 
-func (a *Allocator) allocateFromDynamicPool(l log.Logger, pool *config.Pool, isIPv6 bool, svc string, ports []Port, sharingKey string, backendKey string, poolName string) (net.IP, error) {
+func (a *Allocator) allocateFromDynamicPool(ctx context.Context, l log.Logger, pool *config.Pool, isIPv6 bool, svc string, ports []Port, sharingKey, backendKey, protocol, poolName string) (net.IP, error) {
+	// Services with a sharing key join an IP already reserved for
+	// compatible services, and hold its reservation with them, see
+	// UnAllocate.
+	if ip := a.sharedIP(poolName, svc, ports, sharingKey, backendKey, protocol); ip != nil {
+		l.Log("event", "ipShared", "ip", ip, "networkType", ipam.NetworkType(poolName), "msg", "IP address shared with other services")
+		return ip, nil
+	}
+	if a.shadow {
+		return nil, &SimulatedIPAMError{Pool: poolName}
+	}
 	metaData := reservationMetaData()
+	if pool.SharedIPAM && metaData[ipam.ClusterIDKey] == "" {
+		return nil, fmt.Errorf("pool %q is shared with other clusters, but there is no cluster ID, set %s", poolName, clusterIDEnvVariable)
+	}
 
 	reservationName := generateReservationName(svc)
 
-	res, err := pool.IPAM.ReserveIP(ipam.NetworkType(poolName), ipam.IPv4, reservationName, "", metaData)
+	c := a.ipamClient(poolName)
+	resID, resAddr, err := c.reserve(ctx, l, pool.IPAM, reservationName, "", metaData)
 	if err != nil {
 		return nil, fmt.Errorf("unable to reserve IP from pool %q, %w", poolName, err)
 	}
 
-	l.Log("event", "ipReserved", "ip", res.Address, "id", reservationName, "networkType", ipam.NetworkType(poolName), "msg", "IP address reserved")
+	l.Log("event", "ipReserved", "ip", resAddr, "id", reservationName, "networkType", ipam.NetworkType(poolName), "msg", "IP address reserved")
 
-	ip := net.ParseIP(res.Address)
+	ip := net.ParseIP(resAddr)
 	if ip == nil {
-		return nil, fmt.Errorf("unable to parse ip from reservation: %s (%s)", res.ID, res.Address)
+		return nil, fmt.Errorf("unable to parse ip from reservation: %s (%s)", resID, resAddr)
 	}
 
-	if err := a.Assign(svc, ip, ports, sharingKey, backendKey); err != nil {
+	if pool.SharedIPAM {
+		other, err := otherReservation(ctx, c, pool.IPAM, resAddr, resID)
+		if err == nil && other != "" {
+			err = fmt.Errorf("IP %s is also reserved by %q, possibly from another cluster", resAddr, other)
+		}
+		if err != nil {
+			if relErr := c.release(ctx, pool.IPAM, []string{resID}); relErr != nil {
+				l.Log("op", "allocateIP", "error", relErr, "id", resID, "msg", "failed to release conflicting reservation")
+			}
+			return nil, fmt.Errorf("unable to reserve IP from shared pool %q, %w", poolName, err)
+		}
+	}
+
+	if err := a.assignIn(svc, ip, poolName, ports, sharingKey, backendKey, protocol); err != nil {
+		// Don't leak the reservation of an IP we can't use.
+		if relErr := c.release(ctx, pool.IPAM, []string{resID}); relErr != nil {
+			l.Log("op", "allocateIP", "error", relErr, "id", resID, "msg", "failed to release unusable reservation")
+		}
 		return nil, fmt.Errorf("unable to assign ip: %s from dynamic pool: %s, %v", ip.String(), poolName, err)
 	}
 
 	return ip, nil
 }
 
-func (a *Allocator) allocateFromStaticPool(pool *config.Pool, isIPv6 bool, svc string, ports []Port, sharingKey string, backendKey string) (net.IP, error) {
+// sharedIP assigns to svc an IP of poolName that is already assigned
+// to services it can share it with, and returns it. It returns nil if
+// there is no such IP.
+func (a *Allocator) sharedIP(poolName, svc string, ports []Port, sharingKey, backendKey, protocol string) net.IP {
+	if sharingKey == "" {
+		return nil
+	}
+	// IPs are tried in order, so that allocations are predictable.
+	var ips []string
+	for ip := range a.poolIPsInUse[poolName] {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if err := a.assignIn(svc, ip, poolName, ports, sharingKey, backendKey, protocol); err == nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+func (a *Allocator) allocateFromStaticPool(pool *config.Pool, poolName string, isIPv6 bool, svc string, ports []Port, sharingKey, backendKey, protocol string) (net.IP, error) {
 	for _, cidr := range pool.CIDR {
 		if cidrIsIPv6(cidr) != isIPv6 {
 			// Not the right ip-family
@@ -294,12 +690,12 @@ func (a *Allocator) allocateFromStaticPool(pool *config.Pool, isIPv6 bool, svc s
 		c := ipaddr.NewCursor([]ipaddr.Prefix{*ipaddr.NewPrefix(cidr)})
 		for pos := c.First(); pos != nil; pos = c.Next() {
 			ip := pos.IP
-			if pool.AvoidBuggyIPs && ipConfusesBuggyFirmwares(ip) {
+			if pool.Reserved(ip) {
 				continue
 			}
 			// Somewhat inefficiently brute-force by invoking the
 			// IP-specific allocator.
-			if err := a.Assign(svc, ip, ports, sharingKey, backendKey); err == nil {
+			if err := a.assignIn(svc, ip, poolName, ports, sharingKey, backendKey, protocol); err == nil {
 				return ip, nil
 			}
 		}
@@ -309,28 +705,156 @@ func (a *Allocator) allocateFromStaticPool(pool *config.Pool, isIPv6 bool, svc s
 }
 
 // Allocate assigns any available and assignable IP to service.
-func (a *Allocator) Allocate(l log.Logger, svc string, isIPv6 bool, ports []Port, sharingKey, backendKey string) (net.IP, error) {
+func (a *Allocator) Allocate(ctx context.Context, l log.Logger, svc string, isIPv6 bool, ports []Port, sharingKey, backendKey, protocol string) (net.IP, error) {
+	return a.AllocateNear(ctx, l, svc, isIPv6, nil, ports, sharingKey, backendKey, protocol)
+}
+
+// AllocateNear is Allocate, but prefers the pools whose topology has
+// the zone of one of nodes, the labels of the nodes running the
+// service's endpoints, then the pools without a topology. Without
+// nodes, it's Allocate.
+func (a *Allocator) AllocateNear(ctx context.Context, l log.Logger, svc string, isIPv6 bool, nodes []labels.Set, ports []Port, sharingKey, backendKey, protocol string) (net.IP, error) {
 	if alloc := a.allocated[svc]; alloc != nil {
-		if err := a.Assign(svc, alloc.ip, ports, sharingKey, backendKey); err != nil {
+		if err := a.Assign(svc, alloc.ip, ports, sharingKey, backendKey, protocol); err != nil {
 			return nil, err
 		}
 		return alloc.ip, nil
 	}
+	if _, err := canonicalPorts(ports); err != nil {
+		return nil, err
+	}
 
-	for poolName := range a.pools {
+	for _, poolName := range a.poolOrder(isIPv6, nodes) {
 		if !a.pools[poolName].AutoAssign {
 			continue
 		}
-		if ip, err := a.AllocateFromPool(l, svc, isIPv6, poolName, ports, sharingKey, backendKey); err == nil {
+		ip, err := a.AllocateFromPool(ctx, l, svc, isIPv6, poolName, ports, sharingKey, backendKey, protocol)
+		if err == nil {
 			return ip, nil
 		}
+		var sim *SimulatedIPAMError
+		if errors.As(err, &sim) {
+			return nil, err
+		}
 	}
 
 	return nil, errors.New("no available IPs")
 }
 
+// AllocateFromSelector is AllocateNear, but tries the pools whose
+// labels match sel, whether they auto-assign or not.
+func (a *Allocator) AllocateFromSelector(ctx context.Context, l log.Logger, svc string, isIPv6 bool, sel labels.Selector, nodes []labels.Set, ports []Port, sharingKey, backendKey, protocol string) (net.IP, error) {
+	if alloc := a.allocated[svc]; alloc != nil {
+		if err := a.Assign(svc, alloc.ip, ports, sharingKey, backendKey, protocol); err != nil {
+			return nil, err
+		}
+		return alloc.ip, nil
+	}
+	if _, err := canonicalPorts(ports); err != nil {
+		return nil, err
+	}
+
+	matched := false
+	for _, poolName := range a.poolOrder(isIPv6, nodes) {
+		if !sel.Matches(a.pools[poolName].Labels) {
+			continue
+		}
+		matched = true
+		ip, err := a.AllocateFromPool(ctx, l, svc, isIPv6, poolName, ports, sharingKey, backendKey, protocol)
+		if err == nil {
+			return ip, nil
+		}
+		var sim *SimulatedIPAMError
+		if errors.As(err, &sim) {
+			return nil, err
+		}
+	}
+
+	if !matched {
+		return nil, fmt.Errorf("no pool matches selector %q", sel)
+	}
+	return nil, fmt.Errorf("no available IPs in the pools matching selector %q", sel)
+}
+
+// CandidatePool returns the pool that a service waiting for an IP
+// would get it from: the pool of the requested ip if not nil, else
+// poolName if not empty, else the first pool serving the family that
+// AllocateFromSelector would try if sel is not nil, or AllocateNear
+// otherwise. It returns "" if no pool qualifies.
+func (a *Allocator) CandidatePool(isIPv6 bool, ip net.IP, poolName string, sel labels.Selector, nodes []labels.Set) string {
+	if ip != nil {
+		pool, err := a.requestedPool(ip, poolName)
+		if err != nil {
+			return ""
+		}
+		return pool
+	}
+	if poolName != "" {
+		if a.pools[poolName] == nil {
+			return ""
+		}
+		return poolName
+	}
+	for _, poolName := range a.poolOrder(isIPv6, nodes) {
+		p := a.pools[poolName]
+		if sel != nil && !sel.Matches(p.Labels) || sel == nil && !p.AutoAssign {
+			continue
+		}
+		if p.ServesFamily(isIPv6) && !(p.Protocol == config.IPAM && isIPv6) {
+			return poolName
+		}
+	}
+	return ""
+}
+
+// poolOrder returns the names of all pools in the order AllocateNear
+// tries them.
+func (a *Allocator) poolOrder(isIPv6 bool, nodes []labels.Set) []string {
+	// Pools are tried in name order, or by free addresses then
+	// name, so that allocations are predictable, and can be
+	// simulated.
+	var names []string
+	for poolName := range a.pools {
+		names = append(names, poolName)
+	}
+	sort.Strings(names)
+	if a.strategy == config.BestFit {
+		free := make(map[string]int64, len(names))
+		for _, n := range names {
+			free[n] = a.poolFree(n, isIPv6)
+		}
+		sort.SliceStable(names, func(i, j int) bool {
+			return free[names[i]] < free[names[j]]
+		})
+	}
+	if len(nodes) > 0 {
+		rank := make(map[string]int, len(names))
+		for _, n := range names {
+			rank[n] = topologyRank(a.pools[n].Topology, nodes)
+		}
+		sort.SliceStable(names, func(i, j int) bool {
+			return rank[names[i]] < rank[names[j]]
+		})
+	}
+	return names
+}
+
+// topologyRank orders pools for AllocateNear: 0 if topology has the
+// zone of one of nodes, 1 without topology, 2 otherwise.
+func topologyRank(t *config.Topology, nodes []labels.Set) int {
+	if t == nil {
+		return 1
+	}
+	for _, n := range nodes {
+		if t.Matches(n) {
+			return 0
+		}
+	}
+	return 2
+}
+
 // UnAllocate releases IPs associated with a service if the pool being used is pointing to external IPAM
-func (a *Allocator) UnAllocate(l log.Logger, svc string) error {
+func (a *Allocator) UnAllocate(ctx context.Context, l log.Logger, svc string) error {
 	svcIP := a.IP(svc)
 	if svcIP == nil {
 		return nil
@@ -351,12 +875,19 @@ func (a *Allocator) UnAllocate(l log.Logger, svc string) error {
 		return nil
 	}
 
-	reservationID, err := getReservationID(pool.IPAM, ipam.NetworkType(poolName), svcIP.String())
+	// The reservation is released with the last holder of a shared
+	// IP.
+	if len(a.servicesOnIP[svcIP.String()]) > 1 {
+		return nil
+	}
+
+	c := a.ipamClient(poolName)
+	reservationID, err := getReservationID(ctx, c, pool.IPAM, svcIP.String(), reservationScope(pool))
 	if err != nil {
 		return fmt.Errorf("could not get reservation ID, %v", err)
 	}
 
-	if err := pool.IPAM.ReleaseIPs(ipam.NetworkType(poolName), []string{reservationID}); err != nil {
+	if err := c.release(ctx, pool.IPAM, []string{reservationID}); err != nil {
 		return fmt.Errorf("unable to release static IP: %s (%s) from pool: %s, %v", reservationID, svcIP.String(), poolName, err)
 	}
 
@@ -365,6 +896,88 @@ func (a *Allocator) UnAllocate(l log.Logger, svc string) error {
 	return nil
 }
 
+// EnsureReservation checks that the external IPAM still holds a
+// reservation for the IP assigned to svc, which may not be the case
+// if the cluster was restored from a backup. If adopt is true, a
+// missing reservation is recreated for the same IP.
+//
+// It returns false if the IP is not reserved for svc, in which case
+// the caller should unassign it and allocate a new one. Services in
+// pools that don't use an external IPAM are always reserved.
+func (a *Allocator) EnsureReservation(ctx context.Context, l log.Logger, svc string, adopt bool) (bool, error) {
+	ip := a.IP(svc)
+	if ip == nil {
+		return false, nil
+	}
+	// An IP of a static pool is never reserved in an IPAM, even if it
+	// got attributed to an IPAM pool.
+	poolName := staticPoolFor(a.pools, ip)
+	if poolName == "" {
+		poolName = a.Pool(svc)
+	}
+	pool := a.pools[poolName]
+	if pool == nil || pool.Protocol != config.IPAM {
+		return true, nil
+	}
+
+	c := a.ipamClient(poolName)
+	reservations, err := c.list(ctx, pool.IPAM, reservationScope(pool), false)
+	if err != nil {
+		return false, fmt.Errorf("unable to list reservations, %v", err)
+	}
+	for _, res := range reservations {
+		if res.Address == ip.String() {
+			return true, nil
+		}
+	}
+
+	l.Log("event", "staleIP", "ip", ip, "networkType", ipam.NetworkType(poolName), "msg", "service's IP is not reserved in IPAM")
+	if !adopt {
+		return false, nil
+	}
+	if pool.SharedIPAM {
+		// Our reservation is gone, and the IP may now belong to
+		// another cluster. Never take it from them.
+		other, err := otherReservation(ctx, c, pool.IPAM, ip.String(), "")
+		if err != nil {
+			return false, err
+		}
+		if other != "" {
+			l.Log("event", "adoptFailed", "ip", ip, "id", other, "msg", "service's IP is reserved by another cluster")
+			return false, nil
+		}
+	}
+
+	reservationName := generateReservationName(svc)
+	resID, resAddr, err := c.reserve(ctx, l, pool.IPAM, reservationName, ip.String(), reservationMetaData())
+	if err != nil {
+		return false, fmt.Errorf("unable to re-reserve IP %q from pool %q, %w", ip, poolName, err)
+	}
+	if resAddr != ip.String() {
+		// IPAM gave us a different address, most likely because ours
+		// now belongs to someone else. Give it back.
+		if err := c.release(ctx, pool.IPAM, []string{resID}); err != nil {
+			l.Log("op", "adoptIP", "error", err, "id", resID, "msg", "failed to release unwanted reservation")
+		}
+		l.Log("event", "adoptFailed", "ip", ip, "got", resAddr, "msg", "could not re-reserve service's IP in IPAM")
+		return false, nil
+	}
+
+	l.Log("event", "ipAdopted", "ip", ip, "id", resID, "networkType", ipam.NetworkType(poolName), "msg", "re-reserved service's IP in IPAM")
+	return true, nil
+}
+
+// ServicesOnIP returns the services that ip is assigned to, in
+// sorted order.
+func (a *Allocator) ServicesOnIP(ip net.IP) []string {
+	var ret []string
+	for svc := range a.servicesOnIP[ip.String()] {
+		ret = append(ret, svc)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 // IP returns the IP address allocated to service, or nil if none are allocated.
 func (a *Allocator) IP(svc string) net.IP {
 	if alloc := a.allocated[svc]; alloc != nil {
@@ -373,14 +986,209 @@ func (a *Allocator) IP(svc string) net.IP {
 	return nil
 }
 
+// Assignment describes the IP assigned to a service, and how the
+// service uses it.
+type Assignment struct {
+	IP         net.IP
+	Ports      []Port
+	SharingKey string
+	BackendKey string
+}
+
+// Assignments returns the current assignment of every service.
+func (a *Allocator) Assignments() map[string]Assignment {
+	ret := make(map[string]Assignment, len(a.allocated))
+	for svc, alloc := range a.allocated {
+		ret[svc] = Assignment{
+			IP:         alloc.ip,
+			Ports:      append([]Port(nil), alloc.ports...),
+			SharingKey: alloc.sharing,
+			BackendKey: alloc.backend,
+		}
+	}
+	return ret
+}
+
+// PoolUsage returns the number of addresses in pool, how many of
+// them are in use, and by how many services. For pools using an
+// external IPAM, the number of addresses is the IPAM's, as of the
+// last SetIPAMUsage.
+func (a *Allocator) PoolUsage(pool string) (addresses, inUse int64, services int) {
+	if a.pools[pool] == nil {
+		return 0, 0, 0
+	}
+	return a.poolCapacity(pool), int64(len(a.poolIPsInUse[pool])), a.poolServices[pool]
+}
+
+// IPAMUsage returns the number of addresses of pool in its external
+// IPAM, and how many of them are reserved by this cluster or others,
+// as of the last SetIPAMUsage. ok is false if that's unknown.
+func (a *Allocator) IPAMUsage(pool string) (addresses, reserved int64, ok bool) {
+	u := a.ipamUsage[pool]
+	if u == nil {
+		return 0, 0, false
+	}
+	return u.capacity, u.reserved, true
+}
+
+// IPAMUsageFetch fetches the usage of a pool from its external IPAM.
+// Unlike the allocator, it may be used from any goroutine, so that
+// slow IPAMs don't hold up allocations.
+type IPAMUsageFetch struct {
+	Pool   string
+	client *ipamClient
+	agent  ipam.Agent
+}
+
+// IPAMUsageResult is the outcome of an IPAMUsageFetch, to be recorded
+// with SetIPAMUsage.
+type IPAMUsageResult struct {
+	Pool               string
+	capacity, reserved int64
+	err                error
+}
+
+// Fetch asks the IPAM for the usage of the pool.
+func (f *IPAMUsageFetch) Fetch(ctx context.Context) IPAMUsageResult {
+	capacity, reserved, err := f.client.usage(ctx, f.agent)
+	return IPAMUsageResult{
+		Pool:     f.Pool,
+		capacity: capacity,
+		reserved: reserved,
+		err:      err,
+	}
+}
+
+// DueIPAMUsage returns the fetches of the usage of the pools using an
+// external IPAM that was not fetched since the pools were set, or
+// longer than maxAge ago if maxAge is positive. Pools whose last
+// fetch failed are retried with an exponential backoff instead. The
+// fetches are recorded as attempted at now.
+func (a *Allocator) DueIPAMUsage(now time.Time, maxAge time.Duration) []*IPAMUsageFetch {
+	var ret []*IPAMUsageFetch
+	for n, p := range a.pools {
+		if p.Protocol != config.IPAM || p.IPAM == nil {
+			continue
+		}
+		f := a.ipamFetches[n]
+		switch {
+		case f == nil:
+			f = &ipamFetch{}
+			a.ipamFetches[n] = f
+		case f.failures > 0:
+			if now.Sub(f.at) < ipamUsageBackoff(f.failures) {
+				continue
+			}
+		case maxAge <= 0 || now.Sub(f.at) < maxAge:
+			continue
+		}
+		f.at = now
+		ret = append(ret, &IPAMUsageFetch{
+			Pool:   n,
+			client: a.ipamClient(n),
+			agent:  p.IPAM,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Pool < ret[j].Pool })
+	return ret
+}
+
+// ipamUsageBackoff returns how long to wait before fetching the usage
+// of a pool again after failures in a row.
+func ipamUsageBackoff(failures int) time.Duration {
+	ret := ipamUsageRetry
+	for i := 1; i < failures && ret < ipamUsageMaxRetry; i++ {
+		ret *= 2
+	}
+	if ret > ipamUsageMaxRetry {
+		ret = ipamUsageMaxRetry
+	}
+	return ret
+}
+
+// SetIPAMUsage records the usage fetched by fetches returned by
+// DueIPAMUsage. Pools whose usage couldn't be fetched keep their last
+// known usage, and are retried later.
+func (a *Allocator) SetIPAMUsage(l log.Logger, results []IPAMUsageResult) {
+	for _, r := range results {
+		f := a.ipamFetches[r.Pool]
+		if f == nil {
+			// The pools were set since, the result may be about
+			// another IPAM.
+			continue
+		}
+		if r.err != nil {
+			f.failures++
+			l.Log("op", "ipamUsage", "pool", r.Pool, "error", r.err, "retryIn", ipamUsageBackoff(f.failures), "msg", "failed to fetch pool usage from IPAM")
+			continue
+		}
+		f.failures = 0
+		a.ipamUsage[r.Pool] = &ipamUsage{
+			capacity: r.capacity,
+			reserved: r.reserved,
+		}
+		stats.poolCapacity.WithLabelValues(r.Pool).Set(float64(r.capacity))
+		stats.ipamReserved.WithLabelValues(r.Pool).Set(float64(r.reserved))
+	}
+}
+
+// SharingGroups returns the number of sharing keys in use by the
+// services with IPs of pool.
+func (a *Allocator) SharingGroups(pool string) int {
+	return len(a.sharingGroups[pool])
+}
+
+// poolFree returns the number of free addresses of the family
+// isIPv6 in pool. The addresses of pools using an external IPAM are
+// counted in the IPAM, regardless of family. Pools whose free
+// addresses are unknown count as having plenty.
+func (a *Allocator) poolFree(pool string, isIPv6 bool) int64 {
+	p := a.pools[pool]
+	if p.Protocol == config.IPAM {
+		if u := a.ipamUsage[pool]; u != nil {
+			return u.capacity - u.reserved
+		}
+		return math.MaxInt64
+	}
+
+	family := *p
+	family.CIDR = nil
+	for _, cidr := range p.CIDR {
+		if cidrIsIPv6(cidr) == isIPv6 {
+			family.CIDR = append(family.CIDR, cidr)
+		}
+	}
+	family.ReservedIPs = nil
+	for _, ip := range p.ReservedIPs {
+		if ipIsIPv6(ip) == isIPv6 {
+			family.ReservedIPs = append(family.ReservedIPs, ip)
+		}
+	}
+	free := poolCount(&family)
+	for ip := range a.poolIPsInUse[pool] {
+		if ipIsIPv6(net.ParseIP(ip)) == isIPv6 {
+			free--
+		}
+	}
+	return free
+}
+
+// poolCapacity returns the number of addresses in pool, according to
+// its external IPAM if it has one and its usage is known.
+func (a *Allocator) poolCapacity(pool string) int64 {
+	if u := a.ipamUsage[pool]; u != nil {
+		return u.capacity
+	}
+	return poolCount(a.pools[pool])
+}
+
 // Pool returns the pool from which service's IP was allocated. If
 // service has no IP allocated, "" is returned.
 func (a *Allocator) Pool(svc string) string {
-	ip := a.IP(svc)
-	if ip == nil {
-		return ""
+	if alloc := a.allocated[svc]; alloc != nil {
+		return alloc.pool
 	}
-	return poolFor(a.pools, ip)
+	return ""
 }
 
 func sharingOK(existing, new *key) error {
@@ -399,6 +1207,35 @@ func sharingOK(existing, new *key) error {
 	return nil
 }
 
+// protocolOK returns an error unless services with the existing and
+// new keys are announced from pool with the same protocols, so that
+// an IP isn't announced with layer2 from one node and BGP from others.
+func protocolOK(pool *config.Pool, existing, new *key) error {
+	if existing.protocol == new.protocol {
+		return nil
+	}
+	protos := func(k *key) []config.Proto {
+		if k.protocol == "" {
+			return pool.AnnounceProtocols()
+		}
+		// Speakers announce with all of the pool's protocols if
+		// the selection is invalid.
+		ret, _ := pool.ServiceProtocols(map[string]string{config.ProtocolAnnotation: k.protocol})
+		return ret
+	}
+	a, b := protos(existing), protos(new)
+	if len(a) == len(b) {
+		same := true
+		for i := range a {
+			same = same && a[i] == b[i]
+		}
+		if same {
+			return nil
+		}
+	}
+	return fmt.Errorf("announce protocol %q does not match existing announce protocol %q", new.protocol, existing.protocol)
+}
+
 // poolCount returns the number of addresses in the pool.
 func poolCount(p *config.Pool) int64 {
 	var total int64
@@ -415,7 +1252,7 @@ func poolCount(p *config.Pool) int64 {
 		firstIP := cur.First().IP
 		lastIP := cur.Last().IP
 
-		if p.AvoidBuggyIPs {
+		if p.ReservedHostSuffixes == config.ReserveEvery24 {
 			if o <= 24 {
 				// A pair of buggy IPs occur for each /24 present in the range.
 				buggies := int64(math.Pow(2, float64(24-o))) * 2
@@ -434,20 +1271,46 @@ func poolCount(p *config.Pool) int64 {
 		}
 		total += sz
 	}
+	for _, ip := range p.ReservedIPs {
+		// Don't count addresses the /24 math above already did.
+		if p.ReservedHostSuffixes == config.ReserveEvery24 && ipConfusesBuggyFirmwares(ip) {
+			continue
+		}
+		total--
+	}
 	return total
 }
 
 // poolFor returns the pool that owns the requested IP, or "" if none.
 func poolFor(pools map[string]*config.Pool, ip net.IP) string {
+	if pool := staticPoolFor(pools, ip); pool != "" {
+		return pool
+	}
+	// IPAM pools can hand out any IP, so only attribute ip to one if
+	// there is no other.
+	ret := ""
 	for pname, p := range pools {
-		if p.AvoidBuggyIPs && ipConfusesBuggyFirmwares(ip) {
+		if p.Protocol != config.IPAM {
 			continue
 		}
-
-		if p.Protocol == config.IPAM {
-			return pname
+		if ret != "" {
+			return ""
 		}
+		ret = pname
+	}
+	if ret != "" && pools[ret].Reserved(ip) {
+		return ""
+	}
+	return ret
+}
 
+// staticPoolFor returns the name of the static pool whose CIDRs
+// contain ip, "" if there is none. Static pools don't overlap.
+func staticPoolFor(pools map[string]*config.Pool, ip net.IP) string {
+	for pname, p := range pools {
+		if p.Protocol == config.IPAM || p.Reserved(ip) {
+			continue
+		}
 		for _, cidr := range p.CIDR {
 			if cidr.Contains(ip) {
 				return pname
@@ -457,6 +1320,16 @@ func poolFor(pools map[string]*config.Pool, ip net.IP) string {
 	return ""
 }
 
+// poolOwning returns the pool of pools that al's IP belongs to:
+// the IPAM pool it was assigned from, if that still exists and no
+// static pool has the IP, else the pool poolFor finds.
+func poolOwning(pools map[string]*config.Pool, al *alloc) string {
+	if p := pools[al.pool]; p != nil && p.Protocol == config.IPAM && !p.Reserved(al.ip) && staticPoolFor(pools, al.ip) == "" {
+		return al.pool
+	}
+	return poolFor(pools, al.ip)
+}
+
 func portsEqual(a, b []Port) bool {
 	if len(a) != len(b) {
 		return false
@@ -508,9 +1381,54 @@ func clusterInfo() (string, string, string) {
 	workspaceID := os.Getenv(workspaceIDEnvVariable)
 	instanceID := os.Getenv(instanceIDEnvVariable)
 	clusterID := os.Getenv(clusterIDEnvVariable)
+	if clusterID == "" {
+		clusterID = derivedClusterID
+	}
 	return workspaceID, instanceID, clusterID
 }
 
+// derivedClusterID is the cluster ID used when CLUSTER_ID is not set,
+// see InitClusterID.
+var derivedClusterID string
+
+// maxClusterIDLength is the longest cluster ID the IPAM stores in
+// reservation metadata.
+const maxClusterIDLength = 63
+
+// InitClusterID sets the cluster ID derived from the cluster, e.g. the
+// UID of its kube-system namespace, to use when the CLUSTER_ID
+// environment variable doesn't override it. It returns the effective
+// cluster ID, after checking that the IPAM accepts it.
+func InitClusterID(derived string) (string, error) {
+	derivedClusterID = derived
+	_, _, id := clusterInfo()
+	if err := validateClusterID(id); err != nil {
+		return "", err
+	}
+	stats.clusterID.Reset()
+	if id != "" {
+		stats.clusterID.WithLabelValues(id).Set(1)
+	}
+	return id, nil
+}
+
+// validateClusterID checks that id only has the characters that the
+// IPAM allows in reservation metadata. Empty IDs are valid, pools
+// shared with other clusters refuse to allocate without one.
+func validateClusterID(id string) error {
+	if len(id) > maxClusterIDLength {
+		return fmt.Errorf("cluster ID %q is longer than %d characters", id, maxClusterIDLength)
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("cluster ID %q has invalid character %q, only letters, digits, '-', '_' and '.' are allowed", id, r)
+		}
+	}
+	return nil
+}
+
 func generateReservationName(svc string) string {
 	// The svc name here is {namespace}/{serviceName}, e.g. young-pear/cerulean-heart-jenkins
 	// Let's add the instance ID to make sure its unique
@@ -518,23 +1436,30 @@ func generateReservationName(svc string) string {
 	return fmt.Sprintf("%s-%s", instanceID, svc)
 }
 
-func getReservationID(agent ipam.Agent, networkType ipam.NetworkType, ip string) (string, error) {
+func getReservationID(ctx context.Context, c *ipamClient, agent ipam.Agent, ip string, searchMetaData map[string]string) (string, error) {
 
 	// We need to release the IP address by reservation name.
 	// Let's just look it up instead of baking it into metallb's state.
 
-	reservations, err := agent.ListIPReservations(networkType, reservationSearchMetaData())
-	if err != nil {
-		return "", fmt.Errorf("unable to list reservations, %v", err)
-	}
+	// A reused listing may predate the reservation, e.g. if it was
+	// adopted by another controller, so look again before giving up.
+	for _, fresh := range []bool{false, true} {
+		if fresh && c.limits.BatchWindow == 0 {
+			break
+		}
+		reservations, err := c.list(ctx, agent, searchMetaData, fresh)
+		if err != nil {
+			return "", fmt.Errorf("unable to list reservations, %v", err)
+		}
 
-	for _, res := range reservations {
-		if res.Address == ip {
-			return res.ID, nil
+		for _, res := range reservations {
+			if res.Address == ip {
+				return res.ID, nil
+			}
 		}
 	}
 
-	return "", fmt.Errorf("unable to find reservation for ip %s on network type %s", ip, networkType)
+	return "", fmt.Errorf("unable to find reservation for ip %s on network type %s", ip, c.pool)
 }
 
 func reservationSearchMetaData() map[string]string {
@@ -542,3 +1467,33 @@ func reservationSearchMetaData() map[string]string {
 		ipam.IPReservationTypeKey: ipam.IPReservationTypeLoadbalancer,
 	}
 }
+
+// reservationScope returns the metadata that selects this cluster's
+// reservations in pool. In pools shared with other clusters, this
+// must include the cluster ID, so that we never find, and then
+// release, another cluster's reservation of the same IP.
+func reservationScope(pool *config.Pool) map[string]string {
+	ret := reservationSearchMetaData()
+	if pool.SharedIPAM {
+		_, _, clusterID := clusterInfo()
+		ret[ipam.ClusterIDKey] = clusterID
+	}
+	return ret
+}
+
+// otherReservation returns the ID of a load balancer reservation of
+// ip other than ours, from any cluster, or "" if there is none.
+func otherReservation(ctx context.Context, c *ipamClient, agent ipam.Agent, ip, ours string) (string, error) {
+	// Other clusters' reservations are not reflected in reused
+	// listings, so always ask.
+	reservations, err := c.list(ctx, agent, reservationSearchMetaData(), true)
+	if err != nil {
+		return "", fmt.Errorf("unable to list reservations, %v", err)
+	}
+	for _, res := range reservations {
+		if res.Address == ip && res.ID != ours {
+			return res.ID, nil
+		}
+	}
+	return "", nil
+}
@@ -1,18 +1,23 @@
 package allocator
 
 import (
+	"context"
 	"errors"
 	"math"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/NetApp/nks-on-prem-ipam/pkg/ipam"
 	"github.com/NetApp/nks-on-prem-ipam/pkg/ipam/fake"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"go.universe.tf/metallb/internal/config"
 	"go.universe.tf/metallb/internal/logging"
@@ -29,8 +34,8 @@ func TestAssignment(t *testing.T) {
 			},
 		},
 		"test2": {
-			AvoidBuggyIPs: true,
-			AutoAssign:    true,
+			ReservedHostSuffixes: config.ReserveEvery24,
+			AutoAssign:           true,
 			CIDR: []*net.IPNet{
 				ipnet("1.2.4.0/24"),
 				ipnet("1000::4:0/120"),
@@ -167,6 +172,37 @@ func TestAssignment(t *testing.T) {
 			sharingKey: "share",
 			backendKey: "backend",
 		},
+		{
+			desc:       "s5 shares the IP with an SCTP port of the same number as s4's",
+			svc:        "s5",
+			ip:         "1.2.4.3",
+			ports:      ports("sctp/80"),
+			sharingKey: "share",
+			backendKey: "backend",
+		},
+		{
+			desc:       "s6 can't share with s5 (port conflict, regardless of case)",
+			svc:        "s6",
+			ip:         "1.2.4.3",
+			ports:      ports("SCTP/80"),
+			sharingKey: "share",
+			backendKey: "backend",
+			wantErr:    true,
+		},
+		{
+			desc:       "s6 can't use an unsupported protocol",
+			svc:        "s6",
+			ip:         "1.2.4.3",
+			ports:      ports("quic/443"),
+			sharingKey: "share",
+			backendKey: "backend",
+			wantErr:    true,
+		},
+		{
+			desc: "s5 frees its IP",
+			svc:  "s5",
+			ip:   "",
+		},
 		{
 			desc:       "s3 can't change its sharing key while keeping the same IP",
 			svc:        "s3",
@@ -336,7 +372,7 @@ func TestAssignment(t *testing.T) {
 				t.Fatalf("invalid IP %q in test %q", test.ip, test.desc)
 			}
 			alreadyHasIP := assigned(alloc, test.svc) == test.ip
-			err := alloc.Assign(test.svc, ip, test.ports, test.sharingKey, test.backendKey)
+			err := alloc.Assign(test.svc, ip, test.ports, test.sharingKey, test.backendKey, "")
 			if test.wantErr {
 				assert.Errorf(tt, err, "%q should have caused an error, but did not", test.desc)
 
@@ -591,7 +627,7 @@ func TestPoolAllocation(t *testing.T) {
 				return
 			}
 
-			ip, err := alloc.AllocateFromPool(l, test.svc, test.isIPv6, "test", test.ports, test.sharingKey, "")
+			ip, err := alloc.AllocateFromPool(context.Background(), l, test.svc, test.isIPv6, "test", test.ports, test.sharingKey, "", "")
 			if test.wantErr {
 				assert.Errorf(tt, err, "%s: should have caused an error, but did not", test.desc)
 				return
@@ -609,7 +645,7 @@ func TestPoolAllocation(t *testing.T) {
 	}
 
 	alloc.Unassign("s5")
-	_, err = alloc.AllocateFromPool(l, "s5", false, "nonexistentpool", nil, "", "")
+	_, err = alloc.AllocateFromPool(context.Background(), l, "s5", false, "nonexistentpool", nil, "", "", "")
 	assert.Errorf(t, err, "Allocating from non-existent pool succeeded")
 }
 
@@ -799,7 +835,7 @@ func TestAllocation(t *testing.T) {
 			alloc.Unassign(test.svc)
 			continue
 		}
-		ip, err := alloc.Allocate(l, test.svc, test.isIPv6, test.ports, test.sharingKey, "")
+		ip, err := alloc.Allocate(context.Background(), l, test.svc, test.isIPv6, test.ports, test.sharingKey, "", "")
 		if test.wantErr {
 			if err == nil {
 				t.Errorf("%s: should have caused an error, but did not", test.desc)
@@ -878,7 +914,7 @@ func TestDynamicAllocation(t *testing.T) {
 			fake.SetState(state)
 			alloc.pools["test"].IPAM = fake.GetFakeIPAMAgent()
 
-			ip, err := alloc.Allocate(l, test.svc, false, []Port{}, "", "")
+			ip, err := alloc.Allocate(context.Background(), l, test.svc, false, []Port{}, "", "", "")
 			if test.wantErr {
 				assert.Error(tt, err)
 				return
@@ -890,6 +926,376 @@ func TestDynamicAllocation(t *testing.T) {
 	}
 }
 
+func TestDynamicAllocationSharing(t *testing.T) {
+	l, err := logging.Init()
+	assert.NoError(t, err)
+
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"test": {
+			AutoAssign: true,
+			Protocol:   config.IPAM,
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	// reserveNext makes the IPAM reserve addr for the next service.
+	reserveNext := func(id, addr string) {
+		state := &fake.State{}
+		state.ReservationToReturn = ipam.IPAddressReservation{ID: id, Address: addr}
+		state.ReservationsToReturn = []ipam.IPAddressReservation{{ID: "id1", Address: "1.2.3.4"}}
+		fake.SetState(state)
+		alloc.pools["test"].IPAM = fake.GetFakeIPAMAgent()
+	}
+	reserveNext("id1", "1.2.3.4")
+
+	calls := func(op string) float64 {
+		return testutil.ToFloat64(stats.ipamCalls.WithLabelValues("test", op, "success"))
+	}
+	reserves := calls("ReserveIP")
+
+	ip, err := alloc.Allocate(context.Background(), l, "s1", false, []Port{{"TCP", 80}}, "share", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", ip.String())
+	assert.Equal(t, reserves+1, calls("ReserveIP"))
+
+	// A compatible service joins the reservation.
+	ip, err = alloc.Allocate(context.Background(), l, "s2", false, []Port{{"TCP", 443}}, "share", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", ip.String())
+	assert.Equal(t, reserves+1, calls("ReserveIP"), "shared IP reserved again")
+
+	// Services with another sharing key, or conflicting ports, get
+	// their own reservation.
+	reserveNext("id2", "1.2.3.5")
+	ip, err = alloc.Allocate(context.Background(), l, "s3", false, []Port{{"TCP", 80}}, "share", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.5", ip.String())
+	reserveNext("id3", "1.2.3.6")
+	ip, err = alloc.Allocate(context.Background(), l, "s4", false, []Port{{"TCP", 8080}}, "other", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.6", ip.String())
+
+	// The reservation is released with its last holder.
+	releases := calls("ReleaseIPs")
+	require.NoError(t, alloc.UnAllocate(context.Background(), l, "s1"))
+	alloc.Unassign("s1")
+	assert.Equal(t, releases, calls("ReleaseIPs"), "shared reservation released while in use")
+	require.NoError(t, alloc.UnAllocate(context.Background(), l, "s2"))
+	alloc.Unassign("s2")
+	assert.Equal(t, releases+1, calls("ReleaseIPs"))
+}
+
+func TestAssignRequested(t *testing.T) {
+	l, err := logging.Init()
+	assert.NoError(t, err)
+
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"static": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("10.0.0.0/24")},
+		},
+		"test": {
+			AutoAssign: true,
+			Protocol:   config.IPAM,
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	reserveNext := func(addr string) {
+		state := &fake.State{}
+		state.ReservationToReturn = ipam.IPAddressReservation{ID: "id-" + addr, Address: addr}
+		fake.SetState(state)
+		alloc.pools["test"].IPAM = fake.GetFakeIPAMAgent()
+	}
+	calls := func(op string) float64 {
+		return testutil.ToFloat64(stats.ipamCalls.WithLabelValues("test", op, "success"))
+	}
+	reserves, releases := calls("ReserveIP"), calls("ReleaseIPs")
+
+	// IPs of static pools are assigned without asking the IPAM.
+	require.NoError(t, alloc.AssignRequested(context.Background(), l, "s1", net.ParseIP("10.0.0.1"), "", []Port{}, "", "", ""))
+	assert.Equal(t, "static", alloc.Pool("s1"))
+	assert.Equal(t, reserves, calls("ReserveIP"))
+
+	// Other IPs are assigned once the IPAM confirms them.
+	reserveNext("1.2.3.4")
+	require.NoError(t, alloc.AssignRequested(context.Background(), l, "s2", net.ParseIP("1.2.3.4"), "", []Port{}, "share", "", ""))
+	assert.Equal(t, "1.2.3.4", alloc.IP("s2").String())
+	assert.Equal(t, reserves+1, calls("ReserveIP"))
+
+	// Requesting an IP already assigned shares its reservation.
+	require.NoError(t, alloc.AssignRequested(context.Background(), l, "s3", net.ParseIP("1.2.3.4"), "", []Port{{"UDP", 53}}, "share", "", ""))
+	assert.Equal(t, reserves+1, calls("ReserveIP"))
+
+	// If the IPAM reserves another IP, e.g. because the requested one
+	// is taken, that reservation is given back.
+	reserveNext("1.2.3.5")
+	assert.Error(t, alloc.AssignRequested(context.Background(), l, "s4", net.ParseIP("1.2.3.6"), "test", []Port{}, "", "", ""))
+	assert.Nil(t, alloc.IP("s4"))
+	assert.Equal(t, releases+1, calls("ReleaseIPs"))
+
+	// With several IPAM pools, the service must choose.
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"static": alloc.pools["static"],
+		"test":   alloc.pools["test"],
+		"test2":  {Protocol: config.IPAM},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	assert.Error(t, alloc.AssignRequested(context.Background(), l, "s5", net.ParseIP("1.2.3.7"), "", []Port{}, "", "", ""))
+	reserveNext("1.2.3.7")
+	require.NoError(t, alloc.AssignRequested(context.Background(), l, "s5", net.ParseIP("1.2.3.7"), "test", []Port{}, "", "", ""))
+}
+
+// listAgent is an IPAM agent whose reservations are res.
+type listAgent struct {
+	ipam.Agent
+	res []ipam.IPAddressReservation
+}
+
+func (a *listAgent) ListIPReservations(nt ipam.NetworkType, metaData map[string]string) ([]ipam.IPAddressReservation, error) {
+	return a.res, nil
+}
+
+func TestPoolAttribution(t *testing.T) {
+	l, err := logging.Init()
+	assert.NoError(t, err)
+
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"static": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("10.0.0.0/24")},
+		},
+		"a": {Protocol: config.IPAM},
+		"b": {Protocol: config.IPAM},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	reserveNext := func(pool, addr string) {
+		state := &fake.State{}
+		state.ReservationToReturn = ipam.IPAddressReservation{ID: "id-" + addr, Address: addr}
+		fake.SetState(state)
+		alloc.pools[pool].IPAM = fake.GetFakeIPAMAgent()
+	}
+
+	// IPs of the static pool belong to it, whatever the IPAM pools.
+	require.NoError(t, alloc.Assign("s1", net.ParseIP("10.0.0.1"), []Port{}, "", "", ""))
+	assert.Equal(t, "static", alloc.Pool("s1"))
+
+	// IPAM IPs stay in the pool that reserved them.
+	reserveNext("b", "1.2.3.4")
+	require.NoError(t, alloc.AssignRequested(context.Background(), l, "s2", net.ParseIP("1.2.3.4"), "b", []Port{}, "share", "", ""))
+	reserveNext("a", "1.2.3.5")
+	ip, err := alloc.AllocateFromPool(context.Background(), l, "s3", false, "a", []Port{}, "", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.5", ip.String())
+	for i := 0; i < 10; i++ {
+		require.NoError(t, alloc.Assign("s2", net.ParseIP("1.2.3.4"), []Port{}, "share", "", ""))
+		require.NoError(t, alloc.Assign("s3", net.ParseIP("1.2.3.5"), []Port{}, "", "", ""))
+		assert.Equal(t, "b", alloc.Pool("s2"))
+		assert.Equal(t, "a", alloc.Pool("s3"))
+	}
+
+	// Services sharing an IP share its pool.
+	require.NoError(t, alloc.Assign("s4", net.ParseIP("1.2.3.4"), []Port{{"UDP", 53}}, "share", "", ""))
+	assert.Equal(t, "b", alloc.Pool("s4"))
+
+	// Reloading the same pools keeps the attribution.
+	if err := alloc.SetPools(alloc.pools); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	assert.Equal(t, "static", alloc.Pool("s1"))
+	assert.Equal(t, "b", alloc.Pool("s2"))
+	assert.Equal(t, "a", alloc.Pool("s3"))
+
+	// An IP in no static pool can't be attributed to one of several
+	// IPAM pools without more information.
+	assert.Error(t, alloc.Assign("s5", net.ParseIP("1.2.3.6"), []Port{}, "", "", ""))
+
+	// After a restart, the pool asked for or the one holding the
+	// reservation owns the IP.
+	alloc.pools["a"].IPAM = &listAgent{Agent: fake.GetFakeIPAMAgent()}
+	alloc.pools["b"].IPAM = &listAgent{
+		Agent: fake.GetFakeIPAMAgent(),
+		res:   []ipam.IPAddressReservation{{ID: "id-1.2.3.6", Address: "1.2.3.6"}},
+	}
+	require.NoError(t, alloc.AssignCurrent(context.Background(), l, "s5", net.ParseIP("1.2.3.6"), "", []Port{}, "", "", ""))
+	assert.Equal(t, "b", alloc.Pool("s5"))
+	require.NoError(t, alloc.AssignCurrent(context.Background(), l, "s6", net.ParseIP("1.2.3.7"), "a", []Port{}, "", "", ""))
+	assert.Equal(t, "a", alloc.Pool("s6"))
+	assert.Error(t, alloc.AssignCurrent(context.Background(), l, "s7", net.ParseIP("1.2.3.8"), "", []Port{}, "", "", ""))
+	require.NoError(t, alloc.AssignCurrent(context.Background(), l, "s8", net.ParseIP("10.0.0.2"), "a", []Port{}, "", "", ""))
+	assert.Equal(t, "static", alloc.Pool("s8"))
+}
+
+func TestIPAMUsage(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"test": {
+			AutoAssign: true,
+			Protocol:   config.IPAM,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.0/28")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	// Until the IPAM is asked, the configured addresses are counted.
+	addrs, _, _ := alloc.PoolUsage("test")
+	assert.Equal(t, int64(16), addrs)
+	_, _, ok := alloc.IPAMUsage("test")
+	assert.False(t, ok)
+
+	fake.SetState(&fake.State{
+		IPPoolsToReturn: []ipam.IPPool{
+			{
+				NetworkTypes: []ipam.NetworkType{"test"},
+				IPAddressRange: ipam.IPAddressRange{
+					StartIP: "1.2.3.1",
+					EndIP:   "1.2.3.10",
+				},
+			},
+		},
+		ReservationsToReturn: []ipam.IPAddressReservation{
+			{ID: "a", Address: "1.2.3.1"},
+			{ID: "b", Address: "1.2.3.2"},
+			{ID: "c", Address: "1.2.3.3"},
+		},
+	})
+	alloc.pools["test"].IPAM = fake.GetFakeIPAMAgent()
+
+	l, err := logging.Init()
+	assert.NoError(t, err)
+	now := time.Now()
+	refresh := func() int {
+		fetches := alloc.DueIPAMUsage(now, time.Minute)
+		var results []IPAMUsageResult
+		for _, f := range fetches {
+			results = append(results, f.Fetch(context.Background()))
+		}
+		alloc.SetIPAMUsage(l, results)
+		return len(fetches)
+	}
+	assert.Equal(t, 1, refresh())
+
+	addrs, reserved, ok := alloc.IPAMUsage("test")
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), addrs)
+	assert.Equal(t, int64(3), reserved)
+	addrs, _, _ = alloc.PoolUsage("test")
+	assert.Equal(t, int64(10), addrs)
+	assert.Equal(t, float64(10), testutil.ToFloat64(stats.poolCapacity.WithLabelValues("test")))
+	assert.Equal(t, float64(3), testutil.ToFloat64(stats.ipamReserved.WithLabelValues("test")))
+
+	// Recent usage isn't fetched again.
+	fake.SetState(&fake.State{})
+	assert.Equal(t, 0, refresh())
+	_, reserved, _ = alloc.IPAMUsage("test")
+	assert.Equal(t, int64(3), reserved)
+
+	// Once it is old, it is, and failures keep the last known usage.
+	now = now.Add(time.Minute)
+	assert.Equal(t, 1, refresh())
+	_, reserved, ok = alloc.IPAMUsage("test")
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), reserved)
+
+	// Failed fetches are retried with a backoff, not on every call.
+	now = now.Add(ipamUsageRetry - time.Second)
+	assert.Equal(t, 0, refresh())
+	now = now.Add(time.Second)
+	assert.Equal(t, 1, refresh())
+	now = now.Add(ipamUsageRetry)
+	assert.Equal(t, 0, refresh())
+	now = now.Add(ipamUsageRetry)
+	assert.Equal(t, 1, refresh())
+}
+
+func TestIPAMUsageBackoff(t *testing.T) {
+	assert.Equal(t, 10*time.Second, ipamUsageBackoff(1))
+	assert.Equal(t, 20*time.Second, ipamUsageBackoff(2))
+	assert.Equal(t, 160*time.Second, ipamUsageBackoff(5))
+	assert.Equal(t, ipamUsageMaxRetry, ipamUsageBackoff(100))
+}
+
+func TestSharedDynamicAllocation(t *testing.T) {
+	tests := []struct {
+		desc      string
+		clusterID string
+		listRes   []ipam.IPAddressReservation
+		wantErr   bool
+	}{
+		{
+			desc:    "cluster ID required",
+			wantErr: true,
+		},
+		{
+			desc:      "IP only reserved by us",
+			clusterID: "cluster1",
+			listRes: []ipam.IPAddressReservation{
+				{ID: "other", Address: "1.2.3.5"},
+				{ID: "the id", Address: "1.2.3.4"},
+			},
+		},
+		{
+			desc:      "IP also reserved by another cluster",
+			clusterID: "cluster1",
+			listRes: []ipam.IPAddressReservation{
+				{ID: "the id", Address: "1.2.3.4"},
+				{ID: "other", Address: "1.2.3.4"},
+			},
+			wantErr: true,
+		},
+	}
+
+	l, err := logging.Init()
+	assert.NoError(t, err)
+
+	for _, test := range tests {
+		t.Run(test.desc, func(tt *testing.T) {
+			alloc := New()
+			if err := alloc.SetPools(map[string]*config.Pool{
+				"test": {
+					AutoAssign: true,
+					Protocol:   config.IPAM,
+					SharedIPAM: true,
+				},
+			}); err != nil {
+				tt.Fatalf("SetPools: %s", err)
+			}
+
+			os.Setenv(clusterIDEnvVariable, test.clusterID)
+			defer os.Unsetenv(clusterIDEnvVariable)
+
+			state := &fake.State{}
+			state.ReservationToReturn = ipam.IPAddressReservation{ID: "the id", Address: "1.2.3.4"}
+			state.ReservationsToReturn = test.listRes
+			fake.SetState(state)
+			alloc.pools["test"].IPAM = fake.GetFakeIPAMAgent()
+
+			ip, err := alloc.Allocate(context.Background(), l, "s1", false, []Port{}, "", "", "")
+			if test.wantErr {
+				assert.Error(tt, err)
+				assert.Nil(tt, alloc.IP("s1"))
+				return
+			}
+			assert.NoError(tt, err)
+			assert.Equal(tt, "1.2.3.4", ip.String())
+		})
+	}
+}
+
+func TestReservationScope(t *testing.T) {
+	os.Setenv(clusterIDEnvVariable, "cluster1")
+	defer os.Unsetenv(clusterIDEnvVariable)
+
+	assert.Empty(t, reservationScope(&config.Pool{Protocol: config.IPAM})[ipam.ClusterIDKey])
+	assert.Equal(t, "cluster1", reservationScope(&config.Pool{Protocol: config.IPAM, SharedIPAM: true})[ipam.ClusterIDKey])
+}
+
 func TestUnAllocation(t *testing.T) {
 	allocWithIPAM := New()
 	if err := allocWithIPAM.SetPools(map[string]*config.Pool{
@@ -982,11 +1388,11 @@ func TestUnAllocation(t *testing.T) {
 			fake.SetState(state)
 			allocWithIPAM.pools["test"].IPAM = fake.GetFakeIPAMAgent()
 
-			ip, err := allocWithIPAM.Allocate(l, test.svc, false, []Port{}, "", "")
+			ip, err := allocWithIPAM.Allocate(context.Background(), l, test.svc, false, []Port{}, "", "", "")
 			require.NoError(tt, err)
 			require.NotNil(tt, ip)
 
-			err = allocWithIPAM.UnAllocate(l, test.svc)
+			err = allocWithIPAM.UnAllocate(context.Background(), l, test.svc)
 			if test.wantErr {
 				require.Error(tt, err)
 				assert.Contains(tt, err.Error(), test.expectedErr)
@@ -1033,17 +1439,644 @@ func TestUnAllocation(t *testing.T) {
 	for _, test := range testsNotIPAM {
 		t.Run(test.desc, func(tt *testing.T) {
 			if test.wantAlloc {
-				ip, err := allocNormal.Allocate(l, test.svc, false, []Port{}, "", "")
+				ip, err := allocNormal.Allocate(context.Background(), l, test.svc, false, []Port{}, "", "", "")
 				require.NoError(tt, err)
 				require.NotNil(tt, ip)
 			}
 
-			err := allocNormal.UnAllocate(l, test.svc)
+			err := allocNormal.UnAllocate(context.Background(), l, test.svc)
 			require.NoError(tt, err)
 		})
 	}
 }
 
+func TestEnsureReservation(t *testing.T) {
+	tests := []struct {
+		desc    string
+		listRes []ipam.IPAddressReservation
+		res     ipam.IPAddressReservation
+		adopt   bool
+		want    bool
+	}{
+		{
+			desc: "reservation exists",
+			listRes: []ipam.IPAddressReservation{
+				{ID: "other", Address: "1.2.3.5"},
+				{ID: "the id", Address: "1.2.3.4"},
+			},
+			adopt: true,
+			want:  true,
+		},
+		{
+			desc: "reservation missing, adopted",
+			listRes: []ipam.IPAddressReservation{
+				{ID: "other", Address: "1.2.3.5"},
+			},
+			res:   ipam.IPAddressReservation{ID: "new id", Address: "1.2.3.4"},
+			adopt: true,
+			want:  true,
+		},
+		{
+			desc: "reservation missing, IP taken",
+			listRes: []ipam.IPAddressReservation{
+				{ID: "other", Address: "1.2.3.5"},
+			},
+			res:   ipam.IPAddressReservation{ID: "new id", Address: "1.2.3.6"},
+			adopt: true,
+			want:  false,
+		},
+		{
+			desc: "reservation missing, not adopting",
+			listRes: []ipam.IPAddressReservation{
+				{ID: "other", Address: "1.2.3.5"},
+			},
+			adopt: false,
+			want:  false,
+		},
+	}
+
+	l, err := logging.Init()
+	assert.NoError(t, err)
+
+	for _, test := range tests {
+		t.Run(test.desc, func(tt *testing.T) {
+			alloc := New()
+			if err := alloc.SetPools(map[string]*config.Pool{
+				"test": {
+					AutoAssign: true,
+					Protocol:   config.IPAM,
+				},
+			}); err != nil {
+				tt.Fatalf("SetPools: %s", err)
+			}
+
+			state := &fake.State{}
+			state.ReservationsToReturn = test.listRes
+			state.ReservationToReturn = test.res
+			fake.SetState(state)
+			alloc.pools["test"].IPAM = fake.GetFakeIPAMAgent()
+
+			require.NoError(tt, alloc.Assign("s1", net.ParseIP("1.2.3.4"), []Port{}, "", "", ""))
+
+			got, err := alloc.EnsureReservation(context.Background(), l, "s1", test.adopt)
+			require.NoError(tt, err)
+			assert.Equal(tt, test.want, got)
+		})
+	}
+}
+
+func TestEnsureReservationMixedPools(t *testing.T) {
+	l, err := logging.Init()
+	assert.NoError(t, err)
+
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"static": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("10.0.0.0/24")},
+		},
+		"test": {
+			AutoAssign: true,
+			Protocol:   config.IPAM,
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	state := &fake.State{}
+	state.ReservationToReturn = ipam.IPAddressReservation{ID: "new id", Address: "10.0.0.1"}
+	fake.SetState(state)
+	alloc.pools["test"].IPAM = fake.GetFakeIPAMAgent()
+
+	calls := func(op string) float64 {
+		return testutil.ToFloat64(stats.ipamCalls.WithLabelValues("test", op, "success"))
+	}
+	reserves := calls("ReserveIP")
+
+	// IPs of the static pool are never adopted into the IPAM, even
+	// if they were attributed to the IPAM pool.
+	require.NoError(t, alloc.Assign("s1", net.ParseIP("10.0.0.1"), []Port{}, "", "", ""))
+	require.NoError(t, alloc.assignIn("s2", net.ParseIP("10.0.0.2"), "test", []Port{}, "", "", ""))
+	for _, svc := range []string{"s1", "s2"} {
+		got, err := alloc.EnsureReservation(context.Background(), l, svc, true)
+		require.NoError(t, err)
+		assert.True(t, got, svc)
+	}
+	assert.Equal(t, reserves, calls("ReserveIP"))
+}
+
+// countingAgent is an IPAM agent that counts calls, and blocks
+// listings until unblock is closed, if it is set.
+type countingAgent struct {
+	ipam.Agent
+	unblock  chan struct{}
+	lists    int32
+	releases int32
+}
+
+func (c *countingAgent) ListIPReservations(nt ipam.NetworkType, metaData map[string]string) ([]ipam.IPAddressReservation, error) {
+	atomic.AddInt32(&c.lists, 1)
+	if c.unblock != nil {
+		<-c.unblock
+	}
+	return c.Agent.ListIPReservations(nt, metaData)
+}
+
+func (c *countingAgent) ReleaseIPs(nt ipam.NetworkType, ids []string) error {
+	atomic.AddInt32(&c.releases, 1)
+	return c.Agent.ReleaseIPs(nt, ids)
+}
+
+func TestIPAMLimits(t *testing.T) {
+	l, err := logging.Init()
+	assert.NoError(t, err)
+
+	newAlloc := func(tt *testing.T, limits IPAMLimits, agent *countingAgent) *Allocator {
+		alloc := New()
+		alloc.SetIPAMLimits(limits)
+		if err := alloc.SetPools(map[string]*config.Pool{
+			"test": {
+				AutoAssign: true,
+				Protocol:   config.IPAM,
+			},
+		}); err != nil {
+			tt.Fatalf("SetPools: %s", err)
+		}
+		state := &fake.State{}
+		state.ReservationsToReturn = []ipam.IPAddressReservation{
+			{ID: "id1", Address: "1.2.3.4"},
+			{ID: "id2", Address: "1.2.3.5"},
+		}
+		fake.SetState(state)
+		agent.Agent = fake.GetFakeIPAMAgent()
+		alloc.pools["test"].IPAM = agent
+		require.NoError(tt, alloc.Assign("s1", net.ParseIP("1.2.3.4"), []Port{}, "", "", ""))
+		require.NoError(tt, alloc.Assign("s2", net.ParseIP("1.2.3.5"), []Port{}, "", "", ""))
+		return alloc
+	}
+
+	t.Run("timeout", func(tt *testing.T) {
+		agent := &countingAgent{unblock: make(chan struct{})}
+		alloc := newAlloc(tt, IPAMLimits{Timeout: 50 * time.Millisecond, MaxConcurrent: 1}, agent)
+
+		start := time.Now()
+		_, err := alloc.EnsureReservation(context.Background(), l, "s1", false)
+		assert.True(tt, errors.Is(err, context.DeadlineExceeded), "want a timeout, got %v", err)
+		assert.Less(tt, int64(time.Since(start)), int64(time.Second))
+
+		// The hung call still holds the only slot.
+		_, err = alloc.EnsureReservation(context.Background(), l, "s2", false)
+		assert.Error(tt, err)
+		assert.Equal(tt, int32(1), atomic.LoadInt32(&agent.lists))
+
+		close(agent.unblock)
+		assert.Eventually(tt, func() bool {
+			ok, err := alloc.EnsureReservation(context.Background(), l, "s2", false)
+			return err == nil && ok
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("batching", func(tt *testing.T) {
+		agent := &countingAgent{}
+		alloc := newAlloc(tt, IPAMLimits{BatchWindow: time.Hour}, agent)
+
+		for _, svc := range []string{"s1", "s2"} {
+			ok, err := alloc.EnsureReservation(context.Background(), l, svc, false)
+			require.NoError(tt, err)
+			assert.True(tt, ok)
+		}
+		require.NoError(tt, alloc.UnAllocate(context.Background(), l, "s1"))
+		assert.Equal(tt, int32(1), atomic.LoadInt32(&agent.lists), "listing not reused")
+		assert.Equal(tt, int32(1), atomic.LoadInt32(&agent.releases))
+
+		// Our own release is applied to the reused listing.
+		alloc.Unassign("s1")
+		require.NoError(tt, alloc.Assign("s1", net.ParseIP("1.2.3.4"), []Port{}, "", "", ""))
+		ok, err := alloc.EnsureReservation(context.Background(), l, "s1", false)
+		require.NoError(tt, err)
+		assert.False(tt, ok)
+	})
+}
+
+func TestIPAMStats(t *testing.T) {
+	l, err := logging.Init()
+	assert.NoError(t, err)
+
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"ipam-stats": {
+			AutoAssign: true,
+			Protocol:   config.IPAM,
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	state := &fake.State{}
+	state.ReservationsToReturn = []ipam.IPAddressReservation{
+		{ID: "id1", Address: "1.2.3.4"},
+		{ID: "id2", Address: "1.2.3.5"},
+	}
+	fake.SetState(state)
+	alloc.pools["ipam-stats"].IPAM = fake.GetFakeIPAMAgent()
+
+	calls := func(op, result string) float64 {
+		return testutil.ToFloat64(stats.ipamCalls.WithLabelValues("ipam-stats", op, result))
+	}
+	reservations := func() float64 {
+		return testutil.ToFloat64(stats.ipamReservations.WithLabelValues("ipam-stats"))
+	}
+
+	require.NoError(t, alloc.Assign("s1", net.ParseIP("1.2.3.4"), []Port{}, "", "", ""))
+	require.NoError(t, alloc.Assign("s2", net.ParseIP("1.2.3.5"), []Port{}, "", "", ""))
+	// Sharing an IP shares its reservation.
+	require.NoError(t, alloc.Assign("s3", net.ParseIP("1.2.3.5"), []Port{}, "", "", ""))
+	assert.Equal(t, float64(2), reservations())
+
+	ok, err := alloc.EnsureReservation(context.Background(), l, "s1", false)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), calls("ListIPReservations", "success"))
+
+	require.NoError(t, alloc.UnAllocate(context.Background(), l, "s1"))
+	alloc.Unassign("s1")
+	assert.Equal(t, float64(2), calls("ListIPReservations", "success"))
+	assert.Equal(t, float64(1), calls("ReleaseIPs", "success"))
+	assert.Equal(t, float64(0), calls("ReleaseIPs", "error"))
+	assert.Equal(t, float64(1), reservations())
+}
+
+func TestPoolIPFamily(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"v4only": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			IPFamily:   config.IPv4Family,
+		},
+		"dual": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.4.0/31"), ipnet("1000::/127")},
+			IPFamily:   config.DualStack,
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	l, err := logging.Init()
+	if err != nil {
+		t.Fatalf("failed to initialize logging: %s", err)
+	}
+	if _, err := alloc.AllocateFromPool(context.Background(), l, "s1", true, "v4only", nil, "", "", ""); err == nil {
+		t.Error("allocated an IPv6 address from an ipv4 pool")
+	}
+	ip, err := alloc.AllocateFromPool(context.Background(), l, "s2", true, "dual", nil, "", "", "")
+	if err != nil {
+		t.Fatalf("allocating IPv6 from dual pool: %s", err)
+	}
+	if ip.To4() != nil {
+		t.Errorf("got %s from dual pool, want an IPv6 address", ip)
+	}
+	ip, err = alloc.AllocateFromPool(context.Background(), l, "s3", false, "dual", nil, "", "", "")
+	if err != nil {
+		t.Fatalf("allocating IPv4 from dual pool: %s", err)
+	}
+	if ip.To4() == nil {
+		t.Errorf("got %s from dual pool, want an IPv4 address", ip)
+	}
+}
+
+func TestShadow(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"a": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+		},
+		"b": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.4.0/31")},
+		},
+		"dynamic": {
+			Protocol: config.IPAM,
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	l, err := logging.Init()
+	if err != nil {
+		t.Fatalf("failed to initialize logging: %s", err)
+	}
+	if err := alloc.Assign("s1", net.ParseIP("1.2.3.0"), nil, "", "", ""); err != nil {
+		t.Fatalf("Assign: %s", err)
+	}
+
+	shadow := alloc.Shadow()
+	for _, svc := range []string{"s2", "s3"} {
+		if _, err := shadow.Allocate(context.Background(), l, svc, false, nil, "", "", ""); err != nil {
+			t.Fatalf("shadow Allocate(%s): %s", svc, err)
+		}
+	}
+	// Pools are tried in name order.
+	if got := shadow.IP("s2").String(); got != "1.2.3.1" {
+		t.Errorf("shadow allocated %s to s2, want 1.2.3.1", got)
+	}
+	if got := shadow.IP("s3").String(); got != "1.2.4.0" {
+		t.Errorf("shadow allocated %s to s3, want 1.2.4.0", got)
+	}
+	if !shadow.Unassign("s1") {
+		t.Error("s1 not assigned in shadow")
+	}
+
+	if ip := alloc.IP("s1"); ip == nil || ip.String() != "1.2.3.0" {
+		t.Errorf("shadow changed the IP of s1 to %s", ip)
+	}
+	if ip := alloc.IP("s2"); ip != nil {
+		t.Errorf("shadow allocation leaked, s2 has %s", ip)
+	}
+	if _, inUse, _ := alloc.PoolUsage("a"); inUse != 1 {
+		t.Errorf("shadow changed the usage of pool a to %d", inUse)
+	}
+
+	_, err = shadow.AllocateFromPool(context.Background(), l, "s4", false, "dynamic", nil, "", "", "")
+	var sim *SimulatedIPAMError
+	if !errors.As(err, &sim) || sim.Pool != "dynamic" {
+		t.Errorf("shadow allocation from IPAM pool returned %v, want a SimulatedIPAMError", err)
+	}
+}
+
+func TestBestFit(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"a-large": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+		},
+		"b-small": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.4.0/31"), ipnet("1000::/120")},
+		},
+		"c-medium": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.5.0/30")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	l, err := logging.Init()
+	if err != nil {
+		t.Fatalf("failed to initialize logging: %s", err)
+	}
+
+	if ip, err := alloc.Allocate(context.Background(), l, "first-fit", false, nil, "", "", ""); err != nil || alloc.Pool("first-fit") != "a-large" {
+		t.Errorf("first-fit allocated %s from %q (err %v), want pool a-large", ip, alloc.Pool("first-fit"), err)
+	}
+
+	alloc.SetAutoAssignStrategy(config.BestFit)
+	// The IPv6 range of b-small doesn't make it any larger for IPv4.
+	want := []string{"b-small", "b-small", "c-medium", "c-medium", "c-medium", "c-medium", "a-large"}
+	for i, pool := range want {
+		svc := "s" + strconv.Itoa(i)
+		ip, err := alloc.Allocate(context.Background(), l, svc, false, nil, "", "", "")
+		if err != nil {
+			t.Fatalf("Allocate(%s): %s", svc, err)
+		}
+		if got := alloc.Pool(svc); got != pool {
+			t.Errorf("best-fit allocated %s to %s from pool %q, want %q", ip, svc, got, pool)
+		}
+	}
+}
+
+func TestAllocateNear(t *testing.T) {
+	zone := func(z string) *config.Topology {
+		return &config.Topology{Key: config.DefaultTopologyKey, Zones: []string{z}}
+	}
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"a-zone-a": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			Topology:   zone("a"),
+		},
+		"b-any": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.4.0/31")},
+		},
+		"c-zone-c": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.5.0/31")},
+			Topology:   zone("c"),
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	l, err := logging.Init()
+	if err != nil {
+		t.Fatalf("failed to initialize logging: %s", err)
+	}
+
+	inZone := func(z string) labels.Set {
+		return labels.Set{config.DefaultTopologyKey: z}
+	}
+	tests := []struct {
+		svc   string
+		nodes []labels.Set
+		want  string
+	}{
+		{"no-hint", nil, "a-zone-a"},
+		{"zone-c", []labels.Set{inZone("c")}, "c-zone-c"},
+		{"zones-b-c", []labels.Set{inZone("b"), inZone("c")}, "c-zone-c"},
+		// c-zone-c is full, pools without topology come next.
+		{"zone-c-full", []labels.Set{inZone("c")}, "b-any"},
+		{"zone-b", []labels.Set{inZone("b")}, "b-any"},
+		{"unlabeled", []labels.Set{{}}, "a-zone-a"},
+	}
+	for _, test := range tests {
+		ip, err := alloc.AllocateNear(context.Background(), l, test.svc, false, test.nodes, nil, "", "", "")
+		if err != nil {
+			t.Fatalf("AllocateNear(%s): %s", test.svc, err)
+		}
+		if got := alloc.Pool(test.svc); got != test.want {
+			t.Errorf("allocated %s to %s from pool %q, want %q", ip, test.svc, got, test.want)
+		}
+	}
+}
+
+func TestCandidatePool(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"a-manual": {
+			CIDR:   []*net.IPNet{ipnet("1.2.3.0/31")},
+			Labels: labels.Set{"tier": "gold"},
+		},
+		"b-v4": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.4.0/31")},
+			IPFamily:   config.IPv4Family,
+		},
+		"c-v6": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1000::/127")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	tests := []struct {
+		desc     string
+		isIPv6   bool
+		ip       string
+		poolName string
+		sel      labels.Selector
+		want     string
+	}{
+		{"auto-assign v4", false, "", "", nil, "b-v4"},
+		{"auto-assign v6", true, "", "", nil, "c-v6"},
+		{"requested pool", false, "", "a-manual", nil, "a-manual"},
+		{"unknown pool", false, "", "nope", nil, ""},
+		{"requested IP", false, "1.2.3.1", "", nil, "a-manual"},
+		{"requested IP in no pool", false, "1.2.5.0", "", nil, ""},
+		{"selector", false, "", "", labels.SelectorFromSet(labels.Set{"tier": "gold"}), "a-manual"},
+		{"selector of no pool", false, "", "", labels.SelectorFromSet(labels.Set{"tier": "silver"}), ""},
+	}
+	for _, test := range tests {
+		if got := alloc.CandidatePool(test.isIPv6, net.ParseIP(test.ip), test.poolName, test.sel, nil); got != test.want {
+			t.Errorf("%s: got pool %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestAllocateFromSelector(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"gold-a": {
+			CIDR:   []*net.IPNet{ipnet("1.2.3.0/32")},
+			Labels: labels.Set{"tier": "gold", "site": "a"},
+		},
+		"gold-b": {
+			CIDR:   []*net.IPNet{ipnet("1.2.4.0/32")},
+			Labels: labels.Set{"tier": "gold", "site": "b"},
+		},
+		"silver": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.5.0/31")},
+			Labels:     labels.Set{"tier": "silver"},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	l, err := logging.Init()
+	if err != nil {
+		t.Fatalf("failed to initialize logging: %s", err)
+	}
+
+	tests := []struct {
+		svc     string
+		sel     string
+		want    string
+		wantErr bool
+	}{
+		{"gold", "tier=gold", "gold-a", false},
+		// gold-a is full.
+		{"gold-2", "tier=gold", "gold-b", false},
+		{"gold-3", "tier=gold", "", true},
+		{"not-gold", "tier!=gold", "silver", false},
+		{"bronze", "tier=bronze", "", true},
+	}
+	for _, test := range tests {
+		sel, err := labels.Parse(test.sel)
+		if err != nil {
+			t.Fatalf("invalid selector %q: %s", test.sel, err)
+		}
+		ip, err := alloc.AllocateFromSelector(context.Background(), l, test.svc, false, sel, nil, nil, "", "", "")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: allocated %s from pool %q, want error", test.svc, ip, alloc.Pool(test.svc))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("AllocateFromSelector(%s): %s", test.svc, err)
+		}
+		if got := alloc.Pool(test.svc); got != test.want {
+			t.Errorf("allocated %s to %s from pool %q, want %q", ip, test.svc, got, test.want)
+		}
+	}
+}
+
+func TestSharingProtocols(t *testing.T) {
+	alloc := New()
+	pools := map[string]*config.Pool{
+		"both": {
+			Protocols: []config.Proto{config.Layer2, config.BGP},
+			CIDR:      []*net.IPNet{ipnet("1.2.3.0/31")},
+		},
+		"bgp": {
+			Protocol: config.BGP,
+			CIDR:     []*net.IPNet{ipnet("1.2.4.0/31")},
+		},
+	}
+	if err := alloc.SetPools(pools); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	tcp := func(port int) []Port { return []Port{{Proto: "TCP", Port: port}} }
+
+	// Services sharing an IP must be announced the same way.
+	ip := net.ParseIP("1.2.3.0")
+	require.NoError(t, alloc.Assign("s1", ip, tcp(80), "web", "", "bgp"))
+	require.NoError(t, alloc.Assign("s2", ip, tcp(443), "web", "", "bgp"))
+	assert.Error(t, alloc.Assign("s3", ip, tcp(8080), "web", "", "layer2"))
+	assert.Error(t, alloc.Assign("s3", ip, tcp(8080), "web", "", ""))
+
+	// Selecting a pool's only protocol changes nothing.
+	ip = net.ParseIP("1.2.4.0")
+	require.NoError(t, alloc.Assign("s4", ip, tcp(80), "web", "", ""))
+	require.NoError(t, alloc.Assign("s5", ip, tcp(443), "web", "", "bgp"))
+}
+
+func TestSharingGroups(t *testing.T) {
+	alloc := New()
+	pools := map[string]*config.Pool{
+		"sharing": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.0/30")},
+		},
+	}
+	if err := alloc.SetPools(pools); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	collected := func() float64 {
+		return testutil.ToFloat64(stats.sharingGroupsCollected.WithLabelValues("sharing"))
+	}
+	ip := net.ParseIP("1.2.3.0")
+	tcp := func(port int) []Port { return []Port{{Proto: "TCP", Port: port}} }
+
+	require.NoError(t, alloc.Assign("s1", ip, tcp(80), "web", "", ""))
+	require.NoError(t, alloc.Assign("s2", ip, tcp(443), "web", "", ""))
+	require.NoError(t, alloc.Assign("s3", net.ParseIP("1.2.3.1"), tcp(53), "dns", "", ""))
+	assert.Equal(t, 2, alloc.SharingGroups("sharing"))
+	assert.Equal(t, float64(2), testutil.ToFloat64(stats.sharingGroups.WithLabelValues("sharing")))
+
+	// Reassigning a service keeps its group.
+	require.NoError(t, alloc.Assign("s3", net.ParseIP("1.2.3.1"), tcp(53), "dns", "", ""))
+	assert.Equal(t, float64(0), collected())
+
+	alloc.Unassign("s1")
+	assert.Equal(t, 2, alloc.SharingGroups("sharing"))
+	alloc.Unassign("s2")
+	assert.Equal(t, 1, alloc.SharingGroups("sharing"))
+	assert.Equal(t, float64(1), collected())
+	alloc.Unassign("s3")
+	assert.Equal(t, 0, alloc.SharingGroups("sharing"))
+	assert.Equal(t, float64(2), collected())
+	assert.Empty(t, alloc.sharingGroups)
+
+	// Removing the pool drops its bookkeeping.
+	if err := alloc.SetPools(map[string]*config.Pool{}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	assert.Empty(t, alloc.poolIPsInUse)
+	assert.Empty(t, alloc.poolServices)
+}
+
 func TestBuggyIPs(t *testing.T) {
 	alloc := New()
 	if err := alloc.SetPools(map[string]*config.Pool{
@@ -1056,14 +2089,14 @@ func TestBuggyIPs(t *testing.T) {
 			CIDR:       []*net.IPNet{ipnet("1.2.3.254/31")},
 		},
 		"test3": {
-			AvoidBuggyIPs: true,
-			AutoAssign:    true,
-			CIDR:          []*net.IPNet{ipnet("1.2.4.0/31")},
+			ReservedHostSuffixes: config.ReserveEvery24,
+			AutoAssign:           true,
+			CIDR:                 []*net.IPNet{ipnet("1.2.4.0/31")},
 		},
 		"test4": {
-			AvoidBuggyIPs: true,
-			AutoAssign:    true,
-			CIDR:          []*net.IPNet{ipnet("1.2.4.254/31")},
+			ReservedHostSuffixes: config.ReserveEvery24,
+			AutoAssign:           true,
+			CIDR:                 []*net.IPNet{ipnet("1.2.4.254/31")},
 		},
 	}); err != nil {
 		t.Fatalf("SetPools: %s", err)
@@ -1099,7 +2132,7 @@ func TestBuggyIPs(t *testing.T) {
 
 	for i, test := range tests {
 		t.Run(test.svc, func(tt *testing.T) {
-			ip, err := alloc.Allocate(l, test.svc, false, nil, "", "")
+			ip, err := alloc.Allocate(context.Background(), l, test.svc, false, nil, "", "", "")
 			if test.wantErr {
 				assert.Errorf(tt, err, "#%d should have caused an error, but did not", i+1)
 				return
@@ -1111,6 +2144,39 @@ func TestBuggyIPs(t *testing.T) {
 	}
 }
 
+func TestReservedPoolCIDR(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"test": {
+			ReservedHostSuffixes: config.ReservePoolCIDR,
+			ReservedIPs:          []net.IP{net.ParseIP("1.2.2.0"), net.ParseIP("1.2.3.255")},
+			AutoAssign:           true,
+			CIDR:                 []*net.IPNet{ipnet("1.2.2.0/23")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	tests := []struct {
+		ip      string
+		wantErr bool
+	}{
+		{ip: "1.2.2.0", wantErr: true},
+		{ip: "1.2.2.1"},
+		{ip: "1.2.2.255"},
+		{ip: "1.2.3.0"},
+		{ip: "1.2.3.255", wantErr: true},
+	}
+	for i, test := range tests {
+		err := alloc.Assign("s"+strconv.Itoa(i), net.ParseIP(test.ip), nil, "", "", "")
+		if test.wantErr {
+			assert.Errorf(t, err, "Assign(%s) should have failed", test.ip)
+		} else {
+			assert.NoErrorf(t, err, "Assign(%s)", test.ip)
+		}
+	}
+}
+
 func TestConfigReload(t *testing.T) {
 	alloc := New()
 	if err := alloc.SetPools(map[string]*config.Pool{
@@ -1121,10 +2187,10 @@ func TestConfigReload(t *testing.T) {
 	}); err != nil {
 		t.Fatalf("SetPools: %s", err)
 	}
-	if err := alloc.Assign("s1", net.ParseIP("1.2.3.0"), nil, "", ""); err != nil {
+	if err := alloc.Assign("s1", net.ParseIP("1.2.3.0"), nil, "", "", ""); err != nil {
 		t.Fatalf("Assign(s1, 1.2.3.0): %s", err)
 	}
-	if err := alloc.Assign("s2", net.ParseIP("1000::"), nil, "", ""); err != nil {
+	if err := alloc.Assign("s2", net.ParseIP("1000::"), nil, "", "", ""); err != nil {
 		t.Fatalf("Assign(s1, 1000::): %s", err)
 	}
 
@@ -1260,9 +2326,9 @@ func TestConfigReload(t *testing.T) {
 			desc: "enable buggy IPs not allowed",
 			pools: map[string]*config.Pool{
 				"test2": {
-					AutoAssign:    true,
-					AvoidBuggyIPs: true,
-					CIDR:          []*net.IPNet{ipnet("1.2.3.0/31"), ipnet("1000::/127")},
+					AutoAssign:           true,
+					ReservedHostSuffixes: config.ReserveEvery24,
+					CIDR:                 []*net.IPNet{ipnet("1.2.3.0/31"), ipnet("1000::/127")},
 				},
 			},
 			pool:    "test2",
@@ -1396,7 +2462,7 @@ func TestAutoAssign(t *testing.T) {
 				return
 			}
 
-			ip, err := alloc.Allocate(l, test.svc, test.isIPv6, nil, "", "")
+			ip, err := alloc.Allocate(context.Background(), l, test.svc, test.isIPv6, nil, "", "", "")
 			if test.wantErr {
 				assert.Errorf(tt, err, "#%d should have caused an error, but did not", i+1)
 				return
@@ -1438,18 +2504,38 @@ func TestPoolCount(t *testing.T) {
 		{
 			desc: "BGP /24 and /25, no buggy IPs",
 			pool: &config.Pool{
-				Protocol:      config.BGP,
-				CIDR:          []*net.IPNet{ipnet("1.2.3.0/24"), ipnet("2.3.4.128/25")},
-				AvoidBuggyIPs: true,
+				Protocol:             config.BGP,
+				CIDR:                 []*net.IPNet{ipnet("1.2.3.0/24"), ipnet("2.3.4.128/25")},
+				ReservedHostSuffixes: config.ReserveEvery24,
 			},
 			want: 381,
 		},
+		{
+			desc: "BGP /23, no network and broadcast IPs",
+			pool: &config.Pool{
+				Protocol:             config.BGP,
+				CIDR:                 []*net.IPNet{ipnet("1.2.2.0/23")},
+				ReservedHostSuffixes: config.ReservePoolCIDR,
+				ReservedIPs:          []net.IP{net.ParseIP("1.2.2.0"), net.ParseIP("1.2.3.255")},
+			},
+			want: 510,
+		},
+		{
+			desc: "BGP /24, no buggy IPs and reserved offsets",
+			pool: &config.Pool{
+				Protocol:             config.BGP,
+				CIDR:                 []*net.IPNet{ipnet("1.2.3.0/24")},
+				ReservedHostSuffixes: config.ReserveEvery24,
+				ReservedIPs:          []net.IP{net.ParseIP("1.2.3.0"), net.ParseIP("1.2.3.1"), net.ParseIP("1.2.3.255")},
+			},
+			want: 253,
+		},
 		{
 			desc: "BGP a BIG ipv6 range",
 			pool: &config.Pool{
-				Protocol:      config.BGP,
-				CIDR:          []*net.IPNet{ipnet("1.2.3.0/24"), ipnet("2.3.4.128/25"), ipnet("1000::/64")},
-				AvoidBuggyIPs: true,
+				Protocol:             config.BGP,
+				CIDR:                 []*net.IPNet{ipnet("1.2.3.0/24"), ipnet("2.3.4.128/25"), ipnet("1000::/64")},
+				ReservedHostSuffixes: config.ReserveEvery24,
 			},
 			want: math.MaxInt64,
 		},
@@ -1546,3 +2632,71 @@ func ports(ports ...string) []Port {
 	}
 	return ret
 }
+
+func TestInitClusterID(t *testing.T) {
+	defer func() { derivedClusterID = "" }()
+	info := func(id string) float64 {
+		return testutil.ToFloat64(stats.clusterID.WithLabelValues(id))
+	}
+
+	id, err := InitClusterID("5d3c1ba4-7a4e-4c2e-9d55-2b5e0b0c7a11")
+	require.NoError(t, err)
+	assert.Equal(t, "5d3c1ba4-7a4e-4c2e-9d55-2b5e0b0c7a11", id)
+	assert.Equal(t, id, reservationMetaData()[ipam.ClusterIDKey])
+	assert.Equal(t, float64(1), info(id))
+
+	// CLUSTER_ID overrides the derived ID.
+	os.Setenv(clusterIDEnvVariable, "cluster1")
+	defer os.Unsetenv(clusterIDEnvVariable)
+	id, err = InitClusterID("5d3c1ba4-7a4e-4c2e-9d55-2b5e0b0c7a11")
+	require.NoError(t, err)
+	assert.Equal(t, "cluster1", id)
+	assert.Equal(t, float64(1), info("cluster1"))
+
+	for _, bad := range []string{"cluster 1", "cluster/1", strings.Repeat("a", 64)} {
+		os.Setenv(clusterIDEnvVariable, bad)
+		_, err := InitClusterID("")
+		assert.Error(t, err, "cluster ID %q", bad)
+	}
+}
+
+func TestCheckIPAM(t *testing.T) {
+	l, err := logging.Init()
+	assert.NoError(t, err)
+
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"test": {
+			AutoAssign: true,
+			Protocol:   config.IPAM,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.0/28")},
+		},
+		"local": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("4.5.6.0/28")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	fake.SetState(&fake.State{
+		ReservationsToReturn: []ipam.IPAddressReservation{
+			{ID: "a", Address: "1.2.3.1"},
+			{ID: "b", Address: "1.2.3.2"},
+		},
+	})
+	alloc.pools["test"].IPAM = fake.GetFakeIPAMAgent()
+
+	require.NoError(t, alloc.Assign("s1", net.ParseIP("1.2.3.1"), nil, "", "", ""))
+	require.NoError(t, alloc.Assign("s2", net.ParseIP("1.2.3.3"), nil, "", "", ""))
+	require.NoError(t, alloc.Assign("s3", net.ParseIP("4.5.6.1"), nil, "", "", ""))
+
+	orphans, unreserved, err := alloc.CheckIPAM(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []Reservation{{Pool: "test", ID: "b", IP: "1.2.3.2"}}, orphans)
+	assert.Equal(t, []string{"s2"}, unreserved)
+
+	// Reservations of assigned IPs are never released.
+	assert.Error(t, alloc.ReleaseReservation(context.Background(), l, Reservation{Pool: "test", ID: "a", IP: "1.2.3.1"}))
+	assert.Error(t, alloc.ReleaseReservation(context.Background(), l, Reservation{Pool: "local", ID: "c", IP: "4.5.6.2"}))
+	assert.NoError(t, alloc.ReleaseReservation(context.Background(), l, orphans[0]))
+}
@@ -0,0 +1,71 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+
+	"go.universe.tf/metallb/internal/config"
+)
+
+// Reservation is a reservation of IP in the external IPAM of Pool.
+type Reservation struct {
+	Pool string
+	ID   string
+	IP   string
+}
+
+// CheckIPAM compares the assignments in pools using an external IPAM
+// with this cluster's reservations in the IPAMs. It returns the
+// reservations of IPs that no service is assigned, and the services
+// whose IP isn't reserved.
+func (a *Allocator) CheckIPAM(ctx context.Context) (orphans []Reservation, unreserved []string, err error) {
+	var pools []string
+	for n, p := range a.pools {
+		if p.Protocol == config.IPAM {
+			pools = append(pools, n)
+		}
+	}
+	sort.Strings(pools)
+
+	for _, n := range pools {
+		pool := a.pools[n]
+		res, err := a.ipamClient(n).list(ctx, pool.IPAM, reservationScope(pool), true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to list reservations of pool %q, %v", n, err)
+		}
+		reserved := map[string]bool{}
+		for _, r := range res {
+			reserved[r.Address] = true
+			if len(a.servicesOnIP[r.Address]) == 0 {
+				orphans = append(orphans, Reservation{Pool: n, ID: r.ID, IP: r.Address})
+			}
+		}
+		for svc, alloc := range a.allocated {
+			if alloc.pool == n && !reserved[alloc.ip.String()] {
+				unreserved = append(unreserved, svc)
+			}
+		}
+	}
+	sort.Strings(unreserved)
+	return orphans, unreserved, nil
+}
+
+// ReleaseReservation releases r, a reservation returned by CheckIPAM,
+// unless its IP was assigned since.
+func (a *Allocator) ReleaseReservation(ctx context.Context, l log.Logger, r Reservation) error {
+	pool := a.pools[r.Pool]
+	if pool == nil || pool.Protocol != config.IPAM {
+		return fmt.Errorf("pool %q doesn't use an external IPAM", r.Pool)
+	}
+	if len(a.servicesOnIP[r.IP]) > 0 {
+		return fmt.Errorf("IP %s is assigned", r.IP)
+	}
+	if err := a.ipamClient(r.Pool).release(ctx, pool.IPAM, []string{r.ID}); err != nil {
+		return fmt.Errorf("unable to release reservation %s (%s) from pool: %s, %v", r.ID, r.IP, r.Pool, err)
+	}
+	l.Log("event", "ipReleased", "ip", r.IP, "id", r.ID, "pool", r.Pool, "msg", "orphaned IP reservation released")
+	return nil
+}
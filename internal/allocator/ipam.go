@@ -0,0 +1,344 @@
+package allocator
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NetApp/nks-on-prem-ipam/pkg/ipam"
+	"github.com/go-kit/kit/log"
+
+	"go.universe.tf/metallb/internal/tracing"
+)
+
+// IPAMLimits bounds the calls the allocator makes to external IPAMs.
+// The zero value places no bounds.
+type IPAMLimits struct {
+	// How long a single IPAM call may take. Zero means forever.
+	Timeout time.Duration
+	// How many calls may be in flight to the IPAM of one pool. Calls
+	// that timed out keep their slot until they return, so a hung
+	// IPAM can't pile up abandoned calls. Zero means no limit.
+	MaxConcurrent int
+	// How long a listing of a pool's reservations is reused. During
+	// bursts of service creations or deletions, this turns one
+	// listing per service into one per window. The allocator's own
+	// reservations and releases are applied to the reused listing,
+	// so only changes made by others are seen late. Zero disables
+	// reuse.
+	BatchWindow time.Duration
+}
+
+// ipamClient makes the IPAM calls for one pool, within the
+// allocator's IPAMLimits.
+type ipamClient struct {
+	pool   string
+	limits IPAMLimits
+	slots  chan struct{}
+
+	// scope key -> reused listing. Only touched by the allocator's
+	// caller, never by abandoned calls.
+	listings map[string]*listing
+}
+
+type listing struct {
+	at    time.Time
+	scope map[string]string
+	res   []ipam.IPAddressReservation
+}
+
+func newIPAMClient(pool string, limits IPAMLimits) *ipamClient {
+	ret := &ipamClient{
+		pool:     pool,
+		limits:   limits,
+		listings: map[string]*listing{},
+	}
+	if limits.MaxConcurrent > 0 {
+		ret.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	return ret
+}
+
+// call runs fn, the IPAM operation op, within the limits. If the
+// call times out, fn keeps running in the background, and undo, if
+// not nil, is run after fn succeeds, to revert what the abandoned
+// call did.
+func (c *ipamClient) call(ctx context.Context, op string, fn func() error, undo func()) error {
+	start := time.Now()
+	err := c.callLimited(ctx, op, fn, undo)
+	result := "success"
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		result = "timeout"
+	case err != nil:
+		result = "error"
+	}
+	stats.ipamCalls.WithLabelValues(c.pool, op, result).Inc()
+	stats.ipamCallDuration.WithLabelValues(c.pool, op, result).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (c *ipamClient) callLimited(ctx context.Context, op string, fn func() error, undo func()) error {
+	if c.limits.Timeout == 0 && c.slots == nil {
+		return fn()
+	}
+	if c.limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.limits.Timeout)
+		defer cancel()
+	}
+
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+		case <-ctx.Done():
+			stats.ipamTimeouts.WithLabelValues(c.pool, op).Inc()
+			return fmt.Errorf("IPAM %s: all %d call slots busy: %w", op, cap(c.slots), ctx.Err())
+		}
+	}
+
+	var (
+		mu        sync.Mutex
+		abandoned bool
+		err       error
+		done      = make(chan struct{})
+	)
+	go func() {
+		e := fn()
+		if c.slots != nil {
+			<-c.slots
+		}
+		mu.Lock()
+		err = e
+		revert := abandoned && e == nil && undo != nil
+		close(done)
+		mu.Unlock()
+		if revert {
+			undo()
+		}
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	select {
+	case <-done:
+		// Returned while we were giving up.
+		return err
+	default:
+	}
+	abandoned = true
+	c.invalidate()
+	stats.ipamTimeouts.WithLabelValues(c.pool, op).Inc()
+	return fmt.Errorf("IPAM %s: %w", op, ctx.Err())
+}
+
+// reserve reserves an IPv4 address for name, and returns the ID and
+// address of the reservation. If ip is not empty, that address is
+// requested.
+func (c *ipamClient) reserve(ctx context.Context, l log.Logger, agent ipam.Agent, name, ip string, metaData map[string]string) (string, string, error) {
+	nt := ipam.NetworkType(c.pool)
+	_, span := tracing.Start(ctx, "ipam.ReserveIP", "pool", c.pool, "reservation", name, "ip", ip)
+	var id, addr string
+	err := c.call(ctx, "ReserveIP", func() error {
+		res, err := agent.ReserveIP(nt, ipam.IPv4, name, ip, metaData)
+		if err != nil {
+			return err
+		}
+		id, addr = res.ID, res.Address
+		return nil
+	}, func() {
+		// Late success of a call we gave up on. Nobody knows about
+		// this reservation, so give it back.
+		if err := c.releaseNow(agent, []string{id}); err != nil {
+			l.Log("op", "reserveIP", "error", err, "id", id, "msg", "failed to release reservation of timed out call")
+		}
+	})
+	span.End(err)
+	if err != nil {
+		c.invalidate()
+		return "", "", err
+	}
+	res := ipam.IPAddressReservation{ID: id, Address: addr}
+	for _, lst := range c.listings {
+		if inScope(lst.scope, metaData) {
+			lst.res = append(lst.res, res)
+		}
+	}
+	return id, addr, nil
+}
+
+// reserveAddress reserves the IPv4 address ip for name, and returns
+// the ID of the reservation. It fails if the IPAM doesn't confirm
+// that address, e.g. because it's reserved by someone else, after
+// giving back the address it reserved instead.
+func (c *ipamClient) reserveAddress(ctx context.Context, l log.Logger, agent ipam.Agent, name, ip string, metaData map[string]string) (string, error) {
+	id, addr, err := c.reserve(ctx, l, agent, name, ip, metaData)
+	if err != nil {
+		return "", err
+	}
+	if addr != ip {
+		if err := c.release(ctx, agent, []string{id}); err != nil {
+			l.Log("op", "reserveIP", "error", err, "id", id, "msg", "failed to release unwanted reservation")
+		}
+		return "", fmt.Errorf("IPAM reserved %s instead of the requested %s", addr, ip)
+	}
+	return id, nil
+}
+
+// release releases the reservations ids.
+func (c *ipamClient) release(ctx context.Context, agent ipam.Agent, ids []string) error {
+	_, span := tracing.Start(ctx, "ipam.ReleaseIPs", "pool", c.pool, "reservation", strings.Join(ids, ","))
+	err := c.call(ctx, "ReleaseIPs", func() error {
+		return c.releaseNow(agent, ids)
+	}, nil)
+	span.End(err)
+	if err != nil {
+		c.invalidate()
+		return err
+	}
+	gone := map[string]bool{}
+	for _, id := range ids {
+		gone[id] = true
+	}
+	for _, lst := range c.listings {
+		kept := lst.res[:0:0]
+		for _, res := range lst.res {
+			if !gone[res.ID] {
+				kept = append(kept, res)
+			}
+		}
+		lst.res = kept
+	}
+	return nil
+}
+
+func (c *ipamClient) releaseNow(agent ipam.Agent, ids []string) error {
+	return agent.ReleaseIPs(ipam.NetworkType(c.pool), ids)
+}
+
+// list returns the reservations matching scope. Unless fresh is
+// true, a listing up to BatchWindow old may be returned.
+func (c *ipamClient) list(ctx context.Context, agent ipam.Agent, scope map[string]string, fresh bool) ([]ipam.IPAddressReservation, error) {
+	k := scopeKey(scope)
+	if lst := c.listings[k]; !fresh && lst != nil && time.Since(lst.at) < c.limits.BatchWindow {
+		stats.ipamListingsReused.WithLabelValues(c.pool).Inc()
+		return lst.res, nil
+	}
+
+	ret, err := c.listUncached(ctx, agent, scope)
+	if err != nil {
+		return nil, err
+	}
+	if c.limits.BatchWindow > 0 {
+		c.listings[k] = &listing{
+			at:    time.Now(),
+			scope: scope,
+			res:   ret,
+		}
+	}
+	return ret, nil
+}
+
+// listUncached lists the reservations in scope, without touching the
+// reused listings, so it may run on any goroutine.
+func (c *ipamClient) listUncached(ctx context.Context, agent ipam.Agent, scope map[string]string) ([]ipam.IPAddressReservation, error) {
+	_, span := tracing.Start(ctx, "ipam.ListIPReservations", "pool", c.pool)
+	var ret []ipam.IPAddressReservation
+	err := c.call(ctx, "ListIPReservations", func() error {
+		res, err := agent.ListIPReservations(ipam.NetworkType(c.pool), scope)
+		ret = res
+		return err
+	}, nil)
+	span.End(err)
+	return ret, err
+}
+
+// usage returns how many addresses the pool has in the IPAM, and
+// how many of them are reserved, by this cluster or others. It may
+// run on any goroutine.
+func (c *ipamClient) usage(ctx context.Context, agent ipam.Agent) (capacity, reserved int64, err error) {
+	nt := ipam.NetworkType(c.pool)
+	_, span := tracing.Start(ctx, "ipam.ListIPPools", "pool", c.pool)
+	var pools []ipam.IPPool
+	err = c.call(ctx, "ListIPPools", func() error {
+		var err error
+		pools, err = agent.ListIPPools()
+		return err
+	}, nil)
+	span.End(err)
+	if err != nil {
+		return 0, 0, err
+	}
+	found := false
+	for _, p := range pools {
+		for _, t := range p.NetworkTypes {
+			if t == nt {
+				capacity, err = rangeSize(p.IPAddressRange.StartIP, p.IPAddressRange.EndIP)
+				if err != nil {
+					return 0, 0, err
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("pool %q not found in IPAM", c.pool)
+	}
+
+	res, err := c.listUncached(ctx, agent, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	return capacity, int64(len(res)), nil
+}
+
+// rangeSize returns the number of addresses in the IPv4 range from
+// start to end.
+func rangeSize(start, end string) (int64, error) {
+	s, e := net.ParseIP(start).To4(), net.ParseIP(end).To4()
+	if s == nil || e == nil {
+		return 0, fmt.Errorf("invalid IPv4 range %s-%s", start, end)
+	}
+	first, last := binary.BigEndian.Uint32(s), binary.BigEndian.Uint32(e)
+	if last < first {
+		return 0, fmt.Errorf("invalid IPv4 range %s-%s", start, end)
+	}
+	return int64(last-first) + 1, nil
+}
+
+// invalidate forgets all reused listings, after a call whose effect
+// on the IPAM is unknown.
+func (c *ipamClient) invalidate() {
+	c.listings = map[string]*listing{}
+}
+
+// inScope returns true if a reservation with metaData is selected by
+// scope.
+func inScope(scope, metaData map[string]string) bool {
+	for k, v := range scope {
+		if metaData[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func scopeKey(scope map[string]string) string {
+	var kvs []string
+	for k, v := range scope {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
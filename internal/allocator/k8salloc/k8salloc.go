@@ -2,6 +2,8 @@ package k8salloc
 
 import (
 	"go.universe.tf/metallb/internal/allocator"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 )
@@ -20,14 +22,34 @@ func Ports(svc *v1.Service) []allocator.Port {
 
 // SharingKey extracts the sharing key for a service.
 func SharingKey(svc *v1.Service) string {
+	if gw := svc.Labels[k8s.GatewayNameLabel]; gw != "" {
+		return GatewaySharingKey(svc.Namespace + "/" + gw)
+	}
 	return svc.Annotations["metallb.universe.tf/allow-shared-ip"]
 }
 
+// GatewaySharingKey returns the sharing key with which the gateway
+// name holds its IP. The data plane services of the gateway share
+// the IP with that key.
+func GatewaySharingKey(name string) string {
+	return "gateway:" + name
+}
+
 // BackendKey extracts the backend key for a service.
 func BackendKey(svc *v1.Service) string {
+	if svc.Labels[k8s.GatewayNameLabel] != "" {
+		// Gateways have no backends of their own to compare with.
+		return ""
+	}
 	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
 		return labels.Set(svc.Spec.Selector).String()
 	}
 	// Cluster traffic policy can share services regardless of backends.
 	return ""
 }
+
+// Protocol extracts the protocol a service selects to be announced
+// with, see config.ProtocolAnnotation.
+func Protocol(svc *v1.Service) string {
+	return svc.Annotations[config.ProtocolAnnotation]
+}
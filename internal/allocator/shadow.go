@@ -0,0 +1,65 @@
+package allocator
+
+import "fmt"
+
+// SimulatedIPAMError is returned by allocations from a shadow
+// allocator that would reserve an IP in the external IPAM of Pool.
+type SimulatedIPAMError struct {
+	Pool string
+}
+
+func (e *SimulatedIPAMError) Error() string {
+	return fmt.Sprintf("pool %q reserves IPs in an external IPAM, which is not asked when simulating", e.Pool)
+}
+
+// Shadow returns a copy of the allocator, to simulate allocations
+// without changing a. The copy doesn't update metrics, and doesn't
+// call external IPAMs: allocations from IPAM pools fail with a
+// SimulatedIPAMError instead.
+func (a *Allocator) Shadow() *Allocator {
+	ret := New()
+	ret.shadow = true
+	ret.strategy = a.strategy
+	// Usages are replaced, never changed in place.
+	for n, u := range a.ipamUsage {
+		ret.ipamUsage[n] = u
+	}
+	// Pools and allocs are replaced, never changed in place.
+	for n, p := range a.pools {
+		ret.pools[n] = p
+	}
+	for svc, al := range a.allocated {
+		ret.allocated[svc] = al
+	}
+	for ip, k := range a.sharingKeyForIP {
+		ret.sharingKeyForIP[ip] = k
+	}
+	for ip, ports := range a.portsInUse {
+		ret.portsInUse[ip] = make(map[Port]string, len(ports))
+		for p, svc := range ports {
+			ret.portsInUse[ip][p] = svc
+		}
+	}
+	for ip, svcs := range a.servicesOnIP {
+		ret.servicesOnIP[ip] = make(map[string]bool, len(svcs))
+		for svc, v := range svcs {
+			ret.servicesOnIP[ip][svc] = v
+		}
+	}
+	for pool, ips := range a.poolIPsInUse {
+		ret.poolIPsInUse[pool] = make(map[string]int, len(ips))
+		for ip, n := range ips {
+			ret.poolIPsInUse[pool][ip] = n
+		}
+	}
+	for pool, n := range a.poolServices {
+		ret.poolServices[pool] = n
+	}
+	for pool, keys := range a.sharingGroups {
+		ret.sharingGroups[pool] = make(map[string]int, len(keys))
+		for k, n := range keys {
+			ret.sharingGroups[pool][k] = n
+		}
+	}
+	return ret
+}
@@ -6,6 +6,18 @@ var stats = struct {
 	poolCapacity  *prometheus.GaugeVec
 	poolActive    *prometheus.GaugeVec
 	poolAllocated *prometheus.GaugeVec
+
+	ipamCalls          *prometheus.CounterVec
+	ipamCallDuration   *prometheus.HistogramVec
+	ipamTimeouts       *prometheus.CounterVec
+	ipamListingsReused *prometheus.CounterVec
+	ipamReservations   *prometheus.GaugeVec
+	ipamReserved       *prometheus.GaugeVec
+
+	sharingGroups          *prometheus.GaugeVec
+	sharingGroupsCollected *prometheus.CounterVec
+
+	clusterID *prometheus.GaugeVec
 }{
 	poolCapacity: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "metallb",
@@ -31,10 +43,96 @@ var stats = struct {
 	}, []string{
 		"pool",
 	}),
+	ipamCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "allocator",
+		Name:      "ipam_calls_total",
+		Help:      "Number of calls to external IPAMs, per pool, operation and result (success, error or timeout)",
+	}, []string{
+		"pool",
+		"op",
+		"result",
+	}),
+	ipamCallDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "metallb",
+		Subsystem: "allocator",
+		Name:      "ipam_call_duration_seconds",
+		Help:      "Duration of calls to external IPAMs, per pool, operation and result (success, error or timeout)",
+	}, []string{
+		"pool",
+		"op",
+		"result",
+	}),
+	ipamTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "allocator",
+		Name:      "ipam_timeouts_total",
+		Help:      "Number of calls to external IPAMs that timed out, per pool and operation",
+	}, []string{
+		"pool",
+		"op",
+	}),
+	ipamListingsReused: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "allocator",
+		Name:      "ipam_listings_reused_total",
+		Help:      "Number of IPAM reservation listings served from a recent listing, per pool",
+	}, []string{
+		"pool",
+	}),
+	ipamReservations: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "allocator",
+		Name:      "ipam_reservations",
+		Help:      "Number of IPAM reservations held for assigned IPs, per pool",
+	}, []string{
+		"pool",
+	}),
+	ipamReserved: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "allocator",
+		Name:      "ipam_addresses_reserved",
+		Help:      "Number of addresses reserved in external IPAMs by this cluster or others, per pool",
+	}, []string{
+		"pool",
+	}),
+	sharingGroups: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "allocator",
+		Name:      "sharing_groups",
+		Help:      "Number of sharing keys in use by services, per pool",
+	}, []string{
+		"pool",
+	}),
+	sharingGroupsCollected: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "allocator",
+		Name:      "sharing_groups_collected_total",
+		Help:      "Number of sharing keys forgotten after their last service released its IP, per pool",
+	}, []string{
+		"pool",
+	}),
+	clusterID: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "allocator",
+		Name:      "cluster_info",
+		Help:      "Always 1, labeled with the cluster ID that IPAM reservations are made for",
+	}, []string{
+		"cluster_id",
+	}),
 }
 
 func init() {
 	prometheus.MustRegister(stats.poolCapacity)
 	prometheus.MustRegister(stats.poolActive)
 	prometheus.MustRegister(stats.poolAllocated)
+	prometheus.MustRegister(stats.ipamCalls)
+	prometheus.MustRegister(stats.ipamCallDuration)
+	prometheus.MustRegister(stats.ipamTimeouts)
+	prometheus.MustRegister(stats.ipamListingsReused)
+	prometheus.MustRegister(stats.ipamReservations)
+	prometheus.MustRegister(stats.ipamReserved)
+	prometheus.MustRegister(stats.sharingGroups)
+	prometheus.MustRegister(stats.sharingGroupsCollected)
+	prometheus.MustRegister(stats.clusterID)
 }
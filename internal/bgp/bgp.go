@@ -9,6 +9,8 @@ import (
 	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net"
 	"os"
 	"reflect"
@@ -23,6 +25,42 @@ import (
 
 var errClosed = errors.New("session closed")
 
+// PortRange is an inclusive range of local TCP ports that a session
+// connects from. The zero value lets the kernel pick an ephemeral
+// port.
+type PortRange struct {
+	Min, Max uint16
+}
+
+// SessionOptions are the optional settings of a session. The zero
+// value connects from a local address and port that the kernel picks,
+// with the kernel's default socket options.
+type SessionOptions struct {
+	// Local TCP ports to connect from.
+	SourcePorts PortRange
+	// Local address to connect from, nil to let the kernel pick.
+	SourceAddress net.IP
+	// Socket-level settings of the session's TCP connections.
+	Socket SocketOptions
+}
+
+// SocketOptions are socket-level settings of a session's TCP
+// connection. The zero value keeps the kernel's defaults.
+type SocketOptions struct {
+	// Idle time before the first TCP keepalive probe, and time
+	// between probes, in whole seconds. Zero disables keepalives.
+	KeepaliveInterval time.Duration
+	// Unanswered probes after which the connection is dropped.
+	KeepaliveProbes int
+	// How long sent data may remain unacknowledged before the
+	// connection is dropped.
+	UserTimeout time.Duration
+	// DSCP to mark the connection's packets with. The packets also
+	// get the matching socket priority, which egress-qos-map of VLAN
+	// interfaces can map to an 802.1p priority. Zero marks nothing.
+	DSCP uint8
+}
+
 // Session represents one BGP session to an external router.
 type Session struct {
 	asn      uint32
@@ -33,6 +71,7 @@ type Session struct {
 	holdTime time.Duration
 	logger   log.Logger
 	password string
+	opts     SessionOptions
 
 	newHoldTime chan bool
 	backoff     backoff
@@ -43,8 +82,15 @@ type Session struct {
 	conn           net.Conn
 	actualHoldTime time.Duration
 	defaultNextHop net.IP
-	advertised     map[string]*Advertisement
-	new            map[string]*Advertisement
+	// What the peer should have, and what it was sent on the current
+	// connection, by prefix.
+	desired    map[string]*Advertisement
+	advertised map[string]*Advertisement
+	// Prefixes whose desired state changed since they were last
+	// flushed to the peer. Only these are looked at when sending
+	// updates, so the work per change is proportional to the size
+	// of the change, not to the number of advertisements.
+	dirty map[string]bool
 }
 
 // run tries to stay connected to the peer, and pumps route updates to it.
@@ -73,6 +119,18 @@ func (s *Session) run() {
 	}
 }
 
+// haveNextHop returns true if adv can be sent on the current
+// connection. Advertisements without an explicit next-hop cannot be
+// sent on IPv6-only nodes to peers that don't accept IPv6 next-hops,
+// skip them rather than tearing down the session.
+func (s *Session) haveNextHop(prefix string, adv *Advertisement) bool {
+	if adv.NextHop != nil || s.defaultNextHop != nil {
+		return true
+	}
+	s.logger.Log("op", "sendUpdate", "prefix", prefix, "error", "no IPv4 next-hop available", "msg", "not advertising prefix, local address is IPv6 and there is no IPv4 address on its interface")
+	return false
+}
+
 // sendUpdates waits for changes to desired advertisements, and pushes
 // them out to the peer.
 func (s *Session) sendUpdates() bool {
@@ -88,22 +146,19 @@ func (s *Session) sendUpdates() bool {
 
 	ibgp := s.asn == s.peerASN
 
-	if s.new != nil {
-		s.advertised, s.new = s.new, nil
+	// New connection, the peer has nothing yet.
+	s.advertised = map[string]*Advertisement{}
+	s.dirty = make(map[string]bool, len(s.desired))
+	for c := range s.desired {
+		s.dirty[c] = true
 	}
 
-	for c, adv := range s.advertised {
-		if err := sendUpdate(s.conn, s.asn, ibgp, s.defaultNextHop, adv); err != nil {
-			s.abort()
-			s.logger.Log("op", "sendUpdate", "ip", c, "error", err, "msg", "failed to send BGP update")
+	for {
+		if !s.flush(ibgp) {
 			return true
 		}
-		stats.UpdateSent(s.addr)
-	}
-	stats.AdvertisedPrefixes(s.addr, len(s.advertised))
 
-	for {
-		for s.new == nil && s.conn != nil {
+		for len(s.dirty) == 0 && s.conn != nil {
 			s.cond.Wait()
 		}
 
@@ -113,46 +168,68 @@ func (s *Session) sendUpdates() bool {
 		if s.conn == nil {
 			return true
 		}
-		if s.new == nil {
-			// nil is "no pending updates", contrast to a non-nil
-			// empty map which means "withdraw all".
-			continue
-		}
-
-		for c, adv := range s.new {
-			if adv2, ok := s.advertised[c]; ok && adv.Equal(adv2) {
-				// Peer already has correct state for this
-				// advertisement, nothing to do.
-				continue
-			}
+	}
+}
 
-			if err := sendUpdate(s.conn, s.asn, ibgp, s.defaultNextHop, adv); err != nil {
+// flush sends the desired state of dirty prefixes to the peer. It
+// returns false if the connection failed and was aborted.
+func (s *Session) flush(ibgp bool) bool {
+	wdr := []*net.IPNet{}
+	for c := range s.dirty {
+		adv, old := s.desired[c], s.advertised[c]
+		switch {
+		case adv != nil && old != nil && adv.Equal(old):
+			// Peer already has correct state for this
+			// advertisement, nothing to do.
+		case adv != nil && s.haveNextHop(c, adv):
+			if err := s.sendUpdate(ibgp, adv); err != nil {
 				s.abort()
 				s.logger.Log("op", "sendUpdate", "prefix", c, "error", err, "msg", "failed to send BGP update")
-				return true
+				return false
 			}
 			stats.UpdateSent(s.addr)
+			s.advertised[c] = adv
+		case old != nil:
+			wdr = append(wdr, old.Prefix)
+			delete(s.advertised, c)
 		}
+	}
+	s.dirty = map[string]bool{}
 
-		wdr := []*net.IPNet{}
-		for c, adv := range s.advertised {
-			if s.new[c] == nil {
-				wdr = append(wdr, adv.Prefix)
-			}
-		}
-		if len(wdr) > 0 {
-			if err := sendWithdraw(s.conn, wdr); err != nil {
-				s.abort()
-				for _, pfx := range wdr {
-					s.logger.Log("op", "sendWithdraw", "prefix", pfx, "error", err, "msg", "failed to send BGP withdraw")
-				}
-				return true
+	if len(wdr) > 0 {
+		if err := s.sendWithdraw(wdr); err != nil {
+			s.abort()
+			for _, pfx := range wdr {
+				s.logger.Log("op", "sendWithdraw", "prefix", pfx, "error", err, "msg", "failed to send BGP withdraw")
 			}
-			stats.UpdateSent(s.addr)
+			return false
 		}
-		s.advertised, s.new = s.new, nil
-		stats.AdvertisedPrefixes(s.addr, len(s.advertised))
+		stats.UpdateSent(s.addr)
+	}
+	stats.AdvertisedPrefixes(s.addr, len(s.advertised))
+	return true
+}
+
+// sendUpdate sends adv to the peer, and reports it to the BMP
+// collector.
+func (s *Session) sendUpdate(ibgp bool, adv *Advertisement) error {
+	var msg bytes.Buffer
+	if err := sendUpdate(io.MultiWriter(s.conn, &msg), s.asn, ibgp, s.defaultNextHop, adv); err != nil {
+		return err
+	}
+	monitor.routes(s.addr, []*net.IPNet{adv.Prefix}, false, msg.Bytes())
+	return nil
+}
+
+// sendWithdraw withdraws prefixes from the peer, and reports it to the
+// BMP collector.
+func (s *Session) sendWithdraw(prefixes []*net.IPNet) error {
+	var msg bytes.Buffer
+	if err := sendWithdraw(io.MultiWriter(s.conn, &msg), prefixes); err != nil {
+		return err
 	}
+	monitor.routes(s.addr, prefixes, true, msg.Bytes())
+	return nil
 }
 
 // connect establishes the BGP session with the peer.
@@ -168,7 +245,7 @@ func (s *Session) connect() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	deadline, _ := ctx.Deadline()
-	conn, err := dialMD5(ctx, s.addr, s.password)
+	conn, err := dialMD5(ctx, s.addr, s.password, s.opts)
 	if err != nil {
 		return fmt.Errorf("dial %q: %s", s.addr, err)
 	}
@@ -183,19 +260,31 @@ func (s *Session) connect() error {
 		conn.Close()
 		return fmt.Errorf("getting local addr for default nexthop to %q: %s", s.addr, err)
 	}
-	s.defaultNextHop = addr.IP
+	// We only advertise IPv4 prefixes, which need an IPv4
+	// next-hop. When peering over IPv6, use an IPv4 address from the
+	// same interface if there is one. On IPv6-only nodes and
+	// unnumbered links there isn't, and advertisements must carry an
+	// explicit next-hop, unless the peer accepts our IPv6 address as
+	// the next-hop of IPv4 prefixes (RFC 5549).
+	s.defaultNextHop = addr.IP.To4()
+	if s.defaultNextHop == nil {
+		s.defaultNextHop = ipv4OnInterfaceOf(addr.IP)
+	}
+	extNextHop := s.defaultNextHop == nil
 
 	routerID := s.routerID
 	if routerID == nil {
-		routerID = getRouterID(s.defaultNextHop, s.myNode)
+		routerID = getRouterID(addr.IP, s.myNode)
 	}
 
-	if err = sendOpen(conn, s.asn, routerID, s.holdTime); err != nil {
+	// Keep copies of the OPEN messages for BMP.
+	var sentOpen, rcvdOpen bytes.Buffer
+	if err = sendOpen(io.MultiWriter(conn, &sentOpen), s.asn, routerID, s.holdTime, extNextHop); err != nil {
 		conn.Close()
 		return fmt.Errorf("send OPEN to %q: %s", s.addr, err)
 	}
 
-	op, err := readOpen(conn)
+	op, err := readOpen(io.TeeReader(conn, &rcvdOpen))
 	if err != nil {
 		conn.Close()
 		return fmt.Errorf("read OPEN from %q: %s", s.addr, err)
@@ -204,6 +293,10 @@ func (s *Session) connect() error {
 		conn.Close()
 		return fmt.Errorf("unexpected peer ASN %d, want %d", op.asn, s.peerASN)
 	}
+	if extNextHop && op.extNextHop4 {
+		s.defaultNextHop = addr.IP.To16()
+	}
+	holdTime := negotiateHoldTime(s.holdTime, op.holdTime)
 
 	// BGP session is established, clear the connect timeout deadline.
 	if err := conn.SetDeadline(time.Time{}); err != nil {
@@ -212,7 +305,7 @@ func (s *Session) connect() error {
 	}
 
 	// Consume BGP messages until the connection closes.
-	go s.consumeBGP(conn)
+	go s.consumeBGP(conn, holdTime)
 
 	// Send one keepalive to say that yes, we accept the OPEN.
 	if err := sendKeepalive(conn); err != nil {
@@ -221,16 +314,18 @@ func (s *Session) connect() error {
 	}
 
 	// Set up regular keepalives from now on.
-	s.actualHoldTime = s.holdTime
-	if op.holdTime < s.actualHoldTime {
-		s.actualHoldTime = op.holdTime
-	}
+	s.actualHoldTime = holdTime
 	select {
 	case s.newHoldTime <- true:
 	default:
 	}
 
 	s.conn = conn
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		// The configured ASN rather than the 2-byte My AS of the
+		// OPEN, which is AS_TRANS for 4-byte ASNs.
+		monitor.peerUp(s.addr, s.peerASN, op.routerID, addr, remote, sentOpen.Bytes(), rcvdOpen.Bytes())
+	}
 	return nil
 }
 
@@ -246,16 +341,26 @@ func getRouterID(addr net.IP, myNode string) net.IP {
 	if addr.To4() != nil {
 		return addr
 	}
+	if ip := ipv4OnInterfaceOf(addr); ip != nil {
+		return ip
+	}
+	return hashRouterId(myNode)
+}
 
+// ipv4OnInterfaceOf returns the first IPv4 address on the interface
+// that has addr, or nil if there is none, e.g. on IPv6-only nodes.
+func ipv4OnInterfaceOf(addr net.IP) net.IP {
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return hashRouterId(myNode)
+		return nil
 	}
 	for _, i := range ifaces {
 		addrs, err := i.Addrs()
 		if err != nil {
 			continue
 		}
+		found := false
+		var v4 net.IP
 		for _, a := range addrs {
 			var ip net.IP
 			switch v := a.(type) {
@@ -264,27 +369,18 @@ func getRouterID(addr net.IP, myNode string) net.IP {
 			case *net.IPAddr:
 				ip = v.IP
 			}
-
 			if ip.Equal(addr) {
-				// This is the interface.
-				// Loop through the addresses again and search for ipv4
-				for _, a := range addrs {
-					var ip net.IP
-					switch v := a.(type) {
-					case *net.IPNet:
-						ip = v.IP
-					case *net.IPAddr:
-						ip = v.IP
-					}
-					if ip.To4() != nil {
-						return ip
-					}
-				}
-				return hashRouterId(myNode)
+				found = true
+			}
+			if v4 == nil && ip.To4() != nil {
+				v4 = ip.To4()
 			}
 		}
+		if found {
+			return v4
+		}
 	}
-	return hashRouterId(myNode)
+	return nil
 }
 
 // sendKeepalives sends BGP KEEPALIVE packets at the negotiated rate
@@ -340,11 +436,12 @@ func (s *Session) sendKeepalive() error {
 	return nil
 }
 
-// New creates a BGP session using the given session parameters.
+// New creates a BGP session using the given session parameters, and
+// the optional settings in opts.
 //
 // The session will immediately try to connect and synchronize its
 // local state with the peer.
-func New(l log.Logger, addr string, asn uint32, routerID net.IP, peerASN uint32, holdTime time.Duration, password string, myNode string) (*Session, error) {
+func New(l log.Logger, addr string, asn uint32, routerID net.IP, peerASN uint32, holdTime time.Duration, password string, myNode string, opts SessionOptions) (*Session, error) {
 	ret := &Session{
 		addr:        addr,
 		asn:         asn,
@@ -354,8 +451,11 @@ func New(l log.Logger, addr string, asn uint32, routerID net.IP, peerASN uint32,
 		holdTime:    holdTime,
 		logger:      log.With(l, "peer", addr, "localASN", asn, "peerASN", peerASN),
 		newHoldTime: make(chan bool, 1),
+		desired:     map[string]*Advertisement{},
 		advertised:  map[string]*Advertisement{},
+		dirty:       map[string]bool{},
 		password:    password,
+		opts:        opts,
 	}
 	ret.cond = sync.NewCond(&ret.mu)
 	go ret.sendKeepalives()
@@ -367,14 +467,40 @@ func New(l log.Logger, addr string, asn uint32, routerID net.IP, peerASN uint32,
 	return ret, nil
 }
 
+// negotiateHoldTime returns the hold time of a session, the smaller
+// of ours and the peer's (RFC 4271 section 4.2). Zero, if either
+// side asks for it, disables keepalives and the hold timer.
+func negotiateHoldTime(ours, theirs time.Duration) time.Duration {
+	if theirs < ours {
+		return theirs
+	}
+	return ours
+}
+
+// holdTimerDeadline returns when the hold timer, restarted at now,
+// expires. With a zero hold time it never does, and the zero deadline
+// is returned.
+func holdTimerDeadline(holdTime time.Duration, now time.Time) time.Time {
+	if holdTime == 0 {
+		return time.Time{}
+	}
+	return now.Add(holdTime)
+}
+
 // consumeBGP receives BGP messages from the peer, and ignores
 // them. It does minimal checks for the well-formedness of messages,
-// and terminates the connection if something looks wrong.
-func (s *Session) consumeBGP(conn io.ReadCloser) {
+// and terminates the connection if something looks wrong, or if the
+// peer sends nothing for holdTime.
+func (s *Session) consumeBGP(conn net.Conn, holdTime time.Duration) {
+	expired := false
 	defer func() {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 		if s.conn == conn {
+			if expired {
+				s.logger.Log("event", "holdTimerExpired", "holdTime", holdTime, "msg", "no message from peer within hold time, closing session")
+				sendNotification(conn, 4, 0, nil)
+			}
 			s.abort()
 		} else {
 			conn.Close()
@@ -382,6 +508,9 @@ func (s *Session) consumeBGP(conn io.ReadCloser) {
 	}()
 
 	for {
+		if err := conn.SetReadDeadline(holdTimerDeadline(holdTime, time.Now())); err != nil {
+			return
+		}
 		hdr := struct {
 			Marker1, Marker2 uint64
 			Len              uint16
@@ -389,6 +518,7 @@ func (s *Session) consumeBGP(conn io.ReadCloser) {
 		}{}
 		if err := binary.Read(conn, binary.BigEndian, &hdr); err != nil {
 			// TODO: log, or propagate the error somehow.
+			expired = isTimeout(err)
 			return
 		}
 		if hdr.Marker1 != 0xffffffffffffffff || hdr.Marker2 != 0xffffffffffffffff {
@@ -403,11 +533,18 @@ func (s *Session) consumeBGP(conn io.ReadCloser) {
 		}
 		if _, err := io.Copy(ioutil.Discard, io.LimitReader(conn, int64(hdr.Len)-19)); err != nil {
 			// TODO: propagate
+			expired = isTimeout(err)
 			return
 		}
 	}
 }
 
+// isTimeout returns true if err is a read deadline expiring.
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
 // Set updates the set of Advertisements that this session's peer should receive.
 //
 // Changes are propagated to the peer asynchronously, Set may return
@@ -418,22 +555,86 @@ func (s *Session) Set(advs ...*Advertisement) error {
 
 	newAdvs := map[string]*Advertisement{}
 	for _, adv := range advs {
-		if adv.Prefix.IP.To4() == nil {
-			return fmt.Errorf("cannot advertise non-v4 prefix %q", adv.Prefix)
+		if err := validate(adv); err != nil {
+			return err
 		}
+		newAdvs[adv.Prefix.String()] = adv
+	}
 
-		if adv.NextHop != nil && adv.NextHop.To4() == nil {
-			return fmt.Errorf("next-hop must be IPv4, got %q", adv.NextHop)
+	for c, adv := range newAdvs {
+		if old := s.desired[c]; old == nil || !adv.Equal(old) {
+			s.dirty[c] = true
 		}
-		if len(adv.Communities) > 63 {
-			return fmt.Errorf("max supported communities is 63, got %d", len(adv.Communities))
+	}
+	for c := range s.desired {
+		if newAdvs[c] == nil {
+			s.dirty[c] = true
 		}
-		newAdvs[adv.Prefix.String()] = adv
 	}
+	s.desired = newAdvs
+	s.changed()
+	return nil
+}
 
-	s.new = newAdvs
-	stats.PendingPrefixes(s.addr, len(s.new))
-	s.cond.Broadcast()
+// Update changes the Advertisements of some prefixes, and leaves the
+// others alone: withdraw are no longer advertised, then advs are
+// added or replace the advertisement of their prefix. Unlike Set,
+// its cost is proportional to the number of changes, not to the
+// number of advertisements.
+//
+// Like Set, Update may return before the peer learns about the
+// changes.
+func (s *Session) Update(advs []*Advertisement, withdraw []*net.IPNet) error {
+	for _, adv := range advs {
+		if err := validate(adv); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pfx := range withdraw {
+		c := pfx.String()
+		if s.desired[c] != nil {
+			delete(s.desired, c)
+			s.dirty[c] = true
+		}
+	}
+	for _, adv := range advs {
+		c := adv.Prefix.String()
+		if old := s.desired[c]; old == nil || !adv.Equal(old) {
+			s.dirty[c] = true
+		}
+		s.desired[c] = adv
+	}
+	s.changed()
+	return nil
+}
+
+// changed wakes up sendUpdates if the desired state of some prefixes
+// changed.
+func (s *Session) changed() {
+	stats.PendingPrefixes(s.addr, len(s.desired))
+	if len(s.dirty) > 0 {
+		s.cond.Broadcast()
+	}
+}
+
+// validate returns an error if adv cannot be advertised.
+func validate(adv *Advertisement) error {
+	if adv.Prefix.IP.To4() == nil {
+		return fmt.Errorf("cannot advertise non-v4 prefix %q", adv.Prefix)
+	}
+	if adv.NextHop != nil && adv.NextHop.To4() == nil {
+		return fmt.Errorf("next-hop must be IPv4, got %q", adv.NextHop)
+	}
+	if len(adv.Communities) > 63 {
+		return fmt.Errorf("max supported communities is 63, got %d", len(adv.Communities))
+	}
+	if len(adv.ExtendedCommunities) > 31 {
+		return fmt.Errorf("max supported extended communities is 31, got %d", len(adv.ExtendedCommunities))
+	}
 	return nil
 }
 
@@ -444,16 +645,21 @@ func (s *Session) abort() {
 		s.conn.Close()
 		s.conn = nil
 		stats.SessionDown(s.addr)
+		monitor.peerDown(s.addr, s.closed)
 	}
-	// Next time we retry the connection, we can just skip straight to
-	// the desired end state.
-	if s.new != nil {
-		s.advertised, s.new = s.new, nil
-		stats.PendingPrefixes(s.addr, len(s.advertised))
-	}
+	// Next time we connect, sendUpdates starts over from the desired
+	// state.
 	s.cond.Broadcast()
 }
 
+// Established returns true if the session is currently established
+// with the peer.
+func (s *Session) Established() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil
+}
+
 // Close shuts down the BGP session.
 func (s *Session) Close() error {
 	s.mu.Lock()
@@ -463,6 +669,29 @@ func (s *Session) Close() error {
 	return nil
 }
 
+// Shutdown closes the session like Close, but first sends pending
+// changes to the peer, then tells it that the session is being shut
+// down on purpose: a Cease NOTIFICATION with subcode Administrative
+// Shutdown, carrying the shutdown communication msg (RFC 8203).
+//
+// To withdraw routes gracefully, callers should withdraw all
+// advertisements, and give the peer time to route around this node
+// before calling Shutdown.
+func (s *Session) Shutdown(msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && s.flush(s.asn == s.peerASN) {
+		if err := sendNotification(s.conn, 6, 2, shutdownCommunication(msg)); err != nil {
+			s.logger.Log("op", "shutdown", "error", err, "msg", "failed to send shutdown notification")
+		} else {
+			s.logger.Log("event", "sessionShutdown", "communication", msg, "msg", "sent administrative shutdown to peer")
+		}
+	}
+	s.closed = true
+	s.abort()
+	return nil
+}
+
 // Advertisement represents one network path and its BGP attributes.
 type Advertisement struct {
 	// The prefix being advertised to the peer.
@@ -472,8 +701,27 @@ type Advertisement struct {
 	// The local preference of this route. Only propagated to IBGP
 	// peers (i.e. where the peer ASN matches the local ASN).
 	LocalPref uint32
+	// The multi-exit discriminator of this route. Zero means the
+	// attribute is not sent.
+	MED uint32
 	// BGP communities to attach to the path.
 	Communities []uint32
+	// BGP extended communities (RFC4360) to attach to the path, in
+	// wire format.
+	ExtendedCommunities []uint64
+}
+
+// Well-known communities, from RFC1997 and RFC7999.
+const (
+	NoExportCommunity  uint32 = 0xffffff01 // 65535:65281
+	BlackholeCommunity uint32 = 0xffff029a // 65535:666
+)
+
+// LinkBandwidthCommunity returns the link bandwidth extended community
+// (draft-ietf-idr-link-bandwidth) of asn and bandwidth, in bytes per
+// second, in wire format. Routers weight ECMP paths by it.
+func LinkBandwidthCommunity(asn uint16, bandwidth float32) uint64 {
+	return 0x40<<56 | 0x04<<48 | uint64(asn)<<32 | uint64(math.Float32bits(bandwidth))
 }
 
 // Equal returns true if a and b are equivalent advertisements.
@@ -484,10 +732,13 @@ func (a *Advertisement) Equal(b *Advertisement) bool {
 	if !a.NextHop.Equal(b.NextHop) {
 		return false
 	}
-	if a.LocalPref != b.LocalPref {
+	if a.LocalPref != b.LocalPref || a.MED != b.MED {
+		return false
+	}
+	if !reflect.DeepEqual(a.Communities, b.Communities) {
 		return false
 	}
-	return reflect.DeepEqual(a.Communities, b.Communities)
+	return reflect.DeepEqual(a.ExtendedCommunities, b.ExtendedCommunities)
 }
 
 const (
@@ -512,7 +763,7 @@ type tcpmd5sig struct {
 // proper TCP MD5 options when the password is not empty. Works by manupulating
 // the low level FD's, skipping the net.Conn API as it has not hooks to set
 // the neccessary sockopts for TCP MD5.
-func dialMD5(ctx context.Context, addr, password string) (net.Conn, error) {
+func dialMD5(ctx context.Context, addr, password string, opts SessionOptions) (net.Conn, error) {
 	laddr, err := net.ResolveTCPAddr("tcp", "[::]:0")
 	if err != nil {
 		return nil, fmt.Errorf("Error resolving local address: %s ", err)
@@ -523,6 +774,13 @@ func dialMD5(ctx context.Context, addr, password string) (net.Conn, error) {
 		return nil, fmt.Errorf("invalid remote address: %s ", err)
 	}
 
+	if srcAddr := opts.SourceAddress; srcAddr != nil {
+		if (srcAddr.To4() == nil) != (raddr.IP.To4() == nil) {
+			return nil, fmt.Errorf("source address %s is not in the address family of %s", srcAddr, raddr.IP)
+		}
+		laddr.IP = srcAddr
+	}
+
 	var family int
 	var ra, la unix.Sockaddr
 	if raddr.IP.To4() != nil {
@@ -535,7 +793,17 @@ func dialMD5(ctx context.Context, addr, password string) (net.Conn, error) {
 		la = lsockaddr
 	} else {
 		family = unix.AF_INET6
-		rsockaddr := &unix.SockaddrInet6{Port: raddr.Port}
+		// Link-local peers, as on unnumbered links, are only
+		// reachable through the interface of their zone.
+		var rzone uint32
+		if raddr.Zone != "" {
+			intf, errs := net.InterfaceByName(raddr.Zone)
+			if errs != nil {
+				return nil, errs
+			}
+			rzone = uint32(intf.Index)
+		}
+		rsockaddr := &unix.SockaddrInet6{Port: raddr.Port, ZoneId: rzone}
 		copy(rsockaddr.Addr[:], raddr.IP.To16())
 		ra = rsockaddr
 		var zone uint32
@@ -577,8 +845,12 @@ func dialMD5(ctx context.Context, addr, password string) (net.Conn, error) {
 		}
 	}
 
-	if err = unix.Bind(fd, la); err != nil {
-		return nil, os.NewSyscallError("bind", err)
+	if err = setSocketOptions(fd, family, opts.Socket); err != nil {
+		return nil, err
+	}
+
+	if err = bindPort(fd, la, opts.SourcePorts); err != nil {
+		return nil, err
 	}
 
 	err = unix.Connect(fd, ra)
@@ -643,6 +915,81 @@ func dialMD5(ctx context.Context, addr, password string) (net.Conn, error) {
 	}
 }
 
+// setSocketOptions applies opts to fd, a socket of family.
+func setSocketOptions(fd, family int, opts SocketOptions) error {
+	if opts.KeepaliveInterval > 0 {
+		secs := int(opts.KeepaliveInterval / time.Second)
+		for _, o := range []struct{ level, opt, val int }{
+			{unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, secs},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, secs},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPCNT, opts.KeepaliveProbes},
+		} {
+			if o.val == 0 {
+				continue
+			}
+			if err := unix.SetsockoptInt(fd, o.level, o.opt, o.val); err != nil {
+				return os.NewSyscallError("setsockopt", err)
+			}
+		}
+	}
+	if opts.UserTimeout > 0 {
+		ms := int(opts.UserTimeout / time.Millisecond)
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, ms); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if opts.DSCP > 0 {
+		// The DSCP is the top 6 bits of the TOS / traffic class byte.
+		tos := int(opts.DSCP) << 2
+		level, opt := unix.IPPROTO_IP, unix.IP_TOS
+		if family == unix.AF_INET6 {
+			level, opt = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+		}
+		if err := unix.SetsockoptInt(fd, level, opt, tos); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+		// Setting IP_TOS only derives a priority from the legacy TOS
+		// bits, so CS6 would get none. Use the class selector
+		// instead, capped at 6, the highest priority that doesn't
+		// require CAP_NET_ADMIN.
+		prio := int(opts.DSCP >> 3)
+		if prio > 6 {
+			prio = 6
+		}
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PRIORITY, prio); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
+
+// bindPort binds fd to la, using a local port from ports. Ports are
+// tried starting from a random one, so that a port stuck in TIME_WAIT
+// after a reconnect doesn't block us.
+func bindPort(fd int, la unix.Sockaddr, ports PortRange) error {
+	if ports.Min == 0 {
+		return os.NewSyscallError("bind", unix.Bind(fd, la))
+	}
+
+	n := int(ports.Max) - int(ports.Min) + 1
+	start := rand.Intn(n)
+	var err error
+	for i := 0; i < n; i++ {
+		port := int(ports.Min) + (start+i)%n
+		switch sa := la.(type) {
+		case *unix.SockaddrInet4:
+			sa.Port = port
+		case *unix.SockaddrInet6:
+			sa.Port = port
+		}
+		if err = unix.Bind(fd, la); err != unix.EADDRINUSE {
+			return os.NewSyscallError("bind", err)
+		}
+	}
+	return fmt.Errorf("no free source port in %d-%d: %s", ports.Min, ports.Max, err)
+}
+
 func buildTCPMD5Sig(addr net.IP, key string) tcpmd5sig {
 	t := tcpmd5sig{}
 	if addr.To4() != nil {
@@ -84,7 +84,7 @@ func TestInterop(t *testing.T) {
 	}
 
 	l := log.NewNopLogger()
-	sess, err := New(l, "127.0.0.1:4179", 64543, net.ParseIP("2.3.4.5"), 64543, 10*time.Second, "")
+	sess, err := New(l, "127.0.0.1:4179", 64543, net.ParseIP("2.3.4.5"), 64543, 10*time.Second, "", "pandora", SessionOptions{})
 	if err != nil {
 		t.Fatalf("starting BGP session to GoBGP: %s", err)
 	}
@@ -124,7 +124,7 @@ func TestTCPMD5(t *testing.T) {
 	}
 
 	l := log.NewNopLogger()
-	sess, err := New(l, "127.0.0.1:5179", 64543, net.ParseIP("2.3.4.6"), 64543, 10*time.Second, "somepassword")
+	sess, err := New(l, "127.0.0.1:5179", 64543, net.ParseIP("2.3.4.6"), 64543, 10*time.Second, "somepassword", "pandora", SessionOptions{})
 	if err != nil {
 		t.Fatalf("starting BGP session to GoBGP: %s", err)
 	}
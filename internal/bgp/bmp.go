@@ -0,0 +1,340 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// BMP message types and flags, per RFC 7854 and RFC 8671.
+const (
+	bmpVersion = 3
+
+	bmpRouteMonitoring = 0
+	bmpPeerDown        = 2
+	bmpPeerUp          = 3
+	bmpInitiation      = 4
+
+	bmpInfoSysDescr = 1
+	bmpInfoSysName  = 2
+
+	bmpPeerFlagV = 0x80 // Peer address is IPv6
+	bmpPeerFlagL = 0x40 // Post-policy routes
+	bmpPeerFlagO = 0x10 // Adj-RIB-Out
+
+	// Peer down reasons. Reason 3, a remote close with a
+	// NOTIFICATION, must be followed by the NOTIFICATION PDU, and
+	// isn't used.
+	bmpPeerDownLocalNoNotification = 2
+	bmpPeerDownRemoteNoData        = 4
+
+	// Maximum number of messages buffered for a slow collector. Past
+	// this, the connection is dropped and the collector gets a fresh
+	// dump of the current state when it reconnects.
+	bmpMaxQueue = 10000
+
+	bmpWriteTimeout = 30 * time.Second
+)
+
+// monitor, if non-nil, receives the state of all sessions for export
+// to a BMP collector.
+var monitor *bmpExporter
+
+// ExportBMP streams the state of all BGP sessions, and the routes
+// advertised on them (Adj-RIB-Out, post-policy), to the BMP collector
+// at addr. It must be called before any session is created.
+//
+// The collector gets a full dump of the current state every time it
+// connects, followed by live updates.
+func ExportBMP(l log.Logger, addr, sysName string) {
+	monitor = newBMPExporter(log.With(l, "bmpCollector", addr), addr, sysName)
+	go monitor.run()
+}
+
+type bmpPeer struct {
+	addr     net.IP
+	asn      uint32
+	routerID uint32
+	// Peer Up message, replayed to new collector connections.
+	up []byte
+	// Route Monitoring message for each prefix advertised to the
+	// peer, replayed to new collector connections.
+	routes map[string][]byte
+}
+
+type bmpExporter struct {
+	logger  log.Logger
+	addr    string
+	sysName string
+	backoff backoff
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	peers     map[string]*bmpPeer
+	connected bool
+	queue     [][]byte
+}
+
+func newBMPExporter(l log.Logger, addr, sysName string) *bmpExporter {
+	ret := &bmpExporter{
+		logger:  l,
+		addr:    addr,
+		sysName: sysName,
+		peers:   map[string]*bmpPeer{},
+	}
+	ret.cond = sync.NewCond(&ret.mu)
+	return ret
+}
+
+// run tries to stay connected to the collector, and streams BMP
+// messages to it.
+func (e *bmpExporter) run() {
+	for {
+		conn, err := net.DialTimeout("tcp", e.addr, 10*time.Second)
+		if err != nil {
+			e.logger.Log("op", "connect", "error", err, "msg", "failed to connect to BMP collector")
+			time.Sleep(e.backoff.Duration())
+			continue
+		}
+		e.backoff.Reset()
+		e.logger.Log("event", "bmpConnected", "msg", "connected to BMP collector")
+
+		err = e.stream(conn)
+		conn.Close()
+		e.logger.Log("event", "bmpDisconnected", "error", err, "msg", "disconnected from BMP collector")
+	}
+}
+
+// stream sends the initiation message and a dump of the current state
+// on conn, then live updates until the connection fails.
+func (e *bmpExporter) stream(conn net.Conn) error {
+	e.mu.Lock()
+	msgs := e.dump()
+	e.connected = true
+	e.queue = nil
+	e.mu.Unlock()
+
+	for {
+		for _, msg := range msgs {
+			if err := conn.SetWriteDeadline(time.Now().Add(bmpWriteTimeout)); err != nil {
+				e.disconnect()
+				return err
+			}
+			if _, err := conn.Write(msg); err != nil {
+				e.disconnect()
+				return err
+			}
+		}
+
+		e.mu.Lock()
+		for e.connected && len(e.queue) == 0 {
+			e.cond.Wait()
+		}
+		if !e.connected {
+			e.mu.Unlock()
+			return errors.New("collector is too slow, dropping connection to resynchronize")
+		}
+		msgs, e.queue = e.queue, nil
+		e.mu.Unlock()
+	}
+}
+
+func (e *bmpExporter) disconnect() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.connected = false
+	e.queue = nil
+}
+
+// dump returns the messages that bring a new collector connection up
+// to date. Must be called with e.mu held.
+func (e *bmpExporter) dump() [][]byte {
+	ret := [][]byte{bmpInitiationMsg(e.sysName)}
+
+	peers := make([]string, 0, len(e.peers))
+	for p := range e.peers {
+		peers = append(peers, p)
+	}
+	sort.Strings(peers)
+	for _, name := range peers {
+		p := e.peers[name]
+		ret = append(ret, p.up)
+
+		pfxs := make([]string, 0, len(p.routes))
+		for pfx := range p.routes {
+			pfxs = append(pfxs, pfx)
+		}
+		sort.Strings(pfxs)
+		for _, pfx := range pfxs {
+			ret = append(ret, p.routes[pfx])
+		}
+	}
+	return ret
+}
+
+// send queues msg for the current collector connection, if any. Must
+// be called with e.mu held.
+func (e *bmpExporter) send(msg []byte) {
+	if !e.connected {
+		// The collector gets the current state when it
+		// (re)connects, nothing to queue.
+		return
+	}
+	if len(e.queue) >= bmpMaxQueue {
+		e.connected = false
+		e.queue = nil
+	} else {
+		e.queue = append(e.queue, msg)
+	}
+	e.cond.Broadcast()
+}
+
+// peerUp records that the session to peer was established. local and
+// remote are the endpoints of the session's TCP connection, and
+// sentOpen and rcvdOpen the full OPEN messages exchanged.
+func (e *bmpExporter) peerUp(peer string, asn, routerID uint32, local, remote *net.TCPAddr, sentOpen, rcvdOpen []byte) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p := &bmpPeer{
+		addr:     remote.IP,
+		asn:      asn,
+		routerID: routerID,
+		routes:   map[string][]byte{},
+	}
+	var b bytes.Buffer
+	b.Write(p.header(0, time.Now()))
+	b.Write(bmpAddr(local.IP))
+	binary.Write(&b, binary.BigEndian, uint16(local.Port))
+	binary.Write(&b, binary.BigEndian, uint16(remote.Port))
+	b.Write(sentOpen)
+	b.Write(rcvdOpen)
+	p.up = bmpMsg(bmpPeerUp, b.Bytes())
+
+	e.peers[peer] = p
+	e.send(p.up)
+}
+
+// peerDown records that the session to peer went down, either
+// because it was closed locally or because the connection failed.
+func (e *bmpExporter) peerDown(peer string, local bool) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p := e.peers[peer]
+	if p == nil {
+		return
+	}
+	delete(e.peers, peer)
+
+	var b bytes.Buffer
+	b.Write(p.header(0, time.Now()))
+	if local {
+		b.WriteByte(bmpPeerDownLocalNoNotification)
+		// No FSM event code.
+		binary.Write(&b, binary.BigEndian, uint16(0))
+	} else {
+		b.WriteByte(bmpPeerDownRemoteNoData)
+	}
+	e.send(bmpMsg(bmpPeerDown, b.Bytes()))
+}
+
+// routes records that update, a BGP UPDATE message advertising or
+// withdrawing prefixes, was sent to peer.
+func (e *bmpExporter) routes(peer string, prefixes []*net.IPNet, withdraw bool, update []byte) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p := e.peers[peer]
+	if p == nil {
+		return
+	}
+	msg := bmpMsg(bmpRouteMonitoring, p.header(bmpPeerFlagL|bmpPeerFlagO, time.Now()), update)
+	for _, pfx := range prefixes {
+		if withdraw {
+			delete(p.routes, pfx.String())
+		} else {
+			p.routes[pfx.String()] = msg
+		}
+	}
+	e.send(msg)
+}
+
+// header returns the BMP per-peer header for p.
+func (p *bmpPeer) header(flags uint8, ts time.Time) []byte {
+	if p.addr.To4() == nil {
+		flags |= bmpPeerFlagV
+	}
+	var b bytes.Buffer
+	b.WriteByte(0) // Global instance peer
+	b.WriteByte(flags)
+	b.Write(make([]byte, 8)) // Peer distinguisher
+	b.Write(bmpAddr(p.addr))
+	// Peer AS, always 4 bytes (RFC 7854 section 4.2). The A flag is
+	// clear, the UPDATEs we send have 4-byte AS_PATHs too.
+	binary.Write(&b, binary.BigEndian, p.asn)
+	binary.Write(&b, binary.BigEndian, p.routerID)
+	binary.Write(&b, binary.BigEndian, uint32(ts.Unix()))
+	binary.Write(&b, binary.BigEndian, uint32(ts.Nanosecond()/1000))
+	return b.Bytes()
+}
+
+// bmpAddr encodes ip in the 16-byte form used by BMP, where IPv4
+// addresses occupy the low-order bytes.
+func bmpAddr(ip net.IP) []byte {
+	ret := make([]byte, 16)
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(ret[12:], ip4)
+	} else {
+		copy(ret, ip.To16())
+	}
+	return ret
+}
+
+func bmpInitiationMsg(sysName string) []byte {
+	var b bytes.Buffer
+	for _, tlv := range []struct {
+		typ uint16
+		val string
+	}{
+		{bmpInfoSysDescr, "MetalLB"},
+		{bmpInfoSysName, sysName},
+	} {
+		binary.Write(&b, binary.BigEndian, tlv.typ)
+		binary.Write(&b, binary.BigEndian, uint16(len(tlv.val)))
+		b.WriteString(tlv.val)
+	}
+	return bmpMsg(bmpInitiation, b.Bytes())
+}
+
+// bmpMsg returns a BMP message of type typ, with the concatenation of
+// parts as its body.
+func bmpMsg(typ uint8, parts ...[]byte) []byte {
+	l := 6
+	for _, p := range parts {
+		l += len(p)
+	}
+	ret := make([]byte, 6, l)
+	ret[0] = bmpVersion
+	binary.BigEndian.PutUint32(ret[1:5], uint32(l))
+	ret[5] = typ
+	for _, p := range parts {
+		ret = append(ret, p...)
+	}
+	return ret
+}
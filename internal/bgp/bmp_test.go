@@ -0,0 +1,166 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+// readBMP reads one BMP message from r, and returns its type and body.
+func readBMP(t *testing.T, r io.Reader) (uint8, []byte) {
+	hdr := make([]byte, 6)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		t.Fatalf("reading BMP header: %s", err)
+	}
+	if hdr[0] != bmpVersion {
+		t.Fatalf("wrong BMP version %d", hdr[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint32(hdr[1:5])-6)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("reading BMP body: %s", err)
+	}
+	return hdr[5], body
+}
+
+func TestBMPExport(t *testing.T) {
+	e := newBMPExporter(log.NewNopLogger(), "", "node1")
+
+	local := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 30000}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 179}
+	pfx := ipnet("1.2.3.0/24")
+
+	// State from before the collector connects is replayed to it.
+	e.peerUp("10.0.0.2:179", 64513, 0x0a000002, local, remote, []byte("sent"), []byte("rcvd"))
+	e.routes("10.0.0.2:179", []*net.IPNet{pfx}, false, []byte("update"))
+	// Unknown peers are ignored.
+	e.routes("10.0.0.3:179", []*net.IPNet{pfx}, false, []byte("update"))
+
+	collector, speaker := net.Pipe()
+	errs := make(chan error, 1)
+	go func() { errs <- e.stream(speaker) }()
+
+	typ, body := readBMP(t, collector)
+	if typ != bmpInitiation {
+		t.Fatalf("first message has type %d, want initiation", typ)
+	}
+	if !bytes.Contains(body, []byte("node1")) {
+		t.Errorf("initiation message doesn't have sysName, got %q", body)
+	}
+
+	typ, body = readBMP(t, collector)
+	if typ != bmpPeerUp {
+		t.Fatalf("second message has type %d, want peer up", typ)
+	}
+	if diff := cmp.Diff(bmpAddr(remote.IP), body[10:26]); diff != "" {
+		t.Errorf("wrong peer address in peer up (-want +got)\n%s", diff)
+	}
+	if got := binary.BigEndian.Uint32(body[26:30]); got != 64513 {
+		t.Errorf("wrong peer ASN in peer up, got %d", got)
+	}
+	if diff := cmp.Diff(bmpAddr(local.IP), body[42:58]); diff != "" {
+		t.Errorf("wrong local address in peer up (-want +got)\n%s", diff)
+	}
+	if got := string(body[62:]); got != "sentrcvd" {
+		t.Errorf("wrong OPEN messages in peer up, got %q", got)
+	}
+
+	typ, body = readBMP(t, collector)
+	if typ != bmpRouteMonitoring {
+		t.Fatalf("third message has type %d, want route monitoring", typ)
+	}
+	if got, want := body[1], uint8(bmpPeerFlagL|bmpPeerFlagO); got != want {
+		t.Errorf("route monitoring has peer flags %#x, want %#x", got, want)
+	}
+	if got := string(body[42:]); got != "update" {
+		t.Errorf("wrong BGP update in route monitoring, got %q", got)
+	}
+
+	// Live updates.
+	e.routes("10.0.0.2:179", []*net.IPNet{pfx}, true, []byte("withdraw"))
+	typ, body = readBMP(t, collector)
+	if typ != bmpRouteMonitoring || string(body[42:]) != "withdraw" {
+		t.Fatalf("got message type %d %q, want route monitoring of withdraw", typ, body)
+	}
+	e.peerDown("10.0.0.2:179", true)
+	typ, body = readBMP(t, collector)
+	if typ != bmpPeerDown {
+		t.Fatalf("got message type %d, want peer down", typ)
+	}
+	// Per-peer header, reason 2 and a zero FSM event code.
+	if diff := cmp.Diff([]byte{2, 0, 0}, body[42:]); diff != "" {
+		t.Errorf("wrong local peer down data (-want +got)\n%s", diff)
+	}
+	e.peerUp("10.0.0.2:179", 64513, 0x0a000002, local, remote, nil, nil)
+	if typ, _ = readBMP(t, collector); typ != bmpPeerUp {
+		t.Fatalf("got message type %d, want peer up", typ)
+	}
+	e.peerDown("10.0.0.2:179", false)
+	typ, body = readBMP(t, collector)
+	if typ != bmpPeerDown {
+		t.Fatalf("got message type %d, want peer down", typ)
+	}
+	// Reason 4, remote close without data, and nothing after it.
+	if diff := cmp.Diff([]byte{4}, body[42:]); diff != "" {
+		t.Errorf("wrong remote peer down data (-want +got)\n%s", diff)
+	}
+
+	collector.Close()
+	e.peerUp("10.0.0.2:179", 64513, 0x0a000002, local, remote, nil, nil)
+	if err := <-errs; err == nil {
+		t.Error("stream didn't fail after the collector went away")
+	}
+
+	// A new connection only sees the current state.
+	e.mu.Lock()
+	dump := e.dump()
+	e.mu.Unlock()
+	if len(dump) != 2 {
+		t.Errorf("got %d messages in dump, want initiation and peer up", len(dump))
+	}
+}
+
+func TestBMPPeerASN(t *testing.T) {
+	e := newBMPExporter(log.NewNopLogger(), "", "node1")
+	local := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 30000}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 179}
+
+	// A 4-byte ASN is reported as is, not as AS_TRANS (23456).
+	e.peerUp("10.0.0.2:179", 4200000001, 0x0a000002, local, remote, nil, nil)
+	e.routes("10.0.0.2:179", []*net.IPNet{ipnet("1.2.3.0/24")}, false, []byte("update"))
+	e.mu.Lock()
+	dump := e.dump()
+	e.mu.Unlock()
+	if len(dump) != 3 {
+		t.Fatalf("got %d messages in dump, want initiation, peer up and route monitoring", len(dump))
+	}
+	for _, msg := range dump[1:] {
+		// Common header, then the per-peer header: type, flags, peer
+		// distinguisher and address, and the 4-byte peer AS.
+		if got := binary.BigEndian.Uint32(msg[6+26 : 6+30]); got != 4200000001 {
+			t.Errorf("message type %d has peer AS %d, want 4200000001", msg[5], got)
+		}
+		if got := binary.BigEndian.Uint32(msg[6+30 : 6+34]); got != 0x0a000002 {
+			t.Errorf("message type %d has peer BGP ID %#x, want 0x0a000002, peer AS not 4 bytes", msg[5], got)
+		}
+	}
+}
+
+func TestBMPAddr(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want []byte
+	}{
+		{"1.2.3.4", []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}},
+		{"2001:db8::1", []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, bmpAddr(net.ParseIP(test.ip))); diff != "" {
+			t.Errorf("%s: wrong encoding (-want +got)\n%s", test.ip, diff)
+		}
+	}
+}
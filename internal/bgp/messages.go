@@ -8,9 +8,13 @@ import (
 	"io/ioutil"
 	"net"
 	"time"
+	"unicode/utf8"
 )
 
-func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration) error {
+// sendOpen sends an OPEN message. If extNextHop is true, it also
+// advertises the extended next-hop capability (RFC 5549) for IPv4
+// unicast prefixes with IPv6 next-hops.
+func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration, extNextHop bool) error {
 	if routerID.To4() == nil {
 		panic("non-ipv4 address used as RouterID")
 	}
@@ -83,14 +87,44 @@ func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration)
 	}
 	copy(msg.RouterID[:], routerID.To4())
 
-	return binary.Write(w, binary.BigEndian, msg)
+	ext := struct {
+		CapType uint8
+		CapLen  uint8
+		AFI     uint16
+		SAFI    uint16
+		NHAFI   uint16
+	}{
+		CapType: 5, // Extended next-hop encoding
+		CapLen:  6,
+		AFI:     1, // IPv4
+		SAFI:    1, // Unicast
+		NHAFI:   2, // IPv6
+	}
+	if extNextHop {
+		n := binary.Size(ext)
+		msg.Len += uint16(n)
+		msg.OptsLen += uint8(n)
+		msg.OptLen += uint8(n)
+	}
+
+	if err := binary.Write(w, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	if extNextHop {
+		return binary.Write(w, binary.BigEndian, ext)
+	}
+	return nil
 }
 
 type openResult struct {
 	asn      uint32
+	routerID uint32
 	holdTime time.Duration
 	mp4      bool
 	mp6      bool
+	// extNextHop4 is true if the peer accepts IPv6 next-hops for
+	// IPv4 unicast prefixes.
+	extNextHop4 bool
 }
 
 var notificationCodes = map[uint16]string{
@@ -119,6 +153,8 @@ var notificationCodes = map[uint16]string{
 	0x030a: "Invalid Network Field",
 	0x030b: "Malformed AS_PATH",
 
+	0x0400: "Hold Timer Expired",
+
 	0x0500: "BGP FSM state error (unspecific)",
 	0x0501: "Receive Unexpected Message in OpenSent State",
 	0x0502: "Receive Unexpected Message in OpenConfirm State",
@@ -191,11 +227,12 @@ func readOpen(r io.Reader) (*openResult, error) {
 		return nil, fmt.Errorf("wrong BGP version")
 	}
 	if open.HoldTime != 0 && open.HoldTime < 3 {
-		return nil, fmt.Errorf("invalid hold time %q, must be 0 or >=3s", open.HoldTime)
+		return nil, fmt.Errorf("invalid hold time %ds, must be 0 or >=3s", open.HoldTime)
 	}
 
 	ret := &openResult{
 		asn:      uint32(open.ASN16),
+		routerID: open.RouterID,
 		holdTime: time.Duration(open.HoldTime) * time.Second,
 	}
 
@@ -266,6 +303,16 @@ func readCapabilities(r io.Reader, ret *openResult) error {
 			case af.AFI == 2 && af.SAFI == 1:
 				ret.mp6 = true
 			}
+		case 5:
+			for lr.N > 0 {
+				nh := struct{ AFI, SAFI, NHAFI uint16 }{}
+				if err := binary.Read(&lr, binary.BigEndian, &nh); err != nil {
+					return err
+				}
+				if nh.AFI == 1 && nh.SAFI == 1 && nh.NHAFI == 2 {
+					ret.extNextHop4 = true
+				}
+			}
 		default:
 			// TODO: only ignore capabilities that we know are fine to
 			// ignore.
@@ -280,6 +327,10 @@ func readCapabilities(r io.Reader, ret *openResult) error {
 }
 
 func sendUpdate(w io.Writer, asn uint32, ibgp bool, defaultNextHop net.IP, adv *Advertisement) error {
+	if adv.NextHop == nil && defaultNextHop == nil {
+		return fmt.Errorf("no IPv4 next-hop available for %q, the session's local address is IPv6 and there is no IPv4 address on its interface", adv.Prefix)
+	}
+
 	var b bytes.Buffer
 
 	hdr := struct {
@@ -301,7 +352,9 @@ func sendUpdate(w io.Writer, asn uint32, ibgp bool, defaultNextHop net.IP, adv *
 		return err
 	}
 	binary.BigEndian.PutUint16(b.Bytes()[21:23], uint16(b.Len()-l))
-	encodePrefixes(&b, []*net.IPNet{adv.Prefix})
+	if !mpNextHop(defaultNextHop, adv) {
+		encodePrefixes(&b, []*net.IPNet{adv.Prefix})
+	}
 	binary.BigEndian.PutUint16(b.Bytes()[16:18], uint16(b.Len()))
 
 	if _, err := io.Copy(w, &b); err != nil {
@@ -345,14 +398,42 @@ func encodePathAttrs(b *bytes.Buffer, asn uint32, ibgp bool, defaultNextHop net.
 			return err
 		}
 	}
-	b.Write([]byte{
-		0x40, 3, // mandatory, next-hop
-		4, // len
-	})
-	if adv.NextHop != nil {
-		b.Write(adv.NextHop.To4())
+	if mpNextHop(defaultNextHop, adv) {
+		// The IPv6 next-hop doesn't fit in NEXT_HOP, the prefix
+		// goes in MP_REACH_NLRI instead (RFC 5549).
+		var nlri bytes.Buffer
+		encodePrefixes(&nlri, []*net.IPNet{adv.Prefix})
+		b.Write([]byte{
+			0x80, 14, // optional non-transitive, mp-reach-nlri
+		})
+		b.WriteByte(byte(5 + net.IPv6len + nlri.Len())) // len
+		b.Write([]byte{
+			0, 1, // AFI IPv4
+			1,           // SAFI unicast
+			net.IPv6len, // next-hop len
+		})
+		b.Write(defaultNextHop.To16())
+		b.WriteByte(0) // reserved
+		b.Write(nlri.Bytes())
 	} else {
-		b.Write(defaultNextHop)
+		b.Write([]byte{
+			0x40, 3, // mandatory, next-hop
+			4, // len
+		})
+		if adv.NextHop != nil {
+			b.Write(adv.NextHop.To4())
+		} else {
+			b.Write(defaultNextHop)
+		}
+	}
+	if adv.MED != 0 {
+		b.Write([]byte{
+			0x80, 4, // optional non-transitive, multi-exit-disc
+			4, // len
+		})
+		if err := binary.Write(b, binary.BigEndian, adv.MED); err != nil {
+			return err
+		}
 	}
 	if ibgp {
 		b.Write([]byte{
@@ -378,9 +459,30 @@ func encodePathAttrs(b *bytes.Buffer, asn uint32, ibgp bool, defaultNextHop net.
 		}
 	}
 
+	if len(adv.ExtendedCommunities) > 0 {
+		b.Write([]byte{
+			0xc0, 16, // optional transitive, extended communities
+		})
+		if err := binary.Write(b, binary.BigEndian, uint8(len(adv.ExtendedCommunities)*8)); err != nil {
+			return err
+		}
+		for _, c := range adv.ExtendedCommunities {
+			if err := binary.Write(b, binary.BigEndian, c); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
+// mpNextHop returns true if adv's next-hop is defaultNextHop, and
+// defaultNextHop is an IPv6 address that the peer accepted for IPv4
+// prefixes.
+func mpNextHop(defaultNextHop net.IP, adv *Advertisement) bool {
+	return adv.NextHop == nil && defaultNextHop != nil && defaultNextHop.To4() == nil
+}
+
 func sendWithdraw(w io.Writer, prefixes []*net.IPNet) error {
 	var b bytes.Buffer
 
@@ -411,6 +513,46 @@ func sendWithdraw(w io.Writer, prefixes []*net.IPNet) error {
 	return nil
 }
 
+// sendNotification sends a NOTIFICATION message with the given error
+// code, subcode and data.
+func sendNotification(w io.Writer, code, subcode uint8, data []byte) error {
+	var b bytes.Buffer
+	hdr := struct {
+		Marker1, Marker2 uint64
+		Len              uint16
+		Type             uint8
+		Code, Subcode    uint8
+	}{
+		Marker1: 0xffffffffffffffff,
+		Marker2: 0xffffffffffffffff,
+		Len:     uint16(21 + len(data)),
+		Type:    3,
+		Code:    code,
+		Subcode: subcode,
+	}
+	if err := binary.Write(&b, binary.BigEndian, hdr); err != nil {
+		return err
+	}
+	b.Write(data)
+	_, err := io.Copy(w, &b)
+	return err
+}
+
+// shutdownCommunication encodes msg as the data of an Administrative
+// Shutdown notification (RFC 8203): a length byte followed by at most
+// 128 bytes of UTF-8. Longer messages are truncated, without
+// splitting a character.
+func shutdownCommunication(msg string) []byte {
+	if len(msg) > 128 {
+		n := 128
+		for n > 0 && !utf8.RuneStart(msg[n]) {
+			n--
+		}
+		msg = msg[:n]
+	}
+	return append([]byte{byte(len(msg))}, msg...)
+}
+
 func sendKeepalive(w io.Writer) error {
 	msg := struct {
 		Marker1, Marker2 uint64
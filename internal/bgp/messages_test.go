@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -14,7 +15,7 @@ func TestOpen(t *testing.T) {
 	var b bytes.Buffer
 	wantHold := 4 * time.Second
 	wantASN := uint32(12345)
-	if err := sendOpen(&b, wantASN, net.ParseIP("1.2.3.4"), wantHold); err != nil {
+	if err := sendOpen(&b, wantASN, net.ParseIP("1.2.3.4"), wantHold, false); err != nil {
 		t.Fatalf("Send open: %s", err)
 	}
 	op, err := readOpen(&b)
@@ -27,6 +28,48 @@ func TestOpen(t *testing.T) {
 	if op.asn != wantASN {
 		t.Errorf("Wrong ASN, want %d, got %d", wantASN, op.asn)
 	}
+	if op.extNextHop4 {
+		t.Errorf("Peer accepts IPv6 next-hops, but none were offered")
+	}
+}
+
+func TestOpenHoldTime(t *testing.T) {
+	var b bytes.Buffer
+	if err := sendOpen(&b, 12345, net.ParseIP("1.2.3.4"), 0, false); err != nil {
+		t.Fatalf("Send open: %s", err)
+	}
+	op, err := readOpen(&b)
+	if err != nil {
+		t.Fatalf("Read open: %s", err)
+	}
+	if op.holdTime != 0 {
+		t.Errorf("Wrong hold-time, want 0, got %s", op.holdTime)
+	}
+
+	b.Reset()
+	if err := sendOpen(&b, 12345, net.ParseIP("1.2.3.4"), 2*time.Second, false); err != nil {
+		t.Fatalf("Send open: %s", err)
+	}
+	if _, err := readOpen(&b); err == nil {
+		t.Errorf("Accepted OPEN with hold-time 2s")
+	}
+}
+
+func TestOpenExtendedNextHop(t *testing.T) {
+	var b bytes.Buffer
+	if err := sendOpen(&b, 12345, net.ParseIP("1.2.3.4"), 4*time.Second, true); err != nil {
+		t.Fatalf("Send open: %s", err)
+	}
+	op, err := readOpen(&b)
+	if err != nil {
+		t.Fatalf("Read open: %s", err)
+	}
+	if !op.mp4 || !op.mp6 || op.asn != 12345 {
+		t.Errorf("Capabilities before extended next-hop were not preserved: %#v", op)
+	}
+	if !op.extNextHop4 {
+		t.Errorf("Peer doesn't accept IPv6 next-hops for IPv4 prefixes")
+	}
 }
 
 func TestPcapInterop(t *testing.T) {
@@ -46,3 +89,130 @@ func TestPcapInterop(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdateExtendedCommunities(t *testing.T) {
+	adv := &Advertisement{
+		Prefix:              &net.IPNet{IP: net.ParseIP("1.2.3.4").To4(), Mask: net.CIDRMask(32, 32)},
+		Communities:         []uint32{0xfc0004d2},
+		ExtendedCommunities: []uint64{0x0002fc000000007b, 0x01030a000001000a},
+	}
+	var b bytes.Buffer
+	if err := sendUpdate(&b, 64512, false, net.ParseIP("10.0.0.1").To4(), adv); err != nil {
+		t.Fatalf("Send update: %s", err)
+	}
+
+	want := []byte{
+		0xc0, 16, 16,
+		0x00, 0x02, 0xfc, 0x00, 0x00, 0x00, 0x00, 0x7b,
+		0x01, 0x03, 0x0a, 0x00, 0x00, 0x01, 0x00, 0x0a,
+	}
+	if !bytes.Contains(b.Bytes(), want) {
+		t.Errorf("UPDATE does not contain expected extended communities attribute\nwant: %x\ngot:  %x", want, b.Bytes())
+	}
+}
+
+func TestUpdateNextHop(t *testing.T) {
+	pfx := &net.IPNet{IP: net.ParseIP("1.2.3.4").To4(), Mask: net.CIDRMask(32, 32)}
+
+	// IPv6-only node, with an explicit next-hop.
+	adv := &Advertisement{
+		Prefix:  pfx,
+		NextHop: net.ParseIP("10.0.0.2"),
+	}
+	var b bytes.Buffer
+	if err := sendUpdate(&b, 64512, false, nil, adv); err != nil {
+		t.Fatalf("Send update: %s", err)
+	}
+	want := []byte{0x40, 3, 4, 10, 0, 0, 2}
+	if !bytes.Contains(b.Bytes(), want) {
+		t.Errorf("UPDATE does not contain expected next-hop attribute\nwant: %x\ngot:  %x", want, b.Bytes())
+	}
+
+	// IPv6-only node, without a next-hop.
+	adv = &Advertisement{
+		Prefix: pfx,
+	}
+	b.Reset()
+	if err := sendUpdate(&b, 64512, false, nil, adv); err == nil {
+		t.Errorf("Sent update without any IPv4 next-hop")
+	}
+
+	// Unnumbered link, the peer accepts our IPv6 link-local address
+	// as the next-hop.
+	b.Reset()
+	if err := sendUpdate(&b, 64512, false, net.ParseIP("fe80::1"), adv); err != nil {
+		t.Fatalf("Send update: %s", err)
+	}
+	want = []byte{
+		0x80, 14, 26,
+		0, 1, 1,
+		16, 0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0,
+		32, 1, 2, 3, 4,
+	}
+	if !bytes.HasSuffix(b.Bytes(), want) {
+		t.Errorf("UPDATE does not end with expected mp-reach-nlri attribute\nwant: %x\ngot:  %x", want, b.Bytes())
+	}
+	if bytes.Contains(b.Bytes(), []byte{0x40, 3, 4}) {
+		t.Errorf("UPDATE with an IPv6 next-hop contains a next-hop attribute: %x", b.Bytes())
+	}
+}
+
+func TestUpdateMED(t *testing.T) {
+	adv := &Advertisement{
+		Prefix: &net.IPNet{IP: net.ParseIP("1.2.3.4").To4(), Mask: net.CIDRMask(32, 32)},
+		MED:    300,
+	}
+	var b bytes.Buffer
+	if err := sendUpdate(&b, 64512, false, net.ParseIP("10.0.0.1").To4(), adv); err != nil {
+		t.Fatalf("Send update: %s", err)
+	}
+	want := []byte{0x80, 4, 4, 0, 0, 1, 0x2c}
+	if !bytes.Contains(b.Bytes(), want) {
+		t.Errorf("UPDATE does not contain expected MED attribute\nwant: %x\ngot:  %x", want, b.Bytes())
+	}
+
+	adv.MED = 0
+	b.Reset()
+	if err := sendUpdate(&b, 64512, false, net.ParseIP("10.0.0.1").To4(), adv); err != nil {
+		t.Fatalf("Send update: %s", err)
+	}
+	if bytes.Contains(b.Bytes(), []byte{0x80, 4, 4}) {
+		t.Errorf("UPDATE without MED contains a MED attribute: %x", b.Bytes())
+	}
+}
+
+func TestShutdownNotification(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"", ""},
+		{"node drained for maintenance", "node drained for maintenance"},
+		{strings.Repeat("a", 200), strings.Repeat("a", 128)},
+		// 127 bytes, then a 2-byte character that doesn't fit.
+		{strings.Repeat("a", 127) + "é", strings.Repeat("a", 127)},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := sendNotification(&b, 6, 2, shutdownCommunication(test.msg)); err != nil {
+			t.Fatalf("Send notification: %s", err)
+		}
+		bs := b.Bytes()
+		if len(bs) != 22+len(test.want) {
+			t.Fatalf("Wrong message length %d for %q, want %d", len(bs), test.msg, 22+len(test.want))
+		}
+		if got := int(bs[16])<<8 | int(bs[17]); got != len(bs) {
+			t.Errorf("Wrong length in header, got %d, want %d", got, len(bs))
+		}
+		if bs[18] != 3 || bs[19] != 6 || bs[20] != 2 {
+			t.Errorf("Wrong type/code/subcode, got %d/%d/%d, want 3/6/2", bs[18], bs[19], bs[20])
+		}
+		if got := string(bs[22:]); int(bs[21]) != len(test.want) || got != test.want {
+			t.Errorf("Wrong shutdown communication, got %q (length %d), want %q", got, bs[21], test.want)
+		}
+		if err := readNotification(bytes.NewReader(bs[19:])); err == nil || !strings.Contains(err.Error(), "Administrative Shutdown") {
+			t.Errorf("readNotification got %v, want an Administrative Shutdown error", err)
+		}
+	}
+}
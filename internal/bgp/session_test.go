@@ -0,0 +1,229 @@
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// countingConn is a connection to a peer that discards everything,
+// and counts the BGP messages written to it.
+type countingConn struct {
+	net.Conn
+	msgs int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.msgs++
+	return len(b), nil
+}
+
+func (c *countingConn) Close() error { return nil }
+
+// newTestSession returns a session that is established on conn, but
+// doesn't run its background goroutines. Tests drive it with flush.
+func newTestSession(conn net.Conn) *Session {
+	s := &Session{
+		addr:           "test",
+		asn:            64512,
+		peerASN:        64513,
+		logger:         log.NewNopLogger(),
+		conn:           conn,
+		defaultNextHop: net.ParseIP("10.0.0.1").To4(),
+		desired:        map[string]*Advertisement{},
+		advertised:     map[string]*Advertisement{},
+		dirty:          map[string]bool{},
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func testAdv(i int) *Advertisement {
+	return &Advertisement{
+		Prefix: &net.IPNet{
+			IP:   net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4(),
+			Mask: net.CIDRMask(32, 32),
+		},
+	}
+}
+
+func TestIncrementalUpdates(t *testing.T) {
+	conn := &countingConn{}
+	s := newTestSession(conn)
+
+	flush := func(desc string, wantMsgs int) {
+		t.Helper()
+		conn.msgs = 0
+		if !s.flush(false) {
+			t.Fatalf("%s: flush aborted the session", desc)
+		}
+		if conn.msgs != wantMsgs {
+			t.Errorf("%s: sent %d messages, want %d", desc, conn.msgs, wantMsgs)
+		}
+		if len(s.advertised) != len(s.desired) {
+			t.Errorf("%s: advertised %d prefixes, want %d", desc, len(s.advertised), len(s.desired))
+		}
+	}
+
+	var advs []*Advertisement
+	for i := 0; i < 10; i++ {
+		advs = append(advs, testAdv(i))
+	}
+	if err := s.Set(advs...); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	flush("initial set", 10)
+
+	if err := s.Set(advs...); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	flush("unchanged set", 0)
+
+	changed := *advs[3]
+	changed.LocalPref = 100
+	if err := s.Set(append(advs[:3:3], append([]*Advertisement{&changed}, advs[4:9]...)...)...); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	// One update for the changed prefix, one withdraw for the removed
+	// one.
+	flush("set with one change and one removal", 2)
+
+	if err := s.Update([]*Advertisement{testAdv(9), testAdv(10)}, []*net.IPNet{advs[0].Prefix, advs[1].Prefix}); err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+	// Two updates, and the two withdrawals in one message.
+	flush("update", 3)
+
+	if err := s.Update(nil, []*net.IPNet{testAdv(1000).Prefix}); err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+	flush("withdrawal of unknown prefix", 0)
+
+	if err := s.Update([]*Advertisement{{Prefix: &net.IPNet{IP: net.ParseIP("1000::"), Mask: net.CIDRMask(128, 128)}}}, nil); err == nil {
+		t.Error("Update accepted an IPv6 prefix")
+	}
+}
+
+func TestNegotiateHoldTime(t *testing.T) {
+	tests := []struct {
+		ours, theirs, want time.Duration
+	}{
+		{90 * time.Second, 90 * time.Second, 90 * time.Second},
+		{90 * time.Second, 30 * time.Second, 30 * time.Second},
+		{30 * time.Second, 90 * time.Second, 30 * time.Second},
+		{0, 90 * time.Second, 0},
+		{90 * time.Second, 0, 0},
+		{0, 0, 0},
+	}
+	for _, test := range tests {
+		if got := negotiateHoldTime(test.ours, test.theirs); got != test.want {
+			t.Errorf("negotiateHoldTime(%s, %s) = %s, want %s", test.ours, test.theirs, got, test.want)
+		}
+	}
+
+	now := time.Now()
+	if got := holdTimerDeadline(0, now); !got.IsZero() {
+		t.Errorf("zero hold time has deadline %s, want none", got)
+	}
+	if got := holdTimerDeadline(3*time.Second, now); !got.Equal(now.Add(3 * time.Second)) {
+		t.Errorf("hold timer deadline is %s, want %s", got, now.Add(3*time.Second))
+	}
+}
+
+func TestHoldTimer(t *testing.T) {
+	// The peer goes quiet, the hold timer expires.
+	client, server := net.Pipe()
+	s := newTestSession(client)
+	done := make(chan struct{})
+	go func() {
+		s.consumeBGP(client, 50*time.Millisecond)
+		close(done)
+	}()
+	if _, err := readOpen(server); err == nil || !strings.Contains(err.Error(), "Hold Timer Expired") {
+		t.Errorf("want hold timer expired notification, got %v", err)
+	}
+	<-done
+	if s.Established() {
+		t.Errorf("session still established after the hold timer expired")
+	}
+
+	// With a zero hold time, the quiet peer is kept.
+	client, server = net.Pipe()
+	s = newTestSession(client)
+	done = make(chan struct{})
+	go func() {
+		s.consumeBGP(client, 0)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if !s.Established() {
+		t.Errorf("session with zero hold time closed")
+	}
+	server.Close()
+	<-done
+}
+
+// BenchmarkUpdate measures the cost of changing one advertisement,
+// which must not depend on the number of advertised prefixes.
+func BenchmarkUpdate(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("prefixes=%d", n), func(b *testing.B) {
+			s := newTestSession(&countingConn{})
+			advs := make([]*Advertisement, 0, n)
+			for i := 0; i < n; i++ {
+				advs = append(advs, testAdv(i))
+			}
+			if err := s.Set(advs...); err != nil {
+				b.Fatalf("Set: %s", err)
+			}
+			s.flush(false)
+
+			extra := testAdv(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%2 == 0 {
+					s.Update([]*Advertisement{extra}, nil)
+				} else {
+					s.Update(nil, []*net.IPNet{extra.Prefix})
+				}
+				s.flush(false)
+			}
+		})
+	}
+}
+
+// BenchmarkSet measures the cost of changing one advertisement with
+// Set, which has to compare the whole table.
+func BenchmarkSet(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("prefixes=%d", n), func(b *testing.B) {
+			s := newTestSession(&countingConn{})
+			advs := make([]*Advertisement, 0, n+1)
+			for i := 0; i < n; i++ {
+				advs = append(advs, testAdv(i))
+			}
+			withExtra := append(advs[:n:n], testAdv(n))
+			if err := s.Set(advs...); err != nil {
+				b.Fatalf("Set: %s", err)
+			}
+			s.flush(false)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%2 == 0 {
+					s.Set(withExtra...)
+				} else {
+					s.Set(advs...)
+				}
+				s.flush(false)
+			}
+		})
+	}
+}
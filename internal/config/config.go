@@ -15,7 +15,9 @@
 package config // import "go.universe.tf/metallb/internal/config"
 
 import (
+	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/NetApp/nks-on-prem-ipam/pkg/ipam"
@@ -25,20 +27,100 @@ import (
 // configFile is the configuration as parsed out of the ConfigMap,
 // without validation or useful high level types.
 type configFile struct {
+	// Schema version, see CurrentVersion.
+	Version        int `yaml:"version"`
 	Peers          []peer
+	PeerGroups     []peerGroup       `yaml:"peer-groups"`
 	BGPCommunities map[string]string `yaml:"bgp-communities"`
 	Pools          []addressPool     `yaml:"address-pools"`
+	ServiceIPs     *serviceIPs       `yaml:"service-ip-advertisement"`
+	Strategy       string            `yaml:"auto-assign-strategy"`
+
+	MaintenanceWindows []maintenanceWindow `yaml:"maintenance-windows"`
 }
 
-type peer struct {
-	MyASN         uint32         `yaml:"my-asn"`
-	ASN           uint32         `yaml:"peer-asn"`
-	Addr          string         `yaml:"peer-address"`
-	Port          uint16         `yaml:"peer-port"`
-	HoldTime      string         `yaml:"hold-time"`
-	RouterID      string         `yaml:"router-id"`
+type maintenanceWindow struct {
+	Schedule      string         `yaml:"schedule"`
+	Duration      string         `yaml:"duration"`
+	TimeZone      string         `yaml:"time-zone"`
 	NodeSelectors []nodeSelector `yaml:"node-selectors"`
-	Password      string         `yaml:"password"`
+}
+
+type serviceIPs struct {
+	ClusterIPs        bool               `yaml:"cluster-ips"`
+	ExternalIPs       bool               `yaml:"external-ips"`
+	BGPAdvertisements []bgpAdvertisement `yaml:"bgp-advertisements"`
+}
+
+type peer struct {
+	MyASN           uint32           `yaml:"my-asn"`
+	ASN             uint32           `yaml:"peer-asn"`
+	Addr            string           `yaml:"peer-address"`
+	Port            uint16           `yaml:"peer-port"`
+	HoldTime        string           `yaml:"hold-time"`
+	RouterID        string           `yaml:"router-id"`
+	NodeSelectors   []nodeSelector   `yaml:"node-selectors"`
+	Password        string           `yaml:"password"`
+	PasswordSecret  *secretRef       `yaml:"password-secret"`
+	CommunityFilter *communityFilter `yaml:"community-filter"`
+	SourcePorts     string           `yaml:"source-ports"`
+	AnnouncePodCIDR bool             `yaml:"announce-pod-cidr"`
+	Description     string           `yaml:"description"`
+	RTBH            bool             `yaml:"rtbh"`
+	Network         string           `yaml:"network"`
+	Group           string           `yaml:"peer-group"`
+
+	TCPKeepalive       string `yaml:"tcp-keepalive"`
+	TCPKeepaliveProbes int    `yaml:"tcp-keepalive-probes"`
+	TCPUserTimeout     string `yaml:"tcp-user-timeout"`
+	DSCP               string `yaml:"dscp"`
+
+	Interface string `yaml:"interface"`
+
+	MyASNLabel string `yaml:"my-asn-label"`
+
+	MaxPrefixes int `yaml:"max-prefixes"`
+}
+
+// peerGroup holds session attributes shared by several peers. Peers
+// that reference the group inherit every attribute they don't set
+// themselves.
+type peerGroup struct {
+	Name            string           `yaml:"name"`
+	MyASN           uint32           `yaml:"my-asn"`
+	ASN             uint32           `yaml:"peer-asn"`
+	Port            uint16           `yaml:"peer-port"`
+	HoldTime        string           `yaml:"hold-time"`
+	RouterID        string           `yaml:"router-id"`
+	NodeSelectors   []nodeSelector   `yaml:"node-selectors"`
+	Password        string           `yaml:"password"`
+	PasswordSecret  *secretRef       `yaml:"password-secret"`
+	CommunityFilter *communityFilter `yaml:"community-filter"`
+	SourcePorts     string           `yaml:"source-ports"`
+	Network         string           `yaml:"network"`
+
+	TCPKeepalive       string `yaml:"tcp-keepalive"`
+	TCPKeepaliveProbes int    `yaml:"tcp-keepalive-probes"`
+	TCPUserTimeout     string `yaml:"tcp-user-timeout"`
+	DSCP               string `yaml:"dscp"`
+
+	MyASNLabel string `yaml:"my-asn-label"`
+
+	MaxPrefixes int `yaml:"max-prefixes"`
+}
+
+// secretRef points at a credential held by a secrets.Provider.
+type secretRef struct {
+	Source    string `yaml:"source"`
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+	Key       string `yaml:"key"`
+}
+
+type communityFilter struct {
+	StripAll bool     `yaml:"strip-all"`
+	Allow    []string `yaml:"allow"`
+	Add      []string `yaml:"add"`
 }
 
 type nodeSelector struct {
@@ -54,24 +136,71 @@ type selectorRequirements struct {
 
 type addressPool struct {
 	Protocol          Proto
+	Protocols         []Proto
 	Name              string
 	Addresses         []string
-	AvoidBuggyIPs     bool               `yaml:"avoid-buggy-ips"`
+	ReservedSuffixes  string             `yaml:"reserved-host-suffixes"`
+	ReservedOffsets   *reservedOffsets   `yaml:"reserved-offsets"`
 	AutoAssign        *bool              `yaml:"auto-assign"`
 	BGPAdvertisements []bgpAdvertisement `yaml:"bgp-advertisements"`
 	IPAM              ipamConfig         `yaml:"ipam"`
+	MaxLeaseDuration  string             `yaml:"max-lease-duration"`
+	LeaseExpiryPolicy string             `yaml:"lease-expiry-policy"`
+	FlapDamping       *flapDamping       `yaml:"flap-damping"`
+	ServiceOverrides  *serviceOverrides  `yaml:"service-overrides"`
+	RemovalPolicy     string             `yaml:"request-removal-policy"`
+	IPFamily          string             `yaml:"ip-family"`
+	Network           string             `yaml:"network"`
+
+	NetworkNamespace string `yaml:"network-namespace"`
+	VirtualMAC       string `yaml:"virtual-mac"`
+	Unnumbered       bool   `yaml:"unnumbered"`
+	SecondarySubnet  bool   `yaml:"secondary-subnet"`
+
+	Topology *topology `yaml:"topology"`
+
+	Labels map[string]string `yaml:"labels"`
+
+	MaintenanceWindows []maintenanceWindow `yaml:"maintenance-windows"`
+}
+
+type topology struct {
+	Key   string   `yaml:"key"`
+	Zones []string `yaml:"zones"`
+}
+
+type flapDamping struct {
+	MaxFlaps int    `yaml:"max-flaps"`
+	Window   string `yaml:"window"`
+	Hold     string `yaml:"hold"`
+}
+
+type reservedOffsets struct {
+	First int `yaml:"first"`
+	Last  int `yaml:"last"`
+}
+
+type serviceOverrides struct {
+	LocalPref string `yaml:"local-pref"`
+	MED       string `yaml:"med"`
 }
 
 type bgpAdvertisement struct {
-	AggregationLength *int `yaml:"aggregation-length"`
-	LocalPref         *uint32
-	Communities       []string
+	AggregationLength   *int `yaml:"aggregation-length"`
+	LocalPref           *uint32
+	Communities         []string
+	ExtendedCommunities []string       `yaml:"extended-communities"`
+	NodeSelectors       []nodeSelector `yaml:"node-selectors"`
+	Originators         int            `yaml:"aggregate-originators"`
+	EndpointWeight      string         `yaml:"endpoint-weight"`
 }
 
 type ipamConfig struct {
-	SecretName string `yaml:"secret-name"`
-	SecretKey  string `yaml:"secret-key"`
-	Namespace  string `yaml:"namespace"`
+	SecretSource string `yaml:"secret-source"`
+	SecretName   string `yaml:"secret-name"`
+	SecretKey    string `yaml:"secret-key"`
+	Namespace    string `yaml:"namespace"`
+	Shared       bool   `yaml:"shared"`
 }
 
 // Config is a parsed MetalLB configuration.
@@ -80,6 +209,31 @@ type Config struct {
 	Peers []*Peer
 	// Address pools from which to allocate load balancer IPs.
 	Pools map[string]*Pool
+	// Non-LoadBalancer service IPs to advertise over BGP. nil if
+	// only LoadBalancer IPs are advertised.
+	ServiceIPs *ServiceIPs
+	// How the pool of automatically assigned IPs is chosen. Empty
+	// means FirstFit.
+	AutoAssignStrategy AutoAssignStrategy
+	// Problems that don't prevent using the configuration, like
+	// deprecated settings or suspicious values.
+	Warnings []string
+
+	// Windows during which nodes hand the announcements of all pools
+	// over to other nodes.
+	MaintenanceWindows []*MaintenanceWindow
+}
+
+// ServiceIPs selects which IPs of services, other than their
+// LoadBalancer IP, are advertised over BGP, for clusters that route
+// service networks to the fabric.
+type ServiceIPs struct {
+	// Advertise spec.clusterIP.
+	ClusterIPs bool
+	// Advertise spec.externalIPs.
+	ExternalIPs bool
+	// How the IPs are translated into BGP announcements.
+	BGPAdvertisements []*BGPAdvertisement
 }
 
 // Proto holds the protocol we are speaking.
@@ -92,13 +246,58 @@ const (
 	IPAM         = "ipam"
 )
 
+// IPFamily is the address family policy of a pool.
+type IPFamily string
+
+// Supported pool address families.
+const (
+	IPv4Family IPFamily = "ipv4"
+	IPv6Family IPFamily = "ipv6"
+	DualStack  IPFamily = "dual"
+)
+
+// AutoAssignStrategy is how the pool to automatically assign an IP
+// from is chosen, among the pools with auto-assign.
+type AutoAssignStrategy string
+
+// Supported auto-assign strategies.
+const (
+	// FirstFit tries pools in name order.
+	FirstFit AutoAssignStrategy = "first-fit"
+	// BestFit tries the pools with the fewest free addresses first, so
+	// that large pools stay available for large allocations.
+	BestFit AutoAssignStrategy = "best-fit"
+)
+
+// ReservedHostSuffixes is the policy for IPv4 addresses of a pool
+// that are never handed out, because some devices mistake them for
+// network or broadcast addresses.
+type ReservedHostSuffixes string
+
+// Supported reserved host suffix policies.
+const (
+	// All addresses of the pool are handed out.
+	ReserveNone ReservedHostSuffixes = "none"
+	// The .0 and .255 addresses of every /24 the pool spans are
+	// reserved.
+	ReserveEvery24 ReservedHostSuffixes = "every-24"
+	// Only the network and broadcast addresses of the pool's CIDRs
+	// are reserved.
+	ReservePoolCIDR ReservedHostSuffixes = "pool-cidr"
+)
+
 // Peer is the configuration of a BGP peering session.
 type Peer struct {
-	// AS number to use for the local end of the session.
+	// AS number to use for the local end of the session. Zero when
+	// each node reads its own from MyASNLabel.
 	MyASN uint32
+	// If non-empty, the node label holding each node's local AS
+	// number, for designs that give every rack its own ASN.
+	MyASNLabel string
 	// AS number to expect from the remote end of the session.
 	ASN uint32
-	// Address to dial when establishing the session.
+	// Address to dial when establishing the session. nil for
+	// unnumbered peers whose address is discovered on Interface.
 	Addr net.IP
 	// Port to dial when establishing the session.
 	Port uint16
@@ -111,23 +310,121 @@ type Peer struct {
 	NodeSelectors []labels.Selector
 	// Authentication password for routers enforcing TCP MD5 authenticated sessions
 	Password string
+	// Rewrites the communities of advertisements sent to this
+	// peer. nil means advertisements are sent unmodified.
+	CommunityFilter *CommunityFilter
+	// Local TCP ports to connect from. The zero value lets the
+	// kernel pick an ephemeral port.
+	SourcePorts PortRange
+	// If true, each node also advertises its own pod CIDR to this
+	// peer, so pods are reachable without another BGP daemon.
+	AnnouncePodCIDR bool
+	// Human-readable description of the peer, for logs and metrics.
+	Description string
+	// If true, the peer only receives the blackhole routes of
+	// services under attack, see BlackholeAnnotation, and none of the
+	// regular advertisements.
+	RTBH bool
+	// If non-nil, the session is sourced from this node's address on
+	// the secondary network.
+	Network *NetworkRef
+	// Socket-level settings of the session, to detect dead
+	// connections before the hold timer expires.
+	TCP TCPOptions
+	// If non-empty, the session runs between the IPv6 link-local
+	// addresses of this interface and of the router on it (BGP
+	// unnumbered), and IPv4 prefixes are advertised with IPv6
+	// next-hops (RFC 5549).
+	Interface string
+	// Most prefixes each node advertises to the peer, to stay below
+	// the peer's max-prefix limit. Zero means no limit.
+	MaxPrefixes int
 	// TODO: more BGP session settings
 }
 
+// Host returns the host of p's session, for logs: its address, zoned
+// to its interface for unnumbered peers, or only the interface when
+// the address is discovered.
+func (p *Peer) Host() string {
+	switch {
+	case p.Interface == "":
+		return p.Addr.String()
+	case p.Addr == nil:
+		return "%" + p.Interface
+	default:
+		return p.Addr.String() + "%" + p.Interface
+	}
+}
+
+// TCPOptions are socket-level settings of a BGP session. The zero
+// value keeps the kernel's defaults.
+type TCPOptions struct {
+	// Idle time before the first TCP keepalive probe, and time
+	// between probes. Zero disables keepalives.
+	KeepaliveInterval time.Duration
+	// Unanswered probes after which the connection is dropped.
+	KeepaliveProbes int
+	// How long sent data may remain unacknowledged before the
+	// connection is dropped (TCP_USER_TIMEOUT).
+	UserTimeout time.Duration
+	// DSCP to mark the session's packets with, zero for none.
+	DSCP uint8
+}
+
+// NetworkRef names the Multus NetworkAttachmentDefinition of a
+// secondary host network.
+type NetworkRef struct {
+	Namespace string
+	Name      string
+}
+
+// String returns the "namespace/name" form of the reference, which is
+// also the key of the NetworkAttachmentDefinition.
+func (r NetworkRef) String() string {
+	return r.Namespace + "/" + r.Name
+}
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	Min, Max uint16
+}
+
+// CommunityFilter describes how the communities of outgoing
+// advertisements are rewritten for one peer. Filters are applied in
+// field order: strip, then allow, then add.
+type CommunityFilter struct {
+	// Remove all communities set by the address pool.
+	StripAll bool
+	// If non-empty, only communities in this set are kept.
+	Allow map[uint32]bool
+	// Communities attached to every advertisement, after stripping
+	// and allow-listing.
+	Add map[uint32]bool
+}
+
 // Pool is the configuration of an IP address pool.
 type Pool struct {
-	// Protocol for this pool.
+	// Protocol for this pool. For pools announced with several
+	// protocols, this is the first of Protocols.
 	Protocol Proto
+	// If non-empty, all the protocols that announce this pool.
+	Protocols []Proto
 	// The addresses that are part of this pool, expressed as CIDR
 	// prefixes. secret.Parse guarantees that these are
 	// non-overlapping, both within and between pools.
 	CIDR []*net.IPNet
 	// Some buggy consumer devices mistakenly drop IPv4 traffic for IP
-	// addresses ending in .0 or .255, due to poor implementations of
-	// smurf protection. This setting marks such addresses as
-	// unusable, for maximum compatibility with ancient parts of the
-	// internet.
-	AvoidBuggyIPs bool
+	// addresses that look like network or broadcast addresses, due to
+	// poor implementations of smurf protection. This policy marks
+	// such addresses as unusable, for maximum compatibility with
+	// ancient parts of the internet. Empty is the same as
+	// ReserveNone.
+	ReservedHostSuffixes ReservedHostSuffixes
+	// Other addresses that are never handed out: those reserved by
+	// ReservePoolCIDR, and the first and last few addresses of each
+	// entry of the pool's addresses, which may be wider than the
+	// prefixes in CIDR.
+	ReservedIPs []net.IP
 	// If false, prevents IP addresses to be automatically assigned
 	// from this pool.
 	AutoAssign bool
@@ -136,6 +433,305 @@ type Pool struct {
 	BGPAdvertisements []*BGPAdvertisement
 	// When an Protocol is IPAM then ip allocations go through the IPAM agent.
 	IPAM ipam.Agent
+	// If true, the IPAM network is shared with other clusters.
+	// Reservations are scoped by cluster ID, and IPs that another
+	// cluster also holds are rejected.
+	SharedIPAM bool
+	// How long a service may hold an IP from this pool. Zero means
+	// forever.
+	MaxLeaseDuration time.Duration
+	// If true, IPs held past MaxLeaseDuration are released. Otherwise
+	// the service only gets a warning event.
+	ReleaseExpiredLeases bool
+	// If true, a service whose spec.loadBalancerIP or address-pool
+	// annotation is removed gets a new IP from the auto-assign
+	// pools. Otherwise it keeps its current IP.
+	ReallocateOnRequestRemoval bool
+	// Address families the pool serves. Empty means whichever
+	// families its CIDRs contain.
+	IPFamily IPFamily
+	// Holds announcements of services that flap too often. nil
+	// disables damping.
+	FlapDamping *FlapDamping
+	// Values that services may pick for their BGP LOCAL_PREF and
+	// MULTI_EXIT_DISC with the LocalPrefAnnotation and MEDAnnotation
+	// annotations. nil means the pool doesn't allow overriding that
+	// attribute.
+	ServiceLocalPref *Uint32Range
+	ServiceMED       *Uint32Range
+	// If non-nil, layer2 announcements of IPs from this pool are
+	// only made on the node's interface to this secondary network.
+	Network *NetworkRef
+	// If not empty, layer2 announcements of IPs from this pool are
+	// made on the interfaces of this network namespace, given by
+	// path, instead of the host's.
+	NetworkNamespace string
+	// If non-nil, layer2 announcements of IPs from this pool are
+	// made with a virtual MAC, which moves to the announcing node,
+	// instead of the MAC of the node's interface. Its first four
+	// bytes are the pool's, see VirtualMACFor.
+	VirtualMAC net.HardwareAddr
+	// If true, the layer2 announcements of IPs from this pool are
+	// made for unnumbered or point-to-point links: the announcing
+	// node installs a host route for the IP, and sends gratuitous
+	// announcements to its neighbors on the link.
+	Unnumbered bool
+	// If true, IPs from this pool aren't in the subnets of the
+	// interfaces they're announced on: the announcing node adds them
+	// to a dummy interface, so that it accepts their traffic, and
+	// routers reach them with proxy ARP or an onlink route.
+	SecondarySubnet bool
+	// If non-nil, IPs from this pool are only announced from nodes
+	// in its zones, and the pool is preferred for services with
+	// endpoints there.
+	Topology *Topology
+	// Labels that services select the pool by, with the
+	// address-pool-selector annotation.
+	Labels labels.Set
+	// Windows during which nodes hand the announcements of this
+	// pool's IPs over to other nodes, in addition to the
+	// configuration's.
+	MaintenanceWindows []*MaintenanceWindow
+}
+
+// VirtualMACFor returns the virtual MAC that ip, one of the pool's
+// IPs, is announced with, or nil if the pool has none. Like VRRP's,
+// its last two bytes come from the IP: the IPs of a pool are announced
+// from different nodes, and each node must own the MACs it announces.
+func (p *Pool) VirtualMACFor(ip net.IP) net.HardwareAddr {
+	if p.VirtualMAC == nil {
+		return nil
+	}
+	ip = ip.To16()
+	mac := append(net.HardwareAddr(nil), p.VirtualMAC[:4]...)
+	return append(mac, ip[14], ip[15])
+}
+
+// DefaultTopologyKey is the node label holding the zone of each node,
+// unless a pool's topology names another.
+const DefaultTopologyKey = "topology.kubernetes.io/zone"
+
+// Topology restricts a pool to the nodes of some zones.
+type Topology struct {
+	// Node label holding the zone of each node.
+	Key string
+	// Zones the pool's IPs are announced from.
+	Zones []string
+}
+
+// Matches returns true if a node with labels l is in one of t's
+// zones.
+func (t *Topology) Matches(l labels.Set) bool {
+	zone, ok := l[t.Key]
+	if !ok {
+		return false
+	}
+	for _, z := range t.Zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxMaintenanceDuration is the longest a maintenance window may
+// last.
+const MaxMaintenanceDuration = 7 * 24 * time.Hour
+
+// MaintenanceWindow is a recurring period during which some nodes
+// stop announcing, so that their announcements move to other nodes
+// ahead of planned work like reboots, rather than failing over once
+// the node is gone.
+type MaintenanceWindow struct {
+	// When the window starts, in Location.
+	Schedule *Schedule
+	// How long the window lasts.
+	Duration time.Duration
+	Location *time.Location
+	// The nodes that are in maintenance during the window.
+	NodeSelectors []labels.Selector
+}
+
+// Active returns true if the window is open at now.
+func (w *MaintenanceWindow) Active(now time.Time) bool {
+	t := now.In(w.Location).Truncate(time.Minute)
+	for d := time.Duration(0); d < w.Duration; d += time.Minute {
+		if w.Schedule.Matches(t.Add(-d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers returns true if a node with labels l is in maintenance
+// while the window is open.
+func (w *MaintenanceWindow) Covers(l labels.Set) bool {
+	for _, sel := range w.NodeSelectors {
+		if sel.Matches(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// Annotations with which a service overrides the BGP attributes of
+// its advertisements, within the bounds its pool allows.
+const (
+	LocalPrefAnnotation = "metallb.universe.tf/bgp-local-pref"
+	MEDAnnotation       = "metallb.universe.tf/bgp-med"
+)
+
+// BlackholeAnnotation asks for a service's IP to be advertised with
+// the BLACKHOLE community (RFC7999), so that upstream networks drop
+// its traffic during a DDoS. The value is how long to blackhole for,
+// as a duration, which the controller replaces with the RFC3339 time
+// at which blackholing ends. The controller removes the annotation
+// once that time has passed.
+const BlackholeAnnotation = "metallb.universe.tf/bgp-blackhole"
+
+// Reserved returns true if ip must not be handed out according to
+// the pool's ReservedHostSuffixes.
+func (p *Pool) Reserved(ip net.IP) bool {
+	if p.ReservedHostSuffixes == ReserveEvery24 {
+		if ip4 := ip.To4(); ip4 != nil && (ip4[3] == 0 || ip4[3] == 255) {
+			return true
+		}
+	}
+	for _, r := range p.ReservedIPs {
+		if r.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Uint32Range is an inclusive range of uint32 values.
+type Uint32Range struct {
+	Min, Max uint32
+}
+
+// Contains returns true if v is within r.
+func (r *Uint32Range) Contains(v uint32) bool {
+	return v >= r.Min && v <= r.Max
+}
+
+func (r *Uint32Range) String() string {
+	if r.Min == r.Max {
+		return strconv.FormatUint(uint64(r.Min), 10)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// BGPOverrides are the BGP attributes a service requested for its
+// advertisements. nil fields are not overridden.
+type BGPOverrides struct {
+	LocalPref *uint32
+	MED       *uint32
+}
+
+// ServiceBGPOverrides returns the BGP attribute overrides requested
+// by a service's annotations. It returns an error if an annotation
+// is malformed, or requests a value that p doesn't allow.
+func (p *Pool) ServiceBGPOverrides(annotations map[string]string) (BGPOverrides, error) {
+	var (
+		ret BGPOverrides
+		err error
+	)
+	ret.LocalPref, err = parseOverride(annotations, LocalPrefAnnotation, p.ServiceLocalPref)
+	if err != nil {
+		return BGPOverrides{}, err
+	}
+	ret.MED, err = parseOverride(annotations, MEDAnnotation, p.ServiceMED)
+	if err != nil {
+		return BGPOverrides{}, err
+	}
+	return ret, nil
+}
+
+func parseOverride(annotations map[string]string, annotation string, allowed *Uint32Range) (*uint32, error) {
+	s, ok := annotations[annotation]
+	if !ok {
+		return nil, nil
+	}
+	if allowed == nil {
+		return nil, fmt.Errorf("%s is not allowed by the address pool", annotation)
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %s", annotation, s, err)
+	}
+	ret := uint32(v)
+	if !allowed.Contains(ret) {
+		return nil, fmt.Errorf("%s %d is outside of %s allowed by the address pool", annotation, ret, allowed)
+	}
+	return &ret, nil
+}
+
+// FlapDamping describes when a service's announcement is considered
+// to be flapping, and for how long it is then held steady.
+type FlapDamping struct {
+	// Number of announcement changes allowed within Window.
+	MaxFlaps int
+	// Period over which changes are counted.
+	Window time.Duration
+	// How long the announcement is held in its current state once
+	// MaxFlaps is exceeded.
+	Hold time.Duration
+}
+
+// ServesFamily returns true if IPv6 addresses, or IPv4 addresses if
+// isIPv6 is false, may be allocated from p.
+func (p *Pool) ServesFamily(isIPv6 bool) bool {
+	switch p.IPFamily {
+	case IPv4Family:
+		return !isIPv6
+	case IPv6Family:
+		return isIPv6
+	default:
+		return true
+	}
+}
+
+// AnnounceProtocols returns the protocols that announce IPs from p.
+func (p *Pool) AnnounceProtocols() []Proto {
+	if len(p.Protocols) > 0 {
+		return p.Protocols
+	}
+	return []Proto{p.Protocol}
+}
+
+// AnnouncedWith returns true if proto announces IPs from p.
+func (p *Pool) AnnouncedWith(proto Proto) bool {
+	for _, pp := range p.AnnounceProtocols() {
+		if pp == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// ProtocolAnnotation selects which of the protocols of its pool
+// announces a service, "layer2" or "bgp", for pools announced with
+// several protocols.
+const ProtocolAnnotation = "metallb.universe.tf/announce-protocol"
+
+// ServiceProtocols returns the protocols that announce a service with
+// annotations from p: the one ProtocolAnnotation selects, or all of
+// p's. If the annotation is malformed or selects a protocol p isn't
+// announced with, it returns an error along with all of p's protocols.
+func (p *Pool) ServiceProtocols(annotations map[string]string) ([]Proto, error) {
+	s, ok := annotations[ProtocolAnnotation]
+	if !ok {
+		return p.AnnounceProtocols(), nil
+	}
+	proto := Proto(s)
+	if proto != BGP && proto != Layer2 {
+		return p.AnnounceProtocols(), fmt.Errorf("invalid %s %q, must be bgp or layer2", ProtocolAnnotation, s)
+	}
+	if !p.AnnouncedWith(proto) {
+		return p.AnnounceProtocols(), fmt.Errorf("%s %q is not a protocol of the address pool", ProtocolAnnotation, s)
+	}
+	return []Proto{proto}, nil
 }
 
 // BGPAdvertisement describes one translation from an IP address to a BGP advertisement.
@@ -149,8 +745,42 @@ type BGPAdvertisement struct {
 	LocalPref uint32
 	// Value of the COMMUNITIES path attribute.
 	Communities map[uint32]bool
+	// Value of the EXTENDED_COMMUNITIES path attribute, in wire
+	// format (RFC4360).
+	ExtendedCommunities map[uint64]bool
+	// Nodes that originate this advertisement. Empty means all
+	// nodes.
+	NodeSelectors []labels.Selector
+	// If positive, only this many of the nodes with ready endpoints
+	// of a service originate the aggregate of its IP, elected per
+	// aggregate prefix. 0 means all nodes. Only set when
+	// AggregationLength is below 32.
+	AggregateOriginators int
+	// How each node weights this advertisement by the ready
+	// endpoints of the service it runs. Only set when
+	// AggregationLength is 32.
+	EndpointWeight EndpointWeight
 }
 
+// EndpointWeight is how a node weights its advertisements of a
+// service by how many of the service's ready endpoints it runs, so
+// that ECMP spreads traffic roughly in proportion to them.
+type EndpointWeight string
+
+// Supported endpoint weights.
+const (
+	// NoEndpointWeight advertises services alike from all nodes.
+	NoEndpointWeight EndpointWeight = ""
+	// LinkBandwidthWeight attaches a link bandwidth extended
+	// community of 1Gbps per ready endpoint on the node, for routers
+	// doing weighted ECMP.
+	LinkBandwidthWeight EndpointWeight = "link-bandwidth"
+	// MEDWeight sets the MED to the number of ready endpoints on
+	// other nodes, so that routers prefer the nodes with the most
+	// endpoints.
+	MEDWeight EndpointWeight = "med"
+)
+
 func cidrsOverlap(a, b *net.IPNet) bool {
 	return cidrContainsCIDR(a, b) || cidrContainsCIDR(b, a)
 }
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,40 +10,79 @@ import (
 	"github.com/NetApp/nks-on-prem-ipam/pkg/ipam/factory"
 	"github.com/mikioh/ipaddr"
 	"gopkg.in/yaml.v2"
+	"io"
 	"k8s.io/client-go/kubernetes"
+	"math"
 	"net"
+	"path"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
+	"go.universe.tf/metallb/internal/secrets"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 type Parser struct {
-	k8s kubernetes.Interface
+	// If true, warnings about the configuration are errors.
+	Strict bool
+	// Providers of the credentials that the configuration refers to,
+	// by source name. NewParser adds the Kubernetes provider.
+	Secrets map[string]secrets.Provider
+	// If non-nil, lists the cluster's node labels by node name, to
+	// check the labels that the configuration reads from nodes.
+	Nodes func() (map[string]labels.Set, error)
 }
 
 func NewParser(k8s kubernetes.Interface) Parser {
 	return Parser{
-		k8s: k8s,
+		Secrets: map[string]secrets.Provider{
+			secrets.KubernetesSource: secrets.Kubernetes(k8s),
+		},
 	}
 }
 
-// Parse loads and validates a Config from bs.
-func (cp Parser) Parse(bs []byte) (*Config, error) {
-	var raw configFile
-	if err := yaml.UnmarshalStrict(bs, &raw); err != nil {
-		return nil, fmt.Errorf("could not parse secret: %s", err)
+// getSecret looks up the credential ref points at. Its key defaults
+// to defaultKey.
+func (cp Parser) getSecret(ref *secretRef, defaultKey string) ([]byte, error) {
+	if ref.Name == "" {
+		return nil, errors.New("missing secret name")
+	}
+	source := ref.Source
+	if source == "" {
+		source = secrets.KubernetesSource
+	}
+	p := cp.Secrets[source]
+	if p == nil {
+		return nil, fmt.Errorf("secret source %q is not enabled", source)
+	}
+	key := ref.Key
+	if key == "" {
+		key = defaultKey
 	}
+	return p.Get(ref.Namespace, ref.Name, key)
+}
 
-	cfg := &Config{Pools: map[string]*Pool{}}
-	for i, p := range raw.Peers {
-		peer, err := cp.parsePeer(p)
-		if err != nil {
-			return nil, fmt.Errorf("parsing peer #%d: %s", i+1, err)
-		}
-		cfg.Peers = append(cfg.Peers, peer)
+// Parse loads and validates a Config from bs, which may hold several
+// YAML documents. They are merged as by ParseDocuments.
+func (cp Parser) Parse(bs []byte) (*Config, error) {
+	return cp.ParseDocuments([][]byte{bs})
+}
+
+// ParseDocuments loads and validates a Config split across docs, for
+// example the keys of a Secret. Each of docs may hold several YAML
+// documents. They are merged in order: peers, peer groups and address
+// pools are concatenated, bgp-communities are merged, and
+// service-ip-advertisement may only be set once. A community or
+// auto-assign-strategy defined several times must have the same value
+// each time.
+func (cp Parser) ParseDocuments(docs [][]byte) (*Config, error) {
+	raw, deprecated, err := mergeDocuments(docs)
+	if err != nil {
+		return nil, err
 	}
 
 	communities := map[string]uint32{}
@@ -53,7 +94,36 @@ func (cp Parser) Parse(bs []byte) (*Config, error) {
 		communities[n] = c
 	}
 
+	groups := map[string]*peerGroup{}
+	for i := range raw.PeerGroups {
+		g := &raw.PeerGroups[i]
+		if g.Name == "" {
+			return nil, fmt.Errorf("peer group #%d is missing name", i+1)
+		}
+		if groups[g.Name] != nil {
+			return nil, fmt.Errorf("duplicate definition of peer group %q", g.Name)
+		}
+		groups[g.Name] = g
+	}
+
+	cfg := &Config{Pools: map[string]*Pool{}}
+	for i, p := range raw.Peers {
+		if p.Group != "" {
+			g := groups[p.Group]
+			if g == nil {
+				return nil, fmt.Errorf("parsing peer #%d: unknown peer group %q", i+1, p.Group)
+			}
+			p = applyPeerGroup(p, g)
+		}
+		peer, err := cp.parsePeer(p, communities)
+		if err != nil {
+			return nil, fmt.Errorf("parsing peer #%d: %s", i+1, err)
+		}
+		cfg.Peers = append(cfg.Peers, peer)
+	}
+
 	var allCIDRs []*net.IPNet
+	vmacs := map[string]string{}
 	for i, p := range raw.Pools {
 		if p.Name == "" {
 			return nil, fmt.Errorf("pool #%d is missing name", i+1)
@@ -78,6 +148,16 @@ func (cp Parser) Parse(bs []byte) (*Config, error) {
 			return nil, fmt.Errorf("duplicate definition of pool %q", p.Name)
 		}
 
+		// Check that the IPs of different pools can't get the same
+		// virtual MAC.
+		if pool.VirtualMAC != nil {
+			k := pool.VirtualMAC[:4].String()
+			if vmacs[k] != "" {
+				return nil, fmt.Errorf("virtual-mac %s of pool %q has the same first four bytes as the one of pool %q", pool.VirtualMAC, p.Name, vmacs[k])
+			}
+			vmacs[k] = p.Name
+		}
+
 		// Check that all specified CIDR ranges are non-overlapping.
 		for _, cidr := range pool.CIDR {
 			for _, m := range allCIDRs {
@@ -91,9 +171,137 @@ func (cp Parser) Parse(bs []byte) (*Config, error) {
 		cfg.Pools[p.Name] = pool
 	}
 
+	if raw.ServiceIPs != nil {
+		sips, err := cp.parseServiceIPs(raw.ServiceIPs, communities)
+		if err != nil {
+			return nil, fmt.Errorf("parsing service-ip-advertisement: %s", err)
+		}
+		cfg.ServiceIPs = sips
+	}
+
+	switch s := AutoAssignStrategy(raw.Strategy); s {
+	case "", FirstFit, BestFit:
+		cfg.AutoAssignStrategy = s
+	default:
+		return nil, fmt.Errorf("unknown auto-assign-strategy %q", raw.Strategy)
+	}
+
+	for i, w := range raw.MaintenanceWindows {
+		mw, err := cp.parseMaintenanceWindow(w)
+		if err != nil {
+			return nil, fmt.Errorf("parsing maintenance window #%d: %s", i+1, err)
+		}
+		cfg.MaintenanceWindows = append(cfg.MaintenanceWindows, mw)
+	}
+
+	cfg.Warnings = append(deprecated, warnings(cfg)...)
+	if cp.Nodes != nil {
+		cfg.Warnings = append(cfg.Warnings, cp.nodeWarnings(cfg)...)
+	}
+	if cp.Strict && len(cfg.Warnings) > 0 {
+		return nil, fmt.Errorf("strict parsing: %s", strings.Join(cfg.Warnings, "; "))
+	}
+
 	return cfg, nil
 }
 
+func mergeDocuments(docs [][]byte) (*configFile, []string, error) {
+	var (
+		ret      = &configFile{}
+		warnings []string
+	)
+	for _, bs := range docs {
+		// Each document is decoded twice, in step: generically to
+		// find its version, and into a configFile. Documents of the
+		// current version are decoded from the original, so that
+		// errors point at the right lines.
+		versionDec := yaml.NewDecoder(bytes.NewReader(bs))
+		dec := yaml.NewDecoder(bytes.NewReader(bs))
+		dec.SetStrict(true)
+		for {
+			var doc map[interface{}]interface{}
+			err := versionDec.Decode(&doc)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not parse secret: %s", err)
+			}
+			if doc == nil {
+				// Empty document.
+				doc = map[interface{}]interface{}{}
+			}
+			v, err := documentVersion(doc)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			var raw configFile
+			if v == CurrentVersion {
+				err = dec.Decode(&raw)
+			} else {
+				dec.Decode(&yaml.MapSlice{})
+				var ws []string
+				ws, err = upgrade(doc, v)
+				if err != nil {
+					return nil, nil, err
+				}
+				warnings = append(warnings, ws...)
+				var converted []byte
+				converted, err = yaml.Marshal(doc)
+				if err == nil {
+					err = yaml.UnmarshalStrict(converted, &raw)
+				}
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not parse secret: %s", err)
+			}
+
+			ret.Peers = append(ret.Peers, raw.Peers...)
+			ret.PeerGroups = append(ret.PeerGroups, raw.PeerGroups...)
+			ret.Pools = append(ret.Pools, raw.Pools...)
+			ret.MaintenanceWindows = append(ret.MaintenanceWindows, raw.MaintenanceWindows...)
+			for n, v := range raw.BGPCommunities {
+				if old, ok := ret.BGPCommunities[n]; ok && old != v {
+					return nil, nil, fmt.Errorf("community %q defined twice, as %q and %q", n, old, v)
+				}
+				if ret.BGPCommunities == nil {
+					ret.BGPCommunities = map[string]string{}
+				}
+				ret.BGPCommunities[n] = v
+			}
+			if raw.Strategy != "" {
+				if ret.Strategy != "" && ret.Strategy != raw.Strategy {
+					return nil, nil, fmt.Errorf("auto-assign-strategy defined twice, as %q and %q", ret.Strategy, raw.Strategy)
+				}
+				ret.Strategy = raw.Strategy
+			}
+			if raw.ServiceIPs != nil {
+				if ret.ServiceIPs != nil {
+					return nil, nil, errors.New("service-ip-advertisement defined more than once")
+				}
+				ret.ServiceIPs = raw.ServiceIPs
+			}
+		}
+	}
+	return ret, warnings, nil
+}
+
+func (cp Parser) parseServiceIPs(s *serviceIPs, communities map[string]uint32) (*ServiceIPs, error) {
+	if !s.ClusterIPs && !s.ExternalIPs {
+		return nil, errors.New("neither cluster-ips nor external-ips is enabled")
+	}
+	ads, err := cp.parseBGPAdvertisements(s.BGPAdvertisements, nil, communities)
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceIPs{
+		ClusterIPs:        s.ClusterIPs,
+		ExternalIPs:       s.ExternalIPs,
+		BGPAdvertisements: ads,
+	}, nil
+}
+
 func (cp Parser) createIPAMAgent(p addressPool) (ipam.Agent, error) {
 	config, err := cp.loadIPAMConfig(p.IPAM)
 	if err != nil {
@@ -152,23 +360,102 @@ func (cp Parser) parseHoldTime(ht string) (time.Duration, error) {
 	if err != nil {
 		return 0, fmt.Errorf("invalid hold time %q: %s", ht, err)
 	}
+	// Only an explicit zero disables the hold timer, not a duration
+	// that rounds down to it.
 	rounded := time.Duration(int(d.Seconds())) * time.Second
-	if rounded != 0 && rounded < 3*time.Second {
+	if d != 0 && rounded < 3*time.Second {
 		return 0, fmt.Errorf("invalid hold time %q: must be 0 or >=3s", ht)
 	}
+	// The OPEN message carries it in 16 bits.
+	if rounded > math.MaxUint16*time.Second {
+		return 0, fmt.Errorf("invalid hold time %q: must be at most %ds", ht, math.MaxUint16)
+	}
 	return rounded, nil
 }
 
-func (cp Parser) parsePeer(p peer) (*Peer, error) {
-	if p.MyASN == 0 {
+// ParseASN parses the AS number s, as read from a node label.
+func ParseASN(s string) (uint32, error) {
+	if s == "" {
+		return 0, errors.New("missing ASN")
+	}
+	asn, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || asn == 0 || asn == 4294967295 {
+		return 0, fmt.Errorf("invalid ASN %q", s)
+	}
+	return uint32(asn), nil
+}
+
+// applyPeerGroup returns p with the attributes it doesn't set taken
+// from g.
+func applyPeerGroup(p peer, g *peerGroup) peer {
+	if p.MyASN == 0 && p.MyASNLabel == "" {
+		p.MyASN = g.MyASN
+		p.MyASNLabel = g.MyASNLabel
+	}
+	if p.ASN == 0 {
+		p.ASN = g.ASN
+	}
+	if p.Port == 0 {
+		p.Port = g.Port
+	}
+	if p.HoldTime == "" {
+		p.HoldTime = g.HoldTime
+	}
+	if p.RouterID == "" {
+		p.RouterID = g.RouterID
+	}
+	if len(p.NodeSelectors) == 0 {
+		p.NodeSelectors = g.NodeSelectors
+	}
+	if p.Password == "" && p.PasswordSecret == nil {
+		p.Password = g.Password
+		p.PasswordSecret = g.PasswordSecret
+	}
+	if p.CommunityFilter == nil {
+		p.CommunityFilter = g.CommunityFilter
+	}
+	if p.SourcePorts == "" {
+		p.SourcePorts = g.SourcePorts
+	}
+	if p.Network == "" {
+		p.Network = g.Network
+	}
+	if p.TCPKeepalive == "" {
+		p.TCPKeepalive = g.TCPKeepalive
+	}
+	if p.TCPKeepaliveProbes == 0 {
+		p.TCPKeepaliveProbes = g.TCPKeepaliveProbes
+	}
+	if p.TCPUserTimeout == "" {
+		p.TCPUserTimeout = g.TCPUserTimeout
+	}
+	if p.DSCP == "" {
+		p.DSCP = g.DSCP
+	}
+	if p.MaxPrefixes == 0 {
+		p.MaxPrefixes = g.MaxPrefixes
+	}
+	return p
+}
+
+func (cp Parser) parsePeer(p peer, communities map[string]uint32) (*Peer, error) {
+	if p.MyASN == 0 && p.MyASNLabel == "" {
 		return nil, errors.New("missing local ASN")
 	}
+	if p.MyASNLabel != "" {
+		if p.MyASN != 0 {
+			return nil, errors.New("my-asn and my-asn-label are mutually exclusive")
+		}
+		if errs := validation.IsQualifiedName(p.MyASNLabel); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid my-asn-label %q: %s", p.MyASNLabel, strings.Join(errs, ", "))
+		}
+	}
 	if p.ASN == 0 {
 		return nil, errors.New("missing peer ASN")
 	}
-	ip := net.ParseIP(p.Addr)
-	if ip == nil {
-		return nil, fmt.Errorf("invalid peer IP %q", p.Addr)
+	ip, err := parsePeerAddress(p)
+	if err != nil {
+		return nil, err
 	}
 	holdTime, err := cp.parseHoldTime(p.HoldTime)
 	if err != nil {
@@ -187,6 +474,10 @@ func (cp Parser) parsePeer(p peer) (*Peer, error) {
 		if routerID == nil {
 			return nil, fmt.Errorf("invalid router ID %q", p.RouterID)
 		}
+		// BGP identifiers are 32 bits, even on IPv6-only nodes.
+		if routerID.To4() == nil {
+			return nil, fmt.Errorf("invalid router ID %q, must be an IPv4 address", p.RouterID)
+		}
 	}
 
 	// We use a non-pointer in the raw json object, so that if the
@@ -209,18 +500,351 @@ func (cp Parser) parsePeer(p peer) (*Peer, error) {
 	if p.Password != "" {
 		password = p.Password
 	}
+	if p.PasswordSecret != nil {
+		if p.Password != "" {
+			return nil, errors.New("password and password-secret are mutually exclusive")
+		}
+		bs, err := cp.getSecret(p.PasswordSecret, "password")
+		if err != nil {
+			return nil, fmt.Errorf("getting password: %s", err)
+		}
+		password = string(bs)
+	}
+
+	var filter *CommunityFilter
+	if p.CommunityFilter != nil {
+		filter, err = parseCommunityFilter(p.CommunityFilter, communities)
+		if err != nil {
+			return nil, fmt.Errorf("parsing community filter: %s", err)
+		}
+	}
+
+	if len(p.Description) > 255 {
+		return nil, fmt.Errorf("description %q is longer than 255 bytes", p.Description)
+	}
+	for _, r := range p.Description {
+		if !unicode.IsPrint(r) {
+			return nil, fmt.Errorf("description %q has non-printable character %q", p.Description, r)
+		}
+	}
+
+	if p.RTBH {
+		if p.AnnouncePodCIDR {
+			return nil, errors.New("cannot announce the pod CIDR to an rtbh peer")
+		}
+		if filter != nil {
+			return nil, errors.New("cannot have community-filter on an rtbh peer, blackhole routes are sent unfiltered")
+		}
+	}
+
+	var srcPorts PortRange
+	if p.SourcePorts != "" {
+		srcPorts, err = parsePortRange(p.SourcePorts)
+		if err != nil {
+			return nil, fmt.Errorf("parsing source ports: %s", err)
+		}
+	}
+
+	var network *NetworkRef
+	if p.Network != "" {
+		if p.Interface != "" {
+			return nil, errors.New("network and interface are mutually exclusive")
+		}
+		network, err = parseNetworkRef(p.Network)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tcp, err := parseTCPOptions(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.MaxPrefixes < 0 {
+		return nil, fmt.Errorf("invalid max-prefixes %d, must not be negative", p.MaxPrefixes)
+	}
+
 	return &Peer{
-		MyASN:         p.MyASN,
-		ASN:           p.ASN,
-		Addr:          ip,
-		Port:          port,
-		HoldTime:      holdTime,
-		RouterID:      routerID,
-		NodeSelectors: nodeSels,
-		Password:      password,
+		MyASN:           p.MyASN,
+		MyASNLabel:      p.MyASNLabel,
+		ASN:             p.ASN,
+		Addr:            ip,
+		Port:            port,
+		HoldTime:        holdTime,
+		RouterID:        routerID,
+		NodeSelectors:   nodeSels,
+		Password:        password,
+		CommunityFilter: filter,
+		SourcePorts:     srcPorts,
+		AnnouncePodCIDR: p.AnnouncePodCIDR,
+		Description:     p.Description,
+		RTBH:            p.RTBH,
+		Network:         network,
+		TCP:             tcp,
+		Interface:       p.Interface,
+		MaxPrefixes:     p.MaxPrefixes,
 	}, nil
 }
 
+// parsePeerAddress returns the address of peer p. Unnumbered peers,
+// on an interface, may omit it for the speaker to discover, or give a
+// link-local address. Link-local addresses are only meaningful on an
+// interface.
+func parsePeerAddress(p peer) (net.IP, error) {
+	if p.Interface != "" {
+		if len(p.Interface) > 15 || strings.ContainsAny(p.Interface, "/% \t") {
+			return nil, fmt.Errorf("invalid interface name %q", p.Interface)
+		}
+		if p.Addr == "" {
+			return nil, nil
+		}
+	}
+	ip := net.ParseIP(p.Addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid peer IP %q", p.Addr)
+	}
+	linkLocal := ip.To4() == nil && ip.IsLinkLocalUnicast()
+	switch {
+	case p.Interface != "" && !linkLocal:
+		return nil, fmt.Errorf("peer IP %q on interface %q is not an IPv6 link-local address", p.Addr, p.Interface)
+	case p.Interface == "" && linkLocal:
+		return nil, fmt.Errorf("link-local peer IP %q requires an interface", p.Addr)
+	}
+	return ip, nil
+}
+
+func parseTCPOptions(p peer) (TCPOptions, error) {
+	var ret TCPOptions
+	if p.TCPKeepalive != "" {
+		d, err := time.ParseDuration(p.TCPKeepalive)
+		if err != nil {
+			return ret, fmt.Errorf("invalid tcp-keepalive %q: %s", p.TCPKeepalive, err)
+		}
+		// The kernel counts keepalive times in seconds.
+		if d < time.Second || d%time.Second != 0 {
+			return ret, fmt.Errorf("invalid tcp-keepalive %q: must be a whole number of seconds", p.TCPKeepalive)
+		}
+		ret.KeepaliveInterval = d
+		ret.KeepaliveProbes = 3
+	}
+	if p.TCPKeepaliveProbes != 0 {
+		if ret.KeepaliveInterval == 0 {
+			return ret, errors.New("tcp-keepalive-probes requires tcp-keepalive")
+		}
+		if p.TCPKeepaliveProbes < 1 || p.TCPKeepaliveProbes > 127 {
+			return ret, fmt.Errorf("invalid tcp-keepalive-probes %d: must be between 1 and 127", p.TCPKeepaliveProbes)
+		}
+		ret.KeepaliveProbes = p.TCPKeepaliveProbes
+	}
+	if p.TCPUserTimeout != "" {
+		d, err := time.ParseDuration(p.TCPUserTimeout)
+		if err != nil {
+			return ret, fmt.Errorf("invalid tcp-user-timeout %q: %s", p.TCPUserTimeout, err)
+		}
+		if d < time.Millisecond {
+			return ret, fmt.Errorf("invalid tcp-user-timeout %q: must be at least 1ms", p.TCPUserTimeout)
+		}
+		ret.UserTimeout = d
+	}
+	if p.DSCP != "" {
+		dscp, err := parseDSCP(p.DSCP)
+		if err != nil {
+			return ret, err
+		}
+		ret.DSCP = dscp
+	}
+	return ret, nil
+}
+
+// dscpNames are the standard names of DSCP values (RFC 2474, RFC 2597
+// and RFC 3246).
+var dscpNames = map[string]uint8{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46,
+}
+
+// parseDSCP parses a DSCP given by name ("cs6") or by value ("48").
+func parseDSCP(s string) (uint8, error) {
+	if v, ok := dscpNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || v > 63 {
+		return 0, fmt.Errorf("invalid dscp %q, must be a name like cs6 or af41, or a number between 0 and 63", s)
+	}
+	return uint8(v), nil
+}
+
+// parseNetworkRef parses the "namespace/name" reference to a
+// NetworkAttachmentDefinition.
+func parseNetworkRef(s string) (*NetworkRef, error) {
+	fs := strings.Split(s, "/")
+	if len(fs) != 2 || fs[0] == "" || fs[1] == "" {
+		return nil, fmt.Errorf("invalid network %q, must be namespace/name of a NetworkAttachmentDefinition", s)
+	}
+	return &NetworkRef{Namespace: fs[0], Name: fs[1]}, nil
+}
+
+func parseTopology(t *topology) (*Topology, error) {
+	ret := &Topology{Key: t.Key}
+	if ret.Key == "" {
+		ret.Key = DefaultTopologyKey
+	}
+	if errs := validation.IsQualifiedName(ret.Key); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid key %q: %s", ret.Key, strings.Join(errs, ", "))
+	}
+	if len(t.Zones) == 0 {
+		return nil, errors.New("missing zones")
+	}
+	for _, z := range t.Zones {
+		if z == "" {
+			return nil, errors.New("empty zone")
+		}
+		if errs := validation.IsValidLabelValue(z); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid zone %q: %s", z, strings.Join(errs, ", "))
+		}
+		ret.Zones = append(ret.Zones, z)
+	}
+	return ret, nil
+}
+
+func parsePoolLabels(ls map[string]string) (labels.Set, error) {
+	ret := labels.Set{}
+	for k, v := range ls {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label key %q: %s", k, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label value %q for key %q: %s", v, k, strings.Join(errs, ", "))
+		}
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+func (cp Parser) parseMaintenanceWindow(w maintenanceWindow) (*MaintenanceWindow, error) {
+	sched, err := ParseSchedule(w.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	d, err := time.ParseDuration(w.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration %q: %s", w.Duration, err)
+	}
+	if d < time.Minute || d > MaxMaintenanceDuration {
+		return nil, fmt.Errorf("invalid duration %q, must be between 1m and %s", w.Duration, MaxMaintenanceDuration)
+	}
+	loc := time.UTC
+	if w.TimeZone != "" {
+		if loc, err = time.LoadLocation(w.TimeZone); err != nil {
+			return nil, fmt.Errorf("invalid time-zone %q, or no zoneinfo database (tzdata) to look it up in: %s", w.TimeZone, err)
+		}
+	}
+	// Putting every node in maintenance would withdraw everything
+	// rather than move it.
+	if len(w.NodeSelectors) == 0 {
+		return nil, errors.New("missing node-selectors")
+	}
+	ret := &MaintenanceWindow{
+		Schedule: sched,
+		Duration: d,
+		Location: loc,
+	}
+	for _, ns := range w.NodeSelectors {
+		sel, err := cp.parseNodeSelector(&ns)
+		if err != nil {
+			return nil, fmt.Errorf("parsing node selector: %s", err)
+		}
+		ret.NodeSelectors = append(ret.NodeSelectors, sel)
+	}
+	return ret, nil
+}
+
+// parseNetworkNamespace returns the path of a network namespace,
+// given by path or by its name in /var/run/netns like "ip netns"
+// takes it.
+func parseNetworkNamespace(s string) (string, error) {
+	if !strings.Contains(s, "/") {
+		return path.Join("/var/run/netns", s), nil
+	}
+	if !path.IsAbs(s) {
+		return "", fmt.Errorf("invalid network-namespace %q, must be a name in /var/run/netns or an absolute path", s)
+	}
+	return path.Clean(s), nil
+}
+
+// parsePortRange parses a single port ("1179") or an inclusive range
+// of ports ("40000-40099").
+// checkVirtualMACCIDRs checks that the IPs of cidrs get distinct
+// virtual MACs, which end with the last two bytes of each IP.
+func checkVirtualMACCIDRs(cidrs []*net.IPNet) error {
+	type span struct{ first, last int }
+	var spans []span
+	for _, cidr := range cidrs {
+		ones, bits := cidr.Mask.Size()
+		if bits-ones > 16 {
+			return fmt.Errorf("CIDR %q is too large for virtual-mac, which allows at most 65536 IPs per CIDR", cidr)
+		}
+		ip := cidr.IP.To16()
+		first := int(ip[14])<<8 | int(ip[15])
+		s := span{first, first + 1<<uint(bits-ones) - 1}
+		for i, o := range spans {
+			if s.first <= o.last && o.first <= s.last {
+				return fmt.Errorf("CIDRs %q and %q would share virtual MACs, the last two bytes of their IPs overlap", cidrs[i], cidr)
+			}
+		}
+		spans = append(spans, s)
+	}
+	return nil
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	fs := strings.SplitN(s, "-", 2)
+	min, err := strconv.ParseUint(strings.TrimSpace(fs[0]), 10, 16)
+	if err != nil || min == 0 {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	max := min
+	if len(fs) == 2 {
+		max, err = strconv.ParseUint(strings.TrimSpace(fs[1]), 10, 16)
+		if err != nil || max < min {
+			return PortRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return PortRange{Min: uint16(min), Max: uint16(max)}, nil
+}
+
+func parseCommunityFilter(f *communityFilter, communities map[string]uint32) (*CommunityFilter, error) {
+	ret := &CommunityFilter{
+		StripAll: f.StripAll,
+		Allow:    map[uint32]bool{},
+		Add:      map[uint32]bool{},
+	}
+	if f.StripAll && len(f.Allow) > 0 {
+		return nil, errors.New("strip-all and allow are mutually exclusive")
+	}
+	for _, c := range f.Allow {
+		v, err := lookupCommunity(c, communities)
+		if err != nil {
+			return nil, fmt.Errorf("invalid community %q in allow list: %s", c, err)
+		}
+		ret.Allow[v] = true
+	}
+	for _, c := range f.Add {
+		v, err := lookupCommunity(c, communities)
+		if err != nil {
+			return nil, fmt.Errorf("invalid community %q in add list: %s", c, err)
+		}
+		ret.Add[v] = true
+	}
+	return ret, nil
+}
+
 func (cp Parser) parseDynamicAddressPool(p addressPool, bgpCommunities map[string]uint32) (*Pool, error) {
 	agent, err := cp.createIPAMAgent(p)
 	if err != nil {
@@ -239,21 +863,49 @@ func (cp Parser) parseDynamicAddressPool(p addressPool, bgpCommunities map[strin
 		return nil, fmt.Errorf("parsing address pool %s: %w", p.Name, err)
 	}
 	pool.IPAM = agent
+	pool.SharedIPAM = p.IPAM.Shared
 
 	return pool, nil
 }
 
 func (cp Parser) parseAddressPool(p addressPool, bgpCommunities map[string]uint32) (*Pool, error) {
 	ret := &Pool{
-		Protocol:      p.Protocol,
-		AvoidBuggyIPs: p.AvoidBuggyIPs,
-		AutoAssign:    true,
+		Protocol:   p.Protocol,
+		AutoAssign: true,
 	}
 
 	if p.AutoAssign != nil {
 		ret.AutoAssign = *p.AutoAssign
 	}
 
+	if p.MaxLeaseDuration != "" {
+		d, err := time.ParseDuration(p.MaxLeaseDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max-lease-duration %q: %s", p.MaxLeaseDuration, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid max-lease-duration %q, must be positive", p.MaxLeaseDuration)
+		}
+		ret.MaxLeaseDuration = d
+	}
+	switch p.LeaseExpiryPolicy {
+	case "", "notify":
+	case "release":
+		ret.ReleaseExpiredLeases = true
+	default:
+		return nil, fmt.Errorf("unknown lease-expiry-policy %q, must be \"notify\" or \"release\"", p.LeaseExpiryPolicy)
+	}
+	if ret.ReleaseExpiredLeases && ret.MaxLeaseDuration == 0 {
+		return nil, errors.New("lease-expiry-policy requires max-lease-duration")
+	}
+	switch p.RemovalPolicy {
+	case "", "keep":
+	case "reallocate":
+		ret.ReallocateOnRequestRemoval = true
+	default:
+		return nil, fmt.Errorf("unknown request-removal-policy %q, must be \"keep\" or \"reallocate\"", p.RemovalPolicy)
+	}
+
 	if len(p.Addresses) == 0 && p.Protocol != IPAM {
 		return nil, errors.New("pool has no prefixes defined")
 	}
@@ -265,33 +917,276 @@ func (cp Parser) parseAddressPool(p addressPool, bgpCommunities map[string]uint3
 		ret.CIDR = append(ret.CIDR, nets...)
 	}
 
-	switch ret.Protocol {
-	case Layer2,IPAM:
-		if len(p.BGPAdvertisements) > 0 {
-			return nil, errors.New("cannot have bgp-advertisements configuration element in a layer2 address pool")
+	switch ReservedHostSuffixes(p.ReservedSuffixes) {
+	case "":
+	case ReserveNone, ReserveEvery24, ReservePoolCIDR:
+		ret.ReservedHostSuffixes = ReservedHostSuffixes(p.ReservedSuffixes)
+	default:
+		return nil, fmt.Errorf("unknown reserved-host-suffixes %q, must be %q, %q or %q", p.ReservedSuffixes, ReserveNone, ReserveEvery24, ReservePoolCIDR)
+	}
+	if ret.ReservedHostSuffixes == ReservePoolCIDR {
+		for _, cidr := range p.Addresses {
+			ret.ReservedIPs = appendReservedIPs(ret.ReservedIPs, cidrReservedIPs(cidr)...)
 		}
-	case BGP:
-		ads, err := parseBGPAdvertisements(p.BGPAdvertisements, ret.CIDR, bgpCommunities)
-		if err != nil {
-			return nil, fmt.Errorf("parsing BGP communities: %s", err)
+	}
+	if o := p.ReservedOffsets; o != nil {
+		if o.First < 0 || o.Last < 0 {
+			return nil, fmt.Errorf("invalid reserved-offsets %d/%d, must not be negative", o.First, o.Last)
+		}
+		for _, cidr := range p.Addresses {
+			// parseCIDR already succeeded above.
+			nets, _ := parseCIDR(cidr)
+			ips, err := offsetReservedIPs(nets, o.First, o.Last)
+			if err != nil {
+				return nil, fmt.Errorf("invalid reserved-offsets for %q in pool %q: %s", cidr, p.Name, err)
+			}
+			ret.ReservedIPs = appendReservedIPs(ret.ReservedIPs, ips...)
+		}
+	}
+
+	if len(p.Protocols) > 0 {
+		if p.Protocol != "" {
+			return nil, errors.New("cannot have both protocol and protocols configuration elements in an address pool")
+		}
+		seen := map[Proto]bool{}
+		for _, proto := range p.Protocols {
+			if proto != BGP && proto != Layer2 {
+				return nil, fmt.Errorf("invalid protocol %q in protocols, must be bgp or layer2", proto)
+			}
+			if seen[proto] {
+				return nil, fmt.Errorf("duplicate protocol %q in protocols", proto)
+			}
+			seen[proto] = true
 		}
-		ret.BGPAdvertisements = ads
+		ret.Protocol = p.Protocols[0]
+		ret.Protocols = p.Protocols
+	}
+
+	switch ret.Protocol {
+	case Layer2, IPAM, BGP:
 	case "":
 		return nil, errors.New("address pool is missing the protocol field")
 	default:
 		return nil, fmt.Errorf("unknown protocol %q", ret.Protocol)
 	}
 
+	if p.IPFamily != "" {
+		if err := checkIPFamily(IPFamily(p.IPFamily), ret); err != nil {
+			return nil, err
+		}
+		ret.IPFamily = IPFamily(p.IPFamily)
+	}
+
+	if p.Network != "" {
+		if !ret.AnnouncedWith(Layer2) && ret.Protocol != IPAM {
+			return nil, errors.New("cannot have network configuration element in an address pool not announced with layer2")
+		}
+		network, err := parseNetworkRef(p.Network)
+		if err != nil {
+			return nil, err
+		}
+		ret.Network = network
+	}
+
+	if p.NetworkNamespace != "" {
+		if !ret.AnnouncedWith(Layer2) && ret.Protocol != IPAM {
+			return nil, errors.New("cannot have network-namespace configuration element in an address pool not announced with layer2")
+		}
+		if ret.Network != nil {
+			return nil, errors.New("cannot have both network and network-namespace configuration elements in an address pool")
+		}
+		netns, err := parseNetworkNamespace(p.NetworkNamespace)
+		if err != nil {
+			return nil, err
+		}
+		ret.NetworkNamespace = netns
+	}
+
+	if p.VirtualMAC != "" {
+		if !ret.AnnouncedWith(Layer2) && ret.Protocol != IPAM {
+			return nil, errors.New("cannot have virtual-mac configuration element in an address pool not announced with layer2")
+		}
+		mac, err := net.ParseMAC(p.VirtualMAC)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("invalid virtual-mac %q, must be an Ethernet MAC address", p.VirtualMAC)
+		}
+		if mac[0]&1 != 0 || bytes.Equal(mac, make(net.HardwareAddr, 6)) {
+			return nil, fmt.Errorf("invalid virtual-mac %q, must be a unicast MAC address", p.VirtualMAC)
+		}
+		if mac[4] != 0 || mac[5] != 0 {
+			return nil, fmt.Errorf("invalid virtual-mac %q, the last two bytes must be zero, they are taken from each IP", p.VirtualMAC)
+		}
+		if err := checkVirtualMACCIDRs(ret.CIDR); err != nil {
+			return nil, err
+		}
+		ret.VirtualMAC = mac
+	}
+
+	if p.Unnumbered {
+		if !ret.AnnouncedWith(Layer2) && ret.Protocol != IPAM {
+			return nil, errors.New("cannot have unnumbered configuration element in an address pool not announced with layer2")
+		}
+		ret.Unnumbered = true
+	}
+
+	if p.SecondarySubnet {
+		if !ret.AnnouncedWith(Layer2) && ret.Protocol != IPAM {
+			return nil, errors.New("cannot have secondary-subnet configuration element in an address pool not announced with layer2")
+		}
+		if ret.Unnumbered {
+			return nil, errors.New("cannot have both unnumbered and secondary-subnet configuration elements in an address pool")
+		}
+		for _, cidr := range ret.CIDR {
+			if cidr.IP.To4() == nil {
+				return nil, fmt.Errorf("secondary-subnet only supports IPv4, but the address pool has %s", cidr)
+			}
+		}
+		ret.SecondarySubnet = true
+	}
+
+	if p.Topology != nil {
+		t, err := parseTopology(p.Topology)
+		if err != nil {
+			return nil, fmt.Errorf("parsing topology: %s", err)
+		}
+		ret.Topology = t
+	}
+
+	if len(p.Labels) > 0 {
+		ls, err := parsePoolLabels(p.Labels)
+		if err != nil {
+			return nil, err
+		}
+		ret.Labels = ls
+	}
+
+	for i, w := range p.MaintenanceWindows {
+		mw, err := cp.parseMaintenanceWindow(w)
+		if err != nil {
+			return nil, fmt.Errorf("parsing maintenance window #%d: %s", i+1, err)
+		}
+		ret.MaintenanceWindows = append(ret.MaintenanceWindows, mw)
+	}
+
+	if !ret.AnnouncedWith(BGP) {
+		if len(p.BGPAdvertisements) > 0 {
+			return nil, errors.New("cannot have bgp-advertisements configuration element in a layer2 address pool")
+		}
+		if p.FlapDamping != nil {
+			return nil, errors.New("cannot have flap-damping configuration element in a layer2 address pool")
+		}
+		if p.ServiceOverrides != nil {
+			return nil, errors.New("cannot have service-overrides configuration element in a layer2 address pool")
+		}
+		return ret, nil
+	}
+
+	ads, err := cp.parseBGPAdvertisements(p.BGPAdvertisements, ret.CIDR, bgpCommunities)
+	if err != nil {
+		return nil, fmt.Errorf("parsing BGP communities: %s", err)
+	}
+	ret.BGPAdvertisements = ads
+	if p.FlapDamping != nil {
+		fd, err := parseFlapDamping(p.FlapDamping)
+		if err != nil {
+			return nil, fmt.Errorf("parsing flap-damping: %s", err)
+		}
+		ret.FlapDamping = fd
+	}
+	if o := p.ServiceOverrides; o != nil {
+		if o.LocalPref != "" {
+			if ret.ServiceLocalPref, err = parseUint32Range(o.LocalPref); err != nil {
+				return nil, fmt.Errorf("parsing service-overrides local-pref: %s", err)
+			}
+		}
+		if o.MED != "" {
+			if ret.ServiceMED, err = parseUint32Range(o.MED); err != nil {
+				return nil, fmt.Errorf("parsing service-overrides med: %s", err)
+			}
+		}
+	}
+
 	return ret, nil
 }
 
-func parseBGPAdvertisements(ads []bgpAdvertisement, cidrs []*net.IPNet, communities map[string]uint32) ([]*BGPAdvertisement, error) {
+// parseUint32Range parses "min-max", or a single value.
+func parseUint32Range(s string) (*Uint32Range, error) {
+	fs := strings.SplitN(s, "-", 2)
+	min, err := strconv.ParseUint(strings.TrimSpace(fs[0]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range %q: %s", s, err)
+	}
+	max := min
+	if len(fs) == 2 {
+		if max, err = strconv.ParseUint(strings.TrimSpace(fs[1]), 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid range %q: %s", s, err)
+		}
+	}
+	if min > max {
+		return nil, fmt.Errorf("invalid range %q: start is after end", s)
+	}
+	return &Uint32Range{Min: uint32(min), Max: uint32(max)}, nil
+}
+
+// checkIPFamily validates that the CIDRs of pool match family.
+func checkIPFamily(family IPFamily, pool *Pool) error {
+	var v4, v6 bool
+	for _, cidr := range pool.CIDR {
+		if cidr.IP.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	switch family {
+	case IPv4Family:
+		if v6 {
+			return errors.New("ip-family ipv4 pool has IPv6 addresses")
+		}
+	case IPv6Family:
+		if v4 {
+			return errors.New("ip-family ipv6 pool has IPv4 addresses")
+		}
+	case DualStack:
+		if !v4 || !v6 {
+			return errors.New("ip-family dual pool must have both IPv4 and IPv6 addresses")
+		}
+	default:
+		return fmt.Errorf("unknown ip-family %q, must be \"ipv4\", \"ipv6\" or \"dual\"", family)
+	}
+	if pool.Protocol == IPAM && family != IPv4Family {
+		return errors.New("ipam pools only support ip-family ipv4")
+	}
+	return nil
+}
+
+func parseFlapDamping(f *flapDamping) (*FlapDamping, error) {
+	if f.MaxFlaps <= 0 {
+		return nil, fmt.Errorf("invalid max-flaps %d, must be positive", f.MaxFlaps)
+	}
+	window, err := time.ParseDuration(f.Window)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid window %q, must be a positive duration", f.Window)
+	}
+	hold, err := time.ParseDuration(f.Hold)
+	if err != nil || hold <= 0 {
+		return nil, fmt.Errorf("invalid hold %q, must be a positive duration", f.Hold)
+	}
+	return &FlapDamping{
+		MaxFlaps: f.MaxFlaps,
+		Window:   window,
+		Hold:     hold,
+	}, nil
+}
+
+func (cp Parser) parseBGPAdvertisements(ads []bgpAdvertisement, cidrs []*net.IPNet, communities map[string]uint32) ([]*BGPAdvertisement, error) {
 	if len(ads) == 0 {
 		return []*BGPAdvertisement{
 			{
-				AggregationLength: 32,
-				LocalPref:         0,
-				Communities:       map[uint32]bool{},
+				AggregationLength:   32,
+				LocalPref:           0,
+				Communities:         map[uint32]bool{},
+				ExtendedCommunities: map[uint64]bool{},
 			},
 		}, nil
 	}
@@ -299,9 +1194,10 @@ func parseBGPAdvertisements(ads []bgpAdvertisement, cidrs []*net.IPNet, communit
 	var ret []*BGPAdvertisement
 	for _, rawAd := range ads {
 		ad := &BGPAdvertisement{
-			AggregationLength: 32,
-			LocalPref:         0,
-			Communities:       map[uint32]bool{},
+			AggregationLength:   32,
+			LocalPref:           0,
+			Communities:         map[uint32]bool{},
+			ExtendedCommunities: map[uint64]bool{},
 		}
 
 		if rawAd.AggregationLength != nil {
@@ -317,20 +1213,50 @@ func parseBGPAdvertisements(ads []bgpAdvertisement, cidrs []*net.IPNet, communit
 			}
 		}
 
+		if rawAd.Originators < 0 {
+			return nil, fmt.Errorf("invalid aggregate-originators %d", rawAd.Originators)
+		}
+		if rawAd.Originators > 0 && ad.AggregationLength == 32 {
+			return nil, errors.New("aggregate-originators needs an aggregation-length below 32")
+		}
+		ad.AggregateOriginators = rawAd.Originators
+
+		switch w := EndpointWeight(rawAd.EndpointWeight); w {
+		case NoEndpointWeight, LinkBandwidthWeight, MEDWeight:
+			ad.EndpointWeight = w
+		default:
+			return nil, fmt.Errorf("unknown endpoint-weight %q, must be link-bandwidth or med", rawAd.EndpointWeight)
+		}
+		if ad.EndpointWeight != NoEndpointWeight && ad.AggregationLength != 32 {
+			return nil, errors.New("endpoint-weight needs an aggregation-length of 32")
+		}
+
 		if rawAd.LocalPref != nil {
 			ad.LocalPref = *rawAd.LocalPref
 		}
 
 		for _, c := range rawAd.Communities {
-			if v, ok := communities[c]; ok {
-				ad.Communities[v] = true
-			} else {
-				v, err := parseCommunity(c)
-				if err != nil {
-					return nil, fmt.Errorf("invalid community %q in BGP advertisement: %s", c, err)
-				}
-				ad.Communities[v] = true
+			v, err := lookupCommunity(c, communities)
+			if err != nil {
+				return nil, fmt.Errorf("invalid community %q in BGP advertisement: %s", c, err)
+			}
+			ad.Communities[v] = true
+		}
+
+		for _, c := range rawAd.ExtendedCommunities {
+			v, err := parseExtendedCommunity(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid extended community %q in BGP advertisement: %s", c, err)
+			}
+			ad.ExtendedCommunities[v] = true
+		}
+
+		for _, sel := range rawAd.NodeSelectors {
+			nodeSel, err := cp.parseNodeSelector(&sel)
+			if err != nil {
+				return nil, fmt.Errorf("parsing node selector in BGP advertisement: %s", err)
 			}
+			ad.NodeSelectors = append(ad.NodeSelectors, nodeSel)
 		}
 
 		ret = append(ret, ad)
@@ -339,6 +1265,15 @@ func parseBGPAdvertisements(ads []bgpAdvertisement, cidrs []*net.IPNet, communit
 	return ret, nil
 }
 
+// lookupCommunity resolves c either as an alias defined in
+// bgp-communities, or as a literal community.
+func lookupCommunity(c string, communities map[string]uint32) (uint32, error) {
+	if v, ok := communities[c]; ok {
+		return v, nil
+	}
+	return parseCommunity(c)
+}
+
 func parseCommunity(c string) (uint32, error) {
 	fs := strings.Split(c, ":")
 	if len(fs) != 2 {
@@ -356,6 +1291,59 @@ func parseCommunity(c string) (uint32, error) {
 	return (uint32(a) << 16) + uint32(b), nil
 }
 
+// parseExtendedCommunity parses a route-target or site-of-origin
+// extended community of the form <kind>:<administrator>:<assigned
+// number>, where kind is one of route-target (rt) or site-of-origin
+// (soo), and administrator is an ASN or an IPv4 address. The result
+// is the 8 byte wire encoding from RFC4360.
+func parseExtendedCommunity(c string) (uint64, error) {
+	fs := strings.Split(c, ":")
+	if len(fs) != 3 {
+		return 0, fmt.Errorf("invalid extended community string %q", c)
+	}
+
+	var subType uint64
+	switch fs[0] {
+	case "route-target", "rt":
+		subType = 0x02
+	case "site-of-origin", "soo":
+		subType = 0x03
+	default:
+		return 0, fmt.Errorf("unknown extended community kind %q, must be route-target or site-of-origin", fs[0])
+	}
+
+	if ip := net.ParseIP(fs[1]); ip != nil {
+		if ip.To4() == nil {
+			return 0, fmt.Errorf("invalid administrator %q, must be an IPv4 address", fs[1])
+		}
+		n, err := strconv.ParseUint(fs[2], 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid assigned number %q: %s", fs[2], err)
+		}
+		// IPv4 address specific extended community.
+		return 0x01<<56 | subType<<48 | uint64(binary.BigEndian.Uint32(ip.To4()))<<16 | n, nil
+	}
+
+	asn, err := strconv.ParseUint(fs[1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid administrator %q: %s", fs[1], err)
+	}
+	if asn <= 65535 {
+		n, err := strconv.ParseUint(fs[2], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid assigned number %q: %s", fs[2], err)
+		}
+		// Two-octet AS specific extended community.
+		return 0x00<<56 | subType<<48 | asn<<32 | n, nil
+	}
+	n, err := strconv.ParseUint(fs[2], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid assigned number %q: %s", fs[2], err)
+	}
+	// Four-octet AS specific extended community.
+	return 0x02<<56 | subType<<48 | asn<<16 | n, nil
+}
+
 func parseCIDR(cidr string) ([]*net.IPNet, error) {
 	if !strings.Contains(cidr, "-") {
 		_, n, err := net.ParseCIDR(cidr)
@@ -389,28 +1377,97 @@ func parseCIDR(cidr string) ([]*net.IPNet, error) {
 	return ret, nil
 }
 
+// cidrReservedIPs returns the network and broadcast addresses of
+// cidr, if it is an IPv4 CIDR that has them. IPv6 has no broadcast,
+// so IPv6 CIDRs only reserve their Subnet-Router anycast address.
+// Ranges have none.
+func cidrReservedIPs(cidr string) []net.IP {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil
+	}
+	if o, bits := n.Mask.Size(); o >= bits-1 {
+		return nil
+	}
+	if n.IP.To4() == nil {
+		return []net.IP{n.IP}
+	}
+	network := n.IP.To4()
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range network {
+		broadcast[i] = network[i] | ^n.Mask[i]
+	}
+	return []net.IP{network, broadcast}
+}
+
+// offsetReservedIPs returns the first and last addresses of the
+// address pool entry made of nets. It fails if that leaves no
+// address to hand out.
+func offsetReservedIPs(nets []*net.IPNet, first, last int) ([]net.IP, error) {
+	var pfxs []ipaddr.Prefix
+	for _, n := range nets {
+		pfxs = append(pfxs, *ipaddr.NewPrefix(n))
+	}
+	c := ipaddr.NewCursor(pfxs)
+
+	var ret []net.IP
+	pos := c.First()
+	for i := 0; i < first; i++ {
+		ret = append(ret, pos.IP)
+		if pos = c.Next(); pos == nil {
+			return nil, errors.New("no address left to allocate")
+		}
+	}
+	lowest := pos.IP
+
+	pos = c.Last()
+	if err := c.Set(pos); err != nil {
+		return nil, err
+	}
+	for i := 0; i < last; i++ {
+		ret = append(ret, pos.IP)
+		if pos = c.Prev(); pos == nil {
+			return nil, errors.New("no address left to allocate")
+		}
+	}
+	if bytes.Compare(lowest.To16(), pos.IP.To16()) > 0 {
+		return nil, errors.New("no address left to allocate")
+	}
+	return ret, nil
+}
+
+// appendReservedIPs appends the ips not in reserved yet to reserved.
+func appendReservedIPs(reserved []net.IP, ips ...net.IP) []net.IP {
+next:
+	for _, ip := range ips {
+		for _, r := range reserved {
+			if r.Equal(ip) {
+				continue next
+			}
+		}
+		reserved = append(reserved, ip)
+	}
+	return reserved
+}
+
 func (cp Parser) loadIPAMConfig(i ipamConfig) (*ipam.Config, error) {
 	if i.SecretName == "" {
 		return nil, fmt.Errorf("ipam secret secret name missing")
 	}
 
-	if i.Namespace == "" {
+	if i.Namespace == "" && (i.SecretSource == "" || i.SecretSource == secrets.KubernetesSource) {
 		return nil, fmt.Errorf("ipam secret secret namespace missing")
 	}
 
-	secretKey := "config.json"
-	if i.SecretKey != "" {
-		secretKey = i.SecretKey
+	ref := &secretRef{
+		Source:    i.SecretSource,
+		Namespace: i.Namespace,
+		Name:      i.SecretName,
+		Key:       i.SecretKey,
 	}
-
-	secret, err := cp.k8s.CoreV1().Secrets(i.Namespace).Get(i.SecretName, metav1.GetOptions{})
+	configBytes, err := cp.getSecret(ref, "config.json")
 	if err != nil {
-		return nil, fmt.Errorf("error getting ipam secret secret %s in namespace %s, %w", i.SecretName, i.Namespace, err)
-	}
-
-	configBytes, ok := secret.Data[secretKey]
-	if !ok {
-		return nil, fmt.Errorf("ipam secret missing from secret %s in namespace %s", i.SecretKey, i.Namespace)
+		return nil, fmt.Errorf("error getting ipam secret %s, %w", i.SecretName, err)
 	}
 
 	cfg := &ipam.Config{}
@@ -9,6 +9,7 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes/fake"
 	"net"
+	"sort"
 	"testing"
 	"time"
 )
@@ -25,6 +26,22 @@ func selector(s string) labels.Selector {
 	return ret
 }
 
+func schedule(s string) *Schedule {
+	ret, err := ParseSchedule(s)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+func location(name string) *time.Location {
+	ret, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
 func ipnet(s string) *net.IPNet {
 	_, n, err := net.ParseCIDR(s)
 	if err != nil {
@@ -56,7 +73,10 @@ func TestParse(t *testing.T) {
 		desc   string
 		secret *v1.Secret
 		raw    string
+		strict bool
 		want   *Config
+		// Labels of the cluster's nodes, if non-nil.
+		nodes map[string]labels.Set
 	}{
 		{
 			desc: "empty secret",
@@ -103,6 +123,7 @@ address-pools:
   - aggregation-length: 32
     localpref: 100
     communities: ["bar", "1234:2345"]
+    extended-communities: ["route-target:64512:123", "soo:10.0.0.1:10", "rt:100000:1"]
   - aggregation-length: 24
 - name: pool2
   protocol: bgp
@@ -140,10 +161,10 @@ address-pools:
 				},
 				Pools: map[string]*Pool{
 					"pool1": {
-						Protocol:      BGP,
-						CIDR:          []*net.IPNet{ipnet("10.20.0.0/16"), ipnet("10.50.0.0/24")},
-						AvoidBuggyIPs: true,
-						AutoAssign:    false,
+						Protocol:             BGP,
+						CIDR:                 []*net.IPNet{ipnet("10.20.0.0/16"), ipnet("10.50.0.0/24")},
+						ReservedHostSuffixes: ReserveEvery24,
+						AutoAssign:           false,
 						BGPAdvertisements: []*BGPAdvertisement{
 							{
 								AggregationLength: 32,
@@ -152,10 +173,16 @@ address-pools:
 									0xfc0004d2: true,
 									0x04D20929: true,
 								},
+								ExtendedCommunities: map[uint64]bool{
+									0x0002fc000000007b: true,
+									0x01030a000001000a: true,
+									0x0202000186a00001: true,
+								},
 							},
 							{
-								AggregationLength: 24,
-								Communities:       map[uint32]bool{},
+								AggregationLength:   24,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
 							},
 						},
 					},
@@ -165,8 +192,9 @@ address-pools:
 						AutoAssign: true,
 						BGPAdvertisements: []*BGPAdvertisement{
 							{
-								AggregationLength: 32,
-								Communities:       map[uint32]bool{},
+								AggregationLength:   32,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
 							},
 						},
 					},
@@ -188,6 +216,9 @@ address-pools:
 						AutoAssign: true,
 					},
 				},
+				Warnings: []string{
+					`address pool "pool1": avoid-buggy-ips is deprecated, use reserved-host-suffixes: every-24`,
+				},
 			},
 		},
 
@@ -215,83 +246,246 @@ peers:
 		},
 
 		{
-			desc: "invalid peer-address",
+			desc: "peer with community filter",
 			raw: `
 peers:
 - my-asn: 42
-  peer-asn: 42
-  peer-address: 1.2.3.400
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  community-filter:
+    allow: ["bar", "1234:2345"]
+    add: ["64512:1"]
+- my-asn: 42
+  peer-asn: 242
+  peer-address: 2.3.4.5
+  community-filter:
+    strip-all: true
+bgp-communities:
+  bar: 64512:1234
 `,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						CommunityFilter: &CommunityFilter{
+							Allow: map[uint32]bool{
+								0xfc0004d2: true,
+								0x04D20929: true,
+							},
+							Add: map[uint32]bool{
+								0xfc000001: true,
+							},
+						},
+					},
+					{
+						MyASN:         42,
+						ASN:           242,
+						Addr:          net.ParseIP("2.3.4.5"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						CommunityFilter: &CommunityFilter{
+							StripAll: true,
+							Allow:    map[uint32]bool{},
+							Add:      map[uint32]bool{},
+						},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "invalid my-asn",
+			desc: "peer with source ports",
 			raw: `
 peers:
-- peer-asn: 42
+- my-asn: 42
+  peer-asn: 142
   peer-address: 1.2.3.4
+  peer-port: 1179
+  source-ports: 40000-40099
+- my-asn: 42
+  peer-asn: 242
+  peer-address: 2.3.4.5
+  source-ports: "1179"
 `,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          1179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						SourcePorts:   PortRange{Min: 40000, Max: 40099},
+					},
+					{
+						MyASN:         42,
+						ASN:           242,
+						Addr:          net.ParseIP("2.3.4.5"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						SourcePorts:   PortRange{Min: 1179, Max: 1179},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "invalid peer-asn",
+			desc: "peer groups",
 			raw: `
+peer-groups:
+- name: tor
+  my-asn: 42
+  peer-asn: 142
+  hold-time: 30s
+  password: secret
 peers:
-- my-asn: 42
-  peer-address: 1.2.3.4
+- peer-address: 1.2.3.4
+  peer-group: tor
+- peer-address: 2.3.4.5
+  peer-group: tor
+  peer-asn: 242
+  hold-time: 60s
 `,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      30 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						Password:      "secret",
+					},
+					{
+						MyASN:         42,
+						ASN:           242,
+						Addr:          net.ParseIP("2.3.4.5"),
+						Port:          179,
+						HoldTime:      60 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						Password:      "secret",
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "invalid hold time (wrong format)",
+			desc: "per-node ASN",
 			raw: `
+peer-groups:
+- name: tor
+  my-asn-label: example.com/rack-asn
+  peer-asn: 142
 peers:
-- my-asn: 42
-  peer-asn: 42
-  peer-address: 1.2.3.4
-  hold-time: foo
+- peer-address: 1.2.3.4
+  peer-group: tor
+  node-selectors:
+  - match-labels:
+      rack: a
+- peer-address: 2.3.4.5
+  peer-group: tor
+  my-asn: 42
 `,
+			nodes: map[string]labels.Set{
+				"node1": {"rack": "a", "example.com/rack-asn": "64512"},
+				"node2": {"rack": "a"},
+				"node3": {"rack": "a", "example.com/rack-asn": "sixty"},
+				"node4": {"rack": "b"},
+			},
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASNLabel:    "example.com/rack-asn",
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{selector("rack=a")},
+					},
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("2.3.4.5"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+					},
+				},
+				Pools: map[string]*Pool{},
+				Warnings: []string{
+					`peer 1.2.3.4: node "node2" has no local ASN in label "example.com/rack-asn": missing ASN`,
+					`peer 1.2.3.4: node "node3" has no local ASN in label "example.com/rack-asn": invalid ASN "sixty"`,
+				},
+			},
 		},
 
 		{
-			desc: "invalid hold time (too short)",
+			desc: "my-asn and my-asn-label",
 			raw: `
 peers:
 - my-asn: 42
-  peer-asn: 42
+  my-asn-label: example.com/rack-asn
+  peer-asn: 142
   peer-address: 1.2.3.4
-  hold-time: 1s
 `,
 		},
 
 		{
-			desc: "invalid router ID",
+			desc: "invalid my-asn-label",
 			raw: `
 peers:
-- my-asn: 42
-  peer-asn: 42
+- my-asn-label: "rack asn"
+  peer-asn: 142
   peer-address: 1.2.3.4
-  router-id: oh god how do I BGP
 `,
 		},
 
 		{
-			desc: "empty node selector (select everything)",
+			desc: "max prefixes",
 			raw: `
+peer-groups:
+- name: tor
+  my-asn: 42
+  peer-asn: 142
+  max-prefixes: 100
 peers:
-- my-asn: 42
-  peer-asn: 42
-  peer-address: 1.2.3.4
+- peer-address: 1.2.3.4
+  peer-group: tor
+- peer-address: 2.3.4.5
+  peer-group: tor
+  max-prefixes: 10
 `,
 			want: &Config{
 				Peers: []*Peer{
 					{
 						MyASN:         42,
-						ASN:           42,
+						ASN:           142,
 						Addr:          net.ParseIP("1.2.3.4"),
 						Port:          179,
 						HoldTime:      90 * time.Second,
 						NodeSelectors: []labels.Selector{labels.Everything()},
+						MaxPrefixes:   100,
+					},
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("2.3.4.5"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						MaxPrefixes:   10,
 					},
 				},
 				Pools: map[string]*Pool{},
@@ -299,329 +493,2244 @@ peers:
 		},
 
 		{
-			desc: "invalid label node selector shape",
+			desc: "negative max prefixes",
 			raw: `
 peers:
 - my-asn: 42
-  peer-asn: 42
+  peer-asn: 142
   peer-address: 1.2.3.4
-  node-selectors:
-  - match-labels:
-      foo:
-        bar: baz
+  max-prefixes: -1
 `,
 		},
 
 		{
-			desc: "invalid expression node selector (missing key)",
+			desc: "tcp options",
 			raw: `
+peer-groups:
+- name: tor
+  tcp-keepalive: 5s
 peers:
 - my-asn: 42
-  peer-asn: 42
+  peer-asn: 142
   peer-address: 1.2.3.4
-  node-selectors:
-  - match-expressions:
-    - operator: In
-      values: [foo, bar]
+  peer-group: tor
+  tcp-keepalive-probes: 2
+  tcp-user-timeout: 20s
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 2.3.4.5
+  hold-time: 9s
+  tcp-keepalive: 3s
 `,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						TCP: TCPOptions{
+							KeepaliveInterval: 5 * time.Second,
+							KeepaliveProbes:   2,
+							UserTimeout:       20 * time.Second,
+						},
+					},
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("2.3.4.5"),
+						Port:          179,
+						HoldTime:      9 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						TCP: TCPOptions{
+							KeepaliveInterval: 3 * time.Second,
+							KeepaliveProbes:   3,
+						},
+					},
+				},
+				Pools: map[string]*Pool{},
+				Warnings: []string{
+					"peer 2.3.4.5: tcp-keepalive detects dead connections after 12s, not before hold-time 9s expires",
+				},
+			},
 		},
 
 		{
-			desc: "invalid expression node selector (missing operator)",
+			desc: "tcp-keepalive-probes without tcp-keepalive",
 			raw: `
 peers:
 - my-asn: 42
-  peer-asn: 42
+  peer-asn: 142
   peer-address: 1.2.3.4
-  node-selectors:
-  - match-expressions:
-    - key: foo
-      values: [foo, bar]
+  tcp-keepalive-probes: 2
 `,
 		},
 
 		{
-			desc: "invalid expression node selector (invalid operator)",
+			desc: "fractional tcp-keepalive",
 			raw: `
 peers:
 - my-asn: 42
-  peer-asn: 42
+  peer-asn: 142
   peer-address: 1.2.3.4
-  node-selectors:
-  - match-expressions:
-    - key: foo
-      operator: Surrounds
-      values: [foo, bar]
+  tcp-keepalive: 1500ms
 `,
 		},
 
 		{
-			desc: "invalid router ID",
+			desc: "dscp",
 			raw: `
+peer-groups:
+- name: tor
+  dscp: cs6
 peers:
 - my-asn: 42
-  peer-asn: 42
+  peer-asn: 142
   peer-address: 1.2.3.4
-  router-id: oh god how do I BGP
+  peer-group: tor
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 2.3.4.5
+  dscp: "46"
 `,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						TCP:           TCPOptions{DSCP: 48},
+					},
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("2.3.4.5"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						TCP:           TCPOptions{DSCP: 46},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "no pool name",
+			desc: "dscp out of range",
 			raw: `
-address-pools:
--
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  dscp: 64
 `,
 		},
 
 		{
-			desc: "address pool with no addresses",
+			desc: "unnumbered peers",
 			raw: `
-address-pools:
-- name: pool1
-  protocol: bgp
+peers:
+- my-asn: 42
+  peer-asn: 142
+  interface: swp1
+- my-asn: 42
+  peer-asn: 142
+  peer-address: fe80::1
+  interface: swp2
 `,
-		},
-
-		{
-			desc: "address pool with no protocol",
-			raw: `
-address-pools:
-- name: pool1
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						Interface:     "swp1",
+					},
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("fe80::1"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						Interface:     "swp2",
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "global address on unnumbered peer",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 2001:db8::1
+  interface: swp1
+`,
+		},
+
+		{
+			desc: "link-local peer without interface",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: fe80::1
+`,
+		},
+
+		{
+			desc: "unnumbered peer on secondary network",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  interface: swp1
+  network: storage/data-net
+`,
+		},
+
+		{
+			desc: "best-fit strategy",
+			raw: `
+auto-assign-strategy: best-fit
+`,
+			want: &Config{
+				Pools:              map[string]*Pool{},
+				AutoAssignStrategy: BestFit,
+			},
+		},
+
+		{
+			desc: "unknown strategy",
+			raw: `
+auto-assign-strategy: worst-fit
+`,
+		},
+
+		{
+			desc: "unknown peer group",
+			raw: `
+peers:
+- peer-address: 1.2.3.4
+  peer-group: tor
+`,
+		},
+
+		{
+			desc: "duplicate peer group",
+			raw: `
+peer-groups:
+- name: tor
+  my-asn: 42
+- name: tor
+  my-asn: 43
+peers:
+- peer-address: 1.2.3.4
+  peer-asn: 142
+  peer-group: tor
+`,
+		},
+
+		{
+			desc: "inverted source port range",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  source-ports: 40099-40000
+`,
+		},
+
+		{
+			desc: "invalid source port",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  source-ports: 70000
+`,
+		},
+
+		{
+			desc: "peer with pod CIDR announcement",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  announce-pod-cidr: true
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:           42,
+						ASN:             142,
+						Addr:            net.ParseIP("1.2.3.4"),
+						Port:            179,
+						HoldTime:        90 * time.Second,
+						NodeSelectors:   []labels.Selector{labels.Everything()},
+						AnnouncePodCIDR: true,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "rtbh peer",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  rtbh: true
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						RTBH:          true,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "rtbh peer with pod CIDR announcement",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  rtbh: true
+  announce-pod-cidr: true
+`,
+		},
+
+		{
+			desc: "peer with description",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  description: "rack 12 ToR, port Eth1/49"
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						Description:   "rack 12 ToR, port Eth1/49",
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "peer description with newline",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  description: "rack 12\nToR"
+`,
+		},
+
+		{
+			desc: "community filter with strip-all and allow",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  community-filter:
+    strip-all: true
+    allow: ["1234:2345"]
+`,
+		},
+
+		{
+			desc: "community filter with invalid community",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  community-filter:
+    add: ["flarb"]
+`,
+		},
+
+		{
+			desc: "invalid peer-address",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.400
+`,
+		},
+
+		{
+			desc: "invalid my-asn",
+			raw: `
+peers:
+- peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+		},
+
+		{
+			desc: "invalid peer-asn",
+			raw: `
+peers:
+- my-asn: 42
+  peer-address: 1.2.3.4
+`,
+		},
+
+		{
+			desc: "invalid hold time (wrong format)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: foo
+`,
+		},
+
+		{
+			desc: "invalid hold time (too short)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 1s
+`,
+		},
+
+		{
+			desc: "invalid hold time (rounds to zero)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 500ms
+`,
+		},
+
+		{
+			desc: "invalid hold time (too long)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 24h
+`,
+		},
+
+		{
+			desc: "hold time zero",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  hold-time: 0s
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 2.3.4.5
+  hold-time: "0"
+  tcp-keepalive: 5s
+  tcp-keepalive-probes: 3
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+					},
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("2.3.4.5"),
+						Port:          179,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						TCP:           TCPOptions{KeepaliveInterval: 5 * time.Second, KeepaliveProbes: 3},
+					},
+				},
+				Pools: map[string]*Pool{},
+				Warnings: []string{
+					"peer 1.2.3.4: hold-time 0 disables keepalives and the hold timer, a dead peer goes unnoticed without tcp-keepalive or tcp-user-timeout",
+				},
+			},
+		},
+
+		{
+			desc: "invalid router ID",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  router-id: oh god how do I BGP
+`,
+		},
+
+		{
+			desc: "IPv6 router ID",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 2001:db8::1
+  router-id: 2001:db8::2
+`,
+		},
+
+		{
+			desc: "empty node selector (select everything)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           42,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "invalid label node selector shape",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  node-selectors:
+  - match-labels:
+      foo:
+        bar: baz
+`,
+		},
+
+		{
+			desc: "invalid expression node selector (missing key)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  node-selectors:
+  - match-expressions:
+    - operator: In
+      values: [foo, bar]
+`,
+		},
+
+		{
+			desc: "invalid expression node selector (missing operator)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  node-selectors:
+  - match-expressions:
+    - key: foo
+      values: [foo, bar]
+`,
+		},
+
+		{
+			desc: "invalid expression node selector (invalid operator)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  node-selectors:
+  - match-expressions:
+    - key: foo
+      operator: Surrounds
+      values: [foo, bar]
+`,
+		},
+
+		{
+			desc: "invalid router ID",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  router-id: oh god how do I BGP
+`,
+		},
+
+		{
+			desc: "no pool name",
+			raw: `
+address-pools:
+-
+`,
+		},
+
+		{
+			desc: "address pool with no addresses",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+`,
+		},
+
+		{
+			desc: "address pool with no protocol",
+			raw: `
+address-pools:
+- name: pool1
+`,
+		},
+
+		{
+			desc: "address pool with unknown protocol",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: babel
+`,
+		},
+
+		{
+			desc: "invalid pool CIDR",
+			raw: `
+address-pools:
+- name: pool1
+  addresses:
+  - 100.200.300.400/24
+`,
+		},
+
+		{
+			desc: "invalid pool CIDR prefix length",
+			raw: `
+address-pools:
+- name: pool1
+  addresses:
+  - 1.2.3.0/33
+`,
+		},
+
+		{
+			desc: "simple advertisement",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["1.2.3.0/24"]
+  bgp-advertisements:
+  -
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "advertisement with default BGP settings",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: bgp
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "advertisements with node selectors",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: bgp
+  bgp-advertisements:
+  - aggregation-length: 24
+    node-selectors:
+    - match-labels:
+        role: border
+  - aggregation-length: 32
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   24,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
+								NodeSelectors:       []labels.Selector{selector("role=border")},
+							},
+							{
+								AggregationLength:   32,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "advertisement with invalid node selector",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: bgp
+  bgp-advertisements:
+  - node-selectors:
+    - match-expressions:
+      - {key: role, operator: Bogus, values: [border]}
+`,
+		},
+
+		{
+			desc: "service IP advertisement",
+			raw: `
+service-ip-advertisement:
+  cluster-ips: true
+  external-ips: true
+  bgp-advertisements:
+  - communities: ["1234:2345"]
+`,
+			want: &Config{
+				Pools: map[string]*Pool{},
+				ServiceIPs: &ServiceIPs{
+					ClusterIPs:  true,
+					ExternalIPs: true,
+					BGPAdvertisements: []*BGPAdvertisement{
+						{
+							AggregationLength: 32,
+							Communities: map[uint32]bool{
+								0x04D20929: true,
+							},
+							ExtendedCommunities: map[uint64]bool{},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "service IP advertisement with nothing enabled",
+			raw: `
+service-ip-advertisement:
+  bgp-advertisements:
+  - aggregation-length: 32
+`,
+		},
+
+		{
+			desc: "invalid extended community kind",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["1.2.3.0/24"]
+  bgp-advertisements:
+  - extended-communities: ["color:64512:1"]
+`,
+		},
+
+		{
+			desc: "extended community assigned number out of range",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["1.2.3.0/24"]
+  bgp-advertisements:
+  - extended-communities: ["rt:10.0.0.1:70000"]
+`,
+		},
+
+		{
+			desc: "endpoint weight",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["1.2.3.0/24"]
+  bgp-advertisements:
+  - endpoint-weight: link-bandwidth
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
+								EndpointWeight:      LinkBandwidthWeight,
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "unknown endpoint weight",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["1.2.3.0/24"]
+  bgp-advertisements:
+  - endpoint-weight: latency
+`,
+		},
+
+		{
+			desc: "endpoint weight of aggregate",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["1.2.3.0/24"]
+  bgp-advertisements:
+  - aggregation-length: 24
+    endpoint-weight: med
+`,
+		},
+
+		{
+			desc: "bad aggregation length (too long)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - aggregation-length: 33
+`,
+		},
+
+		{
+			desc: "bad aggregation length (incompatible with CIDR)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.30.40/24
+  - 1.2.3.0/28
+  bgp-advertisements:
+  - aggregation-length: 26
+`,
+		},
+
+		{
+			desc: "aggregate originators without aggregation",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.30.0/24
+  bgp-advertisements:
+  - aggregate-originators: 2
+`,
+		},
+
+		{
+			desc: "negative aggregate originators",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.30.0/24
+  bgp-advertisements:
+  - aggregation-length: 24
+    aggregate-originators: -1
+`,
+		},
+
+		{
+			desc: "bad community literal (wrong format)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["1234"]
+`,
+		},
+
+		{
+			desc: "bad community literal (asn part doesn't fit)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["99999999:1"]
+`,
+		},
+
+		{
+			desc: "bad community literal (community# part doesn't fit)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["1:99999999"]
+`,
+		},
+
+		{
+			desc: "bad community ref (unknown ref)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "bad community ref (ref asn doesn't fit)",
+			raw: `
+bgp-communities:
+  flarb: 99999999:1
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "bad community ref (ref community# doesn't fit)",
+			raw: `
+bgp-communities:
+  flarb: 1:99999999
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "duplicate pool definition",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+- name: pool1
+  protocol: bgp
+- name: pool2
+  protocol: bgp
+`,
+		},
+
+		{
+			desc: "duplicate CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/8
+- name: pool2
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/8
+`,
+		},
+
+		{
+			desc: "overlapping CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/8
+- name: pool2
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/16
+`,
+		},
+
+		{
+			desc: "BGP advertisements in layer2 pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  bgp-advertisements:
+  - communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "pool with several protocols",
+			raw: `
+address-pools:
+- name: pool1
+  protocols: [bgp, layer2]
+  addresses:
+  - 10.0.0.0/16
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						Protocols:  []Proto{BGP, Layer2},
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/16")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "pool with both protocol and protocols",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  protocols: [bgp, layer2]
+  addresses:
+  - 10.0.0.0/16
+`,
+		},
+
+		{
+			desc: "pool with duplicate protocols",
+			raw: `
+address-pools:
+- name: pool1
+  protocols: [layer2, layer2]
+  addresses:
+  - 10.0.0.0/16
+`,
+		},
+
+		{
+			desc: "ipam in protocols",
+			raw: `
+address-pools:
+- name: pool1
+  protocols: [bgp, ipam]
+  addresses:
+  - 10.0.0.0/16
+`,
+		},
+
+		{
+			desc: "bgp-advertisements in pool announced with layer2 only",
+			raw: `
+address-pools:
+- name: pool1
+  protocols: [layer2]
+  addresses:
+  - 10.0.0.0/16
+  bgp-advertisements:
+  - aggregation-length: 32
+`,
+		},
+
+		{
+			desc: "pool with flap damping",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/16
+  flap-damping:
+    max-flaps: 5
+    window: 10m
+    hold: 5m
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/16")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
+							},
+						},
+						FlapDamping: &FlapDamping{
+							MaxFlaps: 5,
+							Window:   10 * time.Minute,
+							Hold:     5 * time.Minute,
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "flap damping without max-flaps",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/16
+  flap-damping:
+    window: 10m
+    hold: 5m
+`,
+		},
+
+		{
+			desc: "flap damping with invalid hold",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/16
+  flap-damping:
+    max-flaps: 5
+    window: 10m
+    hold: 0s
+`,
+		},
+
+		{
+			desc: "flap damping in layer2 pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  flap-damping:
+    max-flaps: 5
+    window: 10m
+    hold: 5m
+`,
+		},
+
+		{
+			desc: "pool with service overrides",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/16
+  service-overrides:
+    local-pref: 100-300
+    med: 50
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/16")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
+							},
+						},
+						ServiceLocalPref: &Uint32Range{Min: 100, Max: 300},
+						ServiceMED:       &Uint32Range{Min: 50, Max: 50},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "service overrides with inverted range",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/16
+  service-overrides:
+    local-pref: 300-100
+`,
+		},
+
+		{
+			desc: "service overrides in layer2 pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  service-overrides:
+    med: 0-100
+`,
+		},
+
+		{
+			desc: "pool with lease limit",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  max-lease-duration: 24h
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 10.1.0.0/16
+  max-lease-duration: 30m
+  lease-expiry-policy: release
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:         Layer2,
+						AutoAssign:       true,
+						CIDR:             []*net.IPNet{ipnet("10.0.0.0/16")},
+						MaxLeaseDuration: 24 * time.Hour,
+					},
+					"pool2": {
+						Protocol:             Layer2,
+						AutoAssign:           true,
+						CIDR:                 []*net.IPNet{ipnet("10.1.0.0/16")},
+						MaxLeaseDuration:     30 * time.Minute,
+						ReleaseExpiredLeases: true,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "invalid max-lease-duration",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  max-lease-duration: forever
+`,
+		},
+
+		{
+			desc: "lease-expiry-policy without max-lease-duration",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  lease-expiry-policy: release
+`,
+		},
+
+		{
+			desc: "unknown lease-expiry-policy",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  max-lease-duration: 1h
+  lease-expiry-policy: delete
+`,
+		},
+
+		{
+			desc: "request removal policies",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  request-removal-policy: keep
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 10.1.0.0/16
+  request-removal-policy: reallocate
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/16")},
+					},
+					"pool2": {
+						Protocol:                   Layer2,
+						AutoAssign:                 true,
+						CIDR:                       []*net.IPNet{ipnet("10.1.0.0/16")},
+						ReallocateOnRequestRemoval: true,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "ip-family policies",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  ip-family: ipv4
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 2001:db8::/64
+  ip-family: ipv6
+- name: pool3
+  protocol: layer2
+  addresses:
+  - 10.1.0.0/16
+  - 2001:db8:1::/64
+  ip-family: dual
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/16")},
+						IPFamily:   IPv4Family,
+					},
+					"pool2": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("2001:db8::/64")},
+						IPFamily:   IPv6Family,
+					},
+					"pool3": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.1.0.0/16"), ipnet("2001:db8:1::/64")},
+						IPFamily:   DualStack,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "ip-family ipv4 with IPv6 addresses",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  - 2001:db8::/64
+  ip-family: ipv4
+`,
+		},
+
+		{
+			desc: "ip-family dual with one family",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  ip-family: dual
+`,
+		},
+
+		{
+			desc: "secondary networks",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 192.168.50.1
+  network: storage/data-net
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 192.168.50.128/26
+  network: storage/data-net
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("192.168.50.1"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						Network:       &NetworkRef{Namespace: "storage", Name: "data-net"},
+					},
+				},
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("192.168.50.128/26")},
+						Network:    &NetworkRef{Namespace: "storage", Name: "data-net"},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "network without namespace",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  network: data-net
+`,
+		},
+
+		{
+			desc: "network on bgp pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/16
+  network: storage/data-net
+`,
+		},
+
+		{
+			desc: "network namespaces",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  network-namespace: ext
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 10.1.0.0/16
+  network-namespace: /run/netns/ext2
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:         Layer2,
+						AutoAssign:       true,
+						CIDR:             []*net.IPNet{ipnet("10.0.0.0/16")},
+						NetworkNamespace: "/var/run/netns/ext",
+					},
+					"pool2": {
+						Protocol:         Layer2,
+						AutoAssign:       true,
+						CIDR:             []*net.IPNet{ipnet("10.1.0.0/16")},
+						NetworkNamespace: "/run/netns/ext2",
+					},
+				},
+			},
+		},
+
+		{
+			desc: "relative network namespace path",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  network-namespace: netns/ext
+`,
+		},
+
+		{
+			desc: "network namespace on bgp pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/16
+  network-namespace: ext
+`,
+		},
+
+		{
+			desc: "virtual mac",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  virtual-mac: 02:00:5e:01:00:00
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 10.1.0.0/16
+  virtual-mac: 00:00:5e:01:00:00
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/16")},
+						VirtualMAC: net.HardwareAddr{0x02, 0, 0x5e, 1, 0, 0},
+					},
+					"pool2": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.1.0.0/16")},
+						VirtualMAC: net.HardwareAddr{0, 0, 0x5e, 1, 0, 0},
+					},
+				},
+				Warnings: []string{
+					`address pool "pool2": virtual-mac 00:00:5e:01:00:00 is not locally administered, and may collide with a NIC's MAC`,
+				},
+			},
+		},
+
+		{
+			desc: "multicast virtual mac",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  virtual-mac: 01:00:5e:00:00:01
+`,
+		},
+
+		{
+			desc: "virtual mac not ending in zeros",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  virtual-mac: 02:00:5e:00:00:01
+`,
+		},
+
+		{
+			desc: "virtual mac on too large cidr",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/15
+  virtual-mac: 02:00:5e:01:00:00
+`,
+		},
+
+		{
+			desc: "virtual mac on cidrs sharing the last two bytes",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  - 10.1.0.128/25
+  virtual-mac: 02:00:5e:01:00:00
+`,
+		},
+
+		{
+			desc: "virtual mac shared by pools",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  virtual-mac: 02:00:5e:01:00:00
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 10.0.1.0/24
+  virtual-mac: 02:00:5e:01:00:00
+`,
+		},
+
+		{
+			desc: "virtual mac on bgp pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/16
+  virtual-mac: 02:00:5e:00:00:01
+`,
+		},
+
+		{
+			desc: "unnumbered",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  unnumbered: true
 `,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/16")},
+						Unnumbered: true,
+					},
+				},
+			},
 		},
 
 		{
-			desc: "address pool with unknown protocol",
+			desc: "secondary subnet",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: babel
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  secondary-subnet: true
 `,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:        Layer2,
+						AutoAssign:      true,
+						CIDR:            []*net.IPNet{ipnet("10.0.0.0/16")},
+						SecondarySubnet: true,
+					},
+				},
+			},
 		},
 
 		{
-			desc: "invalid pool CIDR",
+			desc: "ipv6 secondary subnet",
 			raw: `
 address-pools:
 - name: pool1
+  protocol: layer2
   addresses:
-  - 100.200.300.400/24
+  - 2001:db8::/64
+  secondary-subnet: true
 `,
 		},
 
 		{
-			desc: "invalid pool CIDR prefix length",
+			desc: "unnumbered secondary subnet",
 			raw: `
 address-pools:
 - name: pool1
+  protocol: layer2
   addresses:
-  - 1.2.3.0/33
+  - 10.0.0.0/16
+  unnumbered: true
+  secondary-subnet: true
 `,
 		},
 
 		{
-			desc: "simple advertisement",
+			desc: "unnumbered bgp pool",
 			raw: `
 address-pools:
 - name: pool1
   protocol: bgp
-  addresses: ["1.2.3.0/24"]
-  bgp-advertisements:
-  -
+  addresses:
+  - 10.0.0.0/16
+  unnumbered: true
+`,
+		},
+
+		{
+			desc: "unknown ip-family",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  ip-family: ipv5
+`,
+		},
+
+		{
+			desc: "reserved host suffixes",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  - 10.2.0.0/31
+  - 10.3.0.0-10.3.0.255
+  reserved-host-suffixes: pool-cidr
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 10.1.0.0/16
+  reserved-host-suffixes: every-24
 `,
 			want: &Config{
 				Pools: map[string]*Pool{
 					"pool1": {
-						Protocol:   BGP,
+						Protocol:             Layer2,
+						AutoAssign:           true,
+						CIDR:                 []*net.IPNet{ipnet("10.0.0.0/16"), ipnet("10.2.0.0/31"), ipnet("10.3.0.0/24")},
+						ReservedHostSuffixes: ReservePoolCIDR,
+						ReservedIPs:          []net.IP{net.ParseIP("10.0.0.0").To4(), net.ParseIP("10.0.255.255").To4()},
+					},
+					"pool2": {
+						Protocol:             Layer2,
+						AutoAssign:           true,
+						CIDR:                 []*net.IPNet{ipnet("10.1.0.0/16")},
+						ReservedHostSuffixes: ReserveEvery24,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "version 1 converted",
+			raw: `
+version: 1
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.1.0.0/16
+  avoid-buggy-ips: true
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 10.2.0.0/16
+  avoid-buggy-ips: false
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:             Layer2,
+						AutoAssign:           true,
+						CIDR:                 []*net.IPNet{ipnet("10.1.0.0/16")},
+						ReservedHostSuffixes: ReserveEvery24,
+					},
+					"pool2": {
+						Protocol:   Layer2,
 						AutoAssign: true,
-						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
-						BGPAdvertisements: []*BGPAdvertisement{
-							{
-								AggregationLength: 32,
-								Communities:       map[uint32]bool{},
-							},
-						},
+						CIDR:       []*net.IPNet{ipnet("10.2.0.0/16")},
 					},
 				},
+				Warnings: []string{
+					`address pool "pool1": avoid-buggy-ips is deprecated, use reserved-host-suffixes: every-24`,
+					`address pool "pool2": avoid-buggy-ips is deprecated, use reserved-host-suffixes: every-24`,
+				},
 			},
 		},
 
 		{
-			desc: "advertisement with default BGP settings",
+			desc: "version 2",
 			raw: `
+version: 2
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.1.0.0/16
+  reserved-host-suffixes: every-24
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:             Layer2,
+						AutoAssign:           true,
+						CIDR:                 []*net.IPNet{ipnet("10.1.0.0/16")},
+						ReservedHostSuffixes: ReserveEvery24,
+					},
+				},
+			},
+		},
+
+		{
+			desc: "avoid-buggy-ips in version 2",
+			raw: `
+version: 2
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.1.0.0/16
+  avoid-buggy-ips: true
+`,
+		},
+
+		{
+			desc: "unsupported version",
+			raw: `
+version: 3
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.1.0.0/16
+`,
+		},
+
+		{
+			desc: "suspicious values",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  hold-time: 3s
 address-pools:
 - name: pool1
-  addresses: ["1.2.3.0/24"]
   protocol: bgp
+  addresses:
+  - 10.0.0.0/8
+  bgp-advertisements:
+  - aggregation-length: 8
 `,
 			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      3 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+					},
+				},
 				Pools: map[string]*Pool{
 					"pool1": {
 						Protocol:   BGP,
 						AutoAssign: true,
-						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/8")},
 						BGPAdvertisements: []*BGPAdvertisement{
 							{
-								AggregationLength: 32,
-								Communities:       map[uint32]bool{},
+								AggregationLength:   8,
+								Communities:         map[uint32]bool{},
+								ExtendedCommunities: map[uint64]bool{},
 							},
 						},
 					},
 				},
+				Warnings: []string{
+					"peer 1.2.3.4: hold-time 3s is less than 9s, the session may flap when a few keepalives are lost",
+					`address pool "pool1": aggregation-length 8 advertises prefixes of 16777216 addresses for each service IP`,
+				},
 			},
 		},
 
 		{
-			desc: "bad aggregation length (too long)",
+			desc:   "suspicious values in strict mode",
+			strict: true,
 			raw: `
-address-pools:
-- name: pool1
-  protocol: bgp
-  bgp-advertisements:
-  - aggregation-length: 33
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  hold-time: 3s
 `,
 		},
 
 		{
-			desc: "bad aggregation length (incompatible with CIDR)",
+			desc: "reserved offsets",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: bgp
+  protocol: layer2
   addresses:
-  - 10.20.30.40/24
-  - 1.2.3.0/28
-  bgp-advertisements:
-  - aggregation-length: 26
+  - 10.0.0.0/30
+  - 10.1.0.10-10.1.0.20
+  reserved-offsets:
+    first: 1
+    last: 1
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 2001:db8::/64
+  reserved-host-suffixes: pool-cidr
+  reserved-offsets:
+    first: 2
 `,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/30"), ipnet("10.1.0.10/31"), ipnet("10.1.0.12/30"), ipnet("10.1.0.16/30"), ipnet("10.1.0.20/32")},
+						ReservedIPs: []net.IP{
+							net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.3"),
+							net.ParseIP("10.1.0.10"), net.ParseIP("10.1.0.20"),
+						},
+					},
+					"pool2": {
+						Protocol:             Layer2,
+						AutoAssign:           true,
+						CIDR:                 []*net.IPNet{ipnet("2001:db8::/64")},
+						ReservedHostSuffixes: ReservePoolCIDR,
+						ReservedIPs:          []net.IP{net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::1")},
+					},
+				},
+			},
 		},
 
 		{
-			desc: "bad community literal (wrong format)",
+			desc: "reserved offsets leave no address",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: bgp
-  bgp-advertisements:
-  - communities: ["1234"]
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/31
+  reserved-offsets:
+    first: 1
+    last: 1
 `,
 		},
 
 		{
-			desc: "bad community literal (asn part doesn't fit)",
+			desc: "pool topology",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: bgp
-  bgp-advertisements:
-  - communities: ["99999999:1"]
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  topology:
+    zones: [zone-a, zone-b]
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 10.0.1.0/24
+  topology:
+    key: example.com/rack
+    zones: [rack1]
 `,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/24")},
+						Topology:   &Topology{Key: DefaultTopologyKey, Zones: []string{"zone-a", "zone-b"}},
+					},
+					"pool2": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.1.0/24")},
+						Topology:   &Topology{Key: "example.com/rack", Zones: []string{"rack1"}},
+					},
+				},
+			},
 		},
 
 		{
-			desc: "bad community literal (community# part doesn't fit)",
+			desc: "pool labels",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: bgp
-  bgp-advertisements:
-  - communities: ["1:99999999"]
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  labels:
+    tier: gold
+    example.com/site: paris
 `,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/24")},
+						Labels:     labels.Set{"tier": "gold", "example.com/site": "paris"},
+					},
+				},
+			},
 		},
 
 		{
-			desc: "bad community ref (unknown ref)",
+			desc: "invalid pool label",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: bgp
-  bgp-advertisements:
-  - communities: ["flarb"]
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  labels:
+    tier: "gold!"
 `,
 		},
 
 		{
-			desc: "bad community ref (ref asn doesn't fit)",
+			desc: "maintenance windows",
 			raw: `
-bgp-communities:
-  flarb: 99999999:1
+maintenance-windows:
+- schedule: "0 2 * * 6"
+  duration: 2h
+  node-selectors:
+  - match-labels:
+      rack: a
 address-pools:
 - name: pool1
-  protocol: bgp
-  bgp-advertisements:
-  - communities: ["flarb"]
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  maintenance-windows:
+  - schedule: "30 22 1 * *"
+    duration: 30m
+    time-zone: Europe/Paris
+    node-selectors:
+    - match-labels:
+        rack: b
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/24")},
+						MaintenanceWindows: []*MaintenanceWindow{
+							{
+								Schedule:      schedule("30 22 1 * *"),
+								Duration:      30 * time.Minute,
+								Location:      location("Europe/Paris"),
+								NodeSelectors: []labels.Selector{selector("rack=b")},
+							},
+						},
+					},
+				},
+				MaintenanceWindows: []*MaintenanceWindow{
+					{
+						Schedule:      schedule("0 2 * * 6"),
+						Duration:      2 * time.Hour,
+						Location:      time.UTC,
+						NodeSelectors: []labels.Selector{selector("rack=a")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "maintenance window without node selectors",
+			raw: `
+maintenance-windows:
+- schedule: "0 2 * * 6"
+  duration: 2h
+`,
+		},
+
+		{
+			desc: "maintenance window with invalid schedule",
+			raw: `
+maintenance-windows:
+- schedule: "0 25 * * 6"
+  duration: 2h
+  node-selectors:
+  - match-labels:
+      rack: a
+`,
+		},
+
+		{
+			desc: "maintenance window too long",
+			raw: `
+maintenance-windows:
+- schedule: "0 2 * * 6"
+  duration: 200h
+  node-selectors:
+  - match-labels:
+      rack: a
 `,
 		},
 
 		{
-			desc: "bad community ref (ref community# doesn't fit)",
+			desc: "pool topology without zones",
 			raw: `
-bgp-communities:
-  flarb: 1:99999999
 address-pools:
 - name: pool1
-  protocol: bgp
-  bgp-advertisements:
-  - communities: ["flarb"]
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  topology:
+    key: example.com/rack
 `,
 		},
 
 		{
-			desc: "duplicate pool definition",
+			desc: "pool topology with invalid zone",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: bgp
-- name: pool1
-  protocol: bgp
-- name: pool2
-  protocol: bgp
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  topology:
+    zones: ["not a zone"]
 `,
 		},
 
 		{
-			desc: "duplicate CIDRs",
+			desc: "unknown reserved-host-suffixes",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: bgp
-  addresses:
-  - 10.0.0.0/8
-- name: pool2
-  protocol: bgp
+  protocol: layer2
   addresses:
-  - 10.0.0.0/8
+  - 10.0.0.0/16
+  reserved-host-suffixes: every-16
 `,
 		},
 
 		{
-			desc: "overlapping CIDRs",
+			desc: "reserved-host-suffixes with avoid-buggy-ips",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: bgp
-  addresses:
-  - 10.0.0.0/8
-- name: pool2
-  protocol: bgp
+  protocol: layer2
   addresses:
   - 10.0.0.0/16
+  avoid-buggy-ips: true
+  reserved-host-suffixes: pool-cidr
 `,
 		},
 
 		{
-			desc: "BGP advertisements in layer2 pool",
+			desc: "unknown request-removal-policy",
 			raw: `
 address-pools:
 - name: pool1
   protocol: layer2
   addresses:
   - 10.0.0.0/16
-  bgp-advertisements:
-  - communities: ["flarb"]
+  request-removal-policy: release
 `,
 		},
+
 		{
 			desc: "IPAM Agent backed pool",
 			secret: &v1.Secret{
@@ -654,6 +2763,42 @@ address-pools:
   ipam:
     secret-name: yo
     namespace: test
+`,
+		},
+		{
+			desc: "IPAM Agent backed pool shared with other clusters",
+			secret: &v1.Secret{
+				ObjectMeta: v12.ObjectMeta{
+					Namespace: "test",
+					Name:      "yo",
+				},
+				Data: map[string][]byte{"config.json": []byte(fakeProvider)},
+			},
+			want: &Config{
+				Pools: map[string]*Pool{
+					"ipam-agent": {
+						Protocol:   IPAM,
+						AutoAssign: true,
+						CIDR: []*net.IPNet{
+							ipnet("1.2.3.1/32"),
+							ipnet("1.2.3.2/31"),
+							ipnet("1.2.3.4/30"),
+							ipnet("1.2.3.8/31"),
+							ipnet("1.2.3.10/32"),
+						},
+						IPAM:       fake2.GetFakeIPAMAgent(),
+						SharedIPAM: true,
+					},
+				},
+			},
+			raw: `
+address-pools:
+- name: ipam-agent
+  protocol: ipam
+  ipam:
+    secret-name: yo
+    namespace: test
+    shared: true
 `,
 		},
 		{
@@ -756,6 +2901,64 @@ address-pools:
   ipam:
     secret-name: yo
     namespace: test
+`,
+		},
+		{
+			desc: "peer password from secret",
+			secret: &v1.Secret{
+				ObjectMeta: v12.ObjectMeta{
+					Namespace: "test",
+					Name:      "bgp",
+				},
+				Data: map[string][]byte{"password": []byte("hunter2")},
+			},
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  password-secret:
+    namespace: test
+    name: bgp
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           142,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						Password:      "hunter2",
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+		{
+			desc: "peer password and password secret",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  password: hunter2
+  password-secret:
+    namespace: test
+    name: bgp
+`,
+		},
+		{
+			desc: "peer password from disabled source",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 142
+  peer-address: 1.2.3.4
+  password-secret:
+    source: vault
+    name: secret/data/bgp
 `,
 		},
 	}
@@ -769,6 +2972,10 @@ address-pools:
 
 
 			parser := NewParser(fake.NewSimpleClientset(test.secret))
+			parser.Strict = test.strict
+			if test.nodes != nil {
+				parser.Nodes = func() (map[string]labels.Set, error) { return test.nodes, nil }
+			}
 			got, err := parser.Parse([]byte(test.raw))
 			if err != nil && test.want != nil {
 				t.Errorf("%q: parse failed: %s", test.desc, err)
@@ -796,9 +3003,312 @@ address-pools:
 				}
 				return x.String() == y.String()
 			})
-			if diff := cmp.Diff(test.want, got, selectorComparer); diff != "" {
+			scheduleComparer := cmp.Comparer(func(x, y *Schedule) bool {
+				return x.String() == y.String()
+			})
+			locationComparer := cmp.Comparer(func(x, y *time.Location) bool {
+				return x.String() == y.String()
+			})
+			if diff := cmp.Diff(test.want, got, selectorComparer, scheduleComparer, locationComparer); diff != "" {
 				t.Errorf("%q: parse returned wrong result (-want, +got)\n%s", test.desc, diff)
 			}
 		})
 	}
 }
+
+func TestParseDocuments(t *testing.T) {
+	tests := []struct {
+		desc  string
+		docs  []string
+		peers []string
+		pools []string
+		fail  bool
+	}{
+		{
+			desc: "split across keys",
+			docs: []string{
+				`
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+				`
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: [10.20.0.0/16]
+`,
+			},
+			peers: []string{"1.2.3.4"},
+			pools: []string{"pool1"},
+		},
+		{
+			desc: "mixed versions",
+			docs: []string{
+				`
+version: 2
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: [10.20.0.0/16]
+  reserved-host-suffixes: every-24
+---
+address-pools:
+- name: pool2
+  protocol: bgp
+  addresses: [10.30.0.0/16]
+  avoid-buggy-ips: true
+---
+version: 2
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+			},
+			peers: []string{"1.2.3.4"},
+			pools: []string{"pool1", "pool2"},
+		},
+		{
+			desc: "several documents in one key",
+			docs: []string{
+				`
+bgp-communities:
+  bar: 64512:1234
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: [10.20.0.0/16]
+---
+bgp-communities:
+  bar: 64512:1234
+address-pools:
+- name: pool2
+  protocol: bgp
+  addresses: [10.30.0.0/16]
+  bgp-advertisements:
+  - communities: [bar]
+`,
+				`
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+				`
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.5
+`,
+			},
+			peers: []string{"1.2.3.4", "1.2.3.5"},
+			pools: []string{"pool1", "pool2"},
+		},
+		{
+			desc: "conflicting community",
+			docs: []string{
+				"bgp-communities: {bar: 64512:1234}",
+				"bgp-communities: {bar: 64512:4321}",
+			},
+			fail: true,
+		},
+		{
+			desc: "pool defined twice",
+			docs: []string{
+				"address-pools: [{name: pool1, protocol: bgp, addresses: [10.20.0.0/16]}]",
+				"address-pools: [{name: pool1, protocol: bgp, addresses: [10.30.0.0/16]}]",
+			},
+			fail: true,
+		},
+		{
+			desc: "service IPs set twice",
+			docs: []string{
+				"service-ip-advertisement: {cluster-ips: true}",
+				"---\nservice-ip-advertisement: {external-ips: true}",
+			},
+			fail: true,
+		},
+		{
+			desc: "unknown field in second document",
+			docs: []string{
+				"peers: []\n---\nfoo: bar",
+			},
+			fail: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var docs [][]byte
+			for _, d := range test.docs {
+				docs = append(docs, []byte(d))
+			}
+			cfg, err := NewParser(nil).ParseDocuments(docs)
+			if test.fail {
+				if err == nil {
+					t.Fatal("parse unexpectedly succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse failed: %s", err)
+			}
+
+			var peers, pools []string
+			for _, p := range cfg.Peers {
+				peers = append(peers, p.Addr.String())
+			}
+			for n := range cfg.Pools {
+				pools = append(pools, n)
+			}
+			sort.Strings(pools)
+			if diff := cmp.Diff(test.peers, peers); diff != "" {
+				t.Errorf("wrong peers (-want +got)\n%s", diff)
+			}
+			if diff := cmp.Diff(test.pools, pools); diff != "" {
+				t.Errorf("wrong pools (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServiceBGPOverrides(t *testing.T) {
+	pool := &Pool{
+		ServiceLocalPref: &Uint32Range{Min: 100, Max: 300},
+	}
+	u32 := func(v uint32) *uint32 { return &v }
+
+	tests := []struct {
+		desc        string
+		annotations map[string]string
+		want        BGPOverrides
+		wantErr     bool
+	}{
+		{
+			desc: "no annotations",
+		},
+		{
+			desc:        "local-pref within bounds",
+			annotations: map[string]string{LocalPrefAnnotation: "200"},
+			want:        BGPOverrides{LocalPref: u32(200)},
+		},
+		{
+			desc:        "local-pref out of bounds",
+			annotations: map[string]string{LocalPrefAnnotation: "500"},
+			wantErr:     true,
+		},
+		{
+			desc:        "malformed local-pref",
+			annotations: map[string]string{LocalPrefAnnotation: "high"},
+			wantErr:     true,
+		},
+		{
+			desc:        "med not allowed by pool",
+			annotations: map[string]string{MEDAnnotation: "10"},
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := pool.ServiceBGPOverrides(test.annotations)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.desc, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: overrides differ (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestServiceProtocols(t *testing.T) {
+	pool := &Pool{
+		Protocol:  BGP,
+		Protocols: []Proto{BGP, Layer2},
+	}
+	l2Pool := &Pool{Protocol: Layer2}
+
+	tests := []struct {
+		desc        string
+		pool        *Pool
+		annotations map[string]string
+		want        []Proto
+		wantErr     bool
+	}{
+		{
+			desc: "no annotation",
+			pool: pool,
+			want: []Proto{BGP, Layer2},
+		},
+		{
+			desc:        "layer2 of both",
+			pool:        pool,
+			annotations: map[string]string{ProtocolAnnotation: "layer2"},
+			want:        []Proto{Layer2},
+		},
+		{
+			desc:        "bgp of both",
+			pool:        pool,
+			annotations: map[string]string{ProtocolAnnotation: "bgp"},
+			want:        []Proto{BGP},
+		},
+		{
+			desc:        "protocol of a single protocol pool",
+			pool:        l2Pool,
+			annotations: map[string]string{ProtocolAnnotation: "layer2"},
+			want:        []Proto{Layer2},
+		},
+		{
+			desc:        "protocol not of the pool",
+			pool:        l2Pool,
+			annotations: map[string]string{ProtocolAnnotation: "bgp"},
+			want:        []Proto{Layer2},
+			wantErr:     true,
+		},
+		{
+			desc:        "unknown protocol",
+			pool:        pool,
+			annotations: map[string]string{ProtocolAnnotation: "ospf"},
+			want:        []Proto{BGP, Layer2},
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := test.pool.ServiceProtocols(test.annotations)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %v", test.desc, err, test.wantErr)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: protocols differ (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestVirtualMACFor(t *testing.T) {
+	pool := &Pool{VirtualMAC: net.HardwareAddr{0x02, 0, 0x5e, 1, 0, 0}}
+	tests := []struct {
+		ip   string
+		want net.HardwareAddr
+	}{
+		{"10.0.0.1", net.HardwareAddr{0x02, 0, 0x5e, 1, 0, 1}},
+		{"10.0.1.2", net.HardwareAddr{0x02, 0, 0x5e, 1, 1, 2}},
+		{"2001:db8::a:b", net.HardwareAddr{0x02, 0, 0x5e, 1, 0, 0x0b}},
+	}
+	for _, test := range tests {
+		if got := pool.VirtualMACFor(net.ParseIP(test.ip)); got.String() != test.want.String() {
+			t.Errorf("%s: got virtual MAC %s, want %s", test.ip, got, test.want)
+		}
+	}
+	if got := (&Pool{}).VirtualMACFor(net.ParseIP("10.0.0.1")); got != nil {
+		t.Errorf("pool without virtual MAC: got %s, want nil", got)
+	}
+}
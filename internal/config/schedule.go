@@ -0,0 +1,123 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a cron schedule, with the five usual fields: minute,
+// hour, day of month, month and day of week.
+type Schedule struct {
+	spec string
+
+	minute, hour, dom, month, dow uint64
+	// True if the day of month or week field is "*". Like cron, a
+	// time matches if either day field matches, unless one of them
+	// is "*".
+	domAny, dowAny bool
+}
+
+// ParseSchedule parses a cron schedule like "30 2 * * 6". Fields are
+// "*", numbers, ranges like "1-5", and steps like "*/15" or
+// "0-30/10", separated by commas. Sunday is 0 or 7.
+func ParseSchedule(spec string) (*Schedule, error) {
+	fs := strings.Fields(spec)
+	if len(fs) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, must have 5 fields", spec)
+	}
+	ret := &Schedule{
+		spec:   strings.Join(fs, " "),
+		domAny: fs[2] == "*",
+		dowAny: fs[4] == "*",
+	}
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+		name     string
+	}{
+		{&ret.minute, 0, 59, "minute"},
+		{&ret.hour, 0, 23, "hour"},
+		{&ret.dom, 1, 31, "day of month"},
+		{&ret.month, 1, 12, "month"},
+		{&ret.dow, 0, 7, "day of week"},
+	} {
+		bits, err := parseScheduleField(fs[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q in schedule %q: %s", f.name, fs[i], spec, err)
+		}
+		*f.bits = bits
+	}
+	if ret.dow&(1<<7) != 0 {
+		ret.dow |= 1
+	}
+	return ret, nil
+}
+
+func parseScheduleField(f string, min, max int) (uint64, error) {
+	var ret uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			rng, step = part[:i], s
+		}
+
+		lo, hi := min, max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			fs := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(fs[0]); err != nil {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+			if hi, err = strconv.Atoi(fs[1]); err != nil {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			v, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rng)
+			}
+			lo, hi = v, v
+			if step > 1 {
+				// Like cron, "5/10" is "5-max/10".
+				hi = max
+			}
+		}
+		if lo < min || hi > max {
+			return 0, fmt.Errorf("out of range %d-%d", min, max)
+		}
+		if lo > hi {
+			return 0, errors.New("range ends before it starts")
+		}
+		for v := lo; v <= hi; v += step {
+			ret |= 1 << uint(v)
+		}
+	}
+	return ret, nil
+}
+
+// Matches returns true if the schedule fires at the minute of t, in
+// t's location.
+func (s *Schedule) Matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 || s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (s *Schedule) String() string {
+	return s.spec
+}
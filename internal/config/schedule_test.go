@@ -0,0 +1,88 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	// A Saturday.
+	sat := time.Date(2020, 1, 4, 2, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec    string
+		t       time.Time
+		want    bool
+		wantErr bool
+	}{
+		{spec: "* * * * *", t: sat, want: true},
+		{spec: "30 2 * * *", t: sat, want: true},
+		{spec: "31 2 * * *", t: sat, want: false},
+		{spec: "*/15 * * * *", t: sat, want: true},
+		{spec: "*/20 * * * *", t: sat, want: false},
+		{spec: "0-10,25-35 1-3 * * *", t: sat, want: true},
+		{spec: "30 2 * * 6", t: sat, want: true},
+		{spec: "30 2 * * 1-5", t: sat, want: false},
+		{spec: "30 2 * * 0,7", t: sat.AddDate(0, 0, 1), want: true},
+		{spec: "30 2 4 1 *", t: sat, want: true},
+		{spec: "30 2 * 2 *", t: sat, want: false},
+		// Either day field matches when both are restricted.
+		{spec: "30 2 1 * 6", t: sat, want: true},
+		{spec: "30 2 4 * 1", t: sat, want: true},
+		{spec: "30 2 1 * 1", t: sat, want: false},
+		// Only both match when one is "*".
+		{spec: "30 2 1 * *", t: sat, want: false},
+
+		{spec: "30 2 * *", wantErr: true},
+		{spec: "60 * * * *", wantErr: true},
+		{spec: "* * 0 * *", wantErr: true},
+		{spec: "* * * * 8", wantErr: true},
+		{spec: "5-1 * * * *", wantErr: true},
+		{spec: "*/0 * * * *", wantErr: true},
+		{spec: "a * * * *", wantErr: true},
+	}
+	for _, test := range tests {
+		s, err := ParseSchedule(test.spec)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseSchedule(%q) succeeded, want error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %s", test.spec, err)
+			continue
+		}
+		if got := s.Matches(test.t); got != test.want {
+			t.Errorf("%q matches %s: got %v, want %v", test.spec, test.t, got, test.want)
+		}
+	}
+}
+
+func TestMaintenanceWindowActive(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("no time zone database: %s", err)
+	}
+	w := &MaintenanceWindow{
+		Schedule: schedule("0 2 * * 6"),
+		Duration: 2 * time.Hour,
+		Location: paris,
+	}
+	// 2:00 in Paris is 1:00 UTC in winter.
+	start := time.Date(2020, 1, 4, 1, 0, 0, 0, time.UTC)
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{start.Add(-time.Second), false},
+		{start, true},
+		{start.Add(119 * time.Minute), true},
+		{start.Add(2 * time.Hour), false},
+		{start.AddDate(0, 0, 1), false},
+	}
+	for _, test := range tests {
+		if got := w.Active(test.t); got != test.want {
+			t.Errorf("active at %s: got %v, want %v", test.t, got, test.want)
+		}
+	}
+}
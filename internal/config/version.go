@@ -0,0 +1,86 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CurrentVersion is the version of the configuration schema that the
+// parser reads. Documents without a version field are version 1, and
+// older versions are converted before parsing.
+const CurrentVersion = 2
+
+// conversions[v] converts a document, decoded as generic YAML, from
+// version v to v+1 in place. It returns warnings about deprecated
+// settings.
+var conversions = map[int]func(doc map[interface{}]interface{}) ([]string, error){
+	1: convertV1,
+}
+
+// documentVersion returns the schema version of doc.
+func documentVersion(doc map[interface{}]interface{}) (int, error) {
+	raw, ok := doc["version"]
+	if !ok {
+		return 1, nil
+	}
+	v, ok := raw.(int)
+	if !ok || v < 1 || v > CurrentVersion {
+		return 0, fmt.Errorf("unsupported configuration version %v, supported versions are %s", raw, supportedVersions())
+	}
+	return v, nil
+}
+
+func supportedVersions() string {
+	var vs []string
+	for v := 1; v <= CurrentVersion; v++ {
+		vs = append(vs, strconv.Itoa(v))
+	}
+	return strings.Join(vs, ", ")
+}
+
+// upgrade converts doc from version v to CurrentVersion.
+func upgrade(doc map[interface{}]interface{}, v int) ([]string, error) {
+	var warnings []string
+	for ; v < CurrentVersion; v++ {
+		ws, err := conversions[v](doc)
+		if err != nil {
+			return nil, fmt.Errorf("converting configuration from version %d to %d: %s", v, v+1, err)
+		}
+		warnings = append(warnings, ws...)
+	}
+	doc["version"] = CurrentVersion
+	return warnings, nil
+}
+
+// convertV1 replaces avoid-buggy-ips, which reserved-host-suffixes
+// superseded, in address pools.
+func convertV1(doc map[interface{}]interface{}) ([]string, error) {
+	var warnings []string
+	pools, _ := doc["address-pools"].([]interface{})
+	for _, p := range pools {
+		pool, ok := p.(map[interface{}]interface{})
+		if !ok {
+			// Rejected when decoding the converted document.
+			continue
+		}
+		avoid, ok := pool["avoid-buggy-ips"]
+		if !ok {
+			continue
+		}
+		delete(pool, "avoid-buggy-ips")
+		warnings = append(warnings, fmt.Sprintf("address pool %q: avoid-buggy-ips is deprecated, use reserved-host-suffixes: every-24", fmt.Sprint(pool["name"])))
+		switch avoid {
+		case false:
+		case true:
+			if _, ok := pool["reserved-host-suffixes"]; ok {
+				return nil, errors.New("cannot have both avoid-buggy-ips and reserved-host-suffixes in an address pool")
+			}
+			pool["reserved-host-suffixes"] = string(ReserveEvery24)
+		default:
+			return nil, fmt.Errorf("avoid-buggy-ips must be true or false, not %v", avoid)
+		}
+	}
+	return warnings, nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// Hold times below this let a session flap when only a couple of
+	// keepalives are lost. RFC 4271 suggests 90s, 9s is a common
+	// floor for fast failover setups.
+	minSafeHoldTime = 9 * time.Second
+	// Aggregates shorter than this cover over 65536 addresses, which
+	// is rarely intended.
+	minSafeAggregationLength = 16
+)
+
+// warnings returns the suspicious but valid settings of cfg.
+func warnings(cfg *Config) []string {
+	var ret []string
+	for _, p := range cfg.Peers {
+		if p.HoldTime == 0 && p.TCP.KeepaliveInterval == 0 && p.TCP.UserTimeout == 0 {
+			ret = append(ret, fmt.Sprintf("peer %s: hold-time 0 disables keepalives and the hold timer, a dead peer goes unnoticed without tcp-keepalive or tcp-user-timeout", p.Host()))
+		}
+		if p.HoldTime != 0 && p.HoldTime < minSafeHoldTime {
+			ret = append(ret, fmt.Sprintf("peer %s: hold-time %s is less than %s, the session may flap when a few keepalives are lost", p.Host(), p.HoldTime, minSafeHoldTime))
+		}
+		if d := p.TCP.KeepaliveInterval * time.Duration(p.TCP.KeepaliveProbes+1); p.HoldTime != 0 && d >= p.HoldTime {
+			ret = append(ret, fmt.Sprintf("peer %s: tcp-keepalive detects dead connections after %s, not before hold-time %s expires", p.Host(), d, p.HoldTime))
+		}
+		if p.HoldTime != 0 && p.TCP.UserTimeout >= p.HoldTime {
+			ret = append(ret, fmt.Sprintf("peer %s: tcp-user-timeout %s is not less than hold-time %s, and has no effect", p.Host(), p.TCP.UserTimeout, p.HoldTime))
+		}
+	}
+
+	var names []string
+	for n := range cfg.Pools {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if mac := cfg.Pools[n].VirtualMAC; mac != nil && mac[0]&2 == 0 {
+			ret = append(ret, fmt.Sprintf("address pool %q: virtual-mac %s is not locally administered, and may collide with a NIC's MAC", n, mac))
+		}
+		for _, ad := range cfg.Pools[n].BGPAdvertisements {
+			if w := aggregationWarning(ad); w != "" {
+				ret = append(ret, fmt.Sprintf("address pool %q: %s", n, w))
+			}
+		}
+	}
+	if cfg.ServiceIPs != nil {
+		for _, ad := range cfg.ServiceIPs.BGPAdvertisements {
+			if w := aggregationWarning(ad); w != "" {
+				ret = append(ret, "service-ip-advertisement: "+w)
+			}
+		}
+	}
+	return ret
+}
+
+func aggregationWarning(ad *BGPAdvertisement) string {
+	if ad.AggregationLength >= minSafeAggregationLength {
+		return ""
+	}
+	return fmt.Sprintf("aggregation-length %d advertises prefixes of %d addresses for each service IP", ad.AggregationLength, uint64(1)<<uint(32-ad.AggregationLength))
+}
+
+// nodeWarnings returns the nodes that peers with my-asn-label select,
+// but that don't have a valid ASN in the label.
+func (cp Parser) nodeWarnings(cfg *Config) []string {
+	var check []*Peer
+	for _, p := range cfg.Peers {
+		if p.MyASNLabel != "" {
+			check = append(check, p)
+		}
+	}
+	if len(check) == 0 {
+		return nil
+	}
+	nodes, err := cp.Nodes()
+	if err != nil {
+		return []string{fmt.Sprintf("cannot check my-asn-label on nodes: %s", err)}
+	}
+
+	var names []string
+	for n := range nodes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var ret []string
+	for _, p := range check {
+		for _, n := range names {
+			if !selected(p.NodeSelectors, nodes[n]) {
+				continue
+			}
+			if _, err := ParseASN(nodes[n][p.MyASNLabel]); err != nil {
+				ret = append(ret, fmt.Sprintf("peer %s: node %q has no local ASN in label %q: %s", p.Host(), n, p.MyASNLabel, err))
+			}
+		}
+	}
+	return ret
+}
+
+func selected(sels []labels.Selector, l labels.Set) bool {
+	for _, sel := range sels {
+		if sel.Matches(l) {
+			return true
+		}
+	}
+	return false
+}
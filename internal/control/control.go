@@ -0,0 +1,231 @@
+// Package control is the channel over which speakers report to the
+// controller that they are alive and what they announce, so that the
+// controller doesn't have to infer it from the apiserver or from the
+// speakers' metrics.
+//
+// It is a gRPC service, whose messages are encoded as JSON rather than
+// protobuf so that they don't need generated code. Servers also run
+// the standard gRPC health service.
+package control // import "go.universe.tf/metallb/internal/control"
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	serviceName  = "metallb.control.Control"
+	reportMethod = "/" + serviceName + "/Report"
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec encodes messages as JSON, selected by the "json" content
+// subtype of calls.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+// Announcement is an IP of a service announced by a speaker.
+type Announcement struct {
+	Service  string `json:"service"`
+	IP       string `json:"ip"`
+	Protocol string `json:"protocol"`
+}
+
+// Report is what a speaker periodically sends to the controller.
+type Report struct {
+	Node string `json:"node"`
+	Pod  string `json:"pod,omitempty"`
+	// True while the speaker withdraws everything because the
+	// controller drains its node.
+	Draining      bool           `json:"draining,omitempty"`
+	Announcements []Announcement `json:"announcements,omitempty"`
+}
+
+// Ack is the controller's answer to a Report.
+type Ack struct{}
+
+// Speaker is the last report of a speaker, as seen by the controller.
+type Speaker struct {
+	Report
+	LastSeen time.Time `json:"lastSeen"`
+	Alive    bool      `json:"alive"`
+}
+
+// reportServer is the interface of the Control service, for
+// grpc.ServiceDesc.
+type reportServer interface {
+	Report(ctx context.Context, r *Report) (*Ack, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*reportServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Report", Handler: reportHandler},
+	},
+	Metadata: "control.go",
+}
+
+func reportHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	r := new(Report)
+	if err := dec(r); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(reportServer).Report(ctx, r)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: reportMethod}
+	return interceptor(ctx, r, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(reportServer).Report(ctx, req.(*Report))
+	})
+}
+
+// Server tracks the speakers reporting to the controller.
+type Server struct {
+	token   string
+	timeout time.Duration
+	leading func() bool
+	now     func() time.Time
+
+	grpc   *grpc.Server
+	health *health.Server
+
+	mu       sync.Mutex
+	speakers map[string]*Speaker
+}
+
+// NewServer returns a Server that considers speakers alive for
+// timeout after their last report. If token isn't empty, speakers
+// must send it as a bearer token. Connections are secured with creds,
+// e.g. TLS, or plaintext if it's nil. If leading isn't nil, reports
+// are refused while it returns false, so that speakers reconnect
+// until they reach the controller replica that acts on them.
+func NewServer(token string, creds credentials.TransportCredentials, timeout time.Duration, leading func() bool) *Server {
+	var opts []grpc.ServerOption
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	s := &Server{
+		token:    token,
+		timeout:  timeout,
+		leading:  leading,
+		now:      time.Now,
+		grpc:     grpc.NewServer(opts...),
+		health:   health.NewServer(),
+		speakers: map[string]*Speaker{},
+	}
+	s.grpc.RegisterService(&serviceDesc, s)
+	healthpb.RegisterHealthServer(s.grpc, s.health)
+	s.health.SetServingStatus(serviceName, healthpb.HealthCheckResponse_SERVING)
+	return s
+}
+
+// Serve accepts connections on lis until Stop is called.
+func (s *Server) Serve(lis net.Listener) error {
+	return s.grpc.Serve(lis)
+}
+
+// Stop closes the listeners and connections of the server.
+func (s *Server) Stop() {
+	s.health.Shutdown()
+	s.grpc.Stop()
+}
+
+// Report records the report of a speaker.
+func (s *Server) Report(ctx context.Context, r *Report) (*Ack, error) {
+	if s.token != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		auth := md.Get("authorization")
+		if len(auth) != 1 || subtle.ConstantTimeCompare([]byte(auth[0]), []byte("Bearer "+s.token)) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+	}
+	if r.Node == "" {
+		return nil, status.Error(codes.InvalidArgument, "report has no node")
+	}
+	if s.leading != nil && !s.leading() {
+		return nil, status.Error(codes.Unavailable, "not the leader")
+	}
+
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.speakers[r.Node] = &Speaker{Report: *r, LastSeen: now}
+	// Forget the speakers of nodes that are gone.
+	for node, sp := range s.speakers {
+		if now.Sub(sp.LastSeen) > forgetAfter*s.timeout {
+			delete(s.speakers, node)
+		}
+	}
+	return &Ack{}, nil
+}
+
+// Speakers not reporting for forgetAfter times the timeout are
+// forgotten.
+const forgetAfter = 10
+
+// Speakers returns the speakers that reported recently, by node.
+func (s *Server) Speakers() []Speaker {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]Speaker, 0, len(s.speakers))
+	for _, sp := range s.speakers {
+		ret = append(ret, s.speaker(sp, now))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Node < ret[j].Node })
+	return ret
+}
+
+// Alive returns the number of speakers that reported within the
+// timeout.
+func (s *Server) Alive() int {
+	n := 0
+	for _, sp := range s.Speakers() {
+		if sp.Alive {
+			n++
+		}
+	}
+	return n
+}
+
+// Drained returns whether the speaker of node reports that it is
+// draining and has withdrawn all its announcements, and whether it is
+// alive at all.
+func (s *Server) Drained(node string) (drained, alive bool) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, ok := s.speakers[node]
+	if !ok {
+		return false, false
+	}
+	ret := s.speaker(sp, now)
+	return ret.Alive && ret.Draining && len(ret.Announcements) == 0, ret.Alive
+}
+
+func (s *Server) speaker(sp *Speaker, now time.Time) Speaker {
+	ret := *sp
+	ret.Alive = now.Sub(sp.LastSeen) <= s.timeout
+	return ret
+}
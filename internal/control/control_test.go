@@ -0,0 +1,171 @@
+package control
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestReport(t *testing.T) {
+	leading := true
+	s := NewServer("secret", nil, time.Minute, func() bool { return leading })
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rep := &Report{
+		Node: "iris",
+		Pod:  "speaker-1",
+		Announcements: []Announcement{
+			{Service: "test/foo", IP: "1.2.3.4", Protocol: "bgp"},
+		},
+	}
+
+	bad := &Reporter{Address: lis.Addr().String(), Token: "wrong", Insecure: true}
+	if err := bad.send(ctx, rep); err == nil {
+		t.Fatal("report with the wrong token succeeded")
+	}
+
+	r := &Reporter{Address: lis.Addr().String(), Token: "secret", Insecure: true}
+	leading = false
+	if err := r.send(ctx, rep); err == nil {
+		t.Fatal("report to a standby replica succeeded")
+	}
+	if len(s.Speakers()) != 0 {
+		t.Fatal("standby replica recorded a report")
+	}
+	leading = true
+	if err := r.send(ctx, rep); err != nil {
+		t.Fatalf("report failed: %s", err)
+	}
+	want := []Speaker{{Report: *rep, LastSeen: now, Alive: true}}
+	if diff := cmp.Diff(want, s.Speakers()); diff != "" {
+		t.Errorf("speakers (-want +got)\n%s", diff)
+	}
+	if drained, alive := s.Drained("iris"); drained || !alive {
+		t.Errorf("announcing speaker: got drained=%v alive=%v, want false true", drained, alive)
+	}
+
+	rep.Draining = true
+	rep.Announcements = nil
+	if err := r.send(ctx, rep); err != nil {
+		t.Fatalf("report failed: %s", err)
+	}
+	if drained, alive := s.Drained("iris"); !drained || !alive {
+		t.Errorf("drained speaker: got drained=%v alive=%v, want true true", drained, alive)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if s.Alive() != 0 {
+		t.Error("speaker alive after the timeout")
+	}
+	if _, alive := s.Drained("iris"); alive {
+		t.Error("speaker alive after the timeout")
+	}
+	now = now.Add(time.Hour)
+	if err := r.send(ctx, &Report{Node: "pandora"}); err != nil {
+		t.Fatalf("report failed: %s", err)
+	}
+	if got := s.Speakers(); len(got) != 1 || got[0].Node != "pandora" {
+		t.Errorf("speakers gone for an hour not forgotten: %v", got)
+	}
+
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: serviceName})
+	if err != nil {
+		t.Fatalf("health check failed: %s", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("health status: got %s, want SERVING", resp.Status)
+	}
+}
+
+// testCreds returns the credentials of a server with a self-signed
+// certificate for 127.0.0.1, and of a client that trusts it.
+func testCreds(t *testing.T) (server, client credentials.TransportCredentials) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "metallb-controller"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = credentials.NewServerTLSFromCert(&tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	client = credentials.NewTLS(&tls.Config{RootCAs: pool})
+	return server, client
+}
+
+func TestReportTLS(t *testing.T) {
+	serverCreds, clientCreds := testCreds(t)
+	s := NewServer("secret", serverCreds, time.Minute, nil)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	defer s.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rep := &Report{Node: "iris", Pod: "speaker-1"}
+
+	// The token isn't sent in plaintext, unless asked to.
+	plain := &Reporter{Address: lis.Addr().String(), Token: "secret"}
+	if err := plain.send(ctx, rep); err != errInsecureToken {
+		t.Fatalf("got error %v reporting in plaintext, want %v", err, errInsecureToken)
+	}
+	if plain.conn != nil {
+		t.Fatal("reporter connected to send the token in plaintext")
+	}
+
+	r := &Reporter{Address: lis.Addr().String(), Creds: clientCreds, Token: "secret"}
+	if err := r.send(ctx, rep); err != nil {
+		t.Fatalf("report over TLS failed: %s", err)
+	}
+	if s.Alive() != 1 {
+		t.Errorf("got %d speakers alive after a report over TLS, want 1", s.Alive())
+	}
+}
@@ -0,0 +1,87 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// errInsecureToken is returned instead of sending a bearer token over
+// a plaintext connection, where anyone on the path could read it.
+var errInsecureToken = errors.New("refusing to send the bearer token over a plaintext connection, without transport credentials")
+
+// Reporter periodically sends the report of a speaker to the
+// controller.
+type Reporter struct {
+	// host:port of the controller's control service.
+	Address string
+	// Transport credentials to connect with, e.g. TLS. The connection
+	// is plaintext if nil.
+	Creds credentials.TransportCredentials
+	// Bearer token to authenticate with, if not empty. It is only sent
+	// over a plaintext connection if Insecure is set.
+	Token    string
+	Insecure bool
+	Interval time.Duration
+	// Returns the report to send, or nil to skip this interval.
+	Report func() *Report
+
+	conn *grpc.ClientConn
+}
+
+// Run sends reports every Interval, forever.
+func (r *Reporter) Run(l log.Logger) {
+	failing := false
+	for range time.Tick(r.Interval) {
+		rep := r.Report()
+		if rep == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), r.Interval)
+		err := r.send(ctx, rep)
+		cancel()
+		// Only log changes, a controller that is down would otherwise
+		// flood the logs.
+		switch {
+		case err != nil && !failing:
+			l.Log("op", "controlReport", "address", r.Address, "error", err, "msg", "failed to report to the controller, will retry")
+		case err == nil && failing:
+			l.Log("op", "controlReport", "address", r.Address, "msg", "reporting to the controller again")
+		}
+		failing = err != nil
+	}
+}
+
+// send sends rep. After a failure, the next call reconnects, so that a
+// replica of the controller that refuses reports, or that went away,
+// is eventually replaced with another one behind the same address.
+func (r *Reporter) send(ctx context.Context, rep *Report) error {
+	if r.Token != "" && r.Creds == nil && !r.Insecure {
+		return errInsecureToken
+	}
+	if r.conn == nil {
+		transport := grpc.WithInsecure()
+		if r.Creds != nil {
+			transport = grpc.WithTransportCredentials(r.Creds)
+		}
+		conn, err := grpc.DialContext(ctx, r.Address, transport)
+		if err != nil {
+			return err
+		}
+		r.conn = conn
+	}
+	if r.Token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+r.Token)
+	}
+	if err := r.conn.Invoke(ctx, reportMethod, rep, &Ack{}, grpc.CallContentSubtype("json")); err != nil {
+		r.conn.Close()
+		r.conn = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Package debug exposes runtime diagnostics (pprof profiles, expvar
+// variables and on-demand goroutine/heap dumps) for MetalLB's
+// daemons.
+package debug // import "go.universe.tf/metallb/internal/debug"
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	rpprof "runtime/pprof"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Serve starts an HTTP server on addr exposing pprof under
+// /debug/pprof/ and expvar under /debug/vars. The handlers are
+// registered on a private mux, so they are never reachable through
+// the metrics listener.
+//
+// addr should usually be a loopback address such as
+// "127.0.0.1:6060", since profiles can leak sensitive information.
+func Serve(l log.Logger, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	go func() {
+		l.Log("op", "debugServer", "addr", addr, "msg", "serving debug endpoints")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			l.Log("op", "debugServer", "error", err, "msg", "debug server stopped")
+		}
+	}()
+}
+
+// DumpOnSignal writes a goroutine and a heap profile to dir every
+// time the process receives SIGUSR1.
+func DumpOnSignal(l log.Logger, dir string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			if err := dump(l, dir); err != nil {
+				l.Log("op", "debugDump", "error", err, "msg", "failed to write debug dump")
+			}
+		}
+	}()
+}
+
+func dump(l log.Logger, dir string) error {
+	ts := time.Now().UTC().Format("20060102T150405Z")
+	for _, p := range []struct {
+		name  string
+		debug int
+	}{
+		// debug=2 prints full goroutine stacks in text form, the
+		// heap profile stays in the binary format for go tool pprof.
+		{"goroutine", 2},
+		{"heap", 0},
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("metallb-%s-%d-%s.pprof", p.name, os.Getpid(), ts))
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("creating %q: %s", path, err)
+		}
+		err = rpprof.Lookup(p.name).WriteTo(f, p.debug)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("writing %s profile: %s", p.name, err)
+		}
+		l.Log("op", "debugDump", "profile", p.name, "path", path, "msg", "wrote debug dump")
+	}
+	return nil
+}
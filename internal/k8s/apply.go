@@ -0,0 +1,141 @@
+package k8s
+
+import (
+	"encoding/json"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// With a field manager set, status writes use server-side apply: the
+// apiserver records which fields MetalLB owns, and leaves the other
+// fields of the status, e.g. conditions set by other controllers,
+// alone. Applies are forced, as for any controller that is
+// authoritative for its fields, so that ownership that other writers
+// take is visible in the objects' managedFields rather than failing
+// every write.
+//
+// Applies only remove the fields that MetalLB owns, so fields are
+// cleared with merge patches instead: an IP written before the upgrade
+// to server-side apply, by an update, has another owner, and would
+// stay otherwise.
+//
+// Apiservers before 1.16 reject apply patches, and get updates of the
+// whole status instead.
+
+// statusPatch returns the apply patch that sets status on the object
+// namespace/name of the given kind.
+func statusPatch(apiVersion, kind, namespace, name string, status map[string]interface{}) ([]byte, error) {
+	metadata := map[string]interface{}{"name": name}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	return json.Marshal(map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata":   metadata,
+		"status":     status,
+	})
+}
+
+// writeServiceStatus writes the load balancer status of svc, with
+// server-side apply as fieldManager, or with an update of the whole
+// status if fieldManager is empty.
+func writeServiceStatus(client kubernetes.Interface, fieldManager string, svc *v1.Service) error {
+	if fieldManager == "" {
+		_, err := client.CoreV1().Services(svc.Namespace).UpdateStatus(svc)
+		return err
+	}
+	if len(svc.Status.LoadBalancer.Ingress) == 0 {
+		_, err := client.CoreV1().Services(svc.Namespace).Patch(svc.Name, types.MergePatchType, clearPatch("loadBalancer"), "status")
+		return err
+	}
+	patch, err := statusPatch("v1", "Service", svc.Namespace, svc.Name, map[string]interface{}{
+		"loadBalancer": svc.Status.LoadBalancer,
+	})
+	if err != nil {
+		return err
+	}
+	err = client.CoreV1().RESTClient().Patch(types.ApplyPatchType).
+		Namespace(svc.Namespace).
+		Resource("services").
+		Name(svc.Name).
+		SubResource("status").
+		Param("fieldManager", fieldManager).
+		Param("force", "true").
+		Body(patch).
+		Do().
+		Error()
+	if applyUnsupported(err) {
+		_, err = client.CoreV1().Services(svc.Namespace).UpdateStatus(svc)
+	}
+	return err
+}
+
+// writeDynamicStatus writes the fields of obj's status, with
+// server-side apply as fieldManager, or with an update of the whole
+// status if fieldManager is empty.
+func writeDynamicStatus(client dynamic.Interface, fieldManager string, res schema.GroupVersionResource, obj *unstructured.Unstructured, fields ...string) error {
+	ri := client.Resource(res)
+	var ns dynamic.ResourceInterface = ri
+	if obj.GetNamespace() != "" {
+		ns = ri.Namespace(obj.GetNamespace())
+	}
+	if fieldManager == "" {
+		_, err := ns.UpdateStatus(obj, metav1.UpdateOptions{})
+		return err
+	}
+
+	status := map[string]interface{}{}
+	var cleared []string
+	for _, f := range fields {
+		if v, ok, _ := unstructured.NestedFieldNoCopy(obj.Object, "status", f); ok && v != nil {
+			status[f] = v
+		} else {
+			cleared = append(cleared, f)
+		}
+	}
+	if len(status) > 0 {
+		patch, err := statusPatch(obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace(), obj.GetName(), status)
+		if err != nil {
+			return err
+		}
+		force := true
+		_, err = ns.Patch(obj.GetName(), types.ApplyPatchType, patch, metav1.PatchOptions{FieldManager: fieldManager, Force: &force}, "status")
+		if applyUnsupported(err) {
+			_, err = ns.UpdateStatus(obj, metav1.UpdateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(cleared) > 0 {
+		_, err := ns.Patch(obj.GetName(), types.MergePatchType, clearPatch(cleared...), metav1.PatchOptions{}, "status")
+		return err
+	}
+	return nil
+}
+
+// applyUnsupported returns true if err is the apiserver rejecting an
+// apply patch.
+func applyUnsupported(err error) bool {
+	return apierrors.IsUnsupportedMediaType(err) || apierrors.IsNotAcceptable(err)
+}
+
+// clearPatch returns the merge patch that removes fields from the
+// status of an object, whichever manager owns them.
+func clearPatch(fields ...string) []byte {
+	status := map[string]interface{}{}
+	for _, f := range fields {
+		status[f] = nil
+	}
+	bs, _ := json.Marshal(map[string]interface{}{"status": status})
+	return bs
+}
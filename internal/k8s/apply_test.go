@@ -0,0 +1,144 @@
+package k8s
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestStatusPatch(t *testing.T) {
+	lb := v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}}
+	bs, err := statusPatch("v1", "Service", "ns", "svc", map[string]interface{}{"loadBalancer": lb})
+	if err != nil {
+		t.Fatalf("building patch: %s", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatalf("patch is not JSON: %s", err)
+	}
+	want := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"name":      "svc",
+			"namespace": "ns",
+		},
+		"status": map[string]interface{}{
+			"loadBalancer": map[string]interface{}{
+				"ingress": []interface{}{
+					map[string]interface{}{"ip": "1.2.3.4"},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong patch\ngot:  %s\nwant: %v", bs, want)
+	}
+
+	// Cluster-scoped objects have no namespace.
+	bs, err = statusPatch("metallb.universe.tf/v1alpha1", "IPClaim", "", "claim", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("building patch: %s", err)
+	}
+	got = nil
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatalf("patch is not JSON: %s", err)
+	}
+	if _, ok := got["metadata"].(map[string]interface{})["namespace"]; ok {
+		t.Errorf("patch of cluster-scoped object has a namespace: %s", bs)
+	}
+}
+
+func TestClearServiceStatus(t *testing.T) {
+	// The IP was written by another manager, e.g. by an update before
+	// the upgrade to server-side apply, so an apply of an empty status
+	// wouldn't remove it.
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Name:      "svc",
+			ManagedFields: []metav1.ManagedFieldsEntry{
+				{Manager: "controller", Operation: metav1.ManagedFieldsOperationUpdate},
+			},
+		},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}},
+		},
+	}
+	client := fake.NewSimpleClientset(svc)
+
+	cleared := svc.DeepCopy()
+	cleared.Status = v1.ServiceStatus{}
+	if err := writeServiceStatus(client, "metallb-controller", cleared); err != nil {
+		t.Fatalf("clearing status: %s", err)
+	}
+	got, err := client.CoreV1().Services("ns").Get("svc", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting service: %s", err)
+	}
+	if len(got.Status.LoadBalancer.Ingress) != 0 {
+		t.Errorf("IP owned by another manager not cleared: %v", got.Status.LoadBalancer)
+	}
+}
+
+func TestApplyFallback(t *testing.T) {
+	// Apiservers before 1.16 don't know apply patches.
+	var updated *v1.Service
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPatch && r.Header.Get("Content-Type") == string(types.ApplyPatchType):
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"UnsupportedMediaType","code":415}`))
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v1/namespaces/ns/services/svc/status":
+			bs, _ := ioutil.ReadAll(r.Body)
+			updated = &v1.Service{}
+			if err := json.Unmarshal(bs, updated); err != nil {
+				t.Errorf("decoding update: %s", err)
+			}
+			w.Write(bs)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("creating client: %s", err)
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "svc"},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}},
+		},
+	}
+	if err := writeServiceStatus(client, "metallb-controller", svc); err != nil {
+		t.Fatalf("writing status: %s", err)
+	}
+	if updated == nil {
+		t.Fatal("status not updated after the apply was rejected")
+	}
+	if !reflect.DeepEqual(updated.Status, svc.Status) {
+		t.Errorf("wrong status updated\ngot:  %v\nwant: %v", updated.Status, svc.Status)
+	}
+}
+
+func TestClearPatch(t *testing.T) {
+	got := string(clearPatch("address", "message"))
+	want := `{"status":{"address":null,"message":null}}`
+	if got != want {
+		t.Errorf("wrong patch\ngot:  %s\nwant: %s", got, want)
+	}
+}
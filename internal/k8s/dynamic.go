@@ -0,0 +1,60 @@
+package k8s
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchDynamic sets up a watch of all objects of resource, for
+// resources whose types aren't vendored. Each change queues the
+// object's key wrapped by mkKey.
+func (c *Client) watchDynamic(k8sConfig *rest.Config, resource schema.GroupVersionResource, mkKey func(string) interface{}) (cache.Indexer, cache.Controller, error) {
+	if c.dynamic == nil {
+		dyn, err := dynamic.NewForConfig(k8sConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating dynamic Kubernetes client: %s", err)
+		}
+		c.dynamic = dyn
+	}
+
+	objs := c.dynamic.Resource(resource)
+	watcher := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return objs.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return objs.Watch(options)
+		},
+	}
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(mkKey(key))
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(new)
+			if err == nil {
+				c.queue.Add(mkKey(key))
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(mkKey(key))
+			}
+		},
+	}
+	indexer, informer := cache.NewIndexerInformer(watcher, &unstructured.Unstructured{}, 0, handlers, cache.Indexers{})
+	c.syncFuncs = append(c.syncFuncs, informer.HasSynced)
+	return indexer, informer, nil
+}
@@ -0,0 +1,55 @@
+package k8s
+
+import (
+	"github.com/go-kit/kit/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+)
+
+// GatewayResource is the Gateway API resource that the controller
+// allocates addresses for. The Gateway API types aren't vendored, so
+// gateways are handled as unstructured objects.
+var GatewayResource = schema.GroupVersionResource{
+	Group:    "gateway.networking.k8s.io",
+	Version:  "v1",
+	Resource: "gateways",
+}
+
+// GatewayNameLabel is set by Gateway API implementations on the
+// resources they create for a gateway, such as its data plane
+// Service, to the gateway's name.
+const GatewayNameLabel = "gateway.networking.k8s.io/gateway-name"
+
+type gatewayKey string
+
+// watchGateways sets up the watch of all gateways, calling changed
+// for each change.
+func (c *Client) watchGateways(k8sConfig *rest.Config, changed func(log.Logger, string, *unstructured.Unstructured) SyncState) error {
+	indexer, informer, err := c.watchDynamic(k8sConfig, GatewayResource, func(k string) interface{} { return gatewayKey(k) })
+	if err != nil {
+		return err
+	}
+	c.gwIndexer, c.gwInformer = indexer, informer
+	c.gatewayChanged = changed
+	return nil
+}
+
+func (c *Client) syncGateway(k gatewayKey) SyncState {
+	l := log.With(c.logger, "gateway", string(k))
+	gw, exists, err := c.gwIndexer.GetByKey(string(k))
+	if err != nil {
+		l.Log("op", "getGateway", "error", err, "msg", "failed to get gateway")
+		return SyncStateError
+	}
+	if !exists {
+		return c.gatewayChanged(l, string(k), nil)
+	}
+	return c.gatewayChanged(l, string(k), gw.(*unstructured.Unstructured))
+}
+
+// UpdateGatewayStatus writes the status of gw back into the
+// Kubernetes cluster.
+func (c *Client) UpdateGatewayStatus(gw *unstructured.Unstructured) error {
+	return writeDynamicStatus(c.dynamic, c.fieldManager, GatewayResource, gw, "addresses")
+}
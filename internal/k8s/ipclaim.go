@@ -0,0 +1,49 @@
+package k8s
+
+import (
+	"github.com/go-kit/kit/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+)
+
+// IPClaimResource is MetalLB's cluster-scoped IPClaim resource, which
+// reserves an address from a pool independently of any Service.
+var IPClaimResource = schema.GroupVersionResource{
+	Group:    "metallb.universe.tf",
+	Version:  "v1alpha1",
+	Resource: "ipclaims",
+}
+
+type ipClaimKey string
+
+// watchIPClaims sets up the watch of all IP claims, calling changed
+// for each change.
+func (c *Client) watchIPClaims(k8sConfig *rest.Config, changed func(log.Logger, string, *unstructured.Unstructured) SyncState) error {
+	indexer, informer, err := c.watchDynamic(k8sConfig, IPClaimResource, func(k string) interface{} { return ipClaimKey(k) })
+	if err != nil {
+		return err
+	}
+	c.claimIndexer, c.claimInformer = indexer, informer
+	c.ipClaimChanged = changed
+	return nil
+}
+
+func (c *Client) syncIPClaim(k ipClaimKey) SyncState {
+	l := log.With(c.logger, "ipclaim", string(k))
+	claim, exists, err := c.claimIndexer.GetByKey(string(k))
+	if err != nil {
+		l.Log("op", "getIPClaim", "error", err, "msg", "failed to get IP claim")
+		return SyncStateError
+	}
+	if !exists {
+		return c.ipClaimChanged(l, string(k), nil)
+	}
+	return c.ipClaimChanged(l, string(k), claim.(*unstructured.Unstructured))
+}
+
+// UpdateIPClaimStatus writes the status of claim back into the
+// Kubernetes cluster.
+func (c *Client) UpdateIPClaimStatus(claim *unstructured.Unstructured) error {
+	return writeDynamicStatus(c.dynamic, c.fieldManager, IPClaimResource, claim, "address", "pool", "message")
+}
@@ -1,17 +1,38 @@
 package k8s // import "go.universe.tf/metallb/internal/k8s"
 
 import (
+	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/secrets"
 
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -24,29 +45,111 @@ import (
 // Client watches a Kubernetes cluster and translates events into
 // Controller method calls.
 type Client struct {
-	logger log.Logger
+	logger    log.Logger
+	namespace string
 
-	client *kubernetes.Clientset
-	events record.EventRecorder
-	queue  workqueue.RateLimitingInterface
+	client  *kubernetes.Clientset
+	dynamic dynamic.Interface
+	events  record.EventRecorder
+	queue   *priorityQueue
 
-	svcIndexer   cache.Indexer
-	svcInformer  cache.Controller
-	epIndexer    cache.Indexer
-	epInformer   cache.Controller
-	cmIndexer    cache.Indexer
-	cmInformer   cache.Controller
-	nodeIndexer  cache.Indexer
-	nodeInformer cache.Controller
+	svcIndexer    cache.Indexer
+	svcInformer   cache.Controller
+	epIndexer     cache.Indexer
+	epInformer    cache.Controller
+	cmIndexer     cache.Indexer
+	cmInformer    cache.Controller
+	nodeIndexer   cache.Indexer
+	nodeInformer  cache.Controller
+	nsIndexer     cache.Indexer
+	nsInformer    cache.Controller
+	gwIndexer     cache.Indexer
+	gwInformer    cache.Controller
+	claimIndexer  cache.Indexer
+	claimInformer cache.Controller
+	netIndexer    cache.Indexer
+	netInformer   cache.Controller
+
+	clusterNodeIndexer  cache.Indexer
+	clusterNodeInformer cache.Controller
 
 	syncFuncs []cache.InformerSynced
 
+	// Failed attempts of pending Service writes, for metrics.
+	writes writeTracker
+	// If non-nil, Service statuses are written in the background
+	// through it, see Config.StatusQPS.
+	status *statusWriter
+	// Field manager of server-side applied status writes, see
+	// Config.FieldManager.
+	fieldManager string
+
+	configName   string
+	configSecret bool
+	reloadMu     sync.Mutex
+	reloadSeq    int
+	reloads      map[reloadKey]chan error
+	calls        map[callKey]func()
+
+	strictConfig bool
+	// If true, configuration warnings are recorded as events.
+	configWarningEvents bool
+	secretProviders     map[string]secrets.Provider
+
+	// Serves the metrics port.
+	mux *http.ServeMux
+
+	leaseName     string
+	identity      string
+	isLeader      int32
+	electionCtx   context.Context
+	stopElection  context.CancelFunc
+	leaderChanged func(string)
+
 	serviceChanged func(log.Logger, string, *v1.Service, *v1.Endpoints) SyncState
 	configChanged  func(log.Logger, *config.Config) SyncState
 	nodeChanged    func(log.Logger, *v1.Node) SyncState
+	nsChanged      func(log.Logger, string, *v1.Namespace) SyncState
+	gatewayChanged func(log.Logger, string, *unstructured.Unstructured) SyncState
+	ipClaimChanged func(log.Logger, string, *unstructured.Unstructured) SyncState
+	networkChanged func(log.Logger, string, *unstructured.Unstructured) SyncState
 	synced         func(log.Logger)
+
+	clusterNodeChanged func(log.Logger, string, *v1.Node) SyncState
 }
 
+// DrainAnnotation is set on a node by the controller to ask the
+// speaker running there to withdraw all its announcements, ahead of
+// the speaker being restarted.
+const DrainAnnotation = "metallb.universe.tf/drain"
+
+// MaintenanceAnnotation is set on a node, to any value, to put it in
+// maintenance: its speaker hands its announcements over to other
+// nodes, ahead of planned work on it.
+const MaintenanceAnnotation = "metallb.universe.tf/maintenance"
+
+// WarmupAnnotation is set by a speaker on its node while it warms up
+// after starting, so that the other speakers keep announcing the
+// layer2 IPs it would take over. Its value is the RFC 3339 time at
+// which the warm-up ends at the latest.
+const WarmupAnnotation = "metallb.universe.tf/warming-up"
+
+// SpeakerAnnotation is set by a speaker on its node while it runs, so
+// that the other speakers only elect nodes running a speaker to
+// originate aggregates. Its value is the RFC 3339 time until which the
+// speaker runs at least, which it renews while it does.
+const SpeakerAnnotation = "metallb.universe.tf/speaker"
+
+// FencedAnnotation is set to "true" on a namespace, e.g. by ops
+// tooling during an incident, to withdraw the announcements of all
+// its services.
+const FencedAnnotation = "metallb.universe.tf/fenced"
+
+// NamespaceFencedAnnotation is set to "true" by the controller on
+// the services of fenced namespaces, so that speakers withdraw them
+// without watching namespaces.
+const NamespaceFencedAnnotation = "metallb.universe.tf/namespace-fenced"
+
 // SyncState is the result of calling synchronization callbacks.
 type SyncState int
 
@@ -66,23 +169,139 @@ const (
 type Config struct {
 	ProcessName   string
 	ConfigMapName string
+	// If true, the configuration is read from the Secret named
+	// ConfigMapName instead of a ConfigMap.
+	ConfigSecret  bool
 	NodeName      string
 	MetricsHost   string
 	MetricsPort   int
 	ReadEndpoints bool
 	Logger        log.Logger
 
+	// If true, configurations with warnings are rejected, see
+	// config.Parser.Strict.
+	StrictConfig bool
+	// If true, warnings about the configuration are recorded as
+	// Events on the ConfigMap or Secret. Set it in one process only,
+	// so that they aren't repeated by every speaker.
+	ConfigWarningEvents bool
+	// Providers of credentials that the configuration refers to, in
+	// addition to Kubernetes Secrets, by source name.
+	SecretProviders map[string]secrets.Provider
+	// How often to reload the configuration so that rotated
+	// credentials take effect, 0 to only reload on changes.
+	SecretRefreshInterval time.Duration
+
+	// If non-empty, only the Services, and their Endpoints, of these
+	// namespaces are watched. With a single namespace, the watches
+	// are namespaced, and only need namespaced permissions.
+	ServiceNamespaces []string
+
 	ServiceChanged func(log.Logger, string, *v1.Service, *v1.Endpoints) SyncState
 	ConfigChanged  func(log.Logger, *config.Config) SyncState
 	NodeChanged    func(log.Logger, *v1.Node) SyncState
+	// NamespaceChanged is called with a nil namespace when the named
+	// namespace is deleted.
+	NamespaceChanged func(log.Logger, string, *v1.Namespace) SyncState
+	// ClusterNodeChanged is called for every node of the cluster,
+	// unlike NodeChanged, with a nil node when the named node is
+	// deleted.
+	ClusterNodeChanged func(log.Logger, string, *v1.Node) SyncState
+	// GatewayChanged is called with a nil gateway when the named
+	// gateway is deleted. Setting it requires the Gateway API CRDs to
+	// be installed.
+	GatewayChanged func(log.Logger, string, *unstructured.Unstructured) SyncState
+	// IPClaimChanged is called with a nil claim when the named IP
+	// claim is deleted. Setting it requires the IPClaim CRD to be
+	// installed.
+	IPClaimChanged func(log.Logger, string, *unstructured.Unstructured) SyncState
+	// NetworkChanged is called with a nil attachment when the named
+	// Multus NetworkAttachmentDefinition is deleted. Setting it
+	// requires the Multus CRDs to be installed.
+	NetworkChanged func(log.Logger, string, *unstructured.Unstructured) SyncState
 	Synced         func(log.Logger)
+
+	// Ready, if set, is served on /ready on the metrics port. The
+	// process reports ready when it returns nil. If unset, /ready
+	// always succeeds.
+	Ready func() error
+
+	// If set, the configuration can be reloaded with a POST to
+	// /reload on the metrics port, authenticated with the bearer
+	// token in this file. SIGHUP always reloads the configuration.
+	ReloadTokenFile string
+
+	// If StatusQPS is non-zero, UpdateStatus queues statuses to be
+	// written in the background, with their own client limited to
+	// StatusQPS writes per second with bursts of StatusBurst. A
+	// status queued again before it's written replaces the pending
+	// one. Services whose status can't be written are processed
+	// again. If zero, UpdateStatus writes synchronously through the
+	// informers' client.
+	StatusQPS   float32
+	StatusBurst int
+	// If set, the statuses of Services, Gateways and IPClaims are
+	// written with server-side apply as this field manager, and only
+	// the status fields MetalLB manages are sent. Other writers'
+	// fields are left alone. If empty, whole statuses are updated.
+	FieldManager string
+
+	// If set, Run only processes events while the process holds the
+	// Lease called LeaseName in MetalLB's namespace, as Identity.
+	// Until then, the process is a standby replica: it serves
+	// metrics, but doesn't change anything. LeaderChanged is called
+	// with the identity of each new leader.
+	LeaseName     string
+	Identity      string
+	LeaderChanged func(leader string)
+}
+
+// watchedNamespaces returns the namespace to watch objects of
+// namespaces in, and a filter of the objects to process, nil for all.
+func watchedNamespaces(namespaces []string) (string, func(interface{}) bool) {
+	switch len(namespaces) {
+	case 0:
+		return v1.NamespaceAll, nil
+	case 1:
+		return namespaces[0], nil
+	}
+	watched := map[string]bool{}
+	for _, ns := range namespaces {
+		watched[ns] = true
+	}
+	return v1.NamespaceAll, func(obj interface{}) bool {
+		if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = d.Obj
+		}
+		m, err := meta.Accessor(obj)
+		return err == nil && watched[m.GetNamespace()]
+	}
+}
+
+// filterHandlers returns handlers that only pass the objects that
+// filter accepts on to h, or h if filter is nil.
+func filterHandlers(filter func(interface{}) bool, h cache.ResourceEventHandler) cache.ResourceEventHandler {
+	if filter == nil {
+		return h
+	}
+	return cache.FilteringResourceEventHandler{FilterFunc: filter, Handler: h}
 }
 
 type svcKey string
 type cmKey string
 type nodeKey string
+type nsKey string
+type clusterNodeKey string
 type synced string
 
+// reloadKey is a request to reload the configuration. Each request
+// has its own key, so that the queue doesn't merge them.
+type reloadKey int
+
+// callKey is a request to run a function on the sync goroutine, see
+// Call.
+type callKey int
+
 // New connects to masterAddr, using kubeconfig to authenticate.
 //
 // The client uses processName to identify itself to the cluster
@@ -107,13 +326,46 @@ func New(cfg *Config) (*Client, error) {
 	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(clientset.CoreV1().RESTClient()).Events("")})
 	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: cfg.ProcessName})
 
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	queue := newPriorityQueue(workqueue.DefaultControllerRateLimiter())
 
 	c := &Client{
-		logger: cfg.Logger,
-		client: clientset,
-		events: recorder,
-		queue:  queue,
+		logger:    cfg.Logger,
+		namespace: namespace,
+		client:    clientset,
+		events:    recorder,
+		queue:     queue,
+
+		configName:   cfg.ConfigMapName,
+		configSecret: cfg.ConfigSecret,
+		reloads:      map[reloadKey]chan error{},
+		calls:        map[callKey]func(){},
+
+		strictConfig:        cfg.StrictConfig,
+		configWarningEvents: cfg.ConfigWarningEvents,
+		secretProviders:     cfg.SecretProviders,
+
+		leaseName:     cfg.LeaseName,
+		identity:      cfg.Identity,
+		leaderChanged: cfg.LeaderChanged,
+
+		fieldManager: cfg.FieldManager,
+	}
+	c.electionCtx, c.stopElection = context.WithCancel(context.Background())
+
+	if cfg.StatusQPS > 0 {
+		statusConfig := rest.CopyConfig(k8sConfig)
+		statusConfig.QPS = cfg.StatusQPS
+		statusConfig.Burst = cfg.StatusBurst
+		statusClient, err := kubernetes.NewForConfig(statusConfig)
+		if err != nil {
+			return nil, fmt.Errorf("creating Kubernetes client for status writes: %s", err)
+		}
+		c.status = newStatusWriter(statusClient, cfg.FieldManager, &c.writes, cfg.Logger, func(key string) {
+			c.queue.AddRateLimited(svcKey(key))
+		})
+		for i := 0; i < statusWorkers; i++ {
+			go c.status.run()
+		}
 	}
 
 	if cfg.ServiceChanged != nil {
@@ -121,24 +373,32 @@ func New(cfg *Config) (*Client, error) {
 			AddFunc: func(obj interface{}) {
 				key, err := cache.MetaNamespaceKeyFunc(obj)
 				if err == nil {
-					c.queue.Add(svcKey(key))
+					c.queue.AddPriority(svcKey(key))
 				}
 			},
 			UpdateFunc: func(old interface{}, new interface{}) {
 				key, err := cache.MetaNamespaceKeyFunc(new)
-				if err == nil {
+				if err != nil {
+					return
+				}
+				// Status-only updates, mostly our own writes coming
+				// back, can wait behind services that need an IP.
+				if serviceSpecChanged(old, new) {
+					c.queue.AddPriority(svcKey(key))
+				} else {
 					c.queue.Add(svcKey(key))
 				}
 			},
 			DeleteFunc: func(obj interface{}) {
 				key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 				if err == nil {
-					c.queue.Add(svcKey(key))
+					c.queue.AddPriority(svcKey(key))
 				}
 			},
 		}
-		svcWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "services", v1.NamespaceAll, fields.Everything())
-		c.svcIndexer, c.svcInformer = cache.NewIndexerInformer(svcWatcher, &v1.Service{}, 0, svcHandlers, cache.Indexers{})
+		svcNamespace, svcFilter := watchedNamespaces(cfg.ServiceNamespaces)
+		svcWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "services", svcNamespace, fields.Everything())
+		c.svcIndexer, c.svcInformer = cache.NewIndexerInformer(svcWatcher, &v1.Service{}, 0, filterHandlers(svcFilter, svcHandlers), cache.Indexers{})
 
 		c.serviceChanged = cfg.ServiceChanged
 		c.syncFuncs = append(c.syncFuncs, c.svcInformer.HasSynced)
@@ -164,8 +424,8 @@ func New(cfg *Config) (*Client, error) {
 					}
 				},
 			}
-			epWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "endpoints", v1.NamespaceAll, fields.Everything())
-			c.epIndexer, c.epInformer = cache.NewIndexerInformer(epWatcher, &v1.Endpoints{}, 0, epHandlers, cache.Indexers{})
+			epWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "endpoints", svcNamespace, fields.Everything())
+			c.epIndexer, c.epInformer = cache.NewIndexerInformer(epWatcher, &v1.Endpoints{}, 0, filterHandlers(svcFilter, epHandlers), cache.Indexers{})
 
 			c.syncFuncs = append(c.syncFuncs, c.epInformer.HasSynced)
 		}
@@ -176,27 +436,51 @@ func New(cfg *Config) (*Client, error) {
 			AddFunc: func(obj interface{}) {
 				key, err := cache.MetaNamespaceKeyFunc(obj)
 				if err == nil {
-					c.queue.Add(cmKey(key))
+					c.queue.AddPriority(cmKey(key))
 				}
 			},
 			UpdateFunc: func(old interface{}, new interface{}) {
 				key, err := cache.MetaNamespaceKeyFunc(new)
 				if err == nil {
-					c.queue.Add(cmKey(key))
+					c.queue.AddPriority(cmKey(key))
 				}
 			},
 			DeleteFunc: func(obj interface{}) {
 				key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 				if err == nil {
-					c.queue.Add(cmKey(key))
+					c.queue.AddPriority(cmKey(key))
 				}
 			},
 		}
-		cmWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "configmaps", namespace, fields.OneTermEqualSelector("metadata.name", cfg.ConfigMapName))
-		c.cmIndexer, c.cmInformer = cache.NewIndexerInformer(cmWatcher, &v1.ConfigMap{}, 0, cmHandlers, cache.Indexers{})
+		resource, obj := "configmaps", runtime.Object(&v1.ConfigMap{})
+		if cfg.ConfigSecret {
+			resource, obj = "secrets", &v1.Secret{}
+		}
+		cmWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), resource, namespace, fields.OneTermEqualSelector("metadata.name", cfg.ConfigMapName))
+		c.cmIndexer, c.cmInformer = cache.NewIndexerInformer(cmWatcher, obj, 0, cmHandlers, cache.Indexers{})
 
 		c.configChanged = cfg.ConfigChanged
 		c.syncFuncs = append(c.syncFuncs, c.cmInformer.HasSynced)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := c.Reload(); err != nil {
+					c.logger.Log("op", "reload", "error", err, "msg", "reload on SIGHUP failed")
+				}
+			}
+		}()
+
+		if cfg.SecretRefreshInterval > 0 {
+			go func() {
+				for range time.Tick(cfg.SecretRefreshInterval) {
+					if err := c.Reload(); err != nil && err != errNotLeader {
+						c.logger.Log("op", "reload", "error", err, "msg", "periodic reload for rotated secrets failed")
+					}
+				}
+			}()
+		}
 	}
 
 	if cfg.NodeChanged != nil {
@@ -227,21 +511,146 @@ func New(cfg *Config) (*Client, error) {
 		c.syncFuncs = append(c.syncFuncs, c.nodeInformer.HasSynced)
 	}
 
+	if cfg.NamespaceChanged != nil {
+		handlers := cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				key, err := cache.MetaNamespaceKeyFunc(obj)
+				if err == nil {
+					c.queue.Add(nsKey(key))
+				}
+			},
+			UpdateFunc: func(old interface{}, new interface{}) {
+				key, err := cache.MetaNamespaceKeyFunc(new)
+				if err == nil {
+					c.queue.Add(nsKey(key))
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+				if err == nil {
+					c.queue.Add(nsKey(key))
+				}
+			},
+		}
+		watcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "namespaces", v1.NamespaceAll, fields.Everything())
+		c.nsIndexer, c.nsInformer = cache.NewIndexerInformer(watcher, &v1.Namespace{}, 0, handlers, cache.Indexers{})
+
+		c.nsChanged = cfg.NamespaceChanged
+		c.syncFuncs = append(c.syncFuncs, c.nsInformer.HasSynced)
+	}
+
+	if cfg.ClusterNodeChanged != nil {
+		handlers := cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				key, err := cache.MetaNamespaceKeyFunc(obj)
+				if err == nil {
+					c.queue.Add(clusterNodeKey(key))
+				}
+			},
+			UpdateFunc: func(old interface{}, new interface{}) {
+				key, err := cache.MetaNamespaceKeyFunc(new)
+				if err == nil {
+					c.queue.Add(clusterNodeKey(key))
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+				if err == nil {
+					c.queue.Add(clusterNodeKey(key))
+				}
+			},
+		}
+		watcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "nodes", v1.NamespaceAll, fields.Everything())
+		c.clusterNodeIndexer, c.clusterNodeInformer = cache.NewIndexerInformer(watcher, &v1.Node{}, 0, handlers, cache.Indexers{})
+
+		c.clusterNodeChanged = cfg.ClusterNodeChanged
+		c.syncFuncs = append(c.syncFuncs, c.clusterNodeInformer.HasSynced)
+	}
+
+	if cfg.GatewayChanged != nil {
+		if err := c.watchGateways(k8sConfig, cfg.GatewayChanged); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.IPClaimChanged != nil {
+		if err := c.watchIPClaims(k8sConfig, cfg.IPClaimChanged); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.NetworkChanged != nil {
+		if err := c.watchNetworkAttachments(k8sConfig, cfg.NetworkChanged); err != nil {
+			return nil, err
+		}
+	}
+
 	if cfg.Synced != nil {
 		c.synced = cfg.Synced
 	}
 
-	http.Handle("/metrics", promhttp.Handler())
+	// Use a private mux rather than http.DefaultServeMux, so that
+	// debug handlers registered as a side effect of imports
+	// (net/http/pprof, expvar) are not exposed on the metrics port.
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Ready != nil {
+			if err := cfg.Ready(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if c.configChanged != nil && cfg.ReloadTokenFile != "" {
+		bs, err := ioutil.ReadFile(cfg.ReloadTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading reload token: %s", err)
+		}
+		token := strings.TrimSpace(string(bs))
+		if token == "" {
+			return nil, fmt.Errorf("reload token file %q is empty", cfg.ReloadTokenFile)
+		}
+		mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if err := c.Reload(); err == errNotLeader {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+	}
+	c.mux = mux
 	go func() {
-		http.ListenAndServe(fmt.Sprintf("%s:%d", cfg.MetricsHost, cfg.MetricsPort), nil)
+		http.ListenAndServe(net.JoinHostPort(cfg.MetricsHost, strconv.Itoa(cfg.MetricsPort)), mux)
 	}()
 
 	return c, nil
 }
 
 // Run watches for events on the Kubernetes cluster, and dispatches
-// calls to the Controller.
+// calls to the Controller. With leader election, it first waits to
+// become the leader, and returns an error if it stops being the
+// leader.
 func (c *Client) Run() error {
+	if c.leaseName != "" {
+		return c.runElected()
+	}
+	return c.run()
+}
+
+func (c *Client) run() error {
 	if c.svcInformer != nil {
 		go c.svcInformer.Run(nil)
 	}
@@ -254,6 +663,21 @@ func (c *Client) Run() error {
 	if c.nodeInformer != nil {
 		go c.nodeInformer.Run(nil)
 	}
+	if c.nsInformer != nil {
+		go c.nsInformer.Run(nil)
+	}
+	if c.clusterNodeInformer != nil {
+		go c.clusterNodeInformer.Run(nil)
+	}
+	if c.gwInformer != nil {
+		go c.gwInformer.Run(nil)
+	}
+	if c.claimInformer != nil {
+		go c.claimInformer.Run(nil)
+	}
+	if c.netInformer != nil {
+		go c.netInformer.Run(nil)
+	}
 
 	if !cache.WaitForCacheSync(nil, c.syncFuncs...) {
 		return errors.New("timed out waiting for cache sync")
@@ -281,21 +705,163 @@ func (c *Client) Run() error {
 					c.queue.AddRateLimited(svcKey(k))
 				}
 			}
+			if c.gwIndexer != nil {
+				for _, k := range c.gwIndexer.ListKeys() {
+					c.queue.AddRateLimited(gatewayKey(k))
+				}
+			}
+			if c.claimIndexer != nil {
+				for _, k := range c.claimIndexer.ListKeys() {
+					c.queue.AddRateLimited(ipClaimKey(k))
+				}
+			}
+		}
+	}
+}
+
+// Stop makes Run return, once the work already queued is done.
+func (c *Client) Stop() {
+	c.queue.ShutDown()
+	c.stopElection()
+}
+
+// ForceSync reprocesses all watched services.
+func (c *Client) ForceSync() {
+	if c.svcIndexer != nil {
+		for _, k := range c.svcIndexer.ListKeys() {
+			c.queue.Add(svcKey(k))
 		}
 	}
 }
 
+// RequeueAfter processes the service name again after d, regardless
+// of the backoff of its failed syncs.
+func (c *Client) RequeueAfter(name string, d time.Duration) {
+	c.queue.AddAfter(svcKey(name), d)
+}
+
+// ListServices returns the services in the informer's cache. They
+// may be ahead of the events processed so far.
+func (c *Client) ListServices() []*v1.Service {
+	if c.svcIndexer == nil {
+		return nil
+	}
+	var ret []*v1.Service
+	for _, obj := range c.svcIndexer.List() {
+		ret = append(ret, obj.(*v1.Service))
+	}
+	return ret
+}
+
 // Update writes svc back into the Kubernetes cluster. If successful,
 // the updated Service is returned. Note that changes to svc.Status
 // are not propagated, for that you need to call UpdateStatus.
 func (c *Client) Update(svc *v1.Service) (*v1.Service, error) {
-	return c.client.CoreV1().Services(svc.Namespace).Update(svc)
+	start := time.Now()
+	ret, err := c.client.CoreV1().Services(svc.Namespace).Update(svc)
+	c.writes.done(opUpdate, svc.Namespace+"/"+svc.Name, start, err)
+	return ret, err
 }
 
 // UpdateStatus writes the protected "status" field of svc back into
-// the Kubernetes cluster.
+// the Kubernetes cluster. With Config.StatusQPS set, it only queues
+// the write, and returns nil.
 func (c *Client) UpdateStatus(svc *v1.Service) error {
-	_, err := c.client.CoreV1().Services(svc.Namespace).UpdateStatus(svc)
+	if c.status != nil {
+		c.status.add(svc)
+		return nil
+	}
+	start := time.Now()
+	err := writeServiceStatus(c.client, c.fieldManager, svc)
+	c.writes.done(opUpdateStatus, svc.Namespace+"/"+svc.Name, start, err)
+	return err
+}
+
+// GetDaemonSet returns the DaemonSet called name in MetalLB's
+// namespace.
+func (c *Client) GetDaemonSet(name string) (*appsv1.DaemonSet, error) {
+	return c.client.AppsV1().DaemonSets(c.namespace).Get(name, metav1.GetOptions{})
+}
+
+// UpdateDaemonSet writes ds back into the Kubernetes cluster.
+func (c *Client) UpdateDaemonSet(ds *appsv1.DaemonSet) error {
+	_, err := c.client.AppsV1().DaemonSets(ds.Namespace).Update(ds)
+	return err
+}
+
+// ListPods returns the pods in MetalLB's namespace that match
+// selector.
+func (c *Client) ListPods(selector *metav1.LabelSelector) ([]v1.Pod, error) {
+	sel, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("parsing label selector: %s", err)
+	}
+	pods, err := c.client.CoreV1().Pods(c.namespace).List(metav1.ListOptions{LabelSelector: sel.String()})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// NamespaceUID returns the UID of the namespace name.
+func (c *Client) NamespaceUID(name string) (string, error) {
+	ns, err := c.client.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return string(ns.UID), nil
+}
+
+// ConfigMapData returns the data of the ConfigMap name in namespace,
+// which needn't be MetalLB's, or nil if it doesn't exist.
+func (c *Client) ConfigMapData(namespace, name string) (map[string]string, error) {
+	cm, err := c.client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cm.Data, nil
+}
+
+// nodeLabels returns the labels of the cluster's nodes, by node name.
+func (c *Client) nodeLabels() (map[string]labels.Set, error) {
+	nodes, err := c.client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]labels.Set{}
+	for _, n := range nodes.Items {
+		ret[n.Name] = labels.Set(n.Labels)
+	}
+	return ret, nil
+}
+
+// DeletePod deletes the pod called name in MetalLB's namespace.
+func (c *Client) DeletePod(name string) error {
+	return c.client.CoreV1().Pods(c.namespace).Delete(name, &metav1.DeleteOptions{})
+}
+
+// SetNodeAnnotation sets the annotation key to value on node. An
+// empty value removes the annotation.
+func (c *Client) SetNodeAnnotation(node, key, value string) error {
+	n, err := c.client.CoreV1().Nodes().Get(node, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if n.Annotations[key] == value {
+		return nil
+	}
+	if value == "" {
+		delete(n.Annotations, key)
+	} else {
+		if n.Annotations == nil {
+			n.Annotations = map[string]string{}
+		}
+		n.Annotations[key] = value
+	}
+	_, err = c.client.CoreV1().Nodes().Update(n)
 	return err
 }
 
@@ -309,6 +875,184 @@ func (c *Client) Errorf(svc *v1.Service, kind, msg string, args ...interface{})
 	c.events.Eventf(svc, v1.EventTypeWarning, kind, msg, args...)
 }
 
+// NodeErrorf logs an error event about the node name to the
+// Kubernetes cluster.
+func (c *Client) NodeErrorf(name, kind, msg string, args ...interface{}) {
+	ref := &v1.ObjectReference{
+		Kind: "Node",
+		Name: name,
+		// Node events are conventionally attached to the node's name
+		// as UID, so that they show in kubectl describe node.
+		UID: types.UID(name),
+	}
+	c.events.Eventf(ref, v1.EventTypeWarning, kind, msg, args...)
+}
+
+// configDocuments returns the parts of the configuration in data,
+// the contents of a ConfigMap or Secret. The configuration is in the
+// "config" key, and optionally split further across keys starting
+// with "config.", e.g. "config.peers". The parts are returned in
+// key order, so that they always merge the same way.
+func configDocuments(data map[string][]byte) [][]byte {
+	var keys []string
+	for k := range data {
+		if k == "config" || strings.HasPrefix(k, "config.") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var ret [][]byte
+	for _, k := range keys {
+		ret = append(ret, data[k])
+	}
+	return ret
+}
+
+// configData returns the data of obj, a ConfigMap or Secret.
+func configData(obj interface{}) map[string][]byte {
+	switch o := obj.(type) {
+	case *v1.ConfigMap:
+		ret := map[string][]byte{}
+		for k, v := range o.Data {
+			ret[k] = []byte(v)
+		}
+		return ret
+	case *v1.Secret:
+		return o.Data
+	}
+	return nil
+}
+
+// loadConfig parses the configuration in obj, a ConfigMap or Secret,
+// and hands it to the controller. It returns why the configuration
+// was rejected, if it was.
+func (c *Client) loadConfig(l log.Logger, obj interface{}) (SyncState, error) {
+	// Note that configs that we can read, but that fail parsing
+	// or validation, result in a "synced" state, because the
+	// config is not going to parse any better until the k8s
+	// object changes to fix the issue.
+	parser := config.NewParser(c.client)
+	parser.Strict = c.strictConfig
+	if c.configWarningEvents {
+		// Only the process that reports config warnings checks the
+		// node labels, not every speaker.
+		parser.Nodes = c.nodeLabels
+	}
+	for n, p := range c.secretProviders {
+		parser.Secrets[n] = p
+	}
+	cfg, err := parser.ParseDocuments(configDocuments(configData(obj)))
+	if err != nil {
+		l.Log("event", "configStale", "error", err, "msg", "config (re)load failed, config marked stale")
+		configStale.Set(1)
+		return SyncStateSuccess, err
+	}
+	for _, w := range cfg.Warnings {
+		l.Log("event", "configWarning", "warning", w, "msg", "suspicious configuration")
+		if ro, ok := obj.(runtime.Object); ok && c.configWarningEvents {
+			c.events.Event(ro, v1.EventTypeWarning, "ConfigWarning", w)
+		}
+	}
+	configWarnings.Set(float64(len(cfg.Warnings)))
+
+	st := c.configChanged(l, cfg)
+	if st == SyncStateError {
+		l.Log("event", "configStale", "error", err, "msg", "config (re)load failed, config marked stale")
+		configStale.Set(1)
+		return SyncStateSuccess, errors.New("configuration rejected, see logs for details")
+	}
+
+	configLoaded.Set(1)
+	configStale.Set(0)
+
+	l.Log("event", "configLoaded", "msg", "config (re)loaded")
+	return st, nil
+}
+
+// errShuttingDown is returned by requests made to the event loop
+// once Stop was called, which it would never process.
+var errShuttingDown = errors.New("shutting down")
+
+// Reload re-reads the configuration from the cluster, bypassing the
+// watch cache, and applies it. Secrets that the configuration refers
+// to are read again too. It returns once the configuration is
+// applied, or with the reason it wasn't, e.g. because the client is
+// stopping.
+func (c *Client) Reload() error {
+	if c.configChanged == nil {
+		return errors.New("not watching the configuration")
+	}
+	if !c.leading() {
+		return errNotLeader
+	}
+	done := make(chan error, 1)
+	c.reloadMu.Lock()
+	c.reloadSeq++
+	k := reloadKey(c.reloadSeq)
+	c.reloads[k] = done
+	c.reloadMu.Unlock()
+
+	if !c.queue.AddPriority(k) {
+		c.reloadMu.Lock()
+		delete(c.reloads, k)
+		c.reloadMu.Unlock()
+		return errShuttingDown
+	}
+	return <-done
+}
+
+// Handle serves h on path on the metrics port, in addition to
+// /metrics, /ready and /reload.
+func (c *Client) Handle(path string, h http.Handler) {
+	c.mux.Handle(path, h)
+}
+
+// Call runs f on the goroutine that calls the controller, between two
+// events, so that f can safely read the controller's state. It
+// returns once f has run, or an error if the process is on standby
+// or shutting down.
+func (c *Client) Call(f func()) error {
+	if !c.leading() {
+		return errNotLeader
+	}
+	done := make(chan struct{})
+	c.reloadMu.Lock()
+	c.reloadSeq++
+	k := callKey(c.reloadSeq)
+	c.calls[k] = func() {
+		f()
+		close(done)
+	}
+	c.reloadMu.Unlock()
+
+	if !c.queue.AddPriority(k) {
+		c.reloadMu.Lock()
+		delete(c.calls, k)
+		c.reloadMu.Unlock()
+		return errShuttingDown
+	}
+	<-done
+	return nil
+}
+
+func (c *Client) reload(l log.Logger) (SyncState, error) {
+	var (
+		obj interface{}
+		err error
+	)
+	if c.configSecret {
+		obj, err = c.client.CoreV1().Secrets(c.namespace).Get(c.configName, metav1.GetOptions{})
+	} else {
+		obj, err = c.client.CoreV1().ConfigMaps(c.namespace).Get(c.configName, metav1.GetOptions{})
+	}
+	if err != nil {
+		l.Log("op", "reload", "error", err, "msg", "failed to get configuration")
+		return SyncStateSuccess, err
+	}
+	l.Log("event", "reload", "msg", "reloading configuration on request")
+	return c.loadConfig(l, obj)
+}
+
 func (c *Client) sync(key interface{}) SyncState {
 	defer c.queue.Done(key)
 
@@ -321,6 +1065,7 @@ func (c *Client) sync(key interface{}) SyncState {
 			return SyncStateError
 		}
 		if !exists {
+			c.writes.forget(string(k))
 			return c.serviceChanged(l, string(k), nil, nil)
 		}
 
@@ -351,32 +1096,27 @@ func (c *Client) sync(key interface{}) SyncState {
 			return c.configChanged(l, nil)
 		}
 
-		// Note that configs that we can read, but that fail parsing
-		// or validation, result in a "synced" state, because the
-		// config is not going to parse any better until the k8s
-		// object changes to fix the issue.
-		cm := cmi.(*v1.ConfigMap)
-		parser := config.NewParser(c.client)
-		cfg, err := parser.Parse([]byte(cm.Data["config"]))
-		if err != nil {
-			l.Log("event", "configStale", "error", err, "msg", "config (re)load failed, config marked stale")
-			configStale.Set(1)
-			return SyncStateSuccess
-		}
-
-		st := c.configChanged(l, cfg)
-		if st == SyncStateError {
-			l.Log("event", "configStale", "error", err, "msg", "config (re)load failed, config marked stale")
-			configStale.Set(1)
-			return SyncStateSuccess
-		}
-
-		configLoaded.Set(1)
-		configStale.Set(0)
+		st, _ := c.loadConfig(l, cmi)
+		return st
 
-		l.Log("event", "configLoaded", "msg", "config (re)loaded")
+	case reloadKey:
+		l := log.With(c.logger, "configmap", c.configName)
+		st, err := c.reload(l)
+		c.reloadMu.Lock()
+		done := c.reloads[k]
+		delete(c.reloads, k)
+		c.reloadMu.Unlock()
+		done <- err
 		return st
 
+	case callKey:
+		c.reloadMu.Lock()
+		f := c.calls[k]
+		delete(c.calls, k)
+		c.reloadMu.Unlock()
+		f()
+		return SyncStateSuccess
+
 	case nodeKey:
 		l := log.With(c.logger, "node", string(k))
 		n, exists, err := c.nodeIndexer.GetByKey(string(k))
@@ -391,6 +1131,39 @@ func (c *Client) sync(key interface{}) SyncState {
 		node := n.(*v1.Node)
 		return c.nodeChanged(c.logger, node)
 
+	case nsKey:
+		l := log.With(c.logger, "namespace", string(k))
+		ns, exists, err := c.nsIndexer.GetByKey(string(k))
+		if err != nil {
+			l.Log("op", "getNamespace", "error", err, "msg", "failed to get namespace")
+			return SyncStateError
+		}
+		if !exists {
+			return c.nsChanged(l, string(k), nil)
+		}
+		return c.nsChanged(l, string(k), ns.(*v1.Namespace))
+
+	case clusterNodeKey:
+		l := log.With(c.logger, "node", string(k))
+		n, exists, err := c.clusterNodeIndexer.GetByKey(string(k))
+		if err != nil {
+			l.Log("op", "getNode", "error", err, "msg", "failed to get node")
+			return SyncStateError
+		}
+		if !exists {
+			return c.clusterNodeChanged(l, string(k), nil)
+		}
+		return c.clusterNodeChanged(l, string(k), n.(*v1.Node))
+
+	case gatewayKey:
+		return c.syncGateway(k)
+
+	case ipClaimKey:
+		return c.syncIPClaim(k)
+
+	case networkKey:
+		return c.syncNetworkAttachment(k)
+
 	case synced:
 		if c.synced != nil {
 			c.synced(c.logger)
@@ -0,0 +1,93 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Leader election timings, the defaults of Kubernetes' own
+// controllers.
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// errNotLeader is returned by requests that would change state on a
+// standby replica.
+var errNotLeader = errors.New("not the leader, this replica is on standby")
+
+// leading returns whether the client processes events: it either
+// doesn't use leader election, or holds the lease.
+func (c *Client) leading() bool {
+	return c.leaseName == "" || atomic.LoadInt32(&c.isLeader) != 0
+}
+
+// runElected campaigns for the lease, and processes events while it
+// holds it. It returns once Stop is called, or with an error when
+// leadership is lost, since the state built while leading can't be
+// trusted anymore.
+func (c *Client) runElected() error {
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, c.namespace, c.leaseName, c.client.CoreV1(), c.client.CoordinationV1(), resourcelock.ResourceLockConfig{
+		Identity:      c.identity,
+		EventRecorder: c.events,
+	})
+	if err != nil {
+		return fmt.Errorf("creating leader election lock: %s", err)
+	}
+
+	var (
+		started = make(chan struct{})
+		runErr  = make(chan error, 1)
+	)
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Name:          c.leaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				c.logger.Log("op", "leaderElection", "lease", c.leaseName, "identity", c.identity, "msg", "acquired leadership, processing events")
+				atomic.StoreInt32(&c.isLeader, 1)
+				close(started)
+				runErr <- c.run()
+				c.stopElection()
+			},
+			OnStoppedLeading: func() {
+				atomic.StoreInt32(&c.isLeader, 0)
+			},
+			OnNewLeader: func(identity string) {
+				c.logger.Log("op", "leaderElection", "lease", c.leaseName, "leader", identity, "msg", "new leader elected")
+				if c.leaderChanged != nil {
+					c.leaderChanged(identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("creating leader elector: %s", err)
+	}
+
+	// Run only returns early if the lease couldn't be renewed.
+	le.Run(c.electionCtx)
+
+	if c.electionCtx.Err() == nil {
+		c.queue.ShutDown()
+		return fmt.Errorf("lost leadership of lease %q", c.leaseName)
+	}
+	select {
+	case <-started:
+		// Stopped while leading, finish the work already queued.
+		return <-runErr
+	default:
+		// Stopped on standby.
+		return nil
+	}
+}
@@ -0,0 +1,44 @@
+package k8s
+
+import (
+	"github.com/go-kit/kit/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+)
+
+// NetworkAttachmentResource is Multus' NetworkAttachmentDefinition
+// resource, which describes a secondary network. Its types aren't
+// vendored, so attachments are handled as unstructured objects.
+var NetworkAttachmentResource = schema.GroupVersionResource{
+	Group:    "k8s.cni.cncf.io",
+	Version:  "v1",
+	Resource: "network-attachment-definitions",
+}
+
+type networkKey string
+
+// watchNetworkAttachments sets up the watch of all network
+// attachment definitions, calling changed for each change.
+func (c *Client) watchNetworkAttachments(k8sConfig *rest.Config, changed func(log.Logger, string, *unstructured.Unstructured) SyncState) error {
+	indexer, informer, err := c.watchDynamic(k8sConfig, NetworkAttachmentResource, func(k string) interface{} { return networkKey(k) })
+	if err != nil {
+		return err
+	}
+	c.netIndexer, c.netInformer = indexer, informer
+	c.networkChanged = changed
+	return nil
+}
+
+func (c *Client) syncNetworkAttachment(k networkKey) SyncState {
+	l := log.With(c.logger, "network", string(k))
+	nad, exists, err := c.netIndexer.GetByKey(string(k))
+	if err != nil {
+		l.Log("op", "getNetworkAttachment", "error", err, "msg", "failed to get network attachment definition")
+		return SyncStateError
+	}
+	if !exists {
+		return c.networkChanged(l, string(k), nil)
+	}
+	return c.networkChanged(l, string(k), nad.(*unstructured.Unstructured))
+}
@@ -0,0 +1,263 @@
+package k8s
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var (
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "queue_depth",
+		Help:      "Number of keys waiting to be processed, by priority.",
+	}, []string{
+		"priority",
+	})
+
+	queueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "queue_adds_total",
+		Help:      "Number of keys added to the work queue, by priority. Keys already waiting are not queued again.",
+	}, []string{
+		"priority",
+	})
+
+	queueRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "queue_retries_total",
+		Help:      "Number of keys requeued with backoff after a failure or for reprocessing.",
+	})
+
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "queue_wait_seconds",
+		Help:      "How long keys waited in the work queue before being processed, by priority.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{
+		"priority",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth)
+	prometheus.MustRegister(queueAdds)
+	prometheus.MustRegister(queueRetries)
+	prometheus.MustRegister(queueWait)
+}
+
+// priorityQueue is a rate limiting work queue whose keys are handed
+// out high priority first, so that e.g. new services get their IPs
+// while a flood of endpoint changes waits. Like the workqueue
+// package's queues, a key waits in the queue at most once, and is not
+// handed out again until Done is called for it.
+type priorityQueue struct {
+	limiter workqueue.RateLimiter
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// Keys waiting to be handed out, by priority.
+	high, low []interface{}
+	// Keys in high or low, or re-added while processing, and whether
+	// they are high priority.
+	waiting map[interface{}]bool
+	// When keys in waiting were first added.
+	since map[interface{}]time.Time
+	// Keys being processed.
+	processing map[interface{}]bool
+	shutdown   bool
+}
+
+var _ workqueue.RateLimitingInterface = &priorityQueue{}
+
+func newPriorityQueue(limiter workqueue.RateLimiter) *priorityQueue {
+	q := &priorityQueue{
+		limiter:    limiter,
+		waiting:    map[interface{}]bool{},
+		since:      map[interface{}]time.Time{},
+		processing: map[interface{}]bool{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func priorityName(high bool) string {
+	if high {
+		return "high"
+	}
+	return "low"
+}
+
+// Add queues key with low priority.
+func (q *priorityQueue) Add(key interface{}) {
+	q.add(key, false)
+}
+
+// AddPriority queues key with high priority, or raises the priority
+// of key if it's already waiting. It returns false if the queue is
+// shut down, and key will never be handed out.
+func (q *priorityQueue) AddPriority(key interface{}) bool {
+	return q.add(key, true)
+}
+
+func (q *priorityQueue) add(key interface{}, high bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.shutdown {
+		return false
+	}
+
+	wasHigh, ok := q.waiting[key]
+	if ok && (wasHigh || !high) {
+		return true
+	}
+	queueAdds.WithLabelValues(priorityName(high)).Inc()
+	q.waiting[key] = high
+	if !ok {
+		q.since[key] = time.Now()
+	}
+	if q.processing[key] {
+		// Queued by Done.
+		return true
+	}
+	if ok {
+		// Raising the priority of a waiting key.
+		q.low = remove(q.low, key)
+		queueDepth.WithLabelValues("low").Dec()
+	}
+	if high {
+		q.high = append(q.high, key)
+	} else {
+		q.low = append(q.low, key)
+	}
+	queueDepth.WithLabelValues(priorityName(high)).Inc()
+	q.cond.Signal()
+	return true
+}
+
+func remove(keys []interface{}, key interface{}) []interface{} {
+	for i, k := range keys {
+		if k == key {
+			return append(keys[:i], keys[i+1:]...)
+		}
+	}
+	return keys
+}
+
+// Get blocks until a key is waiting, and returns it, high priority
+// keys first. quit is true once the queue is shut down.
+func (q *priorityQueue) Get() (key interface{}, quit bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.high) == 0 && len(q.low) == 0 && !q.shutdown {
+		q.cond.Wait()
+	}
+	if len(q.high) == 0 && len(q.low) == 0 {
+		return nil, true
+	}
+
+	high := len(q.high) > 0
+	if high {
+		key, q.high = q.high[0], q.high[1:]
+	} else {
+		key, q.low = q.low[0], q.low[1:]
+	}
+	queueDepth.WithLabelValues(priorityName(high)).Dec()
+	queueWait.WithLabelValues(priorityName(high)).Observe(time.Since(q.since[key]).Seconds())
+	delete(q.waiting, key)
+	delete(q.since, key)
+	q.processing[key] = true
+	return key, false
+}
+
+// Done marks key as processed. If it was added again while being
+// processed, it is queued again.
+func (q *priorityQueue) Done(key interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, key)
+	if high, ok := q.waiting[key]; ok {
+		if high {
+			q.high = append(q.high, key)
+		} else {
+			q.low = append(q.low, key)
+		}
+		queueDepth.WithLabelValues(priorityName(high)).Inc()
+		q.cond.Signal()
+	}
+}
+
+// Len returns the number of keys waiting.
+func (q *priorityQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.high) + len(q.low)
+}
+
+// ShutDown makes Get return quit, once the waiting keys are handed
+// out, and ignores further additions.
+func (q *priorityQueue) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.shutdown = true
+	q.cond.Broadcast()
+}
+
+// ShuttingDown returns true once ShutDown was called.
+func (q *priorityQueue) ShuttingDown() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.shutdown
+}
+
+// AddAfter queues key with low priority after d.
+func (q *priorityQueue) AddAfter(key interface{}, d time.Duration) {
+	if d <= 0 {
+		q.Add(key)
+		return
+	}
+	time.AfterFunc(d, func() { q.Add(key) })
+}
+
+// AddRateLimited queues key with low priority once the rate limiter
+// allows it, backing off exponentially for keys that keep failing.
+func (q *priorityQueue) AddRateLimited(key interface{}) {
+	queueRetries.Inc()
+	q.AddAfter(key, q.limiter.When(key))
+}
+
+// Forget resets the backoff of key.
+func (q *priorityQueue) Forget(key interface{}) {
+	q.limiter.Forget(key)
+}
+
+// NumRequeues returns how many times key was requeued since it was
+// last forgotten.
+func (q *priorityQueue) NumRequeues(key interface{}) int {
+	return q.limiter.NumRequeues(key)
+}
+
+// serviceSpecChanged returns whether an update of a service changed
+// more than its status, and so may need a new allocation.
+func serviceSpecChanged(old, new interface{}) bool {
+	o, ok := old.(*v1.Service)
+	if !ok {
+		return true
+	}
+	n, ok := new.(*v1.Service)
+	if !ok {
+		return true
+	}
+	return !reflect.DeepEqual(o.Spec, n.Spec) ||
+		!reflect.DeepEqual(o.Annotations, n.Annotations) ||
+		!reflect.DeepEqual(o.Labels, n.Labels) ||
+		!reflect.DeepEqual(o.DeletionTimestamp, n.DeletionTimestamp)
+}
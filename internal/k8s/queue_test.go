@@ -0,0 +1,120 @@
+package k8s
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/config"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func drain(t *testing.T, q *priorityQueue) []interface{} {
+	var ret []interface{}
+	for q.Len() > 0 {
+		k, quit := q.Get()
+		if quit {
+			t.Fatal("queue shut down while draining")
+		}
+		ret = append(ret, k)
+		q.Done(k)
+	}
+	return ret
+}
+
+func TestPriorityQueue(t *testing.T) {
+	q := newPriorityQueue(workqueue.DefaultControllerRateLimiter())
+
+	q.Add(svcKey("a"))
+	q.Add(svcKey("b"))
+	q.AddPriority(svcKey("c"))
+	q.Add(svcKey("a"))
+	// Raises b above a.
+	q.AddPriority(svcKey("b"))
+	// Doesn't lower c.
+	q.Add(svcKey("c"))
+
+	want := []interface{}{svcKey("c"), svcKey("b"), svcKey("a")}
+	if got := drain(t, q); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong order, got %v, want %v", got, want)
+	}
+
+	// Keys added while processing are handed out again after Done,
+	// not concurrently.
+	q.Add(svcKey("a"))
+	k, _ := q.Get()
+	q.AddPriority(svcKey("a"))
+	if q.Len() != 0 {
+		t.Fatalf("key being processed was queued concurrently")
+	}
+	q.Add(svcKey("b"))
+	q.Done(k)
+	want = []interface{}{svcKey("a"), svcKey("b")}
+	if got := drain(t, q); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong order after requeue, got %v, want %v", got, want)
+	}
+
+	q.ShutDown()
+	q.Add(svcKey("a"))
+	if q.AddPriority(svcKey("b")) {
+		t.Fatal("AddPriority queued a key after ShutDown")
+	}
+	if _, quit := q.Get(); !quit {
+		t.Fatal("Get didn't quit after ShutDown")
+	}
+}
+
+func TestRequestsAfterShutDown(t *testing.T) {
+	c := &Client{
+		queue:   newPriorityQueue(workqueue.DefaultControllerRateLimiter()),
+		reloads: map[reloadKey]chan error{},
+		calls:   map[callKey]func(){},
+		configChanged: func(log.Logger, *config.Config) SyncState {
+			return SyncStateSuccess
+		},
+	}
+	c.queue.ShutDown()
+
+	// Nothing processes the queue anymore, the requests must fail
+	// rather than wait forever.
+	if err := c.Reload(); err != errShuttingDown {
+		t.Errorf("got error %v from Reload, want %v", err, errShuttingDown)
+	}
+	if err := c.Call(func() { t.Error("call ran after ShutDown") }); err != errShuttingDown {
+		t.Errorf("got error %v from Call, want %v", err, errShuttingDown)
+	}
+	if len(c.reloads) != 0 || len(c.calls) != 0 {
+		t.Error("requests still registered after failing")
+	}
+}
+
+func TestServiceSpecChanged(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{"foo": "bar"},
+		},
+		Spec: v1.ServiceSpec{
+			Type: "LoadBalancer",
+		},
+	}
+
+	status := svc.DeepCopy()
+	status.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}
+	if serviceSpecChanged(svc, status) {
+		t.Error("status-only update classified as spec change")
+	}
+
+	spec := svc.DeepCopy()
+	spec.Spec.LoadBalancerIP = "1.2.3.4"
+	if !serviceSpecChanged(svc, spec) {
+		t.Error("spec update not classified as spec change")
+	}
+
+	annotation := svc.DeepCopy()
+	annotation.Annotations["metallb.universe.tf/address-pool"] = "other"
+	if !serviceSpecChanged(svc, annotation) {
+		t.Error("annotation update not classified as spec change")
+	}
+}
@@ -30,6 +30,13 @@ var (
 		Name:      "config_stale_bool",
 		Help:      "1 if running on a stale configuration, because the latest config failed to load.",
 	})
+
+	configWarnings = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "config_warnings",
+		Help:      "Number of warnings about the loaded configuration, like deprecated settings or suspicious values.",
+	})
 )
 
 func init() {
@@ -37,4 +44,5 @@ func init() {
 	prometheus.MustRegister(updateErrors)
 	prometheus.MustRegister(configLoaded)
 	prometheus.MustRegister(configStale)
+	prometheus.MustRegister(configWarnings)
 }
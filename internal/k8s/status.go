@@ -0,0 +1,117 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	statusPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "service_status_pending",
+		Help:      "Number of Service status writes waiting for the status write rate limit.",
+	})
+
+	statusCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "service_status_coalesced_total",
+		Help:      "Number of Service status writes replaced by a newer status of the same service before being sent.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(statusPending)
+	prometheus.MustRegister(statusCoalesced)
+}
+
+// statusWorkers is how many Service statuses are written
+// concurrently, within the rate limit.
+const statusWorkers = 4
+
+// statusWriter writes Service statuses in the background, through a
+// client rate limited apart from the informers and the other
+// writes. A status queued again before it's written replaces the
+// pending one, so that bursts of (re)allocations, e.g. after a config
+// reload or a restart, write each service's status once.
+type statusWriter struct {
+	client       kubernetes.Interface
+	fieldManager string
+	writes       *writeTracker
+	logger       log.Logger
+	// failed is called with the key of each service whose status
+	// couldn't be written, to process it again.
+	failed func(key string)
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// Statuses waiting to be written, by service key, and their keys
+	// in the order they were first queued.
+	pending map[string]*v1.Service
+	order   []string
+}
+
+func newStatusWriter(client kubernetes.Interface, fieldManager string, writes *writeTracker, l log.Logger, failed func(string)) *statusWriter {
+	w := &statusWriter{
+		client:       client,
+		fieldManager: fieldManager,
+		writes:       writes,
+		logger:       l,
+		failed:       failed,
+		pending:      map[string]*v1.Service{},
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// add queues the status of svc to be written, replacing a pending
+// status of the same service.
+func (w *statusWriter) add(svc *v1.Service) {
+	key := svc.Namespace + "/" + svc.Name
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.pending[key]; ok {
+		statusCoalesced.Inc()
+	} else {
+		w.order = append(w.order, key)
+	}
+	w.pending[key] = svc
+	statusPending.Set(float64(len(w.pending)))
+	w.cond.Signal()
+}
+
+// next waits for a pending status, and removes it from the queue.
+func (w *statusWriter) next() *v1.Service {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.order) == 0 {
+		w.cond.Wait()
+	}
+	key := w.order[0]
+	w.order = w.order[1:]
+	svc := w.pending[key]
+	delete(w.pending, key)
+	statusPending.Set(float64(len(w.pending)))
+	return svc
+}
+
+// run writes pending statuses forever.
+func (w *statusWriter) run() {
+	for {
+		svc := w.next()
+		key := svc.Namespace + "/" + svc.Name
+		start := time.Now()
+		err := writeServiceStatus(w.client, w.fieldManager, svc)
+		w.writes.done(opUpdateStatus, key, start, err)
+		if err != nil {
+			w.logger.Log("op", "updateServiceStatus", "service", key, "error", err, "msg", "failed to update service status, will retry")
+			w.failed(key)
+		}
+	}
+}
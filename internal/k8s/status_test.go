@@ -0,0 +1,46 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func statusSvc(name, ip string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{
+				Ingress: []v1.LoadBalancerIngress{{IP: ip}},
+			},
+		},
+	}
+}
+
+func TestStatusWriterCoalesces(t *testing.T) {
+	w := newStatusWriter(nil, "", &writeTracker{}, log.NewNopLogger(), func(string) {})
+
+	w.add(statusSvc("a", "1.2.3.4"))
+	w.add(statusSvc("b", "1.2.3.5"))
+	// Replaces a's pending status, without moving it behind b.
+	w.add(statusSvc("a", "1.2.3.6"))
+
+	got := w.next()
+	if got.Name != "a" || got.Status.LoadBalancer.Ingress[0].IP != "1.2.3.6" {
+		t.Errorf("first write is %s with %v, want a with its latest status", got.Name, got.Status)
+	}
+	if got := w.next(); got.Name != "b" {
+		t.Errorf("second write is %s, want b", got.Name)
+	}
+	if len(w.pending) != 0 || len(w.order) != 0 {
+		t.Errorf("writes still pending: %v", w.order)
+	}
+
+	// Once written, a service's status is queued again.
+	w.add(statusSvc("a", "1.2.3.7"))
+	if got := w.next(); got.Status.LoadBalancer.Ingress[0].IP != "1.2.3.7" {
+		t.Errorf("got status %v, want the new one", got.Status)
+	}
+}
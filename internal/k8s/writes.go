@@ -0,0 +1,107 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var (
+	serviceWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "service_writes_total",
+		Help:      "Number of writes of Service objects to the apiserver, by operation (update or update_status) and result (success, conflict or error).",
+	}, []string{
+		"op",
+		"result",
+	})
+
+	serviceWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "service_write_seconds",
+		Help:      "How long writes of Service objects to the apiserver took, by operation, whatever their result.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{
+		"op",
+	})
+
+	serviceWriteAttempts = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "service_write_attempts",
+		Help:      "Number of attempts successful writes of Service objects took, by operation. Failed writes are retried with backoff, so each retry delays the update.",
+		Buckets:   []float64{1, 2, 3, 5, 8, 13, 21},
+	}, []string{
+		"op",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(serviceWrites)
+	prometheus.MustRegister(serviceWriteDuration)
+	prometheus.MustRegister(serviceWriteAttempts)
+}
+
+// Operations of Service writes, as they label metrics.
+const (
+	opUpdate       = "update"
+	opUpdateStatus = "update_status"
+)
+
+// writeTracker counts the failed attempts of Service writes until
+// they succeed, to report how many attempts each write took.
+type writeTracker struct {
+	mu sync.Mutex
+	// Failed attempts of the pending writes, by operation and
+	// service key.
+	failures map[writeKey]int
+}
+
+type writeKey struct {
+	op  string
+	svc string
+}
+
+// done records the result of a write of svc started at start, and
+// returns the number of attempts it took if it succeeded, zero if it
+// failed.
+func (w *writeTracker) done(op, svc string, start time.Time, err error) int {
+	serviceWriteDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	switch {
+	case err == nil:
+		serviceWrites.WithLabelValues(op, "success").Inc()
+	case apierrors.IsConflict(err):
+		serviceWrites.WithLabelValues(op, "conflict").Inc()
+	default:
+		serviceWrites.WithLabelValues(op, "error").Inc()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	k := writeKey{op, svc}
+	if err != nil {
+		if w.failures == nil {
+			w.failures = map[writeKey]int{}
+		}
+		w.failures[k]++
+		return 0
+	}
+	attempts := w.failures[k] + 1
+	delete(w.failures, k)
+	serviceWriteAttempts.WithLabelValues(op).Observe(float64(attempts))
+	return attempts
+}
+
+// forget drops the failed attempts of writes of the deleted service
+// svc, which will never succeed.
+func (w *writeTracker) forget(svc string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, op := range []string{opUpdate, opUpdateStatus} {
+		delete(w.failures, writeKey{op, svc})
+	}
+}
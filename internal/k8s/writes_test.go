@@ -0,0 +1,42 @@
+package k8s
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestWriteTracker(t *testing.T) {
+	var w writeTracker
+	conflict := apierrors.NewConflict(schema.GroupResource{Resource: "services"}, "svc", errors.New("object was modified"))
+
+	if got := w.done(opUpdateStatus, "ns/a", time.Now(), nil); got != 1 {
+		t.Errorf("first write succeeded after %d attempts, want 1", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := w.done(opUpdateStatus, "ns/a", time.Now(), conflict); got != 0 {
+			t.Errorf("failed write reported %d attempts, want 0", got)
+		}
+	}
+	// Failures of other operations and services are counted apart.
+	w.done(opUpdate, "ns/a", time.Now(), conflict)
+	w.done(opUpdateStatus, "ns/b", time.Now(), errors.New("connection refused"))
+	if got := w.done(opUpdateStatus, "ns/a", time.Now(), nil); got != 3 {
+		t.Errorf("write succeeded after %d attempts, want 3", got)
+	}
+	if got := w.done(opUpdateStatus, "ns/a", time.Now(), nil); got != 1 {
+		t.Errorf("next write succeeded after %d attempts, want 1", got)
+	}
+
+	// Writes of deleted services never succeed, their failures are
+	// dropped.
+	w.forget("ns/b")
+	w.forget("ns/a")
+	if len(w.failures) != 0 {
+		t.Errorf("failures of deleted services still tracked: %v", w.failures)
+	}
+}
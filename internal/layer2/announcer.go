@@ -1,9 +1,13 @@
 package layer2
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -16,69 +20,295 @@ type Announce struct {
 	logger log.Logger
 
 	sync.RWMutex
-	arps     map[int]*arpResponder
-	ndps     map[int]*ndpResponder
-	ips      map[string]net.IP // svcName -> IP
-	ipRefcnt map[string]int    // ip.String() -> number of uses
+	arps     map[link]*arpResponder
+	ndps     map[link]*ndpResponder
+	ips      map[string]net.IP  // svcName -> IP
+	opts     map[string]Options // svcName -> where and how its IP is announced
+	ipRefcnt map[string]int     // ip.String() -> number of uses
+	limiter  *replyLimiter
+	onChange func()
+	// Network namespaces to announce in besides ours, by path, and
+	// the ones whose stale host routes were deleted.
+	namespaces map[string]bool
+	flushed    map[string]bool
+	rescan     chan struct{}
+
+	vmacs      map[string]vmacLink      // macvlan interfaces of virtual MACs, by name
+	routes     map[hostRouteKey]bool    // host routes of unnumbered IPs
+	dummyAddrs map[dummyAddressKey]bool // IPs in secondary subnets on the dummy interface
 }
 
-// New returns an initialized Announce.
-func New(l log.Logger) (*Announce, error) {
+// Options are where and how an IP is announced. The zero value
+// announces it on every interface of our network namespace, with the
+// interfaces' MACs.
+type Options struct {
+	// If not empty, the IP is only announced on this interface.
+	Interface string
+	// Path of the network namespace on whose interfaces the IP is
+	// announced, ours if empty.
+	NetworkNamespace string
+	// If not nil, the IP is announced with this MAC rather than the
+	// interfaces' MACs.
+	VirtualMAC net.HardwareAddr
+	// If true, the IP is announced on unnumbered or point-to-point
+	// links: it gets a host route, and gratuitous announcements go
+	// to the neighbors on the link.
+	Unnumbered bool
+	// If true, the IP isn't in the subnets of the interfaces it's
+	// announced on, and is added to the dummy interface while
+	// announced.
+	SecondarySubnet bool
+}
+
+func (o Options) equal(other Options) bool {
+	return o.Interface == other.Interface &&
+		o.NetworkNamespace == other.NetworkNamespace &&
+		bytes.Equal(o.VirtualMAC, other.VirtualMAC) &&
+		o.Unnumbered == other.Unnumbered &&
+		o.SecondarySubnet == other.SecondarySubnet
+}
+
+// on returns true if the IP is announced on intf in netns.
+func (o Options) on(netns, intf string) bool {
+	return o.NetworkNamespace == netns && (o.Interface == "" || o.Interface == intf)
+}
+
+// link identifies an interface of a network namespace, "" being
+// ours.
+type link struct {
+	netns string
+	index int
+}
+
+// New returns an initialized Announce. Each requester gets at most
+// replyRate replies per second, in bursts of up to replyBurst, or
+// unlimited replies if replyRate is zero.
+func New(l log.Logger, replyRate float64, replyBurst int) (*Announce, error) {
 	ret := &Announce{
 		logger:   l,
-		arps:     map[int]*arpResponder{},
-		ndps:     map[int]*ndpResponder{},
+		limiter:  newReplyLimiter(replyRate, replyBurst),
+		arps:     map[link]*arpResponder{},
+		ndps:     map[link]*ndpResponder{},
 		ips:      map[string]net.IP{},
+		opts:     map[string]Options{},
 		ipRefcnt: map[string]int{},
+
+		namespaces: map[string]bool{},
+		flushed:    map[string]bool{},
+		rescan:     make(chan struct{}, 1),
+
+		vmacs:      map[string]vmacLink{},
+		routes:     map[hostRouteKey]bool{},
+		dummyAddrs: map[dummyAddressKey]bool{},
+	}
+	if err := flushHostRoutes(); err != nil {
+		l.Log("op", "flushHostRoutes", "error", err, "msg", "failed to delete stale host routes")
+	}
+	if err := deleteDummyInterface(dummyInterface); err != nil {
+		l.Log("op", "deleteDummyInterface", "error", err, "msg", "failed to delete stale IPs in secondary subnets")
 	}
 	go ret.interfaceScan()
+	go ret.refreshVirtualMACs()
 
 	return ret, nil
 }
 
+// OnInterfaceChange registers f to be called whenever the set of
+// interfaces that MetalLB announces on changes.
+func (a *Announce) OnInterfaceChange(f func()) {
+	a.Lock()
+	defer a.Unlock()
+	a.onChange = f
+}
+
+// SetNetworkNamespaces sets the network namespaces, by path, whose
+// interfaces IPs are announced on besides ours.
+func (a *Announce) SetNetworkNamespaces(paths []string) {
+	a.Lock()
+	defer a.Unlock()
+	namespaces := map[string]bool{}
+	for _, p := range paths {
+		namespaces[p] = true
+	}
+	if reflect.DeepEqual(namespaces, a.namespaces) {
+		return
+	}
+	a.namespaces = namespaces
+	a.flushNetnsHostRoutes()
+	select {
+	case a.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// flushNetnsHostRoutes deletes the host routes left over by a
+// previous run in the network namespaces we didn't know of yet, and
+// reinstalls ours. The caller must hold the lock.
+func (a *Announce) flushNetnsHostRoutes() {
+	resync := false
+	for p := range a.namespaces {
+		if a.flushed[p] {
+			continue
+		}
+		if err := inNetns(p, flushHostRoutes); err != nil {
+			a.logger.Log("op", "flushHostRoutes", "netns", p, "error", err, "msg", "failed to delete stale host routes")
+			continue
+		}
+		a.flushed[p] = true
+		for r := range a.routes {
+			if r.netns == p {
+				delete(a.routes, r)
+				resync = true
+			}
+		}
+	}
+	if resync {
+		a.syncHostRoutes()
+	}
+}
+
 func (a *Announce) interfaceScan() {
+	// Link changes are only watched in our network namespace, the
+	// interfaces of other namespaces are polled.
+	go watchLinks(a.logger, a.rescan)
 	for {
-		a.updateInterfaces()
-		time.Sleep(10 * time.Second)
+		added, removed := a.updateInterfaces()
+		if added {
+			// Neighbors on a restored link may have stale entries
+			// for our IPs, or none at all.
+			a.reannounce()
+		}
+		if added || removed {
+			a.RLock()
+			f := a.onChange
+			a.RUnlock()
+			if f != nil {
+				f()
+			}
+		}
+
+		select {
+		case <-a.rescan:
+		case <-time.After(10 * time.Second):
+		}
 	}
 }
 
-func (a *Announce) updateInterfaces() {
+// updateInterfaces creates and deletes responders to match the
+// current state of the interfaces of the network namespaces we
+// announce in, and reports whether any were added or removed.
+func (a *Announce) updateInterfaces() (added, removed bool) {
+	a.Lock()
+	defer a.Unlock()
+	// Namespaces that couldn't be entered before are retried.
+	a.flushNetnsHostRoutes()
+
+	netnses := []string{""}
+	for p := range a.namespaces {
+		netnses = append(netnses, p)
+	}
+	sort.Strings(netnses[1:])
+
+	keepARP, keepNDP := map[link]bool{}, map[link]bool{}
+	for _, netns := range netnses {
+		ok := false
+		err := inNetns(netns, func() error {
+			var nsAdded bool
+			nsAdded, ok = a.updateNetnsInterfaces(netns, keepARP, keepNDP)
+			added = added || nsAdded
+			return nil
+		})
+		if err != nil {
+			// Its responders are deleted below, the namespace may
+			// be gone.
+			a.logger.Log("op", "enterNetworkNamespace", "netns", netns, "error", err, "msg", "couldn't enter network namespace, not announcing on its interfaces")
+			continue
+		}
+		if !ok {
+			return
+		}
+	}
+	defer a.syncVirtualMACs()
+
+	for k, client := range a.arps {
+		if !keepARP[k] {
+			client.Close()
+			delete(a.arps, k)
+			removed = true
+			a.logger.Log("interface", client.Interface(), "netns", k.netns, "event", "deleteARPResponder", "msg", "deleted ARP responder for interface")
+		}
+	}
+	for k, client := range a.ndps {
+		if !keepNDP[k] {
+			client.Close()
+			delete(a.ndps, k)
+			removed = true
+			a.logger.Log("interface", client.Interface(), "netns", k.netns, "event", "deleteNDPResponder", "msg", "deleted NDP responder for interface")
+		}
+	}
+
+	return
+}
+
+// updateNetnsInterfaces creates the responders for the interfaces of
+// netns, which the calling thread is in, and marks the ones to keep.
+// It reports whether any were added, and false if the scan failed.
+func (a *Announce) updateNetnsInterfaces(netns string, keepARP, keepNDP map[link]bool) (added, ok bool) {
 	ifs, err := net.Interfaces()
 	if err != nil {
-		a.logger.Log("op", "getInterfaces", "error", err, "msg", "couldn't list interfaces")
+		a.logger.Log("op", "getInterfaces", "netns", netns, "error", err, "msg", "couldn't list interfaces")
 		return
 	}
 
-	a.Lock()
-	defer a.Unlock()
-
-	keepARP, keepNDP := map[int]bool{}, map[int]bool{}
 	for _, intf := range ifs {
 		ifi := intf
+		k := link{netns, ifi.Index}
 		l := log.With(a.logger, "interface", ifi.Name)
+		if netns != "" {
+			l = log.With(l, "netns", netns)
+		}
 		addrs, err := ifi.Addrs()
 		if err != nil {
 			l.Log("op", "getAddresses", "error", err, "msg", "couldn't get addresses for interface")
 			return
 		}
 
-		if ifi.Flags&net.FlagUp == 0 {
+		if ifi.Name == dummyInterface || ifi.Name == hostDummyInterface {
+			continue
+		}
+		vmac := isVirtualMACInterface(ifi.Name)
+		if _, ok := a.vmacs[ifi.Name]; vmac && !ok {
+			// Left over by a previous run, and the node must not
+			// receive traffic for the virtual MAC anymore.
+			if err := deleteVirtualMAC(ifi.Name); err != nil {
+				l.Log("op", "deleteVirtualMAC", "error", err, "msg", "failed to delete stale interface for virtual MAC")
+			}
 			continue
 		}
-		if _, err = os.Stat("/sys/class/net/" + ifi.Name + "/master"); !os.IsNotExist(err) {
+		if ifi.Flags&net.FlagUp == 0 {
 			continue
 		}
-		f, err := ioutil.ReadFile("/sys/class/net/" + ifi.Name + "/flags")
-		if err == nil {
-			flags, _ := strconv.ParseUint(string(f)[:len(string(f))-1], 0, 32)
-			// NOARP flag
-			if flags&0x80 != 0 {
+		// sysfs shows the interfaces of the namespace it was mounted
+		// in, which is ours.
+		if netns == "" {
+			if _, err = os.Stat("/sys/class/net/" + ifi.Name + "/master"); !os.IsNotExist(err) {
 				continue
 			}
+			f, err := ioutil.ReadFile("/sys/class/net/" + ifi.Name + "/flags")
+			if err == nil {
+				flags, _ := strconv.ParseUint(string(f)[:len(string(f))-1], 0, 32)
+				// NOARP flag
+				if flags&0x80 != 0 {
+					continue
+				}
+				// RUNNING flag, unset when the link has no carrier.
+				if flags&0x40 == 0 {
+					continue
+				}
+			}
 		}
 		if ifi.Flags&net.FlagBroadcast != 0 {
-			keepARP[ifi.Index] = true
+			keepARP[k] = true
 		}
 
 		for _, a := range addrs {
@@ -89,46 +319,58 @@ func (a *Announce) updateInterfaces() {
 			if ipaddr.IP.To4() != nil || !ipaddr.IP.IsLinkLocalUnicast() {
 				continue
 			}
-			keepNDP[ifi.Index] = true
+			keepNDP[k] = true
 			break
 		}
 
-		if keepARP[ifi.Index] && a.arps[ifi.Index] == nil {
-			resp, err := newARPResponder(a.logger, &ifi, a.shouldAnnounce)
+		ann, mac := a.announceOn(netns, ifi.Name), a.macOn(netns, ifi.Name)
+		if vmac {
+			// Requests unicast to a virtual MAC, like the probes of
+			// neighbors refreshing their entries, only reach its
+			// macvlan interface.
+			ann, mac = a.announceWith(netns, ifi.HardwareAddr), func(net.IP) net.HardwareAddr { return ifi.HardwareAddr }
+		}
+		if keepARP[k] && a.arps[k] == nil {
+			resp, err := newARPResponder(a.logger, &ifi, ann, mac, a.limiter)
 			if err != nil {
 				l.Log("op", "createARPResponder", "error", err, "msg", "failed to create ARP responder")
 				return
 			}
-			a.arps[ifi.Index] = resp
+			a.arps[k] = resp
+			added = true
 			l.Log("event", "createARPResponder", "msg", "created ARP responder for interface")
 		}
-		if keepNDP[ifi.Index] && a.ndps[ifi.Index] == nil {
-			resp, err := newNDPResponder(a.logger, &ifi, a.shouldAnnounce)
+		if keepNDP[k] && a.ndps[k] == nil {
+			resp, err := newNDPResponder(a.logger, &ifi, ann, mac, a.limiter)
 			if err != nil {
 				l.Log("op", "createNDPResponder", "error", err, "msg", "failed to create NDP responder")
 				return
 			}
-			a.ndps[ifi.Index] = resp
+			// Catch up on the IPs announced while the interface
+			// was unusable.
+			for ip, cnt := range a.ipRefcnt {
+				if cnt == 0 || vmac {
+					continue
+				}
+				if err := resp.Watch(net.ParseIP(ip)); err != nil {
+					l.Log("op", "watchMulticastGroup", "error", err, "ip", ip, "msg", "failed to watch NDP multicast group for IP, NDP responder will not respond to requests for this address")
+				}
+			}
+			a.ndps[k] = resp
+			added = true
 			l.Log("event", "createNDPResponder", "msg", "created NDP responder for interface")
 		}
 	}
+	return added, true
+}
 
-	for i, client := range a.arps {
-		if !keepARP[i] {
-			client.Close()
-			delete(a.arps, i)
-			a.logger.Log("interface", client.Interface(), "event", "deleteARPResponder", "msg", "deleted ARP responder for interface")
-		}
-	}
-	for i, client := range a.ndps {
-		if !keepNDP[i] {
-			client.Close()
-			delete(a.ndps, i)
-			a.logger.Log("interface", client.Interface(), "event", "deleteNDPResponder", "msg", "deleted NDP responder for interface")
-		}
+// reannounce sends gratuitous announcements for all our IPs.
+func (a *Announce) reannounce() {
+	a.RLock()
+	defer a.RUnlock()
+	for name := range a.ips {
+		go a.spam(name)
 	}
-
-	return
 }
 
 func (a *Announce) spam(name string) {
@@ -152,44 +394,117 @@ func (a *Announce) gratuitous(name string) error {
 		// doing announcements.
 		return nil
 	}
+	o := a.opts[name]
 	if ip.To4() != nil {
-		for _, client := range a.arps {
-			if err := client.Gratuitous(ip); err != nil {
+		for k, client := range a.arps {
+			if !o.on(k.netns, client.Interface()) || isVirtualMACInterface(client.Interface()) {
+				continue
+			}
+			if err := client.Gratuitous(ip, o.VirtualMAC); err != nil {
 				return err
 			}
+			if !o.Unnumbered {
+				continue
+			}
+			var neighbors []net.HardwareAddr
+			err := inNetns(k.netns, func() (err error) {
+				neighbors, err = arpNeighbors(client.Interface())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("listing neighbors on %q: %s", client.Interface(), err)
+			}
+			for _, n := range neighbors {
+				if err := client.Targeted(ip, o.VirtualMAC, n); err != nil {
+					return err
+				}
+			}
 		}
 	} else {
-		for _, client := range a.ndps {
-			if err := client.Gratuitous(ip); err != nil {
+		for k, client := range a.ndps {
+			if !o.on(k.netns, client.Interface()) || isVirtualMACInterface(client.Interface()) {
+				continue
+			}
+			if err := client.Gratuitous(ip, o.VirtualMAC); err != nil {
 				return err
 			}
+			if o.Unnumbered {
+				if err := client.Targeted(ip, o.VirtualMAC, allRouters); err != nil {
+					return err
+				}
+			}
 		}
 	}
 	return nil
 }
 
-func (a *Announce) shouldAnnounce(ip net.IP) dropReason {
+// announceOn returns the announceFunc of the responders of intf in
+// netns.
+func (a *Announce) announceOn(netns, intf string) announceFunc {
+	return func(ip net.IP) dropReason {
+		return a.shouldAnnounce(netns, intf, ip)
+	}
+}
+
+// macOn returns the macFunc of the responders of intf in netns.
+func (a *Announce) macOn(netns, intf string) macFunc {
+	return func(ip net.IP) net.HardwareAddr {
+		a.RLock()
+		defer a.RUnlock()
+		for name, i := range a.ips {
+			if o := a.opts[name]; i.Equal(ip) && o.on(netns, intf) {
+				return o.VirtualMAC
+			}
+		}
+		return nil
+	}
+}
+
+// announceWith returns the announceFunc of the responders of the
+// macvlan interface of the virtual MAC mac in netns.
+func (a *Announce) announceWith(netns string, mac net.HardwareAddr) announceFunc {
+	return func(ip net.IP) dropReason {
+		a.RLock()
+		defer a.RUnlock()
+		for name, i := range a.ips {
+			if o := a.opts[name]; i.Equal(ip) && o.NetworkNamespace == netns && bytes.Equal(o.VirtualMAC, mac) {
+				return dropReasonNone
+			}
+		}
+		return dropReasonAnnounceIP
+	}
+}
+
+func (a *Announce) shouldAnnounce(netns, intf string, ip net.IP) dropReason {
 	a.RLock()
 	defer a.RUnlock()
-	for _, i := range a.ips {
-		if i.Equal(ip) {
+	for name, i := range a.ips {
+		if i.Equal(ip) && a.opts[name].on(netns, intf) {
 			return dropReasonNone
 		}
 	}
 	return dropReasonAnnounceIP
 }
 
-// SetBalancer adds ip to the set of announced addresses.
-func (a *Announce) SetBalancer(name string, ip net.IP) {
+// SetBalancer adds ip to the set of announced addresses, announced
+// as opts say.
+func (a *Announce) SetBalancer(name string, ip net.IP, opts Options) {
 	a.Lock()
 	defer a.Unlock()
 
 	// Kubernetes may inform us that we should advertise this address multiple
 	// times, so just no-op any subsequent requests.
 	if _, ok := a.ips[name]; ok {
+		if !a.opts[name].equal(opts) {
+			// Moved to another interface or MAC, let its neighbors
+			// know.
+			a.setOptions(name, opts)
+			go a.spam(name)
+		}
 		return
 	}
 	a.ips[name] = ip
+	a.setOptions(name, opts)
 
 	a.ipRefcnt[ip.String()]++
 	if a.ipRefcnt[ip.String()] > 1 {
@@ -199,6 +514,9 @@ func (a *Announce) SetBalancer(name string, ip net.IP) {
 	}
 
 	for _, client := range a.ndps {
+		if isVirtualMACInterface(client.Interface()) {
+			continue
+		}
 		if err := client.Watch(ip); err != nil {
 			a.logger.Log("op", "watchMulticastGroup", "error", err, "ip", ip, "msg", "failed to watch NDP multicast group for IP, NDP responder will not respond to requests for this address")
 		}
@@ -217,6 +535,7 @@ func (a *Announce) DeleteBalancer(name string) {
 	if !ok {
 		return
 	}
+	a.setOptions(name, Options{})
 	delete(a.ips, name)
 
 	a.ipRefcnt[ip.String()]--
@@ -227,6 +546,9 @@ func (a *Announce) DeleteBalancer(name string) {
 	}
 
 	for _, client := range a.ndps {
+		if isVirtualMACInterface(client.Interface()) {
+			continue
+		}
 		if err := client.Unwatch(ip); err != nil {
 			a.logger.Log("op", "unwatchMulticastGroup", "error", err, "ip", ip, "msg", "failed to unwatch NDP multicast group for IP")
 		}
@@ -234,6 +556,31 @@ func (a *Announce) DeleteBalancer(name string) {
 
 }
 
+func (a *Announce) setOptions(name string, opts Options) {
+	old := a.opts[name]
+	if opts.equal(Options{}) {
+		delete(a.opts, name)
+	} else {
+		a.opts[name] = opts
+	}
+	if old.VirtualMAC != nil || opts.VirtualMAC != nil {
+		a.syncVirtualMACs()
+	}
+	if old.Unnumbered || opts.Unnumbered {
+		a.syncHostRoutes()
+	}
+	if old.SecondarySubnet || opts.SecondarySubnet {
+		a.syncDummyAddresses()
+	}
+}
+
+// IP returns the address announced under name, or nil.
+func (a *Announce) IP(name string) net.IP {
+	a.RLock()
+	defer a.RUnlock()
+	return a.ips[name]
+}
+
 // AnnounceName returns true when we have an announcement under name.
 func (a *Announce) AnnounceName(name string) bool {
 	a.RLock()
@@ -256,4 +603,6 @@ const (
 	dropReasonNoSourceLL
 	dropReasonEthernetDestination
 	dropReasonAnnounceIP
+	dropReasonSpoofed
+	dropReasonRateLimited
 )
@@ -8,6 +8,7 @@ import (
 func Test_SetBalancer_AddsToAnnouncedServices(t *testing.T) {
 	announce := &Announce{
 		ips:      map[string]net.IP{},
+		opts:     map[string]Options{},
 		ipRefcnt: map[string]int{},
 	}
 
@@ -26,10 +27,137 @@ func Test_SetBalancer_AddsToAnnouncedServices(t *testing.T) {
 	}
 
 	for _, service := range services {
-		announce.SetBalancer(service.name, service.ip)
+		announce.SetBalancer(service.name, service.ip, Options{})
 
 		if !announce.AnnounceName(service.name) {
 			t.Fatalf("service %v is not anounced", service.name)
 		}
 	}
 }
+
+func Test_SetBalancer_RestrictsInterface(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string]net.IP{},
+		opts:     map[string]Options{},
+		ipRefcnt: map[string]int{},
+	}
+
+	ip := net.IPv4(192, 168, 1, 20)
+	announce.SetBalancer("foo", ip, Options{Interface: "net1"})
+	if got := announce.shouldAnnounce("", "net1", ip); got != dropReasonNone {
+		t.Errorf("not announced on net1, reason %d", got)
+	}
+	if got := announce.shouldAnnounce("", "eth0", ip); got != dropReasonAnnounceIP {
+		t.Errorf("announced on eth0, reason %d", got)
+	}
+
+	// Another service sharing the IP on all interfaces.
+	announce.SetBalancer("bar", ip, Options{})
+	if got := announce.shouldAnnounce("", "eth0", ip); got != dropReasonNone {
+		t.Errorf("shared IP not announced on eth0, reason %d", got)
+	}
+	announce.DeleteBalancer("bar")
+	if got := announce.shouldAnnounce("", "eth0", ip); got != dropReasonAnnounceIP {
+		t.Errorf("announced on eth0 after deleting shared service, reason %d", got)
+	}
+
+	// Moving the service to another interface.
+	announce.SetBalancer("foo", ip, Options{Interface: "net2"})
+	if got := announce.shouldAnnounce("", "net1", ip); got != dropReasonAnnounceIP {
+		t.Errorf("announced on net1 after move, reason %d", got)
+	}
+	if got := announce.shouldAnnounce("", "net2", ip); got != dropReasonNone {
+		t.Errorf("not announced on net2 after move, reason %d", got)
+	}
+}
+
+func Test_SetBalancer_NetworkNamespace(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string]net.IP{},
+		opts:     map[string]Options{},
+		ipRefcnt: map[string]int{},
+	}
+
+	ip := net.IPv4(192, 168, 1, 20)
+	announce.SetBalancer("foo", ip, Options{NetworkNamespace: "/var/run/netns/ext"})
+	if got := announce.shouldAnnounce("/var/run/netns/ext", "eth0", ip); got != dropReasonNone {
+		t.Errorf("not announced in namespace, reason %d", got)
+	}
+	if got := announce.shouldAnnounce("", "eth0", ip); got != dropReasonAnnounceIP {
+		t.Errorf("announced in our namespace, reason %d", got)
+	}
+
+	// Moving the service to our namespace.
+	announce.SetBalancer("foo", ip, Options{})
+	if got := announce.shouldAnnounce("/var/run/netns/ext", "eth0", ip); got != dropReasonAnnounceIP {
+		t.Errorf("announced in namespace after move, reason %d", got)
+	}
+	if got := announce.shouldAnnounce("", "eth0", ip); got != dropReasonNone {
+		t.Errorf("not announced in our namespace after move, reason %d", got)
+	}
+}
+
+func Test_SetBalancer_VirtualMAC(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string]net.IP{},
+		opts:     map[string]Options{},
+		ipRefcnt: map[string]int{},
+	}
+
+	ip := net.IPv4(192, 168, 1, 20)
+	vmac := net.HardwareAddr{0x02, 0, 0x5e, 0, 0, 1}
+	announce.SetBalancer("foo", ip, Options{Interface: "net1", VirtualMAC: vmac})
+	if got := announce.macOn("", "net1")(ip); got.String() != vmac.String() {
+		t.Errorf("announced with MAC %s on net1, want %s", got, vmac)
+	}
+	if got := announce.macOn("", "eth0")(ip); got != nil {
+		t.Errorf("announced with MAC %s on eth0", got)
+	}
+
+	announce.SetBalancer("foo", ip, Options{Interface: "net1"})
+	if got := announce.macOn("", "net1")(ip); got != nil {
+		t.Errorf("announced with MAC %s after removing virtual MAC", got)
+	}
+}
+
+func Test_AnnounceWith_VirtualMAC(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string]net.IP{},
+		opts:     map[string]Options{},
+		ipRefcnt: map[string]int{},
+	}
+
+	ip1, ip2 := net.IPv4(192, 168, 1, 20), net.IPv4(192, 168, 1, 21)
+	vmac1 := net.HardwareAddr{0x02, 0, 0x5e, 1, 1, 20}
+	vmac2 := net.HardwareAddr{0x02, 0, 0x5e, 1, 1, 21}
+	announce.SetBalancer("foo", ip1, Options{VirtualMAC: vmac1})
+	announce.SetBalancer("bar", ip2, Options{})
+
+	if got := announce.announceWith("", vmac1)(ip1); got != dropReasonNone {
+		t.Errorf("%s not answered for on the interface of its virtual MAC, reason %d", ip1, got)
+	}
+	if got := announce.announceWith("", vmac2)(ip1); got != dropReasonAnnounceIP {
+		t.Errorf("%s answered for on the interface of another virtual MAC", ip1)
+	}
+	if got := announce.announceWith("", vmac2)(ip2); got != dropReasonAnnounceIP {
+		t.Errorf("%s, which has no virtual MAC, answered for on the interface of a virtual MAC", ip2)
+	}
+	if got := announce.announceWith("/run/netns/ext", vmac1)(ip1); got != dropReasonAnnounceIP {
+		t.Errorf("%s answered for in another network namespace", ip1)
+	}
+}
+
+func Test_VirtualMACInterface(t *testing.T) {
+	vmac := net.HardwareAddr{0x02, 0, 0x5e, 0, 0, 1}
+	name := vmacInterface(2, vmac)
+	// IFNAMSIZ, including the terminating NUL.
+	if len(name) > 15 {
+		t.Errorf("interface name %q too long", name)
+	}
+	if !isVirtualMACInterface(name) {
+		t.Errorf("%q not recognized as a virtual MAC interface", name)
+	}
+	if vmacInterface(3, vmac) == name {
+		t.Error("same interface name on different parents")
+	}
+}
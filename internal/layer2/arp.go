@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/mdlayher/arp"
@@ -13,6 +14,10 @@ import (
 
 type announceFunc func(net.IP) dropReason
 
+// macFunc returns the virtual MAC to announce an IP with, or nil for
+// the interface's MAC.
+type macFunc func(net.IP) net.HardwareAddr
+
 type arpResponder struct {
 	logger       log.Logger
 	intf         string
@@ -20,9 +25,11 @@ type arpResponder struct {
 	conn         *arp.Client
 	closed       chan struct{}
 	announce     announceFunc
+	mac          macFunc
+	limiter      *replyLimiter
 }
 
-func newARPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*arpResponder, error) {
+func newARPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc, mac macFunc, limiter *replyLimiter) (*arpResponder, error) {
 	client, err := arp.Dial(ifi)
 	if err != nil {
 		return nil, fmt.Errorf("creating ARP responder for %q: %s", ifi.Name, err)
@@ -35,6 +42,8 @@ func newARPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*
 		conn:         client,
 		closed:       make(chan struct{}),
 		announce:     ann,
+		mac:          mac,
+		limiter:      limiter,
 	}
 	go ret.run()
 	return ret, nil
@@ -47,9 +56,15 @@ func (a *arpResponder) Close() error {
 	return a.conn.Close()
 }
 
-func (a *arpResponder) Gratuitous(ip net.IP) error {
+// Gratuitous announces ip with mac, or the interface's MAC if nil.
+// The frames are sent from that MAC too, so that switches learn
+// where it is.
+func (a *arpResponder) Gratuitous(ip net.IP, mac net.HardwareAddr) error {
+	if mac == nil {
+		mac = a.hardwareAddr
+	}
 	for _, op := range []arp.Operation{arp.OperationRequest, arp.OperationReply} {
-		pkt, err := arp.NewPacket(op, a.hardwareAddr, ip, ethernet.Broadcast, ip)
+		pkt, err := arp.NewPacket(op, mac, ip, ethernet.Broadcast, ip)
 		if err != nil {
 			return fmt.Errorf("assembling %q gratuitous packet for %q: %s", op, ip, err)
 		}
@@ -61,6 +76,23 @@ func (a *arpResponder) Gratuitous(ip net.IP) error {
 	return nil
 }
 
+// Targeted announces ip with mac, or the interface's MAC if nil, to
+// the neighbor dst only.
+func (a *arpResponder) Targeted(ip net.IP, mac, dst net.HardwareAddr) error {
+	if mac == nil {
+		mac = a.hardwareAddr
+	}
+	pkt, err := arp.NewPacket(arp.OperationReply, mac, ip, dst, ip)
+	if err != nil {
+		return fmt.Errorf("assembling targeted packet for %q: %s", ip, err)
+	}
+	if err = a.conn.WriteTo(pkt, dst); err != nil {
+		return fmt.Errorf("writing targeted packet for %q to %s: %s", ip, dst, err)
+	}
+	stats.SentGratuitous(ip.String())
+	return nil
+}
+
 func (a *arpResponder) run() {
 	for a.processRequest() != dropReasonClosed {
 	}
@@ -93,16 +125,41 @@ func (a *arpResponder) processRequest() dropReason {
 		return dropReasonEthernetDestination
 	}
 
+	// Broadcast requests also reach the parent of a virtual MAC's
+	// macvlan interface, whose responder answers them.
+	if isVirtualMACInterface(a.intf) && !bytes.Equal(eth.Destination, a.hardwareAddr) {
+		return dropReasonEthernetDestination
+	}
+
 	// Ignore ARP requests that the announcer tells us to ignore.
 	if reason := a.announce(pkt.TargetIP); reason != dropReasonNone {
 		return reason
 	}
 
+	// Ignore ARP requests that can't come from a genuine neighbor,
+	// including our own.
+	if spoofedMAC(pkt.SenderHardwareAddr, a.hardwareAddr) || spoofedMAC(eth.Source, a.hardwareAddr) {
+		stats.DroppedRequest("spoofed")
+		return dropReasonSpoofed
+	}
+
+	if !a.limiter.allow(pkt.SenderHardwareAddr, time.Now()) {
+		stats.DroppedRequest("rateLimited")
+		return dropReasonRateLimited
+	}
+
+	mac := a.hardwareAddr
+	if a.mac != nil {
+		if vmac := a.mac(pkt.TargetIP); vmac != nil {
+			mac = vmac
+		}
+	}
+
 	stats.GotRequest(pkt.TargetIP.String())
-	a.logger.Log("interface", a.intf, "ip", pkt.TargetIP, "senderIP", pkt.SenderIP, "senderMAC", pkt.SenderHardwareAddr, "responseMAC", a.hardwareAddr, "msg", "got ARP request for service IP, sending response")
+	a.logger.Log("interface", a.intf, "ip", pkt.TargetIP, "senderIP", pkt.SenderIP, "senderMAC", pkt.SenderHardwareAddr, "responseMAC", mac, "msg", "got ARP request for service IP, sending response")
 
-	if err := a.conn.Reply(pkt, a.hardwareAddr, pkt.TargetIP); err != nil {
-		a.logger.Log("op", "arpReply", "interface", a.intf, "ip", pkt.TargetIP, "senderIP", pkt.SenderIP, "senderMAC", pkt.SenderHardwareAddr, "responseMAC", a.hardwareAddr, "error", err, "msg", "failed to send ARP reply")
+	if err := a.conn.Reply(pkt, mac, pkt.TargetIP); err != nil {
+		a.logger.Log("op", "arpReply", "interface", a.intf, "ip", pkt.TargetIP, "senderIP", pkt.SenderIP, "senderMAC", pkt.SenderHardwareAddr, "responseMAC", mac, "error", err, "msg", "failed to send ARP reply")
 	} else {
 		stats.SentResponse(pkt.TargetIP.String())
 	}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/google/go-cmp/cmp"
@@ -13,12 +14,19 @@ import (
 )
 
 func TestARPResponder(t *testing.T) {
+	srcMAC := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	exhausted := newReplyLimiter(0.001, 1)
+	exhausted.allow(srcMAC, time.Now())
+
 	tests := []struct {
 		name           string
+		srcMAC         net.HardwareAddr
+		fromSelf       bool
 		dstMAC         net.HardwareAddr
 		arpTgt         net.IP
 		arpOp          arp.Operation
 		shouldAnnounce announceFunc
+		limiter        *replyLimiter
 		reason         dropReason
 	}{
 		{
@@ -61,6 +69,26 @@ func TestARPResponder(t *testing.T) {
 			},
 			reason: dropReasonNone,
 		},
+		{
+			name:     "request from our own MAC",
+			fromSelf: true,
+			reason:   dropReasonSpoofed,
+		},
+		{
+			name:   "request from zero MAC",
+			srcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 0},
+			reason: dropReasonSpoofed,
+		},
+		{
+			name:    "rate limited",
+			limiter: exhausted,
+			reason:  dropReasonRateLimited,
+		},
+		{
+			name:    "within rate limit",
+			limiter: newReplyLimiter(1, 1),
+			reason:  dropReasonNone,
+		},
 	}
 
 	for _, tt := range tests {
@@ -73,8 +101,15 @@ func TestARPResponder(t *testing.T) {
 			}
 			a, conn, done := newTestARP(t, shouldAnnounce)
 			defer done()
+			a.limiter = tt.limiter
 
 			// Defaults for test params
+			if tt.srcMAC == nil {
+				tt.srcMAC = srcMAC
+			}
+			if tt.fromSelf {
+				tt.srcMAC = a.hardwareAddr
+			}
 			if tt.dstMAC == nil {
 				tt.dstMAC = a.hardwareAddr
 			}
@@ -87,7 +122,7 @@ func TestARPResponder(t *testing.T) {
 
 			eth := &ethernet.Frame{
 				Destination: tt.dstMAC,
-				Source:      net.HardwareAddr{1, 2, 3, 4, 5, 6},
+				Source:      tt.srcMAC,
 				EtherType:   ethernet.EtherTypeARP,
 			}
 			pkt, err := arp.NewPacket(tt.arpOp, eth.Source, net.IPv4(192, 168, 1, 1), tt.dstMAC, tt.arpTgt)
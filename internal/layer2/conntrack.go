@@ -0,0 +1,176 @@
+package layer2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ctnetlink message types and attributes, from
+// linux/netfilter/nfnetlink_conntrack.h. x/sys/unix doesn't have
+// them.
+const (
+	nfnlSubsysCTNetlink = 1
+	ipctnlMsgCTGet      = 1
+	ipctnlMsgCTDelete   = 2
+
+	ctaTupleOrig = 1
+	ctaZone      = 18
+	ctaTupleIP   = 1
+	ctaIPv4Dst   = 2
+	ctaIPv6Dst   = 4
+
+	nlaTypeMask = 0x3fff
+)
+
+// nativeEndian is the byte order of netlink headers.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// FlushConntrack deletes the kernel's connection tracking entries of
+// connections to ip, so that flows pinned to a path through a node
+// that no longer announces ip, or through the previous announcer,
+// get tracked afresh. It returns the number of entries deleted.
+func FlushConntrack(ip net.IP) (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return 0, fmt.Errorf("creating netlink socket: %s", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return 0, fmt.Errorf("binding netlink socket: %s", err)
+	}
+
+	family := uint8(unix.AF_INET)
+	if ip.To4() == nil {
+		family = unix.AF_INET6
+	}
+
+	// Collect the entries first, deleting them while dumping would
+	// disturb the dump.
+	var dels [][]byte
+	err = ctRequest(fd, ctMessage(ipctnlMsgCTGet, unix.NLM_F_REQUEST|unix.NLM_F_DUMP, family, nil), func(data []byte) {
+		if attrs, ok := ctMatch(data, ip); ok {
+			dels = append(dels, attrs)
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("listing conntrack entries: %s", err)
+	}
+
+	deleted := 0
+	for _, attrs := range dels {
+		err := ctRequest(fd, ctMessage(ipctnlMsgCTDelete, unix.NLM_F_REQUEST|unix.NLM_F_ACK, family, attrs), nil)
+		switch err {
+		case nil:
+			deleted++
+		case unix.ENOENT:
+			// The connection went away on its own.
+		default:
+			return deleted, fmt.Errorf("deleting conntrack entry: %s", err)
+		}
+	}
+	return deleted, nil
+}
+
+// ctMessage returns a ctnetlink message of type typ, carrying the
+// already encoded attrs.
+func ctMessage(typ, flags uint16, family uint8, attrs []byte) []byte {
+	b := make([]byte, unix.SizeofNlMsghdr+4+len(attrs))
+	nativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	nativeEndian.PutUint16(b[4:6], nfnlSubsysCTNetlink<<8|typ)
+	nativeEndian.PutUint16(b[6:8], flags)
+	nativeEndian.PutUint32(b[8:12], 1)
+	// nfgenmsg: family, version 0 and resource ID 0.
+	b[unix.SizeofNlMsghdr] = family
+	copy(b[unix.SizeofNlMsghdr+4:], attrs)
+	return b
+}
+
+// ctRequest sends req and reads the replies up to the end of the
+// dump or the acknowledgement, passing the payload of each message,
+// after its nfgenmsg header, to handle.
+func ctRequest(fd int, req []byte, handle func([]byte)) error {
+	return netlinkRequest(fd, req, func(data []byte) {
+		if handle != nil && len(data) >= 4 {
+			handle(data[4:])
+		}
+	})
+}
+
+// ctMatch returns the attributes that identify the conntrack entry
+// described by the attributes data for deletion, if the original
+// direction of the entry goes to ip.
+func ctMatch(data []byte, ip net.IP) ([]byte, bool) {
+	var orig, zone []byte
+	for _, a := range parseAttrs(data) {
+		switch a.typ {
+		case ctaTupleOrig:
+			orig = a.raw
+			if !tupleDst(a.data).Equal(ip) {
+				return nil, false
+			}
+		case ctaZone:
+			zone = a.raw
+		}
+	}
+	if orig == nil {
+		return nil, false
+	}
+	return append(append([]byte(nil), orig...), zone...), true
+}
+
+// tupleDst returns the destination address of the conntrack tuple
+// described by the attributes data.
+func tupleDst(data []byte) net.IP {
+	for _, a := range parseAttrs(data) {
+		if a.typ != ctaTupleIP {
+			continue
+		}
+		for _, ia := range parseAttrs(a.data) {
+			switch ia.typ {
+			case ctaIPv4Dst, ctaIPv6Dst:
+				return net.IP(ia.data)
+			}
+		}
+	}
+	return nil
+}
+
+type nlAttr struct {
+	typ  uint16
+	data []byte
+	// The whole attribute, including its header and padding.
+	raw []byte
+}
+
+// parseAttrs splits b into netlink attributes, ignoring trailing
+// garbage.
+func parseAttrs(b []byte) []nlAttr {
+	var ret []nlAttr
+	for len(b) >= unix.SizeofNlAttr {
+		l := int(nativeEndian.Uint16(b[0:2]))
+		if l < unix.SizeofNlAttr || l > len(b) {
+			break
+		}
+		aligned := (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if aligned > len(b) {
+			aligned = len(b)
+		}
+		ret = append(ret, nlAttr{
+			typ:  nativeEndian.Uint16(b[2:4]) & nlaTypeMask,
+			data: b[unix.SizeofNlAttr:l],
+			raw:  b[:aligned],
+		})
+		b = b[aligned:]
+	}
+	return ret
+}
@@ -0,0 +1,90 @@
+package layer2
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// attr encodes a netlink attribute, padded to 4 bytes.
+func attr(typ uint16, data ...[]byte) []byte {
+	var payload []byte
+	for _, d := range data {
+		payload = append(payload, d...)
+	}
+	b := make([]byte, 4, 4+len(payload)+3)
+	nativeEndian.PutUint16(b[0:2], uint16(4+len(payload)))
+	nativeEndian.PutUint16(b[2:4], typ)
+	b = append(b, payload...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func tuple(dst net.IP) []byte {
+	const nested = 0x8000
+	ipAttr := attr(ctaIPv4Dst, dst.To4())
+	if dst.To4() == nil {
+		ipAttr = attr(ctaIPv6Dst, dst.To16())
+	}
+	return attr(ctaTupleOrig|nested, attr(ctaTupleIP|nested, attr(1, net.ParseIP("10.0.0.1").To4()), ipAttr))
+}
+
+func TestCTMatch(t *testing.T) {
+	vip := net.ParseIP("192.168.1.10")
+	zone := attr(ctaZone, []byte{0, 7})
+	// CTA_TUPLE_REPLY, with the VIP as source.
+	reply := attr(2, attr(ctaTupleIP, attr(1, vip.To4())))
+
+	tests := []struct {
+		desc  string
+		data  []byte
+		ip    net.IP
+		match bool
+		want  []byte
+	}{
+		{
+			desc:  "connection to VIP",
+			data:  append(tuple(vip), reply...),
+			ip:    vip,
+			match: true,
+			want:  tuple(vip),
+		},
+		{
+			desc:  "connection to VIP in a zone",
+			data:  append(append(tuple(vip), reply...), zone...),
+			ip:    vip,
+			match: true,
+			want:  append(tuple(vip), zone...),
+		},
+		{
+			desc: "connection elsewhere",
+			data: tuple(net.ParseIP("192.168.1.11")),
+			ip:   vip,
+		},
+		{
+			desc:  "IPv6 connection",
+			data:  tuple(net.ParseIP("2001:db8::10")),
+			ip:    net.ParseIP("2001:db8::10"),
+			match: true,
+			want:  tuple(net.ParseIP("2001:db8::10")),
+		},
+		{
+			desc: "truncated",
+			data: tuple(vip)[:10],
+			ip:   vip,
+		},
+	}
+
+	for _, test := range tests {
+		got, ok := ctMatch(test.data, test.ip)
+		if ok != test.match {
+			t.Errorf("%s: got match %v, want %v", test.desc, ok, test.match)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got delete attributes %x, want %x", test.desc, got, test.want)
+		}
+	}
+}
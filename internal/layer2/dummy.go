@@ -0,0 +1,174 @@
+package layer2
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/sys/unix"
+)
+
+// IPs of pools in a secondary subnet aren't in the subnets of the
+// interfaces they're announced on, and routers reach them with proxy
+// ARP or an onlink route to the pool's subnet. The node has no route
+// to the IP, so the announcing node adds it as a /32 to a dummy
+// interface, for the kernel to accept its traffic as local rather
+// than route it back out.
+
+// dummyInterface is the dummy interface holding the IPs of pools in
+// a secondary subnet.
+const dummyInterface = "metallb0"
+
+// addDummyInterface creates the dummy interface name, unless it
+// exists, and returns its index.
+func addDummyInterface(name string) (int, error) {
+	var info, attrs []byte
+	info = appendAttr(info, unix.IFLA_INFO_KIND, []byte("dummy"))
+	attrs = appendAttr(attrs, unix.IFLA_IFNAME, append([]byte(name), 0))
+	attrs = appendAttr(attrs, unix.IFLA_LINKINFO|unix.NLA_F_NESTED, info)
+
+	err := linkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, unix.IFF_UP, attrs)
+	if err != nil && err != unix.EEXIST {
+		return 0, fmt.Errorf("creating dummy interface %q: %s", name, err)
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return ifi.Index, nil
+}
+
+// deleteDummyInterface deletes the dummy interface name, with all its
+// addresses, if it exists.
+func deleteDummyInterface(name string) error {
+	attrs := appendAttr(nil, unix.IFLA_IFNAME, append([]byte(name), 0))
+	err := linkRequest(unix.RTM_DELLINK, 0, 0, attrs)
+	if err != nil && err != unix.ENODEV {
+		return fmt.Errorf("deleting dummy interface %q: %s", name, err)
+	}
+	return nil
+}
+
+// hostAddress returns the ifaddrmsg header and attributes of ip as a
+// host address (/32 or /128) on the interface with index, labeled
+// with label if it isn't empty. Only IPv4 addresses have labels.
+func hostAddress(index int, ip net.IP, label string) (hdr, attrs []byte) {
+	family, bits := unix.AF_INET, 32
+	if ip.To4() != nil {
+		ip = ip.To4()
+	} else {
+		family, bits = unix.AF_INET6, 128
+	}
+	// ifaddrmsg: family, prefix length, flags, scope and index.
+	hdr = make([]byte, unix.SizeofIfAddrmsg)
+	hdr[0] = byte(family)
+	hdr[1] = byte(bits)
+	if family == unix.AF_INET6 {
+		// The IP is the node's only while announced, there's
+		// nothing to detect duplicates of.
+		hdr[2] = unix.IFA_F_NODAD
+	}
+	hdr[3] = unix.RT_SCOPE_UNIVERSE
+	nativeEndian.PutUint32(hdr[4:8], uint32(index))
+	attrs = appendAttr(attrs, unix.IFA_LOCAL, ip)
+	attrs = appendAttr(attrs, unix.IFA_ADDRESS, ip)
+	if label != "" && family == unix.AF_INET {
+		attrs = appendAttr(attrs, unix.IFA_LABEL, append([]byte(label), 0))
+	}
+	return hdr, attrs
+}
+
+// addHostAddress adds ip to the interface with index.
+func addHostAddress(index int, ip net.IP, label string) error {
+	hdr, attrs := hostAddress(index, ip, label)
+	return rtnlRequest(unix.RTM_NEWADDR, unix.NLM_F_ACK|unix.NLM_F_CREATE|unix.NLM_F_REPLACE, hdr, attrs, nil)
+}
+
+// deleteHostAddress deletes ip from the interface with index, if it's
+// there.
+func deleteHostAddress(index int, ip net.IP) error {
+	hdr, attrs := hostAddress(index, ip, "")
+	err := rtnlRequest(unix.RTM_DELADDR, unix.NLM_F_ACK, hdr, attrs, nil)
+	if err != nil && err != unix.EADDRNOTAVAIL {
+		return err
+	}
+	return nil
+}
+
+// addDummyAddress adds ip to the dummy interface, creating it if
+// needed.
+func addDummyAddress(ip net.IP) error {
+	index, err := addDummyInterface(dummyInterface)
+	if err != nil {
+		return err
+	}
+	if err := addHostAddress(index, ip, ""); err != nil {
+		return fmt.Errorf("adding %s to %q: %s", ip, dummyInterface, err)
+	}
+	return nil
+}
+
+// deleteDummyAddress deletes ip from the dummy interface, if it's
+// there.
+func deleteDummyAddress(ip net.IP) error {
+	ifi, err := net.InterfaceByName(dummyInterface)
+	if err != nil {
+		// No interface, no address.
+		return nil
+	}
+	if err := deleteHostAddress(ifi.Index, ip); err != nil {
+		return fmt.Errorf("deleting %s from %q: %s", ip, dummyInterface, err)
+	}
+	return nil
+}
+
+// dummyAddressKey identifies the address ip on the dummy interface of
+// netns.
+type dummyAddressKey struct {
+	ip    string
+	netns string
+}
+
+// syncDummyAddresses adds the IPs of pools in a secondary subnet that
+// we announce to the dummy interface, and deletes the ones no longer
+// needed. The caller must hold the lock.
+func (a *Announce) syncDummyAddresses() {
+	want := map[dummyAddressKey]bool{}
+	for name, o := range a.opts {
+		if o.SecondarySubnet {
+			want[dummyAddressKey{a.ips[name].String(), o.NetworkNamespace}] = true
+		}
+	}
+
+	for k := range want {
+		if a.dummyAddrs[k] {
+			continue
+		}
+		l := a.logger
+		if k.netns != "" {
+			l = log.With(l, "netns", k.netns)
+		}
+		if err := inNetns(k.netns, func() error { return addDummyAddress(net.ParseIP(k.ip)) }); err != nil {
+			l.Log("op", "addDummyAddress", "ip", k.ip, "error", err, "msg", "failed to add IP in secondary subnet to dummy interface, its traffic won't be received")
+			continue
+		}
+		a.dummyAddrs[k] = true
+		l.Log("event", "addDummyAddress", "ip", k.ip, "interface", dummyInterface, "msg", "added IP in secondary subnet to dummy interface")
+	}
+
+	for k := range a.dummyAddrs {
+		if want[k] {
+			continue
+		}
+		l := a.logger
+		if k.netns != "" {
+			l = log.With(l, "netns", k.netns)
+		}
+		if err := inNetns(k.netns, func() error { return deleteDummyAddress(net.ParseIP(k.ip)) }); err != nil {
+			l.Log("op", "deleteDummyAddress", "ip", k.ip, "error", err, "msg", "failed to delete IP from dummy interface")
+			continue
+		}
+		delete(a.dummyAddrs, k)
+		l.Log("event", "deleteDummyAddress", "ip", k.ip, "interface", dummyInterface, "msg", "deleted IP from dummy interface")
+	}
+}
@@ -0,0 +1,33 @@
+package layer2
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+func TestHostAddress(t *testing.T) {
+	hdr, attrs := hostAddress(7, net.ParseIP("192.168.1.20"), "")
+	if diff := cmp.Diff([]byte{2, 32, 0, 0}, hdr[:4]); diff != "" {
+		t.Errorf("wrong ifaddrmsg (-want +got)\n%s", diff)
+	}
+	if got := nativeEndian.Uint32(hdr[4:8]); got != 7 {
+		t.Errorf("wrong interface index %d, want 7", got)
+	}
+	// IFA_LOCAL and IFA_ADDRESS, both the IPv4 address.
+	if len(attrs) != 16 || !net.IP(attrs[4:8]).Equal(net.ParseIP("192.168.1.20")) || !net.IP(attrs[12:16]).Equal(net.ParseIP("192.168.1.20")) {
+		t.Errorf("wrong attributes %v", attrs)
+	}
+
+	// "lo:metallb" and its NUL, padded to 12 bytes.
+	if _, attrs := hostAddress(1, net.ParseIP("192.168.1.20"), hostLabel); len(attrs) != 32 {
+		t.Errorf("wrong attributes with label %v", attrs)
+	}
+
+	hdr, attrs = hostAddress(7, net.ParseIP("2001:db8::1"), hostLabel)
+	if hdr[0] != 10 || hdr[1] != 128 || hdr[2] != unix.IFA_F_NODAD || len(attrs) != 40 {
+		t.Errorf("wrong IPv6 address, ifaddrmsg %v, attributes %v", hdr, attrs)
+	}
+}
@@ -0,0 +1,282 @@
+package layer2
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/sys/unix"
+)
+
+// Datapaths that replace kube-proxy, like Cilium's eBPF datapath, only
+// handle the traffic of service IPs that are local addresses of the
+// node. In host address mode, the speaker adds each IP it announces,
+// with any protocol, to a local interface. It lives here with the
+// other netlink code.
+
+// Interfaces that HostAddresses can add IPs to.
+const (
+	// HostDummy adds IPs to the metallb-host dummy interface, which
+	// the speaker owns.
+	HostDummy = "dummy"
+	// HostLoopback adds IPs to the loopback interface.
+	HostLoopback = "lo"
+)
+
+// hostDummyInterface is the dummy interface of HostDummy.
+const hostDummyInterface = "metallb-host"
+
+// hostLabel labels the IPv4 addresses we add to the loopback
+// interface, to tell them apart from the others.
+const hostLabel = "lo:metallb"
+
+// HostAddresses adds the IPs of announced services to a local
+// interface. IPs that are already addresses of the node when they're
+// announced, e.g. added by another component, are left alone, and
+// only the IPs it added are ever deleted. A nil HostAddresses does
+// nothing.
+type HostAddresses struct {
+	logger log.Logger
+	mode   string
+	// Netlink operations, replaced in tests.
+	addAddr    func(net.IP) error
+	deleteAddr func(net.IP) error
+	isLocal    func(net.IP) (bool, error)
+
+	mu sync.Mutex
+	// Announced IPs by service, and the number of services of each.
+	ips  map[string]net.IP
+	refs map[string]int
+	// IPs we added, and IPs that were already there.
+	added     map[string]bool
+	conflicts map[string]bool
+}
+
+// NewHostAddresses returns HostAddresses adding IPs to the interface of
+// mode, HostDummy or HostLoopback, and deletes the IPs left over by a
+// previous run.
+func NewHostAddresses(l log.Logger, mode string) (*HostAddresses, error) {
+	switch mode {
+	case HostDummy:
+		if err := deleteDummyInterface(hostDummyInterface); err != nil {
+			return nil, err
+		}
+	case HostLoopback:
+		if err := flushLabeledAddresses(l, hostLabel); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown host address mode %q, must be %q or %q", mode, HostDummy, HostLoopback)
+	}
+	return newHostAddresses(l, mode), nil
+}
+
+func newHostAddresses(l log.Logger, mode string) *HostAddresses {
+	h := &HostAddresses{
+		logger:    l,
+		mode:      mode,
+		isLocal:   isLocalAddress,
+		ips:       map[string]net.IP{},
+		refs:      map[string]int{},
+		added:     map[string]bool{},
+		conflicts: map[string]bool{},
+	}
+	h.addAddr, h.deleteAddr = h.add, h.delete
+	return h
+}
+
+// Add adds ip, announced for the service name, to the interface,
+// unless it's already an address of the node. IPv6 IPs are refused
+// with HostLoopback.
+func (h *HostAddresses) Add(name string, ip net.IP) error {
+	if h == nil {
+		return nil
+	}
+	// IPv6 addresses have no labels, so IPv6 IPs added to the
+	// loopback interface by a run that crashed would look like
+	// addresses of the node to the next one, and never be deleted.
+	if h.mode == HostLoopback && ip.To4() == nil {
+		return fmt.Errorf("can't add IPv6 address %s to the %s interface, use %q instead", ip, h.mode, HostDummy)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if old, ok := h.ips[name]; ok {
+		if old.Equal(ip) {
+			return nil
+		}
+		h.deleteLocked(name)
+	}
+	k := ip.String()
+	if h.refs[k] == 0 && !h.added[k] {
+		local, err := h.isLocal(ip)
+		if err != nil {
+			return err
+		}
+		if local {
+			h.conflicts[k] = true
+			h.logger.Log("op", "addHostAddress", "ip", ip, "service", name, "msg", "IP is already an address of the node, leaving it alone")
+		} else {
+			if err := h.addAddr(ip); err != nil {
+				return fmt.Errorf("adding %s to %s interface: %s", ip, h.mode, err)
+			}
+			h.added[k] = true
+			h.logger.Log("event", "addHostAddress", "ip", ip, "mode", h.mode, "msg", "added announced IP to local interface")
+		}
+	}
+	h.ips[name] = ip
+	h.refs[k]++
+	return nil
+}
+
+// Delete deletes the IP of the service name from the interface, once
+// no other service uses it, if Add added it.
+func (h *HostAddresses) Delete(name string) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.deleteLocked(name)
+}
+
+func (h *HostAddresses) deleteLocked(name string) error {
+	ip, ok := h.ips[name]
+	if !ok {
+		return nil
+	}
+	k := ip.String()
+	if h.refs[k] > 1 {
+		h.refs[k]--
+		delete(h.ips, name)
+		return nil
+	}
+	if h.added[k] {
+		if err := h.deleteAddr(ip); err != nil {
+			return fmt.Errorf("deleting %s from %s interface: %s", ip, h.mode, err)
+		}
+		delete(h.added, k)
+		h.logger.Log("event", "deleteHostAddress", "ip", ip, "mode", h.mode, "msg", "deleted withdrawn IP from local interface")
+	}
+	delete(h.conflicts, k)
+	delete(h.refs, k)
+	delete(h.ips, name)
+	return nil
+}
+
+// Close deletes all the IPs Add added, e.g. when the speaker stops
+// announcing them on shutdown.
+func (h *HostAddresses) Close() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name := range h.ips {
+		if err := h.deleteLocked(name); err != nil {
+			h.logger.Log("op", "deleteHostAddress", "service", name, "error", err, "msg", "failed to delete IP from local interface")
+		}
+	}
+}
+
+func (h *HostAddresses) add(ip net.IP) error {
+	if h.mode == HostLoopback {
+		ifi, err := net.InterfaceByName("lo")
+		if err != nil {
+			return err
+		}
+		return addHostAddress(ifi.Index, ip, hostLabel)
+	}
+	index, err := addDummyInterface(hostDummyInterface)
+	if err != nil {
+		return err
+	}
+	return addHostAddress(index, ip, "")
+}
+
+func (h *HostAddresses) delete(ip net.IP) error {
+	name := hostDummyInterface
+	if h.mode == HostLoopback {
+		name = "lo"
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		// No interface, no address.
+		return nil
+	}
+	return deleteHostAddress(ifi.Index, ip)
+}
+
+// isLocalAddress returns true if ip is an address of an interface of
+// the node.
+func isLocalAddress(ip net.IP) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// flushLabeledAddresses deletes the IPv4 addresses labeled label.
+// IPv6 addresses have no labels, which is why Add refuses to add them
+// to the loopback interface.
+func flushLabeledAddresses(l log.Logger, label string) error {
+	type addr struct {
+		index int
+		ip    net.IP
+	}
+	var stale []addr
+	hdr := make([]byte, unix.SizeofIfAddrmsg)
+	hdr[0] = unix.AF_INET
+	err := rtnlRequest(unix.RTM_GETADDR, unix.NLM_F_DUMP, hdr, nil, func(data []byte) {
+		if len(data) < unix.SizeofIfAddrmsg {
+			return
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: unix.RTM_NEWADDR},
+			Data:   data,
+		})
+		if err != nil {
+			return
+		}
+		var ip net.IP
+		labeled := false
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case unix.IFA_LOCAL:
+				ip = net.IP(append([]byte(nil), a.Value...))
+			case unix.IFA_LABEL:
+				labeled = string(trimNUL(a.Value)) == label
+			}
+		}
+		if labeled && ip != nil {
+			stale = append(stale, addr{int(nativeEndian.Uint32(data[4:8])), ip})
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("listing addresses: %s", err)
+	}
+	for _, a := range stale {
+		if err := deleteHostAddress(a.index, a.ip); err != nil {
+			return fmt.Errorf("deleting stale address %s: %s", a.ip, err)
+		}
+		l.Log("event", "deleteHostAddress", "ip", a.ip, "msg", "deleted IP left over by a previous run")
+	}
+	return nil
+}
+
+func trimNUL(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
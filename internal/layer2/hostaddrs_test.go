@@ -0,0 +1,90 @@
+package layer2
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHostAddresses(t *testing.T) {
+	h := newHostAddresses(log.NewNopLogger(), HostDummy)
+	var ops []string
+	h.addAddr = func(ip net.IP) error {
+		ops = append(ops, "add "+ip.String())
+		return nil
+	}
+	h.deleteAddr = func(ip net.IP) error {
+		ops = append(ops, "delete "+ip.String())
+		return nil
+	}
+	// 10.0.0.1 is the node's own address.
+	h.isLocal = func(ip net.IP) (bool, error) {
+		return ip.Equal(net.ParseIP("10.0.0.1")), nil
+	}
+
+	steps := []func() error{
+		func() error { return h.Add("test/foo", net.ParseIP("192.168.1.1")) },
+		// Same IP again, and shared with another service.
+		func() error { return h.Add("test/foo", net.ParseIP("192.168.1.1")) },
+		func() error { return h.Add("test/bar", net.ParseIP("192.168.1.1")) },
+		func() error { return h.Delete("test/foo") },
+		func() error { return h.Delete("test/bar") },
+		// Addresses that were already there are never deleted.
+		func() error { return h.Add("test/baz", net.ParseIP("10.0.0.1")) },
+		func() error { return h.Delete("test/baz") },
+		// Moving a service to another IP deletes the old one.
+		func() error { return h.Add("test/qux", net.ParseIP("192.168.1.2")) },
+		func() error { return h.Add("test/qux", net.ParseIP("192.168.1.3")) },
+		func() error { return h.Delete("test/unknown") },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %s", i, err)
+		}
+	}
+	want := []string{
+		"add 192.168.1.1",
+		"delete 192.168.1.1",
+		"add 192.168.1.2",
+		"delete 192.168.1.2",
+		"add 192.168.1.3",
+	}
+	if diff := cmp.Diff(want, ops); diff != "" {
+		t.Errorf("wrong operations (-want +got)\n%s", diff)
+	}
+
+	ops = nil
+	h.Close()
+	if diff := cmp.Diff([]string{"delete 192.168.1.3"}, ops); diff != "" {
+		t.Errorf("wrong operations on close (-want +got)\n%s", diff)
+	}
+
+	var nilH *HostAddresses
+	if err := nilH.Add("test/foo", net.ParseIP("192.168.1.1")); err != nil {
+		t.Errorf("nil HostAddresses: %s", err)
+	}
+}
+
+func TestHostAddressesLoopbackIPv6(t *testing.T) {
+	h := newHostAddresses(log.NewNopLogger(), HostLoopback)
+	var ops []string
+	h.addAddr = func(ip net.IP) error {
+		ops = append(ops, "add "+ip.String())
+		return nil
+	}
+	h.isLocal = func(net.IP) (bool, error) { return false, nil }
+
+	// IPv6 addresses can't be labeled, so they would be left over
+	// after a crash.
+	if err := h.Add("test/foo", net.ParseIP("fc00::1")); err == nil {
+		t.Error("IPv6 IP added to the loopback interface")
+	}
+	if err := h.Add("test/bar", net.ParseIP("192.168.1.1")); err != nil {
+		t.Errorf("adding IPv4 IP: %s", err)
+	}
+	if diff := cmp.Diff([]string{"add 192.168.1.1"}, ops); diff != "" {
+		t.Errorf("wrong operations (-want +got)\n%s", diff)
+	}
+}
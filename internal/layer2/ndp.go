@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/mdlayher/ndp"
@@ -16,12 +17,14 @@ type ndpResponder struct {
 	conn         *ndp.Conn
 	closed       chan struct{}
 	announce     announceFunc
+	mac          macFunc
+	limiter      *replyLimiter
 	// Refcount of how many watchers for each solicited node
 	// multicast group.
 	solicitedNodeGroups map[string]int64
 }
 
-func newNDPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*ndpResponder, error) {
+func newNDPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc, mac macFunc, limiter *replyLimiter) (*ndpResponder, error) {
 	// Use link-local address as the source IPv6 address for NDP communications.
 	conn, _, err := ndp.Dial(ifi, ndp.LinkLocal)
 	if err != nil {
@@ -35,6 +38,8 @@ func newNDPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*
 		conn:                conn,
 		closed:              make(chan struct{}),
 		announce:            ann,
+		mac:                 mac,
+		limiter:             limiter,
 		solicitedNodeGroups: map[string]int64{},
 	}
 	go ret.run()
@@ -48,8 +53,23 @@ func (n *ndpResponder) Close() error {
 	return n.conn.Close()
 }
 
-func (n *ndpResponder) Gratuitous(ip net.IP) error {
-	err := n.advertise(net.IPv6linklocalallnodes, ip, true)
+// Gratuitous announces ip with mac, or the interface's MAC if nil.
+func (n *ndpResponder) Gratuitous(ip net.IP, mac net.HardwareAddr) error {
+	if mac == nil {
+		mac = n.hardwareAddr
+	}
+	err := n.advertise(net.IPv6linklocalallnodes, ip, mac, true)
+	stats.SentGratuitous(ip.String())
+	return err
+}
+
+// Targeted announces ip with mac, or the interface's MAC if nil, to
+// dst only.
+func (n *ndpResponder) Targeted(ip net.IP, mac net.HardwareAddr, dst net.IP) error {
+	if mac == nil {
+		mac = n.hardwareAddr
+	}
+	err := n.advertise(dst, ip, mac, true)
 	stats.SentGratuitous(ip.String())
 	return err
 }
@@ -136,18 +156,37 @@ func (n *ndpResponder) processRequest() dropReason {
 		return reason
 	}
 
+	// Ignore NDP requests that can't come from a genuine neighbor,
+	// including our own.
+	if spoofedMAC(nsLLAddr, n.hardwareAddr) {
+		stats.DroppedRequest("spoofed")
+		return dropReasonSpoofed
+	}
+
+	if !n.limiter.allow(nsLLAddr, time.Now()) {
+		stats.DroppedRequest("rateLimited")
+		return dropReasonRateLimited
+	}
+
+	mac := n.hardwareAddr
+	if n.mac != nil {
+		if vmac := n.mac(ns.TargetAddress); vmac != nil {
+			mac = vmac
+		}
+	}
+
 	stats.GotRequest(ns.TargetAddress.String())
-	n.logger.Log("interface", n.intf, "ip", ns.TargetAddress, "senderIP", src, "senderLLAddr", nsLLAddr, "responseMAC", n.hardwareAddr, "msg", "got NDP request for service IP, sending response")
+	n.logger.Log("interface", n.intf, "ip", ns.TargetAddress, "senderIP", src, "senderLLAddr", nsLLAddr, "responseMAC", mac, "msg", "got NDP request for service IP, sending response")
 
-	if err := n.advertise(src, ns.TargetAddress, false); err != nil {
-		n.logger.Log("op", "arpReply", "interface", n.intf, "ip", ns.TargetAddress, "senderIP", src, "senderLLAddr", nsLLAddr, "responseMAC", n.hardwareAddr, "error", err, "msg", "failed to send ARP reply")
+	if err := n.advertise(src, ns.TargetAddress, mac, false); err != nil {
+		n.logger.Log("op", "arpReply", "interface", n.intf, "ip", ns.TargetAddress, "senderIP", src, "senderLLAddr", nsLLAddr, "responseMAC", mac, "error", err, "msg", "failed to send ARP reply")
 	} else {
 		stats.SentResponse(ns.TargetAddress.String())
 	}
 	return dropReasonNone
 }
 
-func (n *ndpResponder) advertise(dst, target net.IP, gratuitous bool) error {
+func (n *ndpResponder) advertise(dst, target net.IP, mac net.HardwareAddr, gratuitous bool) error {
 	m := &ndp.NeighborAdvertisement{
 		Solicited:     !gratuitous, // <Adam Jensen> I never asked for this...
 		Override:      gratuitous,  // Should clients replace existing cache entries
@@ -155,7 +194,7 @@ func (n *ndpResponder) advertise(dst, target net.IP, gratuitous bool) error {
 		Options: []ndp.Option{
 			&ndp.LinkLayerAddress{
 				Direction: ndp.Target,
-				Addr:      n.hardwareAddr,
+				Addr:      mac,
 			},
 		},
 	}
@@ -0,0 +1,132 @@
+package layer2
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/sys/unix"
+)
+
+// watchLinks signals changes whenever the kernel reports that a link
+// went up or down, or that an address was added or removed. If the
+// subscription fails, it logs and returns, leaving the caller to
+// poll.
+func watchLinks(l log.Logger, changes chan<- struct{}) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		l.Log("op", "watchLinks", "error", err, "msg", "failed to create netlink socket, interface changes will only be noticed by polling")
+		return
+	}
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		l.Log("op", "watchLinks", "error", err, "msg", "failed to subscribe to netlink link and address changes, interface changes will only be noticed by polling")
+		return
+	}
+
+	// We only care that something changed, not what: the interfaces
+	// are rescanned from scratch anyway.
+	buf := make([]byte, 64*1024)
+	for {
+		_, _, err := unix.Recvfrom(fd, buf, 0)
+		switch err {
+		case nil, unix.ENOBUFS:
+			// ENOBUFS means we missed some messages, which is still a
+			// change.
+		case unix.EINTR:
+			continue
+		default:
+			l.Log("op", "watchLinks", "error", err, "msg", "failed to read netlink messages, interface changes will only be noticed by polling")
+			return
+		}
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// netlinkRequest sends req on the netlink socket fd and reads the
+// replies up to the end of the dump or the acknowledgement, passing
+// the payload of each message to handle.
+func netlinkRequest(fd int, req []byte, handle func([]byte)) error {
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return fmt.Errorf("short netlink error message")
+				}
+				if code := int32(nativeEndian.Uint32(m.Data[:4])); code != 0 {
+					return unix.Errno(-code)
+				}
+				// An acknowledgement.
+				return nil
+			}
+			if handle != nil {
+				handle(m.Data)
+			}
+		}
+	}
+}
+
+// rtnlRequest sends an rtnetlink request of type typ, made of the
+// family specific header hdr followed by attrs, and reads the
+// replies like netlinkRequest.
+func rtnlRequest(typ, flags uint16, hdr, attrs []byte, handle func([]byte)) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("creating netlink socket: %s", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("binding netlink socket: %s", err)
+	}
+
+	b := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(hdr)+len(attrs))
+	b = append(append(b, hdr...), attrs...)
+	nativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	nativeEndian.PutUint16(b[4:6], typ)
+	nativeEndian.PutUint16(b[6:8], unix.NLM_F_REQUEST|flags)
+	nativeEndian.PutUint32(b[8:12], 1)
+	return netlinkRequest(fd, b, handle)
+}
+
+// appendAttr appends the netlink attribute typ holding data to b.
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	l := unix.SizeofNlAttr + len(data)
+	aligned := (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+	a := make([]byte, aligned)
+	nativeEndian.PutUint16(a[0:2], uint16(l))
+	nativeEndian.PutUint16(a[2:4], typ)
+	copy(a[unix.SizeofNlAttr:], data)
+	return append(b, a...)
+}
+
+func uint32Attr(v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return b
+}
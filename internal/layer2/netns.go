@@ -0,0 +1,39 @@
+package layer2
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// inNetns calls f in the network namespace at path, or in ours if
+// path is empty. Sockets that f opens stay in that namespace.
+func inNetns(path string, f func() error) error {
+	if path == "" {
+		return f()
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		// The namespace is per thread, so f must run on a thread of
+		// its own. That thread is never unlocked, and so exits with
+		// the goroutine instead of returning to the runtime in
+		// another namespace.
+		runtime.LockOSThread()
+
+		ns, err := os.Open(path)
+		if err != nil {
+			errs <- fmt.Errorf("opening network namespace: %s", err)
+			return
+		}
+		defer ns.Close()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			errs <- fmt.Errorf("entering network namespace %q: %s", path, err)
+			return
+		}
+		errs <- f()
+	}()
+	return <-errs
+}
@@ -0,0 +1,44 @@
+package layer2
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+	"go.universe.tf/metallb/internal/ratelimit"
+)
+
+// replyLimiter rate limits the replies sent to each requester, by
+// source MAC address. A nil replyLimiter allows everything.
+type replyLimiter struct {
+	keyed *ratelimit.Keyed
+}
+
+// newReplyLimiter returns a limiter that allows rate replies per
+// second to each MAC address, in bursts of up to burst replies. It
+// returns nil if rate is zero.
+func newReplyLimiter(rate float64, burst int) *replyLimiter {
+	keyed := ratelimit.New(rate, burst)
+	if keyed == nil {
+		return nil
+	}
+	return &replyLimiter{keyed: keyed}
+}
+
+// allow returns true if a reply to mac can be sent at now.
+func (l *replyLimiter) allow(mac net.HardwareAddr, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	return l.keyed.Allow(mac.String(), now)
+}
+
+// spoofedMAC returns true if mac cannot be the source of a genuine
+// request to us: our own address, or the zero or broadcast address.
+func spoofedMAC(mac, ours net.HardwareAddr) bool {
+	if len(mac) != 6 {
+		return true
+	}
+	return bytes.Equal(mac, ours) || bytes.Equal(mac, ethernet.Broadcast) || bytes.Equal(mac, make(net.HardwareAddr, 6))
+}
@@ -0,0 +1,60 @@
+package layer2
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplyLimiter(t *testing.T) {
+	l := newReplyLimiter(2, 3)
+	mac1 := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	mac2 := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !l.allow(mac1, now) {
+			t.Fatalf("reply %d of the burst was limited", i+1)
+		}
+	}
+	if l.allow(mac1, now) {
+		t.Error("reply past the burst was allowed")
+	}
+	if !l.allow(mac2, now) {
+		t.Error("other requester was limited")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow(mac1, now) {
+		t.Error("reply was limited after the bucket refilled")
+	}
+	if l.allow(mac1, now) {
+		t.Error("second reply was allowed, only one token refilled")
+	}
+
+	var unlimited *replyLimiter
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow(mac1, now) {
+			t.Fatal("nil limiter limited a reply")
+		}
+	}
+}
+
+func TestSpoofedMAC(t *testing.T) {
+	ours := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	tests := []struct {
+		mac  net.HardwareAddr
+		want bool
+	}{
+		{net.HardwareAddr{2, 0, 0, 0, 0, 2}, false},
+		{ours, true},
+		{net.HardwareAddr{0, 0, 0, 0, 0, 0}, true},
+		{net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, true},
+		{net.HardwareAddr{2, 0, 0, 0}, true},
+	}
+	for _, test := range tests {
+		if got := spoofedMAC(test.mac, ours); got != test.want {
+			t.Errorf("spoofedMAC(%s) = %v, want %v", test.mac, got, test.want)
+		}
+	}
+}
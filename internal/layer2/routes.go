@@ -0,0 +1,183 @@
+package layer2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/sys/unix"
+)
+
+// On unnumbered and point-to-point links, such as routed access
+// ports, the router doesn't resolve service IPs on the link: it
+// routes them. The announcing node installs a host route for each
+// such IP, for a routing daemon on the node to redistribute to the
+// router, and sends its announcements straight to its neighbors on
+// the link rather than to the broadcast domain that isn't there.
+
+// hostRouteProtocol tags the host routes of unnumbered IPs, for
+// routing daemons to select them ("ip route show proto 240").
+const hostRouteProtocol = 240
+
+// allRouters is the IPv6 all-routers multicast group.
+var allRouters = net.ParseIP("ff02::2")
+
+// hostRoute returns the rtmsg header and attributes of the host route
+// of ip. The route is a blackhole: kube-proxy intercepts the traffic
+// for services before it's routed, and everything else must not be
+// routed back to the router it came from. It isn't a local route,
+// which routing daemons don't redistribute, so it also catches the
+// connections the node opens to ip itself, before iptables' OUTPUT
+// chain can rewrite them.
+func hostRoute(ip net.IP) (hdr, attrs []byte) {
+	family, bits := unix.AF_INET, 32
+	if ip.To4() != nil {
+		ip = ip.To4()
+	} else {
+		family, bits = unix.AF_INET6, 128
+	}
+	// rtmsg: family, dst_len, src_len, tos, table, protocol, scope,
+	// type and flags.
+	hdr = make([]byte, unix.SizeofRtMsg)
+	hdr[0] = byte(family)
+	hdr[1] = byte(bits)
+	hdr[4] = unix.RT_TABLE_MAIN
+	hdr[5] = hostRouteProtocol
+	hdr[6] = unix.RT_SCOPE_UNIVERSE
+	hdr[7] = unix.RTN_BLACKHOLE
+	attrs = appendAttr(nil, unix.RTA_DST, ip)
+	return hdr, attrs
+}
+
+// addHostRoute installs the host route of ip, replacing any route to
+// exactly ip.
+func addHostRoute(ip net.IP) error {
+	hdr, attrs := hostRoute(ip)
+	if err := rtnlRequest(unix.RTM_NEWROUTE, unix.NLM_F_ACK|unix.NLM_F_CREATE|unix.NLM_F_REPLACE, hdr, attrs, nil); err != nil {
+		return fmt.Errorf("adding host route for %s: %s", ip, err)
+	}
+	return nil
+}
+
+// deleteHostRoute deletes the host route of ip, if it exists.
+func deleteHostRoute(ip net.IP) error {
+	hdr, attrs := hostRoute(ip)
+	err := rtnlRequest(unix.RTM_DELROUTE, unix.NLM_F_ACK, hdr, attrs, nil)
+	if err != nil && err != unix.ESRCH {
+		return fmt.Errorf("deleting host route for %s: %s", ip, err)
+	}
+	return nil
+}
+
+// flushHostRoutes deletes all the host routes we installed, including
+// the ones left over by a previous run.
+func flushHostRoutes() error {
+	var routes [][]byte
+	err := rtnlRequest(unix.RTM_GETROUTE, unix.NLM_F_DUMP, make([]byte, unix.SizeofRtMsg), nil, func(data []byte) {
+		if len(data) >= unix.SizeofRtMsg && data[5] == hostRouteProtocol {
+			routes = append(routes, append([]byte(nil), data...))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("listing routes: %s", err)
+	}
+	for _, r := range routes {
+		err := rtnlRequest(unix.RTM_DELROUTE, unix.NLM_F_ACK, r[:unix.SizeofRtMsg], r[unix.SizeofRtMsg:], nil)
+		if err != nil && err != unix.ESRCH {
+			return fmt.Errorf("deleting route: %s", err)
+		}
+	}
+	return nil
+}
+
+// arpNeighbors returns the MACs of the resolved IPv4 neighbors on
+// intf, from the kernel's ARP table.
+func arpNeighbors(intf string) ([]net.HardwareAddr, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseARPNeighbors(f, intf)
+}
+
+// parseARPNeighbors returns the MACs of the resolved neighbors on
+// intf in r, in the format of /proc/net/arp.
+func parseARPNeighbors(r io.Reader, intf string) ([]net.HardwareAddr, error) {
+	var ret []net.HardwareAddr
+	s := bufio.NewScanner(r)
+	// Skip the header line.
+	s.Scan()
+	for s.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device.
+		fs := strings.Fields(s.Text())
+		if len(fs) != 6 || fs[5] != intf {
+			continue
+		}
+		flags, err := strconv.ParseUint(fs[2], 0, 32)
+		// ATF_COM, the entry is resolved.
+		if err != nil || flags&0x2 == 0 {
+			continue
+		}
+		mac, err := net.ParseMAC(fs[3])
+		if err != nil {
+			continue
+		}
+		ret = append(ret, mac)
+	}
+	return ret, s.Err()
+}
+
+// hostRouteKey identifies the host route of ip in netns.
+type hostRouteKey struct {
+	ip    string
+	netns string
+}
+
+// syncHostRoutes installs the host routes of our unnumbered IPs, and
+// deletes the ones no longer needed. The caller must hold the lock.
+func (a *Announce) syncHostRoutes() {
+	want := map[hostRouteKey]bool{}
+	for name, o := range a.opts {
+		if o.Unnumbered {
+			want[hostRouteKey{a.ips[name].String(), o.NetworkNamespace}] = true
+		}
+	}
+
+	for r := range want {
+		if a.routes[r] {
+			continue
+		}
+		l := a.logger
+		if r.netns != "" {
+			l = log.With(l, "netns", r.netns)
+		}
+		if err := inNetns(r.netns, func() error { return addHostRoute(net.ParseIP(r.ip)) }); err != nil {
+			l.Log("op", "addHostRoute", "ip", r.ip, "error", err, "msg", "failed to add host route for unnumbered IP")
+			continue
+		}
+		a.routes[r] = true
+		l.Log("event", "addHostRoute", "ip", r.ip, "msg", "added host route for unnumbered IP")
+	}
+
+	for r := range a.routes {
+		if want[r] {
+			continue
+		}
+		l := a.logger
+		if r.netns != "" {
+			l = log.With(l, "netns", r.netns)
+		}
+		if err := inNetns(r.netns, func() error { return deleteHostRoute(net.ParseIP(r.ip)) }); err != nil {
+			l.Log("op", "deleteHostRoute", "ip", r.ip, "error", err, "msg", "failed to delete host route")
+			continue
+		}
+		delete(a.routes, r)
+		l.Log("event", "deleteHostRoute", "ip", r.ip, "msg", "deleted host route")
+	}
+}
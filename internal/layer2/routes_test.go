@@ -0,0 +1,41 @@
+package layer2
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseARPNeighbors(t *testing.T) {
+	table := `IP address       HW type     Flags       HW address            Mask     Device
+10.0.0.1         0x1         0x2         52:54:00:12:34:56     *        eth0
+10.0.0.2         0x1         0x0         00:00:00:00:00:00     *        eth0
+10.1.0.1         0x1         0x2         52:54:00:ab:cd:ef     *        eth1
+`
+	got, err := parseARPNeighbors(strings.NewReader(table), "eth0")
+	if err != nil {
+		t.Fatalf("parseARPNeighbors: %s", err)
+	}
+	want := []net.HardwareAddr{{0x52, 0x54, 0, 0x12, 0x34, 0x56}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong neighbors (-want +got)\n%s", diff)
+	}
+}
+
+func TestHostRoute(t *testing.T) {
+	hdr, attrs := hostRoute(net.ParseIP("192.168.1.20"))
+	want := []byte{2, 32, 0, 0, 254, hostRouteProtocol, 0, 6, 0, 0, 0, 0}
+	if diff := cmp.Diff(want, hdr); diff != "" {
+		t.Errorf("wrong rtmsg (-want +got)\n%s", diff)
+	}
+	if len(attrs) != 8 || !net.IP(attrs[4:]).Equal(net.ParseIP("192.168.1.20")) {
+		t.Errorf("wrong attributes %v", attrs)
+	}
+
+	hdr, attrs = hostRoute(net.ParseIP("2001:db8::1"))
+	if hdr[0] != 10 || hdr[1] != 128 || len(attrs) != 20 {
+		t.Errorf("wrong IPv6 route, rtmsg %v, attributes %v", hdr, attrs)
+	}
+}
@@ -29,18 +29,29 @@ var stats = metrics{
 	}, []string{
 		"ip",
 	}),
+
+	dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "requests_dropped",
+		Help:      "Number of layer2 requests for owned IPs that were not responded to",
+	}, []string{
+		"reason",
+	}),
 }
 
 type metrics struct {
 	in         *prometheus.CounterVec
 	out        *prometheus.CounterVec
 	gratuitous *prometheus.CounterVec
+	dropped    *prometheus.CounterVec
 }
 
 func init() {
 	prometheus.MustRegister(stats.in)
 	prometheus.MustRegister(stats.out)
 	prometheus.MustRegister(stats.gratuitous)
+	prometheus.MustRegister(stats.dropped)
 }
 
 func (m *metrics) GotRequest(addr string) {
@@ -54,3 +65,7 @@ func (m *metrics) SentResponse(addr string) {
 func (m *metrics) SentGratuitous(addr string) {
 	m.gratuitous.WithLabelValues(addr).Add(1)
 }
+
+func (m *metrics) DroppedRequest(reason string) {
+	m.dropped.WithLabelValues(reason).Add(1)
+}
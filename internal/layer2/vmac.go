@@ -0,0 +1,202 @@
+package layer2
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/sys/unix"
+)
+
+// Answering for IPs with a virtual MAC, rather than the MAC of the
+// node's interface, keeps the neighbor caches of routers and
+// firewalls valid across failovers: only the switches have to learn
+// that the MAC moved, from the gratuitous announcements of the new
+// node. For the node to receive the frames sent to the virtual MAC,
+// it gets a macvlan interface with that MAC on the interface the IP
+// is announced on.
+
+// macvlan attributes, from linux/if_link.h. x/sys/unix doesn't have
+// them.
+const (
+	iflaMACVLANMode    = 1
+	macvlanModePrivate = 1
+)
+
+// vmacPrefix starts the names of the macvlan interfaces of virtual
+// MACs.
+const vmacPrefix = "mlbv"
+
+// vmacRefresh is how often the virtual MACs are announced again, so
+// that switches don't age them out while neighbors still use them.
+const vmacRefresh = time.Minute
+
+// vmacLink is the macvlan interface of a virtual MAC.
+type vmacLink struct {
+	netns  string
+	parent int
+	mac    net.HardwareAddr
+}
+
+// vmacInterface returns the name of the macvlan interface that
+// receives the frames to mac on the interface with index parent.
+func vmacInterface(parent int, mac net.HardwareAddr) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d/%s", parent, mac)
+	return fmt.Sprintf("%s%08x", vmacPrefix, h.Sum32())
+}
+
+// addVirtualMAC creates the macvlan interface name with mac on the
+// interface with index parent, unless it exists.
+func addVirtualMAC(name string, parent int, mac net.HardwareAddr) error {
+	var data, info, attrs []byte
+	data = appendAttr(data, iflaMACVLANMode, uint32Attr(macvlanModePrivate))
+	info = appendAttr(info, unix.IFLA_INFO_KIND, []byte("macvlan"))
+	info = appendAttr(info, unix.IFLA_INFO_DATA|unix.NLA_F_NESTED, data)
+	attrs = appendAttr(attrs, unix.IFLA_IFNAME, append([]byte(name), 0))
+	attrs = appendAttr(attrs, unix.IFLA_LINK, uint32Attr(uint32(parent)))
+	attrs = appendAttr(attrs, unix.IFLA_ADDRESS, mac)
+	attrs = appendAttr(attrs, unix.IFLA_LINKINFO|unix.NLA_F_NESTED, info)
+
+	err := linkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, unix.IFF_UP, attrs)
+	if err != nil && err != unix.EEXIST {
+		return fmt.Errorf("creating macvlan interface %q: %s", name, err)
+	}
+	return nil
+}
+
+// deleteVirtualMAC deletes the macvlan interface name, if it exists.
+func deleteVirtualMAC(name string) error {
+	attrs := appendAttr(nil, unix.IFLA_IFNAME, append([]byte(name), 0))
+	err := linkRequest(unix.RTM_DELLINK, 0, 0, attrs)
+	if err != nil && err != unix.ENODEV {
+		return fmt.Errorf("deleting macvlan interface %q: %s", name, err)
+	}
+	return nil
+}
+
+// looseRPFilter makes the interface name accept packets from sources
+// that aren't routed through it, as replies to clients of the IPs
+// leave through the macvlan's parent.
+func looseRPFilter(name string) error {
+	return ioutil.WriteFile("/proc/sys/net/ipv4/conf/"+name+"/rp_filter", []byte("2"), 0644)
+}
+
+// linkRequest sends an rtnetlink link request of type typ, setting
+// flags on the link, and waits for its acknowledgement.
+func linkRequest(typ, nlFlags uint16, flags uint32, attrs []byte) error {
+	// ifinfomsg: family, type and index 0, then the flags to set and
+	// the mask of flags to change.
+	hdr := make([]byte, unix.SizeofIfInfomsg)
+	nativeEndian.PutUint32(hdr[8:12], flags)
+	nativeEndian.PutUint32(hdr[12:16], flags)
+	return rtnlRequest(typ, unix.NLM_F_ACK|nlFlags, hdr, attrs, nil)
+}
+
+// isVirtualMACInterface returns true if name is the macvlan
+// interface of a virtual MAC.
+func isVirtualMACInterface(name string) bool {
+	return strings.HasPrefix(name, vmacPrefix)
+}
+
+// syncVirtualMACs creates the macvlan interfaces of the virtual MACs
+// of our IPs on the interfaces they're announced on, and deletes the
+// ones no longer needed. The caller must hold the lock.
+func (a *Announce) syncVirtualMACs() {
+	links := map[link]string{}
+	for k, client := range a.arps {
+		links[k] = client.Interface()
+	}
+	for k, client := range a.ndps {
+		links[k] = client.Interface()
+	}
+	for k, intf := range links {
+		if isVirtualMACInterface(intf) {
+			delete(links, k)
+		}
+	}
+
+	want := map[string]vmacLink{}
+	for _, o := range a.opts {
+		if o.VirtualMAC == nil {
+			continue
+		}
+		for k, intf := range links {
+			if o.on(k.netns, intf) {
+				want[vmacInterface(k.index, o.VirtualMAC)] = vmacLink{k.netns, k.index, o.VirtualMAC}
+			}
+		}
+	}
+
+	changed := false
+	for name, v := range want {
+		if _, ok := a.vmacs[name]; ok {
+			continue
+		}
+		l := a.logger
+		if v.netns != "" {
+			l = log.With(l, "netns", v.netns)
+		}
+		err := inNetns(v.netns, func() error {
+			if err := addVirtualMAC(name, v.parent, v.mac); err != nil {
+				return err
+			}
+			if err := looseRPFilter(name); err != nil {
+				l.Log("op", "setRPFilter", "interface", name, "error", err, "msg", "failed to loosen reverse path filtering, traffic to the virtual MAC may be dropped")
+			}
+			return nil
+		})
+		if err != nil {
+			l.Log("op", "createVirtualMAC", "interface", name, "mac", v.mac, "error", err, "msg", "failed to create interface for virtual MAC, traffic to it won't be received")
+			continue
+		}
+		a.vmacs[name] = v
+		changed = true
+		l.Log("event", "createVirtualMAC", "interface", name, "mac", v.mac, "msg", "created interface for virtual MAC")
+	}
+
+	for name, v := range a.vmacs {
+		if _, ok := want[name]; ok {
+			continue
+		}
+		if err := inNetns(v.netns, func() error { return deleteVirtualMAC(name) }); err != nil {
+			a.logger.Log("op", "deleteVirtualMAC", "interface", name, "mac", v.mac, "error", err, "msg", "failed to delete interface for virtual MAC")
+			continue
+		}
+		delete(a.vmacs, name)
+		changed = true
+		a.logger.Log("event", "deleteVirtualMAC", "interface", name, "mac", v.mac, "msg", "deleted interface for virtual MAC")
+	}
+	if changed {
+		// Give the interfaces their responders, or close the ones of
+		// deleted interfaces.
+		select {
+		case a.rescan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// refreshVirtualMACs periodically announces the IPs that have a
+// virtual MAC.
+func (a *Announce) refreshVirtualMACs() {
+	for range time.Tick(vmacRefresh) {
+		a.RLock()
+		var names []string
+		for name, o := range a.opts {
+			if o.VirtualMAC != nil {
+				names = append(names, name)
+			}
+		}
+		a.RUnlock()
+		for _, name := range names {
+			if err := a.gratuitous(name); err != nil {
+				a.logger.Log("op", "gratuitousAnnounce", "error", err, "service", name, "msg", "failed to refresh virtual MAC announcement")
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package ratelimit rate limits events per key, e.g. per requester or
+// per namespace, with a token bucket for each key.
+package ratelimit // import "go.universe.tf/metallb/internal/ratelimit"
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Number of keys tracked before idle ones are forgotten.
+const maxKeys = 4096
+
+// Keyed is a rate limiter with a token bucket per key. It is safe
+// for concurrent use, and a nil Keyed allows everything.
+type Keyed struct {
+	limit rate.Limit
+	burst int
+	// How long an unused bucket takes to fill up again, after which
+	// it behaves the same as a new one.
+	refill time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	lim  *rate.Limiter
+	last time.Time
+}
+
+// New returns a limiter that allows r events per second for each key,
+// in bursts of up to burst events. It returns nil if r is zero.
+func New(r float64, burst int) *Keyed {
+	if r <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Keyed{
+		limit:   rate.Limit(r),
+		burst:   burst,
+		refill:  time.Duration(float64(burst) / r * float64(time.Second)),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Allow takes a token of key at now, and returns false if there is
+// none.
+func (k *Keyed) Allow(key string, now time.Time) bool {
+	if k == nil {
+		return true
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	b := k.bucket(key, now)
+	b.last = now
+	return b.lim.AllowN(now, 1)
+}
+
+// Delay returns how long from now until key has a token, without
+// taking it.
+func (k *Keyed) Delay(key string, now time.Time) time.Duration {
+	if k == nil {
+		return 0
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	r := k.bucket(key, now).lim.ReserveN(now, 1)
+	defer r.CancelAt(now)
+	return r.DelayFrom(now)
+}
+
+// bucket returns the bucket of key at now, creating it if needed.
+// Must be called with k.mu held.
+func (k *Keyed) bucket(key string, now time.Time) *bucket {
+	if b := k.buckets[key]; b != nil {
+		return b
+	}
+	if len(k.buckets) >= maxKeys {
+		k.forgetIdle(now)
+	}
+	b := &bucket{
+		lim:  rate.NewLimiter(k.limit, k.burst),
+		last: now,
+	}
+	k.buckets[key] = b
+	return b
+}
+
+// forgetIdle drops the buckets that have filled up again. Must be
+// called with k.mu held.
+func (k *Keyed) forgetIdle(now time.Time) {
+	for key, b := range k.buckets {
+		if now.Sub(b.last) >= k.refill {
+			delete(k.buckets, key)
+		}
+	}
+}
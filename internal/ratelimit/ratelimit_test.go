@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestKeyed(t *testing.T) {
+	k := New(1, 2)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if d := k.Delay("a", now); d != 0 {
+		t.Errorf("new key delayed by %s", d)
+	}
+	for i := 0; i < 2; i++ {
+		if !k.Allow("a", now) {
+			t.Fatalf("event %d of the burst was limited", i+1)
+		}
+	}
+	// Asking for the delay doesn't take a token.
+	for i := 0; i < 3; i++ {
+		if d := k.Delay("a", now); d != time.Second {
+			t.Errorf("got delay %s past the burst, want 1s", d)
+		}
+	}
+	if k.Allow("a", now) {
+		t.Error("event past the burst was allowed")
+	}
+	if !k.Allow("b", now) {
+		t.Error("other key was limited")
+	}
+
+	now = now.Add(time.Second)
+	if !k.Allow("a", now) {
+		t.Error("event was limited after the bucket refilled")
+	}
+	if k.Allow("a", now) {
+		t.Error("second event was allowed, only one token refilled")
+	}
+
+	var unlimited *Keyed
+	for i := 0; i < 100; i++ {
+		if !unlimited.Allow("a", now) || unlimited.Delay("a", now) != 0 {
+			t.Fatal("nil limiter limited an event")
+		}
+	}
+}
+
+func TestKeyedForgetsIdle(t *testing.T) {
+	k := New(1, 1)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < maxKeys; i++ {
+		k.Allow(fmt.Sprint(i), now)
+	}
+	// Buckets in use are kept, and dropped once idle if there are
+	// too many.
+	k.Allow("another", now)
+	if len(k.buckets) != maxKeys+1 {
+		t.Fatalf("got %d buckets, want %d", len(k.buckets), maxKeys+1)
+	}
+	k.Allow("new", now.Add(time.Second))
+	if len(k.buckets) != 1 {
+		t.Errorf("got %d buckets after forgetting idle ones, want 1", len(k.buckets))
+	}
+}
@@ -0,0 +1,51 @@
+// Package secrets looks up credentials referenced by the
+// configuration, like BGP passwords and IPAM credentials, so that
+// they don't have to be part of the configuration itself.
+package secrets // import "go.universe.tf/metallb/internal/secrets"
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Names of the providers, as used in the configuration.
+const (
+	KubernetesSource = "kubernetes"
+	VaultSource      = "vault"
+)
+
+// A Provider looks up credentials.
+type Provider interface {
+	// Get returns the value of key in the secret name. namespace
+	// scopes name, its meaning is up to the provider.
+	Get(namespace, name, key string) ([]byte, error)
+}
+
+type kubernetesProvider struct {
+	client kubernetes.Interface
+}
+
+// Kubernetes returns a Provider that reads Kubernetes Secrets.
+func Kubernetes(client kubernetes.Interface) Provider {
+	return kubernetesProvider{client}
+}
+
+func (p kubernetesProvider) Get(namespace, name, key string) ([]byte, error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("missing namespace of secret %q", name)
+	}
+	if p.client == nil {
+		return nil, fmt.Errorf("cannot read secret %s/%s without a Kubernetes client", namespace, name)
+	}
+	secret, err := p.client.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting secret %s/%s: %w", namespace, name, err)
+	}
+	v, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no key %q", namespace, name, key)
+	}
+	return v, nil
+}
@@ -0,0 +1,75 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// vaultProvider reads secrets through a Vault agent listening on a
+// unix socket. The agent authenticates to Vault and adds its token
+// (use_auto_auth_token), so MetalLB never handles Vault credentials.
+type vaultProvider struct {
+	client *http.Client
+}
+
+// Vault returns a Provider that reads secrets from the KV secrets
+// engine (version 1 or 2) through the Vault agent listening on
+// socket. Secret names are Vault API paths, like
+// "secret/data/metallb/bgp", and namespaces are Vault Enterprise
+// namespaces.
+func Vault(socket string) Provider {
+	return vaultProvider{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (p vaultProvider) Get(namespace, name, key string) ([]byte, error) {
+	req, err := http.NewRequest("GET", "http://vault/v1/"+strings.TrimPrefix(name, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Request", "true")
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reading vault secret %q: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("decoding vault secret %q: %w", name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading vault secret %q: %s %s", name, resp.Status, strings.Join(body.Errors, ", "))
+	}
+
+	data := body.Data
+	// KV version 2 nests the secret's data, next to its metadata.
+	if nested, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = nested
+	}
+	v, ok := data[key].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault secret %q has no string key %q", name, key)
+	}
+	return []byte(v), nil
+}
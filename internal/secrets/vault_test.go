@@ -0,0 +1,100 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Request") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/bgp":
+			w.Write([]byte(`{"data": {"password": "v1secret"}}`))
+		case "/v1/secret/data/bgp":
+			if r.Header.Get("X-Vault-Namespace") != "team" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors": ["permission denied"]}`))
+				return
+			}
+			w.Write([]byte(`{"data": {"data": {"password": "v2secret"}, "metadata": {"version": 3}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": []}`))
+		}
+	}))
+
+	tests := []struct {
+		desc      string
+		namespace string
+		name      string
+		key       string
+		want      string
+	}{
+		{
+			desc: "kv version 1",
+			name: "kv/bgp",
+			key:  "password",
+			want: "v1secret",
+		},
+		{
+			desc:      "kv version 2",
+			namespace: "team",
+			name:      "/secret/data/bgp",
+			key:       "password",
+			want:      "v2secret",
+		},
+		{
+			desc: "missing key",
+			name: "kv/bgp",
+			key:  "nope",
+		},
+		{
+			desc: "wrong namespace",
+			name: "secret/data/bgp",
+			key:  "password",
+		},
+		{
+			desc: "missing secret",
+			name: "kv/nope",
+			key:  "password",
+		},
+	}
+
+	p := Vault(socket)
+	for _, test := range tests {
+		got, err := p.Get(test.namespace, test.name, test.key)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %q, want error", test.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.desc, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
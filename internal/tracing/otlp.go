@@ -0,0 +1,185 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// Spans beyond this many pending exports are dropped, so that an
+	// unreachable collector cannot make us run out of memory.
+	maxPendingSpans = 2048
+	flushInterval   = 5 * time.Second
+)
+
+// otlpExporter batches finished spans and posts them to an
+// OTLP/HTTP collector, using the JSON encoding of the OTLP protobufs.
+type otlpExporter struct {
+	logger      log.Logger
+	url         string
+	serviceName string
+	client      *http.Client
+
+	mu      sync.Mutex
+	pending []*Span
+	dropped int
+}
+
+func newOTLPExporter(l log.Logger, endpoint, serviceName string) *otlpExporter {
+	return &otlpExporter{
+		logger:      l,
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *otlpExporter) add(s *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.pending) >= maxPendingSpans {
+		e.dropped++
+		return
+	}
+	e.pending = append(e.pending, s)
+}
+
+func (e *otlpExporter) run() {
+	for range time.Tick(flushInterval) {
+		e.flush()
+	}
+}
+
+// flush exports the pending spans in one batch. Spans that fail to
+// export are dropped, like those beyond maxPendingSpans.
+func (e *otlpExporter) flush() error {
+	e.mu.Lock()
+	spans, dropped := e.pending, e.dropped
+	e.pending, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		e.logger.Log("op", "exportSpans", "dropped", dropped, "msg", "too many pending spans, dropped some")
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	err := e.export(spans)
+	if err != nil {
+		e.logger.Log("op", "exportSpans", "error", err, "spans", len(spans), "msg", "failed to export spans to OTLP collector")
+	}
+	return err
+}
+
+func (e *otlpExporter) export(spans []*Span) error {
+	bs, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return fmt.Errorf("encoding spans: %s", err)
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func keyValues(attrs map[string]string) []otlpKeyValue {
+	var ret []otlpKeyValue
+	for k, v := range attrs {
+		kv := otlpKeyValue{Key: k}
+		kv.Value.StringValue = v
+		ret = append(ret, kv)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+func (e *otlpExporter) encode(spans []*Span) *otlpRequest {
+	ss := otlpScopeSpans{}
+	ss.Scope.Name = "go.universe.tf/metallb"
+
+	var noParent [8]byte
+	for _, s := range spans {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        keyValues(s.attrs),
+			Status:            otlpStatus{Code: 1}, // STATUS_CODE_OK
+		}
+		if s.parentID != noParent {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			out.Status = otlpStatus{Code: 2, Message: s.err.Error()} // STATUS_CODE_ERROR
+		}
+		ss.Spans = append(ss.Spans, out)
+	}
+
+	rs := otlpResourceSpans{
+		ScopeSpans: []otlpScopeSpans{ss},
+	}
+	rs.Resource.Attributes = keyValues(map[string]string{"service.name": e.serviceName})
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{rs},
+	}
+}
@@ -0,0 +1,265 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+// collector is an OTLP/HTTP collector that records the requests it
+// gets, and answers them with status.
+type collector struct {
+	t      *testing.T
+	status int
+
+	mu   sync.Mutex
+	reqs []*otlpRequest
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		c.t.Errorf("export to %s, want /v1/traces", r.URL.Path)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+		c.t.Errorf("export with content type %q, want application/json", ct)
+	}
+	bs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.t.Errorf("reading export: %s", err)
+		return
+	}
+	req := &otlpRequest{}
+	if err := json.Unmarshal(bs, req); err != nil {
+		c.t.Errorf("decoding export: %s", err)
+		return
+	}
+	c.mu.Lock()
+	c.reqs = append(c.reqs, req)
+	c.mu.Unlock()
+	w.WriteHeader(c.status)
+}
+
+func (c *collector) spans() [][]otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ret [][]otlpSpan
+	for _, req := range c.reqs {
+		var spans []otlpSpan
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+		ret = append(ret, spans)
+	}
+	return ret
+}
+
+func testSpan(name string) *Span {
+	return &Span{
+		traceID: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		spanID:  [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		name:    name,
+		start:   time.Unix(1, 500),
+		end:     time.Unix(2, 0),
+		attrs:   map[string]string{},
+	}
+}
+
+func TestEncode(t *testing.T) {
+	e := newOTLPExporter(log.NewNopLogger(), "http://collector:4318/", "metallb-controller")
+	if e.url != "http://collector:4318/v1/traces" {
+		t.Errorf("got URL %q, want http://collector:4318/v1/traces", e.url)
+	}
+
+	root := testSpan("controller.reconcile")
+	root.attrs = map[string]string{"service": "ns/svc", "result": "success"}
+	child := testSpan("ipam.ReserveIP")
+	child.spanID = [8]byte{8, 7, 6, 5, 4, 3, 2, 1}
+	child.parentID = root.spanID
+	child.err = errors.New("IPAM unreachable")
+
+	req := e.encode([]*Span{root, child})
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("spans not encoded in one resource and scope: %+v", req)
+	}
+	rs := req.ResourceSpans[0]
+	if diff := cmp.Diff(keyValues(map[string]string{"service.name": "metallb-controller"}), rs.Resource.Attributes); diff != "" {
+		t.Errorf("resource attributes (-want +got)\n%s", diff)
+	}
+	if got := rs.ScopeSpans[0].Scope.Name; got != "go.universe.tf/metallb" {
+		t.Errorf("got scope %q, want go.universe.tf/metallb", got)
+	}
+	want := []otlpSpan{
+		{
+			TraceID:           "0102030405060708090a0b0c0d0e0f10",
+			SpanID:            "0102030405060708",
+			Name:              "controller.reconcile",
+			Kind:              1,
+			StartTimeUnixNano: "1000000500",
+			EndTimeUnixNano:   "2000000000",
+			Attributes:        keyValues(map[string]string{"result": "success", "service": "ns/svc"}),
+			Status:            otlpStatus{Code: 1},
+		},
+		{
+			TraceID:           "0102030405060708090a0b0c0d0e0f10",
+			SpanID:            "0807060504030201",
+			ParentSpanID:      "0102030405060708",
+			Name:              "ipam.ReserveIP",
+			Kind:              1,
+			StartTimeUnixNano: "1000000500",
+			EndTimeUnixNano:   "2000000000",
+			Status:            otlpStatus{Code: 2, Message: "IPAM unreachable"},
+		},
+	}
+	if diff := cmp.Diff(want, rs.ScopeSpans[0].Spans); diff != "" {
+		t.Errorf("spans (-want +got)\n%s", diff)
+	}
+
+	// The JSON encoding uses the field names of the OTLP protobufs,
+	// with 64-bit integers as strings.
+	bs, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("encoding request: %s", err)
+	}
+	for _, field := range []string{`"resourceSpans"`, `"scopeSpans"`, `"traceId"`, `"parentSpanId"`, `"startTimeUnixNano":"1000000500"`, `"stringValue":"ns/svc"`} {
+		if !strings.Contains(string(bs), field) {
+			t.Errorf("encoded request has no %s: %s", field, bs)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c := &collector{t: t, status: http.StatusOK}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	e := newOTLPExporter(log.NewNopLogger(), srv.URL, "test")
+
+	// Nothing pending, nothing exported.
+	if err := e.flush(); err != nil {
+		t.Fatalf("flushing nothing: %s", err)
+	}
+	if len(c.spans()) != 0 {
+		t.Fatal("exported without spans")
+	}
+
+	// Pending spans are exported in one batch, once.
+	for _, name := range []string{"a", "b", "c"} {
+		e.add(testSpan(name))
+	}
+	if err := e.flush(); err != nil {
+		t.Fatalf("flushing: %s", err)
+	}
+	if err := e.flush(); err != nil {
+		t.Fatalf("flushing again: %s", err)
+	}
+	got := c.spans()
+	if len(got) != 1 {
+		t.Fatalf("got %d exports, want 1", len(got))
+	}
+	var names []string
+	for _, s := range got[0] {
+		names = append(names, s.Name)
+	}
+	if diff := cmp.Diff([]string{"a", "b", "c"}, names); diff != "" {
+		t.Errorf("exported spans (-want +got)\n%s", diff)
+	}
+
+	// Spans beyond the limit are dropped until the next flush.
+	for i := 0; i < maxPendingSpans+10; i++ {
+		e.add(testSpan("overflow"))
+	}
+	if e.dropped != 10 {
+		t.Errorf("dropped %d spans, want 10", e.dropped)
+	}
+	if err := e.flush(); err != nil {
+		t.Fatalf("flushing: %s", err)
+	}
+	if got := c.spans(); len(got) != 2 || len(got[1]) != maxPendingSpans {
+		t.Errorf("overflowing spans not capped at %d", maxPendingSpans)
+	}
+	if e.dropped != 0 || len(e.pending) != 0 {
+		t.Error("flush didn't reset the pending spans")
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	c := &collector{t: t, status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(c)
+	e := newOTLPExporter(log.NewNopLogger(), srv.URL, "test")
+
+	e.add(testSpan("a"))
+	err := e.flush()
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got error %v from a failing collector, want its status", err)
+	}
+	// Failed spans are dropped rather than piling up.
+	if len(e.pending) != 0 {
+		t.Errorf("%d spans still pending after a failed export", len(e.pending))
+	}
+
+	srv.Close()
+	e.add(testSpan("b"))
+	if err := e.flush(); err == nil {
+		t.Error("no error from an unreachable collector")
+	}
+}
+
+func TestStart(t *testing.T) {
+	if _, s := Start(context.Background(), "disabled"); s != nil {
+		t.Fatal("span recorded with tracing disabled")
+	}
+	var nilSpan *Span
+	nilSpan.SetAttributes("k", "v")
+	nilSpan.End(nil)
+	if nilSpan.TraceID() != "" {
+		t.Error("nil span has a trace ID")
+	}
+
+	c := &collector{t: t, status: http.StatusOK}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	mu.Lock()
+	exporter = newOTLPExporter(log.NewNopLogger(), srv.URL, "test")
+	e := exporter
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		exporter = nil
+		mu.Unlock()
+	}()
+
+	ctx, root := Start(context.Background(), "root", "service", "ns/svc", "dangling")
+	_, child := Start(ctx, "child")
+	if child.TraceID() != root.TraceID() || child.parentID != root.spanID {
+		t.Error("child span not in the trace of its parent")
+	}
+	if _, other := Start(context.Background(), "other"); other.TraceID() == root.TraceID() {
+		t.Error("unrelated span in the same trace")
+	}
+	if diff := cmp.Diff(map[string]string{"service": "ns/svc"}, root.attrs); diff != "" {
+		t.Errorf("root attributes (-want +got)\n%s", diff)
+	}
+	child.End(nil)
+	root.End(errors.New("failed"))
+	if err := e.flush(); err != nil {
+		t.Fatalf("flushing: %s", err)
+	}
+	got := c.spans()
+	if len(got) != 1 || len(got[0]) != 2 {
+		t.Fatalf("got exports %+v, want the 2 ended spans", got)
+	}
+	if got[0][1].Status.Code != 2 {
+		t.Errorf("failed span has status %+v", got[0][1].Status)
+	}
+}
@@ -0,0 +1,114 @@
+// Package tracing records spans for MetalLB's internal operations
+// and exports them to an OpenTelemetry collector using OTLP/HTTP with
+// JSON encoding.
+//
+// Tracing is disabled until Init is called, in which case Start
+// returns spans that record nothing, so instrumented code does not
+// need to check whether tracing is enabled.
+package tracing // import "go.universe.tf/metallb/internal/tracing"
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+type spanKey struct{}
+
+var (
+	mu       sync.Mutex
+	exporter *otlpExporter
+)
+
+// Init starts exporting spans to the OTLP/HTTP collector at
+// endpoint (e.g. "http://otel-collector:4318"), tagged with
+// serviceName.
+func Init(l log.Logger, endpoint, serviceName string) {
+	mu.Lock()
+	defer mu.Unlock()
+	exporter = newOTLPExporter(l, endpoint, serviceName)
+	go exporter.run()
+}
+
+// A Span times one operation. A nil *Span is valid and records
+// nothing.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+// Start begins a new span called name, as a child of the span in
+// ctx if there is one. attrs is a list of alternating keys and
+// values. The returned context carries the new span, for use by
+// nested operations.
+func Start(ctx context.Context, name string, attrs ...string) (context.Context, *Span) {
+	mu.Lock()
+	enabled := exporter != nil
+	mu.Unlock()
+	if !enabled {
+		return ctx, nil
+	}
+
+	s := &Span{
+		name:  name,
+		start: time.Now(),
+		attrs: map[string]string{},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	s.SetAttributes(attrs...)
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttributes records additional alternating key/value attributes
+// on the span.
+func (s *Span) SetAttributes(attrs ...string) {
+	if s == nil {
+		return
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+}
+
+// End finishes the span. If err is non-nil, the span is marked as
+// failed.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+
+	mu.Lock()
+	e := exporter
+	mu.Unlock()
+	if e != nil {
+		e.add(s)
+	}
+}
+
+// TraceID returns the hex encoded trace ID of the span, or "" for a
+// nil span. Useful to correlate logs with traces.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
@@ -0,0 +1,245 @@
+// Package allocator exposes MetalLB's IP address allocation logic
+// for embedding in other programs, with an API that is kept stable
+// across releases.
+//
+// An Allocator owns a set of address pools and hands out addresses
+// from them to named consumers ("services"). Several services can
+// share an address if they present the same sharing and backend keys
+// and use disjoint ports, following the rules MetalLB applies to
+// Kubernetes services with the metallb.universe.tf/allow-shared-ip
+// annotation.
+//
+// Pools backed by an external IPAM are not available through this
+// package. Importing it registers the allocator's Prometheus metrics
+// with the default registry.
+package allocator // import "go.universe.tf/metallb/pkg/allocator"
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+
+	"go.universe.tf/metallb/internal/allocator"
+	"go.universe.tf/metallb/internal/config"
+)
+
+// Family is an IP address family.
+type Family int
+
+// Address families.
+const (
+	IPv4 Family = iota
+	IPv6
+)
+
+// Pool is a set of addresses to allocate from.
+type Pool struct {
+	// Address ranges in the pool.
+	CIDRs []*net.IPNet
+	// If true, addresses ending in .0 or .255 are never handed out,
+	// since some consumer devices drop traffic to them.
+	AvoidBuggyIPs bool
+	// If true, Allocate may pick addresses from this pool. Otherwise
+	// only AllocateFromPool and Assign use it.
+	AutoAssign bool
+}
+
+// Port is a port used by a service on its address.
+type Port struct {
+	Proto string `json:"proto"`
+	Port  int    `json:"port"`
+}
+
+// Assignment is the address held by a service.
+type Assignment struct {
+	IP         net.IP `json:"ip"`
+	Ports      []Port `json:"ports,omitempty"`
+	SharingKey string `json:"sharingKey,omitempty"`
+	BackendKey string `json:"backendKey,omitempty"`
+}
+
+// Snapshot is the state of an Allocator, for persisting it or
+// moving it to another Allocator. It can be encoded as JSON.
+type Snapshot struct {
+	Assignments map[string]Assignment `json:"assignments"`
+}
+
+// PoolStatus describes the usage of a pool.
+type PoolStatus struct {
+	Name           string
+	Addresses      int64
+	AddressesInUse int64
+	Services       int
+	// Number of sharing keys in use by the services with addresses
+	// of the pool.
+	SharingGroups int
+}
+
+// An Allocator allocates addresses from pools. It is safe for
+// concurrent use.
+type Allocator struct {
+	mu    sync.Mutex
+	pools map[string]*config.Pool
+	a     *allocator.Allocator
+}
+
+// New returns an Allocator with no pools.
+func New() *Allocator {
+	return &Allocator{
+		pools: map[string]*config.Pool{},
+		a:     allocator.New(),
+	}
+}
+
+// SetPools replaces the pools of the allocator. It fails if an
+// address currently assigned would not belong to any of the new
+// pools.
+func (a *Allocator) SetPools(pools map[string]Pool) error {
+	cfg := map[string]*config.Pool{}
+	for name, p := range pools {
+		cfg[name] = &config.Pool{
+			CIDR:       p.CIDRs,
+			AutoAssign: p.AutoAssign,
+		}
+		if p.AvoidBuggyIPs {
+			cfg[name].ReservedHostSuffixes = config.ReserveEvery24
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.a.SetPools(cfg); err != nil {
+		return err
+	}
+	a.pools = cfg
+	return nil
+}
+
+// Assign assigns ip to svc, if the ip belongs to a pool and its
+// other users allow sharing with svc.
+func (a *Allocator) Assign(svc string, ip net.IP, ports []Port, sharingKey, backendKey string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.a.Assign(svc, ip, toInternal(ports), sharingKey, backendKey, "")
+}
+
+// Allocate assigns an available address of family from any pool
+// with AutoAssign to svc, and returns it. If svc already holds an
+// address, that address is returned.
+func (a *Allocator) Allocate(svc string, family Family, ports []Port, sharingKey, backendKey string) (net.IP, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.a.Allocate(context.Background(), log.NewNopLogger(), svc, family == IPv6, toInternal(ports), sharingKey, backendKey, "")
+}
+
+// AllocateFromPool is like Allocate, but only considers pool.
+func (a *Allocator) AllocateFromPool(svc, pool string, family Family, ports []Port, sharingKey, backendKey string) (net.IP, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.a.AllocateFromPool(context.Background(), log.NewNopLogger(), svc, family == IPv6, pool, toInternal(ports), sharingKey, backendKey, "")
+}
+
+// Release frees the address held by svc, and returns false if svc
+// held none.
+func (a *Allocator) Release(svc string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.a.Unassign(svc)
+}
+
+// IP returns the address held by svc, or nil.
+func (a *Allocator) IP(svc string) net.IP {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.a.IP(svc)
+}
+
+// Pool returns the pool of the address held by svc, or "".
+func (a *Allocator) Pool(svc string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.a.Pool(svc)
+}
+
+// Pools returns the usage of every pool, sorted by name.
+func (a *Allocator) Pools() []PoolStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ret []PoolStatus
+	for name := range a.pools {
+		addrs, inUse, svcs := a.a.PoolUsage(name)
+		ret = append(ret, PoolStatus{
+			Name:           name,
+			Addresses:      addrs,
+			AddressesInUse: inUse,
+			Services:       svcs,
+			SharingGroups:  a.a.SharingGroups(name),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// Snapshot returns the current assignments.
+func (a *Allocator) Snapshot() Snapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ret := Snapshot{Assignments: map[string]Assignment{}}
+	for svc, asg := range a.a.Assignments() {
+		ret.Assignments[svc] = Assignment{
+			IP:         asg.IP,
+			Ports:      fromInternal(asg.Ports),
+			SharingKey: asg.SharingKey,
+			BackendKey: asg.BackendKey,
+		}
+	}
+	return ret
+}
+
+// Restore replaces the current assignments with those of s, which
+// must fit the current pools. If any assignment fails, the
+// allocator is left unchanged.
+func (a *Allocator) Restore(s Snapshot) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	restored := allocator.New()
+	if err := restored.SetPools(a.pools); err != nil {
+		return err
+	}
+	// Restore in a stable order, so that conflicts in s are
+	// reported consistently.
+	svcs := make([]string, 0, len(s.Assignments))
+	for svc := range s.Assignments {
+		svcs = append(svcs, svc)
+	}
+	sort.Strings(svcs)
+	for _, svc := range svcs {
+		asg := s.Assignments[svc]
+		if err := restored.Assign(svc, asg.IP, toInternal(asg.Ports), asg.SharingKey, asg.BackendKey, ""); err != nil {
+			return fmt.Errorf("restoring %q: %s", svc, err)
+		}
+	}
+	a.a = restored
+	return nil
+}
+
+func toInternal(ports []Port) []allocator.Port {
+	var ret []allocator.Port
+	for _, p := range ports {
+		ret = append(ret, allocator.Port{Proto: p.Proto, Port: p.Port})
+	}
+	return ret
+}
+
+func fromInternal(ports []allocator.Port) []Port {
+	var ret []Port
+	for _, p := range ports {
+		ret = append(ret, Port{Proto: p.Proto, Port: p.Port})
+	}
+	return ret
+}
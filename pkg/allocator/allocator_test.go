@@ -0,0 +1,153 @@
+package allocator
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// The signatures below are part of the stable API. Changing any of
+// them breaks embedders, and must fail this test's compilation.
+var (
+	_ func() *Allocator                                                                = New
+	_ func(*Allocator, map[string]Pool) error                                          = (*Allocator).SetPools
+	_ func(*Allocator, string, net.IP, []Port, string, string) error                   = (*Allocator).Assign
+	_ func(*Allocator, string, Family, []Port, string, string) (net.IP, error)         = (*Allocator).Allocate
+	_ func(*Allocator, string, string, Family, []Port, string, string) (net.IP, error) = (*Allocator).AllocateFromPool
+	_ func(*Allocator, string) bool                                                    = (*Allocator).Release
+	_ func(*Allocator, string) net.IP                                                  = (*Allocator).IP
+	_ func(*Allocator, string) string                                                  = (*Allocator).Pool
+	_ func(*Allocator) []PoolStatus                                                    = (*Allocator).Pools
+	_ func(*Allocator) Snapshot                                                        = (*Allocator).Snapshot
+	_ func(*Allocator, Snapshot) error                                                 = (*Allocator).Restore
+)
+
+func ipnet(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func newTestAllocator(t *testing.T) *Allocator {
+	a := New()
+	if err := a.SetPools(map[string]Pool{
+		"auto": {
+			CIDRs:      []*net.IPNet{ipnet("1.2.3.0/31"), ipnet("1000::/127")},
+			AutoAssign: true,
+		},
+		"manual": {
+			CIDRs: []*net.IPNet{ipnet("1.2.4.0/30")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	return a
+}
+
+func TestAllocate(t *testing.T) {
+	a := newTestAllocator(t)
+
+	ip, err := a.Allocate("s1", IPv4, nil, "", "")
+	if err != nil {
+		t.Fatalf("Allocate s1: %s", err)
+	}
+	if a.Pool("s1") != "auto" || !a.IP("s1").Equal(ip) {
+		t.Errorf("s1 got %s from %q, want an IP from \"auto\"", a.IP("s1"), a.Pool("s1"))
+	}
+
+	ip6, err := a.Allocate("s2", IPv6, nil, "", "")
+	if err != nil {
+		t.Fatalf("Allocate s2: %s", err)
+	}
+	if ip6.To4() != nil {
+		t.Errorf("s2 got %s, want an IPv6 address", ip6)
+	}
+
+	// Sharing an IP needs matching keys and disjoint ports.
+	web := []Port{{Proto: "TCP", Port: 80}}
+	if err := a.Assign("s3", net.ParseIP("1.2.4.1"), web, "share", ""); err != nil {
+		t.Fatalf("Assign s3: %s", err)
+	}
+	if err := a.Assign("s4", net.ParseIP("1.2.4.1"), web, "share", ""); err == nil {
+		t.Error("s4 shares a port with s3")
+	}
+	if err := a.Assign("s4", net.ParseIP("1.2.4.1"), []Port{{Proto: "TCP", Port: 443}}, "other", ""); err == nil {
+		t.Error("s4 shares an IP with a different sharing key")
+	}
+	if err := a.Assign("s4", net.ParseIP("1.2.4.1"), []Port{{Proto: "TCP", Port: 443}}, "share", ""); err != nil {
+		t.Errorf("s4 can't share with s3: %s", err)
+	}
+
+	if _, err := a.AllocateFromPool("s5", "manual", IPv6, nil, "", ""); err == nil {
+		t.Error("allocated IPv6 from an IPv4 pool")
+	}
+
+	if !a.Release("s1") || a.IP("s1") != nil {
+		t.Error("s1 not released")
+	}
+	if a.Release("s1") {
+		t.Error("s1 released twice")
+	}
+}
+
+func TestPools(t *testing.T) {
+	a := newTestAllocator(t)
+	if _, err := a.Allocate("s1", IPv4, nil, "", ""); err != nil {
+		t.Fatalf("Allocate: %s", err)
+	}
+	want := []PoolStatus{
+		{Name: "auto", Addresses: 4, AddressesInUse: 1, Services: 1},
+		{Name: "manual", Addresses: 4},
+	}
+	if diff := cmp.Diff(want, a.Pools()); diff != "" {
+		t.Errorf("unexpected pool status (-want +got)\n%s", diff)
+	}
+
+	if err := a.SetPools(map[string]Pool{"manual": {CIDRs: []*net.IPNet{ipnet("1.2.4.0/30")}}}); err == nil {
+		t.Error("SetPools dropped the pool of an assigned IP")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	a := newTestAllocator(t)
+	if _, err := a.Allocate("s1", IPv4, []Port{{Proto: "TCP", Port: 80}}, "share", "backend"); err != nil {
+		t.Fatalf("Allocate: %s", err)
+	}
+	if err := a.Assign("s2", net.ParseIP("1.2.4.2"), nil, "", ""); err != nil {
+		t.Fatalf("Assign: %s", err)
+	}
+
+	// Snapshots survive JSON encoding.
+	bs, err := json.Marshal(a.Snapshot())
+	if err != nil {
+		t.Fatalf("encoding snapshot: %s", err)
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(bs, &snap); err != nil {
+		t.Fatalf("decoding snapshot: %s", err)
+	}
+
+	b := newTestAllocator(t)
+	if err := b.Restore(snap); err != nil {
+		t.Fatalf("Restore: %s", err)
+	}
+	if diff := cmp.Diff(a.Snapshot(), b.Snapshot()); diff != "" {
+		t.Errorf("restored state differs (-orig +restored)\n%s", diff)
+	}
+	if diff := cmp.Diff(a.Pools(), b.Pools()); diff != "" {
+		t.Errorf("restored pool usage differs (-orig +restored)\n%s", diff)
+	}
+
+	// A failed restore leaves the allocator alone.
+	snap.Assignments["s3"] = Assignment{IP: net.ParseIP("9.9.9.9")}
+	if err := b.Restore(snap); err == nil {
+		t.Fatal("restored an IP outside all pools")
+	}
+	if b.IP("s1") == nil || b.IP("s3") != nil {
+		t.Errorf("failed restore changed state: %v", b.Snapshot())
+	}
+}
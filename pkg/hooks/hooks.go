@@ -0,0 +1,83 @@
+// Package hooks lets integrations act on the IP MetalLB assigns to a
+// service before the service's status publishes it, for example to
+// register the IP with a firewall, DNS or a scrubbing service ahead
+// of the first packet.
+//
+// In-process hooks call Register from an init function and are
+// enabled by name with the controller's --allocation-hooks flag.
+// Building them in takes a controller binary that imports their
+// package. Out-of-process integrations use Webhook, which the
+// controller's --allocation-webhook flag enables.
+package hooks // import "go.universe.tf/metallb/pkg/hooks"
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Allocation is an IP newly assigned to a service.
+type Allocation struct {
+	// Namespace and name of the service, as "namespace/name".
+	Service string `json:"service"`
+	// The assigned IP.
+	IP net.IP `json:"ip"`
+	// Name of the address pool the IP belongs to.
+	Pool string `json:"pool"`
+}
+
+// A Hook is called for each IP assigned to a service, before the
+// service's status is updated with it.
+type Hook interface {
+	// Allocated prepares for traffic to a.IP. If it returns an
+	// error, the status is not updated and the service is retried
+	// later, possibly with the same IP, so Allocated must be
+	// idempotent.
+	Allocated(ctx context.Context, a Allocation) error
+}
+
+// HookFunc adapts a function to the Hook interface.
+type HookFunc func(ctx context.Context, a Allocation) error
+
+// Allocated calls f(ctx, a).
+func (f HookFunc) Allocated(ctx context.Context, a Allocation) error {
+	return f(ctx, a)
+}
+
+var (
+	mu    sync.Mutex
+	hooks = map[string]Hook{}
+)
+
+// Register makes h available under name. It panics if name is
+// already registered.
+func Register(name string, h Hook) {
+	mu.Lock()
+	defer mu.Unlock()
+	if h == nil {
+		panic("hooks: Register hook is nil")
+	}
+	if _, dup := hooks[name]; dup {
+		panic("hooks: Register called twice for hook " + name)
+	}
+	hooks[name] = h
+}
+
+// Lookup returns the hook registered under name.
+func Lookup(name string) (Hook, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	h, ok := hooks[name]
+	if !ok {
+		var names []string
+		for n := range hooks {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown allocation hook %q, registered hooks are %q", name, strings.Join(names, ","))
+	}
+	return h, nil
+}
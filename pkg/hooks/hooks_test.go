@@ -0,0 +1,74 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	var got Allocation
+	Register("test", HookFunc(func(ctx context.Context, a Allocation) error {
+		got = a
+		return nil
+	}))
+
+	h, err := Lookup("test")
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	want := Allocation{Service: "default/foo", IP: net.ParseIP("1.2.3.4"), Pool: "pool1"}
+	if err := h.Allocated(context.Background(), want); err != nil {
+		t.Fatalf("hook failed: %s", err)
+	}
+	if got.Service != want.Service || !got.IP.Equal(want.IP) || got.Pool != want.Pool {
+		t.Errorf("hook got %+v, want %+v", got, want)
+	}
+
+	if _, err := Lookup("nope"); err == nil {
+		t.Error("Lookup of unregistered hook succeeded")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a hook twice didn't panic")
+		}
+	}()
+	Register("test", HookFunc(func(context.Context, Allocation) error { return nil }))
+}
+
+func TestWebhook(t *testing.T) {
+	status := http.StatusOK
+	var got Allocation
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("got method %s, want POST", r.Method)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer s3cret" {
+			t.Errorf("got Authorization %q", auth)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding request: %s", err)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("scrubber not ready\n"))
+	}))
+	defer srv.Close()
+
+	w := &Webhook{URL: srv.URL, Token: "s3cret"}
+	a := Allocation{Service: "default/foo", IP: net.ParseIP("2001:db8::1"), Pool: "pool1"}
+	if err := w.Allocated(context.Background(), a); err != nil {
+		t.Fatalf("webhook failed: %s", err)
+	}
+	if got.Service != a.Service || !got.IP.Equal(a.IP) || got.Pool != a.Pool {
+		t.Errorf("webhook got %+v, want %+v", got, a)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := w.Allocated(context.Background(), a); err == nil {
+		t.Error("webhook succeeded on 503")
+	}
+}
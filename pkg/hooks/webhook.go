@@ -0,0 +1,56 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Webhook is a Hook that POSTs each Allocation as a JSON object to an
+// HTTP endpoint. The hook fails unless the endpoint answers with a
+// 2xx status.
+type Webhook struct {
+	// URL to POST allocations to.
+	URL string
+	// If not empty, sent as a bearer token in the Authorization
+	// header.
+	Token string
+	// Client to send requests with, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Allocated implements Hook.
+func (w *Webhook) Allocated(ctx context.Context, a Allocation) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if w.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.Token)
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -15,12 +15,15 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"go.universe.tf/metallb/internal/bgp"
@@ -29,57 +32,234 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+var peerInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "metallb",
+	Subsystem: "speaker",
+	Name:      "bgp_peer_info",
+	Help:      "Information about the BGP peers this speaker has a session with, always 1. The peer label matches the BGP session metrics",
+}, []string{
+	"peer",
+	"description",
+})
+
+var prefixesHeld = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "metallb",
+	Subsystem: "speaker",
+	Name:      "bgp_prefixes_held",
+	Help:      "Prefixes held back from BGP peers to stay within prefix limits. The peer label matches the BGP session metrics, and is empty for the node's limit",
+}, []string{
+	"peer",
+})
+
+func init() {
+	prometheus.MustRegister(peerInfo)
+	prometheus.MustRegister(prefixesHeld)
+}
+
+// endpointBandwidth is the link bandwidth advertised per ready
+// endpoint with config.LinkBandwidthWeight, 1Gbps in bytes per second.
+const endpointBandwidth = 125e6
+
 type peer struct {
 	cfg *config.Peer
 	bgp session
+	// The advertisements last given to bgp, by prefix, so that only
+	// changes are passed on to it.
+	ads map[string]*bgp.Advertisement
+	// The local address bgp connects from, for peers bound to a
+	// secondary network.
+	srcAddr net.IP
+	// The discovered link-local address of an unnumbered peer
+	// configured without one.
+	linkLocal net.IP
+	// The local ASN of the session, read from this node's labels for
+	// peers with MyASNLabel.
+	myASN uint32
+	// Prefixes held back from the session by MaxPrefixes.
+	held int
 }
 
 type bgpController struct {
 	logger     log.Logger
 	myNode     string
 	nodeLabels labels.Set
-	peers      []*peer
-	svcAds     map[string][]*bgp.Advertisement
+	// This node's pod CIDR, for peers with AnnouncePodCIDR. nil if
+	// the node has none.
+	podCIDR *net.IPNet
+	peers   []*peer
+	svcAds  map[string][]*bgp.Advertisement
+	// Node selectors of the advertisements in svcAds that are not
+	// originated from every node.
+	adNodes map[*bgp.Advertisement][]labels.Selector
+	// Services with advertisements or a blackhole route for each
+	// prefix, and the prefixes of each service, so that a change to
+	// one service only revisits the prefixes it touches.
+	prefixSvcs  map[string]map[string]bool
+	svcPrefixes map[string][]string
+	// Set when passing on a single service's change failed, so that
+	// the next change resyncs everything.
+	resync bool
+	// Aggregate prefixes currently being originated, so that we can
+	// log when the last service inside an aggregate goes away.
+	aggregates map[string]bool
+	// Nodes with ready endpoints of each service, as of the last
+	// ShouldAnnounce, which always precedes SetBalancer. They elect
+	// the originators of aggregates with AggregateOriginators.
+	endpointNodes map[string][]string
+	// canOriginate returns true if node runs a speaker that may
+	// originate aggregates of pool, nil for services without a pool.
+	// Only those nodes take part in the election. nil accepts every
+	// node.
+	canOriginate func(node string, pool *config.Pool) bool
+	// Ready endpoints of each service, as of the last ShouldAnnounce,
+	// for advertisements with an EndpointWeight.
+	endpointCounts map[string]endpointCount
+	// Services in svcAds announced with SetBalancer, to redo their
+	// advertisements when the configuration changes.
+	announcedSvcs map[string]announcedSvc
+	// Blackhole advertisements of services under attack, by service
+	// name. Protected by blackholeMu, as the expiry ticker reads it
+	// outside the sync goroutine.
+	blackholeMu sync.Mutex
+	blackholes  map[string]blackhole
+
+	// Host interfaces of the secondary networks peers may be bound
+	// to.
+	networks networkInterfaces
+
+	// Most prefixes this node advertises, zero for no limit, the
+	// prefixes within it, and how many more are held back.
+	maxPrefixes int
+	originated  map[string]bool
+	held        int
+
+	// Snapshot of the sessions that should be running on this node,
+	// for readiness checks which run outside the sync goroutine.
+	sessionsMu sync.Mutex
+	sessions   []session
+}
+
+// announcedSvc is a service announced over BGP, and its IP.
+type announcedSvc struct {
+	svc *v1.Service
+	ip  net.IP
+}
+
+// blackhole is the blackhole advertisement of a service, and when it
+// ends.
+type blackhole struct {
+	ad    *bgp.Advertisement
+	until time.Time
 }
 
 func (c *bgpController) SetConfig(l log.Logger, cfg *config.Config) error {
-	newPeers := make([]*peer, 0, len(cfg.Peers))
-newPeers:
-	for _, p := range cfg.Peers {
-		for i, ep := range c.peers {
-			if ep == nil {
-				continue
-			}
-			if reflect.DeepEqual(p, ep.cfg) {
-				newPeers = append(newPeers, ep)
-				c.peers[i] = nil
-				continue newPeers
+	newPeers := make([]*peer, len(cfg.Peers))
+	// Unchanged peers keep their sessions. Peers whose session
+	// settings are unchanged do as well, but may now get other
+	// advertisements.
+	for i, p := range cfg.Peers {
+		if ep := c.takePeer(p, func(a, b *config.Peer) bool { return reflect.DeepEqual(a, b) }); ep != nil {
+			newPeers[i] = ep
+		}
+	}
+	updateAds := false
+	for i, p := range cfg.Peers {
+		if newPeers[i] != nil {
+			continue
+		}
+		ep := c.takePeer(p, sameSession)
+		if ep == nil {
+			// No existing peers match, create a new one.
+			newPeers[i] = &peer{
+				cfg: p,
 			}
+			continue
 		}
-		// No existing peers match, create a new one.
-		newPeers = append(newPeers, &peer{
-			cfg: p,
-		})
+		l.Log("event", "peerUpdated", "peer", p.Host(), "description", p.Description, "msg", "peer reconfigured, keeping BGP session")
+		if ep.bgp != nil {
+			// The description labels the peer's info metric.
+			ep.deleteInfo()
+			peerInfo.WithLabelValues(ep.addr(), p.Description).Set(1)
+		}
+		ep.cfg = p
+		updateAds = true
+		newPeers[i] = ep
 	}
 
 	oldPeers := c.peers
 	c.peers = newPeers
 
+	// Redo the advertisements of announced services right away, so
+	// that peers get the changed attributes of all of them in one
+	// pass, as updates replacing the previous routes. Services no
+	// longer announced over BGP are withdrawn when reprocessed.
+	for name, a := range c.announcedSvcs {
+		pool := cfg.Pools[poolFor(cfg.Pools, a.ip)]
+		if pool == nil {
+			continue
+		}
+		if protos, _ := pool.ServiceProtocols(a.svc.Annotations); !protoIn(protos, config.BGP) {
+			continue
+		}
+		c.setAds(l, name, a.svc, a.ip, pool)
+		updateAds = true
+	}
+
 	for _, p := range oldPeers {
 		if p == nil {
 			continue
 		}
-		l.Log("event", "peerRemoved", "peer", p.cfg.Addr, "reason", "removedFromConfig", "msg", "peer deconfigured, closing BGP session")
+		l.Log("event", "peerRemoved", "peer", p.cfg.Host(), "description", p.cfg.Description, "reason", "removedFromConfig", "msg", "peer deconfigured, closing BGP session")
 		if p.bgp != nil {
-			if err := p.bgp.Close(); err != nil {
-				l.Log("op", "setConfig", "error", err, "peer", p.cfg.Addr, "msg", "failed to shut down BGP session")
+			if err := p.bgp.Shutdown(c.shutdownMsg("peer deconfigured")); err != nil {
+				l.Log("op", "setConfig", "error", err, "peer", p.cfg.Host(), "msg", "failed to shut down BGP session")
 			}
+			p.deleteInfo()
 		}
 	}
 
-	return c.syncPeers(l)
+	err := c.syncPeers(l)
+	if updateAds {
+		// Kept sessions may need other advertisements, even if
+		// other sessions failed to start, and so may changed
+		// services.
+		if uerr := c.updateAds(l); err == nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
+// takePeer removes the first peer that match says is equivalent to p
+// from c.peers and returns it, or nil if there is none.
+func (c *bgpController) takePeer(p *config.Peer, match func(a, b *config.Peer) bool) *peer {
+	for i, ep := range c.peers {
+		if ep != nil && match(p, ep.cfg) {
+			c.peers[i] = nil
+			return ep
+		}
+	}
+	return nil
+}
+
+// sameSession returns true if peers a and b only differ in settings
+// that don't affect their BGP session, like which advertisements they
+// get or where it runs, so that the session can be kept when a
+// changes into b.
+func sameSession(a, b *config.Peer) bool {
+	pa, pb := *a, *b
+	for _, p := range []*config.Peer{&pa, &pb} {
+		p.NodeSelectors = nil
+		p.CommunityFilter = nil
+		p.AnnouncePodCIDR = false
+		p.Description = ""
+		p.RTBH = false
+		p.MaxPrefixes = 0
+	}
+	return reflect.DeepEqual(pa, pb)
 }
 
 // nodeHasHealthyEndpoint return true if this node has at least one healthy endpoint.
@@ -111,6 +291,44 @@ func nodeHasHealthyEndpoint(eps *v1.Endpoints, node string) bool {
 	return false
 }
 
+// endpointCount is how many ready endpoints of a service run on this
+// node, and in total.
+type endpointCount struct {
+	local, total int
+}
+
+// countEndpoints counts the fully ready endpoints of eps, and those on
+// node.
+func countEndpoints(eps *v1.Endpoints, node string) endpointCount {
+	ready := map[string]bool{}
+	local := map[string]bool{}
+	for _, subset := range eps.Subsets {
+		for _, ep := range subset.Addresses {
+			if _, ok := ready[ep.IP]; !ok {
+				ready[ep.IP] = true
+			}
+			if ep.NodeName != nil && *ep.NodeName == node {
+				local[ep.IP] = true
+			}
+		}
+		for _, ep := range subset.NotReadyAddresses {
+			ready[ep.IP] = false
+		}
+	}
+
+	var ret endpointCount
+	for ip, r := range ready {
+		if !r {
+			continue
+		}
+		ret.total++
+		if local[ip] {
+			ret.local++
+		}
+	}
+	return ret
+}
+
 func healthyEndpointExists(eps *v1.Endpoints) bool {
 	ready := map[string]bool{}
 	for _, subset := range eps.Subsets {
@@ -143,16 +361,28 @@ func (c *bgpController) ShouldAnnounce(l log.Logger, name string, svc *v1.Servic
 	// or
 	//  Local && there's a ready local endpoint.
 	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal && !nodeHasHealthyEndpoint(eps, c.myNode) {
+		delete(c.endpointNodes, name)
+		delete(c.endpointCounts, name)
 		return "noLocalEndpoints"
 	} else if !healthyEndpointExists(eps) {
+		delete(c.endpointNodes, name)
+		delete(c.endpointCounts, name)
 		return "noEndpoints"
 	}
+	if c.endpointNodes == nil {
+		c.endpointNodes = map[string][]string{}
+		c.endpointCounts = map[string]endpointCount{}
+	}
+	c.endpointNodes[name] = usableNodes(eps)
+	c.endpointCounts[name] = countEndpoints(eps, c.myNode)
 	return ""
 }
 
 // Called when either the peer list or node labels have changed,
 // implying that the set of running BGP sessions may need tweaking.
 func (c *bgpController) syncPeers(l log.Logger) error {
+	defer c.snapshotSessions()
+
 	var (
 		errs          int
 		needUpdateAds bool
@@ -168,35 +398,115 @@ func (c *bgpController) syncPeers(l log.Logger) error {
 			}
 		}
 
+		stopReason, stopMsg := "filteredByNodeSelector", "node no longer selected for this peer"
+
+		// Peers on a secondary network are reached from this node's
+		// address on it. Sessions from a stale address are restarted.
+		var (
+			srcAddr net.IP
+			restart bool
+		)
+		if shouldRun && p.cfg.Network != nil {
+			var err error
+			if srcAddr, err = c.sourceAddress(p.cfg); err != nil {
+				l.Log("op", "syncPeers", "error", err, "peer", p.cfg.Host(), "network", p.cfg.Network, "msg", "no source address on the peer's network, not running BGP session")
+				errs++
+				shouldRun = false
+				stopReason, stopMsg = "noSourceAddress", "no address on the peer's network"
+			} else if p.bgp != nil && !p.srcAddr.Equal(srcAddr) {
+				restart = true
+				stopReason, stopMsg = "sourceAddressChanged", "source address changed"
+			}
+		}
+
+		// Unnumbered peers without an address are dialed at the
+		// link-local address of the router on their interface. The
+		// router is only looked for while there is no established
+		// session, since soliciting it blocks, and sessions to a
+		// router that went away are restarted. Failing to find it
+		// never stops a session, the last known address is kept.
+		linkLocal := p.linkLocal
+		if shouldRun && p.cfg.Interface != "" && p.cfg.Addr == nil && (p.bgp == nil || !p.bgp.Established()) {
+			found, err := linkLocalRouter(p.cfg.Interface)
+			switch {
+			case err == nil:
+				linkLocal = found
+				if p.bgp != nil && !p.linkLocal.Equal(linkLocal) {
+					restart = true
+					stopReason, stopMsg = "peerAddressChanged", "peer address changed"
+				}
+			case linkLocal != nil:
+				l.Log("op", "syncPeers", "error", err, "peer", p.cfg.Host(), "address", linkLocal, "msg", "no router found on the peer's interface, using its last known address")
+			default:
+				l.Log("op", "syncPeers", "error", err, "peer", p.cfg.Host(), "msg", "no router found on the peer's interface, not running BGP session")
+				errs++
+				shouldRun = false
+				stopReason, stopMsg = "noPeerAddress", "no router on the peer's interface"
+			}
+		}
+
+		// Peers with a per-node ASN read it from this node's labels.
+		// Sessions opened with a stale ASN are restarted.
+		myASN := p.cfg.MyASN
+		if shouldRun && p.cfg.MyASNLabel != "" {
+			var err error
+			if myASN, err = config.ParseASN(c.nodeLabels[p.cfg.MyASNLabel]); err != nil {
+				l.Log("op", "syncPeers", "error", err, "peer", p.cfg.Host(), "label", p.cfg.MyASNLabel, "msg", "no local ASN in node label, not running BGP session")
+				errs++
+				shouldRun = false
+				stopReason, stopMsg = "noLocalASN", "no local ASN in node label"
+			} else if p.bgp != nil && p.myASN != myASN {
+				restart = true
+				stopReason, stopMsg = "localASNChanged", "local ASN changed"
+			}
+		}
+
 		// Now, compare current state to intended state, and correct.
-		if p.bgp != nil && !shouldRun {
+		if p.bgp != nil && (!shouldRun || restart) {
 			// Oops, session is running but shouldn't be. Shut it down.
-			l.Log("event", "peerRemoved", "peer", p.cfg.Addr, "reason", "filteredByNodeSelector", "msg", "peer deconfigured, closing BGP session")
-			if err := p.bgp.Close(); err != nil {
-				l.Log("op", "syncPeers", "error", err, "peer", p.cfg.Addr, "msg", "failed to shut down BGP session")
+			l.Log("event", "peerRemoved", "peer", p.cfg.Host(), "description", p.cfg.Description, "reason", stopReason, "msg", "peer deconfigured, closing BGP session")
+			if err := p.bgp.Shutdown(c.shutdownMsg(stopMsg)); err != nil {
+				l.Log("op", "syncPeers", "error", err, "peer", p.cfg.Host(), "msg", "failed to shut down BGP session")
 			}
+			p.deleteInfo()
 			p.bgp = nil
-		} else if p.bgp == nil && shouldRun {
+			p.ads = nil
+		}
+		if p.bgp == nil && shouldRun {
 			// Session doesn't exist, but should be running. Create
 			// it.
-			l.Log("event", "peerAdded", "peer", p.cfg.Addr, "msg", "peer configured, starting BGP session")
+			l.Log("event", "peerAdded", "peer", p.cfg.Host(), "description", p.cfg.Description, "msg", "peer configured, starting BGP session")
 			var routerID net.IP
 			if p.cfg.RouterID != nil {
 				routerID = p.cfg.RouterID
 			}
-			s, err := newBGP(c.logger, net.JoinHostPort(p.cfg.Addr.String(), strconv.Itoa(int(p.cfg.Port))), p.cfg.MyASN, routerID, p.cfg.ASN, p.cfg.HoldTime, p.cfg.Password, c.myNode)
+			logger := c.logger
+			if p.cfg.Description != "" {
+				logger = log.With(logger, "description", p.cfg.Description)
+			}
+			p.linkLocal = linkLocal
+			opts := bgp.SessionOptions{
+				SourcePorts:   bgp.PortRange{Min: p.cfg.SourcePorts.Min, Max: p.cfg.SourcePorts.Max},
+				SourceAddress: srcAddr,
+				Socket:        socketOptions(p.cfg),
+			}
+			s, err := newBGP(logger, p.addr(), myASN, routerID, p.cfg.ASN, p.cfg.HoldTime, p.cfg.Password, c.myNode, opts)
 			if err != nil {
-				l.Log("op", "syncPeers", "error", err, "peer", p.cfg.Addr, "msg", "failed to create BGP session")
+				l.Log("op", "syncPeers", "error", err, "peer", p.cfg.Host(), "msg", "failed to create BGP session")
 				errs++
 			} else {
 				p.bgp = s
+				p.ads = map[string]*bgp.Advertisement{}
+				p.srcAddr = srcAddr
+				p.myASN = myASN
+				peerInfo.WithLabelValues(p.addr(), p.cfg.Description).Set(1)
 				needUpdateAds = true
 			}
 		}
 	}
 	if needUpdateAds {
 		// Some new sessions came up, resync advertisement state.
-		if err := c.updateAds(); err != nil {
+		if err := c.updateAds(l); err != nil {
 			l.Log("op", "updateAds", "error", err, "msg", "failed to update BGP advertisements")
 			return err
 		}
@@ -207,9 +517,101 @@ func (c *bgpController) syncPeers(l log.Logger) error {
 	return nil
 }
 
-func (c *bgpController) SetBalancer(l log.Logger, name string, lbIP net.IP, pool *config.Pool) error {
-	c.svcAds[name] = nil
-	for _, adCfg := range pool.BGPAdvertisements {
+func (c *bgpController) SetBalancer(l log.Logger, name string, svc *v1.Service, lbIP net.IP, pool *config.Pool) error {
+	c.setAds(l, name, svc, lbIP, pool)
+	c.setBlackhole(l, name, svc, lbIP)
+
+	if err := c.updateSvcAds(l, name); err != nil {
+		return err
+	}
+
+	l.Log("event", "updatedAdvertisements", "numAds", len(c.svcAds[name]), "msg", "making advertisements using BGP")
+
+	return nil
+}
+
+// setAds makes the advertisements of svc, announced at lbIP from
+// pool, without passing them on to the peers.
+func (c *bgpController) setAds(l log.Logger, name string, svc *v1.Service, lbIP net.IP, pool *config.Pool) {
+	c.forgetAds(name)
+	ads := c.makeAds(lbIP, pool.BGPAdvertisements, c.originatorCandidates(c.endpointNodes[name], pool), c.endpointCounts[name])
+	// The controller reports invalid overrides on the service, so
+	// just announce with the pool's attributes.
+	overrides, err := pool.ServiceBGPOverrides(svc.Annotations)
+	if err != nil {
+		l.Log("op", "setBalancer", "error", err, "msg", "ignoring invalid BGP attribute overrides")
+	}
+	for _, ad := range ads {
+		if overrides.LocalPref != nil {
+			ad.LocalPref = *overrides.LocalPref
+		}
+		if overrides.MED != nil {
+			ad.MED = *overrides.MED
+		}
+	}
+	c.svcAds[name] = ads
+	if c.announcedSvcs == nil {
+		c.announcedSvcs = map[string]announcedSvc{}
+	}
+	c.announcedSvcs[name] = announcedSvc{svc, lbIP}
+}
+
+// setBlackhole records whether svc currently asks for lbIP to be
+// blackholed, see config.BlackholeAnnotation.
+func (c *bgpController) setBlackhole(l log.Logger, name string, svc *v1.Service, lbIP net.IP) {
+	c.blackholeMu.Lock()
+	defer c.blackholeMu.Unlock()
+
+	_, active := c.blackholes[name]
+	// Durations that the controller hasn't turned into an end time
+	// yet don't parse, and are picked up once it has.
+	until, err := time.Parse(time.RFC3339, svc.Annotations[config.BlackholeAnnotation])
+	if err != nil || !timeNow().Before(until) {
+		if active {
+			l.Log("event", "blackholeEnded", "msg", "no longer advertising blackhole route")
+			delete(c.blackholes, name)
+		}
+		return
+	}
+
+	if !active {
+		l.Log("event", "blackholeStarted", "until", until, "msg", "advertising blackhole route")
+	}
+	if c.blackholes == nil {
+		c.blackholes = map[string]blackhole{}
+	}
+	c.blackholes[name] = blackhole{
+		ad: &bgp.Advertisement{
+			Prefix: &net.IPNet{
+				IP:   lbIP,
+				Mask: net.CIDRMask(32, 32),
+			},
+			Communities: []uint32{bgp.BlackholeCommunity, bgp.NoExportCommunity},
+		},
+		until: until,
+	}
+}
+
+// blackholesExpired returns true if any blackhole ended before now,
+// meaning the blackholed services need reprocessing.
+func (c *bgpController) blackholesExpired(now time.Time) bool {
+	c.blackholeMu.Lock()
+	defer c.blackholeMu.Unlock()
+	for _, bh := range c.blackholes {
+		if !now.Before(bh.until) {
+			return true
+		}
+	}
+	return false
+}
+
+// makeAds translates lbIP into advertisements according to adCfgs.
+// nodes are the candidates to originate aggregates with
+// AggregateOriginators, and eps weights advertisements with an
+// EndpointWeight.
+func (c *bgpController) makeAds(lbIP net.IP, adCfgs []*config.BGPAdvertisement, nodes []string, eps endpointCount) []*bgp.Advertisement {
+	var ret []*bgp.Advertisement
+	for _, adCfg := range adCfgs {
 		m := net.CIDRMask(adCfg.AggregationLength, 32)
 		ad := &bgp.Advertisement{
 			Prefix: &net.IPNet{
@@ -218,74 +620,706 @@ func (c *bgpController) SetBalancer(l log.Logger, name string, lbIP net.IP, pool
 			},
 			LocalPref: adCfg.LocalPref,
 		}
+		if adCfg.AggregateOriginators > 0 && !c.designatedOriginator(ad.Prefix, nodes, adCfg.AggregateOriginators) {
+			continue
+		}
 		for comm := range adCfg.Communities {
 			ad.Communities = append(ad.Communities, comm)
 		}
 		sort.Slice(ad.Communities, func(i, j int) bool { return ad.Communities[i] < ad.Communities[j] })
-		c.svcAds[name] = append(c.svcAds[name], ad)
+		for comm := range adCfg.ExtendedCommunities {
+			ad.ExtendedCommunities = append(ad.ExtendedCommunities, comm)
+		}
+		switch adCfg.EndpointWeight {
+		case config.LinkBandwidthWeight:
+			// Receivers only look at the bandwidth, not the AS.
+			ad.ExtendedCommunities = append(ad.ExtendedCommunities, bgp.LinkBandwidthCommunity(0, float32(eps.local)*endpointBandwidth))
+		case config.MEDWeight:
+			ad.MED = uint32(eps.total - eps.local)
+		}
+		sort.Slice(ad.ExtendedCommunities, func(i, j int) bool { return ad.ExtendedCommunities[i] < ad.ExtendedCommunities[j] })
+		if len(adCfg.NodeSelectors) > 0 {
+			if c.adNodes == nil {
+				c.adNodes = map[*bgp.Advertisement][]labels.Selector{}
+			}
+			c.adNodes[ad] = adCfg.NodeSelectors
+		}
+		ret = append(ret, ad)
 	}
+	return ret
+}
 
-	if err := c.updateAds(); err != nil {
-		return err
+func (c *bgpController) updateAds(l log.Logger) error {
+	// Iterate over services in a stable order, so that when several
+	// services roll up into the same aggregate, the same one always
+	// provides the aggregate's attributes.
+	svcs := make([]string, 0, len(c.svcAds))
+	for svc := range c.svcAds {
+		svcs = append(svcs, svc)
 	}
+	sort.Strings(svcs)
 
-	l.Log("event", "updatedAdvertisements", "numAds", len(c.svcAds[name]), "msg", "making advertisements using BGP")
+	// Blackhole routes go to the dedicated RTBH peers if this node
+	// has any. Otherwise, they replace the regular advertisements of
+	// their services on all peers.
+	rtbh := false
+	for _, peer := range c.peers {
+		if peer.bgp != nil && peer.cfg.RTBH {
+			rtbh = true
+		}
+	}
+	var blackholeAds []*bgp.Advertisement
+	blackholed := map[string]bool{}
+	c.blackholeMu.Lock()
+	// Rebuild the index that updateSvcAds works from.
+	c.prefixSvcs, c.svcPrefixes = nil, nil
+	for _, svc := range svcs {
+		c.indexSvc(svc)
+		if bh, ok := c.blackholes[svc]; ok {
+			blackholeAds = append(blackholeAds, bh.ad)
+			blackholed[svc] = true
+		}
+	}
+	c.blackholeMu.Unlock()
 
+	var allAds []*bgp.Advertisement
+	aggregates := map[string]bool{}
+	for _, svc := range svcs {
+		if blackholed[svc] && !rtbh {
+			continue
+		}
+		for _, ad := range c.svcAds[svc] {
+			if !c.originatesHere(ad) {
+				continue
+			}
+			if o, _ := ad.Prefix.Mask.Size(); o == 32 {
+				allAds = append(allAds, ad)
+				continue
+			}
+			// svcAds only contains services that are allocated and
+			// healthy, so an aggregate is originated exactly while
+			// at least one such service lives inside it. Multiple
+			// services in the same aggregate share one advertisement.
+			if aggregates[ad.Prefix.String()] {
+				continue
+			}
+			aggregates[ad.Prefix.String()] = true
+			allAds = append(allAds, ad)
+		}
+	}
+
+	for pfx := range aggregates {
+		if !c.aggregates[pfx] {
+			l.Log("event", "aggregateOriginated", "prefix", pfx, "msg", "first active service in aggregate, originating aggregate prefix")
+		}
+	}
+	for pfx := range c.aggregates {
+		if !aggregates[pfx] {
+			l.Log("event", "aggregateWithdrawn", "prefix", pfx, "msg", "no active services left in aggregate, withdrawing aggregate prefix")
+		}
+	}
+	c.aggregates = aggregates
+
+	allAds, held := limitAds(allAds, func(pfx string) bool { return c.originated[pfx] }, c.maxPrefixes)
+	reportHeld(l, "", &c.held, held, c.maxPrefixes)
+	c.originated = map[string]bool{}
+	for _, ad := range allAds {
+		c.originated[ad.Prefix.String()] = true
+	}
+
+	for _, peer := range c.peers {
+		if peer.bgp == nil {
+			continue
+		}
+		if peer.cfg.RTBH {
+			if err := peer.update(l, blackholeAds); err != nil {
+				return err
+			}
+			continue
+		}
+		ads := allAds
+		if peer.cfg.AnnouncePodCIDR && c.podCIDR != nil {
+			// Force a copy, allAds is shared between peers.
+			ads = append(ads[:len(ads):len(ads)], &bgp.Advertisement{Prefix: c.podCIDR})
+		}
+		if peer.cfg.CommunityFilter != nil {
+			ads = filterCommunities(ads, peer.cfg.CommunityFilter)
+		}
+		if !rtbh {
+			// After filtering, which must not strip the blackhole
+			// community, and last, so that the blackhole route wins
+			// over the regular route of another service sharing the
+			// IP.
+			ads = append(ads[:len(ads):len(ads)], blackholeAds...)
+		}
+		if err := peer.update(l, ads); err != nil {
+			return err
+		}
+	}
+	c.resync = false
 	return nil
 }
 
-func (c *bgpController) updateAds() error {
-	var allAds []*bgp.Advertisement
-	for _, ads := range c.svcAds {
-		// This list might contain duplicates, but that's fine,
-		// they'll get compacted by the session code when it's
-		// calculating advertisements.
-		//
-		// TODO: be more intelligent about compacting advertisements
-		// and detecting conflicting advertisements.
-		allAds = append(allAds, ads...)
+// updateSvcAds passes the change of name's advertisements and
+// blackhole route on to the peers, with the same result as updateAds.
+// Only the prefixes name advertises now or did before are looked at,
+// so the work doesn't grow with the number of other services. Prefix
+// limits depend on all advertisements, so with limits, and after a
+// failed update, it falls back to updateAds.
+func (c *bgpController) updateSvcAds(l log.Logger, name string) error {
+	full := c.resync || c.maxPrefixes > 0
+	rtbh := false
+	for _, peer := range c.peers {
+		if peer.bgp == nil {
+			continue
+		}
+		if peer.cfg.MaxPrefixes > 0 {
+			full = true
+		}
+		if peer.cfg.RTBH {
+			rtbh = true
+		}
+	}
+	if full {
+		return c.updateAds(l)
+	}
+
+	c.blackholeMu.Lock()
+	pfxs := c.indexSvc(name)
+	ads := make([]*bgp.Advertisement, len(pfxs))
+	blackholeAds := make([]*bgp.Advertisement, len(pfxs))
+	for i, pfx := range pfxs {
+		ads[i], blackholeAds[i] = c.resolveAd(pfx, rtbh)
+	}
+	c.blackholeMu.Unlock()
+
+	if c.aggregates == nil {
+		c.aggregates = map[string]bool{}
 	}
+	if c.originated == nil {
+		c.originated = map[string]bool{}
+	}
+	for i, pfx := range pfxs {
+		if ads[i] == nil {
+			delete(c.originated, pfx)
+			if c.aggregates[pfx] {
+				l.Log("event", "aggregateWithdrawn", "prefix", pfx, "msg", "no active services left in aggregate, withdrawing aggregate prefix")
+				delete(c.aggregates, pfx)
+			}
+			continue
+		}
+		c.originated[pfx] = true
+		if o, _ := ads[i].Prefix.Mask.Size(); o != 32 && !c.aggregates[pfx] {
+			l.Log("event", "aggregateOriginated", "prefix", pfx, "msg", "first active service in aggregate, originating aggregate prefix")
+			c.aggregates[pfx] = true
+		}
+	}
+
 	for _, peer := range c.peers {
 		if peer.bgp == nil {
 			continue
 		}
-		if err := peer.bgp.Set(allAds...); err != nil {
+		want := make(map[string]*bgp.Advertisement, len(pfxs))
+		for i, pfx := range pfxs {
+			want[pfx] = c.peerAd(peer, pfx, ads[i], blackholeAds[i], rtbh)
+		}
+		if err := peer.updatePrefixes(want); err != nil {
+			c.resync = true
 			return err
 		}
 	}
 	return nil
 }
 
+// indexSvc records the prefixes of name's advertisements and blackhole
+// route in prefixSvcs, and returns them along with the prefixes name
+// had before, sorted. c.blackholeMu must be held.
+func (c *bgpController) indexSvc(name string) []string {
+	if c.prefixSvcs == nil {
+		c.prefixSvcs = map[string]map[string]bool{}
+		c.svcPrefixes = map[string][]string{}
+	}
+	touched := map[string]bool{}
+	for _, pfx := range c.svcPrefixes[name] {
+		touched[pfx] = true
+		delete(c.prefixSvcs[pfx], name)
+		if len(c.prefixSvcs[pfx]) == 0 {
+			delete(c.prefixSvcs, pfx)
+		}
+	}
+
+	var pfxs []string
+	add := func(pfx string) {
+		if c.prefixSvcs[pfx][name] {
+			return
+		}
+		if c.prefixSvcs[pfx] == nil {
+			c.prefixSvcs[pfx] = map[string]bool{}
+		}
+		c.prefixSvcs[pfx][name] = true
+		touched[pfx] = true
+		pfxs = append(pfxs, pfx)
+	}
+	for _, ad := range c.svcAds[name] {
+		add(ad.Prefix.String())
+	}
+	if bh, ok := c.blackholes[name]; ok {
+		add(bh.ad.Prefix.String())
+	}
+	if len(pfxs) > 0 {
+		c.svcPrefixes[name] = pfxs
+	} else {
+		delete(c.svcPrefixes, name)
+	}
+
+	ret := make([]string, 0, len(touched))
+	for pfx := range touched {
+		ret = append(ret, pfx)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// resolveAd returns the advertisement that updateAds originates for
+// pfx, and the blackhole route for it, looking only at the services
+// in prefixSvcs. c.blackholeMu must be held.
+func (c *bgpController) resolveAd(pfx string, rtbh bool) (ad, blackholeAd *bgp.Advertisement) {
+	svcs := make([]string, 0, len(c.prefixSvcs[pfx]))
+	for svc := range c.prefixSvcs[pfx] {
+		svcs = append(svcs, svc)
+	}
+	sort.Strings(svcs)
+
+	for _, svc := range svcs {
+		bh, blackholed := c.blackholes[svc]
+		if blackholed && bh.ad.Prefix.String() == pfx {
+			blackholeAd = bh.ad
+		}
+		if blackholed && !rtbh {
+			continue
+		}
+		for _, a := range c.svcAds[svc] {
+			if a.Prefix.String() != pfx || !c.originatesHere(a) {
+				continue
+			}
+			// As in updateAds, the last service sharing an IP wins,
+			// but the first service in an aggregate provides its
+			// attributes.
+			if o, _ := a.Prefix.Mask.Size(); o == 32 || ad == nil {
+				ad = a
+			}
+		}
+	}
+	return ad, blackholeAd
+}
+
+// peerAd returns what updateAds gives p for pfx, where ad and
+// blackholeAd are as returned by resolveAd, nil for nothing.
+func (c *bgpController) peerAd(p *peer, pfx string, ad, blackholeAd *bgp.Advertisement, rtbh bool) *bgp.Advertisement {
+	if p.cfg.RTBH {
+		return blackholeAd
+	}
+	if blackholeAd != nil && !rtbh {
+		return blackholeAd
+	}
+	if p.cfg.AnnouncePodCIDR && c.podCIDR != nil && c.podCIDR.String() == pfx {
+		ad = &bgp.Advertisement{Prefix: c.podCIDR}
+	}
+	if ad != nil && p.cfg.CommunityFilter != nil {
+		ad = filterCommunities([]*bgp.Advertisement{ad}, p.cfg.CommunityFilter)[0]
+	}
+	return ad
+}
+
+// limitAds returns the advertisements of ads for at most max
+// prefixes, all of them if max is zero, and how many prefixes it left
+// out. Prefixes that advertised says are already advertised are kept
+// first, so that new advertisements are held back rather than
+// replacing advertised ones.
+func limitAds(ads []*bgp.Advertisement, advertised func(string) bool, max int) ([]*bgp.Advertisement, int) {
+	if max <= 0 {
+		return ads, 0
+	}
+	keep := map[string]bool{}
+	for _, ad := range ads {
+		if pfx := ad.Prefix.String(); advertised(pfx) && len(keep) < max {
+			keep[pfx] = true
+		}
+	}
+	for _, ad := range ads {
+		if pfx := ad.Prefix.String(); !keep[pfx] && len(keep) < max {
+			keep[pfx] = true
+		}
+	}
+	ret := make([]*bgp.Advertisement, 0, len(ads))
+	held := map[string]bool{}
+	for _, ad := range ads {
+		if pfx := ad.Prefix.String(); keep[pfx] {
+			ret = append(ret, ad)
+		} else {
+			held[pfx] = true
+		}
+	}
+	return ret, len(held)
+}
+
+// reportHeld records that n prefixes are held back from peer, empty
+// for the node's limit, where last held back *held, and logs when
+// that starts and stops.
+func reportHeld(l log.Logger, peer string, held *int, n, max int) {
+	if max <= 0 && *held == 0 {
+		return
+	}
+	switch {
+	case n > 0 && *held == 0:
+		l.Log("event", "prefixLimitReached", "peer", peer, "limit", max, "held", n, "msg", "prefix limit reached, holding back new advertisements")
+	case n == 0 && *held > 0:
+		l.Log("event", "prefixLimitCleared", "peer", peer, "msg", "prefixes within the limit again, advertising all of them")
+	}
+	*held = n
+	prefixesHeld.WithLabelValues(peer).Set(float64(n))
+}
+
+// sourceAddress returns the address this node connects to p from, on
+// p's secondary network.
+func (c *bgpController) sourceAddress(p *config.Peer) (net.IP, error) {
+	intf, err := c.networks.lookup(p.Network)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := sourceAddress(intf, p.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("interface %q of network %q: %s", intf, p.Network, err)
+	}
+	return addr, nil
+}
+
+// addr returns the host:port of p's session, which also labels its
+// metrics.
+func (p *peer) addr() string {
+	host := p.cfg.Host()
+	if p.cfg.Addr == nil && p.linkLocal != nil {
+		host = p.linkLocal.String() + "%" + p.cfg.Interface
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(p.cfg.Port)))
+}
+
+// deleteInfo removes p's peerInfo metric, when its session is closed.
+func (p *peer) deleteInfo() {
+	peerInfo.DeleteLabelValues(p.addr(), p.cfg.Description)
+	prefixesHeld.DeleteLabelValues(p.addr())
+	p.held = 0
+}
+
+// update passes the difference between ads, within p's prefix limit,
+// and the advertisements last given to p's session on to it.
+func (p *peer) update(l log.Logger, ads []*bgp.Advertisement) error {
+	ads, held := limitAds(ads, func(pfx string) bool { return p.ads[pfx] != nil }, p.cfg.MaxPrefixes)
+	reportHeld(l, p.addr(), &p.held, held, p.cfg.MaxPrefixes)
+
+	want := make(map[string]*bgp.Advertisement, len(ads))
+	for _, ad := range ads {
+		want[ad.Prefix.String()] = ad
+	}
+
+	var (
+		set []*bgp.Advertisement
+		wdr []*net.IPNet
+	)
+	for pfx, ad := range want {
+		if old := p.ads[pfx]; old == nil || !ad.Equal(old) {
+			set = append(set, ad)
+		}
+	}
+	for pfx, ad := range p.ads {
+		if want[pfx] == nil {
+			wdr = append(wdr, ad.Prefix)
+		}
+	}
+	if len(set) == 0 && len(wdr) == 0 {
+		return nil
+	}
+
+	if err := p.bgp.Update(set, wdr); err != nil {
+		return err
+	}
+	p.ads = want
+	return nil
+}
+
+// updatePrefixes passes the advertisements in want, nil to withdraw
+// the prefix, on to p's session, leaving its other prefixes alone.
+func (p *peer) updatePrefixes(want map[string]*bgp.Advertisement) error {
+	var (
+		set []*bgp.Advertisement
+		wdr []*net.IPNet
+	)
+	for pfx, ad := range want {
+		old := p.ads[pfx]
+		switch {
+		case ad == nil && old != nil:
+			wdr = append(wdr, old.Prefix)
+		case ad != nil && (old == nil || !ad.Equal(old)):
+			set = append(set, ad)
+		}
+	}
+	if len(set) == 0 && len(wdr) == 0 {
+		return nil
+	}
+
+	if err := p.bgp.Update(set, wdr); err != nil {
+		return err
+	}
+	for pfx, ad := range want {
+		if ad == nil {
+			delete(p.ads, pfx)
+		} else {
+			p.ads[pfx] = ad
+		}
+	}
+	return nil
+}
+
+// filterCommunities returns copies of ads with their communities
+// rewritten according to f. The input advertisements are shared
+// between peers, so they must not be modified in place.
+func filterCommunities(ads []*bgp.Advertisement, f *config.CommunityFilter) []*bgp.Advertisement {
+	ret := make([]*bgp.Advertisement, 0, len(ads))
+	for _, ad := range ads {
+		comms := map[uint32]bool{}
+		if !f.StripAll {
+			for _, comm := range ad.Communities {
+				if len(f.Allow) > 0 && !f.Allow[comm] {
+					continue
+				}
+				comms[comm] = true
+			}
+		}
+		for comm := range f.Add {
+			comms[comm] = true
+		}
+
+		filtered := *ad
+		filtered.Communities = nil
+		for comm := range comms {
+			filtered.Communities = append(filtered.Communities, comm)
+		}
+		sort.Slice(filtered.Communities, func(i, j int) bool { return filtered.Communities[i] < filtered.Communities[j] })
+		ret = append(ret, &filtered)
+	}
+	return ret
+}
+
+// designatedOriginator returns true if this node is among the first
+// n of nodes, ordered by the hash of the node and prefix. The order
+// only depends on prefix, so that the same nodes originate an
+// aggregate for all the services rolled up in it.
+func (c *bgpController) designatedOriginator(prefix *net.IPNet, nodes []string, n int) bool {
+	hash := func(node string) [sha256.Size]byte {
+		return sha256.Sum256([]byte(node + "#" + prefix.String()))
+	}
+	ranked := 0
+	mine := hash(c.myNode)
+	found := false
+	for _, node := range nodes {
+		if node == c.myNode {
+			found = true
+			continue
+		}
+		if h := hash(node); bytes.Compare(h[:], mine[:]) < 0 {
+			ranked++
+		}
+	}
+	return found && ranked < n
+}
+
+// originatorCandidates returns the nodes among nodes that may
+// originate aggregates of pool.
+func (c *bgpController) originatorCandidates(nodes []string, pool *config.Pool) []string {
+	if c.canOriginate == nil {
+		return nodes
+	}
+	var ret []string
+	for _, node := range nodes {
+		if c.canOriginate(node, pool) {
+			ret = append(ret, node)
+		}
+	}
+	return ret
+}
+
+// originatesHere returns true if ad's node selectors match this
+// node.
+func (c *bgpController) originatesHere(ad *bgp.Advertisement) bool {
+	sels, ok := c.adNodes[ad]
+	if !ok {
+		return true
+	}
+	for _, sel := range sels {
+		if sel.Matches(c.nodeLabels) {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetAds drops the node selectors of name's advertisements.
+func (c *bgpController) forgetAds(name string) {
+	for _, ad := range c.svcAds[name] {
+		delete(c.adNodes, ad)
+	}
+}
+
 func (c *bgpController) DeleteBalancer(l log.Logger, name, reason string) error {
+	delete(c.endpointNodes, name)
+	delete(c.endpointCounts, name)
 	if _, ok := c.svcAds[name]; !ok {
 		return nil
 	}
+	c.forgetAds(name)
 	delete(c.svcAds, name)
-	return c.updateAds()
+	delete(c.announcedSvcs, name)
+	c.blackholeMu.Lock()
+	delete(c.blackholes, name)
+	c.blackholeMu.Unlock()
+	return c.updateSvcAds(l, name)
+}
+
+// shutdownMsg returns the shutdown communication sent to peers when
+// closing sessions for reason. It names the node, so that router logs
+// can be correlated with the cluster.
+func (c *bgpController) shutdownMsg(reason string) string {
+	return fmt.Sprintf("MetalLB speaker on node %s: %s", c.myNode, reason)
+}
+
+// shutdown withdraws all advertisements, waits grace for peers to
+// route around this node, and then closes all sessions with an
+// Administrative Shutdown notification carrying reason, see
+// shutdownMsg.
+func (c *bgpController) shutdown(l log.Logger, grace time.Duration, reason string) {
+	sessions := 0
+	for _, p := range c.peers {
+		if p.bgp == nil {
+			continue
+		}
+		if err := p.update(l, nil); err != nil {
+			l.Log("op", "shutdown", "error", err, "peer", p.cfg.Host(), "msg", "failed to withdraw advertisements")
+		}
+		sessions++
+	}
+	if sessions == 0 {
+		return
+	}
+
+	l.Log("event", "advertisementsWithdrawn", "gracePeriod", grace, "msg", "withdrew all BGP advertisements, waiting before closing sessions")
+	time.Sleep(grace)
+
+	for _, p := range c.peers {
+		if p.bgp == nil {
+			continue
+		}
+		if err := p.bgp.Shutdown(c.shutdownMsg(reason)); err != nil {
+			l.Log("op", "shutdown", "error", err, "peer", p.cfg.Host(), "msg", "failed to shut down BGP session")
+		}
+		p.deleteInfo()
+		p.bgp = nil
+		p.ads = nil
+	}
+	c.snapshotSessions()
 }
 
 type session interface {
 	io.Closer
-	Set(advs ...*bgp.Advertisement) error
+	Update(advs []*bgp.Advertisement, withdraw []*net.IPNet) error
+	Shutdown(msg string) error
+	Established() bool
+}
+
+func (c *bgpController) snapshotSessions() {
+	var sessions []session
+	for _, p := range c.peers {
+		if p.bgp != nil {
+			sessions = append(sessions, p.bgp)
+		}
+	}
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	c.sessions = sessions
+}
+
+// sessionCounts returns the number of BGP sessions that are
+// established, and the number of sessions that should be running on
+// this node according to the peers' node selectors.
+func (c *bgpController) sessionCounts() (established, total int) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	for _, s := range c.sessions {
+		if s.Established() {
+			established++
+		}
+	}
+	return established, len(c.sessions)
 }
 
 func (c *bgpController) SetLeader(log.Logger, bool) {}
 
 func (c *bgpController) SetNode(l log.Logger, node *v1.Node) error {
+	podCIDR := nodePodCIDR(l, node)
+	podCIDRChanged := podCIDR.String() != c.podCIDR.String()
+	if podCIDRChanged {
+		l.Log("event", "podCIDRChanged", "cidr", podCIDR, "msg", "node pod CIDR changed")
+		c.podCIDR = podCIDR
+	}
+
 	nodeLabels := node.Labels
 	if nodeLabels == nil {
 		nodeLabels = map[string]string{}
 	}
 	ns := labels.Set(nodeLabels)
 	if c.nodeLabels != nil && labels.Equals(c.nodeLabels, ns) {
-		// Node labels unchanged, no action required.
+		// Node labels unchanged, only the pod CIDR may need
+		// re-advertising.
+		if podCIDRChanged {
+			return c.updateAds(l)
+		}
 		return nil
 	}
 	c.nodeLabels = ns
 	l.Log("event", "nodeLabelsChanged", "msg", "Node labels changed, resyncing BGP peers")
-	return c.syncPeers(l)
+	if err := c.syncPeers(l); err != nil {
+		return err
+	}
+	// Advertisements with node selectors may start or stop being
+	// originated here.
+	return c.updateAds(l)
+}
+
+// nodePodCIDR returns the IPv4 pod CIDR of node, or nil if it has
+// none.
+func nodePodCIDR(l log.Logger, node *v1.Node) *net.IPNet {
+	if node.Spec.PodCIDR == "" {
+		return nil
+	}
+	_, cidr, err := net.ParseCIDR(node.Spec.PodCIDR)
+	if err != nil {
+		l.Log("op", "setNode", "error", err, "cidr", node.Spec.PodCIDR, "msg", "invalid pod CIDR on node")
+		return nil
+	}
+	if cidr.IP.To4() == nil {
+		return nil
+	}
+	return cidr
 }
 
-var newBGP = func(logger log.Logger, addr string, myASN uint32, routerID net.IP, asn uint32, hold time.Duration, password string, myNode string) (session, error) {
-	return bgp.New(logger, addr, myASN, routerID, asn, hold, password, myNode)
+var newBGP = func(logger log.Logger, addr string, myASN uint32, routerID net.IP, asn uint32, hold time.Duration, password string, myNode string, opts bgp.SessionOptions) (session, error) {
+	return bgp.New(logger, addr, myASN, routerID, asn, hold, password, myNode, opts)
+}
+
+func socketOptions(p *config.Peer) bgp.SocketOptions {
+	return bgp.SocketOptions{
+		KeepaliveInterval: p.TCP.KeepaliveInterval,
+		KeepaliveProbes:   p.TCP.KeepaliveProbes,
+		UserTimeout:       p.TCP.UserTimeout,
+		DSCP:              p.TCP.DSCP,
+	}
 }
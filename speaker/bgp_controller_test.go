@@ -93,9 +93,25 @@ type fakeBGP struct {
 	sync.Mutex
 	// peer IP -> advertisements
 	gotAds map[string][]*bgp.Advertisement
+	// peer IP -> how sessions closed with Shutdown were shut down.
+	shutdowns map[string]fakeShutdown
+	// peer IP -> source address of the session.
+	srcAddrs map[string]net.IP
+	// peer IP -> local ASN of the session.
+	myASNs map[string]uint32
+	// peer IP -> number of sessions created.
+	sessions map[string]int
+	// peer IP -> number of prefixes withdrawn.
+	withdrawn map[string]int
 }
 
-func (f *fakeBGP) New(_ log.Logger, addr string, _ uint32, _ net.IP, _ uint32, _ time.Duration, _, _ string) (session, error) {
+type fakeShutdown struct {
+	msg string
+	// Number of advertisements still set when shutting down.
+	ads int
+}
+
+func (f *fakeBGP) New(_ log.Logger, addr string, myASN uint32, _ net.IP, _ uint32, _ time.Duration, _, _ string, opts bgp.SessionOptions) (session, error) {
 	f.Lock()
 	defer f.Unlock()
 
@@ -106,6 +122,18 @@ func (f *fakeBGP) New(_ log.Logger, addr string, _ uint32, _ net.IP, _ uint32, _
 	// Nil because we haven't programmed any routes for it yet, but
 	// the key now exists in the map.
 	f.gotAds[addr] = nil
+	if f.srcAddrs == nil {
+		f.srcAddrs = map[string]net.IP{}
+	}
+	f.srcAddrs[addr] = opts.SourceAddress
+	if f.myASNs == nil {
+		f.myASNs = map[string]uint32{}
+	}
+	f.myASNs[addr] = myASN
+	if f.sessions == nil {
+		f.sessions = map[string]int{}
+	}
+	f.sessions[addr]++
 	return &fakeSession{
 		f:    f,
 		addr: addr,
@@ -137,8 +165,15 @@ func (f *fakeBGP) Ads() map[string][]*bgp.Advertisement {
 }
 
 type fakeSession struct {
-	f    *fakeBGP
-	addr string
+	f           *fakeBGP
+	addr        string
+	established bool
+}
+
+func (f *fakeSession) Established() bool {
+	f.f.Lock()
+	defer f.f.Unlock()
+	return f.established
 }
 
 func (f *fakeSession) Close() error {
@@ -154,16 +189,47 @@ func (f *fakeSession) Close() error {
 	return nil
 }
 
-func (f *fakeSession) Set(ads ...*bgp.Advertisement) error {
+func (f *fakeSession) Shutdown(msg string) error {
+	f.f.Lock()
+	if f.f.shutdowns == nil {
+		f.f.shutdowns = map[string]fakeShutdown{}
+	}
+	f.f.shutdowns[f.addr] = fakeShutdown{msg, len(f.f.gotAds[f.addr])}
+	f.f.Unlock()
+	return f.Close()
+}
+
+func (f *fakeSession) Update(ads []*bgp.Advertisement, withdraw []*net.IPNet) error {
 	f.f.Lock()
 	defer f.f.Unlock()
 
-	if _, ok := f.f.gotAds[f.addr]; !ok {
-		f.f.t.Errorf("Tried to set ads on non-existent session to %q", f.addr)
+	cur, ok := f.f.gotAds[f.addr]
+	if !ok {
+		f.f.t.Errorf("Tried to update ads on non-existent session to %q", f.addr)
 		return errors.New("invariant violation")
 	}
 
-	f.f.gotAds[f.addr] = ads
+	drop := map[string]bool{}
+	for _, pfx := range withdraw {
+		drop[pfx.String()] = true
+	}
+	if len(withdraw) > 0 {
+		if f.f.withdrawn == nil {
+			f.f.withdrawn = map[string]int{}
+		}
+		f.f.withdrawn[f.addr] += len(withdraw)
+	}
+	for _, ad := range ads {
+		drop[ad.Prefix.String()] = true
+	}
+	var next []*bgp.Advertisement
+	for _, ad := range cur {
+		if !drop[ad.Prefix.String()] {
+			next = append(next, ad)
+		}
+	}
+	next = append(next, ads...)
+	f.f.gotAds[f.addr] = next
 	return nil
 }
 
@@ -1056,3 +1122,2314 @@ func TestNodeSelectors(t *testing.T) {
 		}
 	}
 }
+
+func TestAggregateOrigination(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 24,
+					},
+				},
+			},
+		},
+	}
+
+	healthy := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+	unhealthy := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				NotReadyAddresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+	lb := func(ip string) *v1.Service {
+		return &v1.Service{
+			Spec: v1.ServiceSpec{
+				Type:                  "LoadBalancer",
+				ExternalTrafficPolicy: "Cluster",
+			},
+			Status: statusAssigned(ip),
+		}
+	}
+
+	tests := []struct {
+		desc     string
+		balancer string
+		svc      *v1.Service
+		eps      *v1.Endpoints
+		wantAds  map[string][]*bgp.Advertisement
+	}{
+		{
+			desc:     "First healthy service originates the aggregate",
+			balancer: "test1",
+			svc:      lb("10.20.30.1"),
+			eps:      healthy,
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix: ipnet("10.20.30.0/24"),
+					},
+				},
+			},
+		},
+		{
+			desc:     "Second service in the aggregate shares the advertisement",
+			balancer: "test2",
+			svc:      lb("10.20.30.2"),
+			eps:      healthy,
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix: ipnet("10.20.30.0/24"),
+					},
+				},
+			},
+		},
+		{
+			desc:     "First service deleted, aggregate still originated",
+			balancer: "test1",
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix: ipnet("10.20.30.0/24"),
+					},
+				},
+			},
+		},
+		{
+			desc:     "Last service loses its endpoints, aggregate withdrawn",
+			balancer: "test2",
+			svc:      lb("10.20.30.2"),
+			eps:      unhealthy,
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": nil,
+			},
+		},
+		{
+			desc:     "Service becomes healthy again, aggregate re-originated",
+			balancer: "test2",
+			svc:      lb("10.20.30.2"),
+			eps:      healthy,
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix: ipnet("10.20.30.0/24"),
+					},
+				},
+			},
+		},
+	}
+
+	l := log.NewNopLogger()
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	for _, test := range tests {
+		if c.SetBalancer(l, test.balancer, test.svc, test.eps) == k8s.SyncStateError {
+			t.Errorf("%q: SetBalancer failed", test.desc)
+		}
+
+		gotAds := b.Ads()
+		sortAds(test.wantAds)
+		sortAds(gotAds)
+		if diff := cmp.Diff(test.wantAds, gotAds); diff != "" {
+			t.Errorf("%q: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestAdvertisementNodeSelectors(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 24,
+						NodeSelectors:     []labels.Selector{labels.SelectorFromSet(labels.Set{"role": "border"})},
+					},
+					{
+						AggregationLength: 32,
+					},
+				},
+			},
+		},
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+
+	l := log.NewNopLogger()
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	if c.SetNode(l, &v1.Node{}) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+
+	hostOnly := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix: ipnet("10.20.30.1/32"),
+			},
+		},
+	}
+	gotAds := b.Ads()
+	sortAds(gotAds)
+	if diff := cmp.Diff(hostOnly, gotAds); diff != "" {
+		t.Errorf("non-border node: unexpected advertisement state (-want +got)\n%s", diff)
+	}
+
+	border := &v1.Node{}
+	border.Labels = map[string]string{"role": "border"}
+	if c.SetNode(l, border) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+	wantAds := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix: ipnet("10.20.30.0/24"),
+			},
+			{
+				Prefix: ipnet("10.20.30.1/32"),
+			},
+		},
+	}
+	gotAds = b.Ads()
+	sortAds(wantAds)
+	sortAds(gotAds)
+	if diff := cmp.Diff(wantAds, gotAds); diff != "" {
+		t.Errorf("border node: unexpected advertisement state (-want +got)\n%s", diff)
+	}
+
+	if c.SetNode(l, &v1.Node{}) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+	gotAds = b.Ads()
+	sortAds(gotAds)
+	if diff := cmp.Diff(hostOnly, gotAds); diff != "" {
+		t.Errorf("label removed: unexpected advertisement state (-want +got)\n%s", diff)
+	}
+}
+
+func TestBGPOverrides(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+						LocalPref:         100,
+					},
+				},
+				ServiceLocalPref: &config.Uint32Range{Min: 100, Max: 300},
+				ServiceMED:       &config.Uint32Range{Min: 0, Max: 100},
+			},
+		},
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+
+	l := log.NewNopLogger()
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	tests := []struct {
+		desc        string
+		annotations map[string]string
+		want        *bgp.Advertisement
+	}{
+		{
+			desc: "no overrides",
+			want: &bgp.Advertisement{
+				Prefix:    ipnet("10.20.30.1/32"),
+				LocalPref: 100,
+			},
+		},
+		{
+			desc: "valid overrides",
+			annotations: map[string]string{
+				config.LocalPrefAnnotation: "250",
+				config.MEDAnnotation:       "20",
+			},
+			want: &bgp.Advertisement{
+				Prefix:    ipnet("10.20.30.1/32"),
+				LocalPref: 250,
+				MED:       20,
+			},
+		},
+		{
+			desc: "out of bounds override",
+			annotations: map[string]string{
+				config.LocalPrefAnnotation: "50",
+			},
+			want: &bgp.Advertisement{
+				Prefix:    ipnet("10.20.30.1/32"),
+				LocalPref: 100,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: test.annotations,
+			},
+			Spec: v1.ServiceSpec{
+				Type:                  "LoadBalancer",
+				ExternalTrafficPolicy: "Cluster",
+			},
+			Status: statusAssigned("10.20.30.1"),
+		}
+		if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+			t.Fatalf("%q: SetBalancer failed", test.desc)
+		}
+		want := map[string][]*bgp.Advertisement{
+			"1.2.3.4:0": {test.want},
+		}
+		if diff := cmp.Diff(want, b.Ads()); diff != "" {
+			t.Errorf("%q: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestBlackhole(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+	bgpCtrl := c.protocols[config.BGP].(*bgpController)
+
+	regular := &config.Peer{
+		Addr:          net.ParseIP("1.2.3.4"),
+		NodeSelectors: []labels.Selector{labels.Everything()},
+	}
+	rtbh := &config.Peer{
+		Addr:          net.ParseIP("1.2.3.5"),
+		NodeSelectors: []labels.Selector{labels.Everything()},
+		RTBH:          true,
+	}
+	pools := map[string]*config.Pool{
+		"default": {
+			Protocol: config.BGP,
+			CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+			BGPAdvertisements: []*config.BGPAdvertisement{
+				{
+					AggregationLength: 32,
+					Communities:       map[uint32]bool{1234: true},
+				},
+			},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{config.BlackholeAnnotation: "2020-01-01T01:00:00Z"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+	regularAd := &bgp.Advertisement{
+		Prefix:      ipnet("10.20.30.1/32"),
+		Communities: []uint32{1234},
+	}
+	blackholeAd := &bgp.Advertisement{
+		Prefix:      ipnet("10.20.30.1/32"),
+		Communities: []uint32{bgp.BlackholeCommunity, bgp.NoExportCommunity},
+	}
+
+	l := log.NewNopLogger()
+	if c.SetConfig(l, &config.Config{Peers: []*config.Peer{regular}, Pools: pools}) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+	// Without RTBH peers, the blackhole route replaces the regular
+	// one.
+	want := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {blackholeAd},
+	}
+	if diff := cmp.Diff(want, b.Ads()); diff != "" {
+		t.Errorf("no rtbh peers: unexpected advertisement state (-want +got)\n%s", diff)
+	}
+
+	if c.SetConfig(l, &config.Config{Peers: []*config.Peer{regular, rtbh}, Pools: pools}) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	want = map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {regularAd},
+		"1.2.3.5:0": {blackholeAd},
+	}
+	if diff := cmp.Diff(want, b.Ads()); diff != "" {
+		t.Errorf("rtbh peer: unexpected advertisement state (-want +got)\n%s", diff)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if !bgpCtrl.blackholesExpired(now) {
+		t.Error("blackhole not expired")
+	}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+	want = map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {regularAd},
+		"1.2.3.5:0": nil,
+	}
+	if diff := cmp.Diff(want, b.Ads()); diff != "" {
+		t.Errorf("expired blackhole: unexpected advertisement state (-want +got)\n%s", diff)
+	}
+	if bgpCtrl.blackholesExpired(now) {
+		t.Error("expired blackhole still tracked")
+	}
+}
+
+func TestFencedService(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+				},
+			},
+		},
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+
+	l := log.NewNopLogger()
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+	if ads := b.Ads()["1.2.3.4:0"]; len(ads) != 1 {
+		t.Fatalf("service not announced, got ads %v", ads)
+	}
+
+	svc.Annotations = map[string]string{k8s.NamespaceFencedAnnotation: "true"}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+	if ads := b.Ads()["1.2.3.4:0"]; len(ads) != 0 {
+		t.Errorf("fenced service still announced, got ads %v", ads)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+			{
+				Addr:          net.ParseIP("1.2.3.5"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol:          config.BGP,
+				CIDR:              []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{{AggregationLength: 32}},
+			},
+		},
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+
+	l := log.NewNopLogger()
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+	if n := len(b.Ads()["1.2.3.4:0"]); n != 1 {
+		t.Fatalf("advertising %d prefixes before shutdown, want 1", n)
+	}
+
+	c.shutdown(l, 0, "maintenance")
+
+	if ads := b.Ads(); len(ads) != 0 {
+		t.Errorf("sessions still open after shutdown: %v", ads)
+	}
+	// Advertisements are withdrawn before shutting down.
+	want := map[string]fakeShutdown{
+		"1.2.3.4:0": {"MetalLB speaker on node pandora: maintenance", 0},
+		"1.2.3.5:0": {"MetalLB speaker on node pandora: maintenance", 0},
+	}
+	if diff := cmp.Diff(want, b.shutdowns, cmp.AllowUnexported(fakeShutdown{})); diff != "" {
+		t.Errorf("unexpected shutdowns (-want +got)\n%s", diff)
+	}
+	if established, total := c.protocols[config.BGP].(*bgpController).sessionCounts(); established != 0 || total != 0 {
+		t.Errorf("got %d/%d sessions after shutdown, want none", established, total)
+	}
+}
+
+func TestServiceIPAdvertisement(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{},
+		ServiceIPs: &config.ServiceIPs{
+			ClusterIPs:  true,
+			ExternalIPs: true,
+			BGPAdvertisements: []*config.BGPAdvertisement{
+				{
+					AggregationLength: 32,
+				},
+			},
+		},
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:        "ClusterIP",
+			ClusterIP:   "10.96.0.10",
+			ExternalIPs: []string{"192.0.2.1", "2001:db8::1"},
+		},
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+
+	l := log.NewNopLogger()
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	tests := []struct {
+		desc    string
+		svc     *v1.Service
+		eps     *v1.Endpoints
+		wantAds map[string][]*bgp.Advertisement
+	}{
+		{
+			desc: "ClusterIP and IPv4 ExternalIP announced",
+			svc:  svc,
+			eps:  eps,
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix: ipnet("10.96.0.10/32"),
+					},
+					{
+						Prefix: ipnet("192.0.2.1/32"),
+					},
+				},
+			},
+		},
+		{
+			desc: "No endpoints, withdrawn",
+			svc:  svc,
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": nil,
+			},
+		},
+		{
+			desc: "Endpoints back, announced again",
+			svc:  svc,
+			eps:  eps,
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix: ipnet("10.96.0.10/32"),
+					},
+					{
+						Prefix: ipnet("192.0.2.1/32"),
+					},
+				},
+			},
+		},
+		{
+			desc: "Service deleted, withdrawn",
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": nil,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if c.SetBalancer(l, "test1", test.svc, test.eps) == k8s.SyncStateError {
+			t.Errorf("%q: SetBalancer failed", test.desc)
+		}
+
+		gotAds := b.Ads()
+		sortAds(test.wantAds)
+		sortAds(gotAds)
+		if diff := cmp.Diff(test.wantAds, gotAds); diff != "" {
+			t.Errorf("%q: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestPodCIDRAnnouncement(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:            net.ParseIP("1.2.3.4"),
+				NodeSelectors:   []labels.Selector{labels.Everything()},
+				AnnouncePodCIDR: true,
+			},
+			{
+				Addr:          net.ParseIP("1.2.3.5"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{},
+	}
+
+	l := log.NewNopLogger()
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	tests := []struct {
+		desc    string
+		podCIDR string
+		wantAds map[string][]*bgp.Advertisement
+	}{
+		{
+			desc:    "Pod CIDR announced to the selected peer only",
+			podCIDR: "10.244.1.0/24",
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix: ipnet("10.244.1.0/24"),
+					},
+				},
+				"1.2.3.5:0": nil,
+			},
+		},
+		{
+			desc:    "Pod CIDR changed",
+			podCIDR: "10.244.2.0/24",
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix: ipnet("10.244.2.0/24"),
+					},
+				},
+				"1.2.3.5:0": nil,
+			},
+		},
+		{
+			desc: "Pod CIDR removed",
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": nil,
+				"1.2.3.5:0": nil,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		node := &v1.Node{}
+		node.Spec.PodCIDR = test.podCIDR
+		if c.SetNode(l, node) == k8s.SyncStateError {
+			t.Errorf("%q: SetNode failed", test.desc)
+		}
+
+		gotAds := b.Ads()
+		sortAds(test.wantAds)
+		sortAds(gotAds)
+		if diff := cmp.Diff(test.wantAds, gotAds); diff != "" {
+			t.Errorf("%q: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestPodCIDRCommunityFilter(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:            net.ParseIP("1.2.3.4"),
+				NodeSelectors:   []labels.Selector{labels.Everything()},
+				AnnouncePodCIDR: true,
+				CommunityFilter: &config.CommunityFilter{
+					StripAll: true,
+					Add:      map[uint32]bool{0xfde80001: true},
+				},
+			},
+		},
+		Pools: map[string]*config.Pool{},
+	}
+
+	l := log.NewNopLogger()
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	node := &v1.Node{}
+	node.Spec.PodCIDR = "10.244.1.0/24"
+	if c.SetNode(l, node) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+
+	// The filter applies to the pod CIDR like to any other
+	// advertisement, and must not drop it.
+	wantAds := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix:      ipnet("10.244.1.0/24"),
+				Communities: []uint32{0xfde80001},
+			},
+		},
+	}
+	if diff := cmp.Diff(wantAds, b.Ads()); diff != "" {
+		t.Errorf("unexpected advertisement state (-want +got)\n%s", diff)
+	}
+}
+
+func TestFlapDamping(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	k := &testK8S{t: t}
+	c.client = k
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+				},
+				FlapDamping: &config.FlapDamping{
+					MaxFlaps: 2,
+					Window:   10 * time.Minute,
+					Hold:     5 * time.Minute,
+				},
+			},
+		},
+	}
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	healthy := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+	unhealthy := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				NotReadyAddresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+	announced := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix: ipnet("10.20.30.1/32"),
+			},
+		},
+	}
+	withdrawn := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": nil,
+	}
+
+	tests := []struct {
+		desc        string
+		at          time.Duration
+		eps         *v1.Endpoints
+		wantAds     map[string][]*bgp.Advertisement
+		wantWarning bool
+	}{
+		{
+			desc:    "Service announced",
+			eps:     healthy,
+			wantAds: announced,
+		},
+		{
+			desc:    "Service withdrawn",
+			at:      time.Minute,
+			eps:     unhealthy,
+			wantAds: withdrawn,
+		},
+		{
+			desc:        "Third change within the window is damped",
+			at:          2 * time.Minute,
+			eps:         healthy,
+			wantAds:     withdrawn,
+			wantWarning: true,
+		},
+		{
+			desc:    "Announcement stays held",
+			at:      4 * time.Minute,
+			eps:     healthy,
+			wantAds: withdrawn,
+		},
+		{
+			desc:    "Hold over, service announced",
+			at:      8 * time.Minute,
+			eps:     healthy,
+			wantAds: announced,
+		},
+	}
+
+	l := log.NewNopLogger()
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	for _, test := range tests {
+		now = start.Add(test.at)
+		c.damper.expire(now)
+		k.loggedWarning = false
+		if c.SetBalancer(l, "test1", svc, test.eps) == k8s.SyncStateError {
+			t.Errorf("%q: SetBalancer failed", test.desc)
+		}
+
+		gotAds := b.Ads()
+		sortAds(test.wantAds)
+		sortAds(gotAds)
+		if diff := cmp.Diff(test.wantAds, gotAds); diff != "" {
+			t.Errorf("%q: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+		if k.loggedWarning != test.wantWarning {
+			t.Errorf("%q: got warning event %v, want %v", test.desc, k.loggedWarning, test.wantWarning)
+		}
+	}
+}
+
+func TestMultiProtocolPool(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode: "pandora",
+		Logger: log.NewNopLogger(),
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	peers := []*config.Peer{
+		{
+			Addr:          net.ParseIP("1.2.3.4"),
+			NodeSelectors: []labels.Selector{labels.Everything()},
+		},
+	}
+	bothCfg := &config.Config{
+		Peers: peers,
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol:  config.BGP,
+				Protocols: []config.Proto{config.BGP, config.Layer2},
+				CIDR:      []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+				},
+			},
+		},
+	}
+	bgpCfg := &config.Config{
+		Peers: peers,
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+				},
+			},
+		},
+	}
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	remote := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+	local := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("pandora"),
+					},
+				},
+			},
+		},
+	}
+	announced := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix: ipnet("10.20.30.1/32"),
+			},
+		},
+	}
+
+	tests := []struct {
+		desc        string
+		config      *config.Config
+		eps         *v1.Endpoints
+		annotations map[string]string
+		wantProtos  map[config.Proto]bool
+		// If true, BGP withdrew the service.
+		withdrawn bool
+	}{
+		{
+			desc:   "Endpoint on another node, only BGP announces",
+			config: bothCfg,
+			eps:    remote,
+			wantProtos: map[config.Proto]bool{
+				config.BGP: true,
+			},
+		},
+		{
+			desc: "Endpoint on this node, both protocols announce",
+			eps:  local,
+			wantProtos: map[config.Proto]bool{
+				config.BGP:    true,
+				config.Layer2: true,
+			},
+		},
+		{
+			desc:   "Layer2 removed from the pool",
+			config: bgpCfg,
+			eps:    local,
+			wantProtos: map[config.Proto]bool{
+				config.BGP: true,
+			},
+		},
+		{
+			desc:        "Service selects a protocol not of the pool, pool's protocols announce",
+			eps:         local,
+			annotations: map[string]string{config.ProtocolAnnotation: "layer2"},
+			wantProtos: map[config.Proto]bool{
+				config.BGP: true,
+			},
+		},
+		{
+			desc:        "Service selects layer2, only layer2 announces",
+			config:      bothCfg,
+			eps:         local,
+			annotations: map[string]string{config.ProtocolAnnotation: "layer2"},
+			wantProtos: map[config.Proto]bool{
+				config.Layer2: true,
+			},
+			withdrawn: true,
+		},
+		{
+			desc:        "Service selects bgp, only BGP announces",
+			eps:         local,
+			annotations: map[string]string{config.ProtocolAnnotation: "bgp"},
+			wantProtos: map[config.Proto]bool{
+				config.BGP: true,
+			},
+		},
+	}
+
+	l := log.NewNopLogger()
+	for _, test := range tests {
+		if test.config != nil {
+			if c.SetConfig(l, test.config) == k8s.SyncStateError {
+				t.Fatalf("%q: SetConfig failed", test.desc)
+			}
+		}
+		svc.Annotations = test.annotations
+		if c.SetBalancer(l, "test1", svc, test.eps) == k8s.SyncStateError {
+			t.Errorf("%q: SetBalancer failed", test.desc)
+		}
+
+		if diff := cmp.Diff(test.wantProtos, c.announced["test1"]); diff != "" {
+			t.Errorf("%q: unexpected announcing protocols (-want +got)\n%s", test.desc, diff)
+		}
+		wantAds := announced
+		if test.withdrawn {
+			wantAds = map[string][]*bgp.Advertisement{"1.2.3.4:0": nil}
+		}
+		gotAds := b.Ads()
+		sortAds(gotAds)
+		if diff := cmp.Diff(wantAds, gotAds); diff != "" {
+			t.Errorf("%q: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestFilterCommunities(t *testing.T) {
+	ads := []*bgp.Advertisement{
+		{
+			Prefix:      ipnet("10.20.30.1/32"),
+			LocalPref:   100,
+			Communities: []uint32{1, 2, 3},
+		},
+	}
+
+	tests := []struct {
+		desc   string
+		filter *config.CommunityFilter
+		want   []uint32
+	}{
+		{
+			desc:   "empty filter",
+			filter: &config.CommunityFilter{},
+			want:   []uint32{1, 2, 3},
+		},
+		{
+			desc: "strip all",
+			filter: &config.CommunityFilter{
+				StripAll: true,
+			},
+		},
+		{
+			desc: "allow list",
+			filter: &config.CommunityFilter{
+				Allow: map[uint32]bool{1: true, 3: true, 4: true},
+			},
+			want: []uint32{1, 3},
+		},
+		{
+			desc: "allow list and additions",
+			filter: &config.CommunityFilter{
+				Allow: map[uint32]bool{2: true},
+				Add:   map[uint32]bool{5: true, 2: true},
+			},
+			want: []uint32{2, 5},
+		},
+		{
+			desc: "strip all and additions",
+			filter: &config.CommunityFilter{
+				StripAll: true,
+				Add:      map[uint32]bool{42: true},
+			},
+			want: []uint32{42},
+		},
+	}
+
+	for _, test := range tests {
+		got := filterCommunities(ads, test.filter)
+		if len(got) != 1 {
+			t.Fatalf("%q: got %d advertisements, want 1", test.desc, len(got))
+		}
+		if diff := cmp.Diff(test.want, got[0].Communities); diff != "" {
+			t.Errorf("%q: wrong communities (-want +got)\n%s", test.desc, diff)
+		}
+		if got[0].LocalPref != 100 || got[0].Prefix.String() != "10.20.30.1/32" {
+			t.Errorf("%q: filter modified unrelated attributes: %#v", test.desc, got[0])
+		}
+	}
+	if diff := cmp.Diff([]uint32{1, 2, 3}, ads[0].Communities); diff != "" {
+		t.Errorf("filter modified input advertisement (-want +got)\n%s", diff)
+	}
+}
+
+func TestReadinessCheck(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+			{
+				Addr:          net.ParseIP("1.2.3.5"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+			{
+				Addr:          net.ParseIP("1.2.3.6"),
+				NodeSelectors: []labels.Selector{mustSelector("foo=bar")},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	establish := func(addr string) {
+		bc := c.protocols[config.BGP].(*bgpController)
+		for _, p := range bc.peers {
+			if p.cfg.Addr.String() == addr {
+				s := p.bgp.(*fakeSession)
+				b.Lock()
+				s.established = true
+				b.Unlock()
+			}
+		}
+	}
+
+	tests := []struct {
+		desc        string
+		establish   string
+		minSessions int
+		wantReady   bool
+	}{
+		{
+			desc:        "no requirement",
+			minSessions: 0,
+			wantReady:   true,
+		},
+		{
+			desc:        "one required, none up",
+			minSessions: 1,
+			wantReady:   false,
+		},
+		{
+			desc:        "one required, one up",
+			establish:   "1.2.3.4",
+			minSessions: 1,
+			wantReady:   true,
+		},
+		{
+			desc:        "all required, one of two up",
+			minSessions: -1,
+			wantReady:   false,
+		},
+		{
+			desc:        "all required, unselected peer doesn't count",
+			establish:   "1.2.3.5",
+			minSessions: -1,
+			wantReady:   true,
+		},
+		{
+			desc:        "more required than configured",
+			minSessions: 3,
+			wantReady:   false,
+		},
+	}
+
+	for _, test := range tests {
+		if test.establish != "" {
+			establish(test.establish)
+		}
+		err := c.readinessCheck(test.minSessions)()
+		if gotReady := err == nil; gotReady != test.wantReady {
+			t.Errorf("%q: got ready=%v (err %v), want ready=%v", test.desc, gotReady, err, test.wantReady)
+		}
+	}
+}
+
+func TestParseReadyBGPSessions(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "all", want: -1},
+		{in: "2", want: 2},
+		{in: "-1", wantErr: true},
+		{in: "some", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseReadyBGPSessions(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %v", test.in, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %d, want %d", test.in, got, test.want)
+		}
+	}
+}
+
+func TestDesignatedOriginator(t *testing.T) {
+	nodes := []string{"a", "b", "c", "d", "e"}
+	prefix := ipnet("10.20.30.0/24")
+
+	elected := func(nodes []string, n int) []string {
+		var ret []string
+		for _, node := range []string{"a", "b", "c", "d", "e", "f"} {
+			c := &bgpController{myNode: node}
+			if c.designatedOriginator(prefix, nodes, n) {
+				ret = append(ret, node)
+			}
+		}
+		return ret
+	}
+
+	two := elected(nodes, 2)
+	if len(two) != 2 {
+		t.Fatalf("got %d originators %v, want 2", len(two), two)
+	}
+	if got := elected(nodes, 10); len(got) != len(nodes) {
+		t.Errorf("got originators %v, want all of %v", got, nodes)
+	}
+	if got := elected(nil, 2); len(got) != 0 {
+		t.Errorf("got originators %v without candidates", got)
+	}
+
+	// The election only depends on the prefix and candidates, so
+	// another service in the same aggregate, whose endpoints are
+	// listed in another order, gets the same originators.
+	if got := elected([]string{"e", "d", "c", "b", "a"}, 2); !cmp.Equal(got, two) {
+		t.Errorf("got originators %v with reordered candidates, want %v", got, two)
+	}
+}
+
+func TestAggregateOriginatorsWithoutSpeaker(t *testing.T) {
+	// Find which of the two nodes wins the election, and run the
+	// speaker of the other one.
+	prefix := ipnet("10.20.30.0/24")
+	winner, loser := "pandora", "iris"
+	if (&bgpController{myNode: loser}).designatedOriginator(prefix, []string{winner, loser}, 1) {
+		winner, loser = loser, winner
+	}
+
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        loser,
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+	l := log.NewNopLogger()
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{prefix},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength:    24,
+						AggregateOriginators: 1,
+					},
+				},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.5", NodeName: strptr(winner)},
+					{IP: "2.3.4.6", NodeName: strptr(loser)},
+				},
+			},
+		},
+	}
+	speaker := func(name string, annotations map[string]string) {
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations}}
+		if c.SetClusterNode(l, name, node) == k8s.SyncStateError {
+			t.Fatalf("SetClusterNode failed")
+		}
+	}
+
+	running := warmupDeadline(time.Now().Add(time.Minute))
+	tests := []struct {
+		desc      string
+		winner    map[string]string
+		originate bool
+	}{
+		{
+			desc:      "both nodes run a speaker",
+			winner:    map[string]string{k8s.SpeakerAnnotation: running},
+			originate: false,
+		},
+		{
+			desc:      "winner runs no speaker",
+			winner:    nil,
+			originate: true,
+		},
+		{
+			desc:      "winner's speaker is draining",
+			winner:    map[string]string{k8s.SpeakerAnnotation: running, k8s.DrainAnnotation: "speaker-1"},
+			originate: true,
+		},
+		{
+			desc:      "winner's speaker is back",
+			winner:    map[string]string{k8s.SpeakerAnnotation: running},
+			originate: false,
+		},
+		{
+			desc:      "winner's speaker died without clearing its annotation",
+			winner:    map[string]string{k8s.SpeakerAnnotation: warmupDeadline(time.Now().Add(-time.Minute))},
+			originate: true,
+		},
+	}
+
+	speaker(loser, map[string]string{k8s.SpeakerAnnotation: running})
+	for _, test := range tests {
+		speaker(winner, test.winner)
+		if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+			t.Fatalf("%q: SetBalancer failed", test.desc)
+		}
+		originated := false
+		for _, ad := range b.Ads()["1.2.3.4:0"] {
+			if ad.Prefix.String() == prefix.String() {
+				originated = true
+			}
+		}
+		if originated != test.originate {
+			t.Errorf("%q: got originating aggregate %v, want %v", test.desc, originated, test.originate)
+		}
+	}
+}
+
+func TestEndpointWeight(t *testing.T) {
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.5", NodeName: strptr("pandora")},
+					{IP: "2.3.4.6", NodeName: strptr("pandora")},
+					{IP: "2.3.4.7", NodeName: strptr("iris")},
+					{IP: "2.3.4.8", NodeName: strptr("pandora")},
+				},
+			},
+			{
+				NotReadyAddresses: []v1.EndpointAddress{
+					{IP: "2.3.4.8", NodeName: strptr("pandora")},
+				},
+			},
+		},
+	}
+	count := countEndpoints(eps, "pandora")
+	if want := (endpointCount{local: 2, total: 3}); count != want {
+		t.Fatalf("got endpoint count %+v, want %+v", count, want)
+	}
+
+	// 1Gbps from AS 64512.
+	if got := bgp.LinkBandwidthCommunity(64512, 125e6); got != 0x4004fc004cee6b28 {
+		t.Errorf("got link bandwidth community %x, want 4004fc004cee6b28", got)
+	}
+
+	c := &bgpController{myNode: "pandora"}
+	ads := c.makeAds(net.ParseIP("10.20.30.1"), []*config.BGPAdvertisement{
+		{
+			AggregationLength: 32,
+			EndpointWeight:    config.LinkBandwidthWeight,
+		},
+		{
+			AggregationLength: 32,
+			EndpointWeight:    config.MEDWeight,
+		},
+	}, nil, count)
+	if len(ads) != 2 {
+		t.Fatalf("got %d advertisements, want 2", len(ads))
+	}
+	if want := []uint64{bgp.LinkBandwidthCommunity(0, 250e6)}; !cmp.Equal(ads[0].ExtendedCommunities, want) {
+		t.Errorf("got extended communities %x, want %x", ads[0].ExtendedCommunities, want)
+	}
+	if ads[1].MED != 1 {
+		t.Errorf("got MED %d, want 1", ads[1].MED)
+	}
+}
+
+func TestBGPUnnumbered(t *testing.T) {
+	defer func(f func(string) (net.IP, error)) { linkLocalRouter = f }(linkLocalRouter)
+	var (
+		router  net.IP
+		lookups int
+	)
+	linkLocalRouter = func(intf string) (net.IP, error) {
+		lookups++
+		if intf != "swp1" {
+			t.Errorf("looked for router on interface %q, want swp1", intf)
+		}
+		if router == nil {
+			return nil, errors.New("no router advertisement received")
+		}
+		return router, nil
+	}
+
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+	l := log.NewNopLogger()
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				NodeSelectors: []labels.Selector{labels.Everything()},
+				Interface:     "swp1",
+			},
+			{
+				Addr:          net.ParseIP("fe80::2"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+				Interface:     "swp2",
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) != k8s.SyncStateError {
+		t.Fatal("SetConfig succeeded before the router advertised itself")
+	}
+	if _, ok := b.gotAds["[fe80::2%swp2]:0"]; !ok || len(b.gotAds) != 1 {
+		t.Fatalf("want only the session to the configured link-local address, got %v", b.gotAds)
+	}
+
+	// The k8s client retries the config, by then the router has
+	// advertised itself.
+	router = net.ParseIP("fe80::1")
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	if _, ok := b.gotAds["[fe80::1%swp1]:0"]; !ok {
+		t.Fatalf("no session to the discovered router, got %v", b.gotAds)
+	}
+
+	// Same router, the session stays up.
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	if len(b.shutdowns) != 0 {
+		t.Fatalf("session restarted with the same router: %v", b.shutdowns)
+	}
+
+	var s *fakeSession
+	for _, p := range c.protocols[config.BGP].(*bgpController).peers {
+		if p.cfg.Interface == "swp1" {
+			s = p.bgp.(*fakeSession)
+		}
+	}
+	setEstablished := func(established bool) {
+		b.Lock()
+		s.established = established
+		b.Unlock()
+	}
+
+	// Once the session is established, the router is not looked
+	// for anymore, and a missed advertisement doesn't stop it.
+	setEstablished(true)
+	router, lookups = nil, 0
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	if lookups != 0 {
+		t.Errorf("looked for the router %d times with an established session", lookups)
+	}
+	if len(b.shutdowns) != 0 {
+		t.Fatalf("established session restarted: %v", b.shutdowns)
+	}
+
+	// The session went down and the router is silent, the last known
+	// address is kept.
+	setEstablished(false)
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed with a last known router")
+	}
+	if lookups != 1 {
+		t.Errorf("looked for the router %d times without an established session, want 1", lookups)
+	}
+	if _, ok := b.gotAds["[fe80::1%swp1]:0"]; !ok || len(b.shutdowns) != 0 {
+		t.Fatalf("session to the last known router stopped, got %v, shutdowns %v", b.gotAds, b.shutdowns)
+	}
+
+	// The router was replaced, the session moves to the new one.
+	router = net.ParseIP("fe80::3")
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	if _, ok := b.shutdowns["[fe80::1%swp1]:0"]; !ok {
+		t.Fatal("session not restarted after the router changed")
+	}
+	if _, ok := b.gotAds["[fe80::3%swp1]:0"]; !ok {
+		t.Fatalf("no session to the new router, got %v", b.gotAds)
+	}
+}
+
+func TestBGPPerNodeASN(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+	l := log.NewNopLogger()
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				MyASNLabel:    "example.com/rack-asn",
+				ASN:           65000,
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) != k8s.SyncStateError {
+		t.Fatal("SetConfig succeeded without the ASN label on the node")
+	}
+	if len(b.gotAds) != 0 {
+		t.Fatalf("session started without a local ASN: %v", b.gotAds)
+	}
+
+	setASN := func(asn string) {
+		node := &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "pandora",
+				Labels: map[string]string{"example.com/rack-asn": asn},
+			},
+		}
+		if c.SetNode(l, node) == k8s.SyncStateError {
+			t.Fatal("SetNode failed")
+		}
+	}
+
+	setASN("64512")
+	if got := b.myASNs["1.2.3.4:0"]; got != 64512 {
+		t.Fatalf("session started with local ASN %d, want 64512", got)
+	}
+
+	// The rack was renumbered, the session restarts with the new ASN.
+	setASN("64513")
+	if _, ok := b.shutdowns["1.2.3.4:0"]; !ok {
+		t.Fatal("session not restarted after the local ASN changed")
+	}
+	if got := b.myASNs["1.2.3.4:0"]; got != 64513 {
+		t.Fatalf("session restarted with local ASN %d, want 64513", got)
+	}
+}
+
+func TestPeerReconfiguration(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+	l := log.NewNopLogger()
+
+	peer := func(addr, desc string, hold time.Duration) *config.Peer {
+		return &config.Peer{
+			Addr:          net.ParseIP(addr),
+			HoldTime:      hold,
+			Description:   desc,
+			NodeSelectors: []labels.Selector{labels.Everything()},
+		}
+	}
+	pools := map[string]*config.Pool{
+		"default": {
+			Protocol: config.BGP,
+			CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+			BGPAdvertisements: []*config.BGPAdvertisement{
+				{
+					AggregationLength: 32,
+					Communities:       map[uint32]bool{1234: true},
+				},
+			},
+		},
+	}
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			peer("1.2.3.4", "tor-a", 90*time.Second),
+			peer("1.2.3.5", "tor-b", 90*time.Second),
+			peer("1.2.3.6", "tor-c", 90*time.Second),
+		},
+		Pools: pools,
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.5", NodeName: strptr("pandora")},
+				},
+			},
+		},
+	}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+
+	// tor-a is renamed and strips communities, which keeps its
+	// session. tor-b gets another hold time, which restarts its
+	// session. tor-c is replaced by tor-d.
+	filtered := peer("1.2.3.4", "tor-a1", 90*time.Second)
+	filtered.CommunityFilter = &config.CommunityFilter{StripAll: true}
+	cfg = &config.Config{
+		Peers: []*config.Peer{
+			filtered,
+			peer("1.2.3.5", "tor-b", 30*time.Second),
+			peer("1.2.3.7", "tor-d", 90*time.Second),
+		},
+		Pools: pools,
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+
+	wantSessions := map[string]int{
+		"1.2.3.4:0": 1,
+		"1.2.3.5:0": 2,
+		"1.2.3.6:0": 1,
+		"1.2.3.7:0": 1,
+	}
+	if diff := cmp.Diff(wantSessions, b.sessions); diff != "" {
+		t.Errorf("unexpected sessions (-want +got)\n%s", diff)
+	}
+	for _, addr := range []string{"1.2.3.5:0", "1.2.3.6:0"} {
+		if _, ok := b.shutdowns[addr]; !ok {
+			t.Errorf("session to %s not shut down", addr)
+		}
+	}
+	if _, ok := b.shutdowns["1.2.3.4:0"]; ok {
+		t.Errorf("session to 1.2.3.4 shut down, want it kept")
+	}
+
+	// The kept session gets the filtered advertisement right away.
+	want := []*bgp.Advertisement{
+		{
+			Prefix: ipnet("10.20.30.1/32"),
+		},
+	}
+	if diff := cmp.Diff(want, b.Ads()["1.2.3.4:0"]); diff != "" {
+		t.Errorf("unexpected advertisements to 1.2.3.4 (-want +got)\n%s", diff)
+	}
+}
+
+func TestHitlessAdvertisementChange(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+	l := log.NewNopLogger()
+
+	makeConfig := func(localPref, community uint32) *config.Config {
+		return &config.Config{
+			Peers: []*config.Peer{
+				{
+					Addr:          net.ParseIP("1.2.3.4"),
+					NodeSelectors: []labels.Selector{labels.Everything()},
+				},
+			},
+			Pools: map[string]*config.Pool{
+				"default": {
+					Protocol: config.BGP,
+					CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+					BGPAdvertisements: []*config.BGPAdvertisement{
+						{
+							AggregationLength: 32,
+							LocalPref:         localPref,
+							Communities:       map[uint32]bool{community: true},
+						},
+					},
+				},
+			},
+		}
+	}
+	if c.SetConfig(l, makeConfig(100, 1234)) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.5", NodeName: strptr("pandora")},
+				},
+			},
+		},
+	}
+	for i, ip := range []string{"10.20.30.1", "10.20.30.2"} {
+		svc := &v1.Service{
+			Spec: v1.ServiceSpec{
+				Type:                  "LoadBalancer",
+				ExternalTrafficPolicy: "Cluster",
+			},
+			Status: statusAssigned(ip),
+		}
+		if c.SetBalancer(l, fmt.Sprintf("test%d", i), svc, eps) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+	}
+
+	// The new attributes reach the peer without reprocessing the
+	// services, and without withdrawing their routes first.
+	if c.SetConfig(l, makeConfig(200, 5678)) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	want := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix:      ipnet("10.20.30.1/32"),
+				LocalPref:   200,
+				Communities: []uint32{5678},
+			},
+			{
+				Prefix:      ipnet("10.20.30.2/32"),
+				LocalPref:   200,
+				Communities: []uint32{5678},
+			},
+		},
+	}
+	gotAds := b.Ads()
+	sortAds(gotAds)
+	if diff := cmp.Diff(want, gotAds); diff != "" {
+		t.Errorf("unexpected advertisements (-want +got)\n%s", diff)
+	}
+	if n := b.withdrawn["1.2.3.4:0"]; n != 0 {
+		t.Errorf("%d prefixes withdrawn while changing their attributes, want none", n)
+	}
+}
+
+func TestPrefixLimit(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+		MaxPrefixes:   2,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+	l := log.NewNopLogger()
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+				MaxPrefixes:   1,
+			},
+			{
+				Addr:          net.ParseIP("1.2.3.5"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+				},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.5", NodeName: strptr("pandora")},
+				},
+			},
+		},
+	}
+	setService := func(name, ip string) {
+		svc := &v1.Service{
+			Spec: v1.ServiceSpec{
+				Type:                  "LoadBalancer",
+				ExternalTrafficPolicy: "Cluster",
+			},
+			Status: statusAssigned(ip),
+		}
+		if c.SetBalancer(l, name, svc, eps) == k8s.SyncStateError {
+			t.Fatalf("SetBalancer(%s) failed", name)
+		}
+	}
+	prefixes := func(addr string) []string {
+		var ret []string
+		for _, ad := range b.Ads()[addr] {
+			ret = append(ret, ad.Prefix.String())
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	setService("test1", "10.20.30.1")
+	setService("test3", "10.20.30.3")
+	setService("test2", "10.20.30.2")
+	if diff := cmp.Diff([]string{"10.20.30.1/32"}, prefixes("1.2.3.4:0")); diff != "" {
+		t.Errorf("unexpected prefixes with peer limit (-want +got)\n%s", diff)
+	}
+	// The node limit holds back test2, even though it sorts before
+	// test3, as test3 was advertised first.
+	if diff := cmp.Diff([]string{"10.20.30.1/32", "10.20.30.3/32"}, prefixes("1.2.3.5:0")); diff != "" {
+		t.Errorf("unexpected prefixes with node limit (-want +got)\n%s", diff)
+	}
+
+	// Withdrawing a service makes room for the held back ones.
+	if err := c.protocols[config.BGP].DeleteBalancer(l, "test1", "test"); err != nil {
+		t.Fatalf("DeleteBalancer: %s", err)
+	}
+	if diff := cmp.Diff([]string{"10.20.30.2/32"}, prefixes("1.2.3.4:0")); diff != "" {
+		t.Errorf("unexpected prefixes with peer limit after withdrawal (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"10.20.30.2/32", "10.20.30.3/32"}, prefixes("1.2.3.5:0")); diff != "" {
+		t.Errorf("unexpected prefixes with node limit after withdrawal (-want +got)\n%s", diff)
+	}
+}
+
+func TestLimitAds(t *testing.T) {
+	ads := []*bgp.Advertisement{
+		{Prefix: ipnet("10.20.30.1/32")},
+		{Prefix: ipnet("10.20.30.2/32")},
+		{Prefix: ipnet("10.20.30.2/32"), LocalPref: 100},
+		{Prefix: ipnet("10.20.30.3/32")},
+	}
+	advertised := func(pfx string) bool { return pfx == "10.20.30.3/32" }
+
+	got, held := limitAds(ads, advertised, 0)
+	if len(got) != len(ads) || held != 0 {
+		t.Errorf("without limit, got %d ads and %d held, want %d and 0", len(got), held, len(ads))
+	}
+
+	got, held = limitAds(ads, advertised, 2)
+	var pfxs []string
+	for _, ad := range got {
+		pfxs = append(pfxs, ad.Prefix.String())
+	}
+	// Duplicate prefixes only count once.
+	if diff := cmp.Diff([]string{"10.20.30.1/32", "10.20.30.3/32"}, pfxs); diff != "" {
+		t.Errorf("unexpected prefixes (-want +got)\n%s", diff)
+	}
+	if held != 1 {
+		t.Errorf("got %d prefixes held, want 1", held)
+	}
+}
+
+func TestUpdateSvcAdsMatchesUpdateAds(t *testing.T) {
+	pool := &config.Pool{
+		BGPAdvertisements: []*config.BGPAdvertisement{
+			{
+				AggregationLength: 32,
+				Communities:       map[uint32]bool{1234: true},
+			},
+			{
+				AggregationLength: 24,
+				LocalPref:         100,
+			},
+		},
+	}
+	until := time.Now().Add(time.Hour).Format(time.RFC3339)
+	plain := &v1.Service{}
+	blackholed := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{config.BlackholeAnnotation: until},
+		},
+	}
+
+	steps := []struct {
+		desc   string
+		svc    string
+		ip     string
+		svcObj *v1.Service
+		delete bool
+	}{
+		{desc: "first service", svc: "ns/a", ip: "10.20.30.1", svcObj: plain},
+		{desc: "service sharing the IP", svc: "ns/b", ip: "10.20.30.1", svcObj: plain},
+		{desc: "service in the same aggregate", svc: "ns/c", ip: "10.20.30.2", svcObj: plain},
+		{desc: "blackhole a shared IP", svc: "ns/b", ip: "10.20.30.1", svcObj: blackholed},
+		{desc: "delete service sharing the blackholed IP", svc: "ns/a", delete: true},
+		{desc: "move service to another aggregate", svc: "ns/c", ip: "10.20.40.2", svcObj: plain},
+		{desc: "end blackhole", svc: "ns/b", ip: "10.20.30.1", svcObj: plain},
+		{desc: "delete last service in aggregate", svc: "ns/b", delete: true},
+	}
+
+	for _, rtbh := range []bool{false, true} {
+		b := &fakeBGP{
+			t:      t,
+			gotAds: map[string][]*bgp.Advertisement{},
+		}
+		c := &bgpController{
+			svcAds:  map[string][]*bgp.Advertisement{},
+			podCIDR: ipnet("10.20.30.0/24"),
+		}
+		for _, cfg := range []*config.Peer{
+			{Addr: net.ParseIP("1.2.3.4")},
+			{
+				Addr:            net.ParseIP("1.2.3.5"),
+				AnnouncePodCIDR: true,
+				CommunityFilter: &config.CommunityFilter{Add: map[uint32]bool{5678: true}},
+			},
+			{Addr: net.ParseIP("1.2.3.6"), RTBH: rtbh},
+		} {
+			s, _ := b.New(nil, cfg.Addr.String(), 0, nil, 0, 0, "", "", bgp.SessionOptions{})
+			c.peers = append(c.peers, &peer{cfg: cfg, bgp: s, ads: map[string]*bgp.Advertisement{}})
+		}
+		l := log.NewNopLogger()
+		// As when the sessions come up.
+		if err := c.updateAds(l); err != nil {
+			t.Fatalf("rtbh=%v: updateAds: %s", rtbh, err)
+		}
+
+		for _, step := range steps {
+			var err error
+			if step.delete {
+				err = c.DeleteBalancer(l, step.svc, "test")
+			} else {
+				err = c.SetBalancer(l, step.svc, step.svcObj, net.ParseIP(step.ip), pool)
+			}
+			if err != nil {
+				t.Fatalf("rtbh=%v, %q: %s", rtbh, step.desc, err)
+			}
+			got := b.Ads()
+			sortAds(got)
+
+			if err := c.updateAds(l); err != nil {
+				t.Fatalf("rtbh=%v, %q: updateAds: %s", rtbh, step.desc, err)
+			}
+			want := b.Ads()
+			sortAds(want)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("rtbh=%v, %q: incremental advertisements differ from a full update (-want +got)\n%s", rtbh, step.desc, diff)
+			}
+		}
+	}
+}
+
+// nopSession is a session that drops updates, so that benchmarks only
+// measure the speaker.
+type nopSession struct{}
+
+func (nopSession) Close() error                                    { return nil }
+func (nopSession) Update([]*bgp.Advertisement, []*net.IPNet) error { return nil }
+func (nopSession) Shutdown(string) error                           { return nil }
+func (nopSession) Established() bool                               { return true }
+
+// BenchmarkSetBalancer measures the cost of announcing and withdrawing
+// one service while n others are announced.
+func BenchmarkSetBalancer(b *testing.B) {
+	pool := &config.Pool{
+		BGPAdvertisements: []*config.BGPAdvertisement{{AggregationLength: 32}},
+	}
+	svc := &v1.Service{}
+	l := log.NewNopLogger()
+	for _, n := range []int{100, 1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("services=%d", n), func(b *testing.B) {
+			c := &bgpController{
+				svcAds: map[string][]*bgp.Advertisement{},
+				peers: []*peer{
+					{cfg: &config.Peer{}, bgp: nopSession{}, ads: map[string]*bgp.Advertisement{}},
+				},
+			}
+			for i := 0; i < n; i++ {
+				ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+				if err := c.SetBalancer(l, fmt.Sprintf("ns/svc%d", i), svc, ip, pool); err != nil {
+					b.Fatalf("SetBalancer: %s", err)
+				}
+			}
+
+			ip := net.IPv4(10, 255, 0, 1)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var err error
+				if i%2 == 0 {
+					err = c.SetBalancer(l, "ns/extra", svc, ip, pool)
+				} else {
+					err = c.DeleteBalancer(l, "ns/extra", "benchmark")
+				}
+				if err != nil {
+					b.Fatalf("updating service: %s", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.universe.tf/metallb/internal/config"
+)
+
+// timeNow is overridden in tests.
+var timeNow = time.Now
+
+// flapDamper tracks how often the announcement of each service
+// changes, and holds announcements steady for services that flap too
+// much.
+type flapDamper struct {
+	// Protects damped, which is also read by the resync ticker.
+	mu      sync.Mutex
+	damped  map[string]time.Time   // service name -> end of damping
+	history map[string][]time.Time // service name -> recent changes
+}
+
+func newFlapDamper() *flapDamper {
+	return &flapDamper{
+		damped:  map[string]time.Time{},
+		history: map[string][]time.Time{},
+	}
+}
+
+// change is called when the announcement of name is about to change
+// at now. It returns true if the change must not happen because name
+// is damped, and started is true if damping began with this change.
+func (d *flapDamper) change(name string, cfg *config.FlapDamping, now time.Time) (damped, started bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if until, ok := d.damped[name]; ok {
+		if now.Before(until) {
+			return true, false
+		}
+		delete(d.damped, name)
+	}
+
+	var recent []time.Time
+	for _, t := range d.history[name] {
+		if now.Sub(t) < cfg.Window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= cfg.MaxFlaps {
+		d.damped[name] = now.Add(cfg.Hold)
+		delete(d.history, name)
+		return true, true
+	}
+	d.history[name] = append(recent, now)
+	return false, false
+}
+
+// expire ends all damping periods that are over at now, and returns
+// true if there were any, meaning the held services need
+// reprocessing.
+func (d *flapDamper) expire(now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ret := false
+	for name, until := range d.damped {
+		if !now.Before(until) {
+			delete(d.damped, name)
+			ret = true
+		}
+	}
+	return ret
+}
+
+// forget drops all state about name.
+func (d *flapDamper) forget(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.damped, name)
+	delete(d.history, name)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/layer2"
+)
+
+// Datapaths forwarding service traffic on the node, for --datapath.
+const (
+	datapathAuto      = "auto"
+	datapathKubeProxy = "kube-proxy"
+	datapathCilium    = "cilium"
+)
+
+// Where Cilium keeps its configuration.
+const (
+	ciliumNamespace = "kube-system"
+	ciliumConfigMap = "cilium-config"
+)
+
+// datapath is what forwards service traffic on the node, and what the
+// speaker can expect of it.
+type datapath struct {
+	name string
+	// Whether the health check node ports of services with the Local
+	// traffic policy are served.
+	healthCheckNodePorts bool
+	// Whether connections from the node itself to node ports and
+	// service IPs are load balanced.
+	hostReachable bool
+}
+
+var kubeProxyDatapath = datapath{
+	name:                 datapathKubeProxy,
+	healthCheckNodePorts: true,
+	hostReachable:        true,
+}
+
+// ciliumReplacesKubeProxy returns true if the Cilium configuration cfg
+// enables its full kube-proxy replacement, "strict" before Cilium 1.14
+// and "true" since. With "partial" or "probe", kube-proxy still
+// handles what Cilium doesn't.
+func ciliumReplacesKubeProxy(cfg map[string]string) bool {
+	switch cfg["kube-proxy-replacement"] {
+	case "strict", "true":
+		return true
+	}
+	return false
+}
+
+// ciliumDatapath returns what Cilium's kube-proxy replacement does
+// with the configuration cfg. Missing settings have Cilium's defaults.
+func ciliumDatapath(cfg map[string]string) datapath {
+	return datapath{
+		name:                 datapathCilium,
+		healthCheckNodePorts: cfg["enable-health-check-nodeport"] != "false",
+		// The socket load balancer translates connections made from
+		// the node. Versions without bpf-lb-sock always turn it on
+		// with the full kube-proxy replacement.
+		hostReachable: cfg["bpf-lb-sock"] != "false",
+	}
+}
+
+// detectDatapath returns the datapath of mode, one of the datapath
+// constants. Cilium is detected, and its configuration read, with
+// ciliumConfig, which returns nil if Cilium isn't installed.
+func detectDatapath(l log.Logger, mode string, ciliumConfig func() (map[string]string, error)) (datapath, error) {
+	switch mode {
+	case datapathKubeProxy:
+		return kubeProxyDatapath, nil
+	case datapathAuto, datapathCilium:
+	default:
+		return datapath{}, fmt.Errorf("unknown datapath %q, must be %q, %q or %q", mode, datapathAuto, datapathKubeProxy, datapathCilium)
+	}
+
+	cfg, err := ciliumConfig()
+	if err != nil {
+		if mode == datapathAuto {
+			l.Log("op", "detectDatapath", "error", err, "msg", "failed to read Cilium's configuration, assuming kube-proxy")
+			return kubeProxyDatapath, nil
+		}
+		l.Log("op", "detectDatapath", "error", err, "msg", "failed to read Cilium's configuration, assuming its defaults")
+		return ciliumDatapath(nil), nil
+	}
+	switch {
+	case mode == datapathAuto && !ciliumReplacesKubeProxy(cfg):
+		return kubeProxyDatapath, nil
+	case mode == datapathCilium && !ciliumReplacesKubeProxy(cfg):
+		l.Log("op", "detectDatapath", "msg", "Cilium's kube-proxy replacement doesn't seem enabled, assuming it is as requested")
+	}
+	return ciliumDatapath(cfg), nil
+}
+
+// hostAddressMode returns the --assign-ips-to-interface mode to use
+// with dp, given the requested mode. Cilium's kube-proxy replacement
+// only handles the traffic of service IPs that are addresses of the
+// node, and the dummy interface is the mode tested with it, so it is
+// turned on if unset, and the loopback interface is refused.
+func hostAddressMode(dp datapath, mode string) (string, error) {
+	if dp.name != datapathCilium {
+		return mode, nil
+	}
+	switch mode {
+	case "":
+		return layer2.HostDummy, nil
+	case layer2.HostDummy:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("--assign-ips-to-interface must be %q with Cilium's kube-proxy replacement, not %q", layer2.HostDummy, mode)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/layer2"
+)
+
+func TestDetectDatapath(t *testing.T) {
+	tests := []struct {
+		desc    string
+		mode    string
+		cfg     map[string]string
+		err     error
+		want    datapath
+		wantErr bool
+	}{
+		{
+			desc: "kube-proxy",
+			mode: datapathKubeProxy,
+			cfg:  map[string]string{"kube-proxy-replacement": "strict"},
+			want: kubeProxyDatapath,
+		},
+		{
+			desc: "auto without Cilium",
+			mode: datapathAuto,
+			want: kubeProxyDatapath,
+		},
+		{
+			desc: "auto with Cilium next to kube-proxy",
+			mode: datapathAuto,
+			cfg:  map[string]string{"kube-proxy-replacement": "partial"},
+			want: kubeProxyDatapath,
+		},
+		{
+			desc: "auto with Cilium's kube-proxy replacement",
+			mode: datapathAuto,
+			cfg:  map[string]string{"kube-proxy-replacement": "strict"},
+			want: datapath{name: datapathCilium, healthCheckNodePorts: true, hostReachable: true},
+		},
+		{
+			desc: "auto without access to Cilium's configuration",
+			mode: datapathAuto,
+			err:  errors.New("forbidden"),
+			want: kubeProxyDatapath,
+		},
+		{
+			desc: "Cilium with its socket load balancer and health check node ports off",
+			mode: datapathCilium,
+			cfg: map[string]string{
+				"kube-proxy-replacement":       "true",
+				"enable-health-check-nodeport": "false",
+				"bpf-lb-sock":                  "false",
+			},
+			want: datapath{name: datapathCilium},
+		},
+		{
+			desc: "Cilium without access to its configuration",
+			mode: datapathCilium,
+			err:  errors.New("forbidden"),
+			want: datapath{name: datapathCilium, healthCheckNodePorts: true, hostReachable: true},
+		},
+		{
+			desc:    "unknown",
+			mode:    "ipvs",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		got, err := detectDatapath(log.NewNopLogger(), test.mode, func() (map[string]string, error) {
+			return test.cfg, test.err
+		})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.desc, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestHostAddressMode(t *testing.T) {
+	cilium := ciliumDatapath(nil)
+	tests := []struct {
+		dp      datapath
+		mode    string
+		want    string
+		wantErr bool
+	}{
+		{dp: kubeProxyDatapath, mode: "", want: ""},
+		{dp: kubeProxyDatapath, mode: layer2.HostLoopback, want: layer2.HostLoopback},
+		{dp: cilium, mode: "", want: layer2.HostDummy},
+		{dp: cilium, mode: layer2.HostDummy, want: layer2.HostDummy},
+		{dp: cilium, mode: layer2.HostLoopback, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := hostAddressMode(test.dp, test.mode)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s, %q: got error %v, want error %v", test.dp.name, test.mode, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s, %q: got %q, want %q", test.dp.name, test.mode, got, test.want)
+		}
+	}
+}
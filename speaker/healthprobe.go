@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// healthProber checks that this node forwards the traffic of each
+// service, by probing the service through kube-proxy, or the datapath
+// replacing it, on this node, and withholds announcements of services
+// that failed threshold probes in a row. This catches kube-proxy
+// failing to program a service, which pod readiness doesn't show. A
+// nil prober considers every service healthy.
+type healthProber struct {
+	hostIP    string
+	interval  time.Duration
+	threshold int
+	// What forwards service traffic on the node, and so which
+	// probes work. Set before the prober runs.
+	datapath datapath
+	// check probes target, overridden in tests.
+	check func(target probeTarget) error
+
+	mu       sync.Mutex
+	targets  map[string]probeTarget // service name -> what to probe
+	failures map[string]int         // service name -> consecutive failed probes
+}
+
+// probeTarget is what to probe for a service.
+type probeTarget struct {
+	addr string
+	// If true, addr is kube-proxy's health check node port for a
+	// service with the Local traffic policy, which answers GET
+	// /healthz with 200 if the node has ready endpoints. Otherwise,
+	// addr is a TCP node port to connect to.
+	healthCheck bool
+}
+
+func newHealthProber(hostIP string, interval time.Duration, threshold int) *healthProber {
+	return &healthProber{
+		hostIP:    hostIP,
+		interval:  interval,
+		threshold: threshold,
+		datapath:  kubeProxyDatapath,
+		check:     checkTarget,
+		targets:   map[string]probeTarget{},
+		failures:  map[string]int{},
+	}
+}
+
+// targetFor returns what to probe for svc on the node with hostIP, or
+// false if svc can't be probed: it has no health check node port and
+// no TCP node port, or dp serves neither to the node itself.
+func targetFor(hostIP string, dp datapath, svc *v1.Service) (probeTarget, bool) {
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal && svc.Spec.HealthCheckNodePort != 0 && dp.healthCheckNodePorts {
+		return probeTarget{
+			addr:        net.JoinHostPort(hostIP, strconv.Itoa(int(svc.Spec.HealthCheckNodePort))),
+			healthCheck: true,
+		}, true
+	}
+	if !dp.hostReachable {
+		// Connections from the node to its node ports aren't load
+		// balanced, e.g. with Cilium's socket load balancer off.
+		return probeTarget{}, false
+	}
+	for _, p := range svc.Spec.Ports {
+		if (p.Protocol == v1.ProtocolTCP || p.Protocol == "") && p.NodePort != 0 {
+			return probeTarget{addr: net.JoinHostPort(hostIP, strconv.Itoa(int(p.NodePort)))}, true
+		}
+	}
+	return probeTarget{}, false
+}
+
+func checkTarget(target probeTarget) error {
+	if !target.healthCheck {
+		conn, err := net.DialTimeout("tcp", target.addr, 2*time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get("http://" + target.addr + "/healthz")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check answered %s", resp.Status)
+	}
+	return nil
+}
+
+// healthy records what to probe for svc, and returns false if its
+// probes failed too many times in a row.
+func (p *healthProber) healthy(name string, svc *v1.Service) bool {
+	if p == nil {
+		return true
+	}
+	target, ok := targetFor(p.hostIP, p.datapath, svc)
+	if !ok {
+		p.forget(name)
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.targets[name] != target {
+		// A new target gets a fresh start.
+		p.targets[name] = target
+		delete(p.failures, name)
+	}
+	return p.failures[name] < p.threshold
+}
+
+// forget stops probing name, which is no longer announced.
+func (p *healthProber) forget(name string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.targets, name)
+	delete(p.failures, name)
+}
+
+// run probes every service each interval, and calls onChange when a
+// service becomes unhealthy or recovers.
+func (p *healthProber) run(l log.Logger, onChange func()) {
+	for range time.Tick(p.interval) {
+		if p.probe(l) {
+			onChange()
+		}
+	}
+}
+
+// probe probes every service once, and returns true if any of them
+// became unhealthy or recovered.
+func (p *healthProber) probe(l log.Logger) bool {
+	p.mu.Lock()
+	targets := make(map[string]probeTarget, len(p.targets))
+	for name, t := range p.targets {
+		targets[name] = t
+	}
+	p.mu.Unlock()
+
+	// Probes run without the lock, so that slow probes don't hold up
+	// service updates.
+	errs := make(map[string]error, len(targets))
+	for name, t := range targets {
+		errs[name] = p.check(t)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := false
+	for name, err := range errs {
+		if p.targets[name] != targets[name] {
+			// The service changed while we were probing.
+			continue
+		}
+		was := p.failures[name]
+		if err == nil {
+			delete(p.failures, name)
+			if was >= p.threshold {
+				l.Log("event", "healthProbeRecovered", "service", name, "addr", targets[name].addr, "msg", "health probe succeeded, announcing again")
+				changed = true
+			}
+			continue
+		}
+		p.failures[name] = was + 1
+		if was+1 == p.threshold {
+			l.Log("event", "healthProbeFailed", "service", name, "addr", targets[name].addr, "error", err, "failures", was+1, "msg", "health probes failed, withdrawing announcements")
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestProbeTarget(t *testing.T) {
+	tests := []struct {
+		desc string
+		dp   *datapath
+		spec v1.ServiceSpec
+		want probeTarget
+		ok   bool
+	}{
+		{
+			desc: "first TCP node port",
+			spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{
+					{Protocol: v1.ProtocolUDP, Port: 53, NodePort: 30053},
+					{Protocol: v1.ProtocolTCP, Port: 53, NodePort: 30054},
+				},
+			},
+			want: probeTarget{addr: "10.0.0.1:30054"},
+			ok:   true,
+		},
+		{
+			desc: "health check node port with Local policy",
+			spec: v1.ServiceSpec{
+				ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal,
+				HealthCheckNodePort:   32000,
+				Ports: []v1.ServicePort{
+					{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080},
+				},
+			},
+			want: probeTarget{addr: "10.0.0.1:32000", healthCheck: true},
+			ok:   true,
+		},
+		{
+			desc: "Cilium without health check node ports",
+			dp:   &datapath{name: datapathCilium, hostReachable: true},
+			spec: v1.ServiceSpec{
+				ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal,
+				HealthCheckNodePort:   32000,
+				Ports: []v1.ServicePort{
+					{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080},
+				},
+			},
+			want: probeTarget{addr: "10.0.0.1:30080"},
+			ok:   true,
+		},
+		{
+			desc: "Cilium without the socket load balancer",
+			dp:   &datapath{name: datapathCilium, healthCheckNodePorts: true},
+			spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{
+					{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080},
+				},
+			},
+		},
+		{
+			desc: "UDP only",
+			spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{
+					{Protocol: v1.ProtocolUDP, Port: 53, NodePort: 30053},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		dp := kubeProxyDatapath
+		if test.dp != nil {
+			dp = *test.dp
+		}
+		got, ok := targetFor("10.0.0.1", dp, &v1.Service{Spec: test.spec})
+		if ok != test.ok || got != test.want {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.desc, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestHealthProber(t *testing.T) {
+	p := newHealthProber("10.0.0.1", 0, 2)
+	failing := map[string]bool{}
+	p.check = func(target probeTarget) error {
+		if failing[target.addr] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	}
+	l := log.NewNopLogger()
+
+	if !p.healthy("default/web", svc) {
+		t.Fatal("new service is unhealthy")
+	}
+	failing["10.0.0.1:30080"] = true
+	if p.probe(l) {
+		t.Error("one failed probe changed the health of the service")
+	}
+	if !p.healthy("default/web", svc) {
+		t.Error("service unhealthy after one failed probe")
+	}
+	if !p.probe(l) {
+		t.Error("second failed probe didn't change the health of the service")
+	}
+	if p.healthy("default/web", svc) {
+		t.Error("service healthy after two failed probes")
+	}
+	if p.probe(l) {
+		t.Error("third failed probe changed the health of the service again")
+	}
+
+	failing["10.0.0.1:30080"] = false
+	if !p.probe(l) {
+		t.Error("successful probe didn't change the health of the service")
+	}
+	if !p.healthy("default/web", svc) {
+		t.Error("service unhealthy after a successful probe")
+	}
+
+	p.forget("default/web")
+	if len(p.targets) != 0 || len(p.failures) != 0 {
+		t.Errorf("forgotten service still probed: %v, %v", p.targets, p.failures)
+	}
+}
@@ -29,9 +29,22 @@ import (
 type layer2Controller struct {
 	announcer *layer2.Announce
 	myNode    string
+	// If true, conntrack entries of IPs are flushed when this node
+	// starts or stops announcing them.
+	conntrack bool
+	// Host interfaces of the secondary networks pools may be bound
+	// to.
+	networks networkInterfaces
 }
 
-func (c *layer2Controller) SetConfig(log.Logger, *config.Config) error {
+func (c *layer2Controller) SetConfig(_ log.Logger, cfg *config.Config) error {
+	var netns []string
+	for _, p := range cfg.Pools {
+		if p.NetworkNamespace != "" {
+			netns = append(netns, p.NetworkNamespace)
+		}
+	}
+	c.announcer.SetNetworkNamespaces(netns)
 	return nil
 }
 
@@ -81,8 +94,25 @@ func (c *layer2Controller) ShouldAnnounce(l log.Logger, name string, svc *v1.Ser
 	return "notOwner"
 }
 
-func (c *layer2Controller) SetBalancer(l log.Logger, name string, lbIP net.IP, pool *config.Pool) error {
-	c.announcer.SetBalancer(name, lbIP)
+func (c *layer2Controller) SetBalancer(l log.Logger, name string, svc *v1.Service, lbIP net.IP, pool *config.Pool) error {
+	intf := ""
+	if pool.Network != nil {
+		var err error
+		if intf, err = c.networks.lookup(pool.Network); err != nil {
+			return err
+		}
+	}
+	takeover := !c.announcer.AnnounceName(name)
+	c.announcer.SetBalancer(name, lbIP, layer2.Options{
+		Interface:        intf,
+		NetworkNamespace: pool.NetworkNamespace,
+		VirtualMAC:       pool.VirtualMACFor(lbIP),
+		Unnumbered:       pool.Unnumbered,
+		SecondarySubnet:  pool.SecondarySubnet,
+	})
+	if takeover {
+		c.flush(l, lbIP, "takeover")
+	}
 	return nil
 }
 
@@ -90,10 +120,29 @@ func (c *layer2Controller) DeleteBalancer(l log.Logger, name, reason string) err
 	if !c.announcer.AnnounceName(name) {
 		return nil
 	}
+	ip := c.announcer.IP(name)
 	c.announcer.DeleteBalancer(name)
+	c.flush(l, ip, reason)
 	return nil
 }
 
+// flush deletes the conntrack entries of connections to ip, if
+// enabled. It runs in the background, since large conntrack tables
+// take a while to go through.
+func (c *layer2Controller) flush(l log.Logger, ip net.IP, reason string) {
+	if !c.conntrack || ip == nil {
+		return
+	}
+	go func() {
+		n, err := layer2.FlushConntrack(ip)
+		if err != nil {
+			l.Log("op", "flushConntrack", "ip", ip, "error", err, "msg", "failed to flush conntrack entries")
+			return
+		}
+		l.Log("event", "conntrackFlushed", "ip", ip, "entries", n, "reason", reason, "msg", "flushed conntrack entries of failed over IP")
+	}()
+}
+
 func (c *layer2Controller) SetNode(log.Logger, *v1.Node) error {
 	return nil
 }
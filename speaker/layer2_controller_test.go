@@ -11,6 +11,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func compareUseableNodesReturnedValue(a, b []string) bool {
@@ -883,3 +884,88 @@ func TestShouldAnnounce(t *testing.T) {
 		}
 	}
 }
+
+func TestDrainingNodeLayer2(t *testing.T) {
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.Layer2,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+			},
+		},
+	}
+	var cs []*controller
+	for _, node := range []string{"iris1", "iris2"} {
+		c, err := newController(controllerConfig{
+			MyNode: node,
+			Logger: l,
+		})
+		if err != nil {
+			t.Fatalf("creating controller: %s", err)
+		}
+		c.client = &testK8S{t: t}
+		if c.SetConfig(l, cfg) == k8s.SyncStateError {
+			t.Fatalf("SetConfig failed")
+		}
+		cs = append(cs, c)
+	}
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.5", NodeName: strptr("iris1")},
+					{IP: "2.3.4.15", NodeName: strptr("iris2")},
+				},
+			},
+		},
+	}
+	announcing := func() []bool {
+		var ret []bool
+		for _, c := range cs {
+			if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+				t.Fatalf("%s: SetBalancer failed", c.myNode)
+			}
+			ret = append(ret, c.announced["test1"][config.Layer2])
+		}
+		return ret
+	}
+
+	// iris2 wins the election, see TestShouldAnnounce.
+	if got := announcing(); got[0] || !got[1] {
+		t.Fatalf("before the drain, iris1 and iris2 announcing %v, want [false true]", got)
+	}
+
+	drained := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "iris2",
+			Annotations: map[string]string{k8s.DrainAnnotation: "speaker-1"},
+		},
+	}
+	cs[1].SetNode(l, drained)
+	for _, c := range cs {
+		if c.SetClusterNode(l, "iris2", drained) != k8s.SyncStateReprocessAll {
+			t.Errorf("%s: draining iris2 didn't reprocess services", c.myNode)
+		}
+	}
+	if got := announcing(); !got[0] || got[1] {
+		t.Errorf("while iris2 drains, iris1 and iris2 announcing %v, want [true false]", got)
+	}
+
+	undrained := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "iris2"}}
+	cs[1].SetNode(l, undrained)
+	for _, c := range cs {
+		c.SetClusterNode(l, "iris2", undrained)
+	}
+	if got := announcing(); got[0] || !got[1] {
+		t.Errorf("after the drain, iris1 and iris2 announcing %v, want [false true]", got)
+	}
+}
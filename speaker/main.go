@@ -17,19 +17,30 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"go.universe.tf/metallb/internal/bgp"
 	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/control"
+	"go.universe.tf/metallb/internal/debug"
 	"go.universe.tf/metallb/internal/k8s"
 	"go.universe.tf/metallb/internal/layer2"
 	"go.universe.tf/metallb/internal/logging"
+	"go.universe.tf/metallb/internal/secrets"
 	"go.universe.tf/metallb/internal/version"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/credentials"
 )
 
 var announcing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -62,15 +73,49 @@ func main() {
 	}
 
 	var (
-		myNode = flag.String("node-name", "", "name of this Kubernetes node")
-		host   = flag.String("host", "", "HTTP host address")
-		port   = flag.Int("port", 80, "HTTP listening port")
-		config = flag.String("config", "config", "Kubernetes ConfigMap containing MetalLB's configuration")
+		myNode       = flag.String("node-name", "", "name of this Kubernetes node")
+		host         = flag.String("host", "", "HTTP host address")
+		port         = flag.Int("port", 80, "HTTP listening port")
+		config       = flag.String("config", "config", "Kubernetes ConfigMap (or Secret, with --config-secret) containing MetalLB's configuration")
+		configSecret = flag.Bool("config-secret", false, "read the configuration from a Secret instead of a ConfigMap, for configurations with peer passwords or other sensitive data")
+		reloadToken  = flag.String("reload-token-file", "", "file holding a bearer token that authorizes POST /reload on the metrics port, to reload the configuration synchronously. The endpoint is disabled if empty, SIGHUP always reloads")
+		debugAddr    = flag.String("debug-addr", "", "address to serve pprof and expvar debug endpoints on (e.g. 127.0.0.1:6060), disabled if empty")
+		readyBGP     = flag.String("ready-bgp-sessions", "", "number of BGP sessions that must be established for the speaker to report ready, or \"all\" for every peer selected for this node. Readiness ignores BGP if empty")
+		bmpAddr      = flag.String("bmp-collector", "", "host:port of a BMP collector to stream BGP sessions and advertised routes to, disabled if empty")
+		l2Rate       = flag.Float64("layer2-reply-rate", 10, "maximum ARP/NDP replies per second to each requesting MAC address, 0 for no limit")
+		l2Burst      = flag.Int("layer2-reply-burst", 50, "number of ARP/NDP replies each requesting MAC address can get in a burst above --layer2-reply-rate")
+		fixNode      = flag.Bool("fix-node-settings", false, "at startup, fix node sysctls that break layer2 mode (arp_ignore and arp_announce with kube-proxy in IPVS mode, strict rp_filter) instead of only reporting them. Requires write access to /proc/sys")
+		l2Conntrack  = flag.Bool("layer2-flush-conntrack", false, "when this node starts or stops announcing a layer2 IP, delete the kernel's conntrack entries of connections to it, so that long-lived UDP flows don't stay pinned to the previous path")
+		waitNet      = flag.Bool("wait-node-network", false, "hold announcements after startup until the node is Ready, its CNI doesn't report the network as unavailable, and --kube-proxy-probe is reachable")
+		proxyAddr    = flag.String("kube-proxy-probe", "", "host:port of a service IP to connect to, to check that kube-proxy has programmed the node, with --wait-node-network. Defaults to the kubernetes API service. \"none\" skips the check")
+		bgpGrace     = flag.Duration("bgp-shutdown-grace-period", 5*time.Second, "on SIGTERM, how long to wait after withdrawing all BGP advertisements before closing the sessions, so that peers route around this node before it goes away. Must be shorter than the pod's termination grace period")
+		secondaryNet = flag.Bool("secondary-networks", false, "allow address pools and BGP peers to be bound to Multus secondary networks with their network setting. Requires the Multus NetworkAttachmentDefinition CRD")
+		shutdownMsg  = flag.String("bgp-shutdown-message", "shutting down", "reason given to BGP peers when closing sessions on SIGTERM. The shutdown communication (RFC 8203) is \"MetalLB speaker on node <node>: <reason>\", truncated to 128 bytes")
+		strictConfig = flag.Bool("strict-config", false, "reject configurations with warnings, like deprecated settings or suspicious values, instead of loading them")
+		vaultSocket  = flag.String("vault-agent-socket", "", "unix socket of a Vault agent, to read BGP passwords and IPAM credentials with source \"vault\" from Vault. Vault is disabled if empty")
+		probeEvery   = flag.Duration("health-probe-interval", 0, "how often to probe each service through kube-proxy on this node: its health check node port with the Local traffic policy, else its first TCP node port. Disabled if 0")
+		probeFails   = flag.Int("health-probe-failures", 3, "number of failed health probes in a row after which this node withdraws a service, with --health-probe-interval")
+		secretReload = flag.Duration("secret-refresh-interval", 0, "how often to reload the configuration and the credentials it refers to, so that rotated credentials take effect, 0 to only reload when the configuration changes")
+		maxPrefixes  = flag.Int("max-prefixes", 0, "most prefixes this node advertises over BGP. New advertisements beyond it are held back until others are withdrawn. No limit if 0, see also the max-prefixes of each peer")
+		maintAnnots  = flag.String("maintenance-node-annotations", "weave.works/kured-reboot-in-progress", "comma-separated node annotations that put a node in maintenance when set, e.g. by a reboot daemon, in addition to metallb.universe.tf/maintenance. Nodes in maintenance hand their announcements over to other nodes")
+		controlAddr  = flag.String("controller-address", "", "host:port of the controller's control channel, see the controller's --control-port, to report that this speaker is alive and what it announces. Disabled if empty")
+		controlToken = flag.String("control-token-file", "", "file holding the bearer token to send on the control channel, see the controller's --control-token-file. Requires --control-ca-file or --control-insecure")
+		controlCA    = flag.String("control-ca-file", "", "file holding the CA certificates to verify the TLS certificate of the control channel with, see the controller's --control-tls-cert-file. The control channel is plaintext if empty")
+		controlInsec = flag.Bool("control-insecure", false, "send the --control-token-file token over a plaintext control channel, where anyone on the network path can read it")
+		warmupPeriod = flag.Duration("warmup-period", 0, "after startup, and once the node network is ready with --wait-node-network, how long to spread BGP advertisements over before announcing all of them, and to leave layer2 IPs to other nodes, so that kube-proxy and the CNI can settle. Disabled if 0")
+		hostIPMode   = flag.String("assign-ips-to-interface", "", "add the IPs this node announces to a local interface, for datapaths that only handle traffic to local addresses, like eBPF datapaths replacing kube-proxy: \"dummy\" for the metallb-host dummy interface, or \"lo\" for the loopback interface, IPv4 only. Disabled if empty")
+		datapathMode = flag.String("datapath", datapathAuto, "what forwards service traffic on the node: \"kube-proxy\", \"cilium\" for Cilium's kube-proxy replacement, which needs --assign-ips-to-interface=dummy and turns it on if unset, or \"auto\" to detect Cilium's kube-proxy replacement from its kube-system/cilium-config ConfigMap")
+		reportEvery  = flag.Duration("control-report-interval", 10*time.Second, "how often to report to the controller on the control channel. Keep it well below the controller's --speaker-report-timeout")
 	)
 	flag.Parse()
 
 	logger.Log("version", version.Version(), "commit", version.CommitHash(), "branch", version.Branch(), "msg", "MetalLB speaker starting "+version.String())
 
+	debug.DumpOnSignal(logger, os.TempDir())
+	if *debugAddr != "" {
+		debug.Serve(logger, *debugAddr)
+	}
+
 	if *myNode == "" {
 		*myNode = os.Getenv("METALLB_NODE_NAME")
 	}
@@ -84,38 +129,272 @@ func main() {
 		os.Exit(1)
 	}
 
+	minSessions, err := parseReadyBGPSessions(*readyBGP)
+	if err != nil {
+		logger.Log("op", "startup", "error", err, "msg", "invalid --ready-bgp-sessions")
+		os.Exit(1)
+	}
+
+	var netGate *networkGate
+	if *waitNet {
+		netGate = &networkGate{probeAddr: *proxyAddr}
+		switch {
+		case *proxyAddr == "none":
+			netGate.probeAddr = ""
+		case *proxyAddr == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "":
+			netGate.probeAddr = net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+		}
+	}
+
+	var prober *healthProber
+	if *probeEvery > 0 {
+		hostIP := os.Getenv("METALLB_HOST")
+		if hostIP == "" || *probeFails < 1 {
+			logger.Log("op", "startup", "error", "health probes need the METALLB_HOST environment variable and --health-probe-failures of at least 1", "msg", "invalid configuration")
+			os.Exit(1)
+		}
+		prober = newHealthProber(hostIP, *probeEvery, *probeFails)
+	}
+
+	if *bmpAddr != "" {
+		bgp.ExportBMP(logger, *bmpAddr, *myNode)
+	}
+
+	var maintenanceAnnotations []string
+	for _, a := range strings.Split(*maintAnnots, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			maintenanceAnnotations = append(maintenanceAnnotations, a)
+		}
+	}
+
 	// Setup all clients and speakers, config decides what is being done runtime.
 	ctrl, err := newController(controllerConfig{
-		MyNode: *myNode,
-		Logger: logger,
+		MyNode:            *myNode,
+		Logger:            logger,
+		Layer2ReplyRate:   *l2Rate,
+		Layer2ReplyBurst:  *l2Burst,
+		Layer2Conntrack:   *l2Conntrack,
+		NetworkGate:       netGate,
+		HealthProber:      prober,
+		SecondaryNetworks: *secondaryNet,
+		MaxPrefixes:       *maxPrefixes,
+		WarmupPeriod:      *warmupPeriod,
+
+		MaintenanceAnnotations: maintenanceAnnotations,
 	})
 	if err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to create MetalLB controller")
 		os.Exit(1)
 	}
 
+	var setNetwork func(log.Logger, string, *unstructured.Unstructured) k8s.SyncState
+	if *secondaryNet {
+		setNetwork = ctrl.SetNetwork
+	}
+
+	secretProviders := map[string]secrets.Provider{}
+	if *vaultSocket != "" {
+		secretProviders[secrets.VaultSource] = secrets.Vault(*vaultSocket)
+	}
+
 	client, err := k8s.New(&k8s.Config{
-		ProcessName:   "metallb-speaker",
-		ConfigMapName: *config,
-		NodeName:      *myNode,
-		Logger:        logger,
+		ProcessName:     "metallb-speaker",
+		ConfigMapName:   *config,
+		ConfigSecret:    *configSecret,
+		StrictConfig:    *strictConfig,
+		ReloadTokenFile: *reloadToken,
+		NodeName:        *myNode,
+		Logger:          logger,
+
+		SecretProviders:       secretProviders,
+		SecretRefreshInterval: *secretReload,
 
 		MetricsHost:   *host,
 		MetricsPort:   *port,
 		ReadEndpoints: true,
+		Ready:         ctrl.readinessCheck(minSessions),
 
 		ServiceChanged: ctrl.SetBalancer,
 		ConfigChanged:  ctrl.SetConfig,
 		NodeChanged:    ctrl.SetNode,
+		NetworkChanged: setNetwork,
+
+		ClusterNodeChanged: ctrl.SetClusterNode,
 	})
 	if err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to create k8s client")
 	}
 	ctrl.client = client
+	// The datapath is only known once the client is up, but before it
+	// processes any events.
+	dp, err := detectDatapath(logger, *datapathMode, func() (map[string]string, error) {
+		return client.ConfigMapData(ciliumNamespace, ciliumConfigMap)
+	})
+	if err != nil {
+		logger.Log("op", "startup", "error", err, "msg", "invalid --datapath")
+		os.Exit(1)
+	}
+	logger.Log("op", "startup", "datapath", dp.name, "msg", "service datapath detected")
+	hostMode, err := hostAddressMode(dp, *hostIPMode)
+	if err != nil {
+		logger.Log("op", "startup", "error", err, "msg", "invalid --assign-ips-to-interface")
+		os.Exit(1)
+	}
+	if hostMode != *hostIPMode {
+		logger.Log("op", "startup", "mode", hostMode, "msg", "adding announced IPs to a local interface, for Cilium's kube-proxy replacement")
+	}
+	if hostMode != "" {
+		ctrl.hostIPs, err = layer2.NewHostAddresses(logger, hostMode)
+		if err != nil {
+			logger.Log("op", "startup", "error", err, "msg", "invalid --assign-ips-to-interface")
+			os.Exit(1)
+		}
+	}
+	if prober != nil {
+		prober.datapath = dp
+	}
+	if netGate != nil && *proxyAddr == "" && !dp.hostReachable {
+		// The node can't reach the kubernetes API service through
+		// the datapath, the gate would never open.
+		netGate.probeAddr = ""
+	}
+	// Annotate the node before processing events, so that no other
+	// speaker hands a layer2 IP over to us during the warm-up.
+	ctrl.warmup.hold(logger, func(value string) error {
+		return client.SetNodeAnnotation(*myNode, k8s.WarmupAnnotation, value)
+	}, time.Now())
+	// Tell the other speakers that this node may originate
+	// aggregates, until we shut down.
+	ctrl.speakers.hold(logger, func(value string) error {
+		return client.SetNodeAnnotation(*myNode, k8s.SpeakerAnnotation, value)
+	}, time.Now())
+	if l2, ok := ctrl.protocols[config.Layer2].(*layer2Controller); ok {
+		checker := &nodeChecker{
+			root:       "/proc/sys",
+			interfaces: hostInterfaces,
+		}
+		checkNode(logger, checker, func(reason, msg string) {
+			client.NodeErrorf(*myNode, reason, "%s", msg)
+		}, *fixNode)
+		// Re-evaluate announcements when interfaces come and go,
+		// rather than waiting for unrelated changes.
+		l2.announcer.OnInterfaceChange(client.ForceSync)
+	}
+	if netGate != nil {
+		go netGate.probe(logger, client.ForceSync)
+	}
+	if prober != nil {
+		go prober.run(logger, client.ForceSync)
+	}
+	go func() {
+		// Services held by flap damping or blackholed must be
+		// reprocessed once their hold or blackhole is over, and all
+		// services when maintenance windows open or close, while
+		// warming up and when speakers of other nodes expire, without
+		// waiting for them to change.
+		bgpCtrl := ctrl.protocols[config.BGP].(*bgpController)
+		for now := range time.Tick(10 * time.Second) {
+			if ctrl.damper.expire(now) || bgpCtrl.blackholesExpired(now) || ctrl.maintenance.update(logger, now) || ctrl.warmup.update(logger, now) || ctrl.speakers.update(logger, now) {
+				client.ForceSync()
+			}
+		}
+	}()
+
+	if *controlAddr != "" {
+		reporter := &control.Reporter{
+			Address:  *controlAddr,
+			Interval: *reportEvery,
+			Report: func() *control.Report {
+				var rep *control.Report
+				if err := client.Call(func() { rep = ctrl.controlReport(os.Getenv("METALLB_POD_NAME")) }); err != nil {
+					return nil
+				}
+				return rep
+			},
+		}
+		if *controlCA != "" {
+			creds, err := credentials.NewClientTLSFromFile(*controlCA, "")
+			if err != nil {
+				logger.Log("op", "startup", "error", err, "msg", "failed to read --control-ca-file")
+				os.Exit(1)
+			}
+			reporter.Creds = creds
+		}
+		if *controlToken != "" {
+			if *controlCA == "" && !*controlInsec {
+				logger.Log("op", "startup", "error", "--control-token-file without --control-ca-file", "msg", "refusing to send the bearer token over a plaintext control channel, set --control-ca-file, or --control-insecure if the network is trusted")
+				os.Exit(1)
+			}
+			token, err := ioutil.ReadFile(*controlToken)
+			if err != nil {
+				logger.Log("op", "startup", "error", err, "msg", "failed to read --control-token-file")
+				os.Exit(1)
+			}
+			reporter.Token = strings.TrimSpace(string(token))
+			reporter.Insecure = *controlInsec
+		}
+		go reporter.Run(logger)
+	}
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+	go func() {
+		<-term
+		logger.Log("event", "shutdownRequested", "msg", "received SIGTERM, shutting down")
+		client.Stop()
+	}()
 
 	if err := client.Run(); err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to run k8s client")
 	}
+	ctrl.speakers.release(logger)
+	ctrl.shutdown(logger, *bgpGrace, *shutdownMsg)
+}
+
+// parseReadyBGPSessions parses the --ready-bgp-sessions flag. It
+// returns 0 if readiness does not depend on BGP, and -1 if all
+// sessions must be established.
+func parseReadyBGPSessions(s string) (int, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "all":
+		return -1, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative number or \"all\"", s)
+	}
+	return n, nil
+}
+
+// readinessCheck returns a function that fails until at least
+// minSessions BGP sessions are established, or all sessions selected
+// for this node if minSessions is negative.
+func (c *controller) readinessCheck(minSessions int) func() error {
+	bgpc := c.protocols[config.BGP].(*bgpController)
+	return func() error {
+		if minSessions == 0 {
+			return nil
+		}
+		established, total := bgpc.sessionCounts()
+		want := minSessions
+		if want < 0 {
+			want = total
+		}
+		if established < want {
+			return fmt.Errorf("%d of %d BGP sessions established, need %d", established, total, want)
+		}
+		return nil
+	}
+}
+
+// shutdown withdraws everything this speaker announces over BGP, and
+// closes its BGP sessions after grace, see bgpController.shutdown.
+// IPs added to a local interface are deleted last.
+func (c *controller) shutdown(l log.Logger, grace time.Duration, reason string) {
+	c.protocols[config.BGP].(*bgpController).shutdown(l, grace, reason)
+	c.hostIPs.Close()
 }
 
 type controller struct {
@@ -124,56 +403,148 @@ type controller struct {
 	config *config.Config
 	client service
 
+	// draining is true while the controller has asked us to
+	// withdraw everything before restarting us.
+	draining bool
+	netGate  *networkGate
+	prober   *healthProber
+	// If non-nil, announced IPs are added to a local interface.
+	hostIPs *layer2.HostAddresses
+	// Host interfaces of the secondary networks, shared with the
+	// protocol handlers.
+	networks networkInterfaces
+
 	protocols map[config.Proto]Protocol
-	announced map[string]config.Proto // service name -> protocol advertising it
-	svcIP     map[string]net.IP       // service name -> assigned IP
+	announced map[string]map[config.Proto]bool // service name -> protocols advertising it
+	svcIP     map[string]net.IP                // service name -> assigned IP
+	damper    *flapDamper
+
+	// Services whose ClusterIP or ExternalIPs are announced.
+	serviceIPsAnnounced map[string]bool
+
+	// Labels of every node, for pools with a topology.
+	zones nodeZones
+	// Nodes being drained for a speaker restart, which don't take
+	// part in layer2 elections.
+	drainingNodes map[string]bool
+	// Nodes running a speaker, which may originate aggregates.
+	speakers *speakers
+	// Nodes in maintenance, which hand their announcements over.
+	maintenance *maintenance
+	// Ramps up announcements after startup.
+	warmup *warmup
 }
 
 type controllerConfig struct {
 	MyNode string
 	Logger log.Logger
 
+	// Rate limit of layer2 replies to each requester, see
+	// layer2.New.
+	Layer2ReplyRate  float64
+	Layer2ReplyBurst int
+	// If true, conntrack entries of layer2 IPs are flushed when this
+	// node starts or stops announcing them.
+	Layer2Conntrack bool
+
+	// If non-nil, holds announcements until the node's network is
+	// ready.
+	NetworkGate *networkGate
+	// If non-nil, withdraws announcements of services that this node
+	// fails to forward.
+	HealthProber *healthProber
+
+	// If true, pools and peers may be bound to Multus secondary
+	// networks, see SetNetwork.
+	SecondaryNetworks bool
+
+	// Most prefixes this node advertises over BGP, zero for no
+	// limit.
+	MaxPrefixes int
+
+	// How long to ramp up announcements after startup, see warmup.
+	WarmupPeriod time.Duration
+
+	// If non-nil, announced IPs are added to a local interface.
+	HostAddresses *layer2.HostAddresses
+
+	// Node annotations that put nodes in maintenance, in addition to
+	// k8s.MaintenanceAnnotation.
+	MaintenanceAnnotations []string
+
 	// For testing only, and will be removed in a future release.
 	// See: https://github.com/google/metallb/issues/152.
 	DisableLayer2 bool
 }
 
 func newController(cfg controllerConfig) (*controller, error) {
+	var networks networkInterfaces
+	if cfg.SecondaryNetworks {
+		networks = networkInterfaces{}
+	}
+
 	protocols := map[config.Proto]Protocol{
 		config.BGP: &bgpController{
-			logger: cfg.Logger,
-			myNode: cfg.MyNode,
-			svcAds: make(map[string][]*bgp.Advertisement),
+			logger:   cfg.Logger,
+			myNode:   cfg.MyNode,
+			svcAds:   make(map[string][]*bgp.Advertisement),
+			networks: networks,
+
+			maxPrefixes: cfg.MaxPrefixes,
 		},
 	}
 
 	if !cfg.DisableLayer2 {
-		a, err := layer2.New(cfg.Logger)
+		a, err := layer2.New(cfg.Logger, cfg.Layer2ReplyRate, cfg.Layer2ReplyBurst)
 		if err != nil {
 			return nil, fmt.Errorf("making layer2 announcer: %s", err)
 		}
 		protocols[config.Layer2] = &layer2Controller{
 			announcer: a,
 			myNode:    cfg.MyNode,
+			conntrack: cfg.Layer2Conntrack,
+			networks:  networks,
 		}
 		protocols[config.IPAM] = &layer2Controller{
 			announcer: a,
 			myNode:    cfg.MyNode,
+			conntrack: cfg.Layer2Conntrack,
+			networks:  networks,
 		}
 	}
 
 	ret := &controller{
 		myNode:    cfg.MyNode,
 		protocols: protocols,
-		announced: map[string]config.Proto{},
+		announced: map[string]map[config.Proto]bool{},
 		svcIP:     map[string]net.IP{},
+		damper:    newFlapDamper(),
+		netGate:   cfg.NetworkGate,
+		prober:    cfg.HealthProber,
+		hostIPs:   cfg.HostAddresses,
+		networks:  networks,
+
+		serviceIPsAnnounced: map[string]bool{},
+
+		zones:         nodeZones{},
+		drainingNodes: map[string]bool{},
+		speakers:      newSpeakers(),
+		maintenance:   newMaintenance(cfg.MaintenanceAnnotations),
+		warmup:        newWarmup(cfg.WarmupPeriod),
 	}
+	protocols[config.BGP].(*bgpController).canOriginate = ret.canOriginate
 
 	return ret, nil
 }
 
 func (c *controller) SetBalancer(l log.Logger, name string, svc *v1.Service, eps *v1.Endpoints) k8s.SyncState {
+	if st := c.setServiceIPs(l, name, svc, eps); st != k8s.SyncStateSuccess {
+		return st
+	}
+
 	if svc == nil {
+		c.damper.forget(name)
+		c.prober.forget(name)
 		return c.deleteBalancer(l, name, "serviceDeleted")
 	}
 
@@ -181,6 +552,7 @@ func (c *controller) SetBalancer(l log.Logger, name string, svc *v1.Service, eps
 	defer l.Log("event", "endUpdate", "msg", "end of service update")
 
 	if svc.Spec.Type != "LoadBalancer" {
+		c.prober.forget(name)
 		return c.deleteBalancer(l, name, "notLoadBalancer")
 	}
 
@@ -190,9 +562,30 @@ func (c *controller) SetBalancer(l log.Logger, name string, svc *v1.Service, eps
 	}
 
 	if len(svc.Status.LoadBalancer.Ingress) != 1 {
+		c.prober.forget(name)
 		return c.deleteBalancer(l, name, "noIPAllocated")
 	}
 
+	if c.draining {
+		return c.deleteBalancer(l, name, "nodeDraining")
+	}
+
+	if svc.Annotations[k8s.NamespaceFencedAnnotation] == "true" {
+		return c.deleteBalancer(l, name, "namespaceFenced")
+	}
+
+	if !c.netGate.isOpen(l) {
+		return c.deleteBalancer(l, name, "nodeNetworkNotReady")
+	}
+	c.warmup.begin(l, timeNow())
+
+	if !c.prober.healthy(name, svc) {
+		if len(c.announced[name]) > 0 {
+			c.client.Errorf(svc, "healthProbeFailed", "node %q failed %d health probes of the service in a row, withdrawing it", c.myNode, c.prober.threshold)
+		}
+		return c.deleteBalancer(l, name, "healthProbeFailed")
+	}
+
 	lbIP := net.ParseIP(svc.Status.LoadBalancer.Ingress[0].IP)
 	if lbIP == nil {
 		l.Log("op", "setBalancer", "error", fmt.Sprintf("invalid LoadBalancer IP %q", svc.Status.LoadBalancer.Ingress[0].IP), "msg", "invalid IP allocated by controller")
@@ -214,35 +607,124 @@ func (c *controller) SetBalancer(l log.Logger, name string, svc *v1.Service, eps
 		return c.deleteBalancer(l, name, "internalError")
 	}
 
-	if proto, ok := c.announced[name]; ok && proto != pool.Protocol {
-		if st := c.deleteBalancer(l, name, "protocolChanged"); st == k8s.SyncStateError {
+	// The controller reports an invalid protocol annotation on the
+	// service, so just announce with the pool's protocols.
+	protos, err := pool.ServiceProtocols(svc.Annotations)
+	if err != nil {
+		l.Log("op", "setBalancer", "error", err, "msg", "ignoring invalid protocol selection")
+	}
+	for proto := range c.announced[name] {
+		if !protoIn(protos, proto) {
+			if err := c.withdraw(l, name, proto, "protocolChanged"); err != nil {
+				return k8s.SyncStateError
+			}
+		}
+	}
+
+	// Each protocol decides independently whether this node announces
+	// the service, e.g. BGP from every node with a healthy endpoint
+	// while layer2 elects a single node.
+	for _, proto := range protos {
+		if st := c.announce(l, name, svc, eps, lbIP, pool, proto); st != k8s.SyncStateSuccess {
 			return st
 		}
 	}
 
-	l = log.With(l, "protocol", pool.Protocol)
-	handler := c.protocols[pool.Protocol]
+	return k8s.SyncStateSuccess
+}
+
+// protoIn returns true if proto is one of protos.
+func protoIn(protos []config.Proto, proto config.Proto) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// announce announces svc with proto if the protocol handler says
+// this node should, and withdraws it otherwise.
+func (c *controller) announce(l log.Logger, name string, svc *v1.Service, eps *v1.Endpoints, lbIP net.IP, pool *config.Pool, proto config.Proto) k8s.SyncState {
+	l = log.With(l, "protocol", proto)
+	handler := c.protocols[proto]
 	if handler == nil {
 		l.Log("bug", "true", "msg", "internal error: unknown balancer protocol!")
 		return c.deleteBalancer(l, name, "internalError")
 	}
 
-	if deleteReason := handler.ShouldAnnounce(l, name, svc, eps); deleteReason != "" {
-		return c.deleteBalancer(l, name, deleteReason)
+	var deleteReason string
+	if t := pool.Topology; t != nil && !t.Matches(c.zones[c.myNode]) {
+		deleteReason = "notInPoolTopology"
+	} else {
+		if t != nil && proto != config.BGP {
+			// Only nodes in the pool's zones take part in the
+			// election.
+			eps = c.zones.inZones(t, eps)
+		}
+		if avail, ok := c.maintenance.available(eps, c.zones, pool); ok {
+			// Nodes in maintenance hand their announcements over
+			// to the others, unless all nodes with endpoints are in
+			// maintenance.
+			if c.maintenance.covers(c.myNode, c.zones, pool) {
+				deleteReason = "nodeInMaintenance"
+			} else if proto != config.BGP {
+				eps = avail
+			}
+		}
+		if proto == config.BGP {
+			if deleteReason == "" && !c.warmup.admits(name, timeNow()) {
+				deleteReason = "warmingUp"
+			}
+		} else {
+			// Draining nodes withdraw everything, so they must not
+			// win elections.
+			eps = filterEndpoints(eps, func(node string) bool { return !c.drainingNodes[node] })
+			if avail, ok := c.warmup.available(eps); ok {
+				// Nodes warming up don't take layer2 IPs over yet.
+				eps = avail
+			}
+		}
+		if deleteReason == "" {
+			deleteReason = handler.ShouldAnnounce(l, name, svc, eps)
+		}
+	}
+	if fd := pool.FlapDamping; fd != nil && proto == config.BGP && (deleteReason == "") != c.announced[name][proto] {
+		damped, started := c.damper.change(name, fd, timeNow())
+		if started {
+			l.Log("event", "flapDamped", "hold", fd.Hold, "msg", "announcement is flapping, holding it steady")
+			c.client.Errorf(svc, "flapDamped", "announcement changed more than %d times in %s, holding it steady for %s", fd.MaxFlaps, fd.Window, fd.Hold)
+		}
+		if damped {
+			return k8s.SyncStateSuccess
+		}
 	}
 
-	if err := handler.SetBalancer(l, name, lbIP, pool); err != nil {
+	if deleteReason != "" {
+		if err := c.withdraw(l, name, proto, deleteReason); err != nil {
+			return k8s.SyncStateError
+		}
+		return k8s.SyncStateSuccess
+	}
+
+	// The IP must be local before traffic for it comes in.
+	if err := c.hostIPs.Add(name, lbIP); err != nil {
+		l.Log("op", "setBalancer", "error", err, "msg", "failed to add IP to local interface")
+		return k8s.SyncStateError
+	}
+	if err := handler.SetBalancer(l, name, svc, lbIP, pool); err != nil {
 		l.Log("op", "setBalancer", "error", err, "msg", "failed to announce service")
 		return k8s.SyncStateError
 	}
 
-	if c.announced[name] == "" {
-		c.announced[name] = pool.Protocol
+	if c.announced[name] == nil {
+		c.announced[name] = map[config.Proto]bool{}
 		c.svcIP[name] = lbIP
 	}
+	c.announced[name][proto] = true
 
 	announcing.With(prometheus.Labels{
-		"protocol": string(pool.Protocol),
+		"protocol": string(proto),
 		"service":  name,
 		"node":     c.myNode,
 		"ip":       lbIP.String(),
@@ -254,14 +736,23 @@ func (c *controller) SetBalancer(l log.Logger, name string, svc *v1.Service, eps
 }
 
 func (c *controller) deleteBalancer(l log.Logger, name, reason string) k8s.SyncState {
-	proto, ok := c.announced[name]
-	if !ok {
-		return k8s.SyncStateSuccess
+	for proto := range c.announced[name] {
+		if err := c.withdraw(l, name, proto, reason); err != nil {
+			return k8s.SyncStateError
+		}
+	}
+	return k8s.SyncStateSuccess
+}
+
+// withdraw stops announcing name with proto.
+func (c *controller) withdraw(l log.Logger, name string, proto config.Proto, reason string) error {
+	if !c.announced[name][proto] {
+		return nil
 	}
 
 	if err := c.protocols[proto].DeleteBalancer(l, name, reason); err != nil {
-		l.Log("op", "deleteBalancer", "error", err, "msg", "failed to clear balancer state")
-		return k8s.SyncStateError
+		l.Log("op", "deleteBalancer", "protocol", proto, "error", err, "msg", "failed to clear balancer state")
+		return err
 	}
 
 	announcing.Delete(prometheus.Labels{
@@ -270,12 +761,17 @@ func (c *controller) deleteBalancer(l log.Logger, name, reason string) k8s.SyncS
 		"node":     c.myNode,
 		"ip":       c.svcIP[name].String(),
 	})
-	delete(c.announced, name)
-	delete(c.svcIP, name)
-
-	l.Log("event", "serviceWithdrawn", "ip", c.svcIP[name], "reason", reason, "msg", "withdrawing service announcement")
+	l.Log("event", "serviceWithdrawn", "protocol", proto, "ip", c.svcIP[name], "reason", reason, "msg", "withdrawing service announcement")
 
-	return k8s.SyncStateSuccess
+	delete(c.announced[name], proto)
+	if len(c.announced[name]) == 0 {
+		if err := c.hostIPs.Delete(name); err != nil {
+			l.Log("op", "deleteBalancer", "error", err, "msg", "failed to delete IP from local interface")
+		}
+		delete(c.announced, name)
+		delete(c.svcIP, name)
+	}
+	return nil
 }
 
 func poolFor(pools map[string]*config.Pool, ip net.IP) string {
@@ -318,6 +814,7 @@ func (c *controller) SetConfig(l log.Logger, cfg *config.Config) k8s.SyncState {
 	}
 
 	c.config = cfg
+	c.maintenance.setConfig(l, cfg, timeNow())
 
 	return k8s.SyncStateReprocessAll
 }
@@ -329,14 +826,156 @@ func (c *controller) SetNode(l log.Logger, node *v1.Node) k8s.SyncState {
 			return k8s.SyncStateError
 		}
 	}
+
+	reprocess := c.netGate.setNode(l, node)
+	if c.netGate.isOpen(l) {
+		c.warmup.begin(l, timeNow())
+	}
+
+	draining := node.Annotations[k8s.DrainAnnotation] != ""
+	if draining != c.draining {
+		c.draining = draining
+		if draining {
+			l.Log("event", "nodeDraining", "msg", "node is being drained for a speaker restart, withdrawing all announcements")
+		} else {
+			l.Log("event", "nodeUndrained", "msg", "node drain finished, resuming announcements")
+		}
+		reprocess = true
+	}
+
+	if reprocess {
+		return k8s.SyncStateReprocessAll
+	}
 	return k8s.SyncStateSuccess
 }
 
+// SetClusterNode tracks the labels and the maintenance, warm-up,
+// drain and speaker annotations of any node of the cluster, and
+// reprocesses all services if that may move IPs of pools with a
+// topology, to or from nodes in maintenance, warming up or being
+// drained, or change the originators of aggregates.
+func (c *controller) SetClusterNode(l log.Logger, name string, node *v1.Node) k8s.SyncState {
+	warming := c.warmup.setNode(name, node, timeNow())
+	inMaintenance := c.maintenance.setNode(name, node)
+	draining := setAnnotated(c.drainingNodes, name, node, k8s.DrainAnnotation)
+	speaker := c.speakers.setNode(name, node, timeNow())
+	labels := c.zones.setNode(name, node)
+	switch {
+	case warming:
+		l.Log("event", "nodeWarmupChanged", "node", name, "warmingUp", c.warmup.isWarming(name), "msg", "node started or finished warming up, reevaluating layer2 elections")
+	case inMaintenance:
+		l.Log("event", "nodeMaintenanceChanged", "node", name, "inMaintenance", c.maintenance.annotated[name], "msg", "node maintenance annotation changed, moving announcements")
+	case draining:
+		l.Log("event", "nodeDrainChanged", "node", name, "draining", c.drainingNodes[name], "msg", "node started or finished draining for a speaker restart, reevaluating layer2 elections")
+	case speaker && usesAggregateOriginators(c.config):
+		l.Log("event", "nodeSpeakerChanged", "node", name, "running", c.speakers.isRunning(name), "msg", "speaker started or stopped on node, reevaluating aggregate originators")
+	case !labels:
+		return k8s.SyncStateSuccess
+	case !usesTopology(c.config) && !usesMaintenanceWindows(c.config) && !usesAggregateOriginators(c.config):
+		return k8s.SyncStateSuccess
+	default:
+		l.Log("event", "nodeLabelsChanged", "msg", "node labels changed, reevaluating pool topologies, maintenance windows and aggregate originators")
+	}
+	return k8s.SyncStateReprocessAll
+}
+
+// setAnnotated tracks in nodes whether the node name, nil if it was
+// deleted, has the annotation key, and returns true if that changed.
+func setAnnotated(nodes map[string]bool, name string, node *v1.Node, key string) bool {
+	annotated := node != nil && node.Annotations[key] != ""
+	if annotated == nodes[name] {
+		return false
+	}
+	if annotated {
+		nodes[name] = true
+	} else {
+		delete(nodes, name)
+	}
+	return true
+}
+
+// canOriginate returns true if the node name runs a speaker that
+// announces the IPs of pool, nil for service IPs, over BGP: one that
+// is not draining, warming up or in maintenance, on a node in the
+// pool's topology and selected by a peer.
+func (c *controller) canOriginate(name string, pool *config.Pool) bool {
+	if !c.speakers.isRunning(name) || c.drainingNodes[name] || c.warmup.isWarming(name) || c.config == nil {
+		return false
+	}
+	if pool == nil {
+		pool = &config.Pool{}
+	}
+	if t := pool.Topology; t != nil && !t.Matches(c.zones[name]) {
+		return false
+	}
+	if c.maintenance.covers(name, c.zones, pool) {
+		return false
+	}
+	for _, p := range c.config.Peers {
+		for _, ns := range p.NodeSelectors {
+			if ns.Matches(c.zones[name]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// usesAggregateOriginators returns true if an advertisement of cfg
+// elects the originators of its aggregates.
+func usesAggregateOriginators(cfg *config.Config) bool {
+	if cfg == nil {
+		return false
+	}
+	var ads []*config.BGPAdvertisement
+	for _, p := range cfg.Pools {
+		ads = append(ads, p.BGPAdvertisements...)
+	}
+	if cfg.ServiceIPs != nil {
+		ads = append(ads, cfg.ServiceIPs.BGPAdvertisements...)
+	}
+	for _, ad := range ads {
+		if ad.AggregateOriginators > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetNetwork tracks the host interface of a Multus secondary
+// network, and reapplies the configuration if pools or peers bound to
+// the network are affected.
+func (c *controller) SetNetwork(l log.Logger, key string, nad *unstructured.Unstructured) k8s.SyncState {
+	intf := ""
+	if nad != nil {
+		var err error
+		if intf, err = networkInterface(nad); err != nil {
+			l.Log("op", "setNetwork", "error", err, "msg", "cannot tell which host interface carries the network")
+		}
+	}
+	if intf == c.networks[key] {
+		return k8s.SyncStateSuccess
+	}
+	if intf == "" {
+		delete(c.networks, key)
+	} else {
+		c.networks[key] = intf
+	}
+	l.Log("event", "networkChanged", "interface", intf, "msg", "host interface of secondary network changed")
+
+	if c.config == nil || !usesNetwork(c.config, key) {
+		return k8s.SyncStateSuccess
+	}
+	// Sessions sourced from the network reconnect from the new
+	// interface, and services move to it when reprocessed.
+	return c.SetConfig(l, c.config)
+}
+
 // A Protocol can advertise an IP address.
 type Protocol interface {
 	SetConfig(log.Logger, *config.Config) error
 	ShouldAnnounce(log.Logger, string, *v1.Service, *v1.Endpoints) string
-	SetBalancer(log.Logger, string, net.IP, *config.Pool) error
+	SetBalancer(log.Logger, string, *v1.Service, net.IP, *config.Pool) error
 	DeleteBalancer(log.Logger, string, string) error
 	SetNode(log.Logger, *v1.Node) error
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+)
+
+// maintenance tracks which nodes are in maintenance, because a
+// maintenance window of the configuration is open for them, or
+// because they have one of the maintenance annotations, e.g. set by
+// a reboot daemon before it drains them. Nodes in maintenance hand
+// their announcements over to the nodes that aren't.
+type maintenance struct {
+	// Node annotations that put a node in maintenance when set, in
+	// addition to k8s.MaintenanceAnnotation.
+	annotations []string
+	// Nodes with one of the annotations. Only used from the sync
+	// goroutine.
+	annotated map[string]bool
+
+	// Protects the windows, which are also used by the resync
+	// ticker. global are the windows of the configuration, which
+	// apply to all pools, windows those and the windows of each
+	// pool.
+	mu      sync.Mutex
+	global  []*config.MaintenanceWindow
+	windows []*config.MaintenanceWindow
+	open    map[*config.MaintenanceWindow]bool
+}
+
+func newMaintenance(annotations []string) *maintenance {
+	return &maintenance{
+		annotations: append([]string{k8s.MaintenanceAnnotation}, annotations...),
+		annotated:   map[string]bool{},
+		open:        map[*config.MaintenanceWindow]bool{},
+	}
+}
+
+// setConfig tracks the maintenance windows of cfg, as of now.
+func (m *maintenance) setConfig(l log.Logger, cfg *config.Config, now time.Time) {
+	var global, windows []*config.MaintenanceWindow
+	if cfg != nil {
+		global = cfg.MaintenanceWindows
+		windows = append(windows, global...)
+		for _, p := range cfg.Pools {
+			windows = append(windows, p.MaintenanceWindows...)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.global = global
+	m.windows = windows
+	m.open = map[*config.MaintenanceWindow]bool{}
+	m.updateLocked(l, now)
+}
+
+// update opens and closes the maintenance windows at now, and
+// returns true if any did, meaning all services need reprocessing.
+func (m *maintenance) update(l log.Logger, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.updateLocked(l, now)
+}
+
+func (m *maintenance) updateLocked(l log.Logger, now time.Time) bool {
+	changed := false
+	for _, w := range m.windows {
+		active := w.Active(now)
+		if active == m.open[w] {
+			continue
+		}
+		changed = true
+		if active {
+			m.open[w] = true
+			l.Log("event", "maintenanceWindowOpened", "schedule", w.Schedule, "duration", w.Duration, "msg", "maintenance window opened, nodes in maintenance hand their announcements over")
+		} else {
+			delete(m.open, w)
+			l.Log("event", "maintenanceWindowClosed", "schedule", w.Schedule, "msg", "maintenance window closed")
+		}
+	}
+	return changed
+}
+
+// setNode tracks the maintenance annotations of the node name, nil
+// if it was deleted, and returns true if that changed whether it is
+// in maintenance.
+func (m *maintenance) setNode(name string, node *v1.Node) bool {
+	annotated := false
+	if node != nil {
+		for _, a := range m.annotations {
+			if node.Annotations[a] != "" {
+				annotated = true
+			}
+		}
+	}
+	if annotated == m.annotated[name] {
+		return false
+	}
+	if annotated {
+		m.annotated[name] = true
+	} else {
+		delete(m.annotated, name)
+	}
+	return true
+}
+
+// covers returns true if the node name, with the labels tracked in
+// zones, is in maintenance for the IPs of pool.
+func (m *maintenance) covers(name string, zones nodeZones, pool *config.Pool) bool {
+	if m == nil {
+		return false
+	}
+	if m.annotated[name] {
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.open) == 0 {
+		return false
+	}
+	for _, windows := range [][]*config.MaintenanceWindow{m.global, pool.MaintenanceWindows} {
+		for _, w := range windows {
+			if m.open[w] && w.Covers(zones[name]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// available returns the endpoints of eps that are on nodes not in
+// maintenance for the IPs of pool, and false if none of them is
+// ready, in which case nodes in maintenance keep announcing.
+func (m *maintenance) available(eps *v1.Endpoints, zones nodeZones, pool *config.Pool) (*v1.Endpoints, bool) {
+	ret := filterEndpoints(eps, func(node string) bool { return !m.covers(node, zones, pool) })
+	return ret, healthyEndpointExists(ret)
+}
+
+// filterEndpoints returns the endpoints of eps on nodes for which keep
+// returns true, and those without a node.
+func filterEndpoints(eps *v1.Endpoints, keep func(node string) bool) *v1.Endpoints {
+	ret := &v1.Endpoints{ObjectMeta: eps.ObjectMeta}
+	for _, subset := range eps.Subsets {
+		var addrs, notReady []v1.EndpointAddress
+		for _, ep := range subset.Addresses {
+			if ep.NodeName == nil || keep(*ep.NodeName) {
+				addrs = append(addrs, ep)
+			}
+		}
+		for _, ep := range subset.NotReadyAddresses {
+			if ep.NodeName == nil || keep(*ep.NodeName) {
+				notReady = append(notReady, ep)
+			}
+		}
+		if len(addrs)+len(notReady) > 0 {
+			ret.Subsets = append(ret.Subsets, v1.EndpointSubset{
+				Addresses:         addrs,
+				NotReadyAddresses: notReady,
+				Ports:             subset.Ports,
+			})
+		}
+	}
+	return ret
+}
+
+// usesMaintenanceWindows returns true if cfg or one of its pools has
+// maintenance windows.
+func usesMaintenanceWindows(cfg *config.Config) bool {
+	if cfg == nil {
+		return false
+	}
+	if len(cfg.MaintenanceWindows) > 0 {
+		return true
+	}
+	for _, p := range cfg.Pools {
+		if len(p.MaintenanceWindows) > 0 {
+			return true
+		}
+	}
+	return false
+}
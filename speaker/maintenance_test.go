@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestMaintenance(t *testing.T) {
+	l := log.NewNopLogger()
+	node := func(name string, annotations map[string]string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Labels:      map[string]string{"rack": name},
+				Annotations: annotations,
+			},
+		}
+	}
+	z := nodeZones{}
+	for _, n := range []string{"iris", "pandora", "rhea"} {
+		z.setNode(n, node(n, nil))
+	}
+
+	sched, err := config.ParseSchedule("0 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	window := func(rack string) *config.MaintenanceWindow {
+		sel, err := labels.Parse("rack=" + rack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &config.MaintenanceWindow{
+			Schedule:      sched,
+			Duration:      time.Hour,
+			Location:      time.UTC,
+			NodeSelectors: []labels.Selector{sel},
+		}
+	}
+	pool := &config.Pool{MaintenanceWindows: []*config.MaintenanceWindow{window("pandora")}}
+	other := &config.Pool{}
+	cfg := &config.Config{
+		MaintenanceWindows: []*config.MaintenanceWindow{window("iris")},
+		Pools:              map[string]*config.Pool{"pool": pool, "other": other},
+	}
+
+	m := newMaintenance([]string{"example.com/reboot"})
+	before := time.Date(2020, 1, 1, 1, 59, 0, 0, time.UTC)
+	m.setConfig(l, cfg, before)
+	for _, n := range []string{"iris", "pandora", "rhea"} {
+		if m.covers(n, z, pool) {
+			t.Errorf("%s in maintenance before the windows", n)
+		}
+	}
+
+	if !m.update(l, before.Add(time.Minute)) {
+		t.Fatal("windows didn't open")
+	}
+	if m.update(l, before.Add(2*time.Minute)) {
+		t.Fatal("windows changed while open")
+	}
+	tests := []struct {
+		node string
+		pool string
+		want bool
+	}{
+		{"iris", "pool", true},
+		{"iris", "other", true},
+		{"pandora", "pool", true},
+		{"pandora", "other", false},
+		{"rhea", "pool", false},
+	}
+	for _, test := range tests {
+		if got := m.covers(test.node, z, cfg.Pools[test.pool]); got != test.want {
+			t.Errorf("%s in maintenance for pool %s: got %v, want %v", test.node, test.pool, got, test.want)
+		}
+	}
+
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.5", NodeName: strptr("iris")},
+					{IP: "2.3.4.6", NodeName: strptr("pandora")},
+					{IP: "2.3.4.7", NodeName: strptr("rhea")},
+				},
+			},
+		},
+	}
+	want := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.7", NodeName: strptr("rhea")},
+				},
+			},
+		},
+	}
+	got, ok := m.available(eps, z, pool)
+	if !ok {
+		t.Fatal("no endpoints available outside maintenance")
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("endpoints outside maintenance (-want +got)\n%s", diff)
+	}
+
+	// Annotated nodes are in maintenance for all pools, at any time.
+	if !m.setNode("rhea", node("rhea", map[string]string{"example.com/reboot": "true"})) {
+		t.Fatal("annotating rhea didn't put it in maintenance")
+	}
+	if _, ok := m.available(eps, z, pool); ok {
+		t.Error("endpoints available with all nodes in maintenance")
+	}
+	if !m.update(l, before.Add(time.Hour+time.Minute)) {
+		t.Fatal("windows didn't close")
+	}
+	if m.covers("iris", z, pool) || !m.covers("rhea", z, other) {
+		t.Error("wrong nodes in maintenance after the windows closed")
+	}
+	if !m.setNode("rhea", node("rhea", map[string]string{k8s.MaintenanceAnnotation: ""})) {
+		t.Fatal("removing the annotation of rhea didn't take it out of maintenance")
+	}
+	if !m.setNode("iris", node("iris", map[string]string{k8s.MaintenanceAnnotation: "reboot"})) {
+		t.Fatal("MetalLB's own annotation didn't put iris in maintenance")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// networkGate holds all announcements after startup until the node
+// can forward traffic: the node is Ready, its CNI doesn't report the
+// network as unavailable, and kube-proxy has programmed service IPs.
+// Once open, the gate stays open. A nil gate is always open.
+type networkGate struct {
+	// Address of a service to connect to, to check that kube-proxy
+	// rules are in place. Empty to skip the check.
+	probeAddr string
+
+	// Only accessed from the sync goroutine.
+	nodeReady bool
+	open      bool
+
+	// Set once the probe succeeded, accessed atomically.
+	proxyReady int32
+}
+
+// nodeNetworkReady returns true if node is Ready and no CNI reports its
+// network as unavailable.
+func nodeNetworkReady(node *v1.Node) bool {
+	ready := false
+	for _, cond := range node.Status.Conditions {
+		switch cond.Type {
+		case v1.NodeReady:
+			ready = cond.Status == v1.ConditionTrue
+		case v1.NodeNetworkUnavailable:
+			if cond.Status == v1.ConditionTrue {
+				return false
+			}
+		}
+	}
+	return ready
+}
+
+// setNode updates the gate with the current state of our node, and
+// returns true if that changed whether the gate is open.
+func (g *networkGate) setNode(l log.Logger, node *v1.Node) bool {
+	if g == nil || g.open {
+		return false
+	}
+	ready := nodeNetworkReady(node)
+	if ready == g.nodeReady {
+		return false
+	}
+	g.nodeReady = ready
+	return g.isOpen(l)
+}
+
+// isOpen returns true if announcements are allowed.
+func (g *networkGate) isOpen(l log.Logger) bool {
+	if g == nil || g.open {
+		return true
+	}
+	if g.nodeReady && atomic.LoadInt32(&g.proxyReady) != 0 {
+		g.open = true
+		l.Log("event", "nodeNetworkReady", "msg", "node network is ready, enabling announcements")
+	}
+	return g.open
+}
+
+// probe connects to probeAddr until it succeeds, then calls
+// onReady.
+func (g *networkGate) probe(l log.Logger, onReady func()) {
+	if g.probeAddr != "" {
+		for attempt := 0; ; attempt++ {
+			conn, err := net.DialTimeout("tcp", g.probeAddr, 2*time.Second)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if attempt == 0 {
+				l.Log("op", "probeKubeProxy", "addr", g.probeAddr, "error", err, "msg", "service IP not reachable yet, holding announcements")
+			}
+			time.Sleep(2 * time.Second)
+		}
+		l.Log("event", "kubeProxyReady", "addr", g.probeAddr, "msg", "service IP reachable through kube-proxy")
+	}
+	atomic.StoreInt32(&g.proxyReady, 1)
+	onReady()
+}
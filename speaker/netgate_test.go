@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/metallb/internal/bgp"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func nodeWithConditions(conds ...v1.NodeCondition) *v1.Node {
+	return &v1.Node{
+		Status: v1.NodeStatus{
+			Conditions: conds,
+		},
+	}
+}
+
+func TestNodeNetworkReady(t *testing.T) {
+	ready := v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionTrue}
+	notReady := v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionFalse}
+	netUnavailable := v1.NodeCondition{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionTrue}
+	netAvailable := v1.NodeCondition{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionFalse}
+
+	tests := []struct {
+		desc string
+		node *v1.Node
+		want bool
+	}{
+		{"no conditions", nodeWithConditions(), false},
+		{"not ready", nodeWithConditions(notReady), false},
+		{"ready", nodeWithConditions(ready), true},
+		{"ready, network available", nodeWithConditions(ready, netAvailable), true},
+		{"ready, network unavailable", nodeWithConditions(ready, netUnavailable), false},
+	}
+	for _, test := range tests {
+		if got := nodeNetworkReady(test.node); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestNetworkGate(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	gate := &networkGate{}
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+		NetworkGate:   gate,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+				},
+			},
+		},
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:       "2.3.4.5",
+						NodeName: strptr("iris"),
+					},
+				},
+			},
+		},
+	}
+	withdrawn := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": nil,
+	}
+	announced := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix: ipnet("10.20.30.1/32"),
+			},
+		},
+	}
+	ready := nodeWithConditions(v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionTrue})
+	notReady := nodeWithConditions(v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionFalse})
+
+	l := log.NewNopLogger()
+	check := func(desc string, want map[string][]*bgp.Advertisement) {
+		t.Helper()
+		if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+			t.Fatalf("%s: SetBalancer failed", desc)
+		}
+		if diff := cmp.Diff(want, b.Ads()); diff != "" {
+			t.Errorf("%s: unexpected advertisement state (-want +got)\n%s", desc, diff)
+		}
+	}
+
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	if c.SetNode(l, notReady) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+	check("node not ready", withdrawn)
+
+	if st := c.SetNode(l, ready); st != k8s.SyncStateSuccess {
+		t.Errorf("node ready before kube-proxy, got sync state %v, want success", st)
+	}
+	check("kube-proxy not ready", withdrawn)
+
+	gate.probe(l, func() {})
+	check("node network ready", announced)
+
+	if st := c.SetNode(l, notReady); st != k8s.SyncStateSuccess {
+		t.Errorf("node not ready after gate opened, got sync state %v, want success", st)
+	}
+	check("gate stays open", announced)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"go.universe.tf/metallb/internal/config"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// hostInterfaceAnnotation on a NetworkAttachmentDefinition names the
+// host interface that carries the network, for CNI plugins whose
+// config doesn't say.
+const hostInterfaceAnnotation = "metallb.universe.tf/host-interface"
+
+// networkInterfaces maps the keys of Multus NetworkAttachmentDefinitions
+// to the host interfaces that carry them. nil means secondary networks
+// are disabled.
+type networkInterfaces map[string]string
+
+// lookup returns the host interface of the network ref.
+func (n networkInterfaces) lookup(ref *config.NetworkRef) (string, error) {
+	if n == nil {
+		return "", fmt.Errorf("network %q is configured, but secondary networks are disabled, start the speaker with --secondary-networks", ref)
+	}
+	intf, ok := n[ref.String()]
+	if !ok {
+		return "", fmt.Errorf("no host interface known for network %q, the NetworkAttachmentDefinition is missing or doesn't name one", ref)
+	}
+	return intf, nil
+}
+
+// usesNetwork returns true if a pool or peer of cfg is bound to the
+// network with the given key.
+func usesNetwork(cfg *config.Config, key string) bool {
+	for _, p := range cfg.Pools {
+		if p.Network != nil && p.Network.String() == key {
+			return true
+		}
+	}
+	for _, p := range cfg.Peers {
+		if p.Network != nil && p.Network.String() == key {
+			return true
+		}
+	}
+	return false
+}
+
+// cniPlugin holds the fields of CNI plugin configs that name the host
+// interface a secondary network attaches to.
+type cniPlugin struct {
+	Type string `json:"type"`
+	// macvlan and ipvlan.
+	Master string `json:"master"`
+	// bridge.
+	Bridge string `json:"bridge"`
+	// host-device.
+	Device string `json:"device"`
+}
+
+// hostInterface returns the host interface of p, or "" if p doesn't
+// attach to one we know of.
+func (p cniPlugin) hostInterface() string {
+	switch p.Type {
+	case "macvlan", "ipvlan":
+		return p.Master
+	case "bridge":
+		if p.Bridge == "" {
+			// The bridge plugin's default.
+			return "cni0"
+		}
+		return p.Bridge
+	case "host-device":
+		return p.Device
+	}
+	return ""
+}
+
+// networkInterface returns the host interface that carries the
+// secondary network described by nad.
+func networkInterface(nad *unstructured.Unstructured) (string, error) {
+	if intf := nad.GetAnnotations()[hostInterfaceAnnotation]; intf != "" {
+		return intf, nil
+	}
+	raw, _, err := unstructured.NestedString(nad.Object, "spec", "config")
+	if err != nil {
+		return "", fmt.Errorf("reading spec.config: %s", err)
+	}
+	if raw == "" {
+		return "", fmt.Errorf("no CNI config in spec.config, set the %s annotation", hostInterfaceAnnotation)
+	}
+	var conf struct {
+		cniPlugin
+		// Set instead when the config is a plugin list.
+		Plugins []cniPlugin `json:"plugins"`
+	}
+	if err := json.Unmarshal([]byte(raw), &conf); err != nil {
+		return "", fmt.Errorf("parsing CNI config: %s", err)
+	}
+	for _, p := range append([]cniPlugin{conf.cniPlugin}, conf.Plugins...) {
+		if intf := p.hostInterface(); intf != "" {
+			return intf, nil
+		}
+	}
+	return "", fmt.Errorf("cannot tell the host interface from the CNI config, set the %s annotation", hostInterfaceAnnotation)
+}
+
+// interfaceAddrs returns the addresses of the named interface.
+var interfaceAddrs = func(name string) ([]net.Addr, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return ifi.Addrs()
+}
+
+// sourceAddress returns the address of intf to connect to peer from:
+// the one on the same subnet as peer if any, else the first one of
+// peer's address family.
+func sourceAddress(intf string, peer net.IP) (net.IP, error) {
+	addrs, err := interfaceAddrs(intf)
+	if err != nil {
+		return nil, err
+	}
+	var ret net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() || (ipnet.IP.To4() == nil) != (peer.To4() == nil) {
+			continue
+		}
+		if ipnet.Contains(peer) {
+			return ipnet.IP, nil
+		}
+		if ret == nil {
+			ret = ipnet.IP
+		}
+	}
+	if ret == nil {
+		return nil, errors.New("interface has no usable address in the peer's address family")
+	}
+	return ret, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/bgp"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func nad(annotations map[string]string, cniConfig string) *unstructured.Unstructured {
+	ret := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "k8s.cni.cncf.io/v1",
+		"kind":       "NetworkAttachmentDefinition",
+		"metadata": map[string]interface{}{
+			"namespace": "storage",
+			"name":      "data-net",
+		},
+		"spec": map[string]interface{}{
+			"config": cniConfig,
+		},
+	}}
+	ret.SetAnnotations(annotations)
+	return ret
+}
+
+func TestNetworkInterface(t *testing.T) {
+	tests := []struct {
+		desc        string
+		annotations map[string]string
+		config      string
+		want        string
+	}{
+		{
+			desc:   "macvlan",
+			config: `{"cniVersion": "0.3.1", "type": "macvlan", "master": "eth1", "mode": "bridge"}`,
+			want:   "eth1",
+		},
+		{
+			desc:   "ipvlan",
+			config: `{"type": "ipvlan", "master": "bond0.100"}`,
+			want:   "bond0.100",
+		},
+		{
+			desc:   "bridge",
+			config: `{"type": "bridge", "bridge": "br-storage"}`,
+			want:   "br-storage",
+		},
+		{
+			desc:   "bridge with default name",
+			config: `{"type": "bridge"}`,
+			want:   "cni0",
+		},
+		{
+			desc:   "host-device",
+			config: `{"type": "host-device", "device": "ens4f1"}`,
+			want:   "ens4f1",
+		},
+		{
+			desc:   "plugin list",
+			config: `{"cniVersion": "0.4.0", "plugins": [{"type": "macvlan", "master": "eth2"}, {"type": "tuning"}]}`,
+			want:   "eth2",
+		},
+		{
+			desc:        "annotation",
+			annotations: map[string]string{hostInterfaceAnnotation: "ens5"},
+			config:      `{"type": "sriov"}`,
+			want:        "ens5",
+		},
+		{
+			desc:   "unknown plugin",
+			config: `{"type": "sriov"}`,
+		},
+		{
+			desc:   "macvlan without master",
+			config: `{"type": "macvlan"}`,
+		},
+		{
+			desc: "no config",
+		},
+		{
+			desc:   "invalid config",
+			config: `{"type": `,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := networkInterface(nad(test.annotations, test.config))
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: got interface %q, want error", test.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.desc, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got interface %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	defer func(f func(string) ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("10.0.0.5").To4(), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("192.168.50.5").To4(), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::5"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+
+	tests := []struct {
+		peer string
+		want string
+	}{
+		{"192.168.50.1", "192.168.50.5"},
+		{"10.0.0.1", "10.0.0.5"},
+		{"172.16.0.1", "10.0.0.5"},
+		{"2001:db8::1", "2001:db8::5"},
+		{"2001:db8:1::1", "2001:db8::5"},
+	}
+	for _, test := range tests {
+		got, err := sourceAddress("net1", net.ParseIP(test.peer))
+		if err != nil {
+			t.Errorf("peer %s: %s", test.peer, err)
+			continue
+		}
+		if !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("peer %s: got source address %s, want %s", test.peer, got, test.want)
+		}
+	}
+
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("10.0.0.5").To4(), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+	if got, err := sourceAddress("net1", net.ParseIP("2001:db8::1")); err == nil {
+		t.Errorf("got source address %s for IPv6 peer on IPv4-only interface, want error", got)
+	}
+}
+
+func TestBGPSecondaryNetwork(t *testing.T) {
+	defer func(f func(string) ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	addr := "192.168.50.5"
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		if name != "eth1" {
+			t.Errorf("looked up addresses of interface %q, want eth1", name)
+		}
+		return []net.Addr{&net.IPNet{IP: net.ParseIP(addr).To4(), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:            "pandora",
+		DisableLayer2:     true,
+		SecondaryNetworks: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+	l := log.NewNopLogger()
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("192.168.50.1"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+				Network:       &config.NetworkRef{Namespace: "storage", Name: "data-net"},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) != k8s.SyncStateError {
+		t.Fatal("SetConfig succeeded before the network is known")
+	}
+	if len(b.srcAddrs) != 0 {
+		t.Fatalf("sessions started without a source address: %v", b.srcAddrs)
+	}
+
+	// The k8s client retries the config once the network is known.
+	if c.SetNetwork(l, "storage/data-net", nad(nil, `{"type": "macvlan", "master": "eth1"}`)) == k8s.SyncStateError {
+		t.Fatal("SetNetwork failed")
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	if got := b.srcAddrs["192.168.50.1:0"]; !got.Equal(net.ParseIP(addr)) {
+		t.Fatalf("session source address is %s, want %s", got, addr)
+	}
+
+	// Same address, the session stays up.
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	if len(b.shutdowns) != 0 {
+		t.Fatalf("session restarted with the same source address: %v", b.shutdowns)
+	}
+
+	// Changed address, the session restarts from the new one.
+	addr = "192.168.50.6"
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	if _, ok := b.shutdowns["192.168.50.1:0"]; !ok {
+		t.Fatal("session not restarted after the source address changed")
+	}
+	if got := b.srcAddrs["192.168.50.1:0"]; !got.Equal(net.ParseIP(addr)) {
+		t.Fatalf("session source address is %s, want %s", got, addr)
+	}
+}
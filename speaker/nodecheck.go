@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var nodeCheckFailed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "metallb",
+	Subsystem: "speaker",
+	Name:      "node_check_failed",
+	Help:      "1 if a startup check found node settings that break layer2 mode, per check",
+}, []string{
+	"check",
+})
+
+func init() {
+	prometheus.MustRegister(nodeCheckFailed)
+}
+
+// ipvsInterface is the dummy interface kube-proxy in IPVS mode binds
+// all service IPs to.
+const ipvsInterface = "kube-ipvs0"
+
+// nodeProblem is a node setting that breaks layer2 mode.
+type nodeProblem struct {
+	// Name of the check, for metrics and events.
+	check string
+	msg   string
+	// The sysctls, relative to /proc/sys, and values that fix the
+	// problem.
+	fix map[string]int
+}
+
+// nodeChecker inspects the node's sysctls for settings that break
+// layer2 mode.
+type nodeChecker struct {
+	// Root of the sysctl tree, normally /proc/sys.
+	root string
+	// Returns the interfaces layer2 mode may announce on.
+	interfaces func() ([]string, error)
+}
+
+// sysctl returns the integer value of the sysctl at path, relative to
+// the root.
+func (n *nodeChecker) sysctl(path string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(n.root, path))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// hostInterfaces returns the interfaces that are up and have an IPv4
+// address, other than loopback and kube-proxy's dummy interface.
+// Those without an address, e.g. the veths of pods, don't receive
+// traffic for service IPs.
+func hostInterfaces() ([]string, error) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, intf := range ifs {
+		if intf.Flags&net.FlagUp == 0 || intf.Flags&net.FlagLoopback != 0 || intf.Name == ipvsInterface {
+			continue
+		}
+		addrs, err := intf.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				ret = append(ret, intf.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// ipvs returns true if kube-proxy runs in IPVS mode.
+func (n *nodeChecker) ipvs() bool {
+	_, err := os.Stat(filepath.Join(n.root, "net/ipv4/conf", ipvsInterface))
+	return err == nil
+}
+
+// check returns the problems with the node's settings.
+func (n *nodeChecker) check() ([]nodeProblem, error) {
+	ifaces, err := n.interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ret []nodeProblem
+	if n.ipvs() {
+		// Service IPs are bound to kube-ipvs0, so unless ARP is
+		// strict, every node answers ARP requests for them.
+		arpIgnore, err := n.sysctl("net/ipv4/conf/all/arp_ignore")
+		if err != nil {
+			return nil, err
+		}
+		if arpIgnore < 1 {
+			ret = append(ret, nodeProblem{
+				check: "ipvsArpIgnore",
+				msg:   fmt.Sprintf("kube-proxy runs in IPVS mode and net.ipv4.conf.all.arp_ignore is %d, all nodes will answer ARP requests for layer2 service IPs. Enable strictARP in kube-proxy, or set it to 1", arpIgnore),
+				fix:   map[string]int{"net/ipv4/conf/all/arp_ignore": 1},
+			})
+		}
+		arpAnnounce, err := n.sysctl("net/ipv4/conf/all/arp_announce")
+		if err != nil {
+			return nil, err
+		}
+		if arpAnnounce < 2 {
+			ret = append(ret, nodeProblem{
+				check: "ipvsArpAnnounce",
+				msg:   fmt.Sprintf("kube-proxy runs in IPVS mode and net.ipv4.conf.all.arp_announce is %d, nodes will use layer2 service IPs as the source of their ARP requests. Enable strictARP in kube-proxy, or set it to 2", arpAnnounce),
+				fix:   map[string]int{"net/ipv4/conf/all/arp_announce": 2},
+			})
+		}
+	}
+
+	// The kernel applies the larger of the "all" and per-interface
+	// rp_filter, so an interface is strict if the larger one is 1.
+	all, err := n.sysctl("net/ipv4/conf/all/rp_filter")
+	if err != nil {
+		return nil, err
+	}
+	fix := map[string]int{}
+	var strict []string
+	if all == 1 {
+		fix["net/ipv4/conf/all/rp_filter"] = 2
+	}
+	for _, iface := range ifaces {
+		v, err := n.sysctl("net/ipv4/conf/" + iface + "/rp_filter")
+		if err != nil {
+			// The interface went away.
+			continue
+		}
+		if v == 1 {
+			fix["net/ipv4/conf/"+iface+"/rp_filter"] = 2
+		}
+		if v == 1 || (all == 1 && v < 2) {
+			strict = append(strict, iface)
+		}
+	}
+	if len(strict) > 0 {
+		ret = append(ret, nodeProblem{
+			check: "strictReversePathFilter",
+			msg:   fmt.Sprintf("strict reverse path filtering (rp_filter=1) is enabled on %s, traffic to layer2 service IPs arriving on another interface than the route back to the client will be dropped. Set rp_filter to 2 (loose) or 0", strings.Join(strict, ", ")),
+			fix:   fix,
+		})
+	}
+	return ret, nil
+}
+
+// apply writes the sysctls that fix p.
+func (n *nodeChecker) apply(p nodeProblem) error {
+	for path, v := range p.fix {
+		if err := ioutil.WriteFile(filepath.Join(n.root, path), []byte(strconv.Itoa(v)), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNode looks for node settings that break layer2 mode, and
+// reports them in logs, metrics and events on the node. If fix is
+// true, it also corrects them.
+func checkNode(l log.Logger, n *nodeChecker, warn func(reason, msg string), fix bool) {
+	problems, err := n.check()
+	if err != nil {
+		l.Log("op", "checkNode", "error", err, "msg", "failed to check node settings for layer2 mode")
+		return
+	}
+	for _, check := range []string{"ipvsArpIgnore", "ipvsArpAnnounce", "strictReversePathFilter"} {
+		nodeCheckFailed.WithLabelValues(check).Set(0)
+	}
+	for _, p := range problems {
+		if fix {
+			if err := n.apply(p); err != nil {
+				l.Log("op", "checkNode", "check", p.check, "error", err, "msg", "failed to fix node settings")
+			} else {
+				l.Log("event", "nodeSettingsFixed", "check", p.check, "msg", "fixed node settings that break layer2 mode")
+				continue
+			}
+		}
+		l.Log("op", "checkNode", "check", p.check, "error", p.msg, "msg", "node settings break layer2 mode")
+		nodeCheckFailed.WithLabelValues(p.check).Set(1)
+		warn(strings.Title(p.check), p.msg)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// sysctlTree creates a sysctl tree under a temporary directory with
+// the given values, relative to net/ipv4/conf.
+func sysctlTree(t *testing.T, values map[string]int) string {
+	root, err := ioutil.TempDir("", "nodecheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, v := range values {
+		p := filepath.Join(root, "net/ipv4/conf", path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(strconv.Itoa(v)+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestNodeCheck(t *testing.T) {
+	defaults := map[string]int{
+		"all/arp_ignore":   0,
+		"all/arp_announce": 0,
+		"all/rp_filter":    0,
+		"eth0/rp_filter":   0,
+		"eth1/rp_filter":   0,
+	}
+
+	tests := []struct {
+		desc    string
+		values  map[string]int
+		want    []string
+		wantFix map[string]int
+	}{
+		{
+			desc: "iptables mode, loose rp_filter",
+		},
+		{
+			desc: "IPVS mode without strict ARP",
+			values: map[string]int{
+				"kube-ipvs0/rp_filter": 0,
+			},
+			want: []string{"ipvsArpAnnounce", "ipvsArpIgnore"},
+			wantFix: map[string]int{
+				"all/arp_ignore":   1,
+				"all/arp_announce": 2,
+			},
+		},
+		{
+			desc: "IPVS mode with strict ARP",
+			values: map[string]int{
+				"kube-ipvs0/rp_filter": 0,
+				"all/arp_ignore":       1,
+				"all/arp_announce":     2,
+			},
+		},
+		{
+			desc: "strict rp_filter on one interface",
+			values: map[string]int{
+				"eth1/rp_filter": 1,
+			},
+			want: []string{"strictReversePathFilter"},
+			wantFix: map[string]int{
+				"eth1/rp_filter": 2,
+			},
+		},
+		{
+			desc: "strict rp_filter on all",
+			values: map[string]int{
+				"all/rp_filter":  1,
+				"eth1/rp_filter": 2,
+			},
+			want: []string{"strictReversePathFilter"},
+			wantFix: map[string]int{
+				"all/rp_filter": 2,
+			},
+		},
+		{
+			desc: "strict rp_filter on an interface without addresses",
+			values: map[string]int{
+				"cali1234/rp_filter": 1,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		values := map[string]int{}
+		for k, v := range defaults {
+			values[k] = v
+		}
+		for k, v := range test.values {
+			values[k] = v
+		}
+		root := sysctlTree(t, values)
+		defer os.RemoveAll(root)
+
+		n := &nodeChecker{
+			root: root,
+			interfaces: func() ([]string, error) {
+				return []string{"eth0", "eth1"}, nil
+			},
+		}
+		problems, err := n.check()
+		if err != nil {
+			t.Fatalf("%s: check failed: %s", test.desc, err)
+		}
+		var got []string
+		for _, p := range problems {
+			got = append(got, p.check)
+		}
+		sort.Strings(got)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got problems %v, want %v", test.desc, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got problems %v, want %v", test.desc, got, test.want)
+			}
+		}
+
+		// Fixing leaves no problems, and only touches what's broken.
+		var warned []string
+		checkNode(log.NewNopLogger(), n, func(reason, msg string) {
+			warned = append(warned, reason)
+		}, true)
+		if len(warned) != 0 {
+			t.Errorf("%s: fixing failed, warned about %v", test.desc, warned)
+		}
+		for path, v := range values {
+			want := v
+			if fix, ok := test.wantFix[path]; ok {
+				want = fix
+			}
+			got, err := n.sysctl(filepath.Join("net/ipv4/conf", path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%s: %s is %d after fixing, want %d", test.desc, path, got, want)
+			}
+		}
+		problems, err = n.check()
+		if err != nil || len(problems) != 0 {
+			t.Errorf("%s: problems left after fixing: %v, %v", test.desc, problems, err)
+		}
+	}
+}
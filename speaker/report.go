@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sort"
+
+	"go.universe.tf/metallb/internal/control"
+)
+
+// controlReport returns what this speaker reports to the controller
+// over the control channel. It must run on the sync goroutine, see
+// k8s.Client.Call.
+func (c *controller) controlReport(pod string) *control.Report {
+	ret := &control.Report{
+		Node:     c.myNode,
+		Pod:      pod,
+		Draining: c.draining,
+	}
+	for name, protos := range c.announced {
+		for proto := range protos {
+			ret.Announcements = append(ret.Announcements, control.Announcement{
+				Service:  name,
+				IP:       c.svcIP[name].String(),
+				Protocol: string(proto),
+			})
+		}
+	}
+	sort.Slice(ret.Announcements, func(i, j int) bool {
+		a, b := ret.Announcements[i], ret.Announcements[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.Protocol < b.Protocol
+	})
+	return ret
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/control"
+)
+
+func TestControlReport(t *testing.T) {
+	c := &controller{
+		myNode:   "iris",
+		draining: true,
+		announced: map[string]map[config.Proto]bool{
+			"test/foo": {config.BGP: true, config.Layer2: true},
+			"test/bar": {config.BGP: true},
+		},
+		svcIP: map[string]net.IP{
+			"test/foo": net.ParseIP("1.2.3.4"),
+			"test/bar": net.ParseIP("1.2.3.5"),
+		},
+	}
+	want := &control.Report{
+		Node:     "iris",
+		Pod:      "speaker-1",
+		Draining: true,
+		Announcements: []control.Announcement{
+			{Service: "test/bar", IP: "1.2.3.5", Protocol: "bgp"},
+			{Service: "test/foo", IP: "1.2.3.4", Protocol: "bgp"},
+			{Service: "test/foo", IP: "1.2.3.4", Protocol: "layer2"},
+		},
+	}
+	if diff := cmp.Diff(want, c.controlReport("speaker-1")); diff != "" {
+		t.Errorf("report (-want +got)\n%s", diff)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/bgp"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+)
+
+// serviceIPsKey returns the key under which the BGP controller holds
+// the ClusterIP and ExternalIP advertisements of service name, next
+// to its LoadBalancer IP advertisements.
+func serviceIPsKey(name string) string {
+	return name + "#service-ips"
+}
+
+// serviceIPs returns the IPs of svc, other than its LoadBalancer IP,
+// that cfg asks to advertise. Only IPv4 addresses are returned, like
+// for LoadBalancer IPs.
+func serviceIPs(svc *v1.Service, cfg *config.ServiceIPs) []net.IP {
+	var ret []net.IP
+	add := func(s string) {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			ret = append(ret, ip)
+		}
+	}
+	if cfg.ClusterIPs {
+		add(svc.Spec.ClusterIP)
+	}
+	if cfg.ExternalIPs {
+		for _, ip := range svc.Spec.ExternalIPs {
+			add(ip)
+		}
+	}
+	return ret
+}
+
+// setServiceIPs advertises the ClusterIP and ExternalIPs of svc over
+// BGP if the config enables it and this node has endpoints for svc,
+// and withdraws them otherwise. svc is nil if name was deleted.
+func (c *controller) setServiceIPs(l log.Logger, name string, svc *v1.Service, eps *v1.Endpoints) k8s.SyncState {
+	handler, ok := c.protocols[config.BGP].(*bgpController)
+	if !ok {
+		return k8s.SyncStateSuccess
+	}
+
+	var (
+		ips    []net.IP
+		reason string
+	)
+	switch {
+	case svc == nil:
+		reason = "serviceDeleted"
+	case c.config == nil || c.config.ServiceIPs == nil:
+		reason = "notEnabled"
+	case c.draining:
+		reason = "nodeDraining"
+	case svc.Annotations[k8s.NamespaceFencedAnnotation] == "true":
+		reason = "namespaceFenced"
+	case !c.netGate.isOpen(l):
+		reason = "nodeNetworkNotReady"
+	default:
+		ips = serviceIPs(svc, c.config.ServiceIPs)
+		if len(ips) == 0 {
+			reason = "noServiceIPs"
+		} else {
+			reason = handler.ShouldAnnounce(l, name, svc, eps)
+		}
+	}
+
+	key := serviceIPsKey(name)
+	if reason != "" {
+		if !c.serviceIPsAnnounced[name] {
+			return k8s.SyncStateSuccess
+		}
+		if err := handler.DeleteBalancer(l, key, reason); err != nil {
+			l.Log("op", "deleteServiceIPs", "error", err, "msg", "failed to withdraw service IPs")
+			return k8s.SyncStateError
+		}
+		delete(c.serviceIPsAnnounced, name)
+		l.Log("event", "serviceIPsWithdrawn", "reason", reason, "msg", "withdrawing ClusterIP and ExternalIP announcements")
+		return k8s.SyncStateSuccess
+	}
+
+	handler.forgetAds(key)
+	var ads []*bgp.Advertisement
+	for _, ip := range ips {
+		ads = append(ads, handler.makeAds(ip, c.config.ServiceIPs.BGPAdvertisements, handler.originatorCandidates(usableNodes(eps), nil), countEndpoints(eps, c.myNode))...)
+	}
+	handler.svcAds[key] = ads
+	if err := handler.updateSvcAds(l, key); err != nil {
+		l.Log("op", "setServiceIPs", "error", err, "msg", "failed to announce service IPs")
+		return k8s.SyncStateError
+	}
+	if !c.serviceIPsAnnounced[name] {
+		c.serviceIPsAnnounced[name] = true
+		l.Log("event", "serviceIPsAnnounced", "ips", len(ips), "msg", "announcing ClusterIP and ExternalIPs")
+	}
+	return k8s.SyncStateSuccess
+}
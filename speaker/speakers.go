@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+)
+
+// speakers tracks the nodes that run a speaker, which may originate
+// aggregates, from k8s.SpeakerAnnotation, and keeps the annotation
+// of our node.
+//
+// The annotation holds the time until which the speaker runs at
+// least, and is renewed while it does. A speaker that crashes or is
+// killed without clearing it stops being elected once it expires, so
+// that the aggregates it would originate move to other nodes.
+type speakers struct {
+	// Protects all the state, which is also used by the resync
+	// ticker.
+	mu sync.Mutex
+	// Ends of the leases of the nodes running a speaker.
+	running map[string]time.Time
+	// Sets the annotation of our node, nil if it isn't set.
+	annotate func(value string) error
+	// End of the lease in the annotation of our node.
+	end time.Time
+}
+
+// speakerLease is how long the annotation of a node keeps it
+// eligible to originate aggregates. It is renewed halfway through.
+const speakerLease = 2 * time.Minute
+
+func newSpeakers() *speakers {
+	return &speakers{
+		running: map[string]time.Time{},
+	}
+}
+
+// hold annotates our node with annotate at now, to tell the other
+// speakers that it may originate aggregates.
+func (s *speakers) hold(l log.Logger, annotate func(value string) error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end := now.Add(speakerLease)
+	if err := annotate(warmupDeadline(end)); err != nil {
+		l.Log("op", "startup", "error", err, "msg", "failed to annotate node, other speakers won't elect it to originate aggregates")
+		return
+	}
+	s.annotate, s.end = annotate, end
+}
+
+// release clears the annotation of our node, so that the other
+// speakers take over the aggregates while our sessions wind down.
+func (s *speakers) release(l log.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.annotate == nil {
+		return
+	}
+	if err := s.annotate(""); err != nil {
+		l.Log("op", "shutdown", "error", err, "msg", "failed to clear node annotation, other speakers ignore it once it expires")
+	}
+	s.annotate = nil
+}
+
+// update renews the annotation of our node at now if half of its
+// lease is over, and forgets the nodes whose lease expired. It
+// returns true if any did, meaning all services need reprocessing.
+func (s *speakers) update(l log.Logger, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.annotate != nil && s.end.Sub(now) < speakerLease/2 {
+		end := now.Add(speakerLease)
+		if err := s.annotate(warmupDeadline(end)); err != nil {
+			l.Log("op", "renewSpeaker", "error", err, "msg", "failed to renew node annotation, will retry")
+		} else {
+			s.end = end
+		}
+	}
+	changed := false
+	for name, end := range s.running {
+		if !now.Before(end) {
+			delete(s.running, name)
+			changed = true
+			l.Log("event", "nodeSpeakerExpired", "node", name, "msg", "speaker annotation of node expired, reevaluating aggregate originators")
+		}
+	}
+	return changed
+}
+
+// setNode tracks the speaker annotation of the node name at now, nil
+// if it was deleted, and returns true if that changed whether the
+// node runs a speaker. Annotations that expired, or hold no deadline,
+// are ignored.
+func (s *speakers) setNode(name string, node *v1.Node, now time.Time) bool {
+	var end time.Time
+	if node != nil {
+		end, _ = time.Parse(time.RFC3339, node.Annotations[k8s.SpeakerAnnotation])
+	}
+	running := now.Before(end)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, was := s.running[name]
+	if running {
+		s.running[name] = end
+	} else {
+		delete(s.running, name)
+	}
+	return running != was
+}
+
+// isRunning returns true if the node name runs a speaker.
+func (s *speakers) isRunning(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.running[name]
+	return ok
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSpeakers(t *testing.T) {
+	l := log.NewNopLogger()
+	s := newSpeakers()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var annotations []string
+	var fail error
+	annotate := func(value string) error {
+		if fail != nil {
+			return fail
+		}
+		annotations = append(annotations, value)
+		return nil
+	}
+
+	// The annotation of our node is renewed halfway through its
+	// lease, and retried if that fails.
+	s.hold(l, annotate, start)
+	s.update(l, start.Add(50*time.Second))
+	fail = errors.New("forbidden")
+	s.update(l, start.Add(70*time.Second))
+	fail = nil
+	s.update(l, start.Add(80*time.Second))
+	s.release(l)
+	want := []string{"2020-01-01T00:02:00Z", "2020-01-01T00:03:20Z", ""}
+	if diff := cmp.Diff(want, annotations); diff != "" {
+		t.Errorf("node annotations (-want +got)\n%s", diff)
+	}
+
+	node := func(value string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "iris", Annotations: map[string]string{k8s.SpeakerAnnotation: value}}}
+	}
+	if s.setNode("iris", node("speaker-1"), start) {
+		t.Error("annotation without a deadline counted as running")
+	}
+	if s.setNode("iris", node("2019-12-31T23:59:00Z"), start) {
+		t.Error("expired annotation counted as running")
+	}
+	if !s.setNode("iris", node("2020-01-01T00:02:00Z"), start) || !s.isRunning("iris") {
+		t.Fatal("annotated node not running")
+	}
+	if s.update(l, start.Add(time.Minute)) {
+		t.Error("lease expired early")
+	}
+	// A speaker that died keeps its annotation, until it expires.
+	if !s.update(l, start.Add(2*time.Minute)) || s.isRunning("iris") {
+		t.Error("expired lease still running")
+	}
+	if s.setNode("iris", nil, start.Add(2*time.Minute)) {
+		t.Error("deleting a node that no longer ran a speaker changed it")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"go.universe.tf/metallb/internal/config"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// nodeZones tracks the labels of every node of the cluster, to only
+// announce the IPs of pools with a topology from nodes in the pool's
+// zones.
+type nodeZones map[string]labels.Set
+
+// setNode tracks the labels of the node name, nil if it was deleted,
+// and returns true if they changed.
+func (z nodeZones) setNode(name string, node *v1.Node) bool {
+	if node == nil {
+		_, ok := z[name]
+		delete(z, name)
+		return ok
+	}
+	l, ok := z[name]
+	if ok && labels.Equals(l, labels.Set(node.Labels)) {
+		return false
+	}
+	z[name] = labels.Set(node.Labels)
+	return true
+}
+
+// inZones returns the endpoints of eps on nodes in t's zones, so that
+// the layer2 election only runs between those nodes.
+func (z nodeZones) inZones(t *config.Topology, eps *v1.Endpoints) *v1.Endpoints {
+	ret := &v1.Endpoints{ObjectMeta: eps.ObjectMeta}
+	for _, subset := range eps.Subsets {
+		var addrs []v1.EndpointAddress
+		for _, ep := range subset.Addresses {
+			if ep.NodeName != nil && t.Matches(z[*ep.NodeName]) {
+				addrs = append(addrs, ep)
+			}
+		}
+		if len(addrs) > 0 {
+			ret.Subsets = append(ret.Subsets, v1.EndpointSubset{
+				Addresses: addrs,
+				Ports:     subset.Ports,
+			})
+		}
+	}
+	return ret
+}
+
+// usesTopology returns true if a pool of cfg has a topology.
+func usesTopology(cfg *config.Config) bool {
+	if cfg == nil {
+		return false
+	}
+	for _, p := range cfg.Pools {
+		if p.Topology != nil {
+			return true
+		}
+	}
+	return false
+}
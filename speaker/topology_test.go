@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/metallb/internal/config"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodeZones(t *testing.T) {
+	node := func(name, zone string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{config.DefaultTopologyKey: zone},
+			},
+		}
+	}
+	z := nodeZones{}
+	if !z.setNode("iris", node("iris", "a")) {
+		t.Errorf("adding iris didn't change the zones")
+	}
+	if z.setNode("iris", node("iris", "a")) {
+		t.Errorf("unchanged iris changed the zones")
+	}
+	z.setNode("pandora", node("pandora", "b"))
+	z.setNode("rhea", node("rhea", "a"))
+	if !z.setNode("rhea", nil) {
+		t.Errorf("deleting rhea didn't change the zones")
+	}
+
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.5", NodeName: strptr("iris")},
+					{IP: "2.3.4.6", NodeName: strptr("pandora")},
+					{IP: "2.3.4.7", NodeName: strptr("rhea")},
+				},
+			},
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.8", NodeName: strptr("pandora")},
+				},
+			},
+		},
+	}
+	want := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.5", NodeName: strptr("iris")},
+				},
+			},
+		},
+	}
+	got := z.inZones(&config.Topology{Key: config.DefaultTopologyKey, Zones: []string{"a"}}, eps)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("endpoints in zone a (-want +got)\n%s", diff)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mdlayher/ndp"
+)
+
+// routerAdvertisementTimeout is how long to wait for the router of an
+// unnumbered link to advertise itself.
+const routerAdvertisementTimeout = 5 * time.Second
+
+// linkLocalRouter returns the link-local address of the router on the
+// unnumbered link intf, from the router advertisements it sends.
+// Routers peering over unnumbered links advertise themselves
+// periodically, soliciting an advertisement saves waiting for the
+// next one.
+var linkLocalRouter = func(intf string) (net.IP, error) {
+	ifi, err := net.InterfaceByName(intf)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := ndp.Dial(ifi, ndp.LinkLocal)
+	if err != nil {
+		return nil, fmt.Errorf("listening for router advertisements on %q: %s", intf, err)
+	}
+	defer conn.Close()
+
+	rs := &ndp.RouterSolicitation{}
+	// Point-to-point links, such as tunnels, have no link-layer
+	// address to give.
+	if len(ifi.HardwareAddr) > 0 {
+		rs.Options = append(rs.Options, &ndp.LinkLayerAddress{
+			Direction: ndp.Source,
+			Addr:      ifi.HardwareAddr,
+		})
+	}
+	if err := conn.WriteTo(rs, nil, net.IPv6linklocalallrouters); err != nil {
+		return nil, fmt.Errorf("soliciting router advertisement on %q: %s", intf, err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(routerAdvertisementTimeout)); err != nil {
+		return nil, err
+	}
+	for {
+		msg, _, from, err := conn.ReadFrom()
+		if err != nil {
+			return nil, fmt.Errorf("no router advertisement received on %q: %s", intf, err)
+		}
+		if _, ok := msg.(*ndp.RouterAdvertisement); ok && from.IsLinkLocalUnicast() {
+			return from, nil
+		}
+	}
+}
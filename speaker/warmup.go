@@ -0,0 +1,195 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+)
+
+// warmup ramps up the announcements of this speaker after it starts,
+// so that kube-proxy and the CNI can settle before the node attracts
+// traffic. It is a ladder: nothing is announced until the network gate
+// opens, then BGP advertisements are spread over the warm-up period,
+// and the node only takes part in layer2 elections once the period is
+// over. Layer2 IPs are held back with k8s.WarmupAnnotation on the
+// node, so that the other speakers keep announcing them meanwhile.
+//
+// The annotation holds the time at which the warm-up ends at the
+// latest, after which the other speakers ignore it: a speaker that
+// crashes or is removed while warming up must not keep its node out
+// of layer2 elections for good.
+type warmup struct {
+	period time.Duration
+
+	// Protects all the state, which is also used by the resync
+	// ticker.
+	mu sync.Mutex
+	// Ends of the warm-ups of the nodes with k8s.WarmupAnnotation,
+	// which don't take part in layer2 elections until then.
+	warming map[string]time.Time
+	start   time.Time
+	done    bool
+	// Sets the annotation of our node, nil if it isn't set.
+	annotate func(value string) error
+}
+
+// warmupNetworkWait is how long the annotation set by hold covers
+// waiting for the network gate, on top of the warm-up period. begin
+// shortens it once the gate opens.
+const warmupNetworkWait = 5 * time.Minute
+
+// newWarmup returns a warmup of period, which is over from the start
+// if period is zero.
+func newWarmup(period time.Duration) *warmup {
+	return &warmup{
+		period:  period,
+		warming: map[string]time.Time{},
+		done:    period <= 0,
+	}
+}
+
+// hold annotates our node with annotate at now, to keep the other
+// speakers announcing layer2 IPs until the warm-up is over. If that
+// fails, e.g. because the speaker may not update nodes, layer2 IPs
+// aren't held back. Without a warm-up, it clears the annotation that
+// a previous run may have left.
+func (w *warmup) hold(l log.Logger, annotate func(value string) error, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		if err := annotate(""); err != nil {
+			l.Log("op", "warmup", "error", err, "msg", "failed to remove a stale warm-up annotation of the node, other speakers ignore it once it expires")
+		}
+		return
+	}
+	if err := annotate(warmupDeadline(now.Add(w.period + warmupNetworkWait))); err != nil {
+		l.Log("op", "warmup", "error", err, "msg", "failed to annotate node, layer2 IPs may move to this node before the warm-up is over")
+		return
+	}
+	w.annotate = annotate
+}
+
+// warmupDeadline returns the value of k8s.WarmupAnnotation for a
+// warm-up ending at end.
+func warmupDeadline(end time.Time) string {
+	return end.UTC().Format(time.RFC3339)
+}
+
+// begin starts the warm-up period at now, once the node's network is
+// ready. Later calls do nothing.
+func (w *warmup) begin(l log.Logger, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done || !w.start.IsZero() {
+		return
+	}
+	w.start = now
+	l.Log("event", "warmupStarted", "period", w.period, "msg", "node network is ready, ramping up announcements")
+	if w.annotate != nil {
+		if err := w.annotate(warmupDeadline(now.Add(w.period))); err != nil {
+			l.Log("op", "warmup", "error", err, "msg", "failed to update the end of the warm-up in the node annotation")
+		}
+	}
+}
+
+// admits returns true if the warm-up lets this node advertise name
+// over BGP at now. Services are admitted in an order given by the
+// hash of their name, evenly over the period.
+func (w *warmup) admits(name string, now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.done:
+		return true
+	case w.start.IsZero():
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	share := float64(h.Sum32()) / math.MaxUint32
+	return float64(now.Sub(w.start)) >= share*float64(w.period)
+}
+
+// update ends the warm-up once the period is over, and forgets the
+// warm-ups of other nodes that ended. It returns true while it ramps
+// up or when a warm-up just ended, meaning all services need
+// reprocessing.
+func (w *warmup) update(l log.Logger, now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	changed := false
+	for name, end := range w.warming {
+		if !now.Before(end) {
+			delete(w.warming, name)
+			changed = true
+			l.Log("event", "nodeWarmupExpired", "node", name, "msg", "warm-up of node is over, reevaluating layer2 elections")
+		}
+	}
+	if w.done || w.start.IsZero() {
+		return changed
+	}
+	if now.Sub(w.start) < w.period {
+		return true
+	}
+	if w.annotate != nil {
+		if err := w.annotate(""); err != nil {
+			l.Log("op", "warmup", "error", err, "msg", "failed to remove the warm-up annotation of the node, will retry")
+			return changed
+		}
+		w.annotate = nil
+	}
+	w.done = true
+	l.Log("event", "warmupDone", "msg", "warm-up over, announcing everything")
+	return true
+}
+
+// setNode tracks the warm-up annotation of the node name at now, nil
+// if it was deleted, and returns true if that changed whether the
+// node is warming up. Annotations that expired, or hold no deadline,
+// are ignored.
+func (w *warmup) setNode(name string, node *v1.Node, now time.Time) bool {
+	var end time.Time
+	if node != nil {
+		end, _ = time.Parse(time.RFC3339, node.Annotations[k8s.WarmupAnnotation])
+	}
+	warming := now.Before(end)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, was := w.warming[name]
+	if warming {
+		w.warming[name] = end
+	} else {
+		delete(w.warming, name)
+	}
+	return warming != was
+}
+
+// isWarming returns true if the node name is warming up.
+func (w *warmup) isWarming(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.warming[name]
+	return ok
+}
+
+// available returns the endpoints of eps that are on nodes that
+// aren't warming up, and false if none of them is ready, in which
+// case nodes warming up take part in layer2 elections after all.
+func (w *warmup) available(eps *v1.Endpoints) (*v1.Endpoints, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.warming) == 0 {
+		return eps, true
+	}
+	ret := filterEndpoints(eps, func(node string) bool {
+		_, ok := w.warming[node]
+		return !ok
+	})
+	return ret, healthyEndpointExists(ret)
+}
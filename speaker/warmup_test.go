@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"go.universe.tf/metallb/internal/k8s"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWarmup(t *testing.T) {
+	l := log.NewNopLogger()
+	if w := newWarmup(0); !w.admits("test/foo", time.Time{}) || w.update(l, time.Time{}) {
+		t.Error("warm-up of 0 holds announcements")
+	}
+
+	w := newWarmup(100 * time.Second)
+	var annotations []string
+	annotate := func(value string) error {
+		annotations = append(annotations, value)
+		return nil
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.hold(l, annotate, start.Add(-time.Minute))
+	var names []string
+	for i := 0; i < 100; i++ {
+		names = append(names, fmt.Sprintf("test/svc-%d", i))
+	}
+	admitted := func(now time.Time) int {
+		n := 0
+		for _, name := range names {
+			if w.admits(name, now) {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := admitted(start); n != 0 {
+		t.Errorf("%d services admitted before the network is ready", n)
+	}
+	if w.update(l, start) {
+		t.Error("warm-up ramping before it began")
+	}
+	w.begin(l, start)
+	w.begin(l, start.Add(time.Hour))
+	if n := admitted(start.Add(50 * time.Second)); n < 30 || n > 70 {
+		t.Errorf("%d of 100 services admitted halfway through the warm-up", n)
+	}
+	if admitted(start.Add(20*time.Second)) > admitted(start.Add(40*time.Second)) {
+		t.Error("services withdrawn during the warm-up")
+	}
+	if !w.update(l, start.Add(50*time.Second)) {
+		t.Error("warm-up not ramping halfway through")
+	}
+	if !w.update(l, start.Add(100*time.Second)) {
+		t.Error("end of warm-up didn't reprocess services")
+	}
+	if w.update(l, start.Add(110*time.Second)) {
+		t.Error("warm-up still ramping after it ended")
+	}
+	if n := admitted(start.Add(100 * time.Second)); n != 100 {
+		t.Errorf("%d of 100 services admitted after the warm-up", n)
+	}
+	// The deadline covers waiting for the network, then is cut down
+	// to the period once the warm-up begins.
+	want := []string{"2020-01-01T00:05:40Z", "2020-01-01T00:01:40Z", ""}
+	if diff := cmp.Diff(want, annotations); diff != "" {
+		t.Errorf("node annotations (-want +got)\n%s", diff)
+	}
+
+	// Without a warm-up, a stale annotation of a previous run is
+	// removed.
+	annotations = nil
+	newWarmup(0).hold(l, annotate, start)
+	if diff := cmp.Diff([]string{""}, annotations); diff != "" {
+		t.Errorf("node annotations without warm-up (-want +got)\n%s", diff)
+	}
+}
+
+func TestWarmupLayer2(t *testing.T) {
+	l := log.NewNopLogger()
+	w := newWarmup(0)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	node := func(name, value string) *v1.Node {
+		ret := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if value != "" {
+			ret.Annotations = map[string]string{k8s.WarmupAnnotation: value}
+		}
+		return ret
+	}
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.5", NodeName: strptr("iris")},
+					{IP: "2.3.4.6", NodeName: strptr("pandora")},
+				},
+			},
+		},
+	}
+
+	if w.setNode("iris", node("iris", ""), now) {
+		t.Error("node without the annotation changed the warm-up")
+	}
+	if w.setNode("iris", node("iris", "true"), now) {
+		t.Error("annotation without a deadline changed the warm-up")
+	}
+	if w.setNode("iris", node("iris", "2019-12-31T23:59:00Z"), now) {
+		t.Error("expired annotation changed the warm-up")
+	}
+	if !w.setNode("iris", node("iris", "2020-01-01T00:01:00Z"), now) {
+		t.Fatal("annotating iris didn't change the warm-up")
+	}
+	want := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "2.3.4.6", NodeName: strptr("pandora")},
+				},
+			},
+		},
+	}
+	got, ok := w.available(eps)
+	if !ok {
+		t.Fatal("no endpoints available outside warming nodes")
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("endpoints outside warming nodes (-want +got)\n%s", diff)
+	}
+
+	// With all nodes warming up, they take part in elections anyway.
+	w.setNode("pandora", node("pandora", "2020-01-01T00:02:00Z"), now)
+	if _, ok := w.available(eps); ok {
+		t.Error("endpoints available with all nodes warming up")
+	}
+
+	// The warm-up of iris ends even though its annotation stays, e.g.
+	// because its speaker crashed.
+	if w.update(l, now.Add(30*time.Second)) {
+		t.Error("warm-ups changed before they ended")
+	}
+	if !w.update(l, now.Add(time.Minute)) {
+		t.Error("end of the warm-up of iris didn't reprocess services")
+	}
+	if w.isWarming("iris") || !w.isWarming("pandora") {
+		t.Error("wrong nodes warming up after the warm-up of iris ended")
+	}
+	if !w.setNode("pandora", nil, now.Add(time.Minute)) {
+		t.Error("removing the annotation didn't change the warm-up")
+	}
+}
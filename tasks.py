@@ -20,6 +20,8 @@ from invoke.exceptions import Exit
 all_binaries = set(["controller",
                     "speaker",
                     "mirror-server"])
+# Version of Cilium installed by dev-env --cni=cilium.
+cilium_version = "1.9.5"
 all_architectures = set(["amd64",
                          "arm",
                          "arm64",
@@ -157,6 +159,7 @@ def push_multiarch(ctx, binaries, tag="dev", docker_user="metallb"):
 @task(help={
     "architecture": "CPU architecture of the local machine. Default 'amd64'.",
     "name": "name of the kind cluster to use.",
+    "cni": "CNI to install in a new cluster instead of kind's, one of e2etest/manifests, or 'cilium' for Cilium replacing kube-proxy.",
 })
 def dev_env(ctx, architecture="amd64", name="kind", cni=None):
     """Build and run MetalLB in a local Kind cluster.
@@ -165,6 +168,10 @@ def dev_env(ctx, architecture="amd64", name="kind", cni=None):
     it is created. Then, build MetalLB docker images from the
     checkout, push them into kind, and deploy manifests/metallb.yaml
     to run those images.
+
+    With --cni=cilium, the cluster runs without kube-proxy, and Cilium
+    is installed with helm to replace it. TestCiliumKind in e2etest
+    runs against such a cluster.
     """
     clusters = run("kind get clusters", hide=True).stdout.strip().splitlines()
     mk_cluster = name not in clusters
@@ -181,6 +188,10 @@ def dev_env(ctx, architecture="amd64", name="kind", cni=None):
             config["networking"] = {
                 "disableDefaultCNI": True,
             }
+        if cni == "cilium":
+            # Disabling kube-proxy needs a newer config version.
+            config["apiVersion"] = "kind.x-k8s.io/v1alpha4"
+            config["networking"]["kubeProxyMode"] = "none"
         config = yaml.dump(config).encode("utf-8")
         with tempfile.NamedTemporaryFile() as tmp:
             tmp.write(config)
@@ -189,7 +200,14 @@ def dev_env(ctx, architecture="amd64", name="kind", cni=None):
 
     config = run("kind get kubeconfig-path --name={}".format(name), hide=True).stdout.strip()
     env = {"KUBECONFIG": config}
-    if mk_cluster and cni:
+    if mk_cluster and cni == "cilium":
+        # Without kube-proxy, Cilium reaches the API server directly.
+        run("helm repo add cilium https://helm.cilium.io/", echo=True)
+        run("helm install cilium cilium/cilium --version {version} --namespace kube-system "
+            "--set kubeProxyReplacement=strict --set k8sServiceHost={name}-control-plane --set k8sServicePort=6443".format(
+                version=cilium_version, name=name),
+            echo=True, env=env)
+    elif mk_cluster and cni:
         run("kubectl apply -f e2etest/manifests/{}.yaml".format(cni), echo=True, env=env)
 
     build(ctx, binaries=["controller", "speaker", "mirror-server"], architectures=[architecture])